@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"contun/internal/hub"
+	"contun/internal/pool"
+)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.SetPrefix("[hub] ")
+
+	opts, err := hub.ParseArgs(os.Args[1:])
+	if errors.Is(err, hub.ErrShowUsage) {
+		fmt.Fprintln(os.Stderr, hub.Usage())
+		os.Exit(0)
+	}
+	if errors.Is(err, hub.ErrShowVersion) {
+		fmt.Printf("hubgo %s (protocol %d)\n", pool.BuildVersion(), pool.ProtocolVersion)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		fmt.Fprintln(os.Stderr, hub.Usage())
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	server := hub.NewServer(*opts)
+	handleOperatorSignals(ctx, server)
+	if err := server.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("fatal: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"contun/internal/hub"
+)
+
+// handleOperatorSignals maps SIGUSR1 to a fleet report and SIGUSR2 to a
+// signed SHUTDOWN broadcast, as in hub.pl.
+func handleOperatorSignals(ctx context.Context, server *hub.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				if sig == syscall.SIGUSR1 {
+					server.ReportFleet()
+				} else {
+					server.BroadcastShutdown()
+				}
+			}
+		}
+	}()
+}
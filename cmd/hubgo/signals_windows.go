@@ -0,0 +1,11 @@
+package main
+
+import (
+	"context"
+
+	"contun/internal/hub"
+)
+
+// handleOperatorSignals does nothing on Windows, which has no SIGUSR1 or
+// SIGUSR2.
+func handleOperatorSignals(context.Context, *hub.Server) {}
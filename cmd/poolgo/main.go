@@ -8,30 +8,193 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"contun/internal/pool"
+	"contun/internal/secure"
+	embed "contun/pkg/pool"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
 	log.SetPrefix("[pool] ")
 
-	opts, err := pool.ParseArgs(os.Args[1:])
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		runCleanup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "genconfig" {
+		runGenconfig(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+
+	p, err := embed.New(embed.Config{Args: os.Args[1:]})
 	if errors.Is(err, pool.ErrShowUsage) {
 		fmt.Fprintln(os.Stderr, pool.Usage())
 		os.Exit(0)
 	}
+	if errors.Is(err, pool.ErrShowVersion) {
+		fmt.Printf("poolgo %s (protocol %d)\n", pool.BuildVersion(), pool.ProtocolVersion)
+		os.Exit(0)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
 		fmt.Fprintln(os.Stderr, pool.Usage())
 		os.Exit(2)
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	supervisor := pool.NewSupervisor(*opts)
-	if err := supervisor.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+	go drainOnSignal(p, cancel)
+	go reloadOnSignal(p, os.Args[1:])
+	err = p.Run(ctx)
+	if errors.Is(err, embed.ErrExpired) || errors.Is(err, embed.ErrRemoteShutdown) {
+		return
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatalf("fatal: %v", err)
 	}
 }
+
+// drainOnSignal drains the pool on the first SIGINT or SIGTERM and stops it
+// outright when the drain timeout passes or a second signal arrives.
+func drainOnSignal(p *embed.Pool, cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	if timeout := p.DrainTimeout(); timeout > 0 {
+		p.Drain()
+		select {
+		case <-signals:
+			log.Printf("Second signal received; closing active sessions")
+		case <-time.After(timeout):
+			log.Printf("Drain timeout of %s reached; closing active sessions", timeout)
+		}
+	}
+	cancel()
+}
+
+// reloadOnSignal parses the command line again, re-reading --config and the
+// files it names, and applies the result on every SIGHUP. Invalid options
+// are reported and the running configuration is kept.
+func reloadOnSignal(p *embed.Pool, args []string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("SIGHUP received; reloading configuration")
+		if err := p.Reload(args); err != nil {
+			log.Printf("Reload failed, keeping the running configuration: %v", err)
+		}
+	}
+}
+
+func runCleanup(args []string) {
+	log.SetPrefix("[cleanup] ")
+
+	opts, err := pool.ParseCleanupArgs(args)
+	if errors.Is(err, pool.ErrShowUsage) {
+		fmt.Fprintln(os.Stderr, pool.CleanupUsage())
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		fmt.Fprintln(os.Stderr, pool.CleanupUsage())
+		os.Exit(2)
+	}
+	if err := pool.Cleanup(*opts, log.Default()); err != nil {
+		log.Fatalf("cleanup incomplete: %v", err)
+	}
+}
+
+func runGenconfig(args []string) {
+	log.SetPrefix("[genconfig] ")
+
+	opts, err := pool.ParseGenconfigArgs(args)
+	if errors.Is(err, pool.ErrShowUsage) {
+		fmt.Fprintln(os.Stderr, pool.GenconfigUsage())
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		fmt.Fprintln(os.Stderr, pool.GenconfigUsage())
+		os.Exit(2)
+	}
+	if err := pool.Genconfig(*opts, log.Default()); err != nil {
+		log.Fatalf("genconfig: %v", err)
+	}
+}
+
+func runBench(args []string) {
+	log.SetFlags(0)
+	log.SetPrefix("poolgo bench: ")
+
+	opts, err := pool.ParseBenchArgs(args)
+	if errors.Is(err, pool.ErrShowUsage) {
+		fmt.Fprintln(os.Stderr, pool.BenchUsage())
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		fmt.Fprintln(os.Stderr, pool.BenchUsage())
+		os.Exit(2)
+	}
+	if err := pool.Bench(*opts, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runCtl(args []string) {
+	log.SetFlags(0)
+	log.SetPrefix("poolgo ctl: ")
+
+	opts, err := pool.ParseCtlArgs(args)
+	if errors.Is(err, pool.ErrShowUsage) {
+		fmt.Fprintln(os.Stderr, pool.CtlUsage())
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n\n", err)
+		fmt.Fprintln(os.Stderr, pool.CtlUsage())
+		os.Exit(2)
+	}
+	if err := pool.Ctl(*opts, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runKeygen writes a new Noise private key to the named file and prints the
+// matching public key for the other end of the link.
+func runKeygen(args []string) {
+	if len(args) != 1 || args[0] == "-h" || args[0] == "--help" {
+		fmt.Fprintln(os.Stderr, "Usage: poolgo keygen <private-key-file>")
+		os.Exit(2)
+	}
+	key, err := secure.GenerateKey()
+	if err != nil {
+		log.Fatalf("generate key: %v", err)
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatalf("create key file: %v", err)
+	}
+	if _, err := fmt.Fprintln(f, secure.EncodePrivateKey(key)); err != nil {
+		log.Fatalf("write key file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("write key file: %v", err)
+	}
+	fmt.Println(secure.EncodePublicKey(key.PublicKey()))
+}
@@ -7,6 +7,7 @@ use Getopt::Long qw(GetOptions);
 use Errno qw(EWOULDBLOCK EAGAIN EINTR);
 use IO::Handle;
 use Socket qw(AF_INET AF_INET6 inet_ntop inet_pton);
+use Digest::SHA qw(hmac_sha256_hex);
 
 use constant MAX_BUFFER => 1024 * 1024; # 1 MiB per-direction safety limit
 
@@ -20,6 +21,8 @@ my %opts = (
     'pool-bind'   => '0.0.0.0',
     'pool-port'   => undef,
     'mode'        => 'auto',
+    'shutdown-key' => undef,
+    'auth-token-file' => undef,
 );
 
 my $help;
@@ -29,6 +32,8 @@ GetOptions(
     'pool-bind|P=s'   => \$opts{'pool-bind'},
     'pool-port|p=i'   => \$opts{'pool-port'},
     'mode|m=s'        => \$opts{'mode'},
+    'shutdown-key=s'  => \$opts{'shutdown-key'},
+    'auth-token-file=s' => \$opts{'auth-token-file'},
     'help|h'          => \$help,
 ) or die usage();
 
@@ -45,6 +50,26 @@ $configured_mode =~ /^(auto|direct|socks)$/
     or die usage("--mode must be one of auto, direct, socks\n");
 my $active_mode = $configured_mode eq 'auto' ? undef : $configured_mode;
 
+my $shutdown_key;
+if (defined $opts{'shutdown-key'}) {
+    $shutdown_key = read_secret($opts{'shutdown-key'});
+}
+my $auth_token;
+if (defined $opts{'auth-token-file'}) {
+    $auth_token = read_secret($opts{'auth-token-file'});
+    $auth_token =~ /^\S+$/ or die "--auth-token-file must contain a single token without whitespace\n";
+}
+my $session_seq = 0;
+# Worker capabilities this hub understands and acknowledges in its OK line.
+my @hub_caps = qw(cancel progress);
+# identity: the worker names itself in an IDENTITY line and only accepts a
+# SHUTDOWN naming it, so it is only worth offering with a shutdown key.
+push @hub_caps, 'identity' if defined $shutdown_key;
+my $shutdown_pending = 0;
+$SIG{USR2} = sub { $shutdown_pending = 1; };
+my $fleet_report_pending = 0;
+$SIG{USR1} = sub { $fleet_report_pending = 1; };
+
 my $client_listener = create_listener($opts{'client-bind'}, $opts{'client-port'});
 my $pool_listener   = create_listener($opts{'pool-bind'},   $opts{'pool-port'});
 
@@ -52,6 +77,7 @@ my $read_set  = IO::Select->new($client_listener, $pool_listener);
 my $write_set = IO::Select->new();
 
 my %ctx;
+my $last_drift_report = '';
 my @available_workers;
 my @pending_clients;
 my @await_mode_clients;
@@ -62,6 +88,14 @@ info("Configured mode: $configured_mode");
 info("Active mode pinned to $active_mode") if defined $active_mode;
 
 while (1) {
+    if ($shutdown_pending) {
+        $shutdown_pending = 0;
+        broadcast_shutdown();
+    }
+    if ($fleet_report_pending) {
+        $fleet_report_pending = 0;
+        report_fleet();
+    }
     my ($read_ready, $write_ready) = IO::Select::select($read_set, $write_set, undef);
     next unless $read_ready || $write_ready;
 
@@ -95,8 +129,17 @@ Optional:
   -C, --client-bind <addr>   Address to bind for the downstream client listener (default 127.0.0.1).
   -P, --pool-bind <addr>     Address to bind for incoming pool workers (default 0.0.0.0).
   -m, --mode <mode>          Operation mode: auto, direct, or socks (default auto).
+      --auth-token-file <file>
+                             Require pool workers to authenticate with this token.
+                             Workers answer a CHALLENGE with an HMAC of the nonce
+                             (or send the token itself in AUTH token mode).
+      --shutdown-key <file>  Shared secret used to sign SHUTDOWN messages; send SIGUSR2
+                             to the hub to decommission every idle pool worker.
   -h, --help                 Show this help and exit.
 
+Send SIGUSR1 to log the version, protocol, feature and configuration
+distribution reported by registered workers in their STATS lines.
+
 hub.pl exposes two sockets: one facing clients on the jump box, and one facing
 pool workers from the bastion. Once a client connects on --client-port the hub
 will pair it with the next available worker connection arriving on --pool-port
@@ -116,6 +159,38 @@ sub info {
     print STDERR "[hub] $msg\n";
 }
 
+sub read_secret {
+    my ($path) = @_;
+    open my $fh, '<', $path or die "Failed to read $path: $!\n";
+    local $/;
+    my $secret = <$fh>;
+    close $fh;
+    $secret = '' unless defined $secret;
+    $secret =~ s/^\s+|\s+$//g;
+    length $secret or die "$path is empty\n";
+    return $secret;
+}
+
+sub broadcast_shutdown {
+    unless (defined $shutdown_key) {
+        info('SIGUSR2 received but no --shutdown-key configured; ignoring');
+        return;
+    }
+    my $count = 0;
+    for my $sock (@available_workers) {
+        next unless $sock && exists $ctx{$sock};
+        next unless ($ctx{$sock}->{state} // '') eq 'idle';
+        my $identity = $ctx{$sock}->{identity};
+        next if $ctx{$sock}->{caps}{identity} && !defined $identity;
+        my $payload = sprintf 'SHUTDOWN %d %08x%08x', time, int(rand(0xFFFFFFFF)), int(rand(0xFFFFFFFF));
+        $payload .= " $identity" if defined $identity;
+        my $mac = hmac_sha256_hex($payload, $shutdown_key);
+        send_control($sock, "$payload $mac\n");
+        $count++;
+    }
+    info("Sent SHUTDOWN to $count idle worker(s)");
+}
+
 sub commit_active_mode {
     my ($mode) = @_;
     return if defined $active_mode;
@@ -258,11 +333,18 @@ sub handle_worker_data {
         my $line = $1;
         $line =~ s/\r?\n$//;
         my $state = $entry->{state};
-        if ($state eq 'await_hello') {
+        if (($state eq 'idle' || $state eq 'await_reply' || $state eq 'cancelling' || $state eq 'draining')
+            && handle_worker_info($sock, $line)) {
+            # Informational lines never change the worker state.
+        } elsif ($state eq 'await_hello') {
             process_worker_hello($sock, $line);
+        } elsif ($state eq 'await_auth') {
+            process_worker_auth($sock, $line);
         } elsif ($state eq 'await_reply') {
             process_worker_reply($sock, $line);
-        } elsif ($state eq 'idle') {
+        } elsif ($state eq 'cancelling') {
+            process_worker_cancelled($sock, $line);
+        } elsif ($state eq 'idle' || $state eq 'draining') {
             # Ignore keepalives or noise.
         } else {
             close_socket($sock, "unexpected line in state $state");
@@ -297,6 +379,13 @@ sub process_worker_hello {
         return;
     }
 
+    my %caps;
+    if ($parts[-2] eq 'CAPS' && @parts == ($mode eq 'direct' ? 9 : 5)) {
+        %caps = map { lc($_) => 1 } split /,/, $parts[-1];
+        splice @parts, -2;
+    }
+    $entry->{caps} = \%caps;
+
     my $dest;
     if ($mode eq 'direct') {
         unless (@parts == 7 && $parts[3] eq 'DEST') {
@@ -324,6 +413,48 @@ sub process_worker_hello {
         return;
     }
 
+    $entry->{mode} = $mode;
+    $entry->{dest} = $dest if $dest;
+
+    if (defined $auth_token) {
+        my $nonce = random_hex(16);
+        $entry->{state} = 'await_auth';
+        $entry->{nonce} = $nonce;
+        send_control($sock, "CHALLENGE $nonce\n");
+        return;
+    }
+    register_worker($sock);
+}
+
+sub process_worker_auth {
+    my ($sock, $line) = @_;
+    my $entry = $ctx{$sock} or return;
+    my $ok = 0;
+    if ($line =~ /^AUTH\s+HMAC\s+([0-9a-fA-F]{64})$/) {
+        my $expected = hmac_sha256_hex($entry->{nonce}, $auth_token);
+        $ok = constant_time_eq(lc $1, $expected);
+    } elsif ($line =~ /^AUTH\s+(\S+)$/) {
+        $ok = constant_time_eq($1, $auth_token);
+    } else {
+        close_socket($sock, "expected AUTH, got '$line'");
+        return;
+    }
+    delete $entry->{nonce};
+    unless ($ok) {
+        info(sprintf 'Rejecting worker fd=%d: authentication failed', fileno($sock));
+        eval { syswrite($sock, "ERR auth failed\n") };
+        close_socket($sock, 'authentication failed');
+        return;
+    }
+    register_worker($sock);
+}
+
+sub register_worker {
+    my ($sock) = @_;
+    my $entry = $ctx{$sock} or return;
+    my $mode  = $entry->{mode};
+    my $dest  = $entry->{dest};
+
     if (defined $active_mode) {
         if ($active_mode ne $mode) {
             info(sprintf 'Rejecting worker fd=%d with mode %s (hub mode %s)',
@@ -340,10 +471,9 @@ sub process_worker_hello {
     }
 
     $entry->{state} = 'idle';
-    $entry->{mode}  = $mode;
-    $entry->{dest}  = $dest if $dest;
     $entry->{buffer} = '';
-    send_control($sock, "OK\n");
+    my @acked = grep { $entry->{caps}{$_} } @hub_caps;
+    send_control($sock, @acked ? 'OK CAPS ' . join(',', @acked) . "\n" : "OK\n");
     if ($mode eq 'direct') {
         info(sprintf 'Worker fd=%d registered direct target %s',
             fileno($sock), format_dest($dest));
@@ -353,6 +483,103 @@ sub process_worker_hello {
     add_available_worker($sock);
 }
 
+sub random_hex {
+    my ($len) = @_;
+    my $raw = '';
+    if (open my $fh, '<:raw', '/dev/urandom') {
+        read $fh, $raw, $len;
+        close $fh;
+    }
+    $raw = join '', map { chr int rand 256 } 1..$len unless length $raw == $len;
+    return unpack 'H*', $raw;
+}
+
+sub constant_time_eq {
+    my ($a, $b) = @_;
+    return 0 unless length $a == length $b;
+    my $diff = 0;
+    $diff |= ord(substr $a, $_, 1) ^ ord(substr $b, $_, 1) for 0 .. length($a) - 1;
+    return $diff == 0;
+}
+
+sub handle_worker_info {
+    my ($sock, $line) = @_;
+    if ($line =~ /^NOTICE\s+(.*)$/) {
+        info(sprintf 'Worker fd=%d notice: %s', fileno($sock), $1);
+        return 1;
+    }
+    if ($line =~ /^PROGRESS\s+(.*)$/) {
+        my $entry = $ctx{$sock};
+        my $client = $entry && $entry->{client};
+        if ($client && $ctx{$client}) {
+            $ctx{$client}{progress} = $1;
+            info(sprintf 'Client fd=%d waiting on worker fd=%d: %s', fileno($client), fileno($sock), $1);
+        }
+        return 1;
+    }
+    if ($line =~ /^IDENTITY\s+(\S+)$/) {
+        $ctx{$sock}{identity} = $1 if $ctx{$sock};
+        return 1;
+    }
+    if ($line =~ /^GOODBYE\b/) {
+        # The worker is shutting down; stop handing it requests. One that
+        # is already dialling finishes or hangs up on its own.
+        info(sprintf 'Worker fd=%d is draining', fileno($sock));
+        my $entry = $ctx{$sock};
+        if ($entry && ($entry->{state} // '') eq 'idle') {
+            $entry->{state} = 'draining';
+            remove_available_worker($sock);
+        }
+        return 1;
+    }
+    if ($line =~ /^STATS(?:\s+(.*))?$/) {
+        my %stats = map { /^([^=]+)=(.*)$/ ? ($1 => $2) : () } split /\s+/, ($1 // '');
+        record_worker_stats($sock, \%stats);
+        return 1;
+    }
+    return 0;
+}
+
+sub record_worker_stats {
+    my ($sock, $stats) = @_;
+    my $entry = $ctx{$sock} or return;
+    $entry->{stats} = $stats;
+    my $config = $stats->{config};
+    return unless defined $config;
+    if (!defined $entry->{config} || $entry->{config} ne $config) {
+        $entry->{config} = $config;
+        check_config_drift();
+    }
+}
+
+sub report_fleet {
+    my @workers = grep { $_->{type} && $_->{type} eq 'worker' && ($_->{state} // '') ne 'await_hello' } values %ctx;
+    info(sprintf 'Fleet: %d registered worker(s)', scalar @workers);
+    for my $key (qw(version proto features config)) {
+        my %dist;
+        $dist{ ($_->{stats} && defined $_->{stats}{$key}) ? $_->{stats}{$key} : 'unknown' }++ for @workers;
+        my $line = join ', ', map { "$_ x$dist{$_}" } sort { $dist{$b} <=> $dist{$a} || $a cmp $b } keys %dist;
+        info(sprintf 'Fleet %-9s %s', "$key:", length $line ? $line : 'none');
+    }
+}
+
+sub check_config_drift {
+    my %configs;
+    for my $entry (values %ctx) {
+        next unless $entry->{type} && $entry->{type} eq 'worker';
+        next unless defined $entry->{config};
+        $configs{ $entry->{config} }++;
+    }
+    my $report = join ', ', map { "$_ x$configs{$_}" } sort keys %configs;
+    return if $report eq $last_drift_report;
+    $last_drift_report = $report;
+    if (keys %configs > 1) {
+        info("Config drift: workers report " . scalar(keys %configs) . " distinct configurations ($report)");
+    } else {
+        info("Worker configuration consistent ($report)");
+    }
+}
+
 sub process_worker_reply {
     my ($sock, $line) = @_;
     my $entry = $ctx{$sock} or return;
@@ -598,6 +825,10 @@ sub close_socket {
         defined($fd) ? $fd : -1,
         $reason // 'unknown'
     );
+    if (($entry->{state} // '') eq 'stream' && $entry->{peer} && exists $ctx{$entry->{peer}}) {
+        info(sprintf 'Session %d ended: %s (%s)',
+            $entry->{session_id} // 0, teardown_reason($entry, $reason), $reason // 'unknown');
+    }
 
     if ($entry->{type} && $entry->{type} eq 'worker') {
         remove_available_worker($sock);
@@ -613,10 +844,20 @@ sub close_socket {
             if (exists $ctx{$worker}) {
                 close_socket($worker, 'client disconnected');
             }
+        } elsif (my $pending = $entry->{worker}) {
+            cancel_worker_request($pending);
         }
     }
 }
 
+# Maps the close reason of the first socket of a streaming pair to the
+# teardown codes poolgo records in its audit log.
+sub teardown_reason {
+    my ($entry, $reason) = @_;
+    return 'error' unless ($reason // '') eq 'peer closed';
+    return $entry->{type} eq 'client' ? 'client-closed' : 'target-closed';
+}
+
 sub add_available_worker {
     my ($worker) = @_;
     push @available_workers, $worker;
@@ -684,6 +925,7 @@ sub assign_worker {
     unless ($worker_entry && $client_entry) {
         return;
     }
+    $client_entry->{session_id} = ++$session_seq;
     my $request = build_request_command($worker_entry, $client_entry);
     unless (defined $request) {
         close_socket($client, 'unable to build request for worker');
@@ -695,6 +937,7 @@ sub assign_worker {
     }
     $worker_entry->{state}  = 'await_reply';
     $worker_entry->{client} = $client;
+    $worker_entry->{session_id} = $client_entry->{session_id};
     $client_entry->{state}  = 'await_reply';
     $client_entry->{worker} = $worker;
     send_control($worker, "$request\n");
@@ -705,6 +948,38 @@ sub assign_worker {
     info("Requesting CONNECT to $dest_str");
 }
 
+# A client gave up while its worker is still dialling. Workers that
+# advertised the cancel capability abort the dial and return to the pool;
+# others are left to finish and are closed once they reply.
+sub cancel_worker_request {
+    my ($worker) = @_;
+    my $entry = $ctx{$worker} or return;
+    return unless ($entry->{state} // '') eq 'await_reply' && $entry->{caps}{cancel};
+    my $id = $entry->{session_id};
+    $entry->{state}  = 'cancelling';
+    $entry->{client} = undef;
+    send_control($worker, "CANCEL $id\n");
+    info(sprintf 'Cancelling session %d on worker fd=%d', $id, fileno($worker));
+}
+
+sub process_worker_cancelled {
+    my ($sock, $line) = @_;
+    my $entry = $ctx{$sock} or return;
+    my @parts = split /\s+/, $line;
+    unless (@parts >= 2 && ($parts[0] eq 'REPLY' || $parts[0] eq 'ERR')) {
+        close_socket($sock, "unexpected worker response '$line'");
+        return;
+    }
+    if ($parts[0] eq 'REPLY' && $parts[1] eq '0') {
+        # The dial won the race against CANCEL; nobody is left to stream to.
+        close_socket($sock, 'stream opened after cancel');
+        return;
+    }
+    info(sprintf 'Worker fd=%d cancelled session %d', fileno($sock), $entry->{session_id});
+    $entry->{state} = 'idle';
+    add_available_worker($sock);
+}
+
 sub send_control {
     my ($sock, $payload) = @_;
     my $entry = $ctx{$sock} or return;
@@ -732,7 +1007,9 @@ sub build_request_command {
     my $atype = $dest->{atype};
     my $host  = $dest->{host};
     my $port  = $dest->{port};
-    return sprintf 'REQUEST CONNECT %s %s %d', $atype, $host, $port;
+    my $request = sprintf 'REQUEST CONNECT %s %s %d', $atype, $host, $port;
+    $request .= " $client_entry->{session_id}" if $worker_entry->{caps}{cancel};
+    return $request;
 }
 
 sub format_dest {
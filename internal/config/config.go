@@ -0,0 +1,186 @@
+// Package config loads option files for poolgo and hubgo. A file sets
+// command line options by their long names, in YAML or TOML:
+//
+//	hub-host: hub.example.net
+//	hub-port: 443
+//	tls: true
+//	alert-pattern: ["password=", "BEGIN RSA"]
+//
+// Values are applied to a flag.FlagSet as if they had been given on the
+// command line, so they are validated exactly like flags, and options that
+// were given on the command line win over the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Values holds option values from a file by long option name. Options that
+// may be repeated, such as --alert-pattern, can have several.
+type Values map[string][]string
+
+// reserved options make no sense in a file.
+var reserved = map[string]bool{"config": true, "help": true, "version": true}
+
+// Load reads an option file. The format follows the extension: .yaml or
+// .yml for YAML and .toml for TOML.
+func Load(path string) (Values, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]any)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unknown config format %q (use .yaml, .yml or .toml)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(Values, len(raw))
+	for name, v := range raw {
+		list, ok := v.([]any)
+		if !ok {
+			list = []any{v}
+		}
+		for _, item := range list {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values[name] = append(values[name], s)
+		}
+	}
+	return values, nil
+}
+
+// scalar renders one value the way it would be written on the command line.
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case nil:
+		return "", errors.New("missing value")
+	}
+	return "", fmt.Errorf("unsupported value of type %T", v)
+}
+
+// Apply sets each option in values on fs unless it was already given on
+// the command line, which fs must have parsed. Unknown options and
+// single-letter aliases are rejected, so a typo in the file is reported
+// instead of silently ignored.
+func Apply(fs *flag.FlagSet, values Values) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(name) == 1 || reserved[name] || fs.Lookup(name) == nil {
+			if guess := closest(fs, name); guess != "" {
+				return fmt.Errorf("unknown option %q (did you mean %q?)", name, guess)
+			}
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if given[name] {
+			continue
+		}
+		for _, v := range values[name] {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// closest returns the long option on fs that name most likely misspells,
+// within two edits once underscores are read as dashes, or "".
+func closest(fs *flag.FlagSet, name string) string {
+	name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	best, bestDistance := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 || reserved[f.Name] {
+			return
+		}
+		if d := distance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	return best
+}
+
+// distance is the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// FileError reports an option file that could not be read or applied.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string { return fmt.Sprintf("--config %s: %v", e.Path, e.Err) }
+
+func (e *FileError) Unwrap() error { return e.Err }
+
+// ApplyFile loads path and applies it to fs; see Load and Apply. Errors are
+// a *FileError.
+func ApplyFile(fs *flag.FlagSet, path string) error {
+	values, err := Load(path)
+	if err == nil {
+		err = Apply(fs, values)
+	}
+	if err != nil {
+		return &FileError{Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	want := Values{
+		"hub-host":      {"hub.example.net"},
+		"hub-port":      {"443"},
+		"tls":           {"true"},
+		"audit-sample":  {"0.25"},
+		"heartbeat":     {"15s"},
+		"alert-pattern": {"password=", "BEGIN RSA"},
+	}
+	for name, content := range map[string]string{
+		"pool.yaml": `
+hub-host: hub.example.net
+hub-port: 443
+tls: true
+audit-sample: 0.25
+heartbeat: 15s
+alert-pattern: ["password=", "BEGIN RSA"]
+`,
+		"pool.toml": `
+hub-host = "hub.example.net"
+hub-port = 443
+tls = true
+audit-sample = 0.25
+heartbeat = "15s"
+alert-pattern = ["password=", "BEGIN RSA"]
+`,
+	} {
+		values, err := Load(writeFile(t, name, content))
+		if err != nil || !reflect.DeepEqual(values, want) {
+			t.Fatalf("%s: Load = %v, %v", name, values, err)
+		}
+	}
+
+	values, err := Load(writeFile(t, "expiry.toml", "expire-at = 2026-11-01T08:00:00Z\n"))
+	if err != nil || values["expire-at"][0] != "2026-11-01T08:00:00Z" {
+		t.Fatalf("TOML datetime = %v, %v", values, err)
+	}
+	if _, err := Load(writeFile(t, "pool.json", "{}")); err == nil {
+		t.Fatalf("loaded a .json file")
+	}
+	if _, err := Load(writeFile(t, "nested.yaml", "tls:\n  ca: ca.pem\n")); err == nil {
+		t.Fatalf("loaded a nested table")
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	host := fs.String("hub-host", "127.0.0.1", "")
+	port := fs.Int("hub-port", 0, "")
+	wait := fs.Duration("heartbeat", 30*time.Second, "")
+	fs.Int("p", 0, "")
+	if err := fs.Parse([]string{"--hub-port", "5555"}); err != nil {
+		t.Fatal(err)
+	}
+	err := Apply(fs, Values{"hub-host": {"hub.example.net"}, "hub-port": {"443"}, "heartbeat": {"15s"}})
+	if err != nil || *host != "hub.example.net" || *port != 5555 || *wait != 15*time.Second {
+		t.Fatalf("Apply: host=%s port=%d heartbeat=%s (%v)", *host, *port, *wait, err)
+	}
+
+	for _, bad := range []Values{{"hub-hots": {"x"}}, {"p": {"1"}}, {"config": {"other.yaml"}}} {
+		if err := Apply(fs, bad); err == nil || !strings.Contains(err.Error(), "unknown option") {
+			t.Fatalf("Apply(%v) = %v, want unknown option", bad, err)
+		}
+	}
+	fs.Float64("retry-delay", 1, "")
+	for name, want := range map[string]string{"retry_dely": `(did you mean "retry-delay"?)`, "hub-hots": `(did you mean "hub-host"?)`, "workers": `unknown option "workers"`} {
+		if err := Apply(fs, Values{name: {"2"}}); err == nil || !strings.HasSuffix(err.Error(), want) {
+			t.Fatalf("Apply(%s) = %v, want %s", name, err, want)
+		}
+	}
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Duration("heartbeat", 30*time.Second, "")
+	if err := Apply(fs, Values{"heartbeat": {"soon"}}); err == nil {
+		t.Fatalf("accepted an invalid duration")
+	}
+}
@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// adminTimeout bounds one admin socket exchange.
+const adminTimeout = 10 * time.Second
+
+// serveAdmin answers --admin-socket connections on ln until ctx ends. Like
+// poolgo's admin socket, each connection carries one command line and gets
+// the reply back before it is closed, so "poolgo ctl" can query the hub.
+func (s *Server) serveAdmin(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Printf("admin socket: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+			line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			_, _ = io.WriteString(conn, s.adminCommand(strings.TrimSpace(line)))
+		}()
+	}
+}
+
+// adminCommand runs one admin command and returns its reply. Failures are
+// a single line starting "error: ".
+func (s *Server) adminCommand(line string) string {
+	var b strings.Builder
+	switch fields := strings.Fields(line); {
+	case len(fields) == 1 && fields[0] == "usage":
+		s.writeUsage(&b)
+	case len(fields) == 1 && fields[0] == "canary":
+		if s.opts.Canary == nil {
+			return "error: --canary is not set\n"
+		}
+		s.writeCanary(&b)
+	default:
+		return fmt.Sprintf("error: unknown command %q (want usage or canary)\n", line)
+	}
+	return b.String()
+}
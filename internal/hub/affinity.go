@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// Affinity selects what ties a client's sessions to one worker.
+type Affinity string
+
+const (
+	AffinityNone   Affinity = "none"
+	AffinityClient Affinity = "client" // the client's IP address
+	AffinityUser   Affinity = "user"   // the SOCKS5 username from --socks-users
+)
+
+// maxAffinityKeys bounds how many keys the hub remembers; the least
+// recently used one is forgotten to make room.
+const maxAffinityKeys = 4096
+
+// affinityEntry is where the sessions with one affinity key went last.
+type affinityEntry struct {
+	worker *worker // nil once that worker disconnected
+	source string  // the pool host the worker connected from
+	used   time.Time
+}
+
+// affinityKey turns a client address or username into the key sent to
+// workers, so the bastion never sees who the client is.
+func affinityKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:8])
+}
+
+// sessionAffinity returns the affinity key for a client connecting from
+// conn as user, or "" when --affinity is off or has nothing to go on.
+func (s *Server) sessionAffinity(conn net.Conn, user string) string {
+	switch s.opts.Affinity {
+	case AffinityClient:
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			return ""
+		}
+		return affinityKey("client:" + host)
+	case AffinityUser:
+		if user == "" {
+			return ""
+		}
+		return affinityKey("user:" + user)
+	}
+	return ""
+}
+
+// workerSource returns the host a worker connected from.
+func workerSource(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// noteAffinity remembers that the sessions with key went to w. The caller
+// holds s.mu.
+func (s *Server) noteAffinity(key string, w *worker) {
+	if key == "" {
+		return
+	}
+	if _, ok := s.affinity[key]; !ok && len(s.affinity) >= maxAffinityKeys {
+		var oldest string
+		for k, e := range s.affinity {
+			if oldest == "" || e.used.Before(s.affinity[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(s.affinity, oldest)
+	}
+	s.affinity[key] = &affinityEntry{worker: w, source: w.source, used: time.Now()}
+}
+
+// forgetWorker keeps the pool host of the affinity entries that pointed at
+// a worker that went away, so their sessions still prefer that host. The
+// caller holds s.mu.
+func (s *Server) forgetWorker(w *worker) {
+	for _, e := range s.affinity {
+		if e.worker == w {
+			e.worker = nil
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"contun/internal/config"
+	"contun/internal/pool"
+)
+
+var (
+	// ErrShowUsage indicates the caller requested help explicitly.
+	ErrShowUsage = errors.New("show usage")
+
+	// ErrShowVersion indicates the caller requested the build version.
+	ErrShowVersion = errors.New("show version")
+
+	usageText = `Usage: hubgo [options]
+
+Required:
+  -c, --client-port <port>   Local jump-box port exposed to downstream clients.
+  -p, --pool-port <port>     Listener port that accepts pool workers from the bastion.
+
+Optional:
+      --config <file>        Read options from a YAML or TOML file; options given here win.
+  -C, --client-bind <addr>   Address to bind for the downstream client listener (default 127.0.0.1).
+  -P, --pool-bind <addr>     Address to bind for incoming pool workers (default 0.0.0.0).
+  -m, --mode <mode>          Operation mode: auto, direct, or socks (default auto).
+      --auth-token-file <f>  Require pool workers to authenticate with this token.
+      --shutdown-key <file>  Shared secret used to sign SHUTDOWN messages; send SIGUSR2
+                             to the hub to decommission every idle pool worker.
+      --noise-key <file>     Hub Noise private key (hex); workers must encrypt the link with Noise_IK.
+      --noise-allow <file>   Worker Noise public keys (hex, one per line) allowed to register.
+      --quic-cert <file>     Also accept workers started with --transport quic on the UDP pool port,
+                             presenting this PEM certificate (experimental).
+      --quic-key <file>      PEM private key for --quic-cert.
+      --socks-users <file>   Require SOCKS5 clients to log in with a user:password listed in
+                             this file (RFC 1929, one entry per line).
+  -L, --forward <spec>       Carry plain TCP accepted on a local port to a fixed target through
+                             socks mode workers, as "[bind:]port:host:hostport" (repeatable).
+  -R, --expose <spec>        Carry plain TCP accepted on a local port to a service a worker offers
+                             with poolgo --expose, as "<name>=[bind:]port" (repeatable).
+      --http-port <port>     Also accept HTTP proxy clients, which open tunnels with CONNECT, on
+                             this port of --client-bind (socks mode).
+      --http-forward         With --http-port, also forward plain requests for http:// URLs.
+      --idle-timeout <t>     Close a client's stream after this long without data either way, as
+                             <duration> for every listener or <port>=<duration> (repeatable).
+      --max-duration <t>     Close a client's stream this long after it opened, in the same form.
+      --connect-timeout <t>  Give pool workers this long to reach a client's target before they
+                             give up and the client is told the TTL expired (default 0, no limit).
+      --flow-window <size>   Let a worker that accepted flow control have this much of a stream
+                             unread by the hub (default 1M).
+      --max-frame-size <size>
+                             Put at most this much stream data in each protocol 2 frame, so control
+                             messages wait behind less of it (default 65535).
+      --listener-rate-limit <r>
+                             Cap the bytes per second all clients of a listener move in each
+                             direction, as <rate> (e.g. 10M) or <port>=<rate> (repeatable).
+      --admin-socket <addr>  Answer "poolgo ctl" (usage: traffic per client listener; canary: tunnel
+                             health) on this Unix socket path or loopback host:port.
+      --canary <host:port>   Run an echo service on this port of --pool-bind and send a session
+                             through a socks mode worker to host:port, the address workers reach it
+                             at, every --canary-interval to check the whole path end to end.
+      --canary-interval <t>  How often to send the --canary session (default 1m).
+      --affinity <key>       Send a client's sessions through the worker (or failing that, the pool
+                             host) that served it last: none, client (its IP address) or user
+                             (its --socks-users name) (default none).
+      --resolve-on <where>   Resolve the names SOCKS5 clients ask for on the pool (the bastion) or
+                             the hub, sending the worker an address (default pool).
+      --dns-server <addr>    With --resolve-on hub, resolve with this server instead of the system
+                             resolver: host[:port], tcp://, tls:// (DNS over TLS) or https:// (DoH).
+      --tun <name>           Experimental (Linux): create TUN interface <name> and route its
+                             packets through a worker started with --tun (socks mode).
+      --version              Print the build version and exit.
+  -h, --help                 Show this help and exit.
+
+Send SIGUSR1 to log the version, protocol, feature and configuration
+distribution reported by registered workers in their STATS lines.
+
+hubgo is the Go implementation of hub.pl. It exposes two sockets: one facing
+clients on the jump box, and one facing pool workers from the bastion. Each
+client is paired with the next idle worker and bytes are forwarded in both
+directions until either side closes. In direct mode the downstream client
+speaks plain TCP; in socks mode the hub terminates the SOCKS5 handshake before
+bridging the stream. Run "poolgo keygen <file>" to create a Noise key pair.`
+)
+
+// Usage returns the command line help text.
+func Usage() string {
+	return usageText
+}
+
+// Mode identifies the hub operating mode.
+type Mode string
+
+const (
+	ModeAuto   Mode = "auto"
+	ModeDirect Mode = "direct"
+	ModeSocks  Mode = "socks"
+)
+
+// Options captures parsed CLI configuration.
+type Options struct {
+	ClientBind string
+	ClientPort int
+	PoolBind   string
+	PoolPort   int
+	Mode       Mode
+
+	AuthTokenFile string
+	AuthToken     *pool.Secret
+
+	ShutdownKeyFile string
+	ShutdownKey     *pool.Secret
+
+	NoiseKeyFile   string
+	NoiseAllowFile string
+
+	QUICCertFile string
+	QUICKeyFile  string
+
+	SocksUsersFile string
+	SocksUsers     *pool.Secret
+
+	HTTPPort    int  // the HTTP proxy listener's port; 0 for none
+	HTTPForward bool // forward requests for http:// URLs as well as CONNECT
+
+	Forwards []*Forward
+	Exposes  []*Expose
+
+	// IdleTimeouts and MaxDurations limit client streams, per listener
+	// port; see ListenerTimeout.
+	IdleTimeouts []ListenerTimeout
+	MaxDurations []ListenerTimeout
+
+	// ConnectTimeout is sent to workers that accept the deadline
+	// capability as the deadline of each CONNECT; 0 for none.
+	ConnectTimeout time.Duration
+
+	// FlowWindow is how much of a stream a worker that accepted the window
+	// capability may send unread (0 for pool.FlowWindow). MaxFrameSize
+	// limits the stream bytes in each data frame to protocol 2 workers; 0
+	// for the most a frame holds.
+	FlowWindow   int
+	MaxFrameSize int
+
+	// ListenerRates caps the traffic of each client listener; see
+	// ListenerRate.
+	ListenerRates []ListenerRate
+
+	AdminSocket string
+
+	// Canary is the hub's echo service as workers reach it, for --canary
+	// probes every CanaryInterval; nil for none.
+	Canary         *destination
+	CanaryInterval time.Duration
+
+	Affinity Affinity
+
+	ResolveOn ResolveOn
+	DNSServer string
+	Resolver  *net.Resolver // from DNSServer; nil for the system's
+
+	TUN string
+}
+
+// ParseArgs parses CLI arguments into Options.
+func ParseArgs(args []string) (*Options, error) {
+	fs := flag.NewFlagSet("hubgo", flag.ContinueOnError)
+	fs.SetOutput(flagDiscard{})
+
+	var (
+		clientBind    = fs.String("client-bind", "127.0.0.1", "")
+		clientBindAlt = fs.String("C", "", "")
+		clientPort    = fs.Int("client-port", 0, "")
+		clientPortAlt = fs.Int("c", 0, "")
+		poolBind      = fs.String("pool-bind", "0.0.0.0", "")
+		poolBindAlt   = fs.String("P", "", "")
+		poolPort      = fs.Int("pool-port", 0, "")
+		poolPortAlt   = fs.Int("p", 0, "")
+		mode          = fs.String("mode", "auto", "")
+		modeAlt       = fs.String("m", "", "")
+		authTokenFile = fs.String("auth-token-file", "", "")
+		shutdownKey   = fs.String("shutdown-key", "", "")
+		noiseKey      = fs.String("noise-key", "", "")
+		noiseAllow    = fs.String("noise-allow", "", "")
+		quicCert      = fs.String("quic-cert", "", "")
+		quicKey       = fs.String("quic-key", "", "")
+		socksUsers    = fs.String("socks-users", "", "")
+		httpPort      = fs.Int("http-port", 0, "")
+		httpForward   = fs.Bool("http-forward", false, "")
+		forwards      forwardList
+		exposes       forwardList
+		idleTimeouts  listenerList
+		maxDurations  listenerList
+		rateLimits    listenerList
+		connectWait   = fs.Duration("connect-timeout", 0, "")
+		flowWindow    = fs.String("flow-window", "", "")
+		maxFrameSize  = fs.String("max-frame-size", "", "")
+		adminSocket   = fs.String("admin-socket", "", "")
+		canary        = fs.String("canary", "", "")
+		canaryEvery   = fs.Duration("canary-interval", time.Minute, "")
+		affinity      = fs.String("affinity", "none", "")
+		resolveOn     = fs.String("resolve-on", "pool", "")
+		dnsServer     = fs.String("dns-server", "", "")
+		tun           = fs.String("tun", "", "")
+		configFile    = fs.String("config", "", "")
+		versionFlag   = fs.Bool("version", false, "")
+		helpFlag      = fs.Bool("help", false, "")
+		helpFlagAlt   = fs.Bool("h", false, "")
+	)
+
+	fs.Var(&forwards, "forward", "")
+	fs.Var(&forwards, "L", "")
+	fs.Var(&exposes, "expose", "")
+	fs.Var(&exposes, "R", "")
+	fs.Var(&idleTimeouts, "idle-timeout", "")
+	fs.Var(&maxDurations, "max-duration", "")
+	fs.Var(&rateLimits, "listener-rate-limit", "")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ErrShowUsage
+		}
+		return nil, err
+	}
+	if *helpFlag || *helpFlagAlt {
+		return nil, ErrShowUsage
+	}
+	if *versionFlag {
+		return nil, ErrShowVersion
+	}
+	if *configFile != "" {
+		if err := config.ApplyFile(fs, *configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &Options{
+		ClientBind:      strings.Trim(normalizeString(*clientBindAlt, *clientBind), "[]"),
+		ClientPort:      normalizeInt(*clientPortAlt, *clientPort),
+		PoolBind:        strings.Trim(normalizeString(*poolBindAlt, *poolBind), "[]"),
+		PoolPort:        normalizeInt(*poolPortAlt, *poolPort),
+		Mode:            Mode(strings.ToLower(normalizeString(*modeAlt, *mode))),
+		AuthTokenFile:   *authTokenFile,
+		ShutdownKeyFile: *shutdownKey,
+		NoiseKeyFile:    *noiseKey,
+		NoiseAllowFile:  *noiseAllow,
+		QUICCertFile:    *quicCert,
+		QUICKeyFile:     *quicKey,
+		SocksUsersFile:  *socksUsers,
+		HTTPPort:        *httpPort,
+		HTTPForward:     *httpForward,
+		Affinity:        Affinity(strings.ToLower(*affinity)),
+		ResolveOn:       ResolveOn(strings.ToLower(*resolveOn)),
+		DNSServer:       *dnsServer,
+		TUN:             *tun,
+		AdminSocket:     *adminSocket,
+		ConnectTimeout:  *connectWait,
+		CanaryInterval:  *canaryEvery,
+	}
+
+	if opts.ClientPort <= 0 || opts.ClientPort > 65535 || opts.PoolPort <= 0 || opts.PoolPort > 65535 {
+		return nil, fmt.Errorf("both --client-port and --pool-port are required")
+	}
+	switch opts.Mode {
+	case ModeAuto, ModeDirect, ModeSocks:
+	default:
+		return nil, fmt.Errorf("--mode must be one of auto, direct, socks")
+	}
+	if opts.NoiseAllowFile != "" && opts.NoiseKeyFile == "" {
+		return nil, fmt.Errorf("--noise-allow requires --noise-key")
+	}
+	if (opts.QUICCertFile == "") != (opts.QUICKeyFile == "") {
+		return nil, fmt.Errorf("--quic-cert and --quic-key must be used together")
+	}
+	if opts.SocksUsersFile != "" && opts.Mode == ModeDirect {
+		return nil, fmt.Errorf("--socks-users requires --mode socks or auto")
+	}
+	if opts.HTTPPort < 0 || opts.HTTPPort > 65535 {
+		return nil, fmt.Errorf("--http-port must be between 1 and 65535")
+	}
+	if opts.HTTPPort > 0 && opts.Mode == ModeDirect {
+		return nil, fmt.Errorf("--http-port requires --mode socks or auto")
+	}
+	if opts.HTTPForward && opts.HTTPPort == 0 {
+		return nil, fmt.Errorf("--http-forward requires --http-port")
+	}
+	for _, text := range forwards {
+		f, err := ParseForward(text)
+		if err != nil {
+			return nil, fmt.Errorf("--forward %s: %v", text, err)
+		}
+		if opts.Mode == ModeDirect {
+			return nil, fmt.Errorf("--forward requires --mode socks or auto")
+		}
+		opts.Forwards = append(opts.Forwards, f)
+	}
+	for _, text := range exposes {
+		e, err := ParseExpose(text)
+		if err != nil {
+			return nil, fmt.Errorf("--expose %s: %v", text, err)
+		}
+		for _, seen := range opts.Exposes {
+			if seen.Name == e.Name {
+				return nil, fmt.Errorf("--expose %s: name %s given twice", text, e.Name)
+			}
+		}
+		opts.Exposes = append(opts.Exposes, e)
+	}
+	for _, flag := range []struct {
+		name  string
+		texts listenerList
+		list  *[]ListenerTimeout
+	}{
+		{"idle-timeout", idleTimeouts, &opts.IdleTimeouts},
+		{"max-duration", maxDurations, &opts.MaxDurations},
+	} {
+		for _, text := range flag.texts {
+			t, err := ParseListenerTimeout(text)
+			if err != nil {
+				return nil, fmt.Errorf("--%s %s: %v", flag.name, text, err)
+			}
+			if t.Port != 0 && !slices.Contains(opts.listenerPorts(), t.Port) {
+				return nil, fmt.Errorf("--%s %s: no client listener on port %d", flag.name, text, t.Port)
+			}
+			for _, seen := range *flag.list {
+				if seen.Port == t.Port {
+					return nil, fmt.Errorf("--%s %s: a limit for that listener was already given", flag.name, text)
+				}
+			}
+			*flag.list = append(*flag.list, t)
+		}
+	}
+	if opts.ConnectTimeout < 0 || (opts.ConnectTimeout > 0 && opts.ConnectTimeout < time.Millisecond) {
+		return nil, fmt.Errorf("--connect-timeout must be at least 1ms, or 0 for no limit")
+	}
+	if *flowWindow != "" {
+		size, err := pool.ParseFlowWindow(*flowWindow)
+		if err != nil {
+			return nil, fmt.Errorf("--flow-window: %v", err)
+		}
+		opts.FlowWindow = size
+	}
+	if *maxFrameSize != "" {
+		size, err := pool.ParseMaxFrameSize(*maxFrameSize)
+		if err != nil {
+			return nil, fmt.Errorf("--max-frame-size: %v", err)
+		}
+		opts.MaxFrameSize = size
+	}
+	for _, text := range rateLimits {
+		r, err := ParseListenerRate(text)
+		if err != nil {
+			return nil, fmt.Errorf("--listener-rate-limit %s: %v", text, err)
+		}
+		if r.Port != 0 && !slices.Contains(opts.listenerPorts(), r.Port) {
+			return nil, fmt.Errorf("--listener-rate-limit %s: no client listener on port %d", text, r.Port)
+		}
+		for _, seen := range opts.ListenerRates {
+			if seen.Port == r.Port {
+				return nil, fmt.Errorf("--listener-rate-limit %s: a limit for that listener was already given", text)
+			}
+		}
+		opts.ListenerRates = append(opts.ListenerRates, r)
+	}
+	if opts.AdminSocket != "" {
+		if _, _, err := pool.AdminAddress(opts.AdminSocket); err != nil {
+			return nil, fmt.Errorf("--admin-socket: %v", err)
+		}
+	}
+	if *canary != "" {
+		dest, err := ParseCanary(*canary)
+		if err != nil {
+			return nil, fmt.Errorf("--canary %s: %v", *canary, err)
+		}
+		if opts.Mode == ModeDirect {
+			return nil, fmt.Errorf("--canary requires --mode socks or auto")
+		}
+		if opts.CanaryInterval <= 0 {
+			return nil, fmt.Errorf("--canary-interval must be positive")
+		}
+		opts.Canary = dest
+	}
+	switch opts.Affinity {
+	case AffinityNone, AffinityClient:
+	case AffinityUser:
+		if opts.SocksUsersFile == "" {
+			return nil, fmt.Errorf("--affinity user requires --socks-users")
+		}
+	default:
+		return nil, fmt.Errorf("--affinity must be one of none, client, user")
+	}
+	switch opts.ResolveOn {
+	case ResolveOnPool:
+		if opts.DNSServer != "" {
+			return nil, fmt.Errorf("--dns-server requires --resolve-on hub")
+		}
+	case ResolveOnHub:
+		if opts.Mode == ModeDirect {
+			return nil, fmt.Errorf("--resolve-on hub requires --mode socks or auto")
+		}
+		resolver, err := pool.NewResolver(opts.DNSServer)
+		if err != nil {
+			return nil, fmt.Errorf("--dns-server: %v", err)
+		}
+		opts.Resolver = resolver
+	default:
+		return nil, fmt.Errorf("--resolve-on must be pool or hub")
+	}
+	if opts.TUN != "" {
+		if !pool.TUNSupported {
+			return nil, fmt.Errorf("--tun is only supported on Linux")
+		}
+		if opts.Mode == ModeDirect {
+			return nil, fmt.Errorf("--tun requires --mode socks or auto")
+		}
+	}
+	if opts.ShutdownKeyFile != "" {
+		key, err := pool.LoadSecret(opts.ShutdownKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("--shutdown-key: %v", err)
+		}
+		key.PrepareMAC()
+		opts.ShutdownKey = key
+	}
+	if opts.AuthTokenFile != "" {
+		token, err := pool.LoadSecret(opts.AuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("--auth-token-file: %v", err)
+		}
+		if bytes.ContainsAny(token.Bytes(), " \t\r\n") {
+			token.Wipe()
+			return nil, fmt.Errorf("--auth-token-file must contain a single token without whitespace")
+		}
+		opts.AuthToken = token
+	}
+	if opts.SocksUsersFile != "" {
+		users, err := pool.LoadSecret(opts.SocksUsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("--socks-users: %v", err)
+		}
+		if err := parseSocksUsers(users.Bytes()); err != nil {
+			users.Wipe()
+			return nil, fmt.Errorf("--socks-users %v", err)
+		}
+		opts.SocksUsers = users
+	}
+	return opts, nil
+}
+
+func normalizeString(override, base string) string {
+	if override != "" {
+		return override
+	}
+	return base
+}
+
+func normalizeInt(override, base int) int {
+	if override != 0 {
+		return override
+	}
+	return base
+}
+
+// flagDiscard is a writer that ignores output to keep flag package quiet.
+type flagDiscard struct{}
+
+func (flagDiscard) Write(p []byte) (int, error) { return len(p), nil }
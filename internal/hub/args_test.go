@@ -0,0 +1,232 @@
+package hub
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"contun/internal/pool"
+)
+
+func TestParseArgs(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-m", "SOCKS"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if opts.ClientPort != 4444 || opts.PoolPort != 5555 || opts.Mode != ModeSocks ||
+		opts.ClientBind != "127.0.0.1" || opts.PoolBind != "0.0.0.0" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+
+	for _, args := range [][]string{
+		{"-c", "4444"},
+		{"-c", "4444", "-p", "5555", "-m", "tun"},
+		{"-c", "4444", "-p", "5555", "--noise-allow", "workers.txt"},
+		{"-c", "4444", "-p", "5555", "--resolve-on", "bastion"},
+		{"-c", "4444", "-p", "5555", "--dns-server", "1.1.1.1"},
+		{"-c", "4444", "-p", "5555", "--resolve-on", "hub", "--dns-server", "quic://1.1.1.1"},
+		{"-c", "4444", "-p", "5555", "--quic-cert", "hub.crt"},
+		{"-c", "4444", "-p", "5555", "-m", "direct", "--http-port", "3128"},
+		{"-c", "4444", "-p", "5555", "--http-port", "70000"},
+		{"-c", "4444", "-p", "5555", "--http-forward"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Fatalf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+	if opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-C", "[::1]", "-P", "::"}); err != nil || opts.ClientBind != "::1" || opts.PoolBind != "::" {
+		t.Fatalf("IPv6 binds: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-h"}); !errors.Is(err, ErrShowUsage) {
+		t.Fatalf("-h: got %v", err)
+	}
+}
+
+func TestParseArgsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hub.toml")
+	os.WriteFile(path, []byte("client-port = 4444\npool-port = 5555\nmode = \"socks\"\npool-bind = \"10.0.0.1\"\n"), 0o600)
+	opts, err := ParseArgs([]string{"--config", path, "-P", "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if opts.ClientPort != 4444 || opts.PoolPort != 5555 || opts.Mode != ModeSocks || opts.PoolBind != "127.0.0.1" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+}
+
+func TestParseArgsSocksUsers(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "users")
+	bad := filepath.Join(dir, "bad")
+	os.WriteFile(good, []byte("alice:s3cret\n"), 0o600)
+	os.WriteFile(bad, []byte("alice\n"), 0o600)
+
+	opts, err := ParseArgs([]string{"-c", "1", "-p", "2", "--socks-users", good})
+	if err != nil || opts.SocksUsers == nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if _, err := ParseArgs([]string{"-c", "1", "-p", "2", "--socks-users", bad}); err == nil {
+		t.Fatalf("accepted an entry without a password")
+	}
+	if _, err := ParseArgs([]string{"-c", "1", "-p", "2", "-m", "direct", "--socks-users", good}); err == nil {
+		t.Fatalf("accepted --socks-users in direct mode")
+	}
+}
+
+func TestParseArgsTUN(t *testing.T) {
+	if !pool.TUNSupported {
+		t.Skip("TUN devices are not supported on this platform")
+	}
+	opts, err := ParseArgs([]string{"-c", "1", "-p", "2", "--tun", "contun0"})
+	if err != nil || opts.TUN != "contun0" {
+		t.Fatalf("ParseArgs = %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-c", "1", "-p", "2", "-m", "direct", "--tun", "contun0"}); err == nil {
+		t.Fatalf("accepted --tun in direct mode")
+	}
+}
+
+func TestParseArgsExpose(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-R", "wiki=8080", "--expose", "db=[::1]:5432"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if len(opts.Exposes) != 2 || opts.Exposes[0].String() != "wiki=:8080" || opts.Exposes[1].String() != "db=[::1]:5432" {
+		t.Fatalf("exposes %v", opts.Exposes)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "-R", "8080"},
+		{"-c", "4444", "-p", "5555", "-R", "=8080"},
+		{"-c", "4444", "-p", "5555", "-R", "wiki=0"},
+		{"-c", "4444", "-p", "5555", "-R", "wiki=a:b:8080"},
+		{"-c", "4444", "-p", "5555", "-R", "wiki=8080", "-R", "wiki=8081"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestParseArgsTimeouts(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-L", "8443:db.internal:5432",
+		"--idle-timeout", "10m", "--idle-timeout", "8443=1h", "--max-duration", "4444=8h", "--connect-timeout", "15s"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if limitFor(opts.IdleTimeouts, 4444) != 10*time.Minute || limitFor(opts.IdleTimeouts, 8443) != time.Hour {
+		t.Errorf("idle timeouts %v", opts.IdleTimeouts)
+	}
+	if limitFor(opts.MaxDurations, 4444) != 8*time.Hour || limitFor(opts.MaxDurations, 8443) != 0 {
+		t.Errorf("max durations %v", opts.MaxDurations)
+	}
+	if opts.ConnectTimeout != 15*time.Second {
+		t.Errorf("connect timeout %v", opts.ConnectTimeout)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "--idle-timeout", "0s"},
+		{"-c", "4444", "-p", "5555", "--idle-timeout", "soon"},
+		{"-c", "4444", "-p", "5555", "--idle-timeout", "8443=1h"},
+		{"-c", "4444", "-p", "5555", "--max-duration", "1h", "--max-duration", "2h"},
+		{"-c", "4444", "-p", "5555", "--connect-timeout", "-1s"},
+		{"-c", "4444", "-p", "5555", "--connect-timeout", "10us"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestParseArgsCanary(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "--canary", "jump.example:7443", "--canary-interval", "30s"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if opts.Canary.String() != "jump.example:7443" || opts.Canary.AddrType != pool.AddrDomain || opts.CanaryInterval != 30*time.Second {
+		t.Fatalf("canary %v every %s", opts.Canary, opts.CanaryInterval)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "--canary", "7443"},
+		{"-c", "4444", "-p", "5555", "--canary", "jump.example:0"},
+		{"-c", "4444", "-p", "5555", "--canary", "jump.example:7443", "--canary-interval", "0s"},
+		{"-c", "4444", "-p", "5555", "-m", "direct", "--canary", "jump.example:7443"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestParseArgsFlowWindow(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "--flow-window", "256K", "--max-frame-size", "16K"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if opts.FlowWindow != 256<<10 || opts.MaxFrameSize != 16<<10 {
+		t.Fatalf("window %d, frame size %d", opts.FlowWindow, opts.MaxFrameSize)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "--flow-window", "2G"},
+		{"-c", "4444", "-p", "5555", "--max-frame-size", "100"},
+		{"-c", "4444", "-p", "5555", "--max-frame-size", "64K"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestParseArgsListenerRate(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-R", "wiki=8080",
+		"--listener-rate-limit", "10M", "--listener-rate-limit", "8080=512K", "--admin-socket", "127.0.0.1:7071"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if rateFor(opts.ListenerRates, 4444) != 10<<20 || rateFor(opts.ListenerRates, 8080) != 512<<10 || opts.AdminSocket != "127.0.0.1:7071" {
+		t.Errorf("rates %v, admin socket %q", opts.ListenerRates, opts.AdminSocket)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "--listener-rate-limit", "off"},
+		{"-c", "4444", "-p", "5555", "--listener-rate-limit", "fast"},
+		{"-c", "4444", "-p", "5555", "--listener-rate-limit", "8080=1M"},
+		{"-c", "4444", "-p", "5555", "--listener-rate-limit", "1M", "--listener-rate-limit", "2M"},
+		{"-c", "4444", "-p", "5555", "--admin-socket", "0.0.0.0:7071"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
+
+func TestParseArgsForward(t *testing.T) {
+	opts, err := ParseArgs([]string{"-c", "4444", "-p", "5555", "-L", "8443:internal.db:5432",
+		"--forward", "127.0.0.2:2222:[2001:db8::1]:22", "--forward", "[::1]:8080:10.0.0.5:80"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	want := []string{":8443 -> internal.db:5432", "127.0.0.2:2222 -> [2001:db8::1]:22", "[::1]:8080 -> 10.0.0.5:80"}
+	if len(opts.Forwards) != len(want) {
+		t.Fatalf("forwards %v", opts.Forwards)
+	}
+	for i, f := range opts.Forwards {
+		if f.String() != want[i] {
+			t.Errorf("forward %d = %s, want %s", i, f, want[i])
+		}
+	}
+	if f := opts.Forwards[1]; f.Dest.AddrType != pool.AddrIPv6 || opts.Forwards[0].Dest.AddrType != pool.AddrDomain {
+		t.Errorf("address types %s and %s", opts.Forwards[0].Dest.AddrType, f.Dest.AddrType)
+	}
+	for _, args := range [][]string{
+		{"-c", "4444", "-p", "5555", "-L", "8443:internal.db"},
+		{"-c", "4444", "-p", "5555", "-L", "0:internal.db:5432"},
+		{"-c", "4444", "-p", "5555", "-L", "8443:internal.db:http"},
+		{"-c", "4444", "-p", "5555", "-L", "8443:2001:db8::1:22"},
+		{"-c", "4444", "-p", "5555", "-L", "8443:[2001:db8::1:22"},
+		{"-c", "4444", "-p", "5555", "-m", "direct", "-L", "8443:internal.db:5432"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// canaryTimeout bounds one --canary probe, from queueing its session to
+// reading the echo back.
+const canaryTimeout = 10 * time.Second
+
+// ParseCanary parses a --canary value, "host:port", with an IPv6 address
+// in brackets.
+func ParseCanary(text string) (*destination, error) {
+	fields, err := splitForward(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 2 || fields[0] == "" {
+		return nil, fmt.Errorf("expected host:port")
+	}
+	dest := &destination{Host: fields[0]}
+	if dest.Port, err = strconv.Atoi(fields[1]); err != nil || dest.Port <= 0 || dest.Port > 65535 {
+		return nil, fmt.Errorf("port must be between 1 and 65535")
+	}
+	if err := dest.classify(); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// canaryStatus is the outcome of the latest --canary probe.
+type canaryStatus struct {
+	mu       sync.Mutex
+	checked  time.Time // zero until the first probe ends
+	latency  time.Duration
+	err      error
+	failures int // consecutive failed probes
+}
+
+// record notes a probe's outcome and reports whether the tunnel's health
+// changed with it.
+func (c *canaryStatus) record(latency time.Duration, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.checked.IsZero() || (err == nil) != (c.err == nil)
+	c.checked, c.latency, c.err = time.Now(), latency, err
+	if err != nil {
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+	return changed
+}
+
+// runCanary probes the tunnel every --canary-interval until ctx ends.
+func (s *Server) runCanary(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.CanaryInterval)
+	defer ticker.Stop()
+	for {
+		latency, err := s.probeCanary(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if s.canary.record(latency, err) {
+			if err != nil {
+				s.logger.Printf("Canary to %s failed, tunnel unhealthy: %v", s.opts.Canary, err)
+			} else {
+				s.logger.Printf("Canary to %s answered in %s, tunnel healthy", s.opts.Canary, latency.Round(time.Millisecond))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeCanary sends a session through a socks mode worker to the hub's own
+// echo service, as a --forward client would, and returns how long the
+// nonce it wrote took to come back.
+func (s *Server) probeCanary(ctx context.Context) (time.Duration, error) {
+	probe, conn := net.Pipe()
+	defer probe.Close()
+	dest := *s.opts.Canary
+	sess := &session{clientID: s.ids.Add(1), client: conn, dest: &dest, done: make(chan struct{})}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return 0, ctx.Err()
+	}
+	if s.mode == ModeDirect {
+		s.mu.Unlock()
+		return 0, errors.New("canaries need socks mode workers")
+	}
+	s.conns[conn] = struct{}{}
+	s.waiting = append(s.waiting, sess)
+	s.wg.Add(1)
+	s.mu.Unlock()
+	s.dispatch()
+	go func() {
+		defer s.wg.Done()
+		if reason := sess.pumpClient(s, bufio.NewReader(conn)); reason != "" {
+			s.closeConn(conn, "client", sess.clientID, reason)
+		}
+	}()
+	stop := context.AfterFunc(ctx, func() { _ = probe.Close() })
+	defer stop()
+
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	started := time.Now()
+	_ = probe.SetDeadline(started.Add(canaryTimeout))
+	echo := make([]byte, len(nonce))
+	_, err := probe.Write(nonce)
+	if err == nil {
+		_, err = io.ReadFull(probe, echo)
+	}
+	switch {
+	case ctx.Err() != nil:
+		return 0, ctx.Err()
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return 0, fmt.Errorf("no echo within %s", canaryTimeout)
+	case err != nil:
+		return 0, errors.New("session closed before the echo came back")
+	case !bytes.Equal(echo, nonce):
+		return 0, errors.New("the echo did not match")
+	}
+	return time.Since(started), nil
+}
+
+// handleEcho serves the --canary echo service: it sends back what the
+// probe wrote, which is never more than a nonce.
+func (s *Server) handleEcho(ctx context.Context, conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	_ = conn.SetDeadline(time.Now().Add(canaryTimeout))
+	_, _ = io.Copy(conn, io.LimitReader(conn, 64))
+}
+
+// writeCanary writes the latest probe's outcome for the admin socket, as
+// "canary healthy=<0|1> ...".
+func (s *Server) writeCanary(w io.Writer) {
+	c := &s.canary
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() {
+		fmt.Fprintf(w, "canary healthy=0 target=%s checked=never\n", s.opts.Canary)
+		return
+	}
+	healthy := 0
+	if c.err == nil {
+		healthy = 1
+	}
+	fmt.Fprintf(w, "canary healthy=%d target=%s checked=%s latency_ms=%d failures=%d",
+		healthy, s.opts.Canary, c.checked.UTC().Format(time.RFC3339), c.latency.Milliseconds(), c.failures)
+	if c.err != nil {
+		fmt.Fprintf(w, " error=%q", c.err.Error())
+	}
+	fmt.Fprintln(w)
+}
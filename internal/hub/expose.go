@@ -0,0 +1,123 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"contun/internal/pool"
+)
+
+// Expose is an --expose listener: plain TCP accepted on Bind:Port is
+// carried to the service a worker offered under Name with poolgo
+// --expose, as ssh -R does.
+type Expose struct {
+	Name string
+	Bind string // "" for --client-bind
+	Port int
+}
+
+func (e *Expose) String() string {
+	return e.Name + "=" + net.JoinHostPort(e.Bind, strconv.Itoa(e.Port))
+}
+
+// ParseExpose parses an --expose value, "<name>=[bind:]port", with an
+// IPv6 bind address in brackets.
+func ParseExpose(text string) (*Expose, error) {
+	name, listen, ok := strings.Cut(text, "=")
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return nil, fmt.Errorf("expected <name>=[bind:]port")
+	}
+	fields, err := splitForward(listen)
+	if err != nil {
+		return nil, err
+	}
+	e := &Expose{Name: name}
+	switch len(fields) {
+	case 1:
+	case 2:
+		e.Bind, fields = fields[0], fields[1:]
+	default:
+		return nil, fmt.Errorf("expected <name>=[bind:]port")
+	}
+	if e.Port, err = strconv.Atoi(fields[0]); err != nil || e.Port <= 0 || e.Port > 65535 {
+		return nil, fmt.Errorf("listen port must be between 1 and 65535")
+	}
+	return e, nil
+}
+
+// parseExposeLine parses a worker's "EXPOSE <name> <atype> <addr> <port>".
+func parseExposeLine(rest string) (string, *destination, error) {
+	parts := strings.Fields(rest)
+	if len(parts) != 4 {
+		return "", nil, fmt.Errorf("unexpected expose line 'EXPOSE %s'", rest)
+	}
+	port, err := strconv.Atoi(parts[3])
+	if err != nil || port < 1 || port > 65535 {
+		return "", nil, fmt.Errorf("invalid exposed port '%s'", parts[3])
+	}
+	dest := &destination{AddrType: pool.AddrType(parts[1]), Host: parts[2], Port: port}
+	if err := validateAddress(dest.AddrType, dest.Host); err != nil {
+		return "", nil, fmt.Errorf("invalid exposed address: %v", err)
+	}
+	return parts[0], dest, nil
+}
+
+// noteExpose records a service a worker offered, if an --expose listener
+// publishes it, and serves any of its clients that were waiting.
+func (s *Server) noteExpose(w *worker, rest string) {
+	name, dest, err := parseExposeLine(rest)
+	if err != nil {
+		s.logger.Printf("Worker id=%d: %v", w.id, err)
+		return
+	}
+	published := false
+	for _, e := range s.opts.Exposes {
+		published = published || e.Name == name
+	}
+	if !published {
+		s.logger.Printf("Worker id=%d exposes %s (%s), which no --expose publishes", w.id, name, dest)
+		return
+	}
+	s.mu.Lock()
+	if w.exposed == nil {
+		w.exposed = make(map[string]*destination)
+	}
+	w.exposed[name] = dest
+	s.mu.Unlock()
+	s.logger.Printf("Worker id=%d exposes %s (%s)", w.id, name, dest)
+	s.dispatch()
+}
+
+// handleExpose returns the handler for the clients of e's listener. Each
+// connection waits for a worker that exposes e.Name and goes to it as a
+// CONNECT to the service it offered; when no registered worker offers
+// the service the connection is closed at once.
+func (s *Server) handleExpose(e *Expose) func(context.Context, net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		sess := &session{clientID: s.ids.Add(1), client: conn, expose: e.Name, done: make(chan struct{})}
+		s.logger.Printf("Client connected (id=%d) for exposed service %s", sess.clientID, e.Name)
+		sess.affinity = s.sessionAffinity(conn, "")
+
+		s.mu.Lock()
+		offered := false
+		for w := range s.workers {
+			offered = offered || w.exposed[e.Name] != nil
+		}
+		if !offered {
+			s.mu.Unlock()
+			s.closeConn(conn, "client", sess.clientID, "no pool worker exposes "+e.Name)
+			return
+		}
+		s.waiting = append(s.waiting, sess)
+		s.mu.Unlock()
+		s.dispatch()
+
+		if reason := sess.pumpClient(s, bufio.NewReader(conn)); reason != "" {
+			s.closeConn(conn, "client", sess.clientID, reason)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Forward is a --forward listener: plain TCP accepted on Bind:Port is
+// carried to Dest through a socks mode worker, as ssh -L does.
+type Forward struct {
+	Bind string // "" for --client-bind
+	Port int
+	Dest *destination
+}
+
+func (f *Forward) String() string {
+	return fmt.Sprintf("%s -> %s", net.JoinHostPort(f.Bind, strconv.Itoa(f.Port)), f.Dest)
+}
+
+// ParseForward parses a --forward value in ssh -L form,
+// "[bind:]port:host:hostport", with IPv6 addresses in brackets.
+func ParseForward(text string) (*Forward, error) {
+	fields, err := splitForward(text)
+	if err != nil {
+		return nil, err
+	}
+	f := &Forward{}
+	switch len(fields) {
+	case 3:
+	case 4:
+		f.Bind, fields = fields[0], fields[1:]
+	default:
+		return nil, fmt.Errorf("expected [bind:]port:host:hostport")
+	}
+	if f.Port, err = strconv.Atoi(fields[0]); err != nil || f.Port <= 0 || f.Port > 65535 {
+		return nil, fmt.Errorf("listen port must be between 1 and 65535")
+	}
+	f.Dest = &destination{Host: fields[1]}
+	if f.Dest.Port, err = strconv.Atoi(fields[2]); err != nil || f.Dest.Port <= 0 || f.Dest.Port > 65535 {
+		return nil, fmt.Errorf("target port must be between 1 and 65535")
+	}
+	if err := f.Dest.classify(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// splitForward splits text at the colons outside brackets and strips the
+// brackets.
+func splitForward(text string) ([]string, error) {
+	var fields []string
+	for text != "" {
+		if text[0] == '[' {
+			end := strings.IndexByte(text, ']')
+			if end < 0 || (end+1 < len(text) && text[end+1] != ':') {
+				return nil, fmt.Errorf("unbalanced brackets")
+			}
+			fields = append(fields, text[1:end])
+			text = strings.TrimPrefix(text[end+1:], ":")
+			continue
+		}
+		field, rest, _ := strings.Cut(text, ":")
+		fields = append(fields, field)
+		text = rest
+	}
+	return fields, nil
+}
+
+// forwardList collects repeated --forward or --expose values.
+type forwardList []string
+
+func (l *forwardList) String() string { return strings.Join(*l, ",") }
+
+func (l *forwardList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// handleForward returns the handler for the clients of f's listener. Each
+// connection goes to a worker as a CONNECT to f.Dest, so the hub must be
+// in socks mode; a target that cannot be reached closes the connection.
+func (s *Server) handleForward(f *Forward) func(context.Context, net.Conn) {
+	return func(ctx context.Context, conn net.Conn) {
+		sess := &session{clientID: s.ids.Add(1), client: conn, done: make(chan struct{})}
+		s.logger.Printf("Forward client connected (id=%d) for %s", sess.clientID, f.Dest)
+
+		mode, err := s.waitMode(ctx)
+		if err != nil {
+			s.closeConn(conn, "client", sess.clientID, "hub shutting down")
+			return
+		}
+		if mode != ModeSocks {
+			s.closeConn(conn, "client", sess.clientID, "forwards need socks mode workers")
+			return
+		}
+		dest := *f.Dest
+		if s.opts.ResolveOn == ResolveOnHub {
+			if err := s.resolveDest(ctx, &dest); err != nil {
+				s.closeConn(conn, "client", sess.clientID, err.Error())
+				return
+			}
+		}
+		sess.dest = &dest
+		sess.affinity = s.sessionAffinity(conn, "")
+
+		s.mu.Lock()
+		s.waiting = append(s.waiting, sess)
+		s.mu.Unlock()
+		s.dispatch()
+
+		if reason := sess.pumpClient(s, bufio.NewReader(conn)); reason != "" {
+			s.closeConn(conn, "client", sess.clientID, reason)
+		}
+	}
+}
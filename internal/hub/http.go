@@ -0,0 +1,200 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpError is an HTTP proxy request the hub answers itself, with the
+// response to send before closing the client.
+type httpError struct {
+	reply  []byte
+	reason string
+}
+
+func (e *httpError) Error() string { return e.reason }
+
+func httpFailure(code int, reason string, header ...string) *httpError {
+	return &httpError{reply: httpResponse(code, reason, header...), reason: reason}
+}
+
+// httpResponse encodes a response to an HTTP proxy client, with reason as
+// its plain-text body and any extra header lines.
+func httpResponse(code int, reason string, header ...string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for _, h := range header {
+		b.WriteString(h + "\r\n")
+	}
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s\n", len(reason)+1, reason)
+	return b.Bytes()
+}
+
+// httpEstablished tells a CONNECT client its tunnel is open.
+var httpEstablished = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+
+// httpStatus maps a worker's REPLY status, a SOCKS5 reply code, to the
+// response an HTTP proxy client gets.
+func httpStatus(status int) int {
+	switch status {
+	case socksNotAllowed:
+		return http.StatusForbidden
+	case socksTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// httpRequest is an HTTP proxy request that passed parsing.
+type httpRequest struct {
+	dest    *destination
+	forward []byte // the request head to send the target, for --http-forward; nil for CONNECT
+	user    string // the --socks-users name it authenticated with, if any
+}
+
+// readHTTPRequest reads an HTTP proxy client's request: CONNECT
+// host:port, or with forward a request for an http:// URL, which is sent
+// on to the target in origin form with "Connection: close" so that the
+// stream carries a single request. With a non-nil auth the client must
+// send Basic Proxy-Authorization that auth accepts.
+func readHTTPRequest(r *bufio.Reader, forward bool, auth socksAuthenticator) (*httpRequest, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		return nil, httpFailure(http.StatusBadRequest, "malformed request: "+err.Error())
+	}
+	out := &httpRequest{}
+	if auth != nil {
+		user, pass, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization"))
+		if !ok || !auth([]byte(user), []byte(pass)) {
+			return nil, httpFailure(http.StatusProxyAuthRequired, "proxy authentication required", `Proxy-Authenticate: Basic realm="hubgo"`)
+		}
+		out.user = user
+	}
+
+	host, port := req.Host, ""
+	switch {
+	case req.Method == http.MethodConnect:
+		if host, port, err = net.SplitHostPort(req.Host); err != nil {
+			return nil, httpFailure(http.StatusBadRequest, "CONNECT needs host:port")
+		}
+	case !forward:
+		return nil, httpFailure(http.StatusMethodNotAllowed, "only CONNECT is supported")
+	case req.URL.Scheme != "http" || req.URL.Host == "":
+		return nil, httpFailure(http.StatusBadRequest, "only absolute http:// URLs can be forwarded")
+	default:
+		host, port = req.URL.Hostname(), req.URL.Port()
+		if port == "" {
+			port = "80"
+		}
+		out.forward = forwardHead(req)
+	}
+	dest := &destination{Host: strings.Trim(host, "[]")}
+	if dest.Port, err = strconv.Atoi(port); err != nil || dest.Port <= 0 || dest.Port > 65535 {
+		return nil, httpFailure(http.StatusBadRequest, "invalid port '"+port+"'")
+	}
+	if err := dest.classify(); err != nil {
+		return nil, httpFailure(http.StatusBadRequest, err.Error())
+	}
+	out.dest = dest
+	return out, nil
+}
+
+// forwardHead rewrites the head of a proxied request for its origin
+// server. Any body follows unchanged from the client connection.
+func forwardHead(req *http.Request) []byte {
+	for name := range req.Header {
+		if strings.HasPrefix(strings.ToLower(name), "proxy-") {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Set("Connection", "close")
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	if len(req.TransferEncoding) > 0 {
+		fmt.Fprintf(&b, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	}
+	_ = req.Header.Write(&b)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// parseProxyAuth decodes Basic Proxy-Authorization credentials.
+func parseProxyAuth(header string) (user, pass string, ok bool) {
+	scheme, encoded, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// handleHTTPClient serves a client of the --http-port listener. Its
+// request goes to a worker as a CONNECT, like a SOCKS5 client's, so the
+// hub must be in socks mode.
+func (s *Server) handleHTTPClient(ctx context.Context, conn net.Conn) {
+	sess := &session{clientID: s.ids.Add(1), client: conn, http: true, done: make(chan struct{})}
+	s.logger.Printf("HTTP client connected (id=%d)", sess.clientID)
+
+	mode, err := s.waitMode(ctx)
+	if err != nil {
+		s.closeConn(conn, "client", sess.clientID, "hub shutting down")
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var req *httpRequest
+	if mode != ModeSocks {
+		err = httpFailure(http.StatusServiceUnavailable, "HTTP proxy clients need socks mode workers")
+	} else {
+		var auth socksAuthenticator
+		if s.opts.SocksUsers != nil {
+			auth = func(user, pass []byte) bool {
+				return checkSocksUser(s.opts.SocksUsers.Bytes(), user, pass)
+			}
+		}
+		req, err = readHTTPRequest(reader, s.opts.HTTPForward, auth)
+		if err == nil && s.opts.ResolveOn == ResolveOnHub {
+			if err = s.resolveDest(ctx, req.dest); err != nil {
+				err = httpFailure(http.StatusBadGateway, err.Error())
+			}
+		}
+	}
+	if err != nil {
+		var httpErr *httpError
+		if errors.As(err, &httpErr) {
+			_, _ = conn.Write(httpErr.reply)
+		} else {
+			err = readError(err)
+		}
+		s.closeConn(conn, "client", sess.clientID, err.Error())
+		return
+	}
+	if req.user != "" {
+		s.logger.Printf("HTTP proxy user '%s' authenticated (id=%d)", req.user, sess.clientID)
+	}
+	sess.dest, sess.pending, sess.forward = req.dest, req.forward, req.forward != nil
+	sess.affinity = s.sessionAffinity(conn, req.user)
+
+	s.mu.Lock()
+	s.waiting = append(s.waiting, sess)
+	s.mu.Unlock()
+	s.dispatch()
+
+	if reason := sess.pumpClient(s, reader); reason != "" {
+		s.closeConn(conn, "client", sess.clientID, reason)
+	}
+}
@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"contun/internal/pool"
+	"contun/internal/secure"
+)
+
+// noiseConfig builds the responder configuration for --noise-key and loads
+// the --noise-allow list. A nil allow list accepts any worker key.
+func (o *Options) noiseConfig() (*secure.Config, map[string]bool, error) {
+	text, err := pool.LoadSecret(o.NoiseKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read --noise-key: %w", err)
+	}
+	defer text.Wipe()
+	key, err := secure.ParsePrivateKey(text.Bytes())
+	if err != nil {
+		return nil, nil, fmt.Errorf("--noise-key: %w", err)
+	}
+	cfg := &secure.Config{StaticKey: key, Prologue: []byte(secure.Prologue)}
+	if o.NoiseAllowFile == "" {
+		return cfg, nil, nil
+	}
+
+	f, err := os.Open(o.NoiseAllowFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read --noise-allow: %w", err)
+	}
+	defer f.Close()
+	allow := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		pub, err := secure.ParsePublicKey(text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("--noise-allow line %d: %w", line, err)
+		}
+		allow[secure.EncodePublicKey(pub)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read --noise-allow: %w", err)
+	}
+	return cfg, allow, nil
+}
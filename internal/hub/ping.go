@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"contun/internal/pool"
+)
+
+// PingResult is a worker's answer to REQUEST PING.
+type PingResult struct {
+	Worker  int64         // worker that sent the probe
+	Address string        // address probed, after the worker resolved it
+	RTT     time.Duration // one round trip
+	Via     string        // "icmp", or "tcp" when the worker cannot send ICMP
+}
+
+// Ping asks the next idle worker that advertised ping to probe host from
+// the bastion and returns the round trip time. The worker times a TCP
+// connect to port (80 when 0) if it may not send ICMP echo requests.
+func (s *Server) Ping(ctx context.Context, host string, port int) (*PingResult, error) {
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", port)
+	}
+	id, line, bind, err := s.runProbe(ctx, &session{command: pool.CommandPing, dest: &destination{Host: host, Port: port}})
+	if err != nil {
+		return nil, err
+	}
+	result := &PingResult{Worker: id, Address: bind.Host}
+	for _, field := range strings.Fields(line) {
+		k, v, _ := strings.Cut(field, "=")
+		switch k {
+		case "rtt":
+			result.RTT, _ = time.ParseDuration(v)
+		case "via":
+			result.Via = v
+		}
+	}
+	return result, nil
+}
+
+// runProbe queues sess, a PING or SCAN of sess.dest.Host, for the next
+// idle worker with the capabilities it needs and waits for the reply. It
+// returns the worker's ID, the REPLY line and its bound address, or an
+// error when the probe could not be sent or the worker reported a failure.
+func (s *Server) runProbe(ctx context.Context, sess *session) (int64, string, *destination, error) {
+	host := sess.dest.Host
+	if err := sess.dest.classify(); err != nil {
+		return 0, "", nil, err
+	}
+
+	sess.clientID, sess.probe, sess.done = s.ids.Add(1), make(chan string, 1), make(chan struct{})
+	needs := sess.needs()
+	s.mu.Lock()
+	capable := false
+	for w := range s.workers {
+		capable = capable || w.supports(needs)
+	}
+	if !capable {
+		s.mu.Unlock()
+		return 0, "", nil, fmt.Errorf("no pool worker supports %s", strings.Join(needs, " with "))
+	}
+	s.waiting = append(s.waiting, sess)
+	s.mu.Unlock()
+	s.dispatch()
+
+	var line string
+	select {
+	case line = <-sess.probe:
+	case <-ctx.Done():
+		s.abandon(sess)
+		return 0, "", nil, ctx.Err()
+	}
+	s.mu.Lock()
+	id := sess.worker.id
+	s.mu.Unlock()
+	status, bind, err := parseReply(line)
+	switch {
+	case err != nil:
+		return 0, "", nil, fmt.Errorf("worker id=%d: %v", id, err)
+	case strings.HasPrefix(line, "ERR"):
+		return 0, "", nil, fmt.Errorf("worker id=%d: %s", id, line)
+	case status != 0:
+		return 0, "", nil, fmt.Errorf("worker id=%d: %s unreachable (status %d)", id, host, status)
+	}
+	return id, line, bind, nil
+}
+
+// answer hands a probe session the worker's reply. Only the first answer
+// counts; a probe whose caller gave up is not waiting for one.
+func (sess *session) answer(line string) {
+	select {
+	case sess.probe <- line:
+	default:
+	}
+}
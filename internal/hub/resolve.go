@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"contun/internal/pool"
+)
+
+// ResolveOn selects where the domain names SOCKS5 clients ask for are
+// resolved.
+type ResolveOn string
+
+const (
+	// ResolveOnPool passes names to the worker, which resolves them on the
+	// bastion.
+	ResolveOnPool ResolveOn = "pool"
+	// ResolveOnHub resolves names here, with --dns-server if set, and sends
+	// the worker an address.
+	ResolveOnHub ResolveOn = "hub"
+)
+
+// resolveTimeout bounds a --resolve-on hub lookup.
+const resolveTimeout = 5 * time.Second
+
+// resolveDest replaces the domain dest names with one of its addresses,
+// preferring IPv4 as poolgo does for UDP. A name that does not resolve
+// fails the SOCKS5 request with "host unreachable".
+func (s *Server) resolveDest(ctx context.Context, dest *destination) error {
+	if dest.AddrType != pool.AddrDomain {
+		return nil
+	}
+	resolver := s.opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupNetIP(ctx, "ip", dest.Host)
+	if err != nil || len(addrs) == 0 {
+		reason := "no addresses for " + dest.Host
+		if err != nil {
+			reason = err.Error()
+		}
+		return socksFailure(socksHostUnreachable, reason)
+	}
+	addr := addrs[0].Unmap()
+	for _, candidate := range addrs {
+		if candidate.Unmap().Is4() {
+			addr = candidate.Unmap()
+			break
+		}
+	}
+	s.logger.Printf("Resolved %s to %s", dest.Host, addr)
+	dest.AddrType, dest.Host = pool.AddrIPv4, addr.String()
+	if addr.Is6() {
+		dest.AddrType = pool.AddrIPv6
+	}
+	return nil
+}
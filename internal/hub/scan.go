@@ -0,0 +1,141 @@
+package hub
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contun/internal/pool"
+)
+
+// ScanResult is a worker's answer to REQUEST SCAN.
+type ScanResult struct {
+	Worker  int64        // worker that ran the scan
+	Address string       // address scanned, after the worker resolved it
+	Ports   []PortResult // in the order requested, or completed when streamed
+}
+
+// PortResult is the outcome of one connect probe in a scan.
+type PortResult struct {
+	Port   int
+	Status int           // SOCKS reply status: 0 open, 5 refused, 4 no answer
+	RTT    time.Duration // until the connect succeeded or failed
+	Banner []byte        // what the service sent first, when asked for
+}
+
+// Open reports whether the port accepted a connection.
+func (r PortResult) Open() bool { return r.Status == 0 }
+
+// Scan asks the next idle worker that advertised scan to try a TCP connect
+// to each of ports on host from the bastion, without bridging anything.
+// The worker probes several ports at once (its --scan-concurrency), which
+// is much faster than a session per port. At most pool.MaxScanPorts ports
+// fit in one scan. A positive banner asks the worker to also read up to
+// that many bytes from each open port, for services such as SSH and SMTP
+// that announce themselves; it needs a worker that advertised banner.
+func (s *Server) Scan(ctx context.Context, host string, ports []int, banner int) (*ScanResult, error) {
+	return s.ScanEach(ctx, host, ports, banner, nil)
+}
+
+// ScanEach is Scan, calling each with every port's result as soon as it is
+// known. A worker that advertised results reports ports as they complete,
+// in that order; for other workers each runs once the scan has finished.
+// each is called from the goroutine reading the worker, so it must not
+// block, and never after ScanEach returns. When ctx ends first, a worker
+// that advertised results is told to stop and ScanEach returns the ports
+// finished so far along with ctx.Err().
+func (s *Server) ScanEach(ctx context.Context, host string, ports []int, banner int, each func(PortResult)) (*ScanResult, error) {
+	if len(ports) == 0 || len(ports) > pool.MaxScanPorts {
+		return nil, fmt.Errorf("a scan needs 1 to %d ports, got %d", pool.MaxScanPorts, len(ports))
+	}
+	for _, port := range ports {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d", port)
+		}
+	}
+	if banner < 0 || banner > pool.MaxBanner || banner*len(ports) > pool.MaxBannerTotal {
+		return nil, fmt.Errorf("banner of %d bytes on %d ports exceeds the limit of %d per port and %d in all",
+			banner, len(ports), pool.MaxBanner, pool.MaxBannerTotal)
+	}
+
+	var (
+		mu       sync.Mutex
+		streamed []PortResult
+		returned bool
+	)
+	sess := &session{command: pool.CommandScan, dest: &destination{Host: host}, ports: pool.FormatPorts(ports), banner: banner}
+	sess.result = func(entry string) {
+		r, err := parsePortResult(entry)
+		if err != nil {
+			s.logger.Printf("Ignoring scan result: %v", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if returned {
+			return
+		}
+		streamed = append(streamed, r)
+		if each != nil {
+			each(r)
+		}
+	}
+	id, line, bind, err := s.runProbe(ctx, sess)
+	mu.Lock()
+	returned = true
+	done := streamed
+	mu.Unlock()
+	if err != nil {
+		if ctx.Err() != nil && len(done) > 0 {
+			return &ScanResult{Ports: done}, err
+		}
+		return nil, err
+	}
+
+	result := &ScanResult{Worker: id, Address: bind.Host, Ports: done}
+	for _, field := range strings.Fields(line) {
+		list, ok := strings.CutPrefix(field, "scan=")
+		if !ok {
+			continue
+		}
+		for _, entry := range strings.Split(list, ",") {
+			r, err := parsePortResult(entry)
+			if err != nil {
+				return nil, fmt.Errorf("worker id=%d: %v", id, err)
+			}
+			result.Ports = append(result.Ports, r)
+			if each != nil {
+				each(r)
+			}
+		}
+	}
+	return result, nil
+}
+
+// parsePortResult parses one "<port>:<status>:<rtt>[:<banner>]" entry of a
+// SCAN reply; the banner is unpadded base64.
+func parsePortResult(entry string) (PortResult, error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return PortResult{}, fmt.Errorf("malformed scan result %q", entry)
+	}
+	port, err1 := strconv.Atoi(fields[0])
+	status, err2 := strconv.Atoi(fields[1])
+	rtt, err3 := time.ParseDuration(fields[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return PortResult{}, fmt.Errorf("malformed scan result %q", entry)
+	}
+	r := PortResult{Port: port, Status: status, RTT: rtt}
+	if len(fields) == 4 {
+		banner, err := base64.RawStdEncoding.DecodeString(fields[3])
+		if err != nil {
+			return PortResult{}, fmt.Errorf("malformed banner in scan result %q", entry)
+		}
+		r.Banner = banner
+	}
+	return r, nil
+}
@@ -0,0 +1,638 @@
+package hub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"contun/internal/pool"
+	"contun/internal/secure"
+	"contun/internal/transport"
+)
+
+// maxBuffer caps client data held while a worker dials, like hub.pl's
+// per-direction safety limit.
+const maxBuffer = 1024 * 1024
+
+// handshakeTimeout bounds a worker's HELLO, authentication and Noise
+// handshake.
+const handshakeTimeout = 30 * time.Second
+
+// shutdownSendTimeout bounds writing SHUTDOWN to one worker, so a worker
+// that stopped reading cannot hold up the others.
+const shutdownSendTimeout = 5 * time.Second
+
+// Server pairs downstream clients with idle pool workers.
+type Server struct {
+	opts   Options
+	logger *log.Logger
+	noise  *secure.Config
+	allow  map[string]bool  // worker keys accepted by --noise-allow; nil accepts any
+	tun    *tunnel          // the --tun device, if any
+	extra  []clientListener // --http-port, --forward and --expose listeners
+	echo   net.Listener     // the --canary echo service, if any
+	canary canaryStatus
+
+	// usage meters every client listener, by port; listeners has them in
+	// the order they are reported. Both are set before clients connect.
+	usage     map[int]*listenerUsage
+	listeners []*listenerUsage
+
+	ids atomic.Int64
+	wg  sync.WaitGroup
+
+	mu         sync.Mutex
+	mode       Mode // active mode; ModeAuto until the first worker registers
+	modeSet    chan struct{}
+	idle       []*worker
+	waiting    []*session
+	workers    map[*worker]struct{}
+	conns      map[net.Conn]struct{}
+	closing    bool
+	sessionSeq int
+	lastDrift  string
+	affinity   map[string]*affinityEntry // by affinity key; see --affinity
+}
+
+// NewServer constructs a Server for the provided options.
+func NewServer(opts Options) *Server {
+	s := &Server{
+		opts:     opts,
+		logger:   log.Default(),
+		mode:     opts.Mode,
+		modeSet:  make(chan struct{}),
+		workers:  make(map[*worker]struct{}),
+		conns:    make(map[net.Conn]struct{}),
+		affinity: make(map[string]*affinityEntry),
+	}
+	if s.mode != ModeAuto {
+		close(s.modeSet)
+	}
+	return s
+}
+
+// Run binds both listeners and serves until the context is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	defer s.opts.AuthToken.Wipe()
+	defer s.opts.ShutdownKey.Wipe()
+	defer s.opts.SocksUsers.Wipe()
+
+	if s.opts.NoiseKeyFile != "" {
+		cfg, allow, err := s.opts.noiseConfig()
+		if err != nil {
+			return err
+		}
+		s.noise, s.allow = cfg, allow
+		s.logger.Printf("Noise: hub public key %s", secure.EncodePublicKey(cfg.StaticKey.PublicKey()))
+		if allow == nil {
+			s.logger.Printf("Noise: no --noise-allow given, accepting any worker key")
+		}
+	}
+
+	if s.opts.TUN != "" {
+		dev, err := pool.OpenTUN(s.opts.TUN)
+		if err != nil {
+			return fmt.Errorf("--tun: %w", err)
+		}
+		defer dev.Close()
+		s.tun = newTunnel(s.opts.TUN, dev)
+	}
+
+	clientLn, err := net.Listen("tcp", net.JoinHostPort(s.opts.ClientBind, strconv.Itoa(s.opts.ClientPort)))
+	if err != nil {
+		return fmt.Errorf("client listener: %w", err)
+	}
+	poolLn, err := net.Listen("tcp", net.JoinHostPort(s.opts.PoolBind, strconv.Itoa(s.opts.PoolPort)))
+	if err != nil {
+		_ = clientLn.Close()
+		return fmt.Errorf("pool listener: %w", err)
+	}
+	if err := s.listenExtra(); err != nil {
+		_ = clientLn.Close()
+		_ = poolLn.Close()
+		return err
+	}
+	var workerLns []net.Listener
+	if s.opts.QUICCertFile != "" {
+		quicLn, err := s.opts.listenQUIC()
+		if err != nil {
+			_ = clientLn.Close()
+			_ = poolLn.Close()
+			s.closeExtra()
+			return fmt.Errorf("quic listener: %w", err)
+		}
+		workerLns = append(workerLns, quicLn)
+	}
+	if s.opts.Canary != nil {
+		if s.echo, err = net.Listen("tcp", net.JoinHostPort(s.opts.PoolBind, strconv.Itoa(s.opts.Canary.Port))); err != nil {
+			_ = clientLn.Close()
+			_ = poolLn.Close()
+			s.closeExtra()
+			for _, ln := range workerLns {
+				_ = ln.Close()
+			}
+			return fmt.Errorf("canary echo listener: %w", err)
+		}
+	}
+	if s.opts.AdminSocket != "" {
+		adminLn, err := pool.ListenAdmin(s.opts.AdminSocket)
+		if err != nil {
+			_ = clientLn.Close()
+			_ = poolLn.Close()
+			s.closeExtra()
+			for _, ln := range workerLns {
+				_ = ln.Close()
+			}
+			if s.echo != nil {
+				_ = s.echo.Close()
+			}
+			return fmt.Errorf("admin socket: %w", err)
+		}
+		s.logger.Printf("Admin socket listening on %s", s.opts.AdminSocket)
+		go s.serveAdmin(ctx, adminLn)
+	}
+	return s.serve(ctx, clientLn, poolLn, workerLns...)
+}
+
+// clientListener accepts clients other than those of the client port.
+type clientListener struct {
+	ln     net.Listener
+	kind   string // who connects, for the log
+	handle func(context.Context, net.Conn)
+}
+
+// listenExtra opens the --http-port, --forward and --expose listeners.
+func (s *Server) listenExtra() error {
+	add := func(bind string, port int, kind string, handle func(context.Context, net.Conn)) error {
+		if bind == "" {
+			bind = s.opts.ClientBind
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(port)))
+		if err != nil {
+			s.closeExtra()
+			return err
+		}
+		s.extra = append(s.extra, clientListener{ln: ln, kind: kind, handle: handle})
+		return nil
+	}
+	if s.opts.HTTPPort > 0 {
+		if err := add("", s.opts.HTTPPort, "HTTP proxy clients", s.handleHTTPClient); err != nil {
+			return fmt.Errorf("http listener: %w", err)
+		}
+	}
+	for _, f := range s.opts.Forwards {
+		if err := add(f.Bind, f.Port, "forward clients to "+f.Dest.String(), s.handleForward(f)); err != nil {
+			return fmt.Errorf("--forward %s: %w", f, err)
+		}
+	}
+	for _, e := range s.opts.Exposes {
+		if err := add(e.Bind, e.Port, "clients of exposed service "+e.Name, s.handleExpose(e)); err != nil {
+			return fmt.Errorf("--expose %s: %w", e, err)
+		}
+	}
+	return nil
+}
+
+// closeExtra closes the listeners listenExtra opened.
+func (s *Server) closeExtra() {
+	for _, c := range s.extra {
+		_ = c.ln.Close()
+	}
+}
+
+// listenQUIC accepts workers over QUIC on the UDP pool port, with the
+// --quic-cert certificate.
+func (o *Options) listenQUIC() (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(o.QUICCertFile, o.QUICKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return transport.ListenQUIC(net.JoinHostPort(o.PoolBind, strconv.Itoa(o.PoolPort)), &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+// serve runs until ctx ends. Workers connect on poolLn and on any extra
+// listener, such as the QUIC one; other clients on those in s.extra.
+func (s *Server) serve(ctx context.Context, clientLn, poolLn net.Listener, extra ...net.Listener) error {
+	s.meterListeners(clientLn)
+	s.logger.Printf("Listening for clients on %s", clientLn.Addr())
+	for _, c := range s.extra {
+		s.logger.Printf("Listening for %s on %s", c.kind, c.ln.Addr())
+	}
+	s.logger.Printf("Listening for pool workers on %s", poolLn.Addr())
+	for _, ln := range extra {
+		s.logger.Printf("Listening for pool workers on %s/%s", ln.Addr().Network(), ln.Addr())
+	}
+	s.logger.Printf("Configured mode: %s", s.opts.Mode)
+	if s.opts.Mode != ModeAuto {
+		s.logger.Printf("Active mode pinned to %s", s.opts.Mode)
+	}
+
+	var listeners sync.WaitGroup
+	listeners.Add(1)
+	go func() {
+		defer listeners.Done()
+		s.acceptLoop(ctx, clientLn, s.handleClient)
+	}()
+	for _, c := range s.extra {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			s.acceptLoop(ctx, c.ln, c.handle)
+		}()
+	}
+	for _, ln := range append([]net.Listener{poolLn}, extra...) {
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			s.acceptLoop(ctx, ln, s.handleWorker)
+		}()
+	}
+	if s.echo != nil {
+		s.logger.Printf("Canary echo service listening on %s for %s", s.echo.Addr(), s.opts.Canary)
+		listeners.Add(1)
+		go func() {
+			defer listeners.Done()
+			s.acceptLoop(ctx, s.echo, s.handleEcho)
+		}()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runCanary(ctx)
+		}()
+	}
+	if s.tun != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.runTunnel(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+	_ = clientLn.Close()
+	_ = poolLn.Close()
+	s.closeExtra()
+	for _, ln := range extra {
+		_ = ln.Close()
+	}
+	if s.echo != nil {
+		_ = s.echo.Close()
+	}
+	listeners.Wait()
+
+	s.mu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return ctx.Err()
+}
+
+func (s *Server) acceptLoop(ctx context.Context, ln net.Listener, handle func(context.Context, net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Printf("accept on %s: %v", ln.Addr(), err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		if s.closing {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// closeConn closes a client or worker socket and logs why, mirroring
+// hub.pl's "Closed <type>" lines.
+func (s *Server) closeConn(conn net.Conn, kind string, id int64, reason string) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	_ = conn.Close()
+	s.logger.Printf("Closed %s (id=%d): %s", kind, id, reason)
+}
+
+// waitMode blocks until the hub has an active mode.
+func (s *Server) waitMode(ctx context.Context) (Mode, error) {
+	select {
+	case <-s.modeSet:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mode, nil
+}
+
+// hubCaps lists the worker capabilities this hub understands, in the order
+// they are acknowledged.
+func (s *Server) hubCaps() []string {
+	caps := []string{"affinity", "banner", "cancel", "client", "deadline", "heartbeat", "pattern", "ping", "progress", "results", "scan", "snappy", "udp", "window", "zstd"}
+	if s.noise != nil {
+		caps = append(caps, "noise")
+	}
+	if s.tun != nil {
+		caps = append(caps, "tun")
+	}
+	if len(s.opts.Exposes) > 0 {
+		caps = append(caps, "expose")
+	}
+	if s.opts.ShutdownKey != nil {
+		caps = append(caps, "identity")
+	}
+	return caps
+}
+
+// dispatch pairs waiting clients with idle workers and sends the REQUEST
+// lines.
+func (s *Server) dispatch() {
+	type assignment struct {
+		w    *worker
+		sess *session
+		line string
+	}
+	var assigned []assignment
+	var refused []*session
+	s.mu.Lock()
+	for i := 0; i < len(s.waiting) && len(s.idle) > 0; {
+		sess := s.waiting[i]
+		j := s.pickWorker(sess)
+		if j < 0 && s.unservable(sess) {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			refused = append(refused, sess)
+			continue
+		}
+		if j < 0 {
+			// Leave it queued for a capable worker; later sessions may
+			// still be served.
+			i++
+			continue
+		}
+		w := s.idle[j]
+		s.idle = append(s.idle[:j], s.idle[j+1:]...)
+		s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+		s.sessionSeq++
+		sess.id = s.sessionSeq
+		if w.mode == ModeDirect {
+			sess.dest = w.dest
+		}
+		if sess.expose != "" {
+			sess.dest = w.exposed[sess.expose]
+		}
+		command := pool.CommandConnect
+		if sess.udp != nil {
+			command = pool.CommandAssociate
+		} else if sess.tun != nil {
+			command = pool.CommandTUN
+		} else if sess.probe != nil {
+			command = sess.command
+		}
+		port := strconv.Itoa(sess.dest.Port)
+		if sess.ports != "" {
+			port = sess.ports
+		}
+		line := fmt.Sprintf("REQUEST %s %s %s %s", command, sess.dest.AddrType, sess.dest.Host, port)
+		if w.caps["cancel"] {
+			line += " " + strconv.Itoa(sess.id)
+		}
+		if sess.banner > 0 {
+			line += " banner=" + strconv.Itoa(sess.banner)
+		}
+		if sess.affinity != "" && w.caps["affinity"] {
+			line += " affinity=" + sess.affinity
+		}
+		if (command == pool.CommandConnect || command == pool.CommandAssociate) && w.caps["client"] {
+			line += sess.clientFields()
+		}
+		if command == pool.CommandConnect && s.opts.ConnectTimeout > 0 && w.caps["deadline"] {
+			line += " deadline=" + strconv.FormatInt(s.opts.ConnectTimeout.Milliseconds(), 10)
+		}
+		s.noteAffinity(sess.affinity, w)
+		w.state, w.session, sess.worker = workerAwaitReply, sess, w
+		assigned = append(assigned, assignment{w: w, sess: sess, line: line})
+	}
+	s.mu.Unlock()
+
+	for _, sess := range refused {
+		s.logger.Printf("No pool worker serves %s for client id=%d", sess.dest, sess.clientID)
+		sess.fail(s, socksNotAllowed, "no pool worker serves "+sess.dest.String())
+	}
+	for _, a := range assigned {
+		s.logger.Printf("Paired client id=%d with worker id=%d", a.sess.clientID, a.w.id)
+		if a.sess.udp != nil {
+			s.logger.Printf("Requesting ASSOCIATE for %s", a.sess.dest)
+		} else if a.sess.tun != nil {
+			s.logger.Printf("Requesting TUN for %s", a.sess.tun.t.name)
+		} else if a.sess.command == pool.CommandScan {
+			s.logger.Printf("Requesting SCAN of %s ports %s", a.sess.dest.Host, a.sess.ports)
+		} else if a.sess.probe != nil {
+			s.logger.Printf("Requesting PING to %s", a.sess.dest)
+		} else {
+			s.logger.Printf("Requesting CONNECT to %s", a.sess.dest)
+		}
+		if err := a.w.send(a.line); err != nil {
+			// The worker's reader notices the closed socket and fails the
+			// session.
+			_ = a.w.conn.Close()
+		}
+	}
+}
+
+// pickWorker returns the index of the idle worker to serve sess, or -1 if
+// none can. A session with an affinity key prefers the worker its key last
+// went to, then another worker from the same pool host, so the target sees
+// the same source address; otherwise the longest idle worker wins. A
+// client of an --expose listener only goes to a worker that exposes its
+// service, and other clients only to workers whose PATTERN lines cover
+// their destination. The caller holds s.mu.
+func (s *Server) pickWorker(sess *session) int {
+	needs := sess.needs()
+	prev := s.affinity[sess.affinity]
+	pick := -1
+	for i, w := range s.idle {
+		if w.stopped || !w.supports(needs) {
+			continue
+		}
+		if sess.expose != "" && w.exposed[sess.expose] == nil || sess.expose == "" && !w.serves(sess.dest) {
+			continue
+		}
+		if prev == nil || w == prev.worker {
+			return i
+		}
+		if pick < 0 || (w.source == prev.source && s.idle[pick].source != prev.source) {
+			pick = i
+		}
+	}
+	return pick
+}
+
+// unservable reports whether every registered worker sent PATTERN lines
+// and none covers sess's destination, so that it would wait for ever.
+// The caller holds s.mu.
+func (s *Server) unservable(sess *session) bool {
+	if sess.dest == nil || sess.expose != "" || len(s.workers) == 0 {
+		return false
+	}
+	for w := range s.workers {
+		if w.serves(sess.dest) {
+			return false
+		}
+	}
+	return true
+}
+
+// needs lists the capabilities a worker must have advertised to serve
+// sess: udp for UDP associations, tun for the tunnel, ping or scan for
+// probes and banner for a scan that reads banners. Plain CONNECTs need
+// none.
+func (sess *session) needs() []string {
+	switch {
+	case sess.udp != nil:
+		return []string{"udp"}
+	case sess.tun != nil:
+		return []string{"tun"}
+	case sess.probe != nil && sess.banner > 0:
+		return []string{strings.ToLower(sess.command), "banner"}
+	case sess.probe != nil:
+		return []string{strings.ToLower(sess.command)}
+	}
+	return nil
+}
+
+// BroadcastShutdown signs a SHUTDOWN message for every idle worker, naming
+// the worker when it announced an IDENTITY. The workers are held back from
+// dispatch until theirs is written, so it never lands in a stream; one that
+// cannot take it is disconnected.
+func (s *Server) BroadcastShutdown() {
+	if s.opts.ShutdownKey == nil {
+		s.logger.Printf("SIGUSR2 received but no --shutdown-key configured; ignoring")
+		return
+	}
+	s.mu.Lock()
+	idle := append([]*worker(nil), s.idle...)
+	for _, w := range idle {
+		w.stopped = true
+	}
+	s.mu.Unlock()
+	count := 0
+	for _, w := range idle {
+		s.mu.Lock()
+		// A worker that accepted identity only takes a SHUTDOWN naming it.
+		id := w.identity
+		ready := w.state == workerIdle && !w.leaving && (id != "" || !w.caps["identity"])
+		if !ready {
+			w.stopped = false
+		}
+		s.mu.Unlock()
+		if !ready {
+			continue
+		}
+		line := pool.SignShutdown(s.opts.ShutdownKey, id, time.Now(), randomHex(8))
+		if err := w.sendWithin(line, shutdownSendTimeout); err != nil {
+			// Part of the line may have gone out. The worker's reader
+			// notices the closed socket and drops it.
+			_ = w.conn.Close()
+			continue
+		}
+		count++
+		s.mu.Lock()
+		w.stopped = false
+		s.mu.Unlock()
+		s.dispatch()
+	}
+	s.logger.Printf("Sent SHUTDOWN to %d idle worker(s)", count)
+}
+
+// ReportFleet logs the distribution of version, protocol, feature and
+// configuration values reported by registered workers.
+func (s *Server) ReportFleet() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Printf("Fleet: %d registered worker(s)", len(s.workers))
+	for _, key := range []string{"version", "proto", "features", "config"} {
+		dist := make(map[string]int)
+		for w := range s.workers {
+			value := w.stats[key]
+			if value == "" {
+				value = "unknown"
+			}
+			dist[value]++
+		}
+		line := formatDistribution(dist, func(a, b string) bool {
+			if dist[a] != dist[b] {
+				return dist[a] > dist[b]
+			}
+			return a < b
+		})
+		if line == "" {
+			line = "none"
+		}
+		s.logger.Printf("Fleet %-9s %s", key+":", line)
+	}
+}
+
+// checkDrift logs when registered workers stop agreeing on a configuration
+// hash. The caller holds s.mu.
+func (s *Server) checkDrift() {
+	configs := make(map[string]int)
+	for w := range s.workers {
+		if w.config != "" {
+			configs[w.config]++
+		}
+	}
+	report := formatDistribution(configs, func(a, b string) bool { return a < b })
+	if report == s.lastDrift {
+		return
+	}
+	s.lastDrift = report
+	if len(configs) > 1 {
+		s.logger.Printf("Config drift: workers report %d distinct configurations (%s)", len(configs), report)
+	} else {
+		s.logger.Printf("Worker configuration consistent (%s)", report)
+	}
+}
+
+func formatDistribution(dist map[string]int, less func(a, b string) bool) string {
+	keys := make([]string, 0, len(dist))
+	for k := range dist {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s x%d", k, dist[k])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,405 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"contun/internal/pool"
+)
+
+// session is one downstream client, from its SOCKS or HTTP proxy request
+// (or connect, in direct mode) until its stream ends.
+type session struct {
+	clientID int64
+	client   net.Conn
+	socks    bool
+	http     bool         // an --http-port client
+	forward  bool         // an --http-forward request, answered by the target itself
+	udp      *udpRelay    // set for SOCKS5 UDP ASSOCIATE sessions
+	tun      *tunConn     // set for sessions carrying the --tun device
+	probe    chan string  // set for Ping and Scan; receives the worker's reply
+	command  string       // probe command, pool.CommandPing or pool.CommandScan
+	ports    string       // port list sent in place of the port by Scan
+	banner   int          // banner bytes Scan asks for from each open port
+	result   func(string) // receives streamed RESULT entries for Scan
+	affinity string       // --affinity key, if any
+	expose   string       // the --expose service a client of its listener wants
+
+	// Guarded by Server.mu.
+	id     int
+	dest   *destination
+	worker *worker
+
+	mu       sync.Mutex
+	pending  []byte         // client bytes received before the worker replied
+	wconn    net.Conn       // worker connection once streaming
+	compress string         // algorithm compressing the stream, if any
+	activity *activity      // set while streaming with --idle-timeout
+	usage    *listenerUsage // the client's listener, for TCP streams
+	closed   bool           // the session ended before streaming
+	ended    int            // stream directions finished
+	expired  string         // the timeout that ended the stream, if one did
+	reason   string
+	done     chan struct{}
+}
+
+func (s *Server) handleClient(ctx context.Context, conn net.Conn) {
+	sess := &session{clientID: s.ids.Add(1), client: conn, done: make(chan struct{})}
+	s.logger.Printf("Client connected (id=%d)", sess.clientID)
+
+	mode, err := s.waitMode(ctx)
+	if err != nil {
+		s.closeConn(conn, "client", sess.clientID, "hub shutting down")
+		return
+	}
+	reader := bufio.NewReader(conn)
+	var user string // the SOCKS5 username, with --socks-users
+	if mode == ModeSocks {
+		sess.socks = true
+		var auth socksAuthenticator
+		if s.opts.SocksUsers != nil {
+			auth = func(user, pass []byte) bool {
+				return checkSocksUser(s.opts.SocksUsers.Bytes(), user, pass)
+			}
+		}
+		req, err := readSocksRequest(reader, conn, auth)
+		if err == nil && req.command == socksCmdAssociate {
+			sess.udp, err = s.newAssociation(conn, req.dest)
+		} else if err == nil && s.opts.ResolveOn == ResolveOnHub {
+			err = s.resolveDest(ctx, req.dest)
+		}
+		if err != nil {
+			var socksErr *socksError
+			if errors.As(err, &socksErr) {
+				_, _ = conn.Write(socksErr.reply)
+			} else {
+				err = readError(err)
+			}
+			s.closeConn(conn, "client", sess.clientID, err.Error())
+			return
+		}
+		if req.user != "" {
+			s.logger.Printf("SOCKS user '%s' authenticated (id=%d)", req.user, sess.clientID)
+		}
+		sess.dest = req.dest
+		user = req.user
+	}
+	sess.affinity = s.sessionAffinity(conn, user)
+	if sess.udp != nil {
+		defer sess.udp.Close()
+	}
+
+	s.mu.Lock()
+	s.waiting = append(s.waiting, sess)
+	s.mu.Unlock()
+	s.dispatch()
+
+	if reason := sess.pumpClient(s, reader); reason != "" {
+		s.closeConn(conn, "client", sess.clientID, reason)
+	}
+}
+
+// clientFields are the REQUEST options naming the session's client for
+// workers that advertised client: its address and the ID in the hub's log.
+func (sess *session) clientFields() string {
+	fields := " client-id=" + strconv.FormatInt(sess.clientID, 10)
+	if addr, ok := sess.client.RemoteAddr().(*net.TCPAddr); ok {
+		ap := addr.AddrPort()
+		fields = " client=" + netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String() + fields
+	}
+	return fields
+}
+
+// pumpClient buffers client data until the worker replies and then streams
+// it to the worker. It returns the reason for closing the client, or "" if
+// the session was already failed and closed.
+func (sess *session) pumpClient(s *Server, reader *bufio.Reader) string {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(buf)
+		sess.mu.Lock()
+		if wconn := sess.wconn; wconn != nil && sess.udp != nil {
+			sess.mu.Unlock()
+			// The TCP connection only keeps a UDP association alive.
+			if err == nil {
+				_, err = io.Copy(io.Discard, reader)
+			} else if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			_ = sess.udp.Close()
+			closeWrite(wconn)
+			sess.endDirection(s, true, err)
+			<-sess.done
+			return "association ended"
+		} else if wconn != nil {
+			sess.mu.Unlock()
+			if n > 0 {
+				sess.activity.touch()
+				if _, werr := wconn.Write(buf[:n]); werr != nil {
+					err = werr
+				} else {
+					sess.usage.sent(n)
+				}
+			}
+			if err == nil {
+				_, err = io.CopyBuffer(wconn, sess.activity.reader(sess.usage.fromClient(reader)), buf)
+			} else if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			closeWrite(wconn)
+			sess.mu.Lock()
+			expired := sess.expired != ""
+			sess.mu.Unlock()
+			if expired {
+				// The target may stay open as long as the client did.
+				_ = wconn.Close()
+			}
+			sess.endDirection(s, true, err)
+			<-sess.done
+			return "stream ended"
+		}
+		if sess.closed {
+			sess.mu.Unlock()
+			return ""
+		}
+		if len(sess.pending)+n > maxBuffer {
+			sess.closed = true
+			sess.mu.Unlock()
+			s.abandon(sess)
+			return "client pending buffer limit exceeded"
+		}
+		sess.pending = append(sess.pending, buf[:n]...)
+		if err != nil {
+			sess.closed = true
+			sess.mu.Unlock()
+			s.abandon(sess)
+			return readError(err).Error()
+		}
+		sess.mu.Unlock()
+	}
+}
+
+// abandon withdraws a session whose client left before streaming. Workers
+// that advertised cancel are told to abort their dial; others are closed
+// once they reply.
+func (s *Server) abandon(sess *session) {
+	s.mu.Lock()
+	for i, waiting := range s.waiting {
+		if waiting == sess {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			s.mu.Unlock()
+			return
+		}
+	}
+	// A probe is not cancelled, except for a scan on a worker that
+	// advertised results: the worker replies within a bounded time and
+	// stays idle, and its late answer is dropped.
+	w := sess.worker
+	cancellable := sess.probe == nil || (sess.command == pool.CommandScan && w != nil && w.caps["results"])
+	if w == nil || w.session != sess || w.state != workerAwaitReply || !w.caps["cancel"] || !cancellable {
+		s.mu.Unlock()
+		return
+	}
+	w.state = workerCancelling
+	s.mu.Unlock()
+
+	s.logger.Printf("Cancelling session %d on worker id=%d", sess.id, w.id)
+	if err := w.send("CANCEL " + strconv.Itoa(sess.id)); err != nil {
+		_ = w.conn.Close()
+	}
+}
+
+// fail ends a session whose worker could not connect. SOCKS and HTTP proxy
+// clients get a failure reply before the connection closes.
+func (sess *session) fail(s *Server, status int, reason string) {
+	if sess.probe != nil {
+		sess.answer("ERR " + reason)
+		return
+	}
+	sess.mu.Lock()
+	if sess.closed || sess.wconn != nil {
+		sess.mu.Unlock()
+		return
+	}
+	sess.closed = true
+	sess.mu.Unlock()
+	switch {
+	case sess.socks:
+		_, _ = sess.client.Write(socksReply(status, nil))
+	case sess.http:
+		_, _ = sess.client.Write(httpResponse(httpStatus(status), reason))
+	}
+	s.closeConn(sess.client, "client", sess.clientID, reason)
+}
+
+// startStream confirms the connection to the client, flushes the data it
+// sent while waiting and switches both sides to raw streaming. It reports
+// false if the client has already gone.
+func (sess *session) startStream(s *Server, w *worker, bind *destination) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return false
+	}
+	s.mu.Lock()
+	w.state = workerStream
+	s.mu.Unlock()
+	if sess.udp != nil {
+		// Clients send datagrams to the hub's relay, not to the worker's
+		// socket; anything sent on the TCP connection is ignored.
+		bind = sess.udp.bind()
+		sess.pending = nil
+	}
+	var reply []byte
+	switch {
+	case sess.socks:
+		reply = socksReply(0, bind)
+	case sess.http && !sess.forward:
+		reply = httpEstablished
+	}
+	if reply != nil {
+		if _, err := sess.client.Write(reply); err != nil {
+			sess.closed = true
+			s.closeConn(sess.client, "client", sess.clientID, "write error: "+err.Error())
+			return false
+		}
+	}
+	wconn := w.conn
+	if sess.udp == nil && sess.tun == nil {
+		sess.usage = s.usageFor(sess.client)
+		if sess.compress = w.compression(); sess.compress != "" {
+			// NewCompressConn only fails for an unknown algorithm.
+			wconn, _ = pool.NewCompressConn(w.conn, sess.compress)
+		}
+	}
+	if len(sess.pending) > 0 {
+		if _, err := wconn.Write(sess.pending); err != nil {
+			sess.closed = true
+			s.closeConn(sess.client, "client", sess.clientID, "worker disconnected")
+			return false
+		}
+		sess.usage.sent(len(sess.pending))
+		sess.pending = nil
+	}
+	sess.wconn = wconn
+	sess.usage.start()
+	if sess.udp == nil && sess.tun == nil {
+		if idle, maxDuration := s.sessionTimeouts(sess.client); idle > 0 || maxDuration > 0 {
+			if idle > 0 {
+				sess.activity = &activity{}
+				sess.activity.touch()
+			}
+			go sess.watchTimeouts(s, w, idle, maxDuration)
+		}
+	}
+	if sess.udp != nil {
+		go sess.udp.forwardClient(w.conn)
+		s.logger.Printf("UDP association active client id=%d <-> worker id=%d via %s", sess.clientID, w.id, sess.udp.pc.LocalAddr())
+		return true
+	}
+	if sess.tun != nil {
+		sess.tun.start()
+		s.logger.Printf("Tunnel %s active via worker id=%d", sess.tun.t.name, w.id)
+		return true
+	}
+	if sess.compress != "" {
+		s.logger.Printf("Stream active client id=%d <-> worker id=%d (%s, %s)", sess.clientID, w.id, sess.dest, sess.compress)
+		return true
+	}
+	s.logger.Printf("Stream active client id=%d <-> worker id=%d (%s)", sess.clientID, w.id, sess.dest)
+	return true
+}
+
+// pumpWorker streams worker data to the client until the worker finishes,
+// then waits for the client direction.
+func (sess *session) pumpWorker(s *Server, reader io.Reader) string {
+	var err error
+	if sess.compress != "" {
+		// NewDecompressReader only fails for an unknown algorithm.
+		reader, _ = pool.NewDecompressReader(reader, sess.compress)
+	}
+	if sess.udp != nil {
+		err = sess.udp.forwardWorker(reader)
+	} else {
+		_, err = io.Copy(sess.client, sess.activity.reader(sess.usage.toClient(reader)))
+	}
+	closeWrite(sess.client)
+	sess.endDirection(s, false, err)
+	<-sess.done
+	return "stream ended"
+}
+
+// endDirection records one finished stream direction. The first direction
+// to finish decides the teardown reason; once both are done the session
+// ends and both connections are closed.
+func (sess *session) endDirection(s *Server, fromClient bool, err error) {
+	sess.mu.Lock()
+	sess.ended++
+	if sess.ended == 1 {
+		sess.reason = sess.expired
+		if sess.reason == "" {
+			sess.reason = teardownReason(s, fromClient, err)
+		}
+	}
+	done := sess.ended == 2
+	sess.mu.Unlock()
+	if !done {
+		return
+	}
+	s.logger.Printf("Session %d ended: %s", sess.id, sess.reason)
+	sess.usage.end()
+	close(sess.done)
+}
+
+// teardownReason uses the codes poolgo records in its session audit
+// records.
+func teardownReason(s *Server, fromClient bool, err error) string {
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	switch {
+	case closing:
+		return "admin-kill"
+	case err != nil && !errors.Is(err, net.ErrClosed):
+		return "error"
+	case fromClient:
+		return "client-closed"
+	default:
+		return "target-closed"
+	}
+}
+
+// closeWrite half-closes conn when it supports that and closes it
+// otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+// newAssociation prepares a UDP ASSOCIATE session. It is refused up front
+// when no registered worker can relay UDP.
+func (s *Server) newAssociation(conn net.Conn, dest *destination) (*udpRelay, error) {
+	s.mu.Lock()
+	capable := false
+	for w := range s.workers {
+		capable = capable || w.caps["udp"]
+	}
+	s.mu.Unlock()
+	if !capable {
+		return nil, socksFailure(socksCommandNotSupported, "no pool worker supports UDP")
+	}
+	relay, err := newUDPRelay(conn, dest)
+	if err != nil {
+		return nil, socksFailure(socksGeneralFailure, "udp relay: "+err.Error())
+	}
+	return relay, nil
+}
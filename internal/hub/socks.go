@@ -0,0 +1,315 @@
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"contun/internal/pool"
+)
+
+// SOCKS5 reply codes used by the hub itself (RFC 1928 section 6). Worker
+// REPLY statuses are passed through unchanged.
+const (
+	socksGeneralFailure      = 1
+	socksNotAllowed          = 2
+	socksHostUnreachable     = 4
+	socksTTLExpired          = 6
+	socksCommandNotSupported = 7
+	socksAddrNotSupported    = 8
+)
+
+// destination is a target requested by a client or declared by a direct
+// mode worker.
+type destination struct {
+	AddrType pool.AddrType
+	Host     string
+	Port     int
+}
+
+func (d *destination) String() string {
+	if d == nil {
+		return "unknown"
+	}
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
+// classify sets d's address type from its host, an IPv4 or IPv6 address
+// or else a domain, and checks the host.
+func (d *destination) classify() error {
+	d.AddrType = pool.AddrDomain
+	if ip := net.ParseIP(d.Host); ip != nil {
+		d.AddrType = pool.AddrIPv4
+		if ip.To4() == nil {
+			d.AddrType = pool.AddrIPv6
+		}
+	}
+	return validateAddress(d.AddrType, d.Host)
+}
+
+// SOCKS5 commands the hub accepts (RFC 1928 section 4).
+const (
+	socksCmdConnect   = 1
+	socksCmdAssociate = 3
+)
+
+// SOCKS5 authentication methods (RFC 1928 section 3).
+const (
+	socksMethodNone         = 0
+	socksMethodUserPass     = 2
+	socksMethodUnacceptable = 0xFF
+)
+
+// socksError carries the bytes to send before closing the client: a
+// request reply, or a method selection or RFC 1929 status during
+// negotiation.
+type socksError struct {
+	reply  []byte
+	reason string
+}
+
+func (e *socksError) Error() string { return e.reason }
+
+func socksFailure(code int, reason string) *socksError {
+	return &socksError{reply: socksReply(code, nil), reason: reason}
+}
+
+// socksAuthenticator checks an RFC 1929 username and password.
+type socksAuthenticator func(user, pass []byte) bool
+
+// socksRequest is a client request that passed negotiation.
+type socksRequest struct {
+	command byte // socksCmdConnect or socksCmdAssociate
+	dest    *destination
+	user    string // authenticated username, if any
+}
+
+// readSocksRequest runs the server side of a SOCKS5 handshake and returns
+// the client's CONNECT or UDP ASSOCIATE request. With a nil auth the
+// client must offer "no authentication"; otherwise it must offer and pass
+// username/password authentication. Negotiation replies are written to w;
+// the final reply is sent once a worker has answered.
+func readSocksRequest(r *bufio.Reader, w io.Writer, auth socksAuthenticator) (*socksRequest, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != 5 {
+		return nil, socksFailure(socksGeneralFailure, "unsupported socks version")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksMethodNone)
+	if auth != nil {
+		method = socksMethodUserPass
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		return nil, &socksError{reply: []byte{5, socksMethodUnacceptable}, reason: "no supported auth methods"}
+	}
+	if _, err := w.Write([]byte{5, method}); err != nil {
+		return nil, err
+	}
+	req := &socksRequest{}
+	if auth != nil {
+		var err error
+		if req.user, err = readSocksUserPass(r, w, auth); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	req.command, req.dest, err = readSocksCommand(r)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// readSocksUserPass runs the RFC 1929 sub-negotiation and returns the
+// accepted username.
+func readSocksUserPass(r *bufio.Reader, w io.Writer, auth socksAuthenticator) (string, error) {
+	version, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != 1 {
+		return "", &socksError{reply: []byte{1, 1}, reason: "unsupported username/password auth version"}
+	}
+	user, err := readSocksField(r)
+	if err != nil {
+		return "", err
+	}
+	pass, err := readSocksField(r)
+	if err != nil {
+		return "", err
+	}
+	defer clear(pass)
+	if !auth(user, pass) {
+		return "", &socksError{reply: []byte{1, 1}, reason: fmt.Sprintf("socks authentication failed for user '%s'", user)}
+	}
+	if _, err := w.Write([]byte{1, 0}); err != nil {
+		return "", err
+	}
+	return string(user), nil
+}
+
+// readSocksField reads a length-prefixed RFC 1929 field.
+func readSocksField(r *bufio.Reader) ([]byte, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, n)
+	if _, err := io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+// readSocksCommand reads the client request that follows negotiation.
+func readSocksCommand(r *bufio.Reader) (byte, *destination, error) {
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil {
+		return 0, nil, err
+	}
+	if req[0] != 5 {
+		return 0, nil, socksFailure(socksGeneralFailure, "unsupported socks version")
+	}
+	if req[1] != socksCmdConnect && req[1] != socksCmdAssociate {
+		return 0, nil, socksFailure(socksCommandNotSupported, "command not supported")
+	}
+	dest := &destination{}
+	switch req[3] {
+	case 1:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return 0, nil, err
+		}
+		dest.AddrType, dest.Host = pool.AddrIPv4, net.IP(addr).String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return 0, nil, err
+		}
+		if err := validateAddress(pool.AddrDomain, string(name)); err != nil {
+			return 0, nil, socksFailure(socksGeneralFailure, err.Error())
+		}
+		dest.AddrType, dest.Host = pool.AddrDomain, string(name)
+	case 4:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return 0, nil, err
+		}
+		dest.AddrType, dest.Host = pool.AddrIPv6, net.IP(addr).String()
+	default:
+		return 0, nil, socksFailure(socksAddrNotSupported, "address type not supported")
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return 0, nil, err
+	}
+	dest.Port = int(binary.BigEndian.Uint16(port[:]))
+	return req[1], dest, nil
+}
+
+// socksReply encodes a SOCKS5 reply. Worker statuses above 255 become a
+// general failure, as in hub.pl.
+func socksReply(status int, bind *destination) []byte {
+	code := byte(socksGeneralFailure)
+	if status >= 0 && status <= 0xFF {
+		code = byte(status)
+	}
+	out := []byte{5, code, 0}
+	host, port := "0.0.0.0", 0
+	atype := pool.AddrIPv4
+	if bind != nil {
+		atype, host, port = bind.AddrType, bind.Host, bind.Port
+	}
+	switch ip := net.ParseIP(host); {
+	case atype == pool.AddrDomain:
+		name := host[:min(len(host), 255)]
+		out = append(out, 3, byte(len(name)))
+		out = append(out, name...)
+	case atype == pool.AddrIPv6 && ip != nil:
+		out = append(out, 4)
+		out = append(out, ip.To16()...)
+	case ip != nil && ip.To4() != nil:
+		out = append(out, 1)
+		out = append(out, ip.To4()...)
+	default:
+		out = append(out, 1, 0, 0, 0, 0)
+	}
+	return binary.BigEndian.AppendUint16(out, uint16(port))
+}
+
+// validateAddress checks the textual address of a DEST or REPLY field.
+func validateAddress(atype pool.AddrType, text string) error {
+	switch atype {
+	case pool.AddrIPv4:
+		if ip := net.ParseIP(text); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid IPv4 address '%s'", text)
+		}
+	case pool.AddrIPv6:
+		if ip := net.ParseIP(text); ip == nil || !strings.Contains(text, ":") {
+			return fmt.Errorf("invalid IPv6 address '%s'", text)
+		}
+	case pool.AddrDomain:
+		if text == "" {
+			return fmt.Errorf("domain empty")
+		}
+		if len(text) > 255 {
+			return fmt.Errorf("domain too long")
+		}
+	default:
+		return fmt.Errorf("unknown address type '%s'", atype)
+	}
+	return nil
+}
+
+// parseSocksUsers checks a --socks-users file: one user:password entry per
+// line, blank lines and # comments ignored.
+func parseSocksUsers(data []byte) error {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		user, pass, ok := bytes.Cut(line, []byte(":"))
+		if !ok || len(user) == 0 || len(pass) == 0 {
+			return fmt.Errorf("line %d: expected user:password", i+1)
+		}
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("line %d: user and password are limited to 255 bytes", i+1)
+		}
+	}
+	return nil
+}
+
+// checkSocksUser reports whether user and pass match an entry of a
+// --socks-users file. Passwords are compared in constant time.
+func checkSocksUser(data, user, pass []byte) bool {
+	ok := false
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		u, p, _ := bytes.Cut(line, []byte(":"))
+		if bytes.Equal(u, user) && subtle.ConstantTimeCompare(p, pass) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
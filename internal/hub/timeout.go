@@ -0,0 +1,183 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerTimeout is an --idle-timeout or --max-duration value: a limit
+// for the streams of clients of the listener on Port, or of every client
+// listener when Port is 0.
+type ListenerTimeout struct {
+	Port  int
+	Limit time.Duration
+}
+
+func (t ListenerTimeout) String() string {
+	if t.Port == 0 {
+		return t.Limit.String()
+	}
+	return strconv.Itoa(t.Port) + "=" + t.Limit.String()
+}
+
+// ParseListenerTimeout parses "[<port>=]<duration>".
+func ParseListenerTimeout(text string) (ListenerTimeout, error) {
+	var t ListenerTimeout
+	limit := text
+	if port, rest, ok := strings.Cut(text, "="); ok {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return t, fmt.Errorf("port must be between 1 and 65535")
+		}
+		t.Port, limit = n, rest
+	}
+	d, err := time.ParseDuration(limit)
+	if err != nil || d <= 0 {
+		return t, fmt.Errorf("expected [<port>=]<duration> with a positive duration")
+	}
+	t.Limit = d
+	return t, nil
+}
+
+// listenerList collects repeated per-listener values: --idle-timeout,
+// --max-duration or --listener-rate-limit.
+type listenerList []string
+
+func (l *listenerList) String() string { return strings.Join(*l, ",") }
+
+func (l *listenerList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// limitFor returns the limit in list for the listener on port: its own,
+// or else the one for every listener, or 0 for none.
+func limitFor(list []ListenerTimeout, port int) time.Duration {
+	var limit time.Duration
+	for _, t := range list {
+		if t.Port == port {
+			return t.Limit
+		}
+		if t.Port == 0 {
+			limit = t.Limit
+		}
+	}
+	return limit
+}
+
+// listenerPorts lists the ports of the hub's client listeners, which
+// --idle-timeout, --max-duration and --listener-rate-limit may name.
+func (o *Options) listenerPorts() []int {
+	ports := []int{o.ClientPort}
+	if o.HTTPPort > 0 {
+		ports = append(ports, o.HTTPPort)
+	}
+	for _, f := range o.Forwards {
+		ports = append(ports, f.Port)
+	}
+	for _, e := range o.Exposes {
+		ports = append(ports, e.Port)
+	}
+	return ports
+}
+
+// sessionTimeouts returns the idle and maximum stream durations for a
+// client that connected to conn's listener.
+func (s *Server) sessionTimeouts(conn net.Conn) (idle, maxDuration time.Duration) {
+	port := 0
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	return limitFor(s.opts.IdleTimeouts, port), limitFor(s.opts.MaxDurations, port)
+}
+
+// activity records when a stream last carried data in either direction,
+// for --idle-timeout.
+type activity struct{ last atomic.Int64 }
+
+func (a *activity) touch() {
+	if a != nil {
+		a.last.Store(time.Now().UnixNano())
+	}
+}
+
+// reader returns r, noting each read that returns data.
+func (a *activity) reader(r io.Reader) io.Reader {
+	if a == nil {
+		return r
+	}
+	return &activeReader{r: r, a: a}
+}
+
+type activeReader struct {
+	r io.Reader
+	a *activity
+}
+
+func (r *activeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.a.touch()
+	}
+	return n, err
+}
+
+// watchTimeouts ends sess's stream once it has been idle for idle or open
+// for maxDuration, whichever comes first; a zero value disables either.
+// It returns when the session ends.
+func (sess *session) watchTimeouts(s *Server, w *worker, idle, maxDuration time.Duration) {
+	start := time.Now()
+	for {
+		now := time.Now()
+		reason, wait := "", time.Duration(0)
+		if maxDuration > 0 {
+			if wait = start.Add(maxDuration).Sub(now); wait <= 0 {
+				reason = "quota"
+			}
+		}
+		if idle > 0 && reason == "" {
+			idleWait := time.Unix(0, sess.activity.last.Load()).Add(idle).Sub(now)
+			if idleWait <= 0 {
+				reason = "idle-timeout"
+			} else if wait <= 0 || idleWait < wait {
+				wait = idleWait
+			}
+		}
+		if reason != "" {
+			sess.expire(s, w, reason)
+			return
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-sess.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// expire closes a stream that ran past a timeout. A protocol 2 worker is
+// told why in a NOTICE; every worker sees the client side of the stream
+// end as if the client had closed it, so it closes its target cleanly.
+func (sess *session) expire(s *Server, w *worker, reason string) {
+	sess.mu.Lock()
+	sess.expired = reason
+	wconn, ended := sess.wconn, sess.ended
+	sess.mu.Unlock()
+	s.logger.Printf("Closing session %d (client id=%d): %s", sess.id, sess.clientID, reason)
+	if w.frames != nil {
+		_ = w.send(fmt.Sprintf("NOTICE session %d closed by hub: %s", sess.id, reason))
+	}
+	_ = sess.client.Close()
+	if ended > 0 {
+		// One direction already finished; the other may be the one that
+		// never does.
+		_ = wconn.Close()
+	}
+}
@@ -0,0 +1,209 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"contun/internal/pool"
+)
+
+// tunnelRetry is how long the hub waits before offering the tunnel to a
+// worker again when the previous session failed or ended quickly.
+const tunnelRetry = time.Second
+
+// tunnel owns the hub's --tun device. Packets the kernel routes into it are
+// relayed through one worker that advertised tun at a time; while no
+// worker holds the tunnel they are dropped, as on a link that is down.
+type tunnel struct {
+	dev     io.ReadWriteCloser
+	name    string
+	peer    *destination // the hub's tunnel address, named in REQUEST TUN
+	packets chan []byte
+	active  atomic.Bool // a session is streaming
+}
+
+func newTunnel(name string, dev io.ReadWriteCloser) *tunnel {
+	return &tunnel{dev: dev, name: name, peer: interfaceAddress(name), packets: make(chan []byte, 64)}
+}
+
+// interfaceAddress returns the first IPv4 address of the named interface,
+// or its first IPv6 address, or 0.0.0.0 when it has none yet.
+func interfaceAddress(name string) *destination {
+	dest := &destination{AddrType: pool.AddrIPv4, Host: "0.0.0.0"}
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return dest
+	}
+	addrs, _ := ifi.Addrs()
+	var v6 *destination
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			return &destination{AddrType: pool.AddrIPv4, Host: ip.String()}
+		}
+		if v6 == nil {
+			v6 = &destination{AddrType: pool.AddrIPv6, Host: ipnet.IP.String()}
+		}
+	}
+	if v6 != nil {
+		return v6
+	}
+	return dest
+}
+
+// readDevice hands packets from the device to the active session until
+// the device is closed.
+func (t *tunnel) readDevice() {
+	defer close(t.packets)
+	for {
+		buf := make([]byte, pool.MaxDatagram)
+		n, err := t.dev.Read(buf)
+		if err != nil {
+			return
+		}
+		if !t.active.Load() {
+			continue
+		}
+		select {
+		case t.packets <- buf[:n]:
+		default:
+			// The worker link is not keeping up; drop like a full queue.
+		}
+	}
+}
+
+// tunConn is one worker session's view of the tunnel: a net.Conn whose
+// byte stream is the datagram framing, so the session plumbing used for
+// clients carries packets unchanged.
+type tunConn struct {
+	t      *tunnel
+	closed chan struct{}
+	once   sync.Once
+
+	frame []byte // framed packet being read
+	rest  []byte // unread part of frame
+	wbuf  []byte // incomplete frame written by the worker side
+}
+
+func (t *tunnel) attach() *tunConn {
+	return &tunConn{t: t, closed: make(chan struct{})}
+}
+
+// start lets packets from the device through once the worker replied.
+func (c *tunConn) start() {
+	c.t.active.Store(true)
+}
+
+func (c *tunConn) Read(p []byte) (int, error) {
+	for len(c.rest) == 0 {
+		select {
+		case <-c.closed:
+			return 0, io.EOF
+		case packet, ok := <-c.t.packets:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.frame = binary.BigEndian.AppendUint16(c.frame[:0], uint16(len(packet)))
+			c.frame = append(c.frame, packet...)
+			c.rest = c.frame
+		}
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write takes framed packets from the worker and writes each complete one
+// to the device.
+func (c *tunConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	for len(c.wbuf) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < n {
+			break
+		}
+		// A packet the kernel refuses is lost, as on a real link.
+		_, _ = c.t.dev.Write(c.wbuf[2:n])
+		c.wbuf = c.wbuf[:copy(c.wbuf, c.wbuf[n:])]
+	}
+	return len(p), nil
+}
+
+// CloseWrite ends the session when the worker finishes: the tunnel has no
+// half-open state.
+func (c *tunConn) CloseWrite() error {
+	return c.Close()
+}
+
+// Close ends the session. The device stays open for the next one.
+func (c *tunConn) Close() error {
+	c.once.Do(func() {
+		c.t.active.Store(false)
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *tunConn) LocalAddr() net.Addr                { return tunAddr(c.t.name) }
+func (c *tunConn) RemoteAddr() net.Addr               { return tunAddr(c.t.name) }
+func (c *tunConn) SetDeadline(t time.Time) error      { return nil }
+func (c *tunConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tunConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// tunAddr names the tunnel device in place of a socket address.
+type tunAddr string
+
+func (a tunAddr) Network() string { return "tun" }
+func (a tunAddr) String() string  { return string(a) }
+
+// runTunnel keeps the --tun device attached to a worker: it queues a
+// tunnel session, waits for it to end and queues the next one.
+func (s *Server) runTunnel(ctx context.Context) {
+	go s.tun.readDevice()
+	mode, err := s.waitMode(ctx)
+	if err != nil {
+		return
+	}
+	if mode != ModeSocks {
+		s.logger.Printf("Tunnel %s disabled: TUN workers run in socks mode, hub is in %s mode", s.tun.name, mode)
+		return
+	}
+	s.logger.Printf("Tunnel %s waiting for a worker (hub address %s)", s.tun.name, s.tun.peer.Host)
+	for {
+		conn := s.tun.attach()
+		s.mu.Lock()
+		if s.closing || ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		sess := &session{clientID: s.ids.Add(1), client: conn, tun: conn, dest: s.tun.peer, done: make(chan struct{})}
+		s.mu.Lock()
+		s.waiting = append(s.waiting, sess)
+		s.mu.Unlock()
+		s.dispatch()
+
+		started := time.Now()
+		if reason := sess.pumpClient(s, bufio.NewReader(conn)); reason != "" {
+			s.closeConn(conn, "tunnel", sess.clientID, reason)
+		}
+		if time.Since(started) < tunnelRetry {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tunnelRetry):
+			}
+		}
+	}
+}
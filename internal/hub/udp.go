@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+
+	"contun/internal/pool"
+)
+
+// udpRelay is the hub's UDP socket for one SOCKS5 UDP ASSOCIATE client.
+// Client datagrams are framed onto the worker connection and the worker's
+// frames are sent back to the client with a SOCKS5 UDP header.
+type udpRelay struct {
+	pc         *net.UDPConn
+	clientIP   netip.Addr // datagrams from other addresses are dropped
+	clientPort uint16     // expected source port; 0 accepts any
+
+	mu     sync.Mutex
+	client netip.AddrPort // learned from the first accepted datagram
+}
+
+// newUDPRelay binds a UDP socket on the address the client reached the hub
+// on. dest is the source address the client announced in its request.
+func newUDPRelay(conn net.Conn, dest *destination) (*udpRelay, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		return nil, err
+	}
+	remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	return &udpRelay{pc: pc, clientIP: remote.Addr().Unmap(), clientPort: uint16(dest.Port)}, nil
+}
+
+// bind is the relay address reported to the client in the SOCKS reply.
+func (r *udpRelay) bind() *destination {
+	addr := r.pc.LocalAddr().(*net.UDPAddr).AddrPort()
+	ip := addr.Addr().Unmap()
+	atype := pool.AddrIPv4
+	if ip.Is6() {
+		atype = pool.AddrIPv6
+	}
+	return &destination{AddrType: atype, Host: ip.String(), Port: int(addr.Port())}
+}
+
+func (r *udpRelay) Close() error {
+	return r.pc.Close()
+}
+
+// forwardClient frames client datagrams onto the worker connection until
+// the relay socket is closed. Fragmented datagrams are dropped, as RFC 1928
+// allows.
+func (r *udpRelay) forwardClient(wconn net.Conn) {
+	buf := make([]byte, 3+pool.MaxDatagram)
+	for {
+		n, from, err := r.pc.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != r.clientIP || (r.clientPort != 0 && from.Port() != r.clientPort) {
+			continue
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		body := buf[3:n]
+		if _, _, _, _, err := pool.ParseDatagram(body); err != nil {
+			continue
+		}
+		r.mu.Lock()
+		r.client = from
+		r.mu.Unlock()
+		if err := pool.WriteDatagram(wconn, body); err != nil {
+			return
+		}
+	}
+}
+
+// forwardWorker sends the worker's reply frames to the client until the
+// worker ends the association.
+func (r *udpRelay) forwardWorker(reader io.Reader) error {
+	buf := make([]byte, pool.MaxDatagram)
+	out := make([]byte, 0, 3+pool.MaxDatagram)
+	for {
+		body, err := pool.ReadDatagram(reader, buf)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		r.mu.Lock()
+		client := r.client
+		r.mu.Unlock()
+		if !client.IsValid() {
+			continue
+		}
+		out = append(append(out[:0], 0, 0, 0), body...)
+		_, _ = r.pc.WriteToUDPAddrPort(out, client)
+	}
+}
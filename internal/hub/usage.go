@@ -0,0 +1,181 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"contun/internal/pool"
+)
+
+// ListenerRate is a --listener-rate-limit value: the bytes per second the
+// clients of the listener on Port may move together in each direction, or
+// those of each client listener when Port is 0.
+type ListenerRate struct {
+	Port int
+	Rate int64
+}
+
+func (r ListenerRate) String() string {
+	if r.Port == 0 {
+		return pool.FormatRate(r.Rate)
+	}
+	return strconv.Itoa(r.Port) + "=" + pool.FormatRate(r.Rate)
+}
+
+// ParseListenerRate parses "[<port>=]<rate>", with the rate written as for
+// poolgo --rate-limit.
+func ParseListenerRate(text string) (ListenerRate, error) {
+	var r ListenerRate
+	rate := text
+	if port, rest, ok := strings.Cut(text, "="); ok {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return r, fmt.Errorf("port must be between 1 and 65535")
+		}
+		r.Port, rate = n, rest
+	}
+	n, err := pool.ParseRate(rate)
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("expected [<port>=]<rate> with a rate such as 512K or 10M")
+	}
+	r.Rate = n
+	return r, nil
+}
+
+// rateFor returns the limit in list for the listener on port: its own, or
+// else the one for every listener, or 0 for none.
+func rateFor(list []ListenerRate, port int) int64 {
+	var rate int64
+	for _, r := range list {
+		if r.Port == port {
+			return r.Rate
+		}
+		if r.Port == 0 {
+			rate = r.Rate
+		}
+	}
+	return rate
+}
+
+// listenerUsage meters the streams of one client listener, for the admin
+// socket's usage command, and holds its --listener-rate-limit. Bytes are
+// counted as they are carried between the client and the worker; UDP
+// associations and the packet tunnel are not metered.
+type listenerUsage struct {
+	addr string
+	kind string
+
+	streams     atomic.Int64 // streams started
+	active      atomic.Int64 // streams not yet ended
+	fromClients atomic.Int64 // bytes sent on to workers
+	toClients   atomic.Int64 // bytes sent back to clients
+
+	upload, download *pool.RateLimiter // nil without --listener-rate-limit
+}
+
+// meterListeners sets up the usage of the client listener and those in
+// s.extra, before any client is accepted.
+func (s *Server) meterListeners(clientLn net.Listener) {
+	s.usage = make(map[int]*listenerUsage)
+	add := func(ln net.Listener, kind string) {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok {
+			return
+		}
+		u := &listenerUsage{addr: addr.String(), kind: kind}
+		if rate := rateFor(s.opts.ListenerRates, addr.Port); rate > 0 {
+			u.upload, u.download = pool.NewRateLimiter(rate), pool.NewRateLimiter(rate)
+		}
+		s.usage[addr.Port] = u
+		s.listeners = append(s.listeners, u)
+	}
+	add(clientLn, "clients")
+	for _, c := range s.extra {
+		add(c.ln, c.kind)
+	}
+}
+
+// usageFor returns the usage of the listener conn was accepted on, or nil.
+func (s *Server) usageFor(conn net.Conn) *listenerUsage {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return s.usage[addr.Port]
+	}
+	return nil
+}
+
+// The methods below are no-ops on a nil *listenerUsage, which sessions on
+// unmetered listeners have.
+
+func (u *listenerUsage) start() {
+	if u != nil {
+		u.streams.Add(1)
+		u.active.Add(1)
+	}
+}
+
+func (u *listenerUsage) end() {
+	if u != nil {
+		u.active.Add(-1)
+	}
+}
+
+// sent counts n bytes a client sent that went on to its worker outside
+// fromClient's reader.
+func (u *listenerUsage) sent(n int) {
+	if u != nil {
+		u.fromClients.Add(int64(n))
+	}
+}
+
+// fromClient returns r, reading a client's stream, metered and held to the
+// listener's upload limit. A wait for the limit is not cut short when the
+// stream closes; the read after it fails instead.
+func (u *listenerUsage) fromClient(r io.Reader) io.Reader {
+	if u == nil {
+		return r
+	}
+	if u.upload != nil {
+		r = u.upload.Reader(context.Background(), r)
+	}
+	return &countingReader{r: r, n: &u.fromClients}
+}
+
+// toClient returns r, reading the worker's side of a stream, metered and
+// held to the listener's download limit.
+func (u *listenerUsage) toClient(r io.Reader) io.Reader {
+	if u == nil {
+		return r
+	}
+	if u.download != nil {
+		r = u.download.Reader(context.Background(), r)
+	}
+	return &countingReader{r: r, n: &u.toClients}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// writeUsage writes one line per client listener for the admin socket.
+func (s *Server) writeUsage(w io.Writer) {
+	for _, u := range s.listeners {
+		rate := int64(0)
+		if u.upload != nil {
+			rate = u.upload.Rate()
+		}
+		fmt.Fprintf(w, "listener %s streams=%d active=%d from_clients=%d to_clients=%d rate_limit=%s kind=%q\n",
+			u.addr, u.streams.Load(), u.active.Load(), u.fromClients.Load(), u.toClients.Load(), pool.FormatRate(rate), u.kind)
+	}
+}
@@ -0,0 +1,588 @@
+package hub
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contun/internal/pool"
+	"contun/internal/secure"
+	"contun/internal/websocket"
+)
+
+type workerState int
+
+const (
+	workerHandshake workerState = iota
+	workerIdle
+	workerAwaitReply
+	workerCancelling
+	workerStream
+)
+
+// worker is one registered pool connection.
+type worker struct {
+	id     int64
+	conn   net.Conn
+	source string // the pool host, as the hub sees it
+	mode   Mode
+	dest   *destination
+	caps   map[string]bool
+
+	// frames carries the connection once a protocol 2 worker registered;
+	// conn then points at it too, so stream data is framed.
+	frames *pool.FrameConn
+
+	wmu sync.Mutex // serialises control writes
+
+	// Guarded by Server.mu.
+	state    workerState
+	session  *session
+	stats    map[string]string
+	config   string
+	leaving  bool                    // sent GOODBYE; gets no more requests
+	stopped  bool                    // being sent SHUTDOWN; gets no requests meanwhile
+	identity string                  // from IDENTITY; its SHUTDOWN must name it
+	exposed  map[string]*destination // services offered with EXPOSE, by name
+	pattern  []pool.ACLRule          // the only destinations it serves, from PATTERN; nil for any
+}
+
+// send writes one control line to the worker.
+func (w *worker) send(line string) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	return w.sendLocked(line)
+}
+
+// sendWithin is send with a write deadline of timeout, for lines written
+// outside the worker's own goroutine.
+func (w *worker) sendWithin(line string, timeout time.Duration) error {
+	w.wmu.Lock()
+	defer w.wmu.Unlock()
+	_ = w.conn.SetWriteDeadline(time.Now().Add(timeout))
+	defer func() { _ = w.conn.SetWriteDeadline(time.Time{}) }()
+	return w.sendLocked(line)
+}
+
+func (w *worker) sendLocked(line string) error {
+	if w.frames != nil {
+		return w.frames.WriteControl(line)
+	}
+	_, err := io.WriteString(w.conn, line+"\n")
+	return err
+}
+
+// readControl reads the worker's next control message.
+func (w *worker) readControl(reader *bufio.Reader) (string, error) {
+	if w.frames != nil {
+		return w.frames.ReadControl()
+	}
+	return readLine(reader)
+}
+
+// compression returns the algorithm CONNECT streams on this worker are
+// compressed with, or "" when it offered none.
+func (w *worker) compression() string {
+	for _, alg := range []string{pool.CompressZstd, pool.CompressSnappy} {
+		if w.caps[alg] {
+			return alg
+		}
+	}
+	return ""
+}
+
+// supports reports whether the worker advertised every capability in caps.
+func (w *worker) supports(caps []string) bool {
+	for _, c := range caps {
+		if !w.caps[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// serves reports whether the PATTERN lines w sent, if any, cover dest.
+// The caller holds Server.mu.
+func (w *worker) serves(dest *destination) bool {
+	if w.pattern == nil || dest == nil {
+		return true
+	}
+	for _, r := range w.pattern {
+		if r.Matches(dest.Host, dest.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleWorker(ctx context.Context, raw net.Conn) {
+	w := &worker{id: s.ids.Add(1), conn: raw, source: workerSource(raw)}
+	s.logger.Printf("Worker connected (id=%d)", w.id)
+
+	_ = raw.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(raw)
+	if websocket.IsUpgrade(reader) {
+		// A worker started with --hub-url, possibly relayed by a reverse
+		// proxy; the hub protocol runs inside the WebSocket.
+		ws, _, err := websocket.Upgrade(raw, reader)
+		if err != nil {
+			s.dropWorker(w, raw, err.Error())
+			return
+		}
+		s.logger.Printf("Worker id=%d connected over WebSocket", w.id)
+		raw, w.conn = ws, ws
+		reader = bufio.NewReader(ws)
+	}
+	reader, err := s.registerWorker(w, reader)
+	if err != nil {
+		s.dropWorker(w, raw, err.Error())
+		return
+	}
+	s.dispatch()
+	s.dropWorker(w, raw, s.serveWorker(w, reader))
+}
+
+// registerWorker runs the HELLO, optional CHALLENGE/AUTH and optional Noise
+// handshake, then adds the worker to the idle pool.
+func (s *Server) registerWorker(w *worker, reader *bufio.Reader) (*bufio.Reader, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, readError(err)
+	}
+	var version int
+	if version, w.mode, w.dest, w.caps, err = parseHello(line); err != nil {
+		return nil, err
+	}
+
+	if token := s.opts.AuthToken; token != nil {
+		nonce := randomHex(16)
+		if err := w.send("CHALLENGE " + nonce); err != nil {
+			return nil, err
+		}
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, readError(err)
+		}
+		ok, err := verifyAuth(token, nonce, line)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			s.logger.Printf("Rejecting worker id=%d: authentication failed", w.id)
+			_ = w.send("ERR auth failed")
+			return nil, errors.New("authentication failed")
+		}
+	}
+	if s.noise != nil && !w.caps["noise"] {
+		s.logger.Printf("Rejecting worker id=%d: Noise encryption required", w.id)
+		_ = w.send("ERR noise required")
+		return nil, errors.New("noise required")
+	}
+
+	if err := s.admit(w); err != nil {
+		// Version 1 workers just see the hang-up, as with hub.pl. Newer
+		// ones are told why, so they do not mistake it for a hub that
+		// only speaks version 1.
+		if version >= 2 {
+			_ = w.send("ERR " + err.Error())
+		}
+		return nil, err
+	}
+	var acked []string
+	for _, c := range s.hubCaps() {
+		if w.caps[c] {
+			acked = append(acked, c)
+		}
+	}
+	ok := "OK"
+	if len(acked) > 0 {
+		ok += " CAPS " + strings.Join(acked, ",")
+	}
+	if err := w.send(ok); err != nil {
+		return nil, err
+	}
+
+	if s.noise != nil {
+		if reader.Buffered() > 0 {
+			return nil, errors.New("unexpected data before Noise handshake")
+		}
+		conn, err := secure.Server(w.conn, *s.noise)
+		if err != nil {
+			return nil, fmt.Errorf("noise handshake failed: %v", err)
+		}
+		key := secure.EncodePublicKey(conn.PeerKey())
+		if s.allow != nil && !s.allow[key] {
+			s.logger.Printf("Rejecting worker id=%d: Noise key %s not allowed", w.id, key)
+			return nil, errors.New("noise key not allowed")
+		}
+		s.logger.Printf("Worker id=%d Noise key %s", w.id, key)
+		w.conn = conn
+		reader = bufio.NewReader(conn)
+	}
+	if version >= 2 {
+		w.frames = pool.NewFrameConn(w.conn, reader)
+		w.frames.OnControl = func(line string) { s.handleWorkerInfo(w, line) }
+		if s.opts.MaxFrameSize > 0 {
+			w.frames.SetMaxFrameSize(s.opts.MaxFrameSize)
+		}
+		if w.caps["window"] {
+			window := pool.FlowWindow
+			if s.opts.FlowWindow > 0 {
+				window = s.opts.FlowWindow
+			}
+			w.frames.SetWindow(window)
+		}
+		w.conn = w.frames
+	}
+
+	_ = w.conn.SetDeadline(time.Time{})
+	s.mu.Lock()
+	w.state = workerIdle
+	s.idle = append(s.idle, w)
+	s.mu.Unlock()
+	if w.mode == ModeDirect {
+		s.logger.Printf("Worker id=%d registered direct target %s", w.id, w.dest)
+	} else {
+		s.logger.Printf("Worker id=%d registered in socks mode", w.id)
+	}
+	return reader, nil
+}
+
+// admit checks the worker's mode against the hub, adopting it when the hub
+// runs in auto mode and no mode is active yet.
+func (s *Server) admit(w *worker) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.mode == ModeAuto:
+		s.mode = w.mode
+		close(s.modeSet)
+		s.logger.Printf("Active mode set to %s", s.mode)
+	case s.mode != w.mode:
+		s.logger.Printf("Rejecting worker id=%d with mode %s (hub mode %s)", w.id, w.mode, s.mode)
+		return errors.New("mode mismatch")
+	}
+	s.workers[w] = struct{}{}
+	return nil
+}
+
+// serveWorker reads control lines until the worker disconnects or its
+// stream ends, and returns the reason for closing it.
+func (s *Server) serveWorker(w *worker, reader *bufio.Reader) string {
+	for {
+		line, err := w.readControl(reader)
+		if err != nil {
+			return readError(err).Error()
+		}
+		if line == "" || s.handleWorkerInfo(w, line) {
+			continue
+		}
+		if seq, ok := strings.CutPrefix(line, "PING"); ok {
+			s.answerPing(w, seq)
+			continue
+		}
+
+		s.mu.Lock()
+		state, sess := w.state, w.session
+		s.mu.Unlock()
+		switch state {
+		case workerIdle:
+			// Ignore keepalives or noise.
+		case workerAwaitReply:
+			status, bind, err := parseReply(line)
+			if err != nil {
+				return err.Error()
+			}
+			if sess.probe != nil {
+				s.release(w)
+				sess.answer(line)
+				continue
+			}
+			if status != 0 {
+				s.logger.Printf("Worker id=%d reported failure status=%d", w.id, status)
+				s.release(w)
+				sess.fail(s, status, fmt.Sprintf("worker failure status=%d", status))
+				continue
+			}
+			if !sess.startStream(s, w, bind) {
+				return "missing client for reply"
+			}
+			if w.frames != nil {
+				return sess.pumpWorker(s, w.frames)
+			}
+			return sess.pumpWorker(s, reader)
+		case workerCancelling:
+			status, _, err := parseReply(line)
+			if err != nil {
+				return err.Error()
+			}
+			if sess.probe != nil {
+				// A scan that finished before the CANCEL arrived leaves the
+				// worker idle all the same.
+				s.logger.Printf("Worker id=%d cancelled session %d", w.id, sess.id)
+				s.release(w)
+				sess.answer(line)
+				continue
+			}
+			if status == 0 {
+				// The dial won the race against CANCEL; nobody is left to
+				// stream to.
+				return "stream opened after cancel"
+			}
+			s.logger.Printf("Worker id=%d cancelled session %d", w.id, sess.id)
+			s.release(w)
+		}
+	}
+}
+
+// answerPing replies PONG to an idle worker's heartbeat. A worker that was
+// just handed a REQUEST gets no answer: the REQUEST shows the hub is alive,
+// and a PONG queued behind it could end up inside a version 1 stream. The
+// check and the write happen under s.mu so dispatch cannot slip a REQUEST
+// in between.
+func (s *Server) answerPing(w *worker, seq string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.state == workerIdle {
+		_ = w.send("PONG" + seq)
+	}
+}
+
+// release returns a worker to the idle pool after a request finished
+// without streaming.
+func (s *Server) release(w *worker) {
+	s.mu.Lock()
+	w.state, w.session = workerIdle, nil
+	if !w.leaving {
+		s.idle = append(s.idle, w)
+	}
+	s.mu.Unlock()
+	s.dispatch()
+}
+
+// dropWorker forgets a worker and closes its connection. A client still
+// waiting on the worker's reply is failed.
+func (s *Server) dropWorker(w *worker, raw net.Conn, reason string) {
+	s.mu.Lock()
+	for i, idle := range s.idle {
+		if idle == w {
+			s.idle = append(s.idle[:i], s.idle[i+1:]...)
+			break
+		}
+	}
+	_, registered := s.workers[w]
+	delete(s.workers, w)
+	s.forgetWorker(w)
+	state, sess := w.state, w.session
+	w.session = nil
+	if registered && w.config != "" {
+		s.checkDrift()
+	}
+	s.mu.Unlock()
+
+	s.closeConn(raw, "worker", w.id, reason)
+	if state != workerAwaitReply || sess == nil {
+		return
+	}
+	if w.leaving && s.requeue(sess) {
+		// The REQUEST crossed the worker's GOODBYE; another worker can
+		// still serve the client.
+		s.logger.Printf("Requeued client id=%d from draining worker id=%d", sess.clientID, w.id)
+		s.dispatch()
+		return
+	}
+	sess.fail(s, socksGeneralFailure, "worker disconnected")
+}
+
+// requeue puts a session whose worker left before replying back at the
+// head of the queue. It reports false if the client has gone meanwhile.
+func (s *Server) requeue(sess *session) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.closed {
+		return false
+	}
+	s.mu.Lock()
+	sess.worker = nil
+	s.waiting = append([]*session{sess}, s.waiting...)
+	s.mu.Unlock()
+	return true
+}
+
+// handleWorkerInfo logs NOTICE, PROGRESS and STATS lines, hands RESULT
+// lines to the scan waiting for them, records EXPOSE, PATTERN and IDENTITY
+// lines and retires workers that said GOODBYE. It reports whether the line was informational.
+func (s *Server) handleWorkerInfo(w *worker, line string) bool {
+	verb, rest, _ := strings.Cut(line, " ")
+	switch verb {
+	case "NOTICE":
+		s.logger.Printf("Worker id=%d notice: %s", w.id, rest)
+	case "PROGRESS":
+		s.mu.Lock()
+		sess := w.session
+		waiting := w.state == workerAwaitReply
+		s.mu.Unlock()
+		if waiting {
+			s.logger.Printf("Client id=%d waiting on worker id=%d: %s", sess.clientID, w.id, rest)
+		}
+	case "RESULT":
+		s.mu.Lock()
+		sess := w.session
+		waiting := w.state == workerAwaitReply && sess != nil && sess.result != nil
+		s.mu.Unlock()
+		if waiting {
+			sess.result(rest)
+		}
+	case "EXPOSE":
+		s.noteExpose(w, rest)
+	case "PATTERN":
+		rule, err := pool.ParseACLRule(rest)
+		if err != nil {
+			s.logger.Printf("Worker id=%d: invalid pattern '%s': %v", w.id, rest, err)
+			break
+		}
+		s.mu.Lock()
+		w.pattern = append(w.pattern, rule)
+		s.mu.Unlock()
+		s.logger.Printf("Worker id=%d serves destinations matching %s", w.id, rule)
+		s.dispatch()
+	case "IDENTITY":
+		s.mu.Lock()
+		w.identity = rest
+		s.mu.Unlock()
+	case "GOODBYE":
+		s.mu.Lock()
+		w.leaving = true
+		for i, idle := range s.idle {
+			if idle == w {
+				s.idle = append(s.idle[:i], s.idle[i+1:]...)
+				break
+			}
+		}
+		s.mu.Unlock()
+		s.logger.Printf("Worker id=%d is draining", w.id)
+	case "STATS":
+		stats := make(map[string]string)
+		for _, field := range strings.Fields(rest) {
+			if k, v, ok := strings.Cut(field, "="); ok {
+				stats[k] = v
+			}
+		}
+		s.mu.Lock()
+		w.stats = stats
+		if config := stats["config"]; config != "" && config != w.config {
+			w.config = config
+			s.checkDrift()
+		}
+		s.mu.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+// parseHello parses "HELLO <version> <mode> [DEST <atype> <addr> <port>]
+// [CAPS <list>]" for protocol versions 1 and 2.
+func parseHello(line string) (int, Mode, *destination, map[string]bool, error) {
+	parts := strings.Fields(line)
+	if len(parts) < 3 || parts[0] != "HELLO" || (parts[1] != "1" && parts[1] != "2") {
+		return 0, "", nil, nil, fmt.Errorf("unexpected hello line '%s'", line)
+	}
+	version, _ := strconv.Atoi(parts[1])
+	mode := Mode(strings.ToLower(parts[2]))
+	if mode != ModeDirect && mode != ModeSocks {
+		return 0, "", nil, nil, fmt.Errorf("unsupported worker mode '%s'", mode)
+	}
+
+	caps := make(map[string]bool)
+	if n := len(parts); n >= 5 && parts[n-2] == "CAPS" {
+		for _, c := range strings.Split(parts[n-1], ",") {
+			caps[strings.ToLower(c)] = true
+		}
+		parts = parts[:n-2]
+	}
+
+	if mode == ModeSocks {
+		if len(parts) > 3 {
+			return 0, "", nil, nil, fmt.Errorf("unexpected tokens in socks mode hello")
+		}
+		return version, mode, nil, caps, nil
+	}
+	if len(parts) != 7 || parts[3] != "DEST" {
+		return 0, "", nil, nil, fmt.Errorf("direct mode requires DEST parameters")
+	}
+	port, err := strconv.Atoi(parts[6])
+	if err != nil || port < 1 || port > 65535 {
+		return 0, "", nil, nil, fmt.Errorf("invalid direct destination port '%s'", parts[6])
+	}
+	dest := &destination{AddrType: pool.AddrType(parts[4]), Host: parts[5], Port: port}
+	if err := validateAddress(dest.AddrType, dest.Host); err != nil {
+		return 0, "", nil, nil, fmt.Errorf("invalid direct destination address: %v", err)
+	}
+	return version, mode, dest, caps, nil
+}
+
+// parseReply parses "REPLY <status> [<atype> <addr> <port>]" or "ERR ...",
+// which counts as a general failure. Invalid bind addresses fall back to
+// 0.0.0.0:0.
+func parseReply(line string) (int, *destination, error) {
+	parts := strings.Fields(line)
+	if len(parts) >= 1 && parts[0] == "ERR" {
+		return socksGeneralFailure, nil, nil
+	}
+	if len(parts) < 2 || parts[0] != "REPLY" {
+		return 0, nil, fmt.Errorf("unexpected worker response '%s'", line)
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || status < 0 {
+		status = 0
+	}
+	bind := &destination{AddrType: pool.AddrIPv4, Host: "0.0.0.0"}
+	if len(parts) >= 5 {
+		port, err := strconv.Atoi(parts[4])
+		if validateAddress(pool.AddrType(parts[2]), parts[3]) == nil && err == nil && port >= 0 && port <= 65535 {
+			bind = &destination{AddrType: pool.AddrType(parts[2]), Host: parts[3], Port: port}
+		}
+	}
+	return status, bind, nil
+}
+
+// verifyAuth checks an "AUTH HMAC <hex>" or "AUTH <token>" line against the
+// token and the nonce sent in CHALLENGE.
+func verifyAuth(token *pool.Secret, nonce, line string) (bool, error) {
+	parts := strings.Fields(line)
+	switch {
+	case len(parts) == 3 && parts[0] == "AUTH" && parts[1] == "HMAC":
+		want := hex.EncodeToString(token.MAC([]byte(nonce)))
+		return hmac.Equal([]byte(strings.ToLower(parts[2])), []byte(want)), nil
+	case len(parts) == 2 && parts[0] == "AUTH":
+		return subtle.ConstantTimeCompare([]byte(parts[1]), token.Bytes()) == 1, nil
+	}
+	return false, fmt.Errorf("expected AUTH, got '%s'", line)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readError renders a read failure the way hub.pl logs closed sockets.
+func readError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return errors.New("peer closed")
+	}
+	return fmt.Errorf("read error: %v", err)
+}
@@ -0,0 +1,378 @@
+// Package logx is the thin layer between the pool and the standard log
+// package that lets --log-format json turn its output into structured
+// records. Code keeps logging through *log.Logger; in JSON mode the logger
+// writes to an encoder that wraps each line in a record, and Log attaches
+// fields such as the worker, session and destination to it. --log-level
+// filters what each module writes; see At.
+package logx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Format selects how log output is written.
+type Format string
+
+const (
+	// Text is the plain log package output: a timestamp, a prefix such
+	// as "[pool worker 3] " and the message.
+	Text Format = "text"
+	// JSON writes one JSON object per line with "time", "msg" and any
+	// fields, for ingestion into ELK, Loki and the like.
+	JSON Format = "json"
+)
+
+// ParseFormat returns the Format named s, ignoring case.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case Text, JSON:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q", s)
+}
+
+// encoder writes JSON records to out. Loggers derived with New share the
+// encoder and add their own fields.
+type encoder struct {
+	mu  sync.Mutex
+	out io.Writer
+	now func() time.Time
+}
+
+// Level orders records by severity. Records below the level --log-level
+// sets for their module are dropped.
+type Level int8
+
+const (
+	Trace Level = -8
+	Debug Level = -4
+	Info  Level = 0
+	Warn  Level = 4
+	Error Level = 8
+)
+
+var levelNames = map[Level]string{Trace: "trace", Debug: "debug", Info: "info", Warn: "warn", Error: "error"}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int8(l))
+}
+
+// ParseLevel returns the Level named s, ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Levels is a --log-level setting: the level of each module it names and
+// the default for the rest. The zero value logs Info and above everywhere.
+type Levels struct {
+	Default Level
+	Modules map[string]Level
+}
+
+// ParseLevels parses a --log-level value, a comma-separated list of levels
+// for modules ("proto=trace") and at most one bare default level, as in
+// "warn,proto=trace". Only the given modules may be named.
+func ParseLevels(spec string, modules []string) (Levels, error) {
+	var levels Levels
+	seenDefault := false
+	for _, item := range strings.Split(spec, ",") {
+		module, name, named := strings.Cut(strings.TrimSpace(item), "=")
+		if !named {
+			module, name = "", module
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return Levels{}, err
+		}
+		_, dup := levels.Modules[module]
+		switch {
+		case !named && seenDefault:
+			return Levels{}, fmt.Errorf("more than one default level")
+		case !named:
+			levels.Default, seenDefault = level, true
+		case !slices.Contains(modules, module):
+			return Levels{}, fmt.Errorf("unknown module %q (want one of %s)", module, strings.Join(modules, ", "))
+		case dup:
+			return Levels{}, fmt.Errorf("module %s given twice", module)
+		default:
+			if levels.Modules == nil {
+				levels.Modules = make(map[string]Level)
+			}
+			levels.Modules[module] = level
+		}
+	}
+	return levels, nil
+}
+
+func (l Levels) String() string {
+	items := []string{l.Default.String()}
+	for module, level := range l.Modules {
+		items = append(items, module+"="+level.String())
+	}
+	slices.Sort(items[1:])
+	return strings.Join(items, ",")
+}
+
+func (l Levels) enabled(module string, level Level) bool {
+	min, ok := l.Modules[module]
+	if !ok {
+		min = l.Default
+	}
+	return level >= min
+}
+
+var current atomic.Pointer[Levels]
+
+// SetLevels makes levels the --log-level setting of every logger.
+func SetLevels(levels Levels) {
+	current.Store(&levels)
+}
+
+// Enabled reports whether module logs records of level.
+func Enabled(module string, level Level) bool {
+	levels := current.Load()
+	if levels == nil {
+		return level >= Info
+	}
+	return levels.enabled(module, level)
+}
+
+var discard = log.New(io.Discard, "", 0)
+
+// At returns the logger to write a record of module and level through:
+// one that discards it when --log-level filters it out, or one deriving
+// from l otherwise, whose JSON records carry the module and level. Plain
+// writes to a logger from Setup or New count as Info for the component.
+func At(l *log.Logger, module string, level Level) *log.Logger {
+	if !Enabled(module, level) {
+		return discard
+	}
+	w, ok := l.Writer().(*writer)
+	if !ok {
+		return l
+	}
+	at := &writer{enc: w.enc, out: w.out, fields: w.fields, module: module, level: level, redact: w.redact, replacer: w.replacer}
+	if w.enc != nil {
+		at.fields = append(append([]any(nil), w.fields...), "module", module, "level", level.String())
+	}
+	return log.New(at, l.Prefix(), l.Flags())
+}
+
+// Redact derives a logger from l that writes replacement wherever a record
+// would show secret, in its text and in its fields.
+func Redact(l *log.Logger, secret, replacement string) *log.Logger {
+	w, ok := l.Writer().(*writer)
+	if !ok {
+		w = &writer{out: l.Writer()}
+	}
+	r := *w
+	r.redact = append(append([]string(nil), w.redact...), secret, replacement)
+	r.replacer = strings.NewReplacer(r.redact...)
+	return log.New(&r, l.Prefix(), l.Flags())
+}
+
+// writer is the io.Writer loggers from Setup, New, At and Redact write to.
+// Each Write is one message of module at level; in text mode it goes to out
+// as is, in JSON mode it is encoded as a record.
+type writer struct {
+	enc    *encoder // nil in text mode
+	out    io.Writer
+	fields []any
+	module string
+	level  Level
+
+	redact   []string // old, new pairs for replacer
+	replacer *strings.Replacer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !Enabled(w.module, w.level) {
+		return len(p), nil
+	}
+	if w.enc == nil {
+		if w.replacer != nil {
+			if _, err := w.out.Write([]byte(w.replacer.Replace(string(p)))); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+		return w.out.Write(p)
+	}
+	if err := w.enc.write(string(bytes.TrimRight(p, "\n")), w.fields, nil, w.replacer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write encodes one record: time, msg, then the logger's fields and the
+// record's own, in order. A replacer redacts msg and the text of values.
+func (e *encoder) write(msg string, fields, extra []any, replacer *strings.Replacer) error {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	appendValue(&b, e.now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"msg":`)
+	if replacer != nil {
+		msg = replacer.Replace(msg)
+	}
+	appendValue(&b, msg)
+	for _, kv := range [][]any{fields, extra} {
+		for i := 0; i+1 < len(kv); i += 2 {
+			b.WriteByte(',')
+			appendValue(&b, fmt.Sprint(kv[i]))
+			b.WriteByte(':')
+			value := kv[i+1]
+			if replacer != nil {
+				switch x := value.(type) {
+				case string:
+					value = replacer.Replace(x)
+				case error:
+					value = replacer.Replace(x.Error())
+				}
+			}
+			appendValue(&b, value)
+		}
+	}
+	b.WriteString("}\n")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.out.Write(b.Bytes())
+	return err
+}
+
+func appendValue(b *bytes.Buffer, v any) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case time.Duration:
+		v = x.Milliseconds()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// Setup points the standard logger at out in the given format. Text leaves
+// its prefix and flags alone; JSON drops them, since records carry the time
+// and fields instead, and tags records with the component. Its plain
+// writes are Info records of the module named after the component.
+func Setup(format Format, out io.Writer, component string) {
+	if format != JSON {
+		log.SetOutput(&writer{out: out, module: component})
+		return
+	}
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(&writer{enc: &encoder{out: out, now: time.Now}, fields: []any{"component", component}, module: component})
+}
+
+// New derives a logger from base for one part of the program, such as a
+// worker. Text output gets prefix in front of every line; JSON records get
+// fields, given as alternating keys and values.
+func New(base *log.Logger, prefix string, fields ...any) *log.Logger {
+	if w, ok := base.Writer().(*writer); ok && w.enc != nil {
+		all := append(append([]any(nil), w.fields...), fields...)
+		return log.New(&writer{enc: w.enc, fields: all, module: w.module, level: w.level, redact: w.redact, replacer: w.replacer}, "", 0)
+	}
+	return log.New(base.Writer(), prefix, base.Flags())
+}
+
+// Log writes msg with fields. JSON records carry the fields as keys; text
+// output is just msg, so callers put what a reader needs into it.
+func Log(l *log.Logger, msg string, fields ...any) {
+	if w, ok := l.Writer().(*writer); ok && w.enc != nil {
+		if Enabled(w.module, w.level) {
+			_ = w.enc.write(msg, w.fields, fields, w.replacer)
+		}
+		return
+	}
+	l.Print(msg)
+}
+
+// Repeats collapses a run of identical messages, such as a worker failing
+// to reach the hub once a second during an outage, into the first one and
+// then a summary every Every, and once more when the run ends, counting the
+// messages left out and when the first and last of them were sent. A zero
+// Every writes every message.
+type Repeats struct {
+	Every time.Duration
+
+	mu          sync.Mutex
+	l           *log.Logger
+	msg         string
+	fields      []any
+	count       int // messages left out since the last one written
+	first, last time.Time
+	written     time.Time
+	now         func() time.Time
+}
+
+// Log writes msg with fields through l, as Log does, unless it repeats the
+// previous message and a summary is not yet due.
+func (r *Repeats) Log(l *log.Logger, msg string, fields ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock()
+	if r.Every > 0 && msg == r.msg && r.l != nil {
+		if r.count == 0 {
+			r.first = now
+		}
+		r.count++
+		r.last = now
+		r.l, r.fields = l, fields
+		if now.Sub(r.written) >= r.Every {
+			r.summarize(now)
+		}
+		return
+	}
+	if r.count > 0 {
+		r.summarize(now)
+	}
+	r.l, r.msg, r.fields, r.written = l, msg, fields, now
+	Log(l, msg, fields...)
+}
+
+// Flush ends the current run, writing a summary of the messages it left
+// out since the last one written.
+func (r *Repeats) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count > 0 {
+		r.summarize(r.clock())
+	}
+	r.l, r.msg, r.fields = nil, "", nil
+}
+
+func (r *Repeats) summarize(now time.Time) {
+	first, last := r.first.Format(time.RFC3339), r.last.Format(time.RFC3339)
+	Log(r.l, fmt.Sprintf("%s (repeated %d times from %s to %s)", r.msg, r.count, first, last),
+		append(append([]any(nil), r.fields...), "repeated", r.count, "first", first, "last", last)...)
+	r.count, r.written = 0, now
+}
+
+func (r *Repeats) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,145 @@
+package logx
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	base := log.New(&writer{enc: &encoder{out: &out, now: time.Now}, fields: []any{"component", "pool"}}, "", 0)
+	worker := New(base, "[pool worker 3] ", "worker", 3)
+	worker.Printf("connected to hub")
+	Log(worker, "bridge to db:5432 ended", "session", "7", "bytes_in", int64(42),
+		"duration_ms", 1500*time.Millisecond, "error", errors.New("reset"))
+
+	dec := json.NewDecoder(&out)
+	var recs []map[string]any
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want 2", len(recs))
+	}
+	if r := recs[0]; r["msg"] != "connected to hub" || r["component"] != "pool" || r["worker"] != 3.0 || r["time"] == nil {
+		t.Fatalf("printf record %v", r)
+	}
+	r := recs[1]
+	if r["session"] != "7" || r["bytes_in"] != 42.0 || r["duration_ms"] != 1500.0 || r["error"] != "reset" || r["worker"] != 3.0 {
+		t.Fatalf("structured record %v", r)
+	}
+}
+
+func TestText(t *testing.T) {
+	var out bytes.Buffer
+	base := log.New(&out, "[pool] ", log.Lmsgprefix)
+	worker := New(base, "[pool worker 3] ", "worker", 3)
+	Log(worker, "bridging db:5432", "session", "7")
+	if got := out.String(); got != "[pool worker 3] bridging db:5432\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	if f, err := ParseFormat("JSON"); err != nil || f != JSON {
+		t.Fatalf("ParseFormat(JSON) = %q, %v", f, err)
+	}
+	if _, err := ParseFormat("logfmt"); err == nil {
+		t.Fatal("accepted logfmt")
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	modules := []string{"pool", "bridge", "proto"}
+	levels, err := ParseLevels("warn, proto=TRACE,bridge=error", modules)
+	if err != nil || levels.String() != "warn,bridge=error,proto=trace" {
+		t.Fatalf("ParseLevels = %v, %v", levels, err)
+	}
+	if !levels.enabled("proto", Trace) || levels.enabled("bridge", Warn) || levels.enabled("pool", Info) || !levels.enabled("pool", Warn) {
+		t.Fatalf("enabled disagrees with %v", levels)
+	}
+	for _, spec := range []string{"", "loud", "info,debug", "hub=debug", "proto=debug,proto=trace"} {
+		if _, err := ParseLevels(spec, modules); err == nil {
+			t.Errorf("ParseLevels accepted %q", spec)
+		}
+	}
+}
+
+func TestAt(t *testing.T) {
+	defer SetLevels(Levels{})
+	SetLevels(Levels{Default: Warn, Modules: map[string]Level{"proto": Trace}})
+
+	var out bytes.Buffer
+	base := log.New(&writer{out: &out, module: "pool"}, "[pool] ", log.Lmsgprefix)
+	base.Printf("connected to hub")
+	At(base, "bridge", Info).Printf("bridging db:5432")
+	At(base, "proto", Trace).Printf("> OK")
+	At(base, "pool", Warn).Printf("failed to connect")
+	if got := out.String(); got != "[pool] > OK\n[pool] failed to connect\n" {
+		t.Fatalf("text output %q", got)
+	}
+
+	out.Reset()
+	base = log.New(&writer{enc: &encoder{out: &out, now: time.Now}, fields: []any{"component", "pool"}, module: "pool"}, "", 0)
+	Log(New(base, "", "worker", 1), "session ended")
+	Log(At(New(base, "", "worker", 1), "proto", Trace), "< REQUEST")
+	var rec map[string]any
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil || rec["msg"] != "< REQUEST" || rec["module"] != "proto" || rec["level"] != "trace" || rec["worker"] != 1.0 {
+		t.Fatalf("JSON output %q", out.String())
+	}
+}
+
+func TestRedact(t *testing.T) {
+	var out bytes.Buffer
+	worker := Redact(log.New(&out, "[pool worker 1] ", 0), "db.corp", "redacted-1")
+	At(worker, "bridge", Warn).Printf("failed to reach db.corp:5432: lookup db.corp: no such host")
+	if got := out.String(); got != "[pool worker 1] failed to reach redacted-1:5432: lookup redacted-1: no such host\n" {
+		t.Fatalf("text output %q", got)
+	}
+
+	out.Reset()
+	base := log.New(&writer{enc: &encoder{out: &out, now: time.Now}, fields: []any{"component", "pool"}}, "", 0)
+	worker = New(Redact(base, "db.corp", "redacted-1"), "", "worker", 1)
+	Log(worker, "bridging db.corp:5432", "dest", "db.corp:5432", "error", errors.New("lookup db.corp"))
+	var rec map[string]any
+	if err := json.Unmarshal(out.Bytes(), &rec); err != nil || rec["msg"] != "bridging redacted-1:5432" ||
+		rec["dest"] != "redacted-1:5432" || rec["error"] != "lookup redacted-1" || rec["worker"] != 1.0 {
+		t.Fatalf("JSON output %q", out.String())
+	}
+}
+
+func TestRepeats(t *testing.T) {
+	var out bytes.Buffer
+	l := log.New(&out, "", 0)
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := &Repeats{Every: time.Minute, now: func() time.Time { return clock }}
+	for i := 0; i < 90; i++ {
+		r.Log(l, "failed to connect to hub: connection refused")
+		clock = clock.Add(time.Second)
+	}
+	r.Log(l, "failed to connect to hub: i/o timeout")
+	r.Flush()
+	want := "failed to connect to hub: connection refused\n" +
+		"failed to connect to hub: connection refused (repeated 60 times from 2024-05-01T12:00:01Z to 2024-05-01T12:01:00Z)\n" +
+		"failed to connect to hub: connection refused (repeated 29 times from 2024-05-01T12:01:01Z to 2024-05-01T12:01:29Z)\n" +
+		"failed to connect to hub: i/o timeout\n"
+	if got := out.String(); got != want {
+		t.Fatalf("output %q", got)
+	}
+
+	out.Reset()
+	r = &Repeats{}
+	r.Log(l, "failed")
+	r.Log(l, "failed")
+	if got := out.String(); got != "failed\nfailed\n" {
+		t.Fatalf("without Every: %q", got)
+	}
+}
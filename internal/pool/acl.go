@@ -0,0 +1,255 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ACLRule is one --allow or --deny rule: a destination network or domain
+// glob, and the ports it covers.
+type ACLRule struct {
+	Network netip.Prefix // set for address rules
+	Domain  string       // glob for domain rules; "*" matches every destination
+	Ports   []PortRange  // nil covers every port
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct{ Lo, Hi int }
+
+func (r ACLRule) String() string {
+	host := r.Domain
+	if r.Network.IsValid() {
+		host = r.Network.String()
+		if r.Network.Addr().Is6() {
+			host = "[" + host + "]"
+		}
+	}
+	if r.Ports == nil {
+		return host
+	}
+	ports := make([]string, len(r.Ports))
+	for i, p := range r.Ports {
+		ports[i] = strconv.Itoa(p.Lo)
+		if p.Hi != p.Lo {
+			ports[i] += "-" + strconv.Itoa(p.Hi)
+		}
+	}
+	return host + ":" + strings.Join(ports, ",")
+}
+
+// ParseACLRule parses an --allow or --deny value, "<host>[:<ports>]". The
+// host is an address, a CIDR network (IPv6 in brackets when ports follow),
+// a domain glob such as "*.corp.example" or "*" for any; ports are a
+// comma-separated list of ports and ranges such as "22,8000-8100", or "*".
+func ParseACLRule(text string) (ACLRule, error) {
+	host, ports := text, ""
+	if rest, ok := strings.CutPrefix(text, "["); ok {
+		var found bool
+		if host, ports, found = strings.Cut(rest, "]"); !found {
+			return ACLRule{}, fmt.Errorf("missing ] in %q", text)
+		}
+		if ports != "" {
+			var hasPorts bool
+			if ports, hasPorts = strings.CutPrefix(ports, ":"); !hasPorts {
+				return ACLRule{}, fmt.Errorf("expected :<ports> after ] in %q", text)
+			}
+		}
+	} else if _, err := netip.ParsePrefix(text); err != nil && strings.Contains(text, ":") {
+		if _, err := netip.ParseAddr(text); err != nil {
+			i := strings.LastIndex(text, ":")
+			host, ports = text[:i], text[i+1:]
+		}
+	}
+
+	var rule ACLRule
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		rule.Network = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(host); err == nil && addr.Zone() == "" {
+		rule.Network = netip.PrefixFrom(addr, addr.BitLen())
+	} else if _, err := path.Match(host, ""); err != nil || host == "" || strings.ContainsAny(host, "/[]") {
+		return ACLRule{}, fmt.Errorf("invalid host %q", host)
+	} else {
+		rule.Domain = strings.ToLower(host)
+	}
+	if ports == "" && strings.HasSuffix(text, ":") {
+		return ACLRule{}, fmt.Errorf("missing ports after : in %q", text)
+	}
+	if ports == "" || ports == "*" {
+		return rule, nil
+	}
+	for _, item := range strings.Split(ports, ",") {
+		lo, hi, isRange := strings.Cut(item, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 1 || last > 65535 || first > last {
+			return ACLRule{}, fmt.Errorf("invalid port list entry %q", item)
+		}
+		rule.Ports = append(rule.Ports, PortRange{first, last})
+	}
+	return rule, nil
+}
+
+// LoadACLFile reads an --acl-file: one "allow <rule>" or "deny <rule>" per
+// line, with blank lines and # comments ignored.
+func LoadACLFile(name string) (allow, deny []ACLRule, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 || fields[0] != "allow" && fields[0] != "deny" {
+			return nil, nil, fmt.Errorf("%s:%d: expected allow <rule> or deny <rule>", name, n)
+		}
+		rule, err := ParseACLRule(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		if fields[0] == "allow" {
+			allow = append(allow, rule)
+		} else {
+			deny = append(deny, rule)
+		}
+	}
+	return allow, deny, scanner.Err()
+}
+
+func (r ACLRule) coversPort(port int) bool {
+	if r.Ports == nil {
+		return true
+	}
+	for _, p := range r.Ports {
+		if port >= p.Lo && port <= p.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesName reports whether a domain rule matches host, the destination
+// as the hub sent it.
+func (r ACLRule) matchesName(host string) bool {
+	if r.Domain == "" {
+		return false
+	}
+	ok, _ := path.Match(r.Domain, strings.ToLower(host))
+	return ok
+}
+
+// Matches reports whether r covers host and port as given, without
+// resolving a name: address rules match addresses and domain rules names,
+// except that "*" matches both.
+func (r ACLRule) Matches(host string, port int) bool {
+	if !r.coversPort(port) {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return r.Network.Contains(ip.Unmap()) || r.Domain == "*"
+	}
+	return r.matchesName(host)
+}
+
+// checkACL returns why --allow and --deny refuse req, or "" when they let
+// it through. A destination is refused when a deny rule matches it, or when
+// there are allow rules and none covers it. Address rules apply to domains
+// through what they resolve to, all of which must be allowed; that is
+// checked before the dial, which resolves the name again. UDP associations
+// and the packet tunnel reach destinations the request does not name, so
+// they are refused outright while any rule is set.
+func (s *Supervisor) checkACL(ctx context.Context, req *Request) string {
+	opts := s.link().opts
+	if len(opts.Allow) == 0 && len(opts.Deny) == 0 {
+		return ""
+	}
+	switch req.Command {
+	case CommandAssociate, CommandTUN:
+		return req.Command + " is not allowed with --allow or --deny rules"
+	}
+	ports := []int{req.Port}
+	if req.Command == CommandScan {
+		ports = req.Ports
+	} else if req.Port == 0 {
+		ports = []int{pingFallbackPort}
+	}
+
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(req.Address); err == nil {
+		ips = []netip.Addr{ip.Unmap()}
+	} else if aclNeedsAddrs(opts.Allow) || aclNeedsAddrs(opts.Deny) {
+		// A name that does not resolve matches no address rule.
+		targets, _ := s.resolveTarget(ctx, req)
+		for _, t := range targets {
+			ips = append(ips, t.Addr().Unmap())
+		}
+	}
+
+	for _, port := range ports {
+		for _, r := range opts.Deny {
+			if !r.coversPort(port) {
+				continue
+			}
+			if r.matchesName(req.Address) {
+				return fmt.Sprintf("%s matches --deny %s", net.JoinHostPort(req.Address, strconv.Itoa(port)), r)
+			}
+			for _, ip := range ips {
+				if r.Network.IsValid() && r.Network.Contains(ip) {
+					return fmt.Sprintf("%s (%s) matches --deny %s", net.JoinHostPort(req.Address, strconv.Itoa(port)), ip, r)
+				}
+			}
+		}
+		if len(opts.Allow) > 0 && !aclAllows(opts.Allow, req.Address, ips, port) {
+			return fmt.Sprintf("%s is not covered by any --allow rule", net.JoinHostPort(req.Address, strconv.Itoa(port)))
+		}
+	}
+	return ""
+}
+
+// aclAllows reports whether a domain rule in allow matches host, or every
+// one of its addresses falls in the network of some address rule.
+func aclAllows(allow []ACLRule, host string, ips []netip.Addr, port int) bool {
+	covered := make([]bool, len(ips))
+	for _, r := range allow {
+		if !r.coversPort(port) {
+			continue
+		}
+		if r.matchesName(host) {
+			return true
+		}
+		for i, ip := range ips {
+			if r.Network.IsValid() && r.Network.Contains(ip) {
+				covered[i] = true
+			}
+		}
+	}
+	for _, ok := range covered {
+		if !ok {
+			return false
+		}
+	}
+	return len(ips) > 0
+}
+
+func aclNeedsAddrs(rules []ACLRule) bool {
+	for _, r := range rules {
+		if r.Network.IsValid() {
+			return true
+		}
+	}
+	return false
+}
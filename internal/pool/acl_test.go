@@ -0,0 +1,113 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseACLRule(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"10.1.0.0/16", "10.1.0.0/16"},
+		{"10.1.2.3/16:22,443", "10.1.0.0/16:22,443"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"fd00::/8", "[fd00::/8]"},
+		{"[fd00::1]:8000-8100", "[fd00::1/128]:8000-8100"},
+		{"*.Corp.Example:443", "*.corp.example:443"},
+		{"*", "*"},
+		{"*:*", "*"},
+	} {
+		rule, err := ParseACLRule(tc.in)
+		if err != nil || rule.String() != tc.want {
+			t.Errorf("ParseACLRule(%q) = %v, %v; want %s", tc.in, rule, err, tc.want)
+		}
+	}
+	for _, in := range []string{"", "10.0.0.0/8:", "10.0.0.0/8:0", "host:70000", "host:9-1", "[fd00::1", "[fd00::1]22", "a/b", "[x"} {
+		if _, err := ParseACLRule(in); err == nil {
+			t.Errorf("ParseACLRule accepted %q", in)
+		}
+	}
+}
+
+func TestLoadACLFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "acl")
+	os.WriteFile(name, []byte("# engagement scope\nallow 10.0.0.0/8:22\n\ndeny 10.0.0.1 # jump host\n"), 0o600)
+	allow, deny, err := LoadACLFile(name)
+	if err != nil || fmt.Sprint(allow, deny) != "[10.0.0.0/8:22] [10.0.0.1/32]" {
+		t.Fatalf("LoadACLFile = %v, %v, %v", allow, deny, err)
+	}
+	os.WriteFile(name, []byte("permit 10.0.0.0/8\n"), 0o600)
+	if _, _, err := LoadACLFile(name); err == nil || !strings.Contains(err.Error(), ":1:") {
+		t.Fatalf("LoadACLFile accepted a bad line: %v", err)
+	}
+}
+
+func TestCheckACL(t *testing.T) {
+	rules := func(texts ...string) []ACLRule {
+		var out []ACLRule
+		for _, text := range texts {
+			rule, err := ParseACLRule(text)
+			if err != nil {
+				t.Fatalf("ParseACLRule(%q): %v", text, err)
+			}
+			out = append(out, rule)
+		}
+		return out
+	}
+	s := NewSupervisor(Options{
+		Mode:  ModeSocks,
+		Allow: rules("10.1.0.0/16:22,443", "*.corp.example"),
+		Deny:  rules("10.1.5.1", "secret.corp.example"),
+	})
+	for _, tc := range []struct {
+		line    string
+		allowed bool
+	}{
+		{"REQUEST CONNECT ipv4 10.1.2.3 22 1", true},
+		{"REQUEST CONNECT ipv4 10.1.2.3 80 1", false},
+		{"REQUEST CONNECT ipv4 10.1.5.1 22 1", false},
+		{"REQUEST CONNECT ipv4 10.2.0.1 22 1", false},
+		{"REQUEST CONNECT domain git.CORP.example 8080 1", true},
+		{"REQUEST CONNECT domain secret.corp.example 443 1", false},
+		{"REQUEST CONNECT domain corp.example.evil 443 1", false},
+		{"REQUEST SCAN ipv4 10.1.0.9 22,443 1", true},
+		{"REQUEST SCAN ipv4 10.1.0.9 22,80 1", false},
+		{"REQUEST ASSOCIATE ipv4 0.0.0.0 0 1", false},
+	} {
+		req, err := ParseRequest(tc.line)
+		if err != nil {
+			t.Fatalf("ParseRequest(%q): %v", tc.line, err)
+		}
+		if why := s.checkACL(context.Background(), req); (why == "") != tc.allowed {
+			t.Errorf("checkACL(%q) = %q, want allowed=%v", tc.line, why, tc.allowed)
+		}
+	}
+
+	open := NewSupervisor(Options{Mode: ModeSocks})
+	req, _ := ParseRequest("REQUEST ASSOCIATE ipv4 0.0.0.0 0 1")
+	if why := open.checkACL(context.Background(), req); why != "" {
+		t.Fatalf("checkACL without rules = %q", why)
+	}
+}
+
+func TestHubSessionACL(t *testing.T) {
+	deny, _ := ParseACLRule("127.0.0.1")
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, Deny: []ACLRule{deny}})
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK\nREQUEST CONNECT ipv4 127.0.0.1 22 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 2 ") {
+		t.Fatalf("denied request answered %q", line)
+	}
+}
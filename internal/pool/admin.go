@@ -0,0 +1,305 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminTimeout bounds one admin socket exchange, on both ends.
+const adminTimeout = 10 * time.Second
+
+// workerState is what a worker is doing, as reported on the admin socket.
+type workerState string
+
+const (
+	workerConnecting workerState = "connecting" // dialling the hub
+	workerBackoff    workerState = "backoff"    // waiting to retry the hub
+	workerIdle       workerState = "idle"       // waiting for a request
+	workerBusy       workerState = "busy"       // handling a request
+)
+
+// workerStatus is a snapshot of one worker.
+type workerStatus struct {
+	id        int
+	state     workerState
+	since     time.Time
+	lastErr   string   // why the last hub connection or dial failed
+	session   *Request // the request being handled while busy
+	sessionAt time.Time
+}
+
+// setState records what w is doing; err, if any, is kept as its last
+// error. The worker methods below are no-ops on a nil *worker, as
+// handleHubSession has none in tests.
+func (w *worker) setState(state workerState, err error) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.status.state, w.status.since, w.status.session = state, time.Now(), nil
+	if err != nil {
+		w.status.lastErr = err.Error()
+	}
+	if state == workerConnecting || state == workerBackoff {
+		w.kill = nil
+	}
+}
+
+// serving records that w reached the hub; cancel ends that connection.
+func (w *worker) serving(cancel context.CancelFunc) {
+	if w == nil {
+		return
+	}
+	w.setState(workerIdle, nil)
+	w.mu.Lock()
+	w.kill = cancel
+	w.mu.Unlock()
+}
+
+// begin records that w is handling req.
+func (w *worker) begin(req *Request) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	w.status.state, w.status.since = workerBusy, now
+	w.status.session, w.status.sessionAt = req, now
+}
+
+func (w *worker) snapshot() workerStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.status
+	st.id = w.id
+	return st
+}
+
+// killSession ends w's hub connection if it is handling session id.
+func (w *worker) killSession(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status.session == nil || w.status.session.SessionID != id || w.kill == nil {
+		return false
+	}
+	w.kill()
+	return true
+}
+
+func (s *Supervisor) registerWorker(w *worker) {
+	s.workersMu.Lock()
+	s.workers[w.id] = w
+	s.workersMu.Unlock()
+}
+
+func (s *Supervisor) unregisterWorker(w *worker) {
+	s.workersMu.Lock()
+	delete(s.workers, w.id)
+	s.workersMu.Unlock()
+}
+
+// workerStatuses returns a snapshot of every running worker, including
+// retired ones still finishing a request, ordered by ID.
+func (s *Supervisor) workerStatuses() []workerStatus {
+	s.workersMu.Lock()
+	out := make([]workerStatus, 0, len(s.workers))
+	for _, w := range s.workers {
+		out = append(out, w.snapshot())
+	}
+	s.workersMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].id < out[j].id })
+	return out
+}
+
+// AdminAddress splits an --admin-socket value into a network and address.
+// Anything that is not host:port is a Unix socket path; TCP is only allowed
+// on loopback as the socket is not authenticated. hubgo's admin socket
+// takes the same values.
+func AdminAddress(addr string) (network, address string, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || strings.Contains(addr, "/") {
+		return "unix", addr, nil
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", "", fmt.Errorf("TCP address must be on loopback, not %q", host)
+	}
+	return "tcp", addr, nil
+}
+
+// ListenAdmin opens an --admin-socket address. A Unix socket left behind
+// by a process that did not exit cleanly is replaced, one still answering
+// is not.
+func ListenAdmin(addr string) (net.Listener, error) {
+	network, address, err := AdminAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if conn, err := net.DialTimeout(network, address, time.Second); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", address)
+		}
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0o600); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// serveAdmin answers admin connections on ln until ctx ends. Each
+// connection carries one command line; the reply is written back and the
+// connection closed.
+func (s *Supervisor) serveAdmin(ctx context.Context, ln net.Listener) {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Printf("admin socket: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+			line, err := bufio.NewReader(io.LimitReader(conn, 4096)).ReadString('\n')
+			if err != nil && line == "" {
+				return
+			}
+			_, _ = io.WriteString(conn, s.adminCommand(strings.TrimSpace(line)))
+		}()
+	}
+}
+
+// adminCommand runs one admin command and returns its reply. Failures are
+// a single line starting "error: ".
+func (s *Supervisor) adminCommand(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "error: empty command\n"
+	}
+	var b strings.Builder
+	now := time.Now()
+	switch cmd, args := fields[0], fields[1:]; {
+	case cmd == "status" && len(args) == 0:
+		workers := s.workerStatuses()
+		fmt.Fprintf(&b, "pool version=%s mode=%s workers=%d active=%d pending=%d draining=%t\n",
+			BuildVersion(), s.opts.Mode, len(workers), s.active.Load(), s.pending.Load(), s.isDraining())
+		for _, w := range workers {
+			fmt.Fprintf(&b, "worker %d %s %s", w.id, w.state, now.Sub(w.since).Round(time.Second))
+			if w.session != nil {
+				fmt.Fprintf(&b, " session=%s dest=%s", sessionName(w.session), w.session.hostPort())
+			}
+			if w.lastErr != "" && w.state != workerIdle && w.state != workerBusy {
+				fmt.Fprintf(&b, " error=%q", w.lastErr)
+			}
+			b.WriteByte('\n')
+		}
+	case cmd == "sessions" && len(args) == 0:
+		for _, w := range s.workerStatuses() {
+			if w.session == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "session %s worker=%d command=%s dest=%s age=%s",
+				sessionName(w.session), w.id, w.session.Command,
+				w.session.hostPort(),
+				now.Sub(w.sessionAt).Round(time.Second))
+			if w.session.Affinity != "" {
+				fmt.Fprintf(&b, " affinity=%s", w.session.Affinity)
+			}
+			if w.session.Client.IsValid() {
+				fmt.Fprintf(&b, " client=%s", w.session.Client)
+			}
+			if w.session.ClientID != "" {
+				fmt.Fprintf(&b, " client_id=%s", w.session.ClientID)
+			}
+			if alias := s.link().opts.aliasFor(w.session.Address, w.session.Port); alias != "" {
+				fmt.Fprintf(&b, " alias=%s", alias)
+			}
+			b.WriteByte('\n')
+		}
+	case cmd == "drain" && len(args) == 0:
+		s.logger.Printf("Drain requested on the admin socket")
+		s.Drain()
+		b.WriteString("draining\n")
+	case cmd == "kill-session" && len(args) == 1:
+		s.workersMu.Lock()
+		var killed *worker
+		for _, w := range s.workers {
+			if w.killSession(args[0]) {
+				killed = w
+				break
+			}
+		}
+		s.workersMu.Unlock()
+		if killed == nil {
+			return fmt.Sprintf("error: no active session %s\n", args[0])
+		}
+		s.logger.Printf("Admin socket: closed session %s on worker %d", args[0], killed.id)
+		s.audit.Record("admin_kill", map[string]any{"session": args[0], "worker": killed.id})
+		fmt.Fprintf(&b, "killed session %s on worker %d\n", args[0], killed.id)
+	case (cmd == "rate-limit" || cmd == "pool-rate-limit") && len(args) <= 1:
+		limit := &s.streamRate
+		if cmd == "pool-rate-limit" {
+			limit = &s.poolRate
+		}
+		if len(args) == 1 {
+			rate, err := ParseRate(args[0])
+			if err != nil {
+				return fmt.Sprintf("error: %s must be a rate such as 512K or 10M, or off\n", cmd)
+			}
+			limit.Store(rate)
+			s.logger.Printf("Admin socket: %s set to %s", cmd, FormatRate(rate))
+			s.audit.Record("admin_rate_limit", map[string]any{"limit": cmd, "rate": rate})
+		}
+		fmt.Fprintf(&b, "%s %s\n", cmd, FormatRate(limit.Load()))
+	default:
+		return fmt.Sprintf("error: unknown command %q (want status, sessions, drain, kill-session <id>, rate-limit [<rate>] or pool-rate-limit [<rate>])\n", line)
+	}
+	return b.String()
+}
+
+// sessionName is how the admin socket shows a request, which has no ID
+// when the hub speaks protocol 1.
+func sessionName(req *Request) string {
+	if req.SessionID == "" {
+		return "-"
+	}
+	return req.SessionID
+}
+
+func (s *Supervisor) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
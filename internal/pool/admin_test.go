@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr, network string
+		ok            bool
+	}{
+		{"/run/poolgo.sock", "unix", true},
+		{"poolgo.sock", "unix", true},
+		{"127.0.0.1:7070", "tcp", true},
+		{"[::1]:7070", "tcp", true},
+		{"localhost:7070", "tcp", true},
+		{"0.0.0.0:7070", "", false},
+		{"10.0.0.1:7070", "", false},
+		{"127.0.0.1:http", "", false},
+	} {
+		network, _, err := AdminAddress(tc.addr)
+		if (err == nil) != tc.ok || network != tc.network {
+			t.Errorf("AdminAddress(%q) = %q, %v", tc.addr, network, err)
+		}
+	}
+}
+
+func TestParseCtlArgs(t *testing.T) {
+	opts, err := ParseCtlArgs([]string{"-s", "/run/poolgo.sock", "kill-session", "17"})
+	if err != nil {
+		t.Fatalf("ParseCtlArgs: %v", err)
+	}
+	if opts.Socket != "/run/poolgo.sock" || strings.Join(opts.Command, " ") != "kill-session 17" {
+		t.Fatalf("unexpected options %+v", opts)
+	}
+	if _, err := ParseCtlArgs([]string{"status"}); err == nil {
+		t.Fatalf("expected an error without --socket")
+	}
+	if _, err := ParseCtlArgs([]string{"--socket", "/run/poolgo.sock"}); err == nil {
+		t.Fatalf("expected an error without a command")
+	}
+	if _, err := ParseArgs([]string{"--hub-host", "hub", "--admin-socket", "0.0.0.0:7070"}); err == nil {
+		t.Fatalf("expected --admin-socket to refuse a non-loopback address")
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(c, c)
+		}
+	}()
+	hubLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hubLn.Close()
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	s := NewSupervisor(Options{
+		Mode: ModeSocks, Protocol: 1, Workers: 1, RetryDelay: time.Minute,
+		HubHost: "127.0.0.1", HubPort: hubLn.Addr().(*net.TCPAddr).Port,
+		AdminSocket: socket,
+	})
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	hub, err := hubLn.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer hub.Close()
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	hub.Write([]byte("OK\n"))
+
+	ctl := func(command ...string) (string, error) {
+		var out strings.Builder
+		err := Ctl(CtlOptions{Socket: socket, Command: command}, &out)
+		return out.String(), err
+	}
+	waitFor := func(want string, command ...string) string {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			out, err := ctl(command...)
+			if err == nil && strings.Contains(out, want) {
+				return out
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: want %q, got %q (%v)", strings.Join(command, " "), want, out, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("\nworker 1 idle ", "status")
+	fmt.Fprintf(hub, "REQUEST CONNECT ipv4 127.0.0.1 %d 17\n", target.Addr().(*net.TCPAddr).Port)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	status := waitFor("worker 1 busy ", "status")
+	if !strings.Contains(status, "session=17 dest=127.0.0.1:") || !strings.Contains(status, " active=1 ") {
+		t.Fatalf("unexpected status %q", status)
+	}
+	waitFor("session 17 worker=1 command=CONNECT dest=127.0.0.1:", "sessions")
+
+	if _, err := ctl("reboot"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("reboot: %v", err)
+	}
+	// Draining lets the busy worker finish, so the socket stays up.
+	if out, err := ctl("drain"); err != nil || out != "draining\n" {
+		t.Fatalf("drain: %q, %v", out, err)
+	}
+	waitFor("draining=true", "status")
+
+	if _, err := ctl("kill-session", "99"); err == nil || !strings.Contains(err.Error(), "no active session 99") {
+		t.Fatalf("kill-session 99: %v", err)
+	}
+	if out, err := ctl("kill-session", "17"); err != nil || out != "killed session 17 on worker 1\n" {
+		t.Fatalf("kill-session 17: %q, %v", out, err)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Fatalf("hub connection was not closed: %v", err)
+	}
+}
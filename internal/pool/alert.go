@@ -0,0 +1,178 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parsePattern decodes an --alert-pattern value: literal text, or raw bytes
+// written as hex:<digits>.
+func parsePattern(text string) ([]byte, error) {
+	if digits, ok := strings.CutPrefix(text, "hex:"); ok {
+		b, err := hex.DecodeString(digits)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid hex pattern %q", text)
+		}
+		return b, nil
+	}
+	if text == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	if len(text) > 1024 {
+		return nil, fmt.Errorf("pattern longer than 1024 bytes")
+	}
+	return []byte(text), nil
+}
+
+// patternScanner passes a stream through unchanged while looking for the
+// configured patterns. It keeps the last len(longest)-1 bytes of each read
+// so matches that straddle reads are found, and reports each pattern at
+// most once per stream.
+type patternScanner struct {
+	r        io.Reader
+	patterns []*AlertPattern
+	seen     []bool
+	window   []byte // last keep bytes seen
+	edge     []byte
+	keep     int
+	match    func(p *AlertPattern)
+}
+
+func newPatternScanner(r io.Reader, patterns []*AlertPattern, match func(p *AlertPattern)) *patternScanner {
+	keep := 0
+	for _, p := range patterns {
+		keep = max(keep, len(p.Bytes)-1)
+	}
+	return &patternScanner{r: r, patterns: patterns, seen: make([]bool, len(patterns)), keep: keep, match: match}
+}
+
+func (s *patternScanner) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.scan(p[:n])
+	}
+	return n, err
+}
+
+func (s *patternScanner) scan(chunk []byte) {
+	// edge covers matches that start in the previous reads and end in this
+	// one; everything else lies wholly inside chunk.
+	s.edge = append(append(s.edge[:0], s.window...), chunk[:min(len(chunk), s.keep)]...)
+	for i, pat := range s.patterns {
+		if s.seen[i] {
+			continue
+		}
+		start := max(0, len(s.window)-len(pat.Bytes)+1)
+		if bytes.Contains(s.edge[start:], pat.Bytes) || bytes.Contains(chunk, pat.Bytes) {
+			s.seen[i] = true
+			s.match(pat)
+		}
+	}
+	if len(chunk) >= s.keep {
+		s.window = append(s.window[:0], chunk[len(chunk)-s.keep:]...)
+		return
+	}
+	s.window = append(s.window, chunk...)
+	if drop := len(s.window) - s.keep; drop > 0 {
+		s.window = append(s.window[:0], s.window[drop:]...)
+	}
+}
+
+// AlertPattern is one --alert-pattern: the bytes to look for and the text
+// the operator configured, used in alerts.
+type AlertPattern struct {
+	Text  string
+	Bytes []byte `json:"-"`
+}
+
+// alertEvent is the JSON body posted to --alert-webhook.
+type alertEvent struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Pattern   string    `json:"pattern"`
+	Direction string    `json:"direction"`
+	Dest      string    `json:"dest"`
+	Port      int       `json:"port"`
+	Config    string    `json:"config"`
+}
+
+// webhook delivers alert events in the background so the copy path never
+// waits on the receiver. Events are dropped when the queue is full.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan alertEvent
+	logger *log.Logger
+}
+
+func newWebhook(url string, logger *log.Logger) *webhook {
+	return &webhook{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		queue:  make(chan alertEvent, 64),
+		logger: logger,
+	}
+}
+
+func (w *webhook) send(ev alertEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		w.logger.Printf("alert webhook queue full; dropping %s alert", ev.Event)
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			body, _ := json.Marshal(ev)
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+			if err != nil {
+				w.logger.Printf("alert webhook: %v", err)
+				continue
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := w.client.Do(req)
+			if err != nil {
+				w.logger.Printf("alert webhook: %v", err)
+				continue
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				w.logger.Printf("alert webhook: %s", resp.Status)
+			}
+		}
+	}
+}
+
+// scanStream wraps one direction of a bridged session with the configured
+// --alert-pattern matcher. direction is "outbound" for data the client
+// sends towards the target and "inbound" for the target's responses.
+func (s *Supervisor) scanStream(r io.Reader, req *Request, direction string) io.Reader {
+	if len(s.opts.AlertPatterns) == 0 {
+		return r
+	}
+	return newPatternScanner(r, s.opts.AlertPatterns, func(p *AlertPattern) {
+		s.redactDest(s.logger, req).Printf("payload alert: %q seen %s for %s", p.Text, direction, req.hostPort())
+		s.audit.Record("payload_match", map[string]any{
+			"dest": req.Address, "port": req.Port, "pattern": p.Text, "direction": direction,
+		})
+		if s.webhook != nil {
+			s.webhook.send(alertEvent{
+				Time: time.Now().UTC(), Event: "payload_match", Pattern: p.Text, Direction: direction,
+				Dest: req.Address, Port: req.Port, Config: s.link().hash,
+			})
+		}
+	})
+}
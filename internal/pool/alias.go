@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"contun/internal/logx"
+)
+
+// DestAlias gives a destination a name for logs, audit records, the
+// session log and traces, so that reviewers read "dc1-db" rather than
+// 10.3.4.5:5432. It never changes where a session goes.
+type DestAlias struct {
+	Name string
+	Host string
+	Port int // 0 names the host on every port
+}
+
+func (a DestAlias) String() string {
+	if a.Port == 0 {
+		return a.Name + "=" + a.Host
+	}
+	return a.Name + "=" + net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// ParseDestAlias parses an --alias value: "<name>=<host>[:<port>]", with
+// an IPv6 host in brackets.
+func ParseDestAlias(text string) (DestAlias, error) {
+	name, dest, ok := strings.Cut(text, "=")
+	name, dest = strings.TrimSpace(name), strings.TrimSpace(dest)
+	if !ok || !validLabelKey(name) || dest == "" {
+		return DestAlias{}, fmt.Errorf("expected <name>=<host>[:<port>] with a name of letters, digits, '_', '-' or '.'")
+	}
+	a := DestAlias{Name: name, Host: strings.Trim(dest, "[]")}
+	if host, port, err := net.SplitHostPort(dest); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return DestAlias{}, fmt.Errorf("port must be between 1 and 65535")
+		}
+		a.Host, a.Port = host, n
+	}
+	if strings.ContainsAny(a.Host, "[]") {
+		return DestAlias{}, fmt.Errorf("invalid host %q", a.Host)
+	}
+	a.Host = strings.ToLower(a.Host)
+	return a, nil
+}
+
+// aliasFor returns the name --alias gives host and port, preferring one
+// for that port over one for the whole host, or "".
+func (o *Options) aliasFor(host string, port int) string {
+	name := ""
+	for _, a := range o.Aliases {
+		if !strings.EqualFold(a.Host, host) {
+			continue
+		}
+		if a.Port == port {
+			return a.Name
+		}
+		if a.Port == 0 {
+			name = a.Name
+		}
+	}
+	return name
+}
+
+// aliasDest derives a logger that shows req's destination under its
+// --alias name, as "dc1-db (10.3.4.5:5432)", or just the name when
+// --redact hides the host.
+func (s *Supervisor) aliasDest(logger *log.Logger, req *Request) *log.Logger {
+	opts := s.link().opts
+	name := opts.aliasFor(req.Address, req.Port)
+	if name == "" {
+		return logger
+	}
+	if _, redacted := opts.redactedHost(req.Address); redacted {
+		return logx.Redact(logger, req.hostPort(), name)
+	}
+	return logx.Redact(logger, req.hostPort(), name+" ("+req.hostPort()+")")
+}
@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseArgsAlias(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks",
+		"--alias", "dc1-db=10.3.4.5:5432", "--alias", "dc1-v6=[2001:db8::1]:443", "--alias", "dc1-web = Web.DC1.internal"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	want := []DestAlias{{"dc1-db", "10.3.4.5", 5432}, {"dc1-v6", "2001:db8::1", 443}, {"dc1-web", "web.dc1.internal", 0}}
+	if len(opts.Aliases) != len(want) {
+		t.Fatalf("aliases %v, want %v", opts.Aliases, want)
+	}
+	for i := range want {
+		if opts.Aliases[i] != want[i] {
+			t.Fatalf("alias %d = %v, want %v", i, opts.Aliases[i], want[i])
+		}
+	}
+	for _, bad := range []string{"10.3.4.5", "=10.3.4.5", "db one=10.3.4.5", "db=", "db=10.3.4.5:0", "db=[10.3.4.5"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "--alias", bad}); err == nil {
+			t.Errorf("--alias %q accepted", bad)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "--alias", "a=10.0.0.1:22", "--alias", "b=10.0.0.1:22"}); err == nil {
+		t.Error("two names for one destination accepted")
+	}
+}
+
+func TestAliasFor(t *testing.T) {
+	opts := Options{Aliases: []DestAlias{{"dc1-host", "10.3.4.5", 0}, {"dc1-db", "10.3.4.5", 5432}, {"dc1-web", "web.dc1.internal", 0}}}
+	for _, tc := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"10.3.4.5", 5432, "dc1-db"},
+		{"10.3.4.5", 22, "dc1-host"},
+		{"WEB.dc1.internal", 443, "dc1-web"},
+		{"10.3.4.6", 5432, ""},
+	} {
+		if got := opts.aliasFor(tc.host, tc.port); got != tc.want {
+			t.Errorf("aliasFor(%s, %d) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestAliasInLogsAndAudit(t *testing.T) {
+	opts := Options{Mode: ModeSocks, Aliases: []DestAlias{{"dc1-db", "10.3.4.5", 5432}}}
+	s := NewSupervisor(opts)
+	s.current.Store(newLink(&s.opts))
+	req := &Request{Command: CommandConnect, AddrType: AddrIPv4, Address: "10.3.4.5", Port: 5432}
+
+	var buf bytes.Buffer
+	s.redactDest(log.New(&buf, "", 0), req).Printf("bridging %s", req.hostPort())
+	if got := strings.TrimSpace(buf.String()); got != "bridging dc1-db (10.3.4.5:5432)" {
+		t.Errorf("log line %q", got)
+	}
+
+	// A redacted host is not shown next to its name.
+	buf.Reset()
+	opts.Redact = []string{"10.3.4.5"}
+	s = NewSupervisor(opts)
+	s.current.Store(newLink(&s.opts))
+	s.redactDest(log.New(&buf, "", 0), req).Printf("bridging %s", req.hostPort())
+	if got := strings.TrimSpace(buf.String()); got != "bridging dc1-db" {
+		t.Errorf("redacted log line %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, AuditJSON, 1, nil)
+	if err != nil {
+		t.Fatalf("openAuditLog: %v", err)
+	}
+	audit.alias = opts.aliasFor
+	audit.Record("request_denied", map[string]any{"dest": "10.3.4.5", "port": 5432, "reason": "test"})
+	audit.Record("request_denied", map[string]any{"dest": "10.3.4.5", "port": 22, "reason": "test"})
+	audit.Close()
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var first, second map[string]any
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &first) != nil || json.Unmarshal([]byte(lines[1]), &second) != nil {
+		t.Fatalf("audit log %q", data)
+	}
+	if first["dest_alias"] != "dc1-db" || second["dest_alias"] != nil {
+		t.Errorf("audit records %v and %v", first, second)
+	}
+}
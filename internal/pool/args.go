@@ -1,39 +1,205 @@
 package pool
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"net/netip"
+	"net/url"
+	"os/exec"
+	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"contun/internal/config"
+	"contun/internal/logx"
+	"contun/internal/transport"
 )
 
 var (
 	// ErrShowUsage indicates the caller requested help explicitly.
 	ErrShowUsage = errors.New("show usage")
 
+	// ErrShowVersion indicates the caller requested the build version.
+	ErrShowVersion = errors.New("show version")
+
 	usageText = `Usage: poolgo [options]
+       poolgo cleanup [options]
+       poolgo ctl --socket <addr> <command>
+       poolgo keygen <private-key-file>
 
 Required:
   -j, --hub-host <host>      Hub listener hostname or IP address (default 127.0.0.1).
   -p, --hub-port <port>      Hub listener port accepting pool workers.
+      --hub-url <url>        Reach the hub over WebSocket at ws://host[:port]/path or wss://...
+                             (TLS), e.g. behind a reverse proxy; replaces -j and -p.
   -m, --mode <mode>          Operation mode: direct or socks (default direct).
 
 Direct mode:
   -t, --target-host <host>   Target hostname or IP the bastion can reach.
   -T, --target-port <port>   Target port to proxy traffic to.
+      --target <host:port>   A destination to serve instead of --target-host/--target-port
+                             (repeatable; the workers are shared out between them).
+      --target-pattern <p>   Instead of a target, serve any destination the hub asks for that matches
+                             "<glob|cidr|ip>[:<ports>]" (e.g. *.lab.corp:22; repeatable).
+      --target-dns-ttl <d>   Reuse the addresses a target name resolved to for this long
+                             (default 0, resolve it again for every session).
 
 Optional:
+      --config <file>        Read options from a YAML or TOML file; options given here win.
   -w, --workers <n>          Number of concurrent worker goroutines to keep alive (default 4).
+      --max-workers <n>      Scale the workers with demand, up to this many, instead of keeping --workers.
+      --min-workers <n>      With --max-workers, keep this many workers ready for new requests (default 1).
+      --scale-down-after <d> With --max-workers, retire surplus workers idle this long (default 1m).
   -r, --retry-delay <sec>    Seconds to wait before re-dialling the hub after a failure (default 1).
+      --hub-dial-timeout <d> Give up connecting to the hub, including TLS, after this long (default 5s).
+      --target-dial-timeout <d>
+                             Give up connecting to a target and answer the hub with a failure
+                             REPLY after this long (default 5s).
+      --so-rcvbuf <size>     Socket receive buffer for hub and target connections (e.g. 4M).
+      --so-sndbuf <size>     Socket send buffer for hub and target connections (e.g. 4M).
+      --read-ahead <size>    Read at most this much target data ahead of a slow hub (e.g. 256K;
+                             default off, reads wait for each hub write).
+      --rate-limit <rate>    Move at most this many bytes per second each way per session (e.g. 1M).
+      --pool-rate-limit <rate>
+                             Move at most this many bytes per second each way across all sessions.
+      --source-rule <r>      Connect to targets in a network from a given local address, as
+                             "<cidr> via <ip>" (repeatable; the most specific network wins).
+      --netns-rule <r>       Connect to targets in a network from inside a network namespace, as
+                             "<cidr> in <name|path>" (repeatable; Linux, needs CAP_SYS_ADMIN).
+      --target-mss <bytes>   Clamp the TCP MSS of target connections (e.g. 1360) where PMTUD is broken.
+      --container-api <path> Resolve targets named container:<name> or label:<key>=<value> through the
+                             Docker or Podman API on this socket (e.g. /var/run/docker.sock).
+      --kubeconfig <file>    Resolve targets named k8s:<namespace>/<service>[:<port>] to the service's
+                             ready pods through this cluster, or "in-cluster" for the pod's service account.
+      --dns-server <addr>    Resolve target names with this server instead of the system resolver:
+                             host[:port], tcp://host[:port], tls://host[:port] (DNS over TLS)
+                             or an https:// URL (DNS over HTTPS).
+      --vrf <name>           Bind target connections to this Linux VRF device (e.g. vrf-data).
+      --bind-address <ip>    Connect to targets from this local address unless a --source-rule
+                             picks another.
+      --bind-interface <name>
+                             Send target connections out this network interface only (Linux).
+      --upstream-proxy <url> Reach targets through this proxy: socks5://[user:pass@]host[:port]
+                             (names resolved here), socks5h:// (names resolved by the proxy)
+                             or http://[user:pass@]host[:port] (CONNECT).
+      --send-proxy-protocol <v>
+                             Start each target connection with a PROXY protocol v1 or v2 header
+                             carrying the client address the hub saw (e.g. for HAProxy, Postgres).
+      --tun <name>           Relay raw IP packets from the hub through this TUN interface (socks mode, Linux, experimental).
+      --tls                  Wrap the hub connection in TLS.
+      --tls-ca <file>        PEM CA bundle used to verify the hub (default system roots).
+      --tls-server-name <n>  Server name to verify instead of --hub-host.
+      --tls-insecure         Skip hub certificate verification (testing only).
+      --tls-cert <file>      PEM client certificate presented to the hub (mutual TLS).
+      --tls-key <file>       PEM private key for --tls-cert.
+      --via-ssh <user@host>  Reach the hub through an SSH jump host (host may include :port).
+      --ssh-key <file>       Private key for --via-ssh (default: ssh-agent via SSH_AUTH_SOCK).
+      --ssh-known-hosts <f>  known_hosts file used to verify the jump host (default ~/.ssh/known_hosts).
+      --hub-proxy <url>      Reach the hub through this proxy, as socks5://, socks5h:// or http://
+                             [user:pass@]host[:port] like --upstream-proxy.
+      --transport <name>     Carry the hub link over tcp (default) or quic: one UDP connection to
+                             the hub port with a stream per worker, verified like --tls (experimental).
+                             Builds that register more transports accept their names too.
+      --noise-hub-key <f>    Hub Noise public key (hex); encrypts the hub link with Noise_IK.
+      --noise-key <file>     Worker Noise private key (default: a new key per run).
+      --compress <alg>       Offer to compress bridged streams with zstd or snappy (default none).
+      --scan-concurrency <n> Ports probed at once for a REQUEST SCAN from the hub (default 32).
+      --pending-requests <n> Queue up to n REQUESTs a protocol 2 hub pipelines while a worker is
+                             busy; more are answered RETRY (default 0, no pipelining).
+      --max-sessions <n>     Bridge at most n streams at once across the pool; more are answered
+                             RETRY or a failure REPLY (default 0, no limit).
+      --queue-timeout <d>    Let a request past --max-sessions wait this long for a free slot
+                             before turning it away (default 0, at once).
+      --max-load <n>         Turn new sessions away like --max-sessions while the 1-minute load
+                             average per CPU is above n (default 0, off; Linux only).
+      --max-cpu <percent>    Turn new sessions away while the host's CPUs were busier than this
+                             over the last second (default 0, off; Linux only).
+      --progress             Offer PROGRESS lines (resolving, connecting) to the hub during slow dials.
+      --protocol <v>         Hub protocol version: 1, 2 or auto (2, falling back to 1; default auto).
+      --flow-control         Offer a protocol 2 hub per-stream flow control windows, so a slow client
+                             or target cannot back data up on the hub link.
+      --flow-window <size>   With --flow-control, let the hub have this much of a stream unread
+                             by the worker (default 1M).
+      --max-frame-size <size>
+                             Put at most this much stream data in each protocol 2 frame, so control
+                             messages wait behind less of it (default 65535).
+      --tcp-keepalive <d>    Send TCP keepalive probes on hub and target connections after this much
+                             silence (default 15s, 0 disables).
+      --tcp-keepalive-interval <d>
+                             Time between unanswered keepalive probes (default 15s).
+      --heartbeat <d>        PING an idle hub connection after this much silence (default 30s, 0 disables).
+      --heartbeat-timeout <d>
+                             Reconnect when the hub does not answer a PING within this long (default 10s).
+      --stall-timeout <d>    Log a bridge direction that cannot write for this long while the other
+                             flows (e.g. 30s; default 0, off).
+      --idle-timeout <d>     Close a bridged session after this long without data in either direction
+                             (e.g. 15m; default 0, off).
+      --simulate-latency <d> Delay every target dial and all data read from targets by this much
+                             (e.g. 80ms), to test against tunnel latency in staging.
+      --drain-timeout <d>    On SIGINT/SIGTERM, let active sessions finish for up to this long
+                             before closing them (default 30s, 0 closes them at once).
+      --expire-at <time>     RFC3339 timestamp after which the pool shuts itself down for good.
+      --max-runtime <dur>    Maximum time to run before shutting down (e.g. 8h or 72h).
+      --state-file <path>    Write a JSON state file describing the running pool; removed on exit.
+      --admin-socket <addr>  Answer "poolgo ctl" on this Unix socket path or loopback host:port.
+      --shutdown-key <file>  Shared secret used to verify SHUTDOWN messages sent by the hub.
+      --shutdown-wipe        Delete credential files (including --shutdown-key) after a remote SHUTDOWN.
+      --auth-token-file <f>  Pre-shared token used to authenticate to the hub.
+      --auth-mode <mode>     How the token is presented: hmac (challenge/response) or token (default hmac).
+      --log-format <fmt>     Log output format: text or json (default text).
+      --log-level <spec>     Log level overall and per module pool, bridge or proto
+                             (e.g. warn,proto=trace; default info).
+      --log-repeat-interval <d>
+                             Log a hub connection error that keeps repeating once, then as a summary
+                             with a count this often (default 1m, 0 logs every one).
+      --redact <glob>        Hide destination hosts matching this glob in the log, but not in the
+                             audit log (e.g. '*.corp.example'; repeatable).
+      --redact-mode <mode>   How --redact hides a host: hash or truncate (default hash).
+      --audit-log <path>     Append security-relevant events to this file, one record per line.
+      --audit-format <fmt>   Audit record format: json, cef or leef (default json).
+      --audit-sample <r>     Fraction of sessions (0-1) recorded in the audit log; denials are always recorded (default 0).
+      --session-log <path>   Append a summary of every bridged session to this file.
+      --session-log-format <fmt>
+                             Session log format: jsonl or csv (default jsonl).
+      --tamper-notice        Report debugger attachment and executable changes to the hub and audit log.
+      --tamper-interval <d>  How often --tamper-notice re-checks (default 30s).
+      --stats-interval <d>   Send STATS (config hash, activity) to the hub this often (default off).
+      --inbound-limit <size> Alert when a session receives more than this from its target (e.g. 50M).
+      --inbound-limit-action <a>
+                             What to do past --inbound-limit: alert or close (default alert).
+      --alert-pattern <p>    Audit bridged traffic containing this text, or hex:<bytes> (repeatable).
+      --alert-webhook <url>  Also POST a JSON event to this URL for every --alert-pattern match.
+      --hook <file>          Starlark script that may allow, deny or rewrite each request from the hub.
+      --label <key=value>    Label this pool for --hook scripts (repeatable).
+      --alias <name=dest>    Name a destination, host or host:port, in logs, audit records and
+                             traces (repeatable; e.g. dc1-db=10.3.4.5:5432).
+      --expose <name=host:port>
+                             Offer a service the bastion can reach for a hub started with
+                             --expose <name>=... to publish on a port of its own (repeatable).
+      --plugin <command>     Run an external authorizer, audit sink or transport plugin (repeatable).
+      --allow <rule>         Only let the hub reach destinations matching an allow rule, as
+                             "<cidr|ip|glob>[:<ports>]" (e.g. 10.1.0.0/16:22,443; repeatable).
+      --deny <rule>          Refuse destinations matching this rule, even if allowed (repeatable).
+      --acl-file <file>      Read "allow <rule>" and "deny <rule>" lines from this file too.
+      --deny-private-resolved
+                             Refuse domains that resolve to loopback, private or link-local
+                             addresses not covered by an --allow address rule.
+      --otlp-endpoint <url>  Export OpenTelemetry spans for handshakes, dials and bridges over
+                             OTLP/HTTP (e.g. http://collector:4318).
+      --trace-sample <r>     Fraction of requests (0-1) traced with --otlp-endpoint (default 1).
+      --version              Print the build version and exit.
   -h, --help                 Show this help message and exit.
 
 poolgo maintains a pool of outbound connections from the bastion to the hub.
 In direct mode each worker declares a fixed target and repeatedly proxies
 streams to that host:port. In socks mode, workers accept per-connection
-destinations supplied by the hub.`
+destinations supplied by the hub. Run "poolgo cleanup -h" for teardown help
+and "poolgo keygen <file>" to create a Noise key pair.`
 )
 
 // Usage returns the command line help text.
@@ -49,6 +215,12 @@ const (
 	ModeSocks  Mode = "socks"
 )
 
+// Hub link transports for --transport.
+const (
+	transportTCP  = "tcp"
+	transportQUIC = "quic"
+)
+
 // Options captures parsed CLI configuration.
 type Options struct {
 	HubHost    string
@@ -58,10 +230,186 @@ type Options struct {
 	TargetPort int
 	Workers    int
 	RetryDelay time.Duration
+	Progress   bool
+	Protocol   int // 0 offers the newest version and falls back to 1
+	SoRcvBuf   int
+	SoSndBuf   int
+	ReadAhead  int
+	TargetMSS  int
+	VRF        string
+	TUN        string
+	Compress   string // CompressZstd, CompressSnappy or "" for none
+
+	// FlowControl offers protocol 2 hubs per-stream flow control, with
+	// FlowWindow bytes the hub may send unread (0 for the protocol's
+	// FlowWindow). MaxFrameSize limits the stream bytes in each protocol 2
+	// data frame; 0 for the most a frame holds.
+	FlowControl  bool
+	FlowWindow   int
+	MaxFrameSize int
+
+	// RateLimit caps each direction of every session and PoolRateLimit
+	// each direction of all of them together, in bytes per second.
+	RateLimit     int64
+	PoolRateLimit int64
+
+	// MaxSessions caps the streams bridged at once; a request past it
+	// waits up to QueueTimeout for a slot.
+	MaxSessions  int
+	QueueTimeout time.Duration
+
+	// MaxLoad and MaxCPU turn requests away like MaxSessions while the
+	// host's load average per CPU, or the percentage of CPU time busy,
+	// is above them; see loadMonitor.
+	MaxLoad float64
+	MaxCPU  float64
+
+	// MaxWorkers, when set, replaces the fixed Workers count with one
+	// that follows demand; see scaleWorkers.
+	MinWorkers     int
+	MaxWorkers     int
+	ScaleDownAfter time.Duration
+
+	SourceRules  []SourceRule
+	NetnsRules   []NetnsRule
+	ContainerAPI string // Docker Engine API socket for container:/label: targets
+	Kubeconfig   string // kubeconfig file or "in-cluster" for k8s: targets
+
+	// DNSServer resolves target names instead of the system resolver; see
+	// NewResolver.
+	DNSServer string
+
+	// BindAddress and BindInterface pin target connections to a local
+	// address and a network interface.
+	BindAddress   netip.Addr
+	BindInterface string
+
+	// UpstreamProxy is the proxy CONNECT streams reach their targets
+	// through; see parseUpstreamProxy.
+	UpstreamProxy string
+
+	// SendProxyProtocol, when set, starts every CONNECT stream with a
+	// PROXY protocol header naming the client the hub accepted.
+	SendProxyProtocol ProxyProtocol
+
+	ScanConcurrency int
+	PendingRequests int
+
+	HubDialTimeout    time.Duration
+	TargetDialTimeout time.Duration
+	TargetDNSTTL      time.Duration // how long direct-mode target addresses are reused; 0 resolves per session
+	KeepAlive         time.Duration // like net.Dialer: 0 is the default, negative disables
+	KeepAliveInterval time.Duration
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	DrainTimeout      time.Duration
+	StallTimeout      time.Duration
+	IdleTimeout       time.Duration
+	SimulateLatency   time.Duration
+
+	TLS           bool
+	TLSCAFile     string
+	TLSServerName string
+	TLSInsecure   bool
+	TLSCertFile   string
+	TLSKeyFile    string
+
+	NoiseHubKeyFile string
+	NoiseKeyFile    string
+
+	ViaSSH        string
+	SSHKeyFile    string
+	SSHKnownHosts string
+
+	// HubProxy is the proxy workers reach the hub through; see
+	// parseUpstreamProxy.
+	HubProxy string
+
+	// HubURL is the ws:// or wss:// URL the hub link is carried over
+	// WebSocket to; it sets HubHost and HubPort.
+	HubURL string
+
+	// Transport names the registered transport that carries the hub link:
+	// transportTCP, with TLS and WebSocket as configured, transportQUIC, or
+	// one a program embedding the pool registered.
+	Transport string
+
+	ExpireAt   time.Time
+	MaxRuntime time.Duration
+	StateFile  string
+
+	AdminSocket string
+
+	ShutdownKeyFile string
+	ShutdownKey     *Secret
+	ShutdownWipe    bool
+
+	AuthTokenFile string
+	AuthToken     *Secret
+	AuthMode      AuthMode
+
+	LogFormat logx.Format
+	LogLevel  logx.Levels
+
+	// LogRepeats is how often a worker summarizes a connection error it
+	// keeps running into instead of logging every retry; 0 logs them all.
+	LogRepeats time.Duration
+
+	// Redact lists host globs the log shows only as RedactMode says;
+	// audit records keep them.
+	Redact     []string
+	RedactMode RedactMode
+
+	AuditLog         string
+	AuditFormat      AuditFormat
+	AuditSample      float64
+	SessionLog       string
+	SessionLogFormat SessionLogFormat
+	TamperNotice     bool
+	TamperInterval   time.Duration
+	StatsInterval    time.Duration
 
-	DirectDestination *Destination
+	InboundLimit  int64
+	InboundAction InboundAction
+	AlertPatterns []*AlertPattern
+	AlertWebhook  string
+
+	HookFile string
+	Hook     *Hook
+	Labels   map[string]string
+	Aliases  []DestAlias
+	Exposes  []Expose
+	Plugins  []string
+
+	// Allow and Deny hold the --allow and --deny rules followed by those
+	// from ACLFile; see checkACL.
+	Allow   []ACLRule
+	Deny    []ACLRule
+	ACLFile string
+
+	// DenyPrivate keeps domains from reaching loopback, private
+	// and link-local addresses; see privateDenied.
+	DenyPrivate bool
+
+	OTLPEndpoint string
+	TraceSample  float64
+
+	// Targets are the direct-mode destinations. Worker n serves
+	// Targets[n % len(Targets)].
+	Targets []*Destination
+
+	// TargetPatterns replace Targets for a constrained direct-mode pool:
+	// workers register in socks mode and serve only matching CONNECTs.
+	TargetPatterns []ACLRule
+
+	// Sources says where the options came from, for the startup banner.
+	Sources OptionSources
 }
 
+// logModules are what --log-level can set apart: bridge for bridged
+// sessions, proto for the hub protocol and pool for everything else.
+var logModules = []string{"pool", "bridge", "proto"}
+
 // Destination represents a fixed direct-mode target.
 type Destination struct {
 	AddrType AddrType
@@ -83,23 +431,132 @@ func ParseArgs(args []string) (*Options, error) {
 	fs := flag.NewFlagSet("poolgo", flag.ContinueOnError)
 	fs.SetOutput(flagDiscard{})
 
+	var alertPatterns stringList
+	fs.Var(&alertPatterns, "alert-pattern", "")
+	var labels stringList
+	fs.Var(&labels, "label", "")
+	var aliases stringList
+	fs.Var(&aliases, "alias", "")
+	var exposes stringList
+	fs.Var(&exposes, "expose", "")
+	var plugins stringList
+	fs.Var(&plugins, "plugin", "")
+	var targets stringList
+	fs.Var(&targets, "target", "")
+	var targetPatterns stringList
+	fs.Var(&targetPatterns, "target-pattern", "")
+	var sourceRules stringList
+	fs.Var(&sourceRules, "source-rule", "")
+	var netnsRules stringList
+	fs.Var(&netnsRules, "netns-rule", "")
+	var redact stringList
+	fs.Var(&redact, "redact", "")
+	var allowRules, denyRules stringList
+	fs.Var(&allowRules, "allow", "")
+	fs.Var(&denyRules, "deny", "")
+
 	var (
-		hubHost       = fs.String("hub-host", "127.0.0.1", "")
-		hubHostAlt    = fs.String("j", "", "")
-		hubPort       = fs.Int("hub-port", 0, "")
-		hubPortAlt    = fs.Int("p", 0, "")
-		mode          = fs.String("mode", "direct", "")
-		modeAlt       = fs.String("m", "", "")
-		targetHost    = fs.String("target-host", "", "")
-		targetHostAlt = fs.String("t", "", "")
-		targetPort    = fs.Int("target-port", 0, "")
-		targetPortAlt = fs.Int("T", 0, "")
-		workers       = fs.Int("workers", 4, "")
-		workersAlt    = fs.Int("w", 0, "")
-		retryDelay    = fs.Float64("retry-delay", 1.0, "")
-		retryDelayAlt = fs.Float64("r", 0.0, "")
-		helpFlag      = fs.Bool("help", false, "")
-		helpFlagAlt   = fs.Bool("h", false, "")
+		hubHost        = fs.String("hub-host", "127.0.0.1", "")
+		hubHostAlt     = fs.String("j", "", "")
+		hubPort        = fs.Int("hub-port", 0, "")
+		hubPortAlt     = fs.Int("p", 0, "")
+		mode           = fs.String("mode", "direct", "")
+		modeAlt        = fs.String("m", "", "")
+		targetHost     = fs.String("target-host", "", "")
+		targetHostAlt  = fs.String("t", "", "")
+		targetPort     = fs.Int("target-port", 0, "")
+		targetPortAlt  = fs.Int("T", 0, "")
+		workers        = fs.Int("workers", 4, "")
+		workersAlt     = fs.Int("w", 0, "")
+		minWorkers     = fs.Int("min-workers", 1, "")
+		maxWorkers     = fs.Int("max-workers", 0, "")
+		scaleDownAfter = fs.Duration("scale-down-after", defaultScaleDownAfter, "")
+		retryDelay     = fs.Float64("retry-delay", 1.0, "")
+		retryDelayAlt  = fs.Float64("r", 0.0, "")
+		soRcvBuf       = fs.String("so-rcvbuf", "", "")
+		readAhead      = fs.String("read-ahead", "", "")
+		rateLimit      = fs.String("rate-limit", "", "")
+		poolRateLimit  = fs.String("pool-rate-limit", "", "")
+		soSndBuf       = fs.String("so-sndbuf", "", "")
+		targetMSS      = fs.Int("target-mss", 0, "")
+		vrfDevice      = fs.String("vrf", "", "")
+		dnsServer      = fs.String("dns-server", "", "")
+		bindAddress    = fs.String("bind-address", "", "")
+		bindInterface  = fs.String("bind-interface", "", "")
+		upstreamProxy  = fs.String("upstream-proxy", "", "")
+		sendProxy      = fs.String("send-proxy-protocol", "", "")
+		containerAPI   = fs.String("container-api", "", "")
+		kubeconfigFile = fs.String("kubeconfig", "", "")
+		tunDevice      = fs.String("tun", "", "")
+		useTLS         = fs.Bool("tls", false, "")
+		tlsCA          = fs.String("tls-ca", "", "")
+		tlsServerName  = fs.String("tls-server-name", "", "")
+		tlsInsecure    = fs.Bool("tls-insecure", false, "")
+		tlsCert        = fs.String("tls-cert", "", "")
+		tlsKey         = fs.String("tls-key", "", "")
+		viaSSH         = fs.String("via-ssh", "", "")
+		sshKey         = fs.String("ssh-key", "", "")
+		sshKnownHosts  = fs.String("ssh-known-hosts", "", "")
+		hubProxy       = fs.String("hub-proxy", "", "")
+		hubURL         = fs.String("hub-url", "", "")
+		hubTransport   = fs.String("transport", transportTCP, "")
+		noiseHubKey    = fs.String("noise-hub-key", "", "")
+		noiseKey       = fs.String("noise-key", "", "")
+		compressAlg    = fs.String("compress", "none", "")
+		scanWorkers    = fs.Int("scan-concurrency", 32, "")
+		pendingReqs    = fs.Int("pending-requests", 0, "")
+		maxSessions    = fs.Int("max-sessions", 0, "")
+		queueTimeout   = fs.Duration("queue-timeout", 0, "")
+		maxLoad        = fs.Float64("max-load", 0, "")
+		maxCPU         = fs.Float64("max-cpu", 0, "")
+		progressFlag   = fs.Bool("progress", false, "")
+		flowControl    = fs.Bool("flow-control", false, "")
+		flowWindow     = fs.String("flow-window", "", "")
+		maxFrameSize   = fs.String("max-frame-size", "", "")
+		protocol       = fs.String("protocol", "auto", "")
+		hubDialWait    = fs.Duration("hub-dial-timeout", defaultDialTimeout, "")
+		targetDialWait = fs.Duration("target-dial-timeout", defaultDialTimeout, "")
+		targetDNSTTL   = fs.Duration("target-dns-ttl", 0, "")
+		keepAlive      = fs.Duration("tcp-keepalive", defaultKeepAlive, "")
+		keepAliveEvery = fs.Duration("tcp-keepalive-interval", defaultKeepAlive, "")
+		heartbeat      = fs.Duration("heartbeat", 30*time.Second, "")
+		heartbeatWait  = fs.Duration("heartbeat-timeout", 10*time.Second, "")
+		stallTimeout   = fs.Duration("stall-timeout", 0, "")
+		idleTimeout    = fs.Duration("idle-timeout", 0, "")
+		latency        = fs.Duration("simulate-latency", 0, "")
+		drainTimeout   = fs.Duration("drain-timeout", 30*time.Second, "")
+		expireAt       = fs.String("expire-at", "", "")
+		maxRuntime     = fs.Duration("max-runtime", 0, "")
+		stateFile      = fs.String("state-file", "", "")
+		adminSocket    = fs.String("admin-socket", "", "")
+		shutdownKey    = fs.String("shutdown-key", "", "")
+		shutdownWipe   = fs.Bool("shutdown-wipe", false, "")
+		authTokenFile  = fs.String("auth-token-file", "", "")
+		authMode       = fs.String("auth-mode", "hmac", "")
+		logFormat      = fs.String("log-format", "text", "")
+		logLevel       = fs.String("log-level", "info", "")
+		logRepeats     = fs.Duration("log-repeat-interval", time.Minute, "")
+		redactMode     = fs.String("redact-mode", "hash", "")
+		auditLog       = fs.String("audit-log", "", "")
+		auditFormat    = fs.String("audit-format", "json", "")
+		auditSample    = fs.Float64("audit-sample", 0, "")
+		sessionLog     = fs.String("session-log", "", "")
+		sessionFormat  = fs.String("session-log-format", "jsonl", "")
+		tamperNotice   = fs.Bool("tamper-notice", false, "")
+		tamperEvery    = fs.Duration("tamper-interval", 30*time.Second, "")
+		statsEvery     = fs.Duration("stats-interval", 0, "")
+		inboundLimit   = fs.String("inbound-limit", "", "")
+		inboundAction  = fs.String("inbound-limit-action", "alert", "")
+		alertWebhook   = fs.String("alert-webhook", "", "")
+		hookFile       = fs.String("hook", "", "")
+		aclFile        = fs.String("acl-file", "", "")
+		denyPrivate    = fs.Bool("deny-private-resolved", false, "")
+		otlpEndpoint   = fs.String("otlp-endpoint", "", "")
+		traceSample    = fs.Float64("trace-sample", 1, "")
+		configFile     = fs.String("config", "", "")
+		versionFlag    = fs.Bool("version", false, "")
+		helpFlag       = fs.Bool("help", false, "")
+		helpFlagAlt    = fs.Bool("h", false, "")
 	)
 
 	if err := fs.Parse(args); err != nil {
@@ -111,19 +568,101 @@ func ParseArgs(args []string) (*Options, error) {
 	if *helpFlag || *helpFlagAlt {
 		return nil, ErrShowUsage
 	}
+	if *versionFlag {
+		return nil, ErrShowVersion
+	}
+	var sources OptionSources
+	fs.Visit(func(f *flag.Flag) { sources.Args = append(sources.Args, f.Name) })
+	if *configFile != "" {
+		if err := config.ApplyFile(fs, *configFile); err != nil {
+			return nil, err
+		}
+		sources.ConfigFile = *configFile
+		fs.Visit(func(f *flag.Flag) {
+			if !slices.Contains(sources.Args, f.Name) {
+				sources.File = append(sources.File, f.Name)
+			}
+		})
+	}
 
-	hubHostVal := normalizeString(*hubHostAlt, *hubHost)
+	hubHostVal := unbracket(normalizeString(*hubHostAlt, *hubHost))
 	hubPortVal := normalizeInt(*hubPortAlt, *hubPort)
 	modeVal := Mode(strings.ToLower(normalizeString(*modeAlt, *mode)))
 	workersVal := normalizeInt(*workersAlt, *workers)
-	targetHostVal := normalizeString(*targetHostAlt, *targetHost)
+	targetHostVal := unbracket(normalizeString(*targetHostAlt, *targetHost))
 	targetPortVal := normalizeInt(*targetPortAlt, *targetPort)
 
 	opts := &Options{
-		HubHost: hubHostVal,
-		HubPort: hubPortVal,
-		Mode:    modeVal,
-		Workers: workersVal,
+		HubHost:    hubHostVal,
+		HubPort:    hubPortVal,
+		Mode:       modeVal,
+		Workers:    workersVal,
+		Progress:   *progressFlag,
+		TargetMSS:  *targetMSS,
+		VRF:        *vrfDevice,
+		TUN:        *tunDevice,
+		MaxRuntime: *maxRuntime,
+		StateFile:  *stateFile,
+
+		AdminSocket: *adminSocket,
+		Sources:     sources,
+
+		ScanConcurrency: *scanWorkers,
+		PendingRequests: *pendingReqs,
+		MaxSessions:     *maxSessions,
+		QueueTimeout:    *queueTimeout,
+		MaxLoad:         *maxLoad,
+		MaxCPU:          *maxCPU,
+
+		HubDialTimeout:    *hubDialWait,
+		TargetDialTimeout: *targetDialWait,
+		TargetDNSTTL:      *targetDNSTTL,
+		KeepAlive:         *keepAlive,
+		KeepAliveInterval: *keepAliveEvery,
+		HeartbeatInterval: *heartbeat,
+		HeartbeatTimeout:  *heartbeatWait,
+		DrainTimeout:      *drainTimeout,
+		StallTimeout:      *stallTimeout,
+		IdleTimeout:       *idleTimeout,
+		SimulateLatency:   *latency,
+
+		TLS:           *useTLS,
+		TLSCAFile:     *tlsCA,
+		TLSServerName: *tlsServerName,
+		TLSInsecure:   *tlsInsecure,
+		TLSCertFile:   *tlsCert,
+		TLSKeyFile:    *tlsKey,
+
+		NoiseHubKeyFile: *noiseHubKey,
+		NoiseKeyFile:    *noiseKey,
+
+		ViaSSH:        *viaSSH,
+		SSHKeyFile:    *sshKey,
+		SSHKnownHosts: *sshKnownHosts,
+
+		ShutdownKeyFile: *shutdownKey,
+		ShutdownWipe:    *shutdownWipe,
+
+		AuthTokenFile: *authTokenFile,
+		AuthMode:      AuthMode(strings.ToLower(*authMode)),
+
+		AuditLog:         *auditLog,
+		AuditFormat:      AuditFormat(strings.ToLower(*auditFormat)),
+		AuditSample:      *auditSample,
+		SessionLog:       *sessionLog,
+		SessionLogFormat: SessionLogFormat(strings.ToLower(*sessionFormat)),
+		TamperNotice:     *tamperNotice,
+		TamperInterval:   *tamperEvery,
+		StatsInterval:    *statsEvery,
+
+		InboundAction: InboundAction(strings.ToLower(*inboundAction)),
+		AlertWebhook:  *alertWebhook,
+
+		HookFile: *hookFile,
+		Plugins:  plugins,
+
+		OTLPEndpoint: *otlpEndpoint,
+		TraceSample:  *traceSample,
 	}
 
 	retrySeconds := normalizeFloat(*retryDelayAlt, *retryDelay)
@@ -137,21 +676,532 @@ func ParseArgs(args []string) (*Options, error) {
 		opts.TargetHost = targetHostVal
 		opts.TargetPort = targetPortVal
 	case ModeSocks:
-		if targetHostVal != "" || targetPortVal != 0 {
-			return nil, fmt.Errorf("--target-host/--target-port are not used in socks mode")
+		if targetHostVal != "" || targetPortVal != 0 || len(targets) > 0 || len(targetPatterns) > 0 {
+			return nil, fmt.Errorf("--target-host/--target-port/--target/--target-pattern are not used in socks mode")
 		}
 	default:
 		return nil, fmt.Errorf("--mode must be direct or socks")
 	}
 
+	if opts.HubURL = *hubURL; opts.HubURL != "" {
+		u, host, port, err := parseHubURL(opts.HubURL)
+		if err != nil {
+			return nil, fmt.Errorf("--hub-url: %v", err)
+		}
+		named := false
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "hub-host", "j", "hub-port", "p":
+				named = true
+			}
+		})
+		if named {
+			return nil, fmt.Errorf("--hub-url already names the hub; drop --hub-host and --hub-port")
+		}
+		if u.Scheme == "ws" && opts.TLS {
+			return nil, fmt.Errorf("--tls with a ws:// --hub-url; use wss:// instead")
+		}
+		opts.HubHost, opts.HubPort = host, port
+		opts.TLS = opts.TLS || u.Scheme == "wss"
+	}
 	if opts.HubPort <= 0 || opts.HubPort > 65535 {
 		return nil, fmt.Errorf("missing or invalid --hub-port")
 	}
 	if opts.Workers <= 0 {
 		return nil, fmt.Errorf("--workers must be positive")
 	}
+	opts.MinWorkers, opts.MaxWorkers, opts.ScaleDownAfter = *minWorkers, *maxWorkers, *scaleDownAfter
+	if opts.MaxWorkers < 0 {
+		return nil, fmt.Errorf("--max-workers must not be negative")
+	}
+	if opts.MaxWorkers > 0 {
+		if opts.MinWorkers <= 0 || opts.MinWorkers > opts.MaxWorkers {
+			return nil, fmt.Errorf("--min-workers must be between 1 and --max-workers")
+		}
+		if opts.ScaleDownAfter <= 0 {
+			return nil, fmt.Errorf("--scale-down-after must be positive")
+		}
+	}
+	switch opts.Transport = strings.ToLower(*hubTransport); opts.Transport {
+	case transportTCP:
+	case transportQUIC:
+		// QUIC runs its own TLS 1.3 handshake over UDP, which none of
+		// these can carry.
+		switch {
+		case opts.HubURL != "":
+			return nil, fmt.Errorf("--transport quic cannot be combined with --hub-url")
+		case opts.ViaSSH != "":
+			return nil, fmt.Errorf("--transport quic cannot be combined with --via-ssh")
+		case *hubProxy != "":
+			return nil, fmt.Errorf("--transport quic cannot be combined with --hub-proxy")
+		case opts.TLS:
+			return nil, fmt.Errorf("--transport quic always encrypts the hub link; drop --tls")
+		}
+	default:
+		if !transport.Registered(opts.Transport) {
+			return nil, fmt.Errorf("--transport must be one of %s", strings.Join(transport.Names(), ", "))
+		}
+	}
+	if !opts.TLS && opts.Transport != transportQUIC && (opts.TLSCAFile != "" || opts.TLSServerName != "" || opts.TLSInsecure ||
+		opts.TLSCertFile != "" || opts.TLSKeyFile != "") {
+		return nil, fmt.Errorf("--tls-ca, --tls-server-name, --tls-insecure, --tls-cert and --tls-key require --tls or --transport quic")
+	}
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be used together")
+	}
+	if opts.TLSInsecure && opts.TLSCAFile != "" {
+		return nil, fmt.Errorf("--tls-insecure and --tls-ca are mutually exclusive")
+	}
+	if opts.ViaSSH != "" {
+		if _, _, err := parseSSHTarget(opts.ViaSSH); err != nil {
+			return nil, err
+		}
+	} else if opts.SSHKeyFile != "" || opts.SSHKnownHosts != "" {
+		return nil, fmt.Errorf("--ssh-key and --ssh-known-hosts require --via-ssh")
+	}
+	if opts.HubProxy = *hubProxy; opts.HubProxy != "" {
+		if _, err := parseUpstreamProxy(opts.HubProxy); err != nil {
+			return nil, fmt.Errorf("--hub-proxy: %v", err)
+		}
+		if opts.ViaSSH != "" {
+			return nil, fmt.Errorf("--hub-proxy and --via-ssh both choose how to reach the hub; use one")
+		}
+	}
+	if opts.NoiseKeyFile != "" && opts.NoiseHubKeyFile == "" {
+		return nil, fmt.Errorf("--noise-key requires --noise-hub-key")
+	}
+	if *expireAt != "" {
+		t, err := time.Parse(time.RFC3339, *expireAt)
+		if err != nil {
+			return nil, fmt.Errorf("--expire-at must be an RFC3339 timestamp: %v", err)
+		}
+		opts.ExpireAt = t
+	}
+	if opts.MaxRuntime < 0 {
+		return nil, fmt.Errorf("--max-runtime must not be negative")
+	}
+	if opts.AdminSocket != "" {
+		if _, _, err := AdminAddress(opts.AdminSocket); err != nil {
+			return nil, fmt.Errorf("--admin-socket: %v", err)
+		}
+	}
+	format, err := logx.ParseFormat(*logFormat)
+	if err != nil {
+		return nil, fmt.Errorf("--log-format must be text or json")
+	}
+	opts.LogFormat = format
+	if opts.LogLevel, err = logx.ParseLevels(*logLevel, logModules); err != nil {
+		return nil, fmt.Errorf("--log-level: %v", err)
+	}
+	if _, err := NewResolver(*dnsServer); err != nil {
+		return nil, fmt.Errorf("--dns-server: %v", err)
+	}
+	opts.DNSServer = *dnsServer
+	if opts.LogRepeats = *logRepeats; opts.LogRepeats < 0 {
+		return nil, fmt.Errorf("--log-repeat-interval must not be negative")
+	}
+	for _, pattern := range redact {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("--redact: invalid pattern %q", pattern)
+		}
+		opts.Redact = append(opts.Redact, strings.ToLower(pattern))
+	}
+	switch opts.RedactMode = RedactMode(strings.ToLower(*redactMode)); opts.RedactMode {
+	case RedactHash, RedactTruncate:
+	default:
+		return nil, fmt.Errorf("--redact-mode must be hash or truncate")
+	}
+	switch opts.AuditFormat {
+	case AuditJSON, AuditCEF, AuditLEEF:
+	default:
+		return nil, fmt.Errorf("--audit-format must be json, cef or leef")
+	}
+	switch opts.SessionLogFormat {
+	case SessionLogJSONL, SessionLogCSV:
+	default:
+		return nil, fmt.Errorf("--session-log-format must be jsonl or csv")
+	}
+	if opts.AuditSample < 0 || opts.AuditSample > 1 {
+		return nil, fmt.Errorf("--audit-sample must be between 0 and 1")
+	}
+	if opts.TamperInterval <= 0 {
+		return nil, fmt.Errorf("--tamper-interval must be positive")
+	}
+	switch alg := strings.ToLower(*compressAlg); alg {
+	case "none", "":
+	case CompressZstd, CompressSnappy:
+		opts.Compress = alg
+	default:
+		return nil, fmt.Errorf("--compress must be zstd, snappy or none")
+	}
+	if opts.ScanConcurrency < 1 {
+		return nil, fmt.Errorf("--scan-concurrency must be positive")
+	}
+	if opts.PendingRequests < 0 {
+		return nil, fmt.Errorf("--pending-requests must not be negative")
+	}
+	if opts.MaxSessions < 0 {
+		return nil, fmt.Errorf("--max-sessions must not be negative")
+	}
+	if opts.QueueTimeout < 0 {
+		return nil, fmt.Errorf("--queue-timeout must not be negative")
+	}
+	if opts.MaxLoad < 0 {
+		return nil, fmt.Errorf("--max-load must not be negative")
+	}
+	if opts.MaxCPU < 0 || opts.MaxCPU > 100 {
+		return nil, fmt.Errorf("--max-cpu must be a percentage from 0 to 100")
+	}
+	if (opts.MaxLoad > 0 || opts.MaxCPU > 0) && !loadSupported {
+		return nil, fmt.Errorf("--max-load and --max-cpu are only supported on Linux")
+	}
+	if opts.HubDialTimeout <= 0 {
+		return nil, fmt.Errorf("--hub-dial-timeout must be positive")
+	}
+	if opts.TargetDialTimeout <= 0 {
+		return nil, fmt.Errorf("--target-dial-timeout must be positive")
+	}
+	if opts.TargetDNSTTL < 0 {
+		return nil, fmt.Errorf("--target-dns-ttl must not be negative")
+	}
+	if opts.KeepAlive < 0 {
+		return nil, fmt.Errorf("--tcp-keepalive must not be negative")
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = -1
+	}
+	if opts.KeepAliveInterval <= 0 {
+		return nil, fmt.Errorf("--tcp-keepalive-interval must be positive")
+	}
+	if opts.HeartbeatInterval < 0 {
+		return nil, fmt.Errorf("--heartbeat must not be negative")
+	}
+	if opts.HeartbeatTimeout <= 0 {
+		return nil, fmt.Errorf("--heartbeat-timeout must be positive")
+	}
+	if opts.DrainTimeout < 0 {
+		return nil, fmt.Errorf("--drain-timeout must not be negative")
+	}
+	if opts.StallTimeout < 0 {
+		return nil, fmt.Errorf("--stall-timeout must not be negative")
+	}
+	if opts.IdleTimeout < 0 {
+		return nil, fmt.Errorf("--idle-timeout must not be negative")
+	}
+	if opts.SimulateLatency < 0 {
+		return nil, fmt.Errorf("--simulate-latency must not be negative")
+	}
+	if opts.StatsInterval < 0 {
+		return nil, fmt.Errorf("--stats-interval must not be negative")
+	}
+	for _, b := range []struct {
+		flag, value string
+		dst         *int
+	}{
+		{"--so-rcvbuf", *soRcvBuf, &opts.SoRcvBuf},
+		{"--so-sndbuf", *soSndBuf, &opts.SoSndBuf},
+		{"--read-ahead", *readAhead, &opts.ReadAhead},
+	} {
+		if b.value == "" {
+			continue
+		}
+		size, err := parseByteSize(b.value)
+		if err != nil || size > maxSocketBuffer {
+			return nil, fmt.Errorf("%s must be a size between 1 and 1G", b.flag)
+		}
+		*b.dst = int(size)
+	}
+	for _, r := range []struct {
+		flag, value string
+		dst         *int64
+	}{
+		{"--rate-limit", *rateLimit, &opts.RateLimit},
+		{"--pool-rate-limit", *poolRateLimit, &opts.PoolRateLimit},
+	} {
+		if r.value == "" {
+			continue
+		}
+		rate, err := ParseRate(r.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a rate such as 512K or 10M, or off", r.flag)
+		}
+		*r.dst = rate
+	}
+	if opts.TUN != "" {
+		if !TUNSupported {
+			return nil, fmt.Errorf("--tun is only supported on Linux")
+		}
+		if opts.Mode != ModeSocks {
+			return nil, fmt.Errorf("--tun requires --mode socks")
+		}
+	}
+	switch strings.ToLower(*protocol) {
+	case "auto":
+	case "1", "2":
+		opts.Protocol, _ = strconv.Atoi(*protocol)
+	default:
+		return nil, fmt.Errorf("--protocol must be 1, 2 or auto")
+	}
+	opts.FlowControl = *flowControl
+	if opts.FlowControl && opts.Protocol == 1 {
+		return nil, fmt.Errorf("--flow-control requires --protocol 2 or auto")
+	}
+	if *flowWindow != "" {
+		if !opts.FlowControl {
+			return nil, fmt.Errorf("--flow-window requires --flow-control")
+		}
+		if opts.FlowWindow, err = ParseFlowWindow(*flowWindow); err != nil {
+			return nil, fmt.Errorf("--flow-window: %v", err)
+		}
+	}
+	if *maxFrameSize != "" {
+		if opts.Protocol == 1 {
+			return nil, fmt.Errorf("--max-frame-size requires --protocol 2 or auto")
+		}
+		if opts.MaxFrameSize, err = ParseMaxFrameSize(*maxFrameSize); err != nil {
+			return nil, fmt.Errorf("--max-frame-size: %v", err)
+		}
+	}
+	if opts.TargetMSS != 0 {
+		if !mssSupported {
+			return nil, fmt.Errorf("--target-mss is not supported on this platform")
+		}
+		if opts.TargetMSS < minTargetMSS || opts.TargetMSS > maxTargetMSS {
+			return nil, fmt.Errorf("--target-mss must be between %d and %d", minTargetMSS, maxTargetMSS)
+		}
+	}
+	if opts.VRF != "" {
+		if !vrfSupported {
+			return nil, fmt.Errorf("--vrf is only supported on Linux")
+		}
+		if len(opts.VRF) > maxVRFName || strings.ContainsAny(opts.VRF, "/ \t\n") {
+			return nil, fmt.Errorf("--vrf must be an interface name of at most %d characters", maxVRFName)
+		}
+	}
+	if opts.BindInterface = *bindInterface; opts.BindInterface != "" {
+		if !vrfSupported {
+			return nil, fmt.Errorf("--bind-interface is only supported on Linux")
+		}
+		if opts.VRF != "" {
+			return nil, fmt.Errorf("--bind-interface and --vrf both bind to a device; use one")
+		}
+		if len(opts.BindInterface) > maxVRFName || strings.ContainsAny(opts.BindInterface, "/ \t\n") {
+			return nil, fmt.Errorf("--bind-interface must be an interface name of at most %d characters", maxVRFName)
+		}
+	}
+	if *bindAddress != "" {
+		addr, err := netip.ParseAddr(*bindAddress)
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("--bind-address must be an IP address")
+		}
+		opts.BindAddress = addr.Unmap()
+	}
+	if *inboundLimit != "" {
+		limit, err := parseByteSize(*inboundLimit)
+		if err != nil {
+			return nil, fmt.Errorf("--inbound-limit: %v", err)
+		}
+		opts.InboundLimit = limit
+	}
+	switch opts.InboundAction {
+	case InboundAlert, InboundClose:
+	default:
+		return nil, fmt.Errorf("--inbound-limit-action must be alert or close")
+	}
+	for _, text := range sourceRules {
+		rule, err := ParseSourceRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("--source-rule: %v", err)
+		}
+		opts.SourceRules = append(opts.SourceRules, rule)
+	}
+	if len(netnsRules) > 0 && !netnsSupported {
+		return nil, fmt.Errorf("--netns-rule is only supported on Linux")
+	}
+	for _, text := range netnsRules {
+		rule, err := ParseNetnsRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("--netns-rule: %v", err)
+		}
+		opts.NetnsRules = append(opts.NetnsRules, rule)
+	}
+	if opts.UpstreamProxy = *upstreamProxy; opts.UpstreamProxy != "" {
+		if _, err := parseUpstreamProxy(opts.UpstreamProxy); err != nil {
+			return nil, fmt.Errorf("--upstream-proxy: %v", err)
+		}
+		if len(opts.SourceRules) > 0 || len(opts.NetnsRules) > 0 {
+			return nil, fmt.Errorf("--upstream-proxy cannot be combined with --source-rule or --netns-rule")
+		}
+	}
+	switch opts.SendProxyProtocol = ProxyProtocol(strings.ToLower(*sendProxy)); opts.SendProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return nil, fmt.Errorf("--send-proxy-protocol must be v1 or v2")
+	}
+	opts.ContainerAPI, opts.Kubeconfig = *containerAPI, *kubeconfigFile
+	for _, text := range alertPatterns {
+		pattern, err := parsePattern(text)
+		if err != nil {
+			return nil, fmt.Errorf("--alert-pattern: %v", err)
+		}
+		opts.AlertPatterns = append(opts.AlertPatterns, &AlertPattern{Text: text, Bytes: pattern})
+	}
+	if opts.AlertWebhook != "" {
+		if len(opts.AlertPatterns) == 0 {
+			return nil, fmt.Errorf("--alert-webhook requires --alert-pattern")
+		}
+		if u, err := url.Parse(opts.AlertWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("--alert-webhook must be an http or https URL")
+		}
+	}
+	if opts.OTLPEndpoint != "" {
+		if u, err := url.Parse(opts.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("--otlp-endpoint must be an http or https URL")
+		}
+	}
+	if opts.TraceSample < 0 || opts.TraceSample > 1 {
+		return nil, fmt.Errorf("--trace-sample must be between 0 and 1")
+	}
+	for _, label := range labels {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || !validLabelKey(key) {
+			return nil, fmt.Errorf("--label must be key=value with a key of letters, digits, '_', '-' or '.'")
+		}
+		if _, dup := opts.Labels[key]; dup {
+			return nil, fmt.Errorf("--label %s given twice", key)
+		}
+		if opts.Labels == nil {
+			opts.Labels = make(map[string]string)
+		}
+		opts.Labels[key] = value
+	}
+	for _, text := range aliases {
+		alias, err := ParseDestAlias(text)
+		if err != nil {
+			return nil, fmt.Errorf("--alias %s: %v", text, err)
+		}
+		for _, seen := range opts.Aliases {
+			if seen.Host == alias.Host && seen.Port == alias.Port {
+				return nil, fmt.Errorf("--alias %s: %s already has the name %s", text, strings.TrimPrefix(alias.String(), alias.Name+"="), seen.Name)
+			}
+		}
+		opts.Aliases = append(opts.Aliases, alias)
+	}
+	for _, text := range exposes {
+		e, err := ParseExpose(text)
+		if err != nil {
+			return nil, fmt.Errorf("--expose %s: %v", text, err)
+		}
+		for _, seen := range opts.Exposes {
+			if seen.Name == e.Name {
+				return nil, fmt.Errorf("--expose %s: name %s given twice", text, e.Name)
+			}
+		}
+		opts.Exposes = append(opts.Exposes, e)
+	}
+	for _, text := range allowRules {
+		rule, err := ParseACLRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("--allow: %v", err)
+		}
+		opts.Allow = append(opts.Allow, rule)
+	}
+	for _, text := range denyRules {
+		rule, err := ParseACLRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("--deny: %v", err)
+		}
+		opts.Deny = append(opts.Deny, rule)
+	}
+	opts.DenyPrivate = *denyPrivate
+	if opts.ACLFile = *aclFile; opts.ACLFile != "" {
+		allow, deny, err := LoadACLFile(opts.ACLFile)
+		if err != nil {
+			return nil, fmt.Errorf("--acl-file: %v", err)
+		}
+		opts.Allow, opts.Deny = append(opts.Allow, allow...), append(opts.Deny, deny...)
+	}
+	if opts.HookFile != "" {
+		hook, err := LoadHook(opts.HookFile)
+		if err != nil {
+			return nil, fmt.Errorf("--hook: %v", err)
+		}
+		opts.Hook = hook
+	}
+	for _, command := range opts.Plugins {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("--plugin must name a command")
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return nil, fmt.Errorf("--plugin: %v", err)
+		}
+	}
+	if opts.ShutdownKeyFile != "" {
+		key, err := LoadSecret(opts.ShutdownKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("--shutdown-key: %v", err)
+		}
+		key.PrepareMAC()
+		opts.ShutdownKey = key
+	} else if opts.ShutdownWipe {
+		return nil, fmt.Errorf("--shutdown-wipe requires --shutdown-key")
+	}
 
-	if opts.Mode == ModeDirect {
+	switch opts.AuthMode {
+	case AuthHMAC, AuthToken:
+	default:
+		return nil, fmt.Errorf("--auth-mode must be hmac or token")
+	}
+	if opts.AuthTokenFile != "" {
+		token, err := LoadSecret(opts.AuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("--auth-token-file: %v", err)
+		}
+		if bytes.ContainsAny(token.Bytes(), " \t\r\n") {
+			token.Wipe()
+			return nil, fmt.Errorf("--auth-token-file must contain a single token without whitespace")
+		}
+		if opts.AuthMode == AuthHMAC {
+			token.PrepareMAC()
+		}
+		opts.AuthToken = token
+	}
+
+	if opts.Mode == ModeDirect && len(targetPatterns) > 0 {
+		if opts.TargetHost != "" || opts.TargetPort != 0 || len(targets) > 0 {
+			return nil, fmt.Errorf("--target-pattern cannot be combined with --target-host/--target-port/--target")
+		}
+		for _, text := range targetPatterns {
+			rule, err := ParseACLRule(text)
+			if err != nil {
+				return nil, fmt.Errorf("--target-pattern: %v", err)
+			}
+			opts.TargetPatterns = append(opts.TargetPatterns, rule)
+		}
+	} else if opts.Mode == ModeDirect && len(targets) > 0 {
+		if opts.TargetHost != "" || opts.TargetPort != 0 {
+			return nil, fmt.Errorf("--target cannot be combined with --target-host/--target-port")
+		}
+		for _, target := range targets {
+			dest, err := parseTarget(target)
+			if err != nil {
+				return nil, err
+			}
+			for _, seen := range opts.Targets {
+				if *seen == *dest {
+					return nil, fmt.Errorf("--target %s given twice", target)
+				}
+			}
+			opts.Targets = append(opts.Targets, dest)
+		}
+		if opts.Workers < len(opts.Targets) {
+			return nil, fmt.Errorf("--workers must be at least the number of --target destinations (%d)", len(opts.Targets))
+		}
+		if opts.MaxWorkers > 0 && len(opts.Targets) > 1 {
+			return nil, fmt.Errorf("--max-workers cannot share workers out between several --target destinations")
+		}
+	} else if opts.Mode == ModeDirect {
 		if opts.TargetHost == "" {
 			return nil, fmt.Errorf("--target-host is required in direct mode")
 		}
@@ -159,16 +1209,58 @@ func ParseArgs(args []string) (*Options, error) {
 			return nil, fmt.Errorf("--target-port must be between 1 and 65535")
 		}
 		addrType := classifyAddr(opts.TargetHost)
-		opts.DirectDestination = &Destination{
+		opts.Targets = []*Destination{{
 			AddrType: addrType,
 			Host:     opts.TargetHost,
 			Port:     opts.TargetPort,
-		}
+		}}
 	}
 
 	return opts, nil
 }
 
+// Deadline reports when a pool started at start must shut down, taking the
+// earlier of --expire-at and --max-runtime. ok is false when neither is set.
+func (o *Options) Deadline(start time.Time) (deadline time.Time, ok bool) {
+	if !o.ExpireAt.IsZero() {
+		deadline, ok = o.ExpireAt, true
+	}
+	if o.MaxRuntime > 0 {
+		if limit := start.Add(o.MaxRuntime); !ok || limit.Before(deadline) {
+			deadline, ok = limit, true
+		}
+	}
+	return deadline, ok
+}
+
+// parseTarget parses a --target host:port, with an IPv6 host in brackets.
+func parseTarget(target string) (*Destination, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("--target must be host:port, got %q", target)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("--target %s: port must be between 1 and 65535", target)
+	}
+	return &Destination{AddrType: classifyAddr(host), Host: host, Port: port}, nil
+}
+
+// validLabelKey reports whether key is usable as a --label name.
+func validLabelKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func normalizeString(override, base string) string {
 	if override != "" {
 		return override
@@ -190,6 +1282,18 @@ func normalizeFloat(override, base float64) float64 {
 	return base
 }
 
+// unbracket returns an IPv6 address given as [addr] without its brackets,
+// the form the protocol and net.JoinHostPort expect. Other hosts are
+// returned unchanged.
+func unbracket(host string) string {
+	if inner, ok := strings.CutPrefix(host, "["); ok {
+		if inner, ok = strings.CutSuffix(inner, "]"); ok && net.ParseIP(inner) != nil {
+			return inner
+		}
+	}
+	return host
+}
+
 func classifyAddr(host string) AddrType {
 	if ip := net.ParseIP(host); ip != nil {
 		if ip.To4() != nil {
@@ -216,10 +1320,10 @@ func FormatDestination(dest *Destination) string {
 // ParseRequest converts a hub REQUEST line into a Request struct.
 func ParseRequest(line string) (*Request, error) {
 	fields := strings.Fields(line)
-	if len(fields) != 5 {
+	if len(fields) < 5 || len(fields) > 10 {
 		return nil, fmt.Errorf("unexpected request line: %q", line)
 	}
-	if fields[0] != "REQUEST" || fields[1] != "CONNECT" {
+	if fields[0] != "REQUEST" || (fields[1] != CommandConnect && fields[1] != CommandAssociate && fields[1] != CommandTUN && fields[1] != CommandPing && fields[1] != CommandScan) {
 		return nil, fmt.Errorf("unexpected request command: %q", line)
 	}
 	addrType := AddrType(strings.ToLower(fields[2]))
@@ -228,20 +1332,141 @@ func ParseRequest(line string) (*Request, error) {
 	default:
 		return nil, fmt.Errorf("unknown address type %q", fields[2])
 	}
-	port, err := strconv.Atoi(fields[4])
-	if err != nil || port < 1 || port > 65535 {
-		return nil, fmt.Errorf("invalid port in request: %q", fields[4])
+	// An ASSOCIATE names the client's expected UDP source, which may be
+	// port 0 when the client does not know it yet. A TUN request names the
+	// hub's end of the tunnel and has no port, and a PING only needs one for
+	// the TCP fallback. A SCAN carries a port list in place of the port.
+	minPort := 1
+	if fields[1] != CommandConnect {
+		minPort = 0
 	}
-	return &Request{
+	req := &Request{
+		Command:  fields[1],
 		AddrType: addrType,
 		Address:  fields[3],
-		Port:     port,
-	}, nil
+	}
+	if addrType == AddrIPv6 {
+		req.Address = unbracket(req.Address)
+	}
+	if req.Command == CommandScan {
+		ports, err := ParsePorts(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports in request: %v", err)
+		}
+		req.Ports = ports
+	} else {
+		port, err := strconv.Atoi(fields[4])
+		if err != nil || port < minPort || port > 65535 {
+			return nil, fmt.Errorf("invalid port in request: %q", fields[4])
+		}
+		req.Port = port
+	}
+	// The session ID may be followed or replaced by key=value options,
+	// which the hub only sends to workers that advertised them.
+	for _, field := range fields[5:] {
+		key, value, isOption := strings.Cut(field, "=")
+		switch {
+		case !isOption && req.SessionID == "":
+			req.SessionID = field
+		case key == "banner" && req.Command == CommandScan:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > MaxBanner || n*len(req.Ports) > MaxBannerTotal {
+				return nil, fmt.Errorf("invalid banner length in request: %q", field)
+			}
+			req.Banner = n
+		case key == "affinity":
+			if !validAffinity(value) {
+				return nil, fmt.Errorf("invalid affinity key in request: %q", field)
+			}
+			req.Affinity = value
+		case key == "client" && (req.Command == CommandConnect || req.Command == CommandAssociate):
+			client, err := netip.ParseAddrPort(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid client address in request: %q", field)
+			}
+			req.Client = client
+		case key == "client-id" && (req.Command == CommandConnect || req.Command == CommandAssociate):
+			if !validAffinity(value) {
+				return nil, fmt.Errorf("invalid client ID in request: %q", field)
+			}
+			req.ClientID = value
+		case key == "deadline" && req.Command == CommandConnect:
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms <= 0 {
+				return nil, fmt.Errorf("invalid deadline in request: %q", field)
+			}
+			req.Deadline = time.Duration(ms) * time.Millisecond
+		default:
+			return nil, fmt.Errorf("unexpected request field: %q", field)
+		}
+	}
+	return req, nil
 }
 
 // Request describes a hub connection request.
 type Request struct {
+	Command  string // CommandConnect, CommandAssociate, CommandTUN, CommandPing or CommandScan
 	AddrType AddrType
 	Address  string
 	Port     int
+	Ports    []int // set instead of Port for CommandScan
+	Banner   int   // CommandScan: bytes to read from each open port
+	// SessionID is set by hubs that may CANCEL the request mid-dial.
+	SessionID string
+	// Affinity names the client the request came from, for hubs that
+	// route a client's requests to the same worker.
+	Affinity string
+	// Client is the address of the client the hub accepted and ClientID
+	// the hub's opaque name for that client, for hubs that send them.
+	Client   netip.AddrPort
+	ClientID string
+	// Deadline is how long the hub gives a CONNECT to reach its target,
+	// counted from when the worker reads it; 0 for no limit.
+	Deadline time.Duration
+}
+
+// hostPort returns the request's destination as host:port, with an IPv6
+// address in brackets, the one form every log line and notice uses.
+func (r *Request) hostPort() string {
+	return net.JoinHostPort(r.Address, strconv.Itoa(r.Port))
+}
+
+// clientDesc describes the client a request came from for the log, as
+// " for client <ip:port> (id <id>)", or "" when the hub did not say.
+func (r *Request) clientDesc() string {
+	switch {
+	case r.Client.IsValid() && r.ClientID != "":
+		return fmt.Sprintf(" for client %s (id %s)", r.Client, r.ClientID)
+	case r.Client.IsValid():
+		return " for client " + r.Client.String()
+	case r.ClientID != "":
+		return " for client id " + r.ClientID
+	}
+	return ""
+}
+
+// clientFields are the structured log fields for the request's client.
+func (r *Request) clientFields() []any {
+	var fields []any
+	if r.Client.IsValid() {
+		fields = append(fields, "client", r.Client.String())
+	}
+	if r.ClientID != "" {
+		fields = append(fields, "client_id", r.ClientID)
+	}
+	return fields
+}
+
+// validAffinity reports whether key is a usable affinity key, or client
+// ID: 1 to 64 letters, digits, dots, dashes or underscores.
+func validAffinity(key string) bool {
+	if key == "" || len(key) > 64 {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
 }
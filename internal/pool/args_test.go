@@ -1,8 +1,17 @@
 package pool
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
+
+	"contun/internal/logx"
 )
 
 func TestParseArgsDirect(t *testing.T) {
@@ -27,17 +36,36 @@ func TestParseArgsDirect(t *testing.T) {
 	if opts.Mode != ModeDirect {
 		t.Fatalf("unexpected mode %q", opts.Mode)
 	}
-	if opts.DirectDestination == nil {
-		t.Fatal("direct destination nil")
+	if len(opts.Targets) != 1 {
+		t.Fatalf("direct destinations %v", opts.Targets)
 	}
-	if opts.DirectDestination.AddrType != AddrIPv4 {
-		t.Fatalf("addr type %q", opts.DirectDestination.AddrType)
+	if opts.Targets[0].AddrType != AddrIPv4 {
+		t.Fatalf("addr type %q", opts.Targets[0].AddrType)
 	}
 	if opts.RetryDelay != 2500*time.Millisecond {
 		t.Fatalf("retry delay %v", opts.RetryDelay)
 	}
 }
 
+func TestParseArgsIPv6(t *testing.T) {
+	for _, hub := range []string{"2001:db8::1", "[2001:db8::1]"} {
+		opts, err := ParseArgs([]string{"-j", hub, "-p", "5555", "-m", "direct", "-t", "[2001:db8::2]", "-T", "22"})
+		if err != nil {
+			t.Fatalf("ParseArgs(-j %s): %v", hub, err)
+		}
+		if opts.HubHost != "2001:db8::1" {
+			t.Fatalf("-j %s: hub host %q", hub, opts.HubHost)
+		}
+		if got := FormatDestination(opts.Targets[0]); got != "DEST ipv6 2001:db8::2 22" {
+			t.Fatalf("-j %s: %s", hub, got)
+		}
+	}
+	opts, err := ParseArgs([]string{"-j", "hub.example", "-p", "5555", "-m", "direct", "--target", "[2001:db8::2]:22"})
+	if err != nil || opts.Targets[0].AddrType != AddrIPv6 || opts.Targets[0].Host != "2001:db8::2" {
+		t.Fatalf("--target: %+v, %v", opts, err)
+	}
+}
+
 func TestParseArgsSocks(t *testing.T) {
 	opts, err := ParseArgs([]string{
 		"--hub-host", "hub.example",
@@ -80,6 +108,64 @@ func TestParseRequest(t *testing.T) {
 	if _, err = ParseRequest("REQUEST CONNECT domain example.com 80"); err != nil {
 		t.Fatalf("unexpected error parsing domain: %v", err)
 	}
+	if req, err = ParseRequest("REQUEST CONNECT domain example.com 80 42"); err != nil || req.SessionID != "42" {
+		t.Fatalf("unexpected session id parse %+v: %v", req, err)
+	}
+	if req, err = ParseRequest("REQUEST ASSOCIATE ipv4 0.0.0.0 0 7"); err != nil || req.Command != CommandAssociate || req.Port != 0 {
+		t.Fatalf("unexpected associate parse %+v: %v", req, err)
+	}
+	if req, err = ParseRequest("REQUEST TUN ipv4 10.99.0.1 0 8"); err != nil || req.Command != CommandTUN || req.Address != "10.99.0.1" {
+		t.Fatalf("unexpected TUN request %+v (%v)", req, err)
+	}
+	if req, err = ParseRequest("REQUEST PING domain db.internal 0"); err != nil || req.Command != CommandPing || req.Port != 0 {
+		t.Fatalf("unexpected PING request %+v (%v)", req, err)
+	}
+	if req, err = ParseRequest("REQUEST SCAN ipv4 10.0.0.5 22,80,8000-8002 9"); err != nil || req.Command != CommandScan ||
+		fmt.Sprint(req.Ports) != "[22 80 8000 8001 8002]" {
+		t.Fatalf("unexpected SCAN request %+v (%v)", req, err)
+	}
+	if req, err = ParseRequest("REQUEST SCAN ipv4 10.0.0.5 22 banner=128"); err != nil || req.Banner != 128 || req.SessionID != "" {
+		t.Fatalf("unexpected SCAN request with banner %+v (%v)", req, err)
+	}
+	if req, err = ParseRequest("REQUEST SCAN ipv4 10.0.0.5 22 9 banner=128 affinity=3f2a9c"); err != nil || req.Affinity != "3f2a9c" || req.SessionID != "9" {
+		t.Fatalf("unexpected SCAN request with affinity %+v (%v)", req, err)
+	}
+	if _, err = ParseRequest("REQUEST CONNECT ipv4 10.0.0.5 22 9 affinity=a/b"); err == nil {
+		t.Fatalf("accepted an invalid affinity key")
+	}
+	if req, err = ParseRequest("REQUEST ASSOCIATE ipv4 0.0.0.0 0 7 affinity=3f2a9c client=192.0.2.7:51234 client-id=42"); err != nil ||
+		req.Client.String() != "192.0.2.7:51234" || req.ClientID != "42" || req.clientDesc() != " for client 192.0.2.7:51234 (id 42)" {
+		t.Fatalf("unexpected request with client metadata %+v (%v)", req, err)
+	}
+	if _, err = ParseRequest("REQUEST CONNECT ipv4 10.0.0.5 22 9 client-id=a/b"); err == nil {
+		t.Fatalf("accepted an invalid client ID")
+	}
+	if req, err = ParseRequest("REQUEST CONNECT ipv4 10.0.0.5 22 9 deadline=2500"); err != nil || req.Deadline != 2500*time.Millisecond {
+		t.Fatalf("unexpected request with deadline %+v (%v)", req, err)
+	}
+	for _, bad := range []string{"REQUEST CONNECT ipv4 10.0.0.5 22 9 deadline=0", "REQUEST PING ipv4 10.0.0.5 22 9 deadline=100"} {
+		if _, err = ParseRequest(bad); err == nil {
+			t.Fatalf("accepted %q", bad)
+		}
+	}
+	if _, err = ParseRequest("REQUEST SCAN ipv4 10.0.0.5 1-100 9 banner=1024"); err == nil {
+		t.Fatalf("accepted banners beyond MaxBannerTotal")
+	}
+	if _, err = ParseRequest("REQUEST CONNECT ipv4 10.0.0.5 22 9 banner=16"); err == nil {
+		t.Fatalf("accepted banner on CONNECT")
+	}
+	for _, addr := range []string{"2001:db8::9", "[2001:db8::9]"} {
+		req, err = ParseRequest("REQUEST CONNECT ipv6 " + addr + " 443 9")
+		if err != nil || req.Address != "2001:db8::9" || req.hostPort() != "[2001:db8::9]:443" {
+			t.Fatalf("unexpected IPv6 request %+v (%v)", req, err)
+		}
+	}
+	if _, err = ParseRequest("REQUEST CONNECT ipv4 203.0.113.9 0"); err == nil {
+		t.Fatalf("expected error for CONNECT to port 0")
+	}
+	if _, err = ParseRequest("REQUEST BIND ipv4 203.0.113.9 80"); err == nil {
+		t.Fatalf("expected error for unsupported command")
+	}
 	if _, err = ParseRequest("REQUEST CONNECT badtype example 80"); err == nil {
 		t.Fatalf("expected error for bad type")
 	}
@@ -87,3 +173,280 @@ func TestParseRequest(t *testing.T) {
 		t.Fatalf("expected error for bad port")
 	}
 }
+
+func TestParseArgsExpiry(t *testing.T) {
+	opts, err := ParseArgs([]string{
+		"--hub-port", "5555",
+		"--mode", "socks",
+		"--expire-at", "2030-01-02T15:04:05Z",
+		"--max-runtime", "8h",
+	})
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if !opts.ExpireAt.Equal(time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected expire-at %v", opts.ExpireAt)
+	}
+	start := time.Date(2030, 1, 2, 12, 0, 0, 0, time.UTC)
+	deadline, ok := opts.Deadline(start)
+	if !ok || !deadline.Equal(start.Add(3*time.Hour+4*time.Minute+5*time.Second)) {
+		t.Fatalf("expected expire-at to win, got %v", deadline)
+	}
+	deadline, ok = opts.Deadline(start.Add(-24 * time.Hour))
+	if !ok || !deadline.Equal(start.Add(-16*time.Hour)) {
+		t.Fatalf("expected max-runtime to win, got %v", deadline)
+	}
+
+	if _, err := ParseArgs([]string{"--hub-port", "5555", "--mode", "socks", "--expire-at", "tomorrow"}); err == nil {
+		t.Fatalf("expected error for malformed --expire-at")
+	}
+}
+
+func TestParseArgsAlertPatterns(t *testing.T) {
+	base := []string{"-p", "5555", "-m", "socks"}
+	opts, err := ParseArgs(append(base,
+		"--alert-pattern", "BEGIN RSA PRIVATE KEY",
+		"--alert-pattern", "hex:504b0304",
+		"--alert-webhook", "https://siem.example/hook"))
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if len(opts.AlertPatterns) != 2 || string(opts.AlertPatterns[1].Bytes) != "PK\x03\x04" {
+		t.Fatalf("unexpected patterns %+v", opts.AlertPatterns)
+	}
+	if _, err := ParseArgs(append(base, "--alert-webhook", "https://siem.example/hook")); err == nil {
+		t.Fatal("expected --alert-webhook without patterns to fail")
+	}
+	if _, err := ParseArgs(append(base, "--alert-pattern", "x", "--alert-webhook", "siem.example")); err == nil {
+		t.Fatal("expected a webhook without scheme to fail")
+	}
+}
+
+func TestParseArgsConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pool.yaml")
+	content := "hub-host: hub.example.net\nhub-port: 443\nmode: socks\nworkers: 8\nalert-pattern: [\"BEGIN RSA\", \"hex:504b0304\"]\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	opts, err := ParseArgs([]string{"--config", path, "-w", "2"})
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if opts.HubHost != "hub.example.net" || opts.HubPort != 443 || opts.Mode != ModeSocks || len(opts.AlertPatterns) != 2 {
+		t.Fatalf("options from file not applied: %+v", opts)
+	}
+	if opts.Workers != 2 {
+		t.Fatalf("workers = %d, want the command line's 2", opts.Workers)
+	}
+	if err := os.WriteFile(path, []byte("hub-port: 443\nworker: 8\n"), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	if _, err := ParseArgs([]string{"--config", path}); err == nil || !strings.Contains(err.Error(), "worker") {
+		t.Fatalf("misspelled option accepted: %v", err)
+	}
+}
+
+func TestParseArgsHook(t *testing.T) {
+	path := writeHook(t, "def request(req):\n    return allow()\n")
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--hook", path, "--label", "site=dc1", "--label", "env="})
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if opts.Hook == nil || len(opts.Labels) != 2 || opts.Labels["site"] != "dc1" {
+		t.Fatalf("unexpected hook %v and labels %v", opts.Hook, opts.Labels)
+	}
+	if !strings.Contains(opts.Features(), "hook") {
+		t.Fatalf("features %q do not list hook", opts.Features())
+	}
+	for _, label := range []string{"site", "=dc1", "si te=dc1"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--label", label}); err == nil {
+			t.Fatalf("accepted --label %q", label)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--label", "a=1", "--label", "a=2"}); err == nil {
+		t.Fatal("accepted a repeated --label key")
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--hook", writeHook(t, "x = 1\n")}); err == nil {
+		t.Fatal("accepted a hook without request()")
+	}
+}
+
+func TestParseArgsSocketBuffers(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--so-rcvbuf", "8M", "--so-sndbuf", "524288"})
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if opts.SoRcvBuf != 8<<20 || opts.SoSndBuf != 512<<10 {
+		t.Fatalf("unexpected buffers rcv=%d snd=%d", opts.SoRcvBuf, opts.SoSndBuf)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--so-rcvbuf", "2G"}); err == nil {
+		t.Fatal("expected an oversized --so-rcvbuf to fail")
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--read-ahead", "256K"})
+	if err != nil || opts.ReadAhead != 256<<10 {
+		t.Fatalf("--read-ahead 256K: %v, %v", opts, err)
+	}
+}
+
+func TestParseArgsTargetMSS(t *testing.T) {
+	if !mssSupported {
+		t.Skip("TCP_MAXSEG is not available on this platform")
+	}
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--target-mss", "1360"})
+	if err != nil {
+		t.Fatalf("ParseArgs returned error: %v", err)
+	}
+	if opts.TargetMSS != 1360 {
+		t.Fatalf("unexpected MSS %d", opts.TargetMSS)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--target-mss", "50"}); err == nil {
+		t.Fatal("expected an undersized --target-mss to fail")
+	}
+}
+
+func TestParseArgsProtocol(t *testing.T) {
+	for arg, want := range map[string]int{"auto": 0, "1": 1, "2": 2} {
+		opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--protocol", arg})
+		if err != nil || opts.Protocol != want {
+			t.Fatalf("--protocol %s: got %v, %v", arg, opts, err)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--protocol", "3"}); err == nil {
+		t.Fatal("expected --protocol 3 to fail")
+	}
+}
+
+func TestParseArgsFlowControl(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--flow-control"})
+	if err != nil || !opts.FlowControl {
+		t.Fatalf("--flow-control: got %v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--flow-control", "--protocol", "1"}); err == nil {
+		t.Fatal("expected --flow-control with --protocol 1 to fail")
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--flow-control", "--flow-window", "256K", "--max-frame-size", "16K"})
+	if err != nil || opts.FlowWindow != 256<<10 || opts.MaxFrameSize != 16<<10 {
+		t.Fatalf("--flow-window/--max-frame-size: got %v, %v", opts, err)
+	}
+	for _, args := range [][]string{
+		{"--flow-window", "256K"},
+		{"--flow-control", "--flow-window", "1K"},
+		{"--max-frame-size", "64K"},
+		{"--max-frame-size", "16K", "--protocol", "1"},
+	} {
+		if _, err := ParseArgs(append([]string{"-p", "5555", "-m", "socks"}, args...)); err == nil {
+			t.Fatalf("expected %v to fail", args)
+		}
+	}
+}
+
+func TestParseArgsLogFormat(t *testing.T) {
+	for arg, want := range map[string]logx.Format{"": logx.Text, "text": logx.Text, "JSON": logx.JSON} {
+		args := []string{"-p", "5555", "-m", "socks"}
+		if arg != "" {
+			args = append(args, "--log-format", arg)
+		}
+		opts, err := ParseArgs(args)
+		if err != nil || opts.LogFormat != want {
+			t.Fatalf("--log-format %q: got %v, %v", arg, opts, err)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--log-format", "logfmt"}); err == nil {
+		t.Fatal("expected --log-format logfmt to fail")
+	}
+}
+
+func TestParseArgsLogLevel(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks"})
+	if err != nil || opts.LogLevel.String() != "info" {
+		t.Fatalf("default: %v, %v", opts.LogLevel, err)
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--log-level", "pool=debug,bridge=warn,proto=trace"})
+	if err != nil || opts.LogLevel.String() != "info,bridge=warn,pool=debug,proto=trace" {
+		t.Fatalf("per-module levels: %v, %v", opts.LogLevel, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--log-level", "hook=debug"}); err == nil {
+		t.Fatal("expected --log-level for an unknown module to fail")
+	}
+	if opts.LogRepeats != time.Minute {
+		t.Fatalf("default --log-repeat-interval: %s", opts.LogRepeats)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--log-repeat-interval", "-1s"}); err == nil {
+		t.Fatal("expected a negative --log-repeat-interval to fail")
+	}
+}
+
+func TestParseArgsDialTimeouts(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks"})
+	if err != nil || opts.HubDialTimeout != 5*time.Second || opts.TargetDialTimeout != 5*time.Second {
+		t.Fatalf("defaults: %+v, %v", opts, err)
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--hub-dial-timeout", "30s", "--target-dial-timeout", "500ms"})
+	if err != nil || opts.HubDialTimeout != 30*time.Second || opts.TargetDialTimeout != 500*time.Millisecond {
+		t.Fatalf("explicit timeouts: %+v, %v", opts, err)
+	}
+	for _, flag := range []string{"--hub-dial-timeout", "--target-dial-timeout"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", flag, "0"}); err == nil {
+			t.Fatalf("accepted %s 0", flag)
+		}
+	}
+}
+
+func TestTargetDialTimeout(t *testing.T) {
+	// The simulated latency outlasts the timeout, so the dial gives up
+	// before it starts.
+	s := NewSupervisor(Options{Mode: ModeSocks, TargetDialTimeout: 50 * time.Millisecond, SimulateLatency: time.Minute})
+	start := time.Now()
+	_, err := s.dialTarget(context.Background(), &Request{Address: "127.0.0.1", Port: 9}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Fatalf("dialTarget returned %v after %s", err, time.Since(start))
+	}
+}
+
+func TestParseArgsTargets(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "--target", "db.internal:5432", "--target", "[::1]:22", "-w", "3"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	want := []Destination{{AddrDomain, "db.internal", 5432}, {AddrIPv6, "::1", 22}}
+	if len(opts.Targets) != len(want) || *opts.Targets[0] != want[0] || *opts.Targets[1] != want[1] {
+		t.Fatalf("targets %v", opts.Targets)
+	}
+	for _, args := range [][]string{
+		{"--target", "db.internal"},
+		{"--target", "db.internal:0"},
+		{"--target", ":22"},
+		{"--target", "a:1", "--target", "a:1"},
+		{"--target", "a:1", "-t", "b", "-T", "2"},
+		{"--target", "a:1", "--target", "b:2", "-w", "1"},
+		{"--target", "a:1", "-m", "socks"},
+	} {
+		if _, err := ParseArgs(append([]string{"-p", "5555"}, args...)); err == nil {
+			t.Fatalf("accepted %q", args)
+		}
+	}
+}
+
+func TestUnusedFlags(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-t", "db", "-T", "5432", "--deny", "10.0.0.0/8", "--min-workers", "2", "--queue-timeout", "5s", "--heartbeat", "0", "--heartbeat-timeout", "3s"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	want := []string{
+		"--deny has no effect in direct mode",
+		"--min-workers has no effect without --max-workers",
+		"--queue-timeout has no effect without --max-sessions",
+		"--heartbeat-timeout has no effect with --heartbeat 0",
+	}
+	if got := opts.UnusedFlags(); !slices.Equal(got, want) {
+		t.Fatalf("UnusedFlags = %q, want %q", got, want)
+	}
+
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--deny", "10.0.0.0/8", "--max-workers", "8", "--min-workers", "2", "--audit-log", "audit.jsonl", "--audit-sample", "0.5"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if got := opts.UnusedFlags(); len(got) != 0 {
+		t.Fatalf("UnusedFlags = %q", got)
+	}
+}
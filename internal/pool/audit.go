@@ -0,0 +1,203 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditFormat selects how audit records are serialised.
+type AuditFormat string
+
+const (
+	AuditJSON AuditFormat = "json"
+	AuditCEF  AuditFormat = "cef"
+	AuditLEEF AuditFormat = "leef"
+)
+
+// auditSeverity maps audit events to a 0-10 severity for CEF and LEEF.
+var auditSeverity = map[string]int{
+	"expired":           3,
+	"reload":            3,
+	"shutdown":          6,
+	"shutdown_rejected": 7,
+	"auth_failed":       6,
+	"request_denied":    5,
+	"session":           1,
+	"tamper":            8,
+}
+
+// auditLog appends one record per line describing security-relevant pool
+// events, and forwards each record to the audit sink plugins. A nil
+// *auditLog discards records.
+type auditLog struct {
+	mu     sync.Mutex
+	f      *os.File // nil when only plugins receive records
+	format AuditFormat
+	sample float64
+	sinks  []*plugin
+	alias  func(host string, port int) string // the --alias name of a record's dest; nil for none
+}
+
+// openAuditLog opens path for appending, or writes no file when path is
+// empty. sample is the fraction of routine session records kept by
+// RecordSampled.
+func openAuditLog(path string, format AuditFormat, sample float64, sinks []*plugin) (*auditLog, error) {
+	a := &auditLog{format: format, sample: sample, sinks: sinks}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.f = f
+	}
+	return a, nil
+}
+
+// RecordSampled records a routine, high-volume event for the configured
+// fraction of calls. Security events such as policy denials must use Record
+// so they are never dropped.
+func (a *auditLog) RecordSampled(event string, fields map[string]any) {
+	if a == nil || a.sample <= 0 || (a.sample < 1 && rand.Float64() >= a.sample) {
+		return
+	}
+	fields["sample_rate"] = a.sample
+	a.Record(event, fields)
+}
+
+// Record appends an event with the supplied fields, adding dest_alias when
+// their dest has an --alias name. Write failures are ignored so auditing
+// can never take a worker down.
+func (a *auditLog) Record(event string, fields map[string]any) {
+	if a == nil {
+		return
+	}
+	if host, ok := fields["dest"].(string); ok && a.alias != nil {
+		port, _ := fields["port"].(int)
+		if name := a.alias(host, port); name != "" {
+			fields["dest_alias"] = name
+		}
+	}
+	now := time.Now().UTC()
+	for _, sink := range a.sinks {
+		sink.audit(auditRecord(now, event, fields))
+	}
+	if a.f == nil {
+		return
+	}
+	line, err := formatAuditRecord(a.format, now, event, fields)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, _ = a.f.WriteString(line + "\n")
+}
+
+func (a *auditLog) Close() error {
+	if a == nil || a.f == nil {
+		return nil
+	}
+	return a.f.Close()
+}
+
+func formatAuditRecord(format AuditFormat, now time.Time, event string, fields map[string]any) (string, error) {
+	switch format {
+	case AuditCEF:
+		return formatCEF(now, event, fields), nil
+	case AuditLEEF:
+		return formatLEEF(now, event, fields), nil
+	default:
+		data, err := json.Marshal(auditRecord(now, event, fields))
+		return string(data), err
+	}
+}
+
+// auditRecord is the JSON form of an audit record.
+func auditRecord(now time.Time, event string, fields map[string]any) map[string]any {
+	rec := make(map[string]any, len(fields)+2)
+	for k, v := range fields {
+		rec[k] = v
+	}
+	rec["time"] = now.Format(time.RFC3339Nano)
+	rec["event"] = event
+	return rec
+}
+
+// formatCEF renders an ArcSight Common Event Format record.
+func formatCEF(now time.Time, event string, fields map[string]any) string {
+	header := []string{
+		"CEF:0", "contun", "poolgo", BuildVersion(), event,
+		strings.ReplaceAll(event, "_", " "), fmt.Sprint(severityOf(event)),
+	}
+	for i := 1; i < len(header); i++ {
+		header[i] = cefHeaderEscaper.Replace(header[i])
+	}
+	ext := []string{fmt.Sprintf("rt=%d", now.UnixMilli())}
+	for _, k := range sortedKeys(fields) {
+		ext = append(ext, auditKey(k)+"="+cefValueEscaper.Replace(auditValue(fields[k])))
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// formatLEEF renders an IBM QRadar LEEF 1.0 record with tab-separated
+// attributes.
+func formatLEEF(now time.Time, event string, fields map[string]any) string {
+	header := strings.Join([]string{
+		"LEEF:1.0", "contun", "poolgo",
+		leefHeaderEscaper.Replace(BuildVersion()), leefHeaderEscaper.Replace(event),
+	}, "|")
+	attrs := []string{
+		"devTime=" + now.Format("Jan 02 2006 15:04:05.000 MST"),
+		fmt.Sprintf("sev=%d", severityOf(event)),
+	}
+	for _, k := range sortedKeys(fields) {
+		attrs = append(attrs, auditKey(k)+"="+leefValueEscaper.Replace(auditValue(fields[k])))
+	}
+	return header + "|" + strings.Join(attrs, "\t")
+}
+
+var (
+	cefHeaderEscaper  = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`)
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+func severityOf(event string) int {
+	if sev, ok := auditSeverity[event]; ok {
+		return sev
+	}
+	return 3
+}
+
+// auditKey strips characters that CEF and LEEF do not allow in keys.
+func auditKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, k)
+}
+
+func auditValue(v any) string {
+	if t, ok := v.(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package pool
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatAuditRecord(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := map[string]any{"kind": "binary", "detail": "sha256 a=b|c"}
+
+	line, err := formatAuditRecord(AuditJSON, now, "tamper", fields)
+	if err != nil {
+		t.Fatalf("json format error: %v", err)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal([]byte(line), &rec); err != nil || rec["event"] != "tamper" || rec["kind"] != "binary" {
+		t.Fatalf("unexpected json record %s (%v)", line, err)
+	}
+
+	prev := Version
+	Version = "1.2.3"
+	defer func() { Version = prev }()
+
+	line, _ = formatAuditRecord(AuditCEF, now, "tamper", fields)
+	want := `CEF:0|contun|poolgo|1.2.3|tamper|tamper|8|rt=1893553445000 detail=sha256 a\=b|c kind=binary`
+	if line != want {
+		t.Fatalf("unexpected CEF record\n got %s\nwant %s", line, want)
+	}
+
+	line, _ = formatAuditRecord(AuditLEEF, now, "tamper", fields)
+	want = "LEEF:1.0|contun|poolgo|1.2.3|tamper|devTime=Jan 02 2030 03:04:05.000 UTC\tsev=8\tdetail=sha256 a=b|c\tkind=binary"
+	if line != want {
+		t.Fatalf("unexpected LEEF record\n got %q\nwant %q", line, want)
+	}
+}
+
+func TestAuditSampling(t *testing.T) {
+	for _, tc := range []struct {
+		sample float64
+		want   int
+	}{
+		{sample: 0, want: 1},
+		{sample: 1, want: 11},
+	} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		audit, err := openAuditLog(path, AuditJSON, tc.sample, nil)
+		if err != nil {
+			t.Fatalf("openAuditLog: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			audit.RecordSampled("session", map[string]any{"outcome": "bridged"})
+		}
+		audit.Record("request_denied", map[string]any{"reason": "policy"})
+		audit.Close()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read audit log: %v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != tc.want {
+			t.Fatalf("sample %v: got %d records, want %d", tc.sample, len(lines), tc.want)
+		}
+		if !strings.Contains(lines[len(lines)-1], "request_denied") {
+			t.Fatalf("sample %v: denial was not recorded: %q", tc.sample, lines[len(lines)-1])
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package pool
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// AuthMode selects how a worker proves knowledge of the pre-shared token.
+type AuthMode string
+
+const (
+	// AuthHMAC answers the hub's CHALLENGE with an HMAC of its nonce, so the
+	// token itself never crosses the wire.
+	AuthHMAC AuthMode = "hmac"
+	// AuthToken sends the token verbatim. Only use it over --tls.
+	AuthToken AuthMode = "token"
+)
+
+// authError marks a hub rejecting the worker's credentials. Like
+// certificate errors it is not fixed by retrying quickly.
+type authError struct {
+	reason string
+}
+
+func (e *authError) Error() string { return "authentication failed: " + e.reason }
+
+// authResponse builds the AUTH line answering a "CHALLENGE <nonce>" line.
+func authResponse(mode AuthMode, token *Secret, challenge string) (string, error) {
+	fields := strings.Fields(challenge)
+	if len(fields) != 2 || fields[0] != "CHALLENGE" {
+		return "", fmt.Errorf("malformed challenge %q", challenge)
+	}
+	if mode == AuthToken {
+		return "AUTH " + string(token.Bytes()), nil
+	}
+	return "AUTH HMAC " + authMAC(token, fields[1]), nil
+}
+
+func authMAC(token *Secret, nonce string) string {
+	return hex.EncodeToString(token.MAC([]byte(nonce)))
+}
@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAuthResponse(t *testing.T) {
+	token := newSecret([]byte("t0ken"))
+	defer token.Wipe()
+
+	line, err := authResponse(AuthHMAC, token, "CHALLENGE 0123abcd")
+	if err != nil {
+		t.Fatalf("authResponse: %v", err)
+	}
+	if want := "AUTH HMAC " + authMAC(token, "0123abcd"); line != want {
+		t.Fatalf("got %q, want %q", line, want)
+	}
+	if strings.Contains(line, "t0ken") {
+		t.Fatalf("hmac response leaked the token: %q", line)
+	}
+
+	line, err = authResponse(AuthToken, token, "CHALLENGE 0123abcd")
+	if err != nil || line != "AUTH t0ken" {
+		t.Fatalf("token mode: got %q, %v", line, err)
+	}
+
+	if _, err := authResponse(AuthHMAC, token, "CHALLENGE"); err == nil {
+		t.Fatalf("expected malformed challenge to be rejected")
+	}
+}
+
+func TestPerformHandshakeAuth(t *testing.T) {
+	cases := []struct {
+		name    string
+		token   *Secret
+		verdict string
+		wantErr bool
+	}{
+		{name: "accepted", token: newSecret([]byte("t0ken")), verdict: "OK"},
+		{name: "rejected", token: newSecret([]byte("wrong")), verdict: "ERR auth failed", wantErr: true},
+		{name: "no token", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{Mode: ModeSocks, AuthMode: AuthHMAC, AuthToken: tc.token}
+			if tc.token != nil {
+				opts.AuthTokenFile = "token"
+			}
+			s := NewSupervisor(opts)
+			worker, hub := net.Pipe()
+			defer worker.Close()
+			defer hub.Close()
+
+			go func() {
+				r := bufio.NewReader(hub)
+				if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "HELLO 1 socks") {
+					return
+				}
+				hub.Write([]byte("CHALLENGE 0123abcd\n"))
+				if tc.token == nil {
+					return
+				}
+				r.ReadString('\n')
+				hub.Write([]byte(tc.verdict + "\n"))
+			}()
+
+			_, err := s.performHandshake(s.link(), nil, newControlWriter(worker), bufio.NewReader(worker), 1)
+			var authErr *authError
+			if tc.wantErr != (err != nil) || (err != nil && !errors.As(err, &authErr)) {
+				t.Fatalf("performHandshake: got %v, want auth error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
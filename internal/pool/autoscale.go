@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultScaleDownAfter is how long a surplus worker may sit idle before
+// --max-workers autoscaling retires it, unless --scale-down-after says
+// otherwise.
+const defaultScaleDownAfter = time.Minute
+
+// scaleTick is how often runWorkers looks for idle workers to retire while
+// autoscaling. Scaling up does not wait for it: a worker taking a request
+// signals s.demand.
+func scaleTick(opts *Options) time.Duration {
+	return min(max(opts.ScaleDownAfter/4, 100*time.Millisecond), 5*time.Second)
+}
+
+// scaleWorkers decides how --max-workers autoscaling resizes workers: it
+// returns how many workers to start and which ones to retire. Every worker
+// that is not busy, including one still connecting or backing off, counts
+// as spare, so a hub outage does not scale the pool up. Spare workers are
+// added until --min-workers of them are left, up to --max-workers in all.
+// Beyond that, spare workers idle for --scale-down-after are retired,
+// newest first.
+func scaleWorkers(workers []*worker, opts *Options, now time.Time) (add int, retire []*worker) {
+	spare := 0
+	var idle []*worker
+	for _, w := range workers {
+		st := w.snapshot()
+		if st.state == workerBusy {
+			continue
+		}
+		spare++
+		if st.state == workerIdle && now.Sub(st.since) >= opts.ScaleDownAfter {
+			idle = append(idle, w)
+		}
+	}
+	if spare < opts.MinWorkers {
+		return min(opts.MinWorkers-spare, opts.MaxWorkers-len(workers)), nil
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].id > idle[j].id })
+	surplus := min(spare-opts.MinWorkers, len(workers)-opts.MinWorkers, len(idle))
+	if surplus <= 0 {
+		return 0, nil
+	}
+	return 0, idle[:surplus]
+}
+
+// noteDemand wakes runWorkers to check whether more workers are needed.
+func (s *Supervisor) noteDemand() {
+	select {
+	case s.demand <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,126 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScaleWorkers(t *testing.T) {
+	now := time.Now()
+	opts := &Options{MinWorkers: 2, MaxWorkers: 5, ScaleDownAfter: time.Minute}
+	mk := func(id int, state workerState, since time.Duration) *worker {
+		return &worker{id: id, status: workerStatus{state: state, since: now.Add(-since)}}
+	}
+	for _, tc := range []struct {
+		name    string
+		workers []*worker
+		add     int
+		retire  []int
+	}{
+		{"empty", nil, 2, nil},
+		{"enough spare", []*worker{mk(1, workerBusy, 0), mk(2, workerIdle, 0), mk(3, workerConnecting, 0)}, 0, nil},
+		{"all busy", []*worker{mk(1, workerBusy, 0), mk(2, workerBusy, 0), mk(3, workerIdle, 0)}, 1, nil},
+		{"at the maximum", []*worker{mk(1, workerBusy, 0), mk(2, workerBusy, 0), mk(3, workerBusy, 0), mk(4, workerBusy, 0), mk(5, workerIdle, 0)}, 0, nil},
+		{"surplus, newest first", []*worker{mk(1, workerIdle, time.Hour), mk(2, workerIdle, time.Hour), mk(3, workerIdle, time.Hour), mk(4, workerIdle, time.Hour)}, 0, []int{4, 3}},
+		{"surplus not idle long", []*worker{mk(1, workerIdle, time.Hour), mk(2, workerIdle, time.Hour), mk(3, workerIdle, time.Second)}, 0, []int{2}},
+		{"backoff is spare", []*worker{mk(1, workerBackoff, time.Hour), mk(2, workerBackoff, time.Hour), mk(3, workerBackoff, time.Hour)}, 0, nil},
+	} {
+		add, retire := scaleWorkers(tc.workers, opts, now)
+		var ids []int
+		for _, w := range retire {
+			ids = append(ids, w.id)
+		}
+		if add != tc.add || fmt.Sprint(ids) != fmt.Sprint(tc.retire) {
+			t.Errorf("%s: add %d, retire %v; want %d, %v", tc.name, add, ids, tc.add, tc.retire)
+		}
+	}
+}
+
+func TestAutoscale(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	hub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hub.Close()
+	accept := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := hub.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(10 * time.Second))
+		r := bufio.NewReader(c)
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "HELLO ") {
+			t.Fatalf("expected HELLO, got %q", line)
+		}
+		c.Write([]byte("OK\n"))
+		return c, r
+	}
+
+	s := NewSupervisor(Options{
+		Mode: ModeSocks, Protocol: 1, Workers: 4, RetryDelay: time.Second,
+		MinWorkers: 1, MaxWorkers: 2, ScaleDownAfter: 200 * time.Millisecond,
+		HubHost: "127.0.0.1", HubPort: hub.Addr().(*net.TCPAddr).Port,
+	})
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	first, firstReader := accept()
+	fmt.Fprintf(first, "REQUEST CONNECT ipv4 127.0.0.1 %d\n", target.Addr().(*net.TCPAddr).Port)
+	if line, _ := firstReader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	// With the only worker busy a second one connects.
+	_, secondReader := accept()
+	if got := s.statsLine(); !strings.Contains(got, " workers=2 ") {
+		t.Fatalf("STATS after scaling up: %q", got)
+	}
+
+	// Once the bridge ends its worker reconnects, and one of the two idle
+	// workers is retired after --scale-down-after.
+	first.Close()
+	_, thirdReader := accept()
+	retired := make(chan struct{}, 2)
+	for _, r := range []*bufio.Reader{secondReader, thirdReader} {
+		go func() {
+			if _, err := r.ReadByte(); err == io.EOF {
+				retired <- struct{}{}
+			}
+		}()
+	}
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no idle worker was retired")
+	}
+	if got := s.statsLine(); !strings.Contains(got, " workers=1 ") {
+		t.Fatalf("STATS after scaling down: %q", got)
+	}
+}
@@ -0,0 +1,133 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"contun/internal/logx"
+)
+
+// bannerLookupTimeout bounds resolving the hub for the startup banner.
+const bannerLookupTimeout = 2 * time.Second
+
+// OptionSources records where the options came from: the flags set on the
+// command line and those the --config file set.
+type OptionSources struct {
+	Args       []string
+	ConfigFile string
+	File       []string
+}
+
+func (o OptionSources) String() string {
+	text := "args(" + strings.Join(o.Args, ",") + ")"
+	if o.ConfigFile != "" {
+		text += " file " + o.ConfigFile + "(" + strings.Join(o.File, ",") + ")"
+	}
+	return text
+}
+
+// logStartup logs the effective configuration as one record, so support can
+// read a misconfiguration off a single line: where the options came from,
+// the hub and the addresses it resolves to, the capabilities workers offer,
+// the enabled features and the size of each policy. Secrets and rules only
+// show as counts.
+func (s *Supervisor) logStartup(ctx context.Context) {
+	l := s.link()
+	o := l.opts
+	caps := l.capabilities()
+	if o.Protocol != 1 && o.PendingRequests > 0 {
+		caps = append(caps, capQueue)
+	}
+	protocol := "auto"
+	if o.Protocol != 0 {
+		protocol = strconv.Itoa(o.Protocol)
+	}
+	workers := strconv.Itoa(o.Workers)
+	if o.MaxWorkers > 0 {
+		workers = fmt.Sprintf("%d-%d", o.MinWorkers, o.MaxWorkers)
+	}
+	auth := "none"
+	if o.AuthToken != nil {
+		auth = string(o.AuthMode)
+	}
+	hub := net.JoinHostPort(o.HubHost, strconv.Itoa(o.HubPort))
+	if o.HubURL != "" {
+		hub = o.HubURL
+	}
+	fields := []any{
+		"version", BuildVersion(),
+		"config", l.hash,
+		"sources", o.Sources.String(),
+		"hub", hub,
+		"hub_addrs", s.hubAddrs(ctx),
+		"mode", string(o.Mode),
+		"workers", workers,
+		"protocol", protocol,
+		"auth", auth,
+		"caps", strings.Join(caps, ","),
+		"features", o.Features(),
+		"policy", o.policyCounts(),
+	}
+	var b strings.Builder
+	b.WriteString("Effective configuration:")
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&b, " %s=%v", fields[i], fields[i+1])
+	}
+	logx.Log(s.logger, b.String(), fields...)
+}
+
+// hubAddrs returns the addresses the hub host resolves to here, or why it
+// did not resolve.
+func (s *Supervisor) hubAddrs(ctx context.Context) string {
+	if s.opts.ViaSSH != "" {
+		return "resolved-by-ssh-jump"
+	}
+	if p := s.link().hubProxy; p != nil && p.remoteNames() {
+		return "resolved-by-proxy"
+	}
+	ctx, cancel := context.WithTimeout(ctx, bannerLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, s.opts.HubHost)
+	if err != nil {
+		return "unresolved(" + normalizeError(err).Error() + ")"
+	}
+	return strings.Join(addrs, ",")
+}
+
+// policyCounts lists how many rules each policy option holds, as
+// "allow=2,deny=1", or "none".
+func (o *Options) policyCounts() string {
+	var counts []string
+	for _, p := range []struct {
+		name string
+		n    int
+	}{
+		{"allow", len(o.Allow)},
+		{"deny", len(o.Deny)},
+		{"source-rule", len(o.SourceRules)},
+		{"netns-rule", len(o.NetnsRules)},
+		{"alert-pattern", len(o.AlertPatterns)},
+		{"redact", len(o.Redact)},
+		{"plugin", len(o.Plugins)},
+		{"label", len(o.Labels)},
+		{"alias", len(o.Aliases)},
+		{"expose", len(o.Exposes)},
+		{"target", len(o.Targets)},
+		{"target-pattern", len(o.TargetPatterns)},
+	} {
+		if p.n > 0 {
+			counts = append(counts, fmt.Sprintf("%s=%d", p.name, p.n))
+		}
+	}
+	if o.Hook != nil {
+		counts = append(counts, "hook=1")
+	}
+	if len(counts) == 0 {
+		return "none"
+	}
+	return strings.Join(counts, ",")
+}
@@ -0,0 +1,42 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogStartup(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "pool.yaml")
+	token := filepath.Join(dir, "token")
+	os.WriteFile(config, []byte("mode: socks\ndeny: [\"10.0.0.0/8\", \"db.example\"]\n"), 0o600)
+	os.WriteFile(token, []byte("s3cret-token\n"), 0o600)
+	opts, err := ParseArgs([]string{"--config", config, "-j", "127.0.0.1", "-p", "5555", "--auth-token-file", token})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	want := OptionSources{Args: []string{"auth-token-file", "config", "j", "p"}, ConfigFile: config, File: []string{"deny", "mode"}}
+	if !reflect.DeepEqual(opts.Sources, want) {
+		t.Fatalf("sources %+v, want %+v", opts.Sources, want)
+	}
+
+	var out bytes.Buffer
+	s := NewSupervisor(*opts)
+	s.logger = log.New(&out, "", 0)
+	s.logStartup(context.Background())
+	got := out.String()
+	for _, field := range []string{"hub=127.0.0.1:5555 ", "hub_addrs=127.0.0.1 ", "mode=socks ", "auth=hmac ", "policy=deny=2", "caps=cancel,udp,", "sources=args(auth-token-file,config,j,p) file " + config + "(deny,mode) "} {
+		if !strings.Contains(got, field) {
+			t.Errorf("banner lacks %q: %s", field, got)
+		}
+	}
+	if strings.Count(got, "\n") != 1 || strings.Contains(got, "s3cret") {
+		t.Fatalf("banner %q", got)
+	}
+}
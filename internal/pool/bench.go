@@ -0,0 +1,437 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"contun/internal/secure"
+	"contun/internal/transport"
+	"contun/internal/websocket"
+)
+
+var benchUsageText = `Usage: poolgo bench [options]
+
+Measures the hub link transports on the loopback interface: throughput of
+one bulk stream, round-trip time of small messages, and the CPU time the
+process spent per GiB moved.
+
+Options:
+      --transport <list>     Comma-separated transports to measure (default all: ` + "%s" + `).
+      --size <bytes>         Bytes streamed for the throughput run, with K, M or G (default 256M).
+      --rounds <n>           Round trips for the latency run (default 2000).
+      --sessions <n>         Instead, hold n sessions open at once through a pool in this process
+                             and report what each one costs (raise ulimit -n to about 4n).
+      --cpuprofile <file>    Write a CPU profile of the runs to this file, for go tool pprof.
+  -h, --help                 Show this help message and exit.
+
+Both ends run in this process, so the numbers compare transports with
+each other on this machine; they are not what a real link will do.`
+
+// benchMessage is the size of one message in the latency run.
+const benchMessage = 64
+
+// benchTransport sets up one hub link transport between two ends in this
+// process, the way a worker and the hub set it up.
+type benchTransport struct {
+	name string
+	pair func() (client, server net.Conn, err error)
+}
+
+var benchTransports = []benchTransport{
+	{"tcp", loopbackPair},
+	{"tls", tlsPair},
+	{"noise", noisePair},
+	{"ws", wsPair},
+	{"quic", quicPair},
+}
+
+// BenchUsage returns the help text for the bench subcommand.
+func BenchUsage() string {
+	var names []string
+	for _, t := range benchTransports {
+		names = append(names, t.name)
+	}
+	return fmt.Sprintf(benchUsageText, strings.Join(names, ","))
+}
+
+// BenchOptions captures parsed bench subcommand configuration.
+type BenchOptions struct {
+	Transports []string
+	Size       int64
+	Rounds     int
+	Sessions   int // run the session load test instead
+	CPUProfile string
+}
+
+// ParseBenchArgs parses the arguments following "poolgo bench".
+func ParseBenchArgs(args []string) (*BenchOptions, error) {
+	fs := flag.NewFlagSet("poolgo bench", flag.ContinueOnError)
+	fs.SetOutput(flagDiscard{})
+
+	var (
+		transports  = fs.String("transport", "", "")
+		size        = fs.String("size", "256M", "")
+		rounds      = fs.Int("rounds", 2000, "")
+		sessions    = fs.Int("sessions", 0, "")
+		cpuProfile  = fs.String("cpuprofile", "", "")
+		helpFlag    = fs.Bool("help", false, "")
+		helpFlagAlt = fs.Bool("h", false, "")
+	)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ErrShowUsage
+		}
+		return nil, err
+	}
+	if *helpFlag || *helpFlagAlt {
+		return nil, ErrShowUsage
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	opts := &BenchOptions{Rounds: *rounds, Sessions: *sessions, CPUProfile: *cpuProfile}
+	for _, name := range strings.Split(*transports, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		if !slices.ContainsFunc(benchTransports, func(t benchTransport) bool { return t.name == name }) {
+			return nil, fmt.Errorf("--transport: unknown transport %q", name)
+		}
+		opts.Transports = append(opts.Transports, name)
+	}
+	var err error
+	if opts.Size, err = parseByteSize(*size); err != nil {
+		return nil, fmt.Errorf("--size: %v", err)
+	}
+	if opts.Rounds <= 0 {
+		return nil, fmt.Errorf("--rounds must be positive")
+	}
+	if opts.Sessions < 0 || opts.Sessions > 0 && len(opts.Transports) > 0 {
+		return nil, fmt.Errorf("--sessions must be positive and cannot be combined with --transport")
+	}
+	return opts, nil
+}
+
+// BenchResult is what Bench measured for one transport.
+type BenchResult struct {
+	Transport  string
+	Throughput float64       // bytes per second
+	RTT50      time.Duration // median round trip
+	RTT99      time.Duration
+	CPUPerGiB  time.Duration // process CPU time per GiB streamed; 0 if unknown
+}
+
+// Bench measures each transport opts names, or all of them, and writes a
+// table of the results to out.
+func Bench(opts BenchOptions, out io.Writer) error {
+	if opts.CPUProfile != "" {
+		f, err := os.Create(opts.CPUProfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return err
+		}
+		defer pprof.StopCPUProfile()
+	}
+	if opts.Sessions > 0 {
+		res, err := benchSessions(opts.Sessions)
+		if err != nil {
+			return fmt.Errorf("sessions: %w", err)
+		}
+		return writeLoadResult(out, res)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "transport\tthroughput\trtt p50\trtt p99\tcpu/GiB")
+	for _, t := range benchTransports {
+		if len(opts.Transports) > 0 && !slices.Contains(opts.Transports, t.name) {
+			continue
+		}
+		res, err := benchRun(t, opts.Size, opts.Rounds)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.name, err)
+		}
+		cpu := "n/a"
+		if res.CPUPerGiB > 0 {
+			cpu = res.CPUPerGiB.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%.1f MB/s\t%s\t%s\t%s\n", res.Transport, res.Throughput/1e6,
+			res.RTT50.Round(time.Microsecond), res.RTT99.Round(time.Microsecond), cpu)
+	}
+	return w.Flush()
+}
+
+// benchRun streams size bytes from the client end to the server end of a
+// fresh pair, then times rounds echoed messages on another.
+func benchRun(t benchTransport, size int64, rounds int) (BenchResult, error) {
+	res := BenchResult{Transport: t.name}
+	client, server, err := t.pair()
+	if err != nil {
+		return res, err
+	}
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, server)
+		server.Close()
+		received <- err
+	}()
+	buf := make([]byte, 32*1024)
+	cpuBefore, cpuKnown := processCPU()
+	start := time.Now()
+	for sent := int64(0); sent < size; {
+		n := int(min(int64(len(buf)), size-sent))
+		if _, err := client.Write(buf[:n]); err != nil {
+			client.Close()
+			return res, err
+		}
+		sent += int64(n)
+	}
+	if err := closeWrite(client); err != nil {
+		client.Close()
+		return res, err
+	}
+	err = <-received
+	elapsed := time.Since(start)
+	cpuAfter, _ := processCPU()
+	client.Close()
+	if err != nil {
+		return res, err
+	}
+	res.Throughput = float64(size) / elapsed.Seconds()
+	if cpuKnown {
+		res.CPUPerGiB = time.Duration(float64(cpuAfter-cpuBefore) * float64(1<<30) / float64(size))
+	}
+
+	if client, server, err = t.pair(); err != nil {
+		return res, err
+	}
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		msg := make([]byte, benchMessage)
+		for {
+			if _, err := io.ReadFull(server, msg); err != nil {
+				return
+			}
+			if _, err := server.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	rtts := make([]time.Duration, rounds)
+	msg := make([]byte, benchMessage)
+	for i := range rtts {
+		start := time.Now()
+		if _, err := client.Write(msg); err != nil {
+			return res, err
+		}
+		if _, err := io.ReadFull(client, msg); err != nil {
+			return res, err
+		}
+		rtts[i] = time.Since(start)
+	}
+	slices.Sort(rtts)
+	res.RTT50, res.RTT99 = rtts[len(rtts)/2], rtts[len(rtts)*99/100]
+	return res, nil
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// loopbackPair connects two ends over the loopback interface.
+func loopbackPair() (net.Conn, net.Conn, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	server := <-accepted
+	if server == nil {
+		client.Close()
+		return nil, nil, errors.New("accept failed")
+	}
+	return client, server, nil
+}
+
+// handshakePair runs the client and server handshakes of a wrapped
+// transport over a TCP pair at once, as they would run on two hosts.
+func handshakePair(client func(net.Conn) (net.Conn, error), server func(net.Conn) (net.Conn, error)) (net.Conn, net.Conn, error) {
+	c, s, err := loopbackPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := server(s)
+		done <- result{conn, err}
+	}()
+	cc, err := client(c)
+	sr := <-done
+	if err == nil {
+		err = sr.err
+	}
+	if err != nil {
+		c.Close()
+		s.Close()
+		return nil, nil, err
+	}
+	return cc, sr.conn, nil
+}
+
+func tlsPair() (net.Conn, net.Conn, error) {
+	cert, err := benchCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	return handshakePair(func(c net.Conn) (net.Conn, error) {
+		conn := tls.Client(c, &tls.Config{RootCAs: roots, ServerName: "hub.bench", MinVersion: tls.VersionTLS12})
+		return conn, conn.Handshake()
+	}, func(s net.Conn) (net.Conn, error) {
+		conn := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}})
+		return conn, conn.Handshake()
+	})
+}
+
+// benchCertificate makes a throwaway self-signed certificate for the hub
+// end of the TLS pair.
+func benchCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"hub.bench"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func noisePair() (net.Conn, net.Conn, error) {
+	hubKey, err := secure.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	workerKey, err := secure.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return handshakePair(func(c net.Conn) (net.Conn, error) {
+		return secure.Client(c, secure.Config{StaticKey: workerKey, PeerKey: hubKey.PublicKey(), Prologue: []byte(secure.Prologue)})
+	}, func(s net.Conn) (net.Conn, error) {
+		return secure.Server(s, secure.Config{StaticKey: hubKey, Prologue: []byte(secure.Prologue)})
+	})
+}
+
+func wsPair() (net.Conn, net.Conn, error) {
+	u := &url.URL{Scheme: "ws", Host: "hub.bench", Path: "/tunnel"}
+	return handshakePair(func(c net.Conn) (net.Conn, error) {
+		return websocket.Client(context.Background(), c, u)
+	}, func(s net.Conn) (net.Conn, error) {
+		conn, _, err := websocket.Upgrade(s, bufio.NewReader(s))
+		return conn, err
+	})
+}
+
+// quicPair opens one stream of a QUIC connection over the loopback
+// interface. The connection and its listener go away with the client end.
+func quicPair() (net.Conn, net.Conn, error) {
+	cert, err := benchCertificate()
+	if err != nil {
+		return nil, nil, err
+	}
+	ln, err := transport.ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	q := transport.NewQUIC(ln.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "hub.bench"})
+	release := func() {
+		q.Close()
+		ln.Close()
+	}
+	client, err := q.Dial(context.Background())
+	if err == nil {
+		// The stream reaches the hub with its first bytes.
+		_, err = client.Write([]byte{0})
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	server, err := ln.Accept()
+	if err == nil {
+		_, err = io.ReadFull(server, make([]byte, 1))
+	}
+	if err != nil {
+		client.Close()
+		release()
+		return nil, nil, err
+	}
+	return &releasingConn{Conn: client, release: release}, server, nil
+}
+
+// releasingConn runs release once the connection is closed.
+type releasingConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releasingConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+func (c *releasingConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
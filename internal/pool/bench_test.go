@@ -0,0 +1,102 @@
+package pool
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	opts, err := ParseBenchArgs([]string{"--size", "1M", "--rounds", "50"})
+	if err != nil {
+		t.Fatalf("ParseBenchArgs: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Bench(*opts, &out); err != nil {
+		t.Fatalf("Bench: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1+len(benchTransports) || !strings.HasPrefix(lines[1], "tcp ") || !strings.Contains(lines[2], " MB/s ") {
+		t.Fatalf("Bench printed:\n%s", out.String())
+	}
+	for _, args := range [][]string{{"--transport", "carrier-pigeon"}, {"--size", "0"}, {"--rounds", "0"}, {"extra"},
+		{"--sessions", "-1"}, {"--sessions", "5", "--transport", "tcp"}} {
+		if _, err := ParseBenchArgs(args); err == nil {
+			t.Errorf("accepted %q", args)
+		}
+	}
+}
+
+func TestBenchSessions(t *testing.T) {
+	res, err := benchSessions(50)
+	if err != nil {
+		t.Fatalf("benchSessions: %v", err)
+	}
+	// A worker and one copy goroutine for each bridge, the other direction
+	// copying on the worker's, plus Run's own few spread over the sessions.
+	if res.Goroutines > 2.5 {
+		t.Errorf("%.2f goroutines per session, want about 2", res.Goroutines)
+	}
+	if res.Setup <= 0 || res.Reply50 <= 0 || res.Reply99 < res.Reply50 {
+		t.Errorf("benchSessions measured %+v", res)
+	}
+	var out bytes.Buffer
+	if err := writeLoadResult(&out, res); err != nil || !strings.HasPrefix(out.String(), "sessions ") {
+		t.Fatalf("writeLoadResult printed %q (%v)", out.String(), err)
+	}
+}
+
+// BenchmarkTransportThroughput streams through each transport in 32 KiB
+// writes, as poolgo bench does; compare with benchstat.
+func BenchmarkTransportThroughput(b *testing.B) {
+	for _, tr := range benchTransports {
+		b.Run(tr.name, func(b *testing.B) {
+			client, server, err := tr.pair()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			go func() {
+				io.Copy(io.Discard, server)
+				server.Close()
+			}()
+			buf := make([]byte, 32*1024)
+			b.SetBytes(int64(len(buf)))
+			b.ResetTimer()
+			for range b.N {
+				if _, err := client.Write(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTransportRoundTrip times one echoed 64-byte message per
+// iteration.
+func BenchmarkTransportRoundTrip(b *testing.B) {
+	for _, tr := range benchTransports {
+		b.Run(tr.name, func(b *testing.B) {
+			client, server, err := tr.pair()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				io.Copy(server, server)
+			}()
+			msg := make([]byte, benchMessage)
+			b.ResetTimer()
+			for range b.N {
+				if _, err := client.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(client, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package pool
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// processCPU returns the user and system CPU time the process has used.
+func processCPU() (time.Duration, bool) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(windows.CurrentProcess(), &creation, &exit, &kernel, &user); err != nil {
+		return 0, false
+	}
+	// Filetime counts 100-nanosecond intervals.
+	ticks := func(t windows.Filetime) int64 { return int64(t.HighDateTime)<<32 | int64(t.LowDateTime) }
+	return time.Duration((ticks(kernel) + ticks(user)) * 100), true
+}
@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cancelWatch reads the hub control channel while a target dial is in
+// flight, so a CANCEL for the session or the hub hanging up aborts the dial
+// instead of completing a connection nobody will use.
+type cancelWatch struct {
+	hub       net.Conn
+	done      chan struct{}
+	err       error
+	cancelled atomic.Bool
+}
+
+// controlSource hands out control messages that have already arrived in
+// full, so a read deadline can stop a reader at any point without losing a
+// partial message.
+type controlSource interface {
+	// takeControl consumes one complete buffered message, if there is one.
+	takeControl() (string, bool)
+	// fill waits for more input from the hub.
+	fill() error
+}
+
+// lineSource reads version 1 control lines.
+type lineSource struct {
+	reader *bufio.Reader
+}
+
+func (l lineSource) takeControl() (string, bool) {
+	return takeLine(l.reader)
+}
+
+func (l lineSource) fill() error {
+	_, err := l.reader.Peek(l.reader.Buffered() + 1)
+	return err
+}
+
+// watchCancel starts watching hub for "CANCEL <sessionID>" and calls cancel
+// when it arrives or the hub connection fails. Only complete messages are
+// consumed from src, so stopping the watch never loses a partial one.
+func watchCancel(hub net.Conn, src controlSource, sessionID string, cancel context.CancelFunc) *cancelWatch {
+	w := &cancelWatch{hub: hub, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		for {
+			if line, ok := src.takeControl(); ok {
+				fields := strings.Fields(line)
+				if sessionID != "" && len(fields) == 2 && fields[0] == "CANCEL" && fields[1] == sessionID {
+					w.cancelled.Store(true)
+					cancel()
+					return
+				}
+				// Anything else, including a stale CANCEL, is ignored.
+				continue
+			}
+			if err := src.fill(); err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					w.err = err
+					cancel()
+				}
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// stop ends the watch and returns the hub error that aborted it, if any.
+func (w *cancelWatch) stop() error {
+	_ = w.hub.SetReadDeadline(time.Unix(1, 0))
+	<-w.done
+	_ = w.hub.SetReadDeadline(time.Time{})
+	return w.err
+}
+
+// takeLine consumes one complete line already buffered in reader.
+func takeLine(reader *bufio.Reader) (string, bool) {
+	buffered, _ := reader.Peek(reader.Buffered())
+	if bytes.IndexByte(buffered, '\n') < 0 {
+		return "", false
+	}
+	line, err := readLine(reader)
+	return line, err == nil
+}
@@ -0,0 +1,49 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchCancel(t *testing.T) {
+	worker, hub := net.Pipe()
+	defer worker.Close()
+	defer hub.Close()
+	reader := bufio.NewReader(worker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := watchCancel(worker, lineSource{reader}, "7", cancel)
+	go hub.Write([]byte("CANCEL 6\nCANCEL 7\n"))
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("CANCEL did not abort the dial")
+	}
+	if err := watch.stop(); err != nil || !watch.cancelled.Load() {
+		t.Fatalf("stop: err=%v cancelled=%v", err, watch.cancelled.Load())
+	}
+}
+
+func TestWatchCancelKeepsPartialLine(t *testing.T) {
+	worker, hub := net.Pipe()
+	defer worker.Close()
+	defer hub.Close()
+	reader := bufio.NewReader(worker)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := watchCancel(worker, lineSource{reader}, "7", cancel)
+	hub.Write([]byte("SHUTDOWN 1 "))
+	if err := watch.stop(); err != nil || ctx.Err() != nil {
+		t.Fatalf("stop: err=%v ctx=%v", err, ctx.Err())
+	}
+
+	go hub.Write([]byte("abc\n"))
+	if line, err := readLine(reader); err != nil || line != "SHUTDOWN 1 abc" {
+		t.Fatalf("got %q, %v after stopping the watch", line, err)
+	}
+}
@@ -0,0 +1,129 @@
+package pool
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"contun/internal/logx"
+)
+
+// Capabilities a worker may advertise in HELLO. The hub acknowledges the
+// ones it supports with "OK CAPS <list>"; anything it leaves out stays off
+// for that hub session, so an older hub gets the features it understands
+// instead of a worker that fails mid-session. A hub that predates CAPS
+// altogether hangs up on them, and gets a bare HELLO next; see bareHello.
+const (
+	capAffinity  = "affinity"  // REQUEST may carry affinity=<key>
+	capBanner    = "banner"    // REQUEST SCAN may ask for banner=<n>
+	capCancel    = "cancel"    // REQUEST carries a session ID the hub may CANCEL
+	capClient    = "client"    // REQUEST may carry client=<ip:port> and client-id=<id>
+	capDeadline  = "deadline"  // REQUEST CONNECT may carry deadline=<ms>
+	capExpose    = "expose"    // EXPOSE lines offer --expose services after OK
+	capHeartbeat = "heartbeat" // idle workers send PING, the hub answers PONG
+	capIdentity  = "identity"  // an IDENTITY line after OK; SHUTDOWN names it
+	capNoise     = "noise"     // Noise_IK handshake after OK
+	capPattern   = "pattern"   // PATTERN lines announce --target-pattern rules after OK
+	capPing      = "ping"      // REQUEST PING
+	capProgress  = "progress"  // PROGRESS lines during slow dials
+	capQueue     = "queue"     // the hub may pipeline REQUESTs (protocol 2)
+	capResults   = "results"   // SCAN streams RESULT lines and honours CANCEL
+	capScan      = "scan"      // REQUEST SCAN
+	capTUN       = "tun"       // REQUEST TUN
+	capUDP       = "udp"       // REQUEST ASSOCIATE
+	capWindow    = "window"    // protocol 2 streams are flow controlled with WINDOW
+)
+
+// capSet is a set of capability names.
+type capSet map[string]bool
+
+// parseCaps parses a comma-separated capability list.
+func parseCaps(list string) capSet {
+	caps := make(capSet)
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" {
+			caps[c] = true
+		}
+	}
+	return caps
+}
+
+// String lists the capabilities sorted and comma-separated, or "none".
+func (c capSet) String() string {
+	if len(c) == 0 {
+		return "none"
+	}
+	return strings.Join(c.names(), ",")
+}
+
+// names lists the capabilities sorted.
+func (c capSet) names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hubSession is the state negotiated with the hub for one connection.
+type hubSession struct {
+	version int    // control protocol version
+	caps    capSet // capabilities the hub acknowledged
+}
+
+// capabilities lists the optional protocol extensions advertised in HELLO.
+func (l *link) capabilities() []string {
+	caps := []string{capCancel}
+	if l.noise != nil {
+		caps = append(caps, capNoise)
+	}
+	if l.opts.Progress {
+		caps = append(caps, capProgress)
+	}
+	if l.opts.Mode == ModeSocks {
+		caps = append(caps, capUDP, capPing, capScan, capBanner, capResults)
+	}
+	if l.opts.TUN != "" {
+		caps = append(caps, capTUN)
+	}
+	if l.opts.Compress != "" {
+		caps = append(caps, l.opts.Compress)
+	}
+	if l.opts.HeartbeatInterval > 0 {
+		caps = append(caps, capHeartbeat)
+	}
+	if len(l.opts.Exposes) > 0 {
+		caps = append(caps, capExpose)
+	}
+	if len(l.opts.TargetPatterns) > 0 {
+		caps = append(caps, capPattern)
+	}
+	if l.opts.FlowControl {
+		caps = append(caps, capWindow)
+	}
+	if l.opts.ShutdownKeyFile != "" {
+		caps = append(caps, capIdentity)
+	}
+	caps = append(caps, capAffinity, capClient, capDeadline)
+	return caps
+}
+
+// noteDeclined logs the advertised capabilities a hub did not acknowledge,
+// once for each distinct set, so operators learn which features an older
+// hub leaves switched off without a line on every reconnect.
+func (s *Supervisor) noteDeclined(l *link, accepted capSet, logger *log.Logger) {
+	declined := make(capSet)
+	for _, c := range l.capabilities() {
+		if !accepted[c] {
+			declined[c] = true
+		}
+	}
+	s.capsMu.Lock()
+	defer s.capsMu.Unlock()
+	if len(declined) == 0 || declined.String() == s.declined {
+		return
+	}
+	s.declined = declined.String()
+	logx.At(logger, "proto", logx.Info).Printf("hub did not accept capabilities %s; those features stay off on its sessions", s.declined)
+}
@@ -0,0 +1,122 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCaps(t *testing.T) {
+	caps := parseCaps("Cancel, progress,,udp")
+	if got := caps.String(); got != "cancel,progress,udp" {
+		t.Fatalf("parseCaps = %q", got)
+	}
+	if got := parseCaps("").String(); got != "none" {
+		t.Fatalf("empty list = %q, want none", got)
+	}
+}
+
+func TestNoteDeclined(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Progress: true})
+	var out bytes.Buffer
+	logger := log.New(&out, "", 0)
+
+	s.noteDeclined(s.link(), parseCaps("affinity,banner,cancel,client,deadline,ping,progress,results,scan,udp"), logger)
+	if out.Len() != 0 {
+		t.Fatalf("logged although every capability was accepted: %q", out.String())
+	}
+	s.noteDeclined(s.link(), parseCaps("affinity,banner,cancel,client,deadline,ping,progress,results,scan"), logger)
+	s.noteDeclined(s.link(), parseCaps("affinity,banner,cancel,client,deadline,ping,progress,results,scan"), logger)
+	if n := strings.Count(out.String(), "\n"); n != 1 || !strings.Contains(out.String(), "capabilities udp") {
+		t.Fatalf("want one line declining udp, got %q", out.String())
+	}
+	s.noteDeclined(s.link(), parseCaps("affinity,banner,cancel,client,deadline,ping,results,scan"), logger)
+	if !strings.Contains(out.String(), "capabilities progress,udp") {
+		t.Fatalf("a new declined set was not logged: %q", out.String())
+	}
+}
+
+// baselineHello accepts the HELLO lines hub.pl understood before
+// capabilities, "HELLO 1 socks" and "HELLO 1 direct DEST <atype> <addr>
+// <port>"; that hub hung up on anything else.
+func baselineHello(line string) bool {
+	parts := strings.Fields(line)
+	if len(parts) < 3 || parts[0] != "HELLO" || parts[1] != "1" {
+		return false
+	}
+	switch parts[2] {
+	case "socks":
+		return len(parts) == 3
+	case "direct":
+		return len(parts) == 7 && parts[3] == "DEST"
+	}
+	return false
+}
+
+// connectBaselineHub runs hub sessions for s against a hub that answers
+// the HELLO lines accept allows with OK, the way the pool's reconnect loop
+// would, and returns the HELLO lines it sent.
+func connectBaselineHub(t *testing.T, s *Supervisor, target *Destination, accept func(string) bool) []string {
+	t.Helper()
+	var hellos []string
+	for range 4 {
+		conn, hub := tcpPair(t)
+		hub.SetDeadline(time.Now().Add(5 * time.Second))
+		lines := make(chan string, 1)
+		go func() {
+			line, _ := bufio.NewReader(hub).ReadString('\n')
+			line = strings.TrimSpace(line)
+			if accept(line) {
+				io.WriteString(hub, "OK\n")
+			}
+			lines <- line
+			hub.Close()
+		}()
+		w := &worker{target: target, ready: make(chan struct{})}
+		err := s.handleHubSession(context.Background(), context.Background(), s.link(), w, conn, log.New(io.Discard, "", 0))
+		line := <-lines
+		hellos = append(hellos, line)
+		if accept(line) {
+			return hellos
+		}
+		if !errors.Is(err, errLegacyHub) && !errors.Is(err, errCapsRefused) {
+			t.Fatalf("after %q: handleHubSession = %v, want a fallback", line, err)
+		}
+	}
+	t.Fatalf("never registered: %q", hellos)
+	return nil
+}
+
+func TestBareHelloFallback(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks})
+	hellos := connectBaselineHub(t, s, nil, baselineHello)
+	if len(hellos) != 3 || !strings.HasPrefix(hellos[0], "HELLO 2 socks CAPS ") || !strings.HasPrefix(hellos[1], "HELLO 1 socks CAPS ") || hellos[2] != "HELLO 1 socks" {
+		t.Fatalf("HELLO lines %q", hellos)
+	}
+
+	// A hub that refuses the bare HELLO too was not refusing CAPS.
+	worker, hub := tcpPair(t)
+	go func() {
+		bufio.NewReader(hub).ReadString('\n')
+		hub.Close()
+	}()
+	s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	if s.bareHello.Load() {
+		t.Fatal("still leaving CAPS out after a bare HELLO was refused")
+	}
+}
+
+func TestBareHelloFallbackDirect(t *testing.T) {
+	target := &Destination{AddrType: AddrIPv4, Host: "10.0.0.5", Port: 5432}
+	s := NewSupervisor(Options{Mode: ModeDirect, Protocol: 1, Targets: []*Destination{target}})
+	hellos := connectBaselineHub(t, s, target, baselineHello)
+	if len(hellos) != 2 || hellos[1] != "HELLO 1 direct DEST ipv4 10.0.0.5 5432" {
+		t.Fatalf("HELLO lines %q", hellos)
+	}
+}
@@ -0,0 +1,174 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+var cleanupUsageText = `Usage: poolgo cleanup [options]
+
+Removes the files a pool leaves behind on a bastion at the end of an engagement.
+
+Options:
+      --state-file <path>      State file written by --state-file.
+      --shutdown-key <path>    Shutdown secret used with --shutdown-key.
+      --auth-token-file <path> Token file used with --auth-token-file.
+      --audit-log <path>       Audit log written by --audit-log.
+      --session-log <path>     Session log written by --session-log.
+      --config <path>          Config file read with --config.
+      --tls-cert <path>        Client certificate used with --tls-cert.
+      --tls-key <path>         Client private key used with --tls-key.
+      --noise-key <path>       Noise private key used with --noise-key.
+      --ssh-key <path>         SSH private key used with --ssh-key.
+      --artifact <path>        Additional file to remove (repeatable).
+      --artifacts-file <path>  File listing artifacts to remove, one path per line
+                               ('#' starts a comment). The list itself is removed last.
+      --remove-binary          Also delete the poolgo executable.
+  -n, --dry-run                Print what would be removed without deleting anything.
+  -h, --help                   Show this help message and exit.`
+
+// CleanupUsage returns the help text for the cleanup subcommand.
+func CleanupUsage() string {
+	return cleanupUsageText
+}
+
+// CleanupOptions captures parsed cleanup subcommand configuration.
+type CleanupOptions struct {
+	Artifacts     []string
+	ArtifactsFile string
+	RemoveBinary  bool
+	DryRun        bool
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// ParseCleanupArgs parses the arguments following "poolgo cleanup".
+func ParseCleanupArgs(args []string) (*CleanupOptions, error) {
+	fs := flag.NewFlagSet("poolgo cleanup", flag.ContinueOnError)
+	fs.SetOutput(flagDiscard{})
+
+	var artifacts stringList
+	var (
+		stateFile     = fs.String("state-file", "", "")
+		shutdownKey   = fs.String("shutdown-key", "", "")
+		authToken     = fs.String("auth-token-file", "", "")
+		auditLog      = fs.String("audit-log", "", "")
+		sessionLog    = fs.String("session-log", "", "")
+		configFile    = fs.String("config", "", "")
+		tlsCert       = fs.String("tls-cert", "", "")
+		tlsKey        = fs.String("tls-key", "", "")
+		noiseKey      = fs.String("noise-key", "", "")
+		sshKey        = fs.String("ssh-key", "", "")
+		artifactsFile = fs.String("artifacts-file", "", "")
+		removeBinary  = fs.Bool("remove-binary", false, "")
+		dryRun        = fs.Bool("dry-run", false, "")
+		dryRunAlt     = fs.Bool("n", false, "")
+		helpFlag      = fs.Bool("help", false, "")
+		helpFlagAlt   = fs.Bool("h", false, "")
+	)
+	fs.Var(&artifacts, "artifact", "")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ErrShowUsage
+		}
+		return nil, err
+	}
+	if *helpFlag || *helpFlagAlt {
+		return nil, ErrShowUsage
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	opts := &CleanupOptions{
+		ArtifactsFile: *artifactsFile,
+		RemoveBinary:  *removeBinary,
+		DryRun:        *dryRun || *dryRunAlt,
+	}
+	for _, path := range []string{*stateFile, *shutdownKey, *authToken, *auditLog, *sessionLog, *configFile, *tlsCert, *tlsKey, *noiseKey, *sshKey} {
+		if path != "" {
+			opts.Artifacts = append(opts.Artifacts, path)
+		}
+	}
+	opts.Artifacts = append(opts.Artifacts, artifacts...)
+	if len(opts.Artifacts) == 0 && opts.ArtifactsFile == "" && !opts.RemoveBinary {
+		return nil, fmt.Errorf("nothing to clean up")
+	}
+	return opts, nil
+}
+
+// readArtifactList returns the non-empty, non-comment lines of path.
+func readArtifactList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+// Cleanup removes every configured artifact. Missing files are skipped; the
+// first removal failure is reported after all other artifacts were attempted.
+func Cleanup(opts CleanupOptions, logger *log.Logger) error {
+	targets := append([]string(nil), opts.Artifacts...)
+	if opts.ArtifactsFile != "" {
+		listed, err := readArtifactList(opts.ArtifactsFile)
+		if err != nil {
+			return fmt.Errorf("read artifacts file: %w", err)
+		}
+		targets = append(targets, listed...)
+		targets = append(targets, opts.ArtifactsFile)
+	}
+	if opts.RemoveBinary {
+		exe, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("locate executable: %w", err)
+		}
+		targets = append(targets, exe)
+	}
+
+	var firstErr error
+	for _, path := range targets {
+		if opts.DryRun {
+			logger.Printf("would remove %s", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				logger.Printf("already absent: %s", path)
+				continue
+			}
+			logger.Printf("failed to remove %s: %v", path, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logger.Printf("removed %s", path)
+	}
+	return firstErr
+}
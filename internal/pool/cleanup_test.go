@@ -0,0 +1,51 @@
+package pool
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanupRemovesListedArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state.json")
+	sessions := filepath.Join(dir, "sessions.jsonl")
+	config := filepath.Join(dir, "pool.yaml")
+	extra := filepath.Join(dir, "extra.log")
+	list := filepath.Join(dir, "artifacts.txt")
+	for _, path := range []string{state, sessions, config, extra} {
+		if err := os.WriteFile(path, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(list, []byte("# engagement files\n"+extra+"\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := ParseCleanupArgs([]string{
+		"--state-file", state,
+		"--session-log", sessions,
+		"--config", config,
+		"--artifact", filepath.Join(dir, "missing"),
+		"--artifacts-file", list,
+	})
+	if err != nil {
+		t.Fatalf("ParseCleanupArgs error: %v", err)
+	}
+	if err := Cleanup(*opts, log.New(io.Discard, "", 0)); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+	for _, path := range []string{state, sessions, config, extra, list} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s still present", path)
+		}
+	}
+}
+
+func TestParseCleanupArgsRequiresTargets(t *testing.T) {
+	if _, err := ParseCleanupArgs(nil); err == nil {
+		t.Fatalf("expected error with nothing to clean up")
+	}
+}
@@ -0,0 +1,123 @@
+package pool
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for the bridged data path. Each is also the name
+// of the capability that offers it: a worker started with --compress
+// advertises its algorithm, and a hub that accepts it compresses the
+// CONNECT streams it carries on that connection, in both directions.
+// Control messages, datagram and TUN sessions are never compressed.
+const (
+	CompressZstd   = "zstd"
+	CompressSnappy = "snappy"
+)
+
+// compressWindow keeps a zstd stream's memory small, since every active
+// session has its own encoder and decoder.
+const compressWindow = 1 << 20
+
+// flushWriter is a compressing writer that can push out what it has
+// buffered.
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// NewCompressConn returns conn with its writes compressed by alg. Every
+// Write is flushed at once, so interactive protocols see no extra delay,
+// and CloseWrite ends the compressed stream before half-closing conn.
+// Reads are not affected; pair it with NewDecompressReader.
+func NewCompressConn(conn net.Conn, alg string) (net.Conn, error) {
+	var w flushWriter
+	switch alg {
+	case CompressZstd:
+		enc, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(compressWindow))
+		if err != nil {
+			return nil, err
+		}
+		w = enc
+	case CompressSnappy:
+		w = s2.NewWriter(conn, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unknown compression %q", alg)
+	}
+	return &compressConn{Conn: conn, w: w}, nil
+}
+
+// NewDecompressReader returns a reader that decompresses r with alg, as
+// written by the peer's NewCompressConn.
+func NewDecompressReader(r io.Reader, alg string) (io.Reader, error) {
+	switch alg {
+	case CompressZstd:
+		// A single-threaded decoder decodes in Read and needs no Close.
+		return zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(4*compressWindow))
+	case CompressSnappy:
+		return s2.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", alg)
+}
+
+// compressConn compresses writes to the embedded connection.
+type compressConn struct {
+	net.Conn
+	mu     sync.Mutex
+	w      flushWriter
+	closed bool // the compressed stream has ended
+}
+
+func (c *compressConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if _, err := c.w.Write(p); err != nil {
+		return 0, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite ends the compressed stream and half-closes the connection.
+func (c *compressConn) CloseWrite() error {
+	err := c.finish()
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		if cerr := cw.CloseWrite(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	if cerr := c.Conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close closes the connection without ending the compressed stream, since
+// the peer will not read it.
+func (c *compressConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *compressConn) finish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.w.Close()
+}
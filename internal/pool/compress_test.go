@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressConn(t *testing.T) {
+	for _, alg := range []string{CompressZstd, CompressSnappy} {
+		t.Run(alg, func(t *testing.T) {
+			a, b := tcpPair(t)
+			b.SetDeadline(time.Now().Add(5 * time.Second))
+			conn, err := NewCompressConn(a, alg)
+			if err != nil {
+				t.Fatalf("NewCompressConn: %v", err)
+			}
+			r, err := NewDecompressReader(b, alg)
+			if err != nil {
+				t.Fatalf("NewDecompressReader: %v", err)
+			}
+
+			// Each write arrives on its own, before the stream ends.
+			conn.Write([]byte("SSH-2.0-test\r\n"))
+			buf := make([]byte, 14)
+			if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "SSH-2.0-test\r\n" {
+				t.Fatalf("first write arrived as %q (%v)", buf, err)
+			}
+
+			text := strings.Repeat("GET /index.html HTTP/1.1\r\nHost: intranet\r\n\r\n", 200)
+			conn.Write([]byte(text))
+			conn.(interface{ CloseWrite() error }).CloseWrite()
+			var got strings.Builder
+			n, err := io.Copy(&got, r)
+			if err != nil || got.String() != text {
+				t.Fatalf("read %d bytes (%v), want the text back", n, err)
+			}
+		})
+	}
+	if _, err := NewCompressConn(nil, "lz4"); err == nil {
+		t.Fatalf("accepted an unknown algorithm")
+	}
+}
+
+func TestParseArgsCompress(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--compress", "ZSTD"})
+	if err != nil || opts.Compress != CompressZstd || !strings.Contains(opts.Features(), "compress") {
+		t.Fatalf("--compress zstd: %+v, %v", opts, err)
+	}
+	if opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks"}); err != nil || opts.Compress != "" {
+		t.Fatalf("default: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--compress", "gzip"}); err == nil {
+		t.Fatalf("accepted --compress gzip")
+	}
+}
@@ -0,0 +1,159 @@
+package pool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Domain targets with these prefixes name local containers rather than
+// hosts when --container-api is set: "container:<name or ID>" or
+// "label:<key>=<value>".
+const (
+	containerPrefix = "container:"
+	labelPrefix     = "label:"
+)
+
+// containerTarget reports whether host names a container.
+func containerTarget(host string) bool {
+	return strings.HasPrefix(host, containerPrefix) || strings.HasPrefix(host, labelPrefix)
+}
+
+// containerNetworks is the part of the Docker Engine API's container
+// description that lists its addresses, one entry per attached network.
+type containerNetworks struct {
+	Networks map[string]struct {
+		IPAddress         string
+		GlobalIPv6Address string
+	}
+}
+
+// addrs returns the container's addresses, ordered by network name with
+// IPv4 first, so every lookup tries them in the same order.
+func (n containerNetworks) addrs() []netip.Addr {
+	names := make([]string, 0, len(n.Networks))
+	for name := range n.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var v4, v6 []netip.Addr
+	for _, name := range names {
+		network := n.Networks[name]
+		if ip, err := netip.ParseAddr(network.IPAddress); err == nil {
+			v4 = append(v4, ip)
+		}
+		if ip, err := netip.ParseAddr(network.GlobalIPv6Address); err == nil {
+			v6 = append(v6, ip)
+		}
+	}
+	return append(v4, v6...)
+}
+
+// containerClient looks containers up through the Docker Engine API on a
+// Unix socket, which Podman serves as well. Nothing is cached, so a
+// container that restarts with a new address is found at its new one.
+type containerClient struct {
+	http *http.Client
+}
+
+func newContainerClient(socket string) *containerClient {
+	return &containerClient{http: &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}}
+}
+
+// lookup returns the addresses of the running containers host names.
+func (c *containerClient) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if name, ok := strings.CutPrefix(host, containerPrefix); ok {
+		if !validContainerName(name) {
+			return nil, lookupError(host, errors.New("invalid container name"))
+		}
+		var info struct {
+			State           struct{ Running bool }
+			NetworkSettings containerNetworks
+		}
+		found, err := c.get(ctx, "/containers/"+name+"/json", &info)
+		if err != nil {
+			return nil, lookupError(host, err)
+		}
+		if !found {
+			return nil, lookupError(host, errors.New("no such container"))
+		}
+		if !info.State.Running {
+			return nil, lookupError(host, errors.New("container is not running"))
+		}
+		addrs = info.NetworkSettings.addrs()
+	} else {
+		label := strings.TrimPrefix(host, labelPrefix)
+		if key, _, ok := strings.Cut(label, "="); !ok || key == "" {
+			return nil, lookupError(host, errors.New("expected label:<key>=<value>"))
+		}
+		filters, _ := json.Marshal(map[string][]string{"label": {label}})
+		var list []struct{ NetworkSettings containerNetworks }
+		if _, err := c.get(ctx, "/containers/json?filters="+url.QueryEscape(string(filters)), &list); err != nil {
+			return nil, lookupError(host, err)
+		}
+		if len(list) == 0 {
+			return nil, lookupError(host, errors.New("no running container has that label"))
+		}
+		for _, container := range list {
+			addrs = append(addrs, container.NetworkSettings.addrs()...)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, lookupError(host, errors.New("container has no IP address (host networking?)"))
+	}
+	return addrs, nil
+}
+
+// get decodes the JSON answer to an API request into v. It reports false
+// for a 404, which the API returns for unknown containers.
+func (c *containerClient) get(ctx context.Context, path string, v any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://container-api"+path, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("container API: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("container API: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("container API: %w", err)
+	}
+	return true, nil
+}
+
+// validContainerName reports whether name can be a container name or ID,
+// as Docker and Podman allow them.
+func validContainerName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case i > 0 && (r == '_' || r == '.' || r == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
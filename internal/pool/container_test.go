@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeContainerAPI serves the two Docker Engine API calls poolgo makes on
+// a Unix socket and returns its path. webapp runs at 127.0.0.1 and, with
+// label app=web, so does the second container listed.
+func fakeContainerAPI(t *testing.T) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/webapp/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State":{"Running":true},"NetworkSettings":{"Networks":{"lab":{"IPAddress":"127.0.0.1"},"bridge":{"IPAddress":"172.17.0.5"}}}}`)
+	})
+	mux.HandleFunc("/containers/stopped/json", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"State":{"Running":false},"NetworkSettings":{"Networks":{}}}`)
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Query().Get("filters"), `"app=web"`) {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[{"NetworkSettings":{"Networks":{"lab":{"IPAddress":"127.0.0.1","GlobalIPv6Address":"fd00::5"}}}},`+
+			`{"NetworkSettings":{"Networks":{"lab":{"IPAddress":"127.0.0.2"}}}}]`)
+	})
+	mux.HandleFunc("/", http.NotFound)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestContainerLookup(t *testing.T) {
+	c := newContainerClient(fakeContainerAPI(t))
+	for host, want := range map[string]string{
+		"container:webapp": "[172.17.0.5 127.0.0.1]",
+		"label:app=web":    "[127.0.0.1 fd00::5 127.0.0.2]",
+	} {
+		addrs, err := c.lookup(context.Background(), host)
+		if err != nil || fmt.Sprint(addrs) != want {
+			t.Errorf("lookup(%q) = %v, %v; want %s", host, addrs, err, want)
+		}
+	}
+	for host, want := range map[string]string{
+		"container:missing":   "no such container",
+		"container:stopped":   "not running",
+		"container:../images": "invalid container name",
+		"label:app=db":        "no running container",
+		"label:app":           "expected label:<key>=<value>",
+	} {
+		if _, err := c.lookup(context.Background(), host); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("lookup(%q) = %v, want an error containing %q", host, err, want)
+		}
+	}
+}
+
+func TestDialTargetContainer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	s := NewSupervisor(Options{Mode: ModeSocks, ContainerAPI: fakeContainerAPI(t)})
+	req := &Request{AddrType: AddrDomain, Address: "label:app=web", Port: ln.Addr().(*net.TCPAddr).Port}
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Close()
+	req.Address = "container:missing"
+	if _, err := s.dialTarget(context.Background(), req, nil); mapErrorToStatus(err) != 4 {
+		t.Fatalf("dialTarget to a missing container: %v (status %d), want host unreachable", err, mapErrorToStatus(err))
+	}
+}
@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+// errStreaming is returned when a control line is written after the session
+// switched to raw byte streaming.
+var errStreaming = errors.New("control channel is streaming")
+
+// controlWriter serialises control-line writes on a hub connection so that
+// out-of-band notices sent from other goroutines never interleave with REPLY
+// lines or leak into a bridged stream.
+type controlWriter struct {
+	mu        sync.Mutex
+	w         *bufio.Writer
+	frames    *FrameConn // set for protocol version 2
+	streaming bool
+	trace     func(line string) // set once the handshake is over
+}
+
+func newControlWriter(w io.Writer) *controlWriter {
+	return &controlWriter{w: bufio.NewWriter(w)}
+}
+
+// newFrameWriter writes control messages as version 2 control frames.
+// Framing keeps them apart from stream data, so notices are still sent
+// while the session is streaming.
+func newFrameWriter(f *FrameConn) *controlWriter {
+	return &controlWriter{frames: f}
+}
+
+// send writes a single control line and flushes it.
+func (c *controlWriter) send(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streaming {
+		return errStreaming
+	}
+	return c.writeLocked(line)
+}
+
+// sendNotice writes an informational line unless the session is streaming
+// raw bytes. It reports whether the line was sent.
+func (c *controlWriter) sendNotice(line string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streaming && c.frames == nil {
+		return false
+	}
+	return c.writeLocked(line) == nil
+}
+
+// startStream writes the final control line before streaming and blocks
+// further control writes until reset is called.
+func (c *controlWriter) startStream(line string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.streaming {
+		return errStreaming
+	}
+	c.streaming = true
+	return c.writeLocked(line)
+}
+
+// reset re-arms the writer for control lines after a stream ends.
+func (c *controlWriter) reset(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.frames != nil {
+		c.frames.EndStream()
+	} else {
+		c.w.Reset(w)
+	}
+	c.streaming = false
+}
+
+func (c *controlWriter) writeLocked(line string) error {
+	if c.trace != nil {
+		c.trace(line)
+	}
+	if c.frames != nil {
+		return c.frames.WriteControl(line)
+	}
+	if _, err := c.w.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
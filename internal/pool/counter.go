@@ -0,0 +1,35 @@
+package pool
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// counterShards is how many cache lines a counter spreads over.
+const counterShards = 16
+
+// counter is an int64 that every session updates, such as the number of
+// active bridges. A single atomic would bounce its cache line between every
+// core bridging sessions; counter spreads updates over padded shards and
+// sums them on Load, which only the admin socket and STATS lines call.
+type counter struct {
+	shards [counterShards]struct {
+		n atomic.Int64
+		_ [56]byte // pad to a 64-byte cache line
+	}
+}
+
+// Add adds delta to one shard, picked at random: any shard will do, since
+// only the sum means anything.
+func (c *counter) Add(delta int64) {
+	c.shards[rand.IntN(counterShards)].n.Add(delta)
+}
+
+// Load returns the sum of the shards.
+func (c *counter) Load() int64 {
+	var n int64
+	for i := range c.shards {
+		n += c.shards[i].n.Load()
+	}
+	return n
+}
@@ -0,0 +1,26 @@
+package pool
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	var c counter
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.Add(1)
+				c.Add(-1)
+				c.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := c.Load(); n != 8000 {
+		t.Fatalf("Load() = %d, want 8000", n)
+	}
+}
@@ -0,0 +1,105 @@
+package pool
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var ctlUsageText = `Usage: poolgo ctl --socket <addr> <command>
+
+Queries or controls a running pool through its --admin-socket.
+
+Commands:
+  status                     The pool and what each worker is doing: connecting, backoff
+                             (with its last error), idle or busy (with its session).
+  sessions                   Active sessions with their worker, destination and age.
+  drain                      Stop taking requests, as on SIGTERM; active sessions finish.
+  kill-session <id>          Close the hub connection carrying session <id>.
+  rate-limit [<rate>]        Show or set --rate-limit (e.g. 1M or off) without a restart.
+  pool-rate-limit [<rate>]   Show or set --pool-rate-limit the same way.
+  usage                      (hubgo --admin-socket) Streams and bytes per client listener.
+  canary                     (hubgo --admin-socket) Whether the last --canary probe got through.
+
+Options:
+  -s, --socket <addr>        The pool's --admin-socket: a Unix socket path or host:port.
+  -h, --help                 Show this help message and exit.`
+
+// CtlUsage returns the help text for the ctl subcommand.
+func CtlUsage() string {
+	return ctlUsageText
+}
+
+// CtlOptions captures parsed ctl subcommand configuration.
+type CtlOptions struct {
+	Socket  string
+	Command []string
+}
+
+// ParseCtlArgs parses the arguments following "poolgo ctl".
+func ParseCtlArgs(args []string) (*CtlOptions, error) {
+	fs := flag.NewFlagSet("poolgo ctl", flag.ContinueOnError)
+	fs.SetOutput(flagDiscard{})
+
+	var (
+		socket      = fs.String("socket", "", "")
+		socketAlt   = fs.String("s", "", "")
+		helpFlag    = fs.Bool("help", false, "")
+		helpFlagAlt = fs.Bool("h", false, "")
+	)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ErrShowUsage
+		}
+		return nil, err
+	}
+	if *helpFlag || *helpFlagAlt {
+		return nil, ErrShowUsage
+	}
+
+	opts := &CtlOptions{
+		Socket:  normalizeString(*socketAlt, *socket),
+		Command: fs.Args(),
+	}
+	if opts.Socket == "" {
+		return nil, fmt.Errorf("--socket is required")
+	}
+	if _, _, err := AdminAddress(opts.Socket); err != nil {
+		return nil, fmt.Errorf("--socket: %v", err)
+	}
+	if len(opts.Command) == 0 {
+		return nil, fmt.Errorf("a command is required")
+	}
+	return opts, nil
+}
+
+// Ctl sends opts.Command to a pool's admin socket and copies the reply to
+// out. A reply reporting failure is returned as an error instead.
+func Ctl(opts CtlOptions, out io.Writer) error {
+	network, address, err := AdminAddress(opts.Socket)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout(network, address, adminTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+	if _, err := io.WriteString(conn, strings.Join(opts.Command, " ")+"\n"); err != nil {
+		return err
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if msg, ok := strings.CutPrefix(string(reply), "error: "); ok {
+		return errors.New(strings.TrimSpace(msg))
+	}
+	_, err = out.Write(reply)
+	return err
+}
@@ -0,0 +1,164 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dohTimeout bounds one DNS over HTTPS exchange that has no deadline of
+// its own.
+const dohTimeout = 10 * time.Second
+
+// NewResolver returns the resolver for a --dns-server value, or nil for ""
+// (the system's). The server is a plain DNS server as host[:port] or
+// udp://host[:port], tcp://host[:port] for DNS over TCP only,
+// tls://host[:port] for DNS over TLS (port 853) or an https:// URL for DNS
+// over HTTPS. The resolver still reads /etc/hosts first.
+func NewResolver(server string) (*net.Resolver, error) {
+	if server == "" {
+		return nil, nil
+	}
+	scheme, address := "udp", server
+	if strings.Contains(server, "://") {
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		scheme, address = strings.ToLower(u.Scheme), u.Host
+		if scheme == "https" {
+			return &net.Resolver{PreferGo: true, Dial: dohDialer(u.String())}, nil
+		}
+		if u.Path != "" && u.Path != "/" {
+			return nil, fmt.Errorf("unexpected path in %q", server)
+		}
+	}
+	port := "53"
+	switch scheme {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q (want udp, tcp, tls or https)", scheme)
+	}
+	host, p, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
+	} else {
+		port = p
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing server address in %q", server)
+	}
+	address = net.JoinHostPort(host, port)
+	return &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+		var d net.Dialer
+		switch scheme {
+		case "tcp":
+			return d.DialContext(ctx, "tcp", address)
+		case "tls":
+			// A stream, so the resolver frames its queries as for TCP.
+			return (&tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", address)
+		}
+		return d.DialContext(ctx, network, address)
+	}}, nil
+}
+
+// dohDialer returns a resolver Dial function whose connections carry each
+// query to endpoint as an RFC 8484 POST.
+func dohDialer(endpoint string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	client := &http.Client{}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, client: client, endpoint: endpoint}, nil
+	}
+}
+
+// dohConn looks to the resolver like a DNS over TCP connection: it writes a
+// query with a two-byte length in front, and reads the answer the same way.
+// The exchange itself happens over HTTPS once the whole query is written.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+	deadline time.Time
+
+	query  bytes.Buffer
+	answer bytes.Reader
+}
+
+func (c *dohConn) Write(p []byte) (int, error) {
+	c.query.Write(p)
+	b := c.query.Bytes()
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return len(p), nil
+	}
+	msg := b[2 : 2+int(binary.BigEndian.Uint16(b))]
+	answer, err := c.exchange(msg)
+	c.query.Reset()
+	if err != nil {
+		return 0, err
+	}
+	c.answer.Reset(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+	return len(p), nil
+}
+
+func (c *dohConn) exchange(msg []byte) ([]byte, error) {
+	deadline := c.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(dohTimeout)
+	}
+	ctx, cancel := context.WithDeadline(c.ctx, deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS over HTTPS: %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, 0xFFFF+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(answer) > 0xFFFF {
+		return nil, fmt.Errorf("DNS over HTTPS: answer too long")
+	}
+	return answer, nil
+}
+
+func (c *dohConn) Read(p []byte) (int, error)         { return c.answer.Read(p) }
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr{} }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "https" }
+func (dohAddr) String() string  { return "dns-over-https" }
+
+// resolver returns the resolver for target names: that of --dns-server, or
+// the system's.
+func (s *Supervisor) resolver() *net.Resolver {
+	if r := s.link().resolver; r != nil {
+		return r
+	}
+	return net.DefaultResolver
+}
@@ -0,0 +1,101 @@
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// dnsAnswer answers an A query with ip and any other query with no
+// records.
+func dnsAnswer(query []byte, ip netip.Addr) []byte {
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // root label, type and class
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+	answer := append([]byte(nil), query[:2]...)
+	answer = append(answer, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0)
+	answer = append(answer, query[12:end]...)
+	if qtype == 1 {
+		answer[7] = 1
+		answer = append(answer, 0xC0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		answer = append(answer, ip.AsSlice()...)
+	}
+	return answer
+}
+
+func TestNewResolver(t *testing.T) {
+	if r, err := NewResolver(""); r != nil || err != nil {
+		t.Fatalf("no server: %v, %v", r, err)
+	}
+	for _, server := range []string{"1.1.1.1", "[2606:4700::1111]:53", "tcp://10.0.0.2", "tls://dns.example:8853", "https://dns.example/dns-query"} {
+		if _, err := NewResolver(server); err != nil {
+			t.Errorf("NewResolver(%q): %v", server, err)
+		}
+	}
+	for _, server := range []string{"quic://dns.example", "tls://", "udp://1.1.1.1/path"} {
+		if _, err := NewResolver(server); err == nil {
+			t.Errorf("NewResolver accepted %q", server)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--dns-server", "quic://dns.example"}); err == nil {
+		t.Fatal("expected an unsupported --dns-server to fail")
+	}
+}
+
+func TestResolverServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(dnsAnswer(buf[:n], netip.MustParseAddr("192.0.2.7")), addr)
+		}
+	}()
+
+	resolver, err := NewResolver(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSupervisor(Options{})
+	s.current.Load().resolver = resolver
+	targets, err := s.resolveTarget(context.Background(), &Request{AddrType: AddrDomain, Address: "db.test", Port: 5432})
+	if err != nil || len(targets) != 1 || targets[0] != netip.MustParseAddrPort("192.0.2.7:5432") {
+		t.Fatalf("resolveTarget: %v, %v", targets, err)
+	}
+}
+
+func TestResolverDoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(dnsAnswer(query, netip.MustParseAddr("198.51.100.9")))
+	}))
+	defer srv.Close()
+
+	resolver := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return &dohConn{ctx: ctx, client: srv.Client(), endpoint: srv.URL}, nil
+	}}
+	addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "api.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != netip.MustParseAddr("198.51.100.9") {
+		t.Fatalf("LookupNetIP: %v, %v", addrs, err)
+	}
+}
@@ -0,0 +1,106 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			io.Copy(c, c)
+			c.Close()
+		}
+	}()
+	hubLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hubLn.Close()
+
+	s := NewSupervisor(Options{
+		Mode: ModeSocks, Protocol: 1, Workers: 2, RetryDelay: time.Second,
+		HubHost: "127.0.0.1", HubPort: hubLn.Addr().(*net.TCPAddr).Port,
+	})
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := make(chan error, 1)
+	go func() { run <- s.Run(ctx) }()
+
+	var conns [2]net.Conn
+	var readers [2]*bufio.Reader
+	for i := range conns {
+		c, err := hubLn.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		conns[i], readers[i] = c, bufio.NewReader(c)
+		readers[i].ReadString('\n')
+		c.Write([]byte("OK\n"))
+	}
+	busy := conns[0]
+	fmt.Fprintf(busy, "REQUEST CONNECT ipv4 127.0.0.1 %d\n", target.Addr().(*net.TCPAddr).Port)
+	if line, _ := readers[0].ReadString('\n'); !strings.HasPrefix(line, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.sessionsMu.Lock()
+		n := len(s.sessions)
+		s.sessionsMu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+	}
+
+	s.Drain()
+	if line, _ := readers[1].ReadString('\n'); line != "GOODBYE\n" {
+		t.Fatalf("idle connection got %q, want GOODBYE", line)
+	}
+	if _, err := readers[1].ReadByte(); err != io.EOF {
+		t.Fatalf("idle connection not closed after GOODBYE: %v", err)
+	}
+
+	// The active session keeps running until it ends on its own.
+	busy.Write([]byte("still here"))
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(readers[0], buf); err != nil || string(buf) != "still here" {
+		t.Fatalf("bridge after Drain: %q, %v", buf, err)
+	}
+	busy.(*net.TCPConn).CloseWrite()
+	select {
+	case err := <-run:
+		if err != nil {
+			t.Fatalf("Run = %v, want nil after draining", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return once the last session ended")
+	}
+}
+
+func TestParseArgsDrainTimeout(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks"})
+	if err != nil || opts.DrainTimeout != 30*time.Second {
+		t.Fatalf("default: %+v, %v", opts, err)
+	}
+	if opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--drain-timeout", "0"}); err != nil || opts.DrainTimeout != 0 {
+		t.Fatalf("--drain-timeout 0: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--drain-timeout", "-1s"}); err == nil {
+		t.Fatalf("accepted a negative --drain-timeout")
+	}
+}
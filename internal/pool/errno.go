@@ -0,0 +1,94 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// errDeadlineExpired fails a CONNECT whose deadline= ran out while it
+// waited for a --max-sessions slot or dialed. It is answered with status 6
+// (TTL expired).
+var errDeadlineExpired = errors.New("hub deadline expired")
+
+// errnoInfo is what the pool makes of an errno, whatever the platform
+// calls it: the English text logs show for it and the REPLY status.
+type errnoInfo struct {
+	text   string
+	status int
+}
+
+// knownErrno returns the errno behind err, if the pool knows it.
+func knownErrno(err error) (syscall.Errno, errnoInfo, bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return 0, errnoInfo{}, false
+	}
+	info, ok := knownErrnos[errno]
+	return errno, info, ok
+}
+
+// mapErrorToStatus picks the REPLY status for a failed dial from the errno
+// or type of err, never from its text, which Windows translates into the
+// system language.
+func mapErrorToStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var upstream *upstreamError
+	if _, info, ok := knownErrno(err); ok {
+		return info.status
+	}
+	switch {
+	case errors.As(err, &upstream):
+		return upstream.status
+	case errors.Is(err, errPrivateTarget):
+		return 2
+	case errors.Is(err, errDeadlineExpired):
+		return 6
+	case errors.As(err, &dnsErr):
+		return 4
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return 4
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return 4
+	default:
+		return 1
+	}
+}
+
+// normalizedError is an error whose errno text is the pool's own.
+type normalizedError struct {
+	err  error
+	text string
+}
+
+func (e *normalizedError) Error() string { return e.text }
+func (e *normalizedError) Unwrap() error { return e.err }
+
+// normalizeError returns err with the system's text for a known errno
+// replaced by the same English text on every platform and locale, so logs
+// from a mixed fleet can be grepped alike. Other errors are returned as
+// they are.
+func normalizeError(err error) error {
+	errno, info, ok := knownErrno(err)
+	if !ok {
+		return err
+	}
+	text := err.Error()
+	if system := errno.Error(); system != info.text {
+		text = strings.Replace(text, system, info.text, 1)
+	}
+	return &normalizedError{err: err, text: text}
+}
+
+// lookupError reports that host could not be resolved, as a *net.DNSError
+// so it maps to "host unreachable" like a failed DNS lookup.
+func lookupError(host string, err error) error {
+	return &net.DNSError{Err: err.Error(), Name: host, UnwrapErr: err}
+}
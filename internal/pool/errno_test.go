@@ -0,0 +1,54 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestMapErrorToStatus(t *testing.T) {
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{dialErr(syscall.ECONNREFUSED), 5},
+		{dialErr(syscall.ENETUNREACH), 3},
+		{dialErr(syscall.EHOSTUNREACH), 4},
+		{fmt.Errorf("%w: 10.0.0.1", errPrivateTarget), 2},
+		{&net.DNSError{Err: "no such host", Name: "db.example", IsNotFound: true}, 4},
+		{lookupError("container:web", errors.New("no such container")), 4},
+		{context.DeadlineExceeded, 4},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, 4},
+		// Text alone no longer decides the status.
+		{errors.New("connection refused"), 1},
+	} {
+		if got := mapErrorToStatus(c.err); got != c.want {
+			t.Errorf("mapErrorToStatus(%v) = %d, want %d", c.err, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeError(t *testing.T) {
+	defer func(saved errnoInfo) { knownErrnos[syscall.ECONNREFUSED] = saved }(knownErrnos[syscall.ECONNREFUSED])
+	knownErrnos[syscall.ECONNREFUSED] = errnoInfo{"refused by target", 5}
+
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	got := normalizeError(fmt.Errorf("failed to reach db: %w", err))
+	if got.Error() != "failed to reach db: dial tcp: connect: refused by target" || !errors.Is(got, syscall.ECONNREFUSED) {
+		t.Fatalf("normalizeError = %q", got)
+	}
+	if other := errors.New("handshake failed"); normalizeError(other) != other {
+		t.Fatal("normalizeError changed an error without an errno")
+	}
+	if text := lookupError("k8s:web/api", errors.New("no such service")).Error(); text != "lookup k8s:web/api: no such service" {
+		t.Fatalf("lookupError = %q", text)
+	}
+}
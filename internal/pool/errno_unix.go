@@ -0,0 +1,17 @@
+//go:build !windows
+
+package pool
+
+import "syscall"
+
+var knownErrnos = map[syscall.Errno]errnoInfo{
+	syscall.ECONNREFUSED: {"connection refused", 5},
+	syscall.ENETUNREACH:  {"network is unreachable", 3},
+	syscall.ENETDOWN:     {"network is down", 3},
+	syscall.EHOSTUNREACH: {"no route to host", 4},
+	syscall.EHOSTDOWN:    {"host is down", 4},
+	syscall.ETIMEDOUT:    {"connection timed out", 4},
+	syscall.ECONNRESET:   {"connection reset by peer", 1},
+	syscall.ECONNABORTED: {"software caused connection abort", 1},
+	syscall.EPIPE:        {"broken pipe", 1},
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package pool
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// knownErrnos holds the Winsock codes, whose text Windows gives in the
+// system language.
+var knownErrnos = map[syscall.Errno]errnoInfo{
+	windows.WSAECONNREFUSED:   {"connection refused", 5},
+	windows.WSAENETUNREACH:    {"network is unreachable", 3},
+	windows.WSAENETDOWN:       {"network is down", 3},
+	windows.WSAEHOSTUNREACH:   {"no route to host", 4},
+	windows.WSAEHOSTDOWN:      {"host is down", 4},
+	windows.WSAETIMEDOUT:      {"connection timed out", 4},
+	windows.WSAECONNRESET:     {"connection reset by peer", 1},
+	windows.WSAECONNABORTED:   {"software caused connection abort", 1},
+	windows.ERROR_BROKEN_PIPE: {"broken pipe", 1},
+}
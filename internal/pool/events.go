@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Events are the callbacks a program embedding the pool receives as
+// sessions start and end; see contun/pkg/pool. Any of them may be nil. They
+// are delivered through an Interceptor, so they run on the worker's
+// goroutine, holding up its session, and should return quickly.
+type Events struct {
+	// SessionStart is called once the target is dialled, just before the
+	// REPLY that starts the bridge.
+	SessionStart func(SessionInfo)
+	// SessionEnd is called when a bridge ends, with its byte counts,
+	// duration and teardown reason.
+	SessionEnd func(SessionInfo)
+	// SessionFailed is called when a target could not be reached, with the
+	// REPLY status the hub was sent.
+	SessionFailed func(SessionInfo)
+}
+
+// SessionInfo describes a session to an Events callback or an
+// Interceptor. The fields that do not apply yet are left zero.
+type SessionInfo struct {
+	ID       string // the hub's session ID, if it sent one
+	Command  string // CommandConnect
+	Host     string // the destination as dialled, after any rewrite
+	Port     int
+	Alias    string    // the --alias name of the destination, if any
+	Started  time.Time // when the REQUEST was read
+	Duration time.Duration
+	BytesOut int64  // copied from the hub to the target
+	BytesIn  int64  // copied from the target to the hub
+	Reason   string // why the bridge ended: client-closed, target-closed, idle-timeout, quota, admin-kill or error
+	Status   int    // the REPLY status of a target that could not be reached
+	Err      error
+}
+
+// SetEvents makes s call events. Call it before Run.
+func (s *Supervisor) SetEvents(events Events) {
+	s.AddInterceptor(eventsInterceptor{events: events})
+}
+
+// SetLogger makes s and its workers log through logger rather than the
+// standard logger. Call it before Run.
+func (s *Supervisor) SetLogger(logger *log.Logger) {
+	s.logger = logger
+}
+
+// eventsInterceptor delivers Events.
+type eventsInterceptor struct {
+	NopInterceptor
+	events Events
+}
+
+func (e eventsInterceptor) OnDialResult(_ context.Context, _ Request, info SessionInfo) {
+	switch {
+	case info.Err == nil && e.events.SessionStart != nil:
+		e.events.SessionStart(info)
+	case info.Err != nil && e.events.SessionFailed != nil:
+		e.events.SessionFailed(info)
+	}
+}
+
+func (e eventsInterceptor) OnBridgeClose(_ context.Context, _ Request, info SessionInfo) {
+	if e.events.SessionEnd != nil {
+		e.events.SessionEnd(info)
+	}
+}
+
+// sessionInfo describes req to an Events callback or an Interceptor.
+func (s *Supervisor) sessionInfo(req *Request, started time.Time) SessionInfo {
+	return SessionInfo{
+		ID: req.SessionID, Command: req.Command, Host: req.Address, Port: req.Port,
+		Alias: s.link().opts.aliasFor(req.Address, req.Port), Started: started,
+	}
+}
@@ -0,0 +1,56 @@
+package pool
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Expose is an --expose service: a destination behind the bastion that a
+// hub started with a matching --expose publishes on a port of its own, as
+// ssh -R does. Workers announce it with an EXPOSE line after the
+// handshake, to hubs that accepted the expose capability.
+type Expose struct {
+	Name string
+	Dest *Destination
+}
+
+func (e Expose) String() string {
+	return e.Name + "=" + net.JoinHostPort(e.Dest.Host, strconv.Itoa(e.Dest.Port))
+}
+
+// line is the control line announcing e.
+func (e Expose) line() string {
+	return fmt.Sprintf("EXPOSE %s %s %s %d", e.Name, e.Dest.AddrType, e.Dest.Host, e.Dest.Port)
+}
+
+// ParseExpose parses an --expose value: "<name>=<host>:<port>", with an
+// IPv6 host in brackets.
+func ParseExpose(text string) (Expose, error) {
+	name, dest, ok := strings.Cut(text, "=")
+	name, dest = strings.TrimSpace(name), strings.TrimSpace(dest)
+	if !ok || !validLabelKey(name) {
+		return Expose{}, fmt.Errorf("expected <name>=<host>:<port> with a name of letters, digits, '_', '-' or '.'")
+	}
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil || host == "" {
+		return Expose{}, fmt.Errorf("expected <name>=<host>:<port>")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return Expose{}, fmt.Errorf("port must be between 1 and 65535")
+	}
+	return Expose{Name: name, Dest: &Destination{AddrType: classifyAddr(host), Host: host, Port: port}}, nil
+}
+
+// exposes reports whether req asks for a destination --expose offers.
+// Direct-mode workers serve those as well as their target.
+func (o *Options) exposes(req *Request) bool {
+	for _, e := range o.Exposes {
+		if req.AddrType == e.Dest.AddrType && strings.EqualFold(req.Address, e.Dest.Host) && req.Port == e.Dest.Port {
+			return true
+		}
+	}
+	return false
+}
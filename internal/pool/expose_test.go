@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgsExpose(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--expose", "wiki=wiki.internal:8080", "--expose", "v6=[2001:db8::1]:22"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if len(opts.Exposes) != 2 || opts.Exposes[0].String() != "wiki=wiki.internal:8080" || opts.Exposes[1].line() != "EXPOSE v6 ipv6 2001:db8::1 22" {
+		t.Fatalf("exposes %v", opts.Exposes)
+	}
+	for _, bad := range []string{"wiki.internal:8080", "=wiki.internal:8080", "a b=wiki.internal:8080", "wiki=wiki.internal", "wiki=wiki.internal:0", "wiki=:80"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--expose", bad}); err == nil {
+			t.Errorf("--expose %q accepted", bad)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--expose", "a=10.0.0.1:22", "--expose", "a=10.0.0.2:22"}); err == nil {
+		t.Error("one name for two services accepted")
+	}
+
+	req := &Request{Command: CommandConnect, AddrType: AddrDomain, Address: "WIKI.internal", Port: 8080}
+	if !opts.exposes(req) {
+		t.Error("exposed destination not recognised")
+	}
+	req.Port = 80
+	if opts.exposes(req) {
+		t.Error("other port recognised as exposed")
+	}
+}
+
+func TestExposeAnnounced(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, Exposes: []Expose{{Name: "wiki", Dest: &Destination{AddrType: AddrDomain, Host: "wiki.internal", Port: 8080}}}})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, "expose") {
+		t.Fatalf("HELLO does not offer expose: %q", line)
+	}
+	hub.Write([]byte("OK CAPS expose\n"))
+	if line, _ := reader.ReadString('\n'); line != "EXPOSE wiki domain wiki.internal 8080\n" {
+		t.Fatalf("announcement %q", line)
+	}
+	hub.Close()
+	<-done
+}
@@ -0,0 +1,466 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Protocol version 2 keeps the text HELLO, CHALLENGE/AUTH and OK lines so
+// a version 1 hub can refuse it, and frames everything after the hub's OK
+// (and after the Noise handshake, when one is negotiated). Each frame is a
+// type byte, a 2-byte big-endian payload length and the payload.
+const (
+	frameControl byte = 1 // one control message, without the newline
+	frameData    byte = 2 // stream bytes, or datagram frames for ASSOCIATE
+	frameEnd     byte = 3 // the sender has finished its side of the stream
+)
+
+const (
+	frameHeader     = 3
+	maxFramePayload = 0xFFFF
+)
+
+// FlowWindow is how many stream bytes each side of a connection that
+// negotiated the window capability may send before the peer grants more
+// with "WINDOW <n>", unless the peer announced another window with
+// "WINDOW SIZE <n>". Every stream starts with a full window each way.
+const FlowWindow = 1 << 20
+
+// Bounds of --flow-window and --max-frame-size.
+const (
+	minFlowWindow   = 4 << 10
+	maxFlowWindow   = 1 << 30
+	minMaxFrameSize = 512
+)
+
+// ParseFlowWindow parses a --flow-window value, such as "256K".
+func ParseFlowWindow(text string) (int, error) {
+	size, err := parseByteSize(text)
+	if err != nil {
+		return 0, err
+	}
+	if size < minFlowWindow || size > maxFlowWindow {
+		return 0, fmt.Errorf("window must be between 4K and 1G")
+	}
+	return int(size), nil
+}
+
+// ParseMaxFrameSize parses a --max-frame-size value, the most stream bytes
+// sent in one data frame.
+func ParseMaxFrameSize(text string) (int, error) {
+	size, err := parseByteSize(text)
+	if err != nil {
+		return 0, err
+	}
+	if size < minMaxFrameSize || size > maxFramePayload {
+		return 0, fmt.Errorf("frame size must be between %d and %d", minMaxFrameSize, maxFramePayload)
+	}
+	return int(size), nil
+}
+
+// errDataOutsideStream reports stream bytes where a control message was
+// expected. It takes the place of version 1's "unexpected buffered data"
+// failures, but can only be caused by a misbehaving peer.
+var errDataOutsideStream = errors.New("data frame outside a stream")
+
+// FrameConn carries protocol version 2 over a hub connection. Read and
+// Write move stream bytes as data frames and CloseWrite sends an end frame,
+// so a FrameConn can stand in for the raw connection while bridging;
+// control messages use ReadControl and WriteControl and may be interleaved
+// with stream data.
+type FrameConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// OnControl, when set, receives control messages that arrive while
+	// Read is waiting for stream data. Otherwise they are dropped.
+	OnControl func(line string)
+
+	wmu      sync.Mutex
+	wbuf     []byte
+	written  bool // CloseWrite sent an end frame
+	maxFrame int  // most stream bytes per data frame
+
+	rbuf  []byte
+	data  []byte // unread payload of the current data frame
+	ended bool   // the peer sent an end frame
+
+	// Flow control, once SetWindow turns it on. Read and a Write waiting
+	// for credit both read frames, whichever gets there first, so window
+	// updates arrive even while stream data is not being consumed.
+	window   int // bytes the peer may send; 0 without flow control
+	peer     int // bytes we may send, the peer's window
+	fmu      sync.Mutex
+	fcond    *sync.Cond
+	reading  bool   // a frame is being read with fmu released
+	queued   []byte // stream bytes read but not yet returned by Read
+	credit   int    // bytes Write may still send
+	consumed int    // bytes returned by Read since the last update
+	rerr     error  // the error that ended reading
+}
+
+// NewFrameConn wraps conn. r holds anything already read from conn past the
+// handshake; nil reads conn directly.
+func NewFrameConn(conn net.Conn, r io.Reader) *FrameConn {
+	if r == nil {
+		r = conn
+	}
+	return &FrameConn{
+		Conn:     conn,
+		r:        bufio.NewReaderSize(r, frameHeader+maxFramePayload),
+		rbuf:     make([]byte, maxFramePayload),
+		maxFrame: maxFramePayload,
+	}
+}
+
+// SetWindow turns on flow control for a connection that negotiated the
+// window capability, letting the peer have window unread bytes in flight.
+// A window other than FlowWindow is announced to the peer. Call it before
+// the first stream.
+func (f *FrameConn) SetWindow(window int) {
+	f.window, f.peer, f.credit = window, FlowWindow, FlowWindow
+	f.fcond = sync.NewCond(&f.fmu)
+	if window != FlowWindow {
+		// A failed announcement shows up as a failed read or write soon
+		// enough.
+		_ = f.WriteControl("WINDOW SIZE " + strconv.Itoa(window))
+	}
+}
+
+// SetMaxFrameSize limits the stream bytes Write puts in one data frame, so
+// control messages wait behind less data. Frames of any size are read.
+func (f *FrameConn) SetMaxFrameSize(size int) {
+	f.maxFrame = size
+}
+
+// windowUpdate parses a "WINDOW <n>" control message.
+func windowUpdate(line string) (int, bool) {
+	n, ok := strings.CutPrefix(line, "WINDOW ")
+	if !ok {
+		return 0, false
+	}
+	grant, err := strconv.Atoi(n)
+	if err != nil || grant <= 0 {
+		return 0, false
+	}
+	return grant, true
+}
+
+// windowSize parses a "WINDOW SIZE <n>" control message.
+func windowSize(line string) (int, bool) {
+	n, ok := strings.CutPrefix(line, "WINDOW SIZE ")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.Atoi(n)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// resizeLocked adopts the window the peer announced, for this stream and
+// the ones after it. fmu must be held.
+func (f *FrameConn) resizeLocked(size int) {
+	f.credit += size - f.peer
+	f.peer = size
+}
+
+// flowControl handles the flow control messages that may arrive between
+// streams: window announcements, and late updates for a stream that has
+// ended, which are dropped. It reports whether line was one of them.
+func (f *FrameConn) flowControl(line string) bool {
+	if f.window == 0 {
+		return false
+	}
+	if size, ok := windowSize(line); ok {
+		f.fmu.Lock()
+		f.resizeLocked(size)
+		f.fmu.Unlock()
+		return true
+	}
+	_, ok := windowUpdate(line)
+	return ok
+}
+
+// next reads one frame. The payload is only valid until the next call.
+func (f *FrameConn) next() (byte, []byte, error) {
+	var head [frameHeader]byte
+	if _, err := io.ReadFull(f.r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := f.rbuf[:binary.BigEndian.Uint16(head[1:])]
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return head[0], payload, nil
+}
+
+// ReadControl returns the next control message.
+func (f *FrameConn) ReadControl() (string, error) {
+	for {
+		kind, payload, err := f.next()
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case frameControl:
+			if f.flowControl(string(payload)) {
+				continue
+			}
+			return string(payload), nil
+		case frameData, frameEnd:
+			return "", errDataOutsideStream
+		}
+		// Unknown frame types are reserved for extensions and skipped.
+	}
+}
+
+// takeControl consumes one complete frame that is already buffered and
+// returns it if it is a control message. Partial frames are left in place,
+// so a read deadline can interrupt a caller at any point without losing
+// data.
+func (f *FrameConn) takeControl() (string, bool) {
+	head, err := f.r.Peek(frameHeader)
+	if err != nil || f.r.Buffered() < frameHeader+int(binary.BigEndian.Uint16(head[1:])) {
+		return "", false
+	}
+	kind, payload, err := f.next()
+	if err != nil || kind != frameControl {
+		return "", err == nil
+	}
+	if f.flowControl(string(payload)) {
+		return "", true
+	}
+	return string(payload), true
+}
+
+// fill waits for at least one more byte from the peer.
+func (f *FrameConn) fill() error {
+	_, err := f.r.Peek(f.r.Buffered() + 1)
+	return err
+}
+
+// Read returns stream bytes until the peer sends an end frame, after which
+// it returns io.EOF.
+func (f *FrameConn) Read(p []byte) (int, error) {
+	if f.window > 0 {
+		return f.readWindowed(p)
+	}
+	for len(f.data) == 0 {
+		if f.ended {
+			return 0, io.EOF
+		}
+		kind, payload, err := f.next()
+		if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case frameData:
+			f.data = payload
+		case frameEnd:
+			f.ended = true
+		case frameControl:
+			if f.OnControl != nil {
+				f.OnControl(string(payload))
+			}
+		}
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+// readWindowed is Read with flow control: once half a window has been
+// consumed, the peer is granted that much again.
+func (f *FrameConn) readWindowed(p []byte) (int, error) {
+	f.fmu.Lock()
+	for len(f.queued) == 0 {
+		switch {
+		case f.ended:
+			f.fmu.Unlock()
+			return 0, io.EOF
+		case f.rerr != nil:
+			f.fmu.Unlock()
+			return 0, f.rerr
+		case f.reading:
+			f.fcond.Wait()
+		default:
+			f.pumpLocked()
+		}
+	}
+	n := copy(p, f.queued)
+	f.queued = f.queued[n:]
+	f.consumed += n
+	grant := 0
+	if f.consumed >= f.window/2 && !f.ended {
+		grant, f.consumed = f.consumed, 0
+	}
+	f.fmu.Unlock()
+	if grant > 0 {
+		// A failed update shows up as a failed read or write soon enough.
+		_ = f.WriteControl("WINDOW " + strconv.Itoa(grant))
+	}
+	return n, nil
+}
+
+// pumpLocked reads one frame with fmu released and files it: stream bytes
+// are queued for Read, window updates add credit and other control
+// messages go to OnControl. fmu is held on entry and on return.
+func (f *FrameConn) pumpLocked() {
+	f.reading = true
+	f.fmu.Unlock()
+	kind, payload, err := f.next()
+	var line string
+	if err == nil && kind == frameControl {
+		line = string(payload)
+	}
+	f.fmu.Lock()
+	f.reading = false
+	defer f.fcond.Broadcast()
+	if err != nil {
+		f.rerr = err
+		return
+	}
+	switch kind {
+	case frameData:
+		if len(f.queued)+len(payload) > f.window {
+			f.rerr = errors.New("peer exceeded the flow control window")
+			return
+		}
+		f.queued = append(f.queued, payload...)
+	case frameEnd:
+		f.ended = true
+	case frameControl:
+		if grant, ok := windowUpdate(line); ok {
+			f.credit += grant
+		} else if size, ok := windowSize(line); ok {
+			f.resizeLocked(size)
+		} else if f.OnControl != nil {
+			f.fmu.Unlock()
+			f.OnControl(line)
+			f.fmu.Lock()
+		}
+	}
+}
+
+// takeCredit waits until Write may send up to want bytes and returns how
+// many it may send now.
+func (f *FrameConn) takeCredit(want int) (int, error) {
+	f.fmu.Lock()
+	defer f.fmu.Unlock()
+	for f.credit <= 0 {
+		switch {
+		case f.rerr != nil:
+			return 0, f.rerr
+		case f.reading:
+			f.fcond.Wait()
+		default:
+			f.pumpLocked()
+		}
+	}
+	n := min(want, f.credit)
+	f.credit -= n
+	return n, nil
+}
+
+// Write sends p as one or more data frames.
+func (f *FrameConn) Write(p []byte) (int, error) {
+	if f.window > 0 {
+		return f.writeWindowed(p)
+	}
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if f.written {
+		return 0, fmt.Errorf("write after end of stream")
+	}
+	sent := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), f.maxFrame)]
+		if err := f.writeFrameLocked(frameData, chunk); err != nil {
+			return sent, err
+		}
+		sent += len(chunk)
+		p = p[len(chunk):]
+	}
+	return sent, nil
+}
+
+// writeWindowed is Write with flow control. It holds wmu only while
+// sending, so Read can grant the peer credit meanwhile.
+func (f *FrameConn) writeWindowed(p []byte) (int, error) {
+	sent := 0
+	for len(p) > 0 {
+		n, err := f.takeCredit(min(len(p), f.maxFrame))
+		if err != nil {
+			return sent, err
+		}
+		f.wmu.Lock()
+		if f.written {
+			f.wmu.Unlock()
+			return sent, fmt.Errorf("write after end of stream")
+		}
+		err = f.writeFrameLocked(frameData, p[:n])
+		f.wmu.Unlock()
+		if err != nil {
+			return sent, err
+		}
+		sent += n
+		p = p[n:]
+	}
+	return sent, nil
+}
+
+// CloseWrite sends an end frame. The connection stays open for the peer's
+// data and for control messages.
+func (f *FrameConn) CloseWrite() error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	if f.written {
+		return nil
+	}
+	f.written = true
+	return f.writeFrameLocked(frameEnd, nil)
+}
+
+// WriteControl sends one control message.
+func (f *FrameConn) WriteControl(line string) error {
+	if len(line) > maxFramePayload {
+		return fmt.Errorf("control message of %d bytes too large", len(line))
+	}
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	return f.writeFrameLocked(frameControl, []byte(line))
+}
+
+// EndStream re-arms both directions for the next stream on the connection.
+func (f *FrameConn) EndStream() {
+	f.wmu.Lock()
+	f.written = false
+	f.wmu.Unlock()
+	f.data, f.ended = nil, false
+	if f.window > 0 {
+		f.fmu.Lock()
+		f.ended, f.queued = false, nil
+		f.credit, f.consumed = f.peer, 0
+		f.fmu.Unlock()
+	}
+}
+
+func (f *FrameConn) writeFrameLocked(kind byte, payload []byte) error {
+	f.wbuf = append(f.wbuf[:0], kind, 0, 0)
+	binary.BigEndian.PutUint16(f.wbuf[1:], uint16(len(payload)))
+	f.wbuf = append(f.wbuf, payload...)
+	_, err := f.Conn.Write(f.wbuf)
+	return err
+}
@@ -0,0 +1,239 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameConn(t *testing.T) {
+	a, b := tcpPair(t)
+	left, right := NewFrameConn(a, nil), NewFrameConn(b, nil)
+	var notices []string
+	right.OnControl = func(line string) { notices = append(notices, line) }
+
+	big := bytes.Repeat([]byte("0123456789"), 10000)
+	go func() {
+		left.WriteControl("REPLY 0 ipv4 0.0.0.0 0\nwith a newline")
+		left.Write(big[:40000])
+		left.WriteControl("NOTICE mid-stream")
+		left.Write(big[40000:])
+		left.CloseWrite()
+		left.WriteControl("NOTICE after")
+	}()
+
+	if line, err := right.ReadControl(); err != nil || line != "REPLY 0 ipv4 0.0.0.0 0\nwith a newline" {
+		t.Fatalf("ReadControl = %q, %v", line, err)
+	}
+	got, err := io.ReadAll(right)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("read %d bytes (%v), want %d", len(got), err, len(big))
+	}
+	if len(notices) != 1 || notices[0] != "NOTICE mid-stream" {
+		t.Fatalf("control messages during the stream: %q", notices)
+	}
+	if line, err := right.ReadControl(); err != nil || line != "NOTICE after" {
+		t.Fatalf("ReadControl after the stream = %q, %v", line, err)
+	}
+
+	left.EndStream()
+	go left.Write([]byte("stray"))
+	if _, err := right.ReadControl(); !errors.Is(err, errDataOutsideStream) {
+		t.Fatalf("data outside a stream: got %v", err)
+	}
+}
+
+func TestFrameConnWindow(t *testing.T) {
+	a, b := tcpPair(t)
+	left, right := NewFrameConn(a, nil), NewFrameConn(b, nil)
+	left.SetWindow(8)
+	right.SetWindow(8)
+	notices := make(chan string, 1)
+	right.OnControl = func(line string) { notices <- line }
+	// left learns right's window before the stream, as a hub does before
+	// the worker's REPLY.
+	right.WriteControl("REPLY 0 ipv4 0.0.0.0 0")
+	if line, err := left.ReadControl(); err != nil || line != "REPLY 0 ipv4 0.0.0.0 0" {
+		t.Fatalf("ReadControl = %q, %v", line, err)
+	}
+
+	wrote := make(chan int, 1)
+	go func() {
+		n, _ := left.Write([]byte("0123456789abcdefghij"))
+		wrote <- n
+		left.CloseWrite()
+	}()
+	// right reads nothing yet, so left stops at the window.
+	select {
+	case n := <-wrote:
+		t.Fatalf("Write returned %d before the reader granted more", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// Control messages still get through while the stream is blocked.
+	left.WriteControl("NOTICE blocked")
+	buf := make([]byte, 4)
+	if n, err := io.ReadFull(right, buf); err != nil || string(buf[:n]) != "0123" {
+		t.Fatalf("first read %q, %v", buf[:n], err)
+	}
+	rest, err := io.ReadAll(right)
+	if err != nil || string(rest) != "456789abcdefghij" {
+		t.Fatalf("rest %q, %v", rest, err)
+	}
+	if n := <-wrote; n != 20 {
+		t.Fatalf("Write sent %d bytes, want 20", n)
+	}
+	if line := <-notices; line != "NOTICE blocked" {
+		t.Fatalf("control message %q", line)
+	}
+
+	// The next stream starts with a full window again, and late updates
+	// from the last one are not mistaken for replies.
+	left.EndStream()
+	right.EndStream()
+	right.WriteControl("REPLY 0 ipv4 0.0.0.0 0")
+	if line, err := left.ReadControl(); err != nil || line != "REPLY 0 ipv4 0.0.0.0 0" {
+		t.Fatalf("ReadControl = %q, %v", line, err)
+	}
+}
+
+func TestFrameConnTakeControlKeepsPartialFrame(t *testing.T) {
+	worker, hub := net.Pipe()
+	defer worker.Close()
+	defer hub.Close()
+	frames := NewFrameConn(worker, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch := watchCancel(worker, frames, "7", cancel)
+	hub.Write([]byte{frameControl, 0, 8, 'C', 'A'})
+	if err := watch.stop(); err != nil || ctx.Err() != nil {
+		t.Fatalf("stop: err=%v ctx=%v", err, ctx.Err())
+	}
+
+	go hub.Write([]byte("NCEL 7"))
+	if line, err := frames.ReadControl(); err != nil || line != "CANCEL 7" {
+		t.Fatalf("got %q, %v after stopping the watch", line, err)
+	}
+}
+
+func TestHubSessionProtocol2(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			c.Write([]byte("hello"))
+			io.Copy(io.Discard, c)
+			c.Close()
+		}
+	}()
+
+	s := NewSupervisor(Options{Mode: ModeSocks})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "HELLO 2 socks ") {
+		t.Fatalf("unexpected HELLO %q", line)
+	}
+	// The REQUEST follows the OK line immediately; framing keeps it apart.
+	hub.Write([]byte("OK CAPS cancel\n"))
+	frames := NewFrameConn(hub, reader)
+	port := target.Addr().(*net.TCPAddr).Port
+	frames.WriteControl("REQUEST CONNECT ipv4 127.0.0.1 " + strconv.Itoa(port) + " 1")
+	frames.Write([]byte("early client bytes"))
+	if reply, err := frames.ReadControl(); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q: %v", reply, err)
+	}
+	frames.CloseWrite()
+	if got, err := io.ReadAll(frames); err != nil || string(got) != "hello" {
+		t.Fatalf("stream = %q, %v", got, err)
+	}
+	hub.Close()
+	<-done
+}
+
+func TestProtocolFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		protocol int
+		want     int32
+	}{
+		{name: "auto", want: 1},
+		{name: "pinned", protocol: 2, want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSupervisor(Options{Mode: ModeSocks, Protocol: tc.protocol})
+			worker, hub := tcpPair(t)
+			go func() {
+				bufio.NewReader(hub).ReadString('\n')
+				hub.Close()
+			}()
+			err := s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+			if fellBack := errors.Is(err, errLegacyHub); fellBack != (tc.want == 1) {
+				t.Fatalf("handleHubSession = %v", err)
+			}
+			if got := s.protocol.Load(); got != tc.want {
+				t.Fatalf("protocol after a hang-up = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFrameConnWindowSize(t *testing.T) {
+	a, b := tcpPair(t)
+	left, right := NewFrameConn(a, nil), NewFrameConn(b, nil)
+	left.SetWindow(FlowWindow)
+	right.SetWindow(minFlowWindow) // announced to left
+
+	right.WriteControl("REPLY 0 ipv4 0.0.0.0 0")
+	if line, err := left.ReadControl(); err != nil || line != "REPLY 0 ipv4 0.0.0.0 0" {
+		t.Fatalf("ReadControl = %q, %v", line, err)
+	}
+	// right reads nothing yet, so left stops at right's smaller window.
+	wrote := make(chan int, 1)
+	go func() {
+		n, _ := left.Write(make([]byte, 2*minFlowWindow))
+		wrote <- n
+		left.CloseWrite()
+	}()
+	select {
+	case n := <-wrote:
+		t.Fatalf("Write returned %d past the announced window", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if data, err := io.ReadAll(right); err != nil || len(data) != 2*minFlowWindow {
+		t.Fatalf("read %d bytes (%v)", len(data), err)
+	}
+	if n := <-wrote; n != 2*minFlowWindow {
+		t.Fatalf("Write sent %d bytes, want %d", n, 2*minFlowWindow)
+	}
+}
+
+func TestFrameConnMaxFrameSize(t *testing.T) {
+	a, b := tcpPair(t)
+	left, right := NewFrameConn(a, nil), NewFrameConn(b, nil)
+	left.SetMaxFrameSize(minMaxFrameSize)
+
+	go left.Write(make([]byte, 3*minMaxFrameSize))
+	buf := make([]byte, 3*minMaxFrameSize)
+	for i := 0; i < 3; i++ {
+		if n, err := right.Read(buf); err != nil || n != minMaxFrameSize {
+			t.Fatalf("frame %d carried %d bytes (%v), want %d", i, n, err, minMaxFrameSize)
+		}
+	}
+}
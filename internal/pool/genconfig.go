@@ -0,0 +1,246 @@
+package pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"contun/internal/config"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var genconfigUsageText = `Usage: poolgo genconfig --inventory <file> --template <file> [options]
+
+Renders one --config file per bastion from an inventory and a Go text/template.
+
+Options:
+      --inventory <file>     YAML or TOML inventory of bastions and their variables.
+      --template <file>      Template for one bastion's config; its extension (.yaml, .yml
+                             or .toml) is the output format.
+  -o, --out <dir>            Directory for the rendered <bastion><ext> files (default .).
+  -n, --dry-run              Check and print the rendered configs without writing them.
+  -h, --help                 Show this help message and exit.
+
+The inventory has optional shared "vars" and a "bastions" table of names to
+variables, which override the shared ones:
+
+  vars:
+    hub: jump.example.net
+  bastions:
+    dc1-web: {site: dc1}
+    dc2-db:  {site: dc2, hub: jump2.example.net}
+
+The template sees the merged variables and "name", the bastion's name, and
+can use quote to render a value as a quoted string:
+
+  hub-host: {{ quote .hub }}
+  label: ["site={{ .site }}"]
+  auth-token-file: /etc/contun/{{ .name }}.token
+
+Every rendered file is checked like --config before anything is written.`
+
+// GenconfigUsage returns the help text for the genconfig subcommand.
+func GenconfigUsage() string {
+	return genconfigUsageText
+}
+
+// GenconfigOptions captures parsed genconfig subcommand configuration.
+type GenconfigOptions struct {
+	Inventory string
+	Template  string
+	OutDir    string
+	DryRun    bool
+}
+
+// ParseGenconfigArgs parses the arguments following "poolgo genconfig".
+func ParseGenconfigArgs(args []string) (*GenconfigOptions, error) {
+	fs := flag.NewFlagSet("poolgo genconfig", flag.ContinueOnError)
+	fs.SetOutput(flagDiscard{})
+
+	var (
+		inventory   = fs.String("inventory", "", "")
+		tmpl        = fs.String("template", "", "")
+		outDir      = fs.String("out", ".", "")
+		outDirAlt   = fs.String("o", "", "")
+		dryRun      = fs.Bool("dry-run", false, "")
+		dryRunAlt   = fs.Bool("n", false, "")
+		helpFlag    = fs.Bool("help", false, "")
+		helpFlagAlt = fs.Bool("h", false, "")
+	)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, ErrShowUsage
+		}
+		return nil, err
+	}
+	if *helpFlag || *helpFlagAlt {
+		return nil, ErrShowUsage
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	opts := &GenconfigOptions{
+		Inventory: *inventory,
+		Template:  *tmpl,
+		OutDir:    normalizeString(*outDirAlt, *outDir),
+		DryRun:    *dryRun || *dryRunAlt,
+	}
+	if opts.Inventory == "" || opts.Template == "" {
+		return nil, fmt.Errorf("--inventory and --template are required")
+	}
+	switch configExt(opts.Template) {
+	case ".yaml", ".yml", ".toml":
+	default:
+		return nil, fmt.Errorf("--template must end in .yaml, .yml or .toml")
+	}
+	return opts, nil
+}
+
+// inventory lists the bastions to render configs for.
+type inventory struct {
+	Vars     map[string]any            `yaml:"vars" toml:"vars"`
+	Bastions map[string]map[string]any `yaml:"bastions" toml:"bastions"`
+}
+
+// loadInventory reads a YAML or TOML inventory, chosen by extension.
+func loadInventory(path string) (*inventory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv inventory
+	switch ext := configExt(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&inv)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), &inv)
+		if undecoded := md.Undecoded(); err == nil && len(undecoded) > 0 {
+			err = fmt.Errorf("unknown key %q", undecoded[0].String())
+		}
+	default:
+		return nil, fmt.Errorf("unknown inventory format %q (use .yaml, .yml or .toml)", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(inv.Bastions) == 0 {
+		return nil, errors.New("no bastions")
+	}
+	for name := range inv.Bastions {
+		if !validLabelKey(name) || strings.Trim(name, ".") == "" {
+			return nil, fmt.Errorf("bastion name %q must be letters, digits, '_', '-' or '.'", name)
+		}
+	}
+	return &inv, nil
+}
+
+// Genconfig renders a config for every bastion in the inventory and writes
+// them to the output directory once all of them render and pass the same
+// checks as --config. Checks that need the bastion's own files, such as
+// reading --auth-token-file, are left to poolgo on the bastion.
+func Genconfig(opts GenconfigOptions, logger *log.Logger) error {
+	inv, err := loadInventory(opts.Inventory)
+	if err != nil {
+		return fmt.Errorf("--inventory %s: %w", opts.Inventory, err)
+	}
+	src, err := os.ReadFile(opts.Template)
+	if err != nil {
+		return fmt.Errorf("--template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(opts.Template)).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"quote": quoteConfigValue}).
+		Parse(string(src))
+	if err != nil {
+		return fmt.Errorf("--template: %w", err)
+	}
+
+	names := make([]string, 0, len(inv.Bastions))
+	for name := range inv.Bastions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ext := configExt(opts.Template)
+	scratch, err := os.MkdirTemp("", "poolgo-genconfig-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	rendered := make(map[string][]byte, len(names))
+	for _, name := range names {
+		vars := make(map[string]any, len(inv.Vars)+len(inv.Bastions[name])+1)
+		for k, v := range inv.Vars {
+			vars[k] = v
+		}
+		for k, v := range inv.Bastions[name] {
+			vars[k] = v
+		}
+		vars["name"] = name
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, vars); err != nil {
+			return fmt.Errorf("bastion %s: %w", name, err)
+		}
+		if err := checkConfig(filepath.Join(scratch, name+ext), out.Bytes()); err != nil {
+			return fmt.Errorf("bastion %s: %w", name, err)
+		}
+		rendered[name] = out.Bytes()
+	}
+
+	for _, name := range names {
+		path := filepath.Join(opts.OutDir, name+ext)
+		if opts.DryRun {
+			fmt.Printf("# %s\n%s\n", path, rendered[name])
+			continue
+		}
+		if err := os.WriteFile(path, rendered[name], 0o600); err != nil {
+			return err
+		}
+		logger.Printf("wrote %s", path)
+	}
+	return nil
+}
+
+// checkConfig writes data to path and parses it as poolgo would with
+// --config. Only errors in the file itself count; the rest, such as a
+// key file that exists only on the bastion, is ignored.
+func checkConfig(path string, data []byte) error {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	opts, err := ParseArgs([]string{"--config", path})
+	if opts != nil {
+		opts.ShutdownKey.Wipe()
+		opts.AuthToken.Wipe()
+	}
+	var fileErr *config.FileError
+	if errors.As(err, &fileErr) {
+		return fileErr.Err
+	}
+	return nil
+}
+
+// quoteConfigValue renders v as a double-quoted string, which YAML and
+// TOML read alike.
+func quoteConfigValue(v any) (string, error) {
+	data, err := json.Marshal(fmt.Sprint(v))
+	return string(data), err
+}
+
+func configExt(path string) string {
+	return strings.ToLower(filepath.Ext(path))
+}
@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenconfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	inventory := write("hosts.yaml", `
+vars:
+  hub: jump.example.net
+  port: 5555
+bastions:
+  dc1-web: {site: dc1}
+  dc2-db: {site: "dc2 east", hub: jump2.example.net}
+`)
+	tmpl := write("pool.yaml", `hub-host: {{ quote .hub }}
+hub-port: {{ .port }}
+mode: socks
+label: ["site={{ .site }}", "name={{ .name }}"]
+auth-token-file: /etc/contun/{{ .name }}.token
+`)
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0o700)
+	logger := log.New(io.Discard, "", 0)
+	if err := Genconfig(GenconfigOptions{Inventory: inventory, Template: tmpl, OutDir: out}, logger); err != nil {
+		t.Fatalf("Genconfig: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "dc2-db.yaml"))
+	if err != nil {
+		t.Fatalf("read rendered config: %v", err)
+	}
+	want := `hub-host: "jump2.example.net"
+hub-port: 5555
+mode: socks
+label: ["site=dc2 east", "name=dc2-db"]
+auth-token-file: /etc/contun/dc2-db.token
+`
+	if string(data) != want {
+		t.Fatalf("rendered:\n%s\nwant:\n%s", data, want)
+	}
+	if _, err := os.Stat(filepath.Join(out, "dc1-web.yaml")); err != nil {
+		t.Fatalf("dc1-web not rendered: %v", err)
+	}
+
+	// Nothing is written when any bastion fails.
+	for name, src := range map[string]string{
+		"missing variable": "hub-host: {{ .region }}\n",
+		"unknown option":   "hub-host: {{ .hub }}\nworkerz: 3\n",
+		"bad value":        "hub-host: {{ .hub }}\nworkers: {{ .site }}\n",
+	} {
+		empty := t.TempDir()
+		err := Genconfig(GenconfigOptions{Inventory: inventory, Template: write("bad.yaml", src), OutDir: empty}, logger)
+		if err == nil {
+			t.Fatalf("%s: Genconfig succeeded", name)
+		}
+		if entries, _ := os.ReadDir(empty); len(entries) > 0 {
+			t.Fatalf("%s: wrote %d file(s) despite %v", name, len(entries), err)
+		}
+	}
+	for _, inv := range []string{"bastions: {}\n", "bastions: {\"../x\": {}}\n", "hosts: {a: {}}\n"} {
+		err := Genconfig(GenconfigOptions{Inventory: write("bad-hosts.yaml", inv), Template: tmpl, OutDir: out}, logger)
+		if err == nil || !strings.HasPrefix(err.Error(), "--inventory") {
+			t.Fatalf("inventory %q: %v", inv, err)
+		}
+	}
+}
+
+func TestParseGenconfigArgs(t *testing.T) {
+	opts, err := ParseGenconfigArgs([]string{"--inventory", "hosts.toml", "--template", "pool.TOML", "-o", "/tmp/out", "-n"})
+	if err != nil || opts.OutDir != "/tmp/out" || !opts.DryRun {
+		t.Fatalf("ParseGenconfigArgs: %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{{"--inventory", "hosts.yaml"}, {"--inventory", "h.yaml", "--template", "pool.conf"}} {
+		if _, err := ParseGenconfigArgs(args); err == nil {
+			t.Fatalf("accepted %q", args)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package pool
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeat keeps an idle hub connection honest. While the worker waits for
+// a REQUEST it sends "PING <n>" after each interval of silence from the hub
+// and closes the connection when nothing arrives within timeout of a PING,
+// so a connection silently dropped by a NAT or firewall is replaced before
+// the hub hands it work. A hub answers with "PONG <n>", but any control
+// message counts as a sign of life.
+type heartbeat struct {
+	conn     net.Conn
+	writer   *controlWriter
+	interval time.Duration
+	timeout  time.Duration
+
+	lastSeen atomic.Int64 // UnixNano of the last message from the hub
+	idle     atomic.Bool  // the worker is waiting for a REQUEST
+	expired  atomic.Bool
+	done     chan struct{}
+}
+
+// startHeartbeat starts pinging the hub on conn through writer.
+func startHeartbeat(conn net.Conn, writer *controlWriter, interval, timeout time.Duration) *heartbeat {
+	h := &heartbeat{conn: conn, writer: writer, interval: interval, timeout: timeout, done: make(chan struct{})}
+	h.seen()
+	go h.run()
+	return h
+}
+
+// waiting marks whether the worker is idle, waiting for the hub's next
+// control message. Only idle connections are pinged; dials and bridges have
+// their own failure detection. A nil heartbeat does nothing.
+func (h *heartbeat) waiting(idle bool) {
+	if h == nil {
+		return
+	}
+	if !idle {
+		h.seen()
+	}
+	h.idle.Store(idle)
+}
+
+// seen records a message from the hub.
+func (h *heartbeat) seen() {
+	h.lastSeen.Store(time.Now().UnixNano())
+}
+
+// timedOut reports whether the heartbeat closed the connection because the
+// hub stopped answering.
+func (h *heartbeat) timedOut() bool {
+	return h != nil && h.expired.Load()
+}
+
+// stop ends the heartbeat.
+func (h *heartbeat) stop() {
+	if h != nil {
+		close(h.done)
+	}
+}
+
+func (h *heartbeat) run() {
+	timer := time.NewTimer(h.interval)
+	defer timer.Stop()
+	for seq := 1; ; {
+		select {
+		case <-h.done:
+			return
+		case <-timer.C:
+		}
+		quiet := time.Since(time.Unix(0, h.lastSeen.Load()))
+		if !h.idle.Load() {
+			timer.Reset(h.interval)
+			continue
+		}
+		if quiet < h.interval {
+			timer.Reset(h.interval - quiet)
+			continue
+		}
+		sent := time.Now().UnixNano()
+		if err := h.writer.send(fmt.Sprintf("PING %d", seq)); err != nil {
+			// A failed write surfaces on the worker's next read.
+			timer.Reset(h.interval)
+			continue
+		}
+		seq++
+		timer.Reset(h.timeout)
+		select {
+		case <-h.done:
+			return
+		case <-timer.C:
+		}
+		if h.lastSeen.Load() < sent && h.idle.Load() {
+			h.expired.Store(true)
+			_ = h.conn.Close()
+			return
+		}
+		timer.Reset(h.interval)
+	}
+}
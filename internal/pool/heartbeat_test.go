@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, HeartbeatInterval: 50 * time.Millisecond, HeartbeatTimeout: 100 * time.Millisecond})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, "heartbeat") {
+		t.Fatalf("HELLO does not offer heartbeat: %q", line)
+	}
+	hub.Write([]byte("OK CAPS heartbeat\n"))
+	if line, _ := reader.ReadString('\n'); line != "PING 1\n" {
+		t.Fatalf("got %q, want the first PING", line)
+	}
+	hub.Write([]byte("PONG 1\n"))
+	if line, _ := reader.ReadString('\n'); line != "PING 2\n" {
+		t.Fatalf("got %q, want the second PING", line)
+	}
+
+	// The hub goes silent without closing the connection.
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "did not answer PING") {
+			t.Fatalf("handleHubSession = %v, want a heartbeat timeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("worker did not notice the silent hub")
+	}
+}
+
+func TestParseArgsHeartbeat(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks"})
+	if err != nil || opts.HeartbeatInterval != 30*time.Second || opts.HeartbeatTimeout != 10*time.Second {
+		t.Fatalf("defaults: %+v, %v", opts, err)
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--heartbeat", "0"})
+	if err != nil || opts.HeartbeatInterval != 0 {
+		t.Fatalf("--heartbeat 0: %+v, %v", opts, err)
+	}
+	for _, c := range NewSupervisor(*opts).link().capabilities() {
+		if c == capHeartbeat {
+			t.Fatalf("heartbeat offered with --heartbeat 0")
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--heartbeat-timeout", "0"}); err == nil {
+		t.Fatalf("accepted --heartbeat-timeout 0")
+	}
+}
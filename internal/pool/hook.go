@@ -0,0 +1,287 @@
+package pool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	startime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// hookMaxSteps bounds the Starlark computation one REQUEST may spend in a
+// hook, so a runaway loop denies the request instead of stalling a worker.
+const hookMaxSteps = 1_000_000
+
+// hookDialect enables the language extensions a script may want; runaway
+// loops and recursion are caught by hookMaxSteps.
+var hookDialect = &syntax.FileOptions{Set: true, While: true, TopLevelControl: true, Recursion: true}
+
+// hookVerdict is the constructor name of the values allow, deny and rewrite
+// return.
+const hookVerdict = starlark.String("verdict")
+
+// Hook is a Starlark script consulted for every REQUEST before it is acted
+// on (--hook). It must define request(req), which sees the command,
+// destination, session ID and the pool's --label values and returns
+// allow(), deny(reason) or rewrite(host=..., port=...); returning None
+// allows the request too. A hook that fails denies the request.
+type Hook struct {
+	Sum string // SHA-256 of the script, so the config hash follows edits
+
+	path    string
+	request *starlark.Function
+	now     func() (time.Time, error) // for tests; nil uses the clock
+}
+
+// Decision is a hook's answer to one request.
+type Decision struct {
+	Deny   bool
+	Reason string // why the hook denied it, if it said
+	Host   string // rewritten destination, or "" to keep it
+	Port   int    // rewritten port, or 0 to keep it
+}
+
+// hookBuiltins are predeclared for hook scripts, along with the time module.
+var hookBuiltins = starlark.StringDict{
+	"allow":   starlark.NewBuiltin("allow", hookAllow),
+	"deny":    starlark.NewBuiltin("deny", hookDeny),
+	"rewrite": starlark.NewBuiltin("rewrite", hookRewrite),
+	"time":    startime.Module,
+}
+
+// LoadHook compiles the script at path and runs its top level once.
+func LoadHook(path string) (*Hook, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	thread := &starlark.Thread{Name: "hook " + path, Print: func(*starlark.Thread, string) {}}
+	thread.SetMaxExecutionSteps(hookMaxSteps)
+	globals, err := starlark.ExecFileOptions(hookDialect, thread, path, src, hookBuiltins)
+	if err != nil {
+		return nil, hookError(err)
+	}
+	fn, ok := globals["request"].(*starlark.Function)
+	if !ok || fn.NumParams() != 1 {
+		return nil, fmt.Errorf("%s must define request(req)", path)
+	}
+	sum := sha256.Sum256(src)
+	return &Hook{Sum: hex.EncodeToString(sum[:]), path: path, request: fn}, nil
+}
+
+// Decide runs the hook for req. Anything the script prints is logged.
+func (h *Hook) Decide(ctx context.Context, req *Request, mode Mode, labels map[string]string, logger *log.Logger) (Decision, error) {
+	thread := &starlark.Thread{
+		Name:  "hook " + h.path,
+		Print: func(_ *starlark.Thread, msg string) { logger.Printf("hook: %s", msg) },
+	}
+	thread.SetMaxExecutionSteps(hookMaxSteps)
+	if h.now != nil {
+		startime.SetNow(thread, h.now)
+	}
+	stop := context.AfterFunc(ctx, func() { thread.Cancel(ctx.Err().Error()) })
+	defer stop()
+
+	v, err := starlark.Call(thread, h.request, starlark.Tuple{hookRequest(req, mode, labels)}, nil)
+	if err != nil {
+		return Decision{}, hookError(err)
+	}
+	if v == starlark.None {
+		return Decision{}, nil
+	}
+	verdict, ok := v.(*starlarkstruct.Struct)
+	if !ok || verdict.Constructor() != hookVerdict {
+		return Decision{}, fmt.Errorf("request() returned %s, want allow(), deny() or rewrite()", v.Type())
+	}
+	var d Decision
+	if action, _ := verdict.Attr("action"); action == starlark.String("deny") {
+		d.Deny = true
+		reason, _ := verdict.Attr("reason")
+		d.Reason, _ = starlark.AsString(reason)
+		return d, nil
+	}
+	if host, _ := verdict.Attr("host"); host != nil {
+		d.Host, _ = starlark.AsString(host)
+	}
+	if port, _ := verdict.Attr("port"); port != nil {
+		n, _ := starlark.AsInt32(port)
+		d.Port = n
+	}
+	return d, nil
+}
+
+// Apply rewrites req as the decision says. Only CONNECT, PING and SCAN have
+// a destination to rewrite, and only CONNECT a port.
+func (d Decision) Apply(req *Request) error {
+	if d.Host == "" && d.Port == 0 {
+		return nil
+	}
+	switch req.Command {
+	case CommandConnect, CommandPing, CommandScan:
+	default:
+		return fmt.Errorf("hook cannot rewrite %s requests", req.Command)
+	}
+	if d.Port != 0 && req.Command != CommandConnect {
+		return fmt.Errorf("hook cannot rewrite the port of %s requests", req.Command)
+	}
+	if d.Host != "" {
+		req.Address, req.AddrType = d.Host, classifyAddr(d.Host)
+	}
+	if d.Port != 0 {
+		req.Port = d.Port
+	}
+	return validateRequestAddress(req)
+}
+
+// hookRequest builds the req value a script sees.
+func hookRequest(req *Request, mode Mode, labels map[string]string) starlark.Value {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	dict := starlark.NewDict(len(labels))
+	for _, k := range keys {
+		_ = dict.SetKey(starlark.String(k), starlark.String(labels[k]))
+	}
+	dict.Freeze()
+	ports := make([]starlark.Value, len(req.Ports))
+	for i, port := range req.Ports {
+		ports[i] = starlark.MakeInt(port)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("request"), starlark.StringDict{
+		"command":  starlark.String(req.Command),
+		"atype":    starlark.String(req.AddrType),
+		"host":     starlark.String(req.Address),
+		"port":     starlark.MakeInt(req.Port),
+		"ports":    starlark.Tuple(ports),
+		"session":  starlark.String(req.SessionID),
+		"affinity": starlark.String(req.Affinity),
+		"mode":     starlark.String(mode),
+		"labels":   dict,
+	})
+}
+
+func hookAllow(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs); err != nil {
+		return nil, err
+	}
+	return starlarkstruct.FromStringDict(hookVerdict, starlark.StringDict{"action": starlark.String("allow")}), nil
+}
+
+func hookDeny(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var reason string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "reason?", &reason); err != nil {
+		return nil, err
+	}
+	return starlarkstruct.FromStringDict(hookVerdict, starlark.StringDict{
+		"action": starlark.String("deny"),
+		"reason": starlark.String(reason),
+	}), nil
+}
+
+func hookRewrite(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		host string
+		port int
+	)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "host?", &host, "port?", &port); err != nil {
+		return nil, err
+	}
+	if host == "" && port == 0 {
+		return nil, fmt.Errorf("%s: needs a host or a port", b.Name())
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%s: invalid port %d", b.Name(), port)
+	}
+	if strings.ContainsAny(host, " \t\r\n") {
+		return nil, fmt.Errorf("%s: invalid host %q", b.Name(), host)
+	}
+	return starlarkstruct.FromStringDict(hookVerdict, starlark.StringDict{
+		"action": starlark.String("rewrite"),
+		"host":   starlark.String(host),
+		"port":   starlark.MakeInt(port),
+	}), nil
+}
+
+// hookError adds the script backtrace to evaluation errors.
+func hookError(err error) error {
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		return fmt.Errorf("%s", evalErr.Backtrace())
+	}
+	return err
+}
+
+// authorizer is what can vote on a request: a --hook script or a plugin
+// providing authorize.
+type authorizer interface {
+	Decide(ctx context.Context, req *Request, mode Mode, labels map[string]string, logger *log.Logger) (Decision, error)
+}
+
+// authorize consults the current --hook, then each authorize plugin, then
+// each interceptor, about req. Rewrites apply in turn, so later authorizers see the rewritten
+// request, and the first denial stands. --allow and --deny rules are checked
+// last, against the request as it will be dialled. A denied request, or one an
+// authorizer failed on, is answered with status 2 (not allowed by ruleset)
+// and recorded in the audit log; allowed reports whether the caller should
+// go on. Only a failure to reply is returned.
+func (s *Supervisor) authorize(ctx context.Context, writer *controlWriter, req *Request, logger *log.Logger) (allowed bool, err error) {
+	opts := s.link().opts
+	var names []string
+	var chain []authorizer
+	if opts.Hook != nil {
+		names, chain = append(names, "hook"), append(chain, opts.Hook)
+	}
+	for _, p := range s.pluginsFor(pluginAuthorize) {
+		names, chain = append(names, "plugin "+p.name), append(chain, p)
+	}
+	for _, i := range s.interceptors {
+		names, chain = append(names, fmt.Sprintf("interceptor %T", i)), append(chain, interceptorAuthorizer{i})
+	}
+	rewritten := *req
+	var reason string
+	for i, a := range chain {
+		before := rewritten.hostPort()
+		d, err := a.Decide(ctx, &rewritten, opts.Mode, opts.Labels, logger)
+		if err == nil && !d.Deny {
+			err = d.Apply(&rewritten)
+		}
+		switch {
+		case err != nil:
+			logger.Printf("%s failed on %s %s: %v", names[i], req.Command, before, err)
+			reason = names[i] + " failed"
+		case d.Deny:
+			reason = "denied by " + names[i]
+			if d.Reason != "" {
+				reason += ": " + d.Reason
+			}
+			logger.Printf("%s %s %s", reason, req.Command, before)
+		case d.Host != "" || d.Port != 0:
+			logger.Printf("%s rewrote %s %s to %s", names[i], req.Command, before, rewritten.hostPort())
+		}
+		if reason != "" {
+			break
+		}
+	}
+	if reason == "" {
+		if why := s.checkACL(ctx, &rewritten); why != "" {
+			reason = "denied by acl: " + why
+			logger.Printf("%s", reason)
+		}
+	}
+	if reason == "" {
+		*req = rewritten
+		return true, nil
+	}
+	s.audit.Record("request_denied", map[string]any{"dest": req.Address, "port": req.Port, "reason": reason})
+	return false, sendReply(writer, 2, AddrIPv4, "0.0.0.0", 0)
+}
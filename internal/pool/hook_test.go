@@ -0,0 +1,158 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHook = `
+def request(req):
+    if req.command == "PING":
+        return None
+    if req.host == "db.internal":
+        return rewrite(host = "127.0.0.1", port = int(req.labels["db-port"]))
+    if req.port == 22 and time.now().hour >= 18:
+        return deny("ssh after hours")
+    if req.labels.get("site") != "dc1":
+        return deny()
+    return allow()
+`
+
+func writeHook(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.star")
+	if err := os.WriteFile(path, []byte(src), 0o600); err != nil {
+		t.Fatalf("write hook: %v", err)
+	}
+	return path
+}
+
+func TestHookDecide(t *testing.T) {
+	hook, err := LoadHook(writeHook(t, testHook))
+	if err != nil {
+		t.Fatalf("LoadHook: %v", err)
+	}
+	clock := time.Date(2030, 1, 2, 9, 0, 0, 0, time.UTC)
+	hook.now = func() (time.Time, error) { return clock, nil }
+	labels := map[string]string{"site": "dc1", "db-port": "5432"}
+	logger := log.New(io.Discard, "", 0)
+	decide := func(line string, labels map[string]string) Decision {
+		t.Helper()
+		req, err := ParseRequest(line)
+		if err != nil {
+			t.Fatalf("ParseRequest(%q): %v", line, err)
+		}
+		d, err := hook.Decide(context.Background(), req, ModeSocks, labels, logger)
+		if err != nil {
+			t.Fatalf("Decide(%q): %v", line, err)
+		}
+		return d
+	}
+
+	if d := decide("REQUEST CONNECT ipv4 10.0.0.5 22 1", labels); d != (Decision{}) {
+		t.Fatalf("ssh in office hours: %+v", d)
+	}
+	if d := decide("REQUEST CONNECT domain db.internal 1 2", labels); d.Deny || d.Host != "127.0.0.1" || d.Port != 5432 {
+		t.Fatalf("rewrite: %+v", d)
+	}
+	if d := decide("REQUEST CONNECT ipv4 10.0.0.5 443 3", nil); !d.Deny || d.Reason != "" {
+		t.Fatalf("unlabelled pool: %+v", d)
+	}
+	if d := decide("REQUEST PING ipv4 10.0.0.5 0 4", nil); d != (Decision{}) {
+		t.Fatalf("ping: %+v", d)
+	}
+	clock = clock.Add(10 * time.Hour)
+	if d := decide("REQUEST CONNECT ipv4 10.0.0.5 22 5", labels); !d.Deny || d.Reason != "ssh after hours" {
+		t.Fatalf("ssh after hours: %+v", d)
+	}
+
+	// A script error is returned, never taken as an answer.
+	req, _ := ParseRequest("REQUEST CONNECT domain db.internal 1 6")
+	if _, err := hook.Decide(context.Background(), req, ModeSocks, map[string]string{"db-port": "x"}, logger); err == nil {
+		t.Fatal("Decide ignored a script error")
+	}
+
+	for _, src := range []string{
+		"def request(req):\n    return 1\n",
+		"def request(req):\n    while True:\n        pass\n",
+	} {
+		hook, err := LoadHook(writeHook(t, src))
+		if err != nil {
+			t.Fatalf("LoadHook: %v", err)
+		}
+		if _, err := hook.Decide(context.Background(), req, ModeSocks, nil, logger); err == nil {
+			t.Fatalf("Decide accepted %q", src)
+		}
+	}
+	for _, src := range []string{"def other(req):\n    pass\n", "def request(:\n", "x = undefined\n"} {
+		if _, err := LoadHook(writeHook(t, src)); err == nil {
+			t.Fatalf("LoadHook accepted %q", src)
+		}
+	}
+}
+
+func TestDecisionApply(t *testing.T) {
+	req, _ := ParseRequest("REQUEST CONNECT domain db.internal 80 1")
+	if err := (Decision{Host: "::1", Port: 8080}).Apply(req); err != nil || req.AddrType != AddrIPv6 || req.Address != "::1" || req.Port != 8080 {
+		t.Fatalf("Apply: %+v, %v", req, err)
+	}
+	req, _ = ParseRequest("REQUEST SCAN ipv4 10.0.0.5 22,80 2")
+	if err := (Decision{Port: 8080}).Apply(req); err == nil {
+		t.Fatal("rewrote the port of a SCAN")
+	}
+	req, _ = ParseRequest("REQUEST ASSOCIATE ipv4 0.0.0.0 0 3")
+	if err := (Decision{Host: "10.0.0.1"}).Apply(req); err == nil {
+		t.Fatal("rewrote an ASSOCIATE")
+	}
+}
+
+func TestHubSessionHook(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	port := target.Addr().(*net.TCPAddr).Port
+
+	hook, err := LoadHook(writeHook(t, testHook))
+	if err != nil {
+		t.Fatalf("LoadHook: %v", err)
+	}
+	hook.now = func() (time.Time, error) { return time.Date(2030, 1, 2, 20, 0, 0, 0, time.UTC), nil }
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, Hook: hook, Labels: map[string]string{
+		"site": "dc1", "db-port": fmt.Sprint(port),
+	}})
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK\nREQUEST CONNECT ipv4 127.0.0.1 22 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 2 ") {
+		t.Fatalf("denied request answered %q", line)
+	}
+	fmt.Fprintf(hub, "REQUEST CONNECT domain db.internal 1 2\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 0 ") {
+		t.Fatalf("rewritten request answered %q", line)
+	}
+	if data, _ := io.ReadAll(reader); string(data) != "hello" {
+		t.Fatalf("bridged %q from the rewritten destination", data)
+	}
+}
@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// parseHubURL reads a --hub-url such as wss://hub.example/tunnel and
+// returns it with the host and port workers dial. ws:// defaults to port 80
+// and wss:// to 443.
+func parseHubURL(raw string) (*url.URL, string, int, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	port := 80
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		port = 443
+	default:
+		return nil, "", 0, fmt.Errorf("unsupported scheme %q (want ws or wss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, "", 0, fmt.Errorf("missing hub address in %q", raw)
+	}
+	if u.User != nil {
+		return nil, "", 0, fmt.Errorf("credentials in %q are not supported; use --auth-token-file", u.Redacted())
+	}
+	if u.Port() != "" {
+		if port, err = strconv.Atoi(u.Port()); err != nil || port <= 0 || port > 65535 {
+			return nil, "", 0, fmt.Errorf("invalid port in %q", raw)
+		}
+	}
+	return u, u.Hostname(), port, nil
+}
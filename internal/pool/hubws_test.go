@@ -0,0 +1,99 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"contun/internal/websocket"
+	"contun/pkg/pooltest"
+)
+
+// TestHubURL runs a worker against a fake hub behind a front that ends the
+// WebSocket and relays the stream, as a reverse proxy in front of hubgo
+// would.
+func TestHubURL(t *testing.T) {
+	hub, target := pooltest.NewHub(t), pooltest.NewTarget(t)
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	paths := make(chan string, 4)
+	go func() {
+		for {
+			raw, err := front.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer raw.Close()
+				ws, req, err := websocket.Upgrade(raw, bufio.NewReader(raw))
+				if err != nil {
+					return
+				}
+				paths <- req.URL.Path
+				upstream, err := net.Dial("tcp", net.JoinHostPort(hub.Host(), strconv.Itoa(hub.Port())))
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				done := make(chan struct{})
+				go func() {
+					io.Copy(upstream, ws)
+					upstream.(*net.TCPConn).CloseWrite()
+					close(done)
+				}()
+				io.Copy(ws, upstream)
+				ws.CloseWrite()
+				<-done
+			}()
+		}
+	}()
+
+	opts, err := ParseArgs([]string{"-m", "socks", "-w", "1", "--hub-url", "ws://" + front.Addr().String() + "/tunnel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSupervisor(*opts)
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go s.Run(ctx)
+	if err := hub.Play(ctx, pooltest.Request{Host: target.Host(), Port: target.Port(), Send: "over websocket", Expect: "over websocket"}); err != nil {
+		t.Fatal(err)
+	}
+	if path := <-paths; path != "/tunnel" {
+		t.Fatalf("front was asked for %q", path)
+	}
+}
+
+func TestParseHubURL(t *testing.T) {
+	opts, err := ParseArgs([]string{"-m", "socks", "--hub-url", "wss://hub.example/tunnel", "--tls-ca", "ca.pem"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.HubHost != "hub.example" || opts.HubPort != 443 || !opts.TLS {
+		t.Fatalf("wss URL gave %s:%d, tls=%v", opts.HubHost, opts.HubPort, opts.TLS)
+	}
+	if opts, err = ParseArgs([]string{"-m", "socks", "--hub-url", "ws://[2001:db8::1]:8080"}); err != nil || opts.HubHost != "2001:db8::1" || opts.HubPort != 8080 || opts.TLS {
+		t.Fatalf("ws URL gave %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{
+		{"--hub-url", "https://hub.example"},
+		{"--hub-url", "wss://user:pw@hub.example"},
+		{"--hub-url", "wss://hub.example:0"},
+		{"--hub-url", "ws://hub.example", "--tls"},
+		{"--hub-url", "wss://hub.example", "-p", "443"},
+		{"--hub-url", "wss://hub.example", "--hub-host", "other"},
+	} {
+		if _, err := ParseArgs(append([]string{"-m", "socks"}, args...)); err == nil {
+			t.Errorf("accepted %q", args)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package pool
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout ends a bridge through which nothing has moved for
+// --idle-timeout.
+var errIdleTimeout = errors.New("no data in either direction")
+
+// idleConn wraps a target connection for --idle-timeout. Each read waits at
+// most timeout; when it runs out the session is idle only if nothing was
+// written to the target in that time either, otherwise the read continues
+// with a fresh deadline. The reads and writes both directions of a bridge
+// make on the target thus count as traffic.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last read or write that moved data
+}
+
+// newIdleConn wraps conn, keeping its CloseWrite if it has one so bridge
+// can still half-close it.
+func newIdleConn(conn net.Conn, timeout time.Duration) net.Conn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.touch()
+	if _, ok := conn.(interface{ CloseWrite() error }); ok {
+		return idleHalfConn{c}
+	}
+	return c
+}
+
+func (c *idleConn) touch() { c.last.Store(time.Now().UnixNano()) }
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.touch()
+		}
+		var netErr net.Error
+		if n > 0 || !errors.As(err, &netErr) || !netErr.Timeout() {
+			return n, err
+		}
+		if time.Since(time.Unix(0, c.last.Load())) >= c.timeout {
+			return 0, errIdleTimeout
+		}
+	}
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// idleHalfConn is an idleConn whose target can be half-closed.
+type idleHalfConn struct{ *idleConn }
+
+func (c idleHalfConn) CloseWrite() error {
+	return c.Conn.(interface{ CloseWrite() error }).CloseWrite()
+}
@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestBridgeIdleTimeout(t *testing.T) {
+	s := NewSupervisor(Options{})
+	hub, client := tcpPair(t)
+	target, remote := tcpPair(t)
+	go io.Copy(io.Discard, client)
+	go io.Copy(io.Discard, remote)
+
+	// Hub traffic alone keeps the session open past the timeout.
+	idle := newIdleConn(target, 100*time.Millisecond)
+	go func() {
+		for i := 0; i < 5; i++ {
+			client.Write([]byte("tick"))
+			time.Sleep(40 * time.Millisecond)
+		}
+	}()
+	started := time.Now()
+	res, err := s.bridge(context.Background(), hub, idle, hub, idle, log.New(io.Discard, "", 0))
+	if res.reason != endIdleTimeout || err == nil {
+		t.Fatalf("idle bridge: %+v, %v", res, err)
+	}
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Fatalf("bridge ended after %s despite traffic from the hub", elapsed)
+	}
+	if res.toTarget != 20 {
+		t.Fatalf("bridged %d bytes to the target, want 20", res.toTarget)
+	}
+}
+
+func TestParseArgsIdleTimeout(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--idle-timeout", "15m"})
+	if err != nil || opts.IdleTimeout != 15*time.Minute {
+		t.Fatalf("--idle-timeout 15m: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--idle-timeout", "-1s"}); err == nil {
+		t.Fatalf("ParseArgs accepted a negative --idle-timeout")
+	}
+}
@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// InboundAction selects what happens when a session exceeds --inbound-limit.
+type InboundAction string
+
+const (
+	InboundAlert InboundAction = "alert" // report and keep streaming
+	InboundClose InboundAction = "close" // report and end the session
+)
+
+// errInboundQuota ends the target-to-hub copy once the limit is reached
+// with --inbound-limit-action close.
+var errInboundQuota = errors.New("inbound byte limit exceeded")
+
+// inboundMeter counts bytes read from the target during one session and
+// fires its alert once, when the total first exceeds the limit.
+type inboundMeter struct {
+	r       io.Reader
+	limit   int64
+	action  InboundAction
+	total   int64
+	alerted bool
+	alert   func(total int64)
+}
+
+func (m *inboundMeter) Read(p []byte) (int, error) {
+	if m.alerted && m.action == InboundClose {
+		return 0, errInboundQuota
+	}
+	n, err := m.r.Read(p)
+	m.total += int64(n)
+	if m.total <= m.limit || m.alerted {
+		return n, err
+	}
+	m.alerted = true
+	m.alert(m.total)
+	if m.action == InboundClose {
+		// Forward the bytes up to the limit and nothing beyond it.
+		return n - int(m.total-m.limit), errInboundQuota
+	}
+	return n, err
+}
+
+// reportInbound logs and audits a session whose inbound volume crossed
+// --inbound-limit and tells the hub on every idle control connection.
+func (s *Supervisor) reportInbound(req *Request, total int64) {
+	dest := req.hostPort()
+	s.redactDest(s.logger, req).Printf("inbound limit exceeded: %s sent more than %d bytes (%s)", dest, s.opts.InboundLimit, s.opts.InboundAction)
+	sent := s.broadcastNotice(fmt.Sprintf("NOTICE inbound-limit %s %d %s", dest, s.opts.InboundLimit, s.opts.InboundAction))
+	s.audit.Record("inbound_limit", map[string]any{
+		"dest": req.Address, "port": req.Port, "limit": s.opts.InboundLimit, "bytes": total,
+		"action": string(s.opts.InboundAction), "hub_sessions_notified": sent,
+	})
+}
+
+// parseByteSize parses a byte count with an optional binary K, M or G
+// suffix (e.g. 512K, 20M, 1G).
+func parseByteSize(text string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(text))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 || v > (1<<62)/mult {
+		return 0, fmt.Errorf("invalid size %q", text)
+	}
+	return v * mult, nil
+}
@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for text, want := range map[string]int64{"1500": 1500, "512K": 512 << 10, "20m": 20 << 20, "1GB": 1 << 30} {
+		if got, err := parseByteSize(text); err != nil || got != want {
+			t.Fatalf("parseByteSize(%q) = %d, %v; want %d", text, got, err, want)
+		}
+	}
+	for _, text := range []string{"", "K", "-1", "0", "10T"} {
+		if _, err := parseByteSize(text); err == nil {
+			t.Fatalf("parseByteSize(%q) accepted", text)
+		}
+	}
+}
+
+func TestInboundMeter(t *testing.T) {
+	for _, action := range []InboundAction{InboundAlert, InboundClose} {
+		alerts := 0
+		m := &inboundMeter{r: strings.NewReader(strings.Repeat("x", 100)), limit: 30, action: action,
+			alert: func(total int64) { alerts++ }}
+		got, err := io.ReadAll(io.LimitReader(m, 1000))
+		if alerts != 1 {
+			t.Fatalf("%s: %d alerts, want 1", action, alerts)
+		}
+		switch action {
+		case InboundAlert:
+			if err != nil || len(got) != 100 {
+				t.Fatalf("alert: read %d bytes (%v), want all 100", len(got), err)
+			}
+		case InboundClose:
+			if err != errInboundQuota || len(got) != 30 {
+				t.Fatalf("close: read %d bytes (%v), want 30 and the quota error", len(got), err)
+			}
+		}
+	}
+}
+
+func TestBridgeInboundClose(t *testing.T) {
+	hub, client := tcpPair(t)
+	target, remote := tcpPair(t)
+	s := NewSupervisor(Options{})
+	meter := &inboundMeter{r: target, limit: 10, action: InboundClose, alert: func(int64) {}}
+	done := make(chan endReason, 1)
+	go func() {
+		res, _ := s.bridge(context.Background(), hub, target, hub, meter, log.New(io.Discard, "", 0))
+		done <- res.reason
+	}()
+	remote.Write([]byte(strings.Repeat("y", 64)))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, _ := io.ReadAll(client)
+	if len(got) != 10 {
+		t.Fatalf("client received %d bytes, want the first 10", len(got))
+	}
+	select {
+	case reason := <-done:
+		if reason != endQuota {
+			t.Fatalf("got reason %q, want %q", reason, endQuota)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("bridge did not finish")
+	}
+}
@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Interceptor sees what a worker does on each hub session, for policy,
+// audit or metrics that need more than --hook, plugins or the audit log
+// offer. Programs that embed the pool add one with AddInterceptor, and
+// compiled-in extensions register one for every pool with
+// RegisterInterceptor. Embed NopInterceptor to implement only the methods
+// of interest.
+//
+// The methods run on the worker's goroutine and hold up its session, so
+// they should return quickly. Interceptors are called in the order they
+// were added, registered ones first.
+type Interceptor interface {
+	// OnHandshake is called once the hub has accepted a worker, with the
+	// protocol version and capabilities agreed. An error ends the hub
+	// session; the worker reconnects after --retry-delay.
+	OnHandshake(ctx context.Context, info HandshakeInfo) error
+
+	// OnRequest is consulted about every REQUEST after --hook and authorize
+	// plugins, and before --allow and --deny. Its Decision denies the
+	// request or rewrites its destination, as a hook's does; a later
+	// interceptor sees the rewritten request. An error denies it too.
+	OnRequest(ctx context.Context, req Request) (Decision, error)
+
+	// OnDialResult is called once the target of a CONNECT has been
+	// dialled, or could not be, with the REPLY status and error then.
+	OnDialResult(ctx context.Context, req Request, info SessionInfo)
+
+	// OnBridgeClose is called when a bridged CONNECT ends, with its byte
+	// counts, duration and teardown reason.
+	OnBridgeClose(ctx context.Context, req Request, info SessionInfo)
+}
+
+// HandshakeInfo describes an accepted hub session to OnHandshake.
+type HandshakeInfo struct {
+	Worker  int      // the worker's ID, as on the admin socket
+	Hub     string   // the hub's host:port
+	Version int      // control protocol version
+	Caps    []string // capabilities the hub acknowledged, sorted
+}
+
+// NopInterceptor does nothing and allows every request. Embed it in an
+// Interceptor that needs only some of the methods.
+type NopInterceptor struct{}
+
+func (NopInterceptor) OnHandshake(context.Context, HandshakeInfo) error { return nil }
+func (NopInterceptor) OnRequest(context.Context, Request) (Decision, error) {
+	return Decision{}, nil
+}
+func (NopInterceptor) OnDialResult(context.Context, Request, SessionInfo)  {}
+func (NopInterceptor) OnBridgeClose(context.Context, Request, SessionInfo) {}
+
+var (
+	registeredMu           sync.Mutex
+	registeredInterceptors []Interceptor
+)
+
+// RegisterInterceptor adds i to every pool this program runs, for
+// extensions compiled into poolgo. Call it from an init function.
+func RegisterInterceptor(i Interceptor) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registeredInterceptors = append(registeredInterceptors, i)
+}
+
+// AddInterceptor makes s call i. Call it before Run.
+func (s *Supervisor) AddInterceptor(i Interceptor) {
+	s.interceptors = append(s.interceptors, i)
+}
+
+// interceptorAuthorizer lets an Interceptor take part in authorize.
+type interceptorAuthorizer struct{ Interceptor }
+
+func (a interceptorAuthorizer) Decide(ctx context.Context, req *Request, _ Mode, _ map[string]string, _ *log.Logger) (Decision, error) {
+	return a.OnRequest(ctx, *req)
+}
+
+// handshake calls OnHandshake on every interceptor and returns the first
+// error.
+func (s *Supervisor) handshake(ctx context.Context, info HandshakeInfo) error {
+	for _, i := range s.interceptors {
+		if err := i.OnHandshake(ctx, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialResult calls OnDialResult on every interceptor.
+func (s *Supervisor) dialResult(ctx context.Context, req *Request, info SessionInfo) {
+	for _, i := range s.interceptors {
+		i.OnDialResult(ctx, *req, info)
+	}
+}
+
+// bridgeClosed calls OnBridgeClose on every interceptor.
+func (s *Supervisor) bridgeClosed(ctx context.Context, req *Request, info SessionInfo) {
+	for _, i := range s.interceptors {
+		i.OnBridgeClose(ctx, *req, info)
+	}
+}
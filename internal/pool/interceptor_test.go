@@ -0,0 +1,142 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is an Interceptor that denies port 23, sends port 1 to
+// target, and records what it saw.
+type recorder struct {
+	NopInterceptor
+	target int
+
+	mu        sync.Mutex
+	handshake HandshakeInfo
+	requests  []string
+	dialled   []SessionInfo
+	closed    chan SessionInfo
+}
+
+func (r *recorder) OnHandshake(_ context.Context, info HandshakeInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handshake = info
+	return nil
+}
+
+func (r *recorder) OnRequest(_ context.Context, req Request) (Decision, error) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.hostPort())
+	r.mu.Unlock()
+	switch req.Port {
+	case 23:
+		return Decision{Deny: true, Reason: "no telnet"}, nil
+	case 1:
+		return Decision{Port: r.target}, nil
+	}
+	return Decision{}, nil
+}
+
+func (r *recorder) OnDialResult(_ context.Context, _ Request, info SessionInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dialled = append(r.dialled, info)
+}
+
+func (r *recorder) OnBridgeClose(_ context.Context, _ Request, info SessionInfo) {
+	r.closed <- info
+}
+
+func TestInterceptor(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	r := &recorder{target: ln.Addr().(*net.TCPAddr).Port, closed: make(chan SessionInfo, 1)}
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, HubHost: "hub.example", HubPort: 7000})
+	s.AddInterceptor(r)
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK CAPS cancel\nREQUEST CONNECT ipv4 127.0.0.1 23 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 2 ") {
+		t.Fatalf("request the interceptor denied answered %q", line)
+	}
+	fmt.Fprintf(hub, "REQUEST CONNECT ipv4 127.0.0.1 1 2\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 0 ") {
+		t.Fatalf("request the interceptor rewrote answered %q", line)
+	}
+	io.WriteString(hub, "hi")
+	hub.(*net.TCPConn).CloseWrite()
+	if echoed, err := io.ReadAll(reader); err != nil || string(echoed) != "hi" {
+		t.Fatalf("bridge echoed %q (%v)", echoed, err)
+	}
+	closed := <-r.closed
+	hub.Close()
+	<-done
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.handshake.Hub != "hub.example:7000" || r.handshake.Version != 1 || len(r.handshake.Caps) != 1 || r.handshake.Caps[0] != "cancel" {
+		t.Errorf("OnHandshake got %+v", r.handshake)
+	}
+	if len(r.requests) != 2 || r.requests[0] != "127.0.0.1:23" || r.requests[1] != "127.0.0.1:1" {
+		t.Errorf("OnRequest saw %q", r.requests)
+	}
+	if len(r.dialled) != 1 || r.dialled[0].Port != r.target || r.dialled[0].Err != nil {
+		t.Errorf("OnDialResult got %+v", r.dialled)
+	}
+	if closed.ID != "2" || closed.BytesOut != 2 || closed.BytesIn != 2 || closed.Reason == "" {
+		t.Errorf("OnBridgeClose got %+v", closed)
+	}
+}
+
+// refuser turns every hub session away.
+type refuser struct{ NopInterceptor }
+
+func (refuser) OnHandshake(context.Context, HandshakeInfo) error {
+	return errors.New("hub not on the list")
+}
+
+func TestInterceptorRefusesHandshake(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	s.AddInterceptor(refuser{})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	bufio.NewReader(hub).ReadString('\n')
+	io.WriteString(hub, "OK\n")
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "hub not on the list") {
+		t.Fatalf("handleHubSession = %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// k8sPrefix marks domain targets that name a Kubernetes service when
+// --kubeconfig is set: "k8s:<namespace>/<service>", connecting to the
+// service port the request asks for, or "k8s:<namespace>/<service>:<port>"
+// naming the service port by name or number instead.
+const k8sPrefix = "k8s:"
+
+// kubeconfigInCluster as --kubeconfig uses the service account of the pod
+// poolgo runs in.
+const kubeconfigInCluster = "in-cluster"
+
+// serviceAccountDir is where Kubernetes mounts a pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sTarget reports whether host names a Kubernetes service.
+func k8sTarget(host string) bool {
+	return strings.HasPrefix(host, k8sPrefix)
+}
+
+// k8sClient looks services up through the Kubernetes API. Like
+// containerClient it caches nothing, so replaced pods are found at their
+// new addresses.
+type k8sClient struct {
+	server    string
+	http      *http.Client
+	token     string
+	tokenFile string // read for every request, as projected tokens rotate
+}
+
+// newK8sClient connects to the cluster --kubeconfig names.
+func newK8sClient(kubeconfig string) (*k8sClient, error) {
+	if kubeconfig == kubeconfigInCluster {
+		return inClusterK8s()
+	}
+	return loadKubeconfig(kubeconfig)
+}
+
+// inClusterK8s uses the API server and service account Kubernetes provides
+// to every pod.
+func inClusterK8s() (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account's ca.crt")
+	}
+	return &k8sClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		http:      &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}},
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+	}, nil
+}
+
+// kubeconfig is the part of a kubeconfig file poolgo understands.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Exec                  any    `yaml:"exec"`
+			AuthProvider          any    `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// loadKubeconfig connects to the cluster of the file's current context
+// with its user's token or client certificate. Credential plugins are not
+// supported: a bastion has no one to complete a browser login.
+func loadKubeconfig(path string) (*k8sClient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no current context", path)
+	}
+	// Files named in a kubeconfig are relative to it.
+	dir := filepath.Dir(path)
+	read := func(file, inline string) ([]byte, error) {
+		if inline != "" {
+			return base64.StdEncoding.DecodeString(inline)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return os.ReadFile(file)
+	}
+
+	client := &k8sClient{}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	found = false
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		cfg.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := read(c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: certificate authority: %v", clusterName, err)
+		}
+		if ca != nil {
+			cfg.RootCAs = x509.NewCertPool()
+			if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("cluster %s: no certificates in its certificate authority", clusterName)
+			}
+		}
+	}
+	if !found || client.server == "" {
+		return nil, fmt.Errorf("%s: cluster %q has no server", path, clusterName)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			client.tokenFile = u.User.TokenFile
+			if !filepath.IsAbs(client.tokenFile) {
+				client.tokenFile = filepath.Join(dir, client.tokenFile)
+			}
+		}
+		certPEM, err := read(u.User.ClientCertificate, u.User.ClientCertificateData)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: client certificate: %v", userName, err)
+		}
+		keyPEM, err := read(u.User.ClientKey, u.User.ClientKeyData)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: client key: %v", userName, err)
+		}
+		if certPEM != nil {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %v", userName, err)
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+		if client.token == "" && client.tokenFile == "" && certPEM == nil && (u.User.Exec != nil || u.User.AuthProvider != nil) {
+			return nil, fmt.Errorf("user %s: credential plugins are not supported; use a token or client certificate", userName)
+		}
+	}
+	client.http = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	return client, nil
+}
+
+// k8sServicePort is a port of a Service.
+type k8sServicePort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+// lookup returns the addresses and ports of the ready pods behind the
+// service host names, in random order so sessions spread across them.
+// port is the requested port, the service port unless host names one.
+func (c *k8sClient) lookup(ctx context.Context, host string, port int) ([]netip.AddrPort, error) {
+	ref := strings.TrimPrefix(host, k8sPrefix)
+	namespace, service, _ := strings.Cut(ref, "/")
+	service, portRef, named := strings.Cut(service, ":")
+	if !validK8sName(namespace) || !validK8sName(service) || named && portRef == "" {
+		return nil, lookupError(host, errors.New("expected k8s:<namespace>/<service>[:<port>]"))
+	}
+	if !named {
+		portRef = strconv.Itoa(port)
+	}
+
+	var svc struct {
+		Spec struct {
+			Ports []k8sServicePort `json:"ports"`
+		} `json:"spec"`
+	}
+	found, err := c.get(ctx, "/api/v1/namespaces/"+namespace+"/services/"+service, &svc)
+	if err != nil {
+		return nil, lookupError(host, err)
+	}
+	if !found {
+		return nil, lookupError(host, errors.New("no such service"))
+	}
+	var sp *k8sServicePort
+	for i, p := range svc.Spec.Ports {
+		if p.Name == portRef || strconv.Itoa(p.Port) == portRef {
+			sp = &svc.Spec.Ports[i]
+		}
+	}
+	if sp == nil {
+		return nil, lookupError(host, fmt.Errorf("service has no port %s", portRef))
+	}
+
+	// EndpointSlices name their ports after the service port, so the pods'
+	// target port is found even when it is named in the pod spec.
+	var slices struct {
+		Items []struct {
+			Endpoints []struct {
+				Addresses  []string `json:"addresses"`
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+			Ports []struct {
+				Name *string `json:"name"`
+				Port *int    `json:"port"`
+			} `json:"ports"`
+		} `json:"items"`
+	}
+	selector := url.QueryEscape("kubernetes.io/service-name=" + service)
+	if _, err := c.get(ctx, "/apis/discovery.k8s.io/v1/namespaces/"+namespace+"/endpointslices?labelSelector="+selector, &slices); err != nil {
+		return nil, lookupError(host, err)
+	}
+	var targets []netip.AddrPort
+	for _, slice := range slices.Items {
+		podPort := 0
+		for _, p := range slice.Ports {
+			if p.Port != nil && (p.Name == nil && sp.Name == "" || p.Name != nil && *p.Name == sp.Name) {
+				podPort = *p.Port
+			}
+		}
+		if podPort <= 0 || podPort > 65535 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, a := range ep.Addresses {
+				if ip, err := netip.ParseAddr(a); err == nil {
+					targets = append(targets, netip.AddrPortFrom(ip, uint16(podPort)))
+				}
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return nil, lookupError(host, errors.New("service has no ready endpoints"))
+	}
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	return targets, nil
+}
+
+// get decodes the JSON answer to an API request into v. It reports false
+// for a 404.
+func (c *k8sClient) get(ctx context.Context, path string, v any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path, nil)
+	if err != nil {
+		return false, err
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return false, fmt.Errorf("kubernetes token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("kubernetes API: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode != http.StatusOK:
+		return false, fmt.Errorf("kubernetes API: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("kubernetes API: %w", err)
+	}
+	return true, nil
+}
+
+// validK8sName reports whether name can be a namespace or service name,
+// a DNS label of lower-case letters, digits and dashes.
+func validK8sName(name string) bool {
+	if name == "" || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
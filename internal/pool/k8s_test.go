@@ -0,0 +1,137 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeK8s serves the web service in namespace lab, whose port 80 ("http")
+// maps to podPort on a ready pod at 127.0.0.1 and an unready one, and
+// writes a kubeconfig for it.
+func fakeK8s(t *testing.T, podPort int) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/lab/services/web", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"spec":{"ports":[{"name":"http","port":80},{"name":"metrics","port":9090}]}}`)
+	})
+	mux.HandleFunc("/api/v1/namespaces/lab/services/idle", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"spec":{"ports":[{"port":80}]}}`)
+	})
+	mux.HandleFunc("/apis/discovery.k8s.io/v1/namespaces/lab/endpointslices", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+			fmt.Fprint(w, `{"items":[]}`)
+			return
+		}
+		fmt.Fprintf(w, `{"items":[{"endpoints":[{"addresses":["127.0.0.1"],"conditions":{"ready":true}},`+
+			`{"addresses":["10.0.0.9"],"conditions":{"ready":false}}],"ports":[{"name":"http","port":%d},{"name":"metrics","port":9100}]}]}`, podPort)
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0o600)
+	path := filepath.Join(dir, "kubeconfig")
+	os.WriteFile(path, []byte(`apiVersion: v1
+kind: Config
+current-context: lab
+contexts:
+- name: other
+  context: {cluster: nowhere, user: nobody}
+- name: lab
+  context: {cluster: lab, user: bastion}
+clusters:
+- name: lab
+  cluster:
+    server: `+srv.URL+`
+users:
+- name: bastion
+  user:
+    tokenFile: token
+`), 0o600)
+	return path
+}
+
+func TestK8sLookup(t *testing.T) {
+	c, err := loadKubeconfig(fakeK8s(t, 8080))
+	if err != nil {
+		t.Fatalf("loadKubeconfig: %v", err)
+	}
+	for _, tc := range []struct {
+		host string
+		port int
+		want string
+	}{
+		{"k8s:lab/web", 80, "[127.0.0.1:8080]"},
+		{"k8s:lab/web:http", 443, "[127.0.0.1:8080]"},
+		{"k8s:lab/web:9090", 0, "[127.0.0.1:9100]"},
+	} {
+		got, err := c.lookup(context.Background(), tc.host, tc.port)
+		if err != nil || fmt.Sprint(got) != tc.want {
+			t.Errorf("lookup(%q, %d) = %v, %v; want %s", tc.host, tc.port, got, err, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"k8s:lab/web:https", "service has no port https"},
+		{"k8s:lab/missing", "no such service"},
+		{"k8s:lab/idle", "no ready endpoints"},
+		{"k8s:Lab/web", "expected k8s:<namespace>/<service>"},
+		{"k8s:web", "expected k8s:<namespace>/<service>"},
+	} {
+		if _, err := c.lookup(context.Background(), tc.host, 80); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("lookup(%q) = %v, want an error containing %q", tc.host, err, tc.want)
+		}
+	}
+}
+
+func TestLoadKubeconfigRejectsPlugins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	os.WriteFile(path, []byte(`current-context: eks
+contexts: [{name: eks, context: {cluster: eks, user: sso}}]
+clusters: [{name: eks, cluster: {server: "https://eks.example"}}]
+users: [{name: sso, user: {exec: {command: aws}}}]
+`), 0o600)
+	if _, err := loadKubeconfig(path); err == nil || !strings.Contains(err.Error(), "credential plugins") {
+		t.Fatalf("loadKubeconfig: %v", err)
+	}
+}
+
+func TestDialTargetK8s(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	s := NewSupervisor(Options{Mode: ModeSocks})
+	if s.k8s, err = newK8sClient(fakeK8s(t, ln.Addr().(*net.TCPAddr).Port)); err != nil {
+		t.Fatalf("newK8sClient: %v", err)
+	}
+	conn, err := s.dialTarget(context.Background(), &Request{AddrType: AddrDomain, Address: "k8s:lab/web", Port: 80}, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,31 @@
+package pool
+
+import (
+	"net"
+	"time"
+)
+
+// defaultKeepAlive is the idle time and probe interval for TCP keepalives
+// when --tcp-keepalive and --tcp-keepalive-interval are not given, the same
+// as net.Dialer's.
+const defaultKeepAlive = 15 * time.Second
+
+// setKeepAlive configures d's keepalives for hub and target connections.
+// Probes start after --tcp-keepalive of silence and repeat every
+// --tcp-keepalive-interval; the kernel's probe count decides when an
+// unanswered connection is reset, which fails the bridge or the hub read
+// blocked on it.
+func (o *Options) setKeepAlive(d *net.Dialer) {
+	if o.KeepAlive < 0 {
+		d.KeepAlive = -1
+		d.KeepAliveConfig = net.KeepAliveConfig{}
+		return
+	}
+	d.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: o.KeepAlive, Interval: o.KeepAliveInterval, Count: -1}
+	if d.KeepAliveConfig.Idle == 0 {
+		d.KeepAliveConfig.Idle = defaultKeepAlive
+	}
+	if d.KeepAliveConfig.Interval == 0 {
+		d.KeepAliveConfig.Interval = defaultKeepAlive
+	}
+}
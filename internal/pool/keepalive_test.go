@@ -0,0 +1,64 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTargetKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	req := &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	for _, tc := range []struct {
+		opts           Options
+		enabled        bool
+		idle, interval int
+	}{
+		{Options{}, true, 15, 15},
+		{Options{KeepAlive: time.Minute, KeepAliveInterval: 5 * time.Second}, true, 60, 5},
+		{Options{KeepAlive: -1}, false, 0, 0},
+	} {
+		conn, err := NewSupervisor(tc.opts).dialTarget(context.Background(), req, nil)
+		if err != nil {
+			t.Fatalf("dialTarget: %v", err)
+		}
+		raw, _ := conn.(*net.TCPConn).SyscallConn()
+		raw.Control(func(fd uintptr) {
+			on, _ := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+			idle, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+			interval, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)
+			if (on != 0) != tc.enabled || tc.enabled && (idle != tc.idle || interval != tc.interval) {
+				t.Errorf("%+v: SO_KEEPALIVE %d, TCP_KEEPIDLE %d, TCP_KEEPINTVL %d", tc.opts, on, idle, interval)
+			}
+		})
+		conn.Close()
+	}
+}
+
+func TestParseArgsKeepAlive(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--tcp-keepalive", "0"})
+	if err != nil || opts.KeepAlive >= 0 {
+		t.Fatalf("--tcp-keepalive 0 did not disable keepalives: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--tcp-keepalive-interval", "0"}); err == nil {
+		t.Fatalf("ParseArgs accepted --tcp-keepalive-interval 0")
+	}
+}
@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// delayedChunks bounds how much target data a delayedReader holds, in
+// reads of up to readAheadChunk bytes.
+const delayedChunks = 16
+
+// delayedChunk is one read from the target and when it happened.
+type delayedChunk struct {
+	data []byte
+	err  error
+	at   time.Time
+}
+
+// delayedReader implements --simulate-latency for data from the target. It
+// hands out every read latency after it arrived, as a longer path would,
+// and keeps reading meanwhile so throughput is not cut to one read per
+// delay.
+type delayedReader struct {
+	latency time.Duration
+	chunks  chan delayedChunk
+	done    chan struct{}
+
+	cur []byte
+	err error
+}
+
+// newDelayedReader starts reading r. Call close once the bridge has ended.
+func newDelayedReader(r io.Reader, latency time.Duration) *delayedReader {
+	d := &delayedReader{
+		latency: latency,
+		chunks:  make(chan delayedChunk, delayedChunks),
+		done:    make(chan struct{}),
+	}
+	go d.fill(r)
+	return d
+}
+
+func (d *delayedReader) fill(r io.Reader) {
+	for {
+		buf := make([]byte, readAheadChunk)
+		n, err := r.Read(buf)
+		select {
+		case d.chunks <- delayedChunk{data: buf[:n], err: err, at: time.Now()}:
+		case <-d.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (d *delayedReader) Read(p []byte) (int, error) {
+	for len(d.cur) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		var c delayedChunk
+		select {
+		case c = <-d.chunks:
+		case <-d.done:
+			return 0, net.ErrClosed
+		}
+		if wait := time.Until(c.at.Add(d.latency)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-d.done:
+				timer.Stop()
+				return 0, net.ErrClosed
+			}
+		}
+		d.cur, d.err = c.data, c.err
+	}
+	n := copy(p, d.cur)
+	d.cur = d.cur[n:]
+	return n, nil
+}
+
+// close stops delivering data. A read already blocked on the target returns
+// when the target connection is closed.
+func (d *delayedReader) close() {
+	close(d.done)
+}
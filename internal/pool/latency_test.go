@@ -0,0 +1,93 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDelayedReader(t *testing.T) {
+	target, remote := net.Pipe()
+	defer target.Close()
+	d := newDelayedReader(target, 100*time.Millisecond)
+	defer d.close()
+
+	start := time.Now()
+	go func() {
+		for _, chunk := range []string{"one ", "two ", "three"} {
+			remote.Write([]byte(chunk))
+		}
+		remote.Close()
+	}()
+	got, err := io.ReadAll(d)
+	elapsed := time.Since(start)
+	if err != nil || string(got) != "one two three" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	// Each read is held back by the latency, but they overlap rather than
+	// adding up.
+	if elapsed < 100*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Fatalf("took %s, want about the 100ms latency", elapsed)
+	}
+}
+
+func TestDelayedReaderClose(t *testing.T) {
+	target, remote := net.Pipe()
+	defer target.Close()
+	defer remote.Close()
+	d := newDelayedReader(target, time.Hour)
+	go remote.Write([]byte("late"))
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Read(make([]byte, 4))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	d.close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Read after close: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not wake a delayed Read")
+	}
+}
+
+func TestSimulateLatencyDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	s := NewSupervisor(Options{SimulateLatency: 80 * time.Millisecond})
+	req := &Request{Command: CommandConnect, AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+	start := time.Now()
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("dial took %s, want at least the 80ms latency", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.dialTarget(ctx, req, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled dial: %v", err)
+	}
+}
+
+func TestParseArgsSimulateLatency(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--simulate-latency", "80ms"})
+	if err != nil || opts.SimulateLatency != 80*time.Millisecond {
+		t.Fatalf("ParseArgs: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--simulate-latency", "-1s"}); err == nil {
+		t.Fatal("accepted a negative --simulate-latency")
+	}
+}
@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"contun/internal/logx"
+)
+
+// errOverloaded turns a CONNECT away while the host is busier than
+// --max-load or --max-cpu allow.
+var errOverloaded = errors.New("host overloaded")
+
+// loadInterval is how often the load monitor samples the host.
+const loadInterval = time.Second
+
+// loadSample is one reading of the host's load: the 1-minute load average,
+// and cumulative CPU time, in clock ticks, busy and in total.
+type loadSample struct {
+	load1       float64
+	cpus        int
+	busy, total uint64
+}
+
+// loadMonitor samples the host every loadInterval while --max-load or
+// --max-cpu is set and keeps the verdict for admit, so a CONNECT costs one
+// atomic load rather than a read of /proc.
+type loadMonitor struct {
+	read   func() (loadSample, error)
+	over   atomic.Pointer[error] // why sessions are turned away; nil while they are not
+	prev   loadSample
+	failed bool // the last read failed, logged once
+}
+
+// runLoadMonitor samples the host until ctx ends. A reload can set or
+// clear the thresholds at any time, so it keeps running without them and
+// just does not look.
+func (s *Supervisor) runLoadMonitor(ctx context.Context) {
+	ticker := time.NewTicker(loadInterval)
+	defer ticker.Stop()
+	for {
+		opts := s.link().opts
+		s.load.check(opts.MaxLoad, opts.MaxCPU, s.logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check takes a sample and decides whether sessions are to be turned
+// away, logging each change. A host that cannot be read admits sessions.
+func (m *loadMonitor) check(maxLoad, maxCPU float64, logger *log.Logger) {
+	if maxLoad <= 0 && maxCPU <= 0 {
+		m.set(nil, logger)
+		m.prev = loadSample{}
+		return
+	}
+	sample, err := m.read()
+	if err != nil {
+		if !m.failed {
+			logx.At(logger, "pool", logx.Warn).Printf("warning: cannot read the host load, admitting every session: %v", err)
+			m.failed = true
+		}
+		m.set(nil, logger)
+		return
+	}
+	m.failed = false
+	prev := m.prev
+	m.prev = sample
+
+	var over error
+	if perCPU := sample.load1 / float64(max(sample.cpus, 1)); maxLoad > 0 && perCPU > maxLoad {
+		over = fmt.Errorf("%w: load average %.2f per CPU is above --max-load %g", errOverloaded, perCPU, maxLoad)
+	}
+	// CPU use needs two samples; the first after a start or a reload only
+	// sets the baseline.
+	if total := sample.total - prev.total; maxCPU > 0 && over == nil && prev.total > 0 && total > 0 {
+		if busy := 100 * float64(sample.busy-prev.busy) / float64(total); busy > maxCPU {
+			over = fmt.Errorf("%w: CPU %.0f%% busy is above --max-cpu %g", errOverloaded, busy, maxCPU)
+		}
+	}
+	m.set(over, logger)
+}
+
+// set records over as the verdict and logs a change of it.
+func (m *loadMonitor) set(over error, logger *log.Logger) {
+	var prev error
+	if p := m.over.Load(); p != nil {
+		prev = *p
+	}
+	switch {
+	case over != nil && prev == nil:
+		logx.At(logger, "pool", logx.Warn).Printf("turning new sessions away: %v", over)
+	case over == nil && prev != nil:
+		logger.Printf("host load back under the limits; accepting new sessions")
+	}
+	if over == nil {
+		m.over.Store(nil)
+		return
+	}
+	m.over.Store(&over)
+}
+
+// admit returns errOverloaded, wrapped with the reason, while sessions
+// are to be turned away.
+func (m *loadMonitor) admit() error {
+	if over := m.over.Load(); over != nil {
+		return *over
+	}
+	return nil
+}
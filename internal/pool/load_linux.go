@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const loadSupported = true
+
+// readLoad reads the load average from /proc/loadavg and CPU time from
+// /proc/stat, whose cpu line sums every CPU's user, nice, system, idle,
+// iowait, irq, softirq and steal ticks.
+func readLoad() (loadSample, error) {
+	var sample loadSample
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return sample, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return sample, errors.New("/proc/loadavg is empty")
+	}
+	if sample.load1, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return sample, err
+	}
+
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return sample, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			sample.cpus++
+			continue
+		}
+		for i, field := range fields[1:min(len(fields), 9)] {
+			ticks, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return sample, err
+			}
+			sample.total += ticks
+			if i != 3 && i != 4 { // idle and iowait
+				sample.busy += ticks
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return sample, err
+	}
+	if sample.total == 0 {
+		return sample, errors.New("no cpu line in /proc/stat")
+	}
+	return sample, nil
+}
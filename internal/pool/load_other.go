@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pool
+
+import "errors"
+
+const loadSupported = false
+
+func readLoad() (loadSample, error) {
+	return loadSample{}, errors.New("host load is only read on Linux")
+}
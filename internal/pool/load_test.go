@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMonitor(t *testing.T) {
+	samples := []loadSample{
+		{load1: 3, cpus: 2, busy: 100, total: 1000},
+		{load1: 5, cpus: 2, busy: 200, total: 1100},
+		{load1: 1, cpus: 2, busy: 295, total: 1200},
+		{load1: 1, cpus: 2, busy: 300, total: 1300},
+	}
+	var readErr error
+	m := &loadMonitor{read: func() (loadSample, error) {
+		if readErr != nil {
+			return loadSample{}, readErr
+		}
+		sample := samples[0]
+		samples = samples[1:]
+		return sample, nil
+	}}
+	logger := log.New(io.Discard, "", 0)
+
+	m.check(2, 90, logger) // load 1.5 per CPU, and no CPU baseline yet
+	if err := m.admit(); err != nil {
+		t.Fatalf("first sample: %v", err)
+	}
+	m.check(2, 90, logger) // load 2.5 per CPU
+	if err := m.admit(); !errors.Is(err, errOverloaded) || !strings.Contains(err.Error(), "--max-load 2") {
+		t.Fatalf("load above --max-load: %v", err)
+	}
+	m.check(2, 90, logger) // 95% busy
+	if err := m.admit(); !errors.Is(err, errOverloaded) || !strings.Contains(err.Error(), "--max-cpu 90") {
+		t.Fatalf("CPU above --max-cpu: %v", err)
+	}
+	m.check(2, 90, logger) // 5% busy
+	if err := m.admit(); err != nil {
+		t.Fatalf("load back under the limits: %v", err)
+	}
+
+	m.over.Store(&errOverloaded)
+	readErr = errors.New("no /proc")
+	m.check(2, 90, logger)
+	if err := m.admit(); err != nil {
+		t.Fatalf("unreadable host load turned sessions away: %v", err)
+	}
+	m.over.Store(&errOverloaded)
+	m.check(0, 0, logger)
+	if err := m.admit(); err != nil {
+		t.Fatalf("thresholds cleared by a reload: %v", err)
+	}
+}
+
+func TestHubSessionOverloaded(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, MaxLoad: 1})
+	over := fmt.Errorf("%w: load average 4.00 per CPU is above --max-load 1", errOverloaded)
+	s.load.over.Store(&over)
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK\nREQUEST CONNECT ipv4 127.0.0.1 22 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 1 ") {
+		t.Fatalf("request to an overloaded host answered %q", line)
+	}
+}
+
+func TestParseArgsLoad(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-t", "db", "-T", "5432", "--max-load", "1.5", "--max-cpu", "90"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if opts.MaxLoad != 1.5 || opts.MaxCPU != 90 {
+		t.Fatalf("MaxLoad %g, MaxCPU %g", opts.MaxLoad, opts.MaxCPU)
+	}
+	for _, args := range [][]string{{"--max-load", "-1"}, {"--max-cpu", "-5"}, {"--max-cpu", "101"}} {
+		if _, err := ParseArgs(append([]string{"-p", "5555", "-t", "db", "-T", "5432"}, args...)); err == nil {
+			t.Errorf("accepted %q", args)
+		}
+	}
+}
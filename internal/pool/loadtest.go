@@ -0,0 +1,194 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// loadPayload is what each session of the load test echoes through its
+// target.
+const loadPayload = 16 * 1024
+
+// LoadResult is what the session load test measured.
+type LoadResult struct {
+	Sessions   int
+	Setup      time.Duration // from the first REQUEST until every session was bridged
+	Reply50    time.Duration // REQUEST to REPLY, median
+	Reply99    time.Duration
+	Goroutines float64       // the pool's, per open session
+	Memory     int64         // heap and stack bytes in use per open session
+	CPU        time.Duration // process CPU time per session; 0 if unknown
+}
+
+// benchSessions runs a pool of n workers in this process against a fake
+// hub, bridges a session on every worker at once to an echo target and
+// holds them all open while it takes its measurements.
+func benchSessions(n int) (LoadResult, error) {
+	res := LoadResult{Sessions: n}
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	hub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer hub.Close()
+
+	// Workers log through the standard logger; keep n sessions' worth of
+	// lines off the terminal, but pay for formatting them.
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(io.Discard)
+	defer func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	}()
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	s := NewSupervisor(Options{
+		Mode: ModeSocks, Protocol: 1, Workers: n, RetryDelay: time.Second,
+		HubHost: "127.0.0.1", HubPort: hub.Addr().(*net.TCPAddr).Port,
+	})
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run(ctx) }()
+
+	// Register every worker before the first REQUEST, as a hub would have
+	// them waiting.
+	conns := make([]net.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	readers := make([]*bufio.Reader, 0, n)
+	for len(conns) < n {
+		conn, err := hub.Accept()
+		if err != nil {
+			return res, err
+		}
+		conns = append(conns, conn)
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+		r := bufio.NewReader(conn)
+		if _, err := readLine(r); err != nil {
+			return res, fmt.Errorf("worker HELLO: %w", err)
+		}
+		if _, err := io.WriteString(conn, "OK\n"); err != nil {
+			return res, err
+		}
+		readers = append(readers, r)
+	}
+
+	request := fmt.Sprintf("REQUEST CONNECT ipv4 127.0.0.1 %d\n", target.Addr().(*net.TCPAddr).Port)
+	replies := make([]time.Duration, n)
+	errs := make(chan error, n)
+	var bridged sync.WaitGroup
+	bridged.Add(n)
+	cpuBefore, cpuKnown := processCPU()
+	start := time.Now()
+	for i := range conns {
+		go func() {
+			defer bridged.Done()
+			conn, r := conns[i], readers[i]
+			sent := time.Now()
+			if _, err := io.WriteString(conn, request); err != nil {
+				errs <- err
+				return
+			}
+			line, err := readLine(r)
+			if err != nil {
+				errs <- fmt.Errorf("worker REPLY: %w", err)
+				return
+			}
+			if len(line) < 7 || line[:7] != "REPLY 0" {
+				errs <- fmt.Errorf("worker answered %q", line)
+				return
+			}
+			replies[i] = time.Since(sent)
+			payload := make([]byte, loadPayload)
+			if _, err := conn.Write(payload); err != nil {
+				errs <- err
+				return
+			}
+			if _, err := io.ReadFull(r, payload); err != nil {
+				errs <- fmt.Errorf("echo: %w", err)
+			}
+		}()
+	}
+	bridged.Wait()
+	res.Setup = time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return res, err
+	}
+
+	runtime.GC()
+	var during runtime.MemStats
+	runtime.ReadMemStats(&during)
+	// Less the goroutine the echo target runs for each session.
+	res.Goroutines = float64(runtime.NumGoroutine()-goroutines-n) / float64(n)
+	res.Memory = (inUse(&during) - inUse(&before)) / int64(n)
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	conns = nil
+	cancel()
+	if err := <-ran; err != nil && !errors.Is(err, context.Canceled) {
+		return res, err
+	}
+	if cpuAfter, _ := processCPU(); cpuKnown {
+		res.CPU = (cpuAfter - cpuBefore) / time.Duration(n)
+	}
+	slices.Sort(replies)
+	res.Reply50, res.Reply99 = replies[n/2], replies[n*99/100]
+	return res, nil
+}
+
+// writeLoadResult prints res as a table.
+func writeLoadResult(out io.Writer, res LoadResult) error {
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "sessions\tsetup\treply p50\treply p99\tgoroutines/session\tmemory/session\tcpu/session")
+	cpu := "n/a"
+	if res.CPU > 0 {
+		cpu = res.CPU.Round(time.Microsecond).String()
+	}
+	fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%.1f\t%s KiB\t%s\n", res.Sessions, res.Setup.Round(time.Millisecond),
+		res.Reply50.Round(time.Microsecond), res.Reply99.Round(time.Microsecond),
+		res.Goroutines, strconv.FormatFloat(float64(res.Memory)/1024, 'f', 1, 64), cpu)
+	return w.Flush()
+}
+
+// inUse is the heap and goroutine stack memory m records in use.
+func inUse(m *runtime.MemStats) int64 {
+	return int64(m.HeapInuse) + int64(m.StackInuse)
+}
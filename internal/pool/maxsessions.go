@@ -0,0 +1,61 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errTooManySessions turns a CONNECT away while --max-sessions streams are
+// bridged and no slot freed up within --queue-timeout.
+var errTooManySessions = errors.New("too many sessions")
+
+// acquireSession takes one of the --max-sessions slots for a stream about
+// to be dialled, waiting up to --queue-timeout for one to free up. The
+// caller gives it back with releaseSession once the stream ends.
+func (s *Supervisor) acquireSession(ctx context.Context) error {
+	var timeout <-chan time.Time
+	for {
+		opts := s.link().opts
+		s.slotsMu.Lock()
+		if opts.MaxSessions <= 0 || s.slotsUsed < opts.MaxSessions {
+			s.slotsUsed++
+			s.slotsMu.Unlock()
+			return nil
+		}
+		freed := s.slotFreed
+		s.slotsMu.Unlock()
+		if opts.QueueTimeout <= 0 {
+			return errTooManySessions
+		}
+		if timeout == nil {
+			timer := time.NewTimer(opts.QueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			return errTooManySessions
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseSession gives back a slot taken by acquireSession.
+func (s *Supervisor) releaseSession() {
+	s.slotsMu.Lock()
+	s.slotsUsed--
+	s.slotsMu.Unlock()
+	s.wakeSessions()
+}
+
+// wakeSessions lets the requests waiting for a slot look again, after one
+// is released or a reload raised --max-sessions.
+func (s *Supervisor) wakeSessions() {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+	close(s.slotFreed)
+	s.slotFreed = make(chan struct{})
+}
@@ -0,0 +1,73 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireSession(t *testing.T) {
+	s := NewSupervisor(Options{MaxSessions: 1})
+	if err := s.acquireSession(context.Background()); err != nil {
+		t.Fatalf("first slot: %v", err)
+	}
+	if err := s.acquireSession(context.Background()); err != errTooManySessions {
+		t.Fatalf("second slot without --queue-timeout: %v", err)
+	}
+
+	s.opts.QueueTimeout = 5 * time.Second
+	s.current.Store(newLink(&s.opts))
+	time.AfterFunc(50*time.Millisecond, s.releaseSession)
+	if err := s.acquireSession(context.Background()); err != nil {
+		t.Fatalf("slot after release: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := s.acquireSession(ctx); err != context.Canceled {
+		t.Fatalf("cancelled wait: %v", err)
+	}
+}
+
+func TestHubSessionMaxSessions(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, MaxSessions: 1})
+	if err := s.acquireSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK\nREQUEST CONNECT ipv4 127.0.0.1 22 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 1 ") {
+		t.Fatalf("request past --max-sessions answered %q", line)
+	}
+}
+
+func TestHubSessionDeadline(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, MaxSessions: 1, QueueTimeout: time.Minute})
+	if err := s.acquireSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	started := time.Now()
+	fmt.Fprintf(hub, "OK CAPS deadline\nREQUEST CONNECT ipv4 127.0.0.1 22 1 deadline=100\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 6 ") {
+		t.Fatalf("request past its deadline answered %q", line)
+	}
+	if waited := time.Since(started); waited > 5*time.Second {
+		t.Fatalf("deadline of 100ms answered after %s", waited)
+	}
+}
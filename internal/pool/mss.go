@@ -0,0 +1,35 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// Bounds for --target-mss. Linux refuses values below 88; anything above
+// the largest IPv4 payload clamps nothing.
+const (
+	minTargetMSS = 88
+	maxTargetMSS = 65495
+)
+
+// mssControl wraps a dialer control function so target connections are
+// created with TCP_MAXSEG set to --target-mss. Setting it before connect
+// makes the SYN advertise the clamped MSS, so the target never sends
+// segments too large for a path whose PMTU discovery is broken.
+func (s *Supervisor) mssControl(next func(context.Context, string, string, syscall.RawConn) error) func(context.Context, string, string, syscall.RawConn) error {
+	mss := s.opts.TargetMSS
+	return func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) { opErr = setMSS(fd, mss) }); err != nil {
+			return err
+		}
+		if opErr != nil {
+			return fmt.Errorf("set --target-mss: %w", opErr)
+		}
+		if next != nil {
+			return next(ctx, network, address, c)
+		}
+		return nil
+	}
+}
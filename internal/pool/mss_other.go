@@ -0,0 +1,11 @@
+//go:build !unix || aix
+
+package pool
+
+import "errors"
+
+const mssSupported = false
+
+func setMSS(uintptr, int) error {
+	return errors.New("TCP_MAXSEG is not supported on this platform")
+}
@@ -0,0 +1,38 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTargetMSS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	s := NewSupervisor(Options{TargetMSS: 1000})
+	conn, err := s.dialTarget(context.Background(), &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: addr.Port}, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	defer conn.Close()
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	raw.Control(func(fd uintptr) {
+		if mss, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG); err != nil || mss > 1000 {
+			t.Errorf("TCP_MAXSEG = %d (%v), want at most 1000", mss, err)
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package pool
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netnsDir is where "ip netns add" mounts named network namespaces.
+const netnsDir = "/run/netns"
+
+// NetnsRule makes connections to targets in Network from inside another
+// network namespace on the bastion, such as a container network's. Netns is
+// a name under /run/netns or a path, as given.
+type NetnsRule struct {
+	Network netip.Prefix
+	Netns   string
+}
+
+func (r NetnsRule) String() string {
+	return r.Network.String() + " in " + r.Netns
+}
+
+// path returns the namespace file to enter.
+func (r NetnsRule) path() string {
+	if strings.Contains(r.Netns, "/") {
+		return r.Netns
+	}
+	return filepath.Join(netnsDir, r.Netns)
+}
+
+// ParseNetnsRule parses a --netns-rule value, "<cidr> in <netns>" or
+// "<cidr>=<netns>".
+func ParseNetnsRule(text string) (NetnsRule, error) {
+	network, netns, ok := strings.Cut(text, "=")
+	if fields := strings.Fields(text); !ok && len(fields) == 3 && fields[1] == "in" {
+		network, netns, ok = fields[0], fields[2], true
+	}
+	if !ok {
+		return NetnsRule{}, fmt.Errorf("expected <cidr> in <netns>, got %q", text)
+	}
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+	if err != nil {
+		return NetnsRule{}, fmt.Errorf("invalid network %q", network)
+	}
+	netns = strings.TrimSpace(netns)
+	if netns == "" || netns == "." || netns == ".." {
+		return NetnsRule{}, fmt.Errorf("invalid network namespace %q", netns)
+	}
+	return NetnsRule{Network: prefix.Masked(), Netns: netns}, nil
+}
+
+// netnsFor returns the namespace file for connections to ip: that of the
+// most specific rule whose network contains it.
+func netnsFor(rules []NetnsRule, ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	best := -1
+	for i, r := range rules {
+		if r.Network.Contains(ip) && (best < 0 || r.Network.Bits() > rules[best].Network.Bits()) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return rules[best].path(), true
+}
+
+// missingNetns returns the namespace files of rules that do not exist, which
+// every dial through them would fail to enter.
+func missingNetns(rules []NetnsRule) []string {
+	var missing []string
+	for _, r := range rules {
+		if _, err := os.Stat(r.path()); err != nil {
+			missing = append(missing, r.path())
+		}
+	}
+	return missing
+}
@@ -0,0 +1,59 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const netnsSupported = true
+
+// dialInNetns connects to address from inside the network namespace at
+// path. The namespace belongs to the OS thread, so the dial runs on a
+// goroutine locked to its own thread, which enters the namespace, creates
+// and connects the socket and switches back. The socket keeps the namespace
+// it was created in. Should switching back fail, the goroutine exits still
+// locked and the runtime discards the thread, so no other goroutine ever
+// runs in the wrong namespace.
+func dialInNetns(ctx context.Context, dialer net.Dialer, path, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		conn, restored, err := dialLocked(ctx, dialer, path, address)
+		if restored {
+			runtime.UnlockOSThread()
+		}
+		done <- result{conn, err}
+	}()
+	r := <-done
+	return r.conn, r.err
+}
+
+// dialLocked does the work of dialInNetns on a locked thread. restored
+// reports whether the thread is back in its own namespace.
+func dialLocked(ctx context.Context, dialer net.Dialer, path, address string) (conn net.Conn, restored bool, err error) {
+	own, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		return nil, true, fmt.Errorf("open own netns: %w", err)
+	}
+	defer own.Close()
+	target, err := os.Open(path)
+	if err != nil {
+		return nil, true, fmt.Errorf("open netns: %w", err)
+	}
+	defer target.Close()
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		return nil, true, fmt.Errorf("enter netns %s: %w", path, err)
+	}
+	conn, err = dialer.DialContext(ctx, "tcp", address)
+	restored = unix.Setns(int(own.Fd()), unix.CLONE_NEWNET) == nil
+	return conn, restored, err
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+const netnsSupported = false
+
+func dialInNetns(context.Context, net.Dialer, string, string) (net.Conn, error) {
+	return nil, errors.New("network namespaces are only supported on Linux")
+}
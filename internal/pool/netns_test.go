@@ -0,0 +1,94 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestParseNetnsRule(t *testing.T) {
+	for text, want := range map[string]string{
+		"10.88.0.0/16 in podman":           "10.88.0.0/16 in podman",
+		"10.88.1.2/16=/proc/42/ns/net":     "10.88.0.0/16 in /proc/42/ns/net",
+		"fd00::/8 in /run/netns/blue":      "fd00::/8 in /run/netns/blue",
+		"10.89.0.0/16 = /var/run/netns/ci": "10.89.0.0/16 in /var/run/netns/ci",
+	} {
+		rule, err := ParseNetnsRule(text)
+		if err != nil || rule.String() != want {
+			t.Errorf("ParseNetnsRule(%q) = %v, %v; want %s", text, rule, err, want)
+		}
+	}
+	for _, text := range []string{"10.88.0.0/16", "10.88.0.0/16 in", "podman in 10.88.0.0/16", "10.88.0.0/16 via podman", "10.88.0.0/16=.."} {
+		if _, err := ParseNetnsRule(text); err == nil {
+			t.Errorf("ParseNetnsRule(%q) accepted an invalid rule", text)
+		}
+	}
+}
+
+func TestNetnsFor(t *testing.T) {
+	var rules []NetnsRule
+	for _, text := range []string{"10.0.0.0/8 in outer", "10.88.0.0/16 in /proc/42/ns/net"} {
+		rule, _ := ParseNetnsRule(text)
+		rules = append(rules, rule)
+	}
+	for ip, want := range map[string]string{
+		"10.1.2.3":         "/run/netns/outer",
+		"10.88.2.3":        "/proc/42/ns/net",
+		"::ffff:10.88.2.3": "/proc/42/ns/net",
+		"192.168.1.1":      "",
+		"fd00::1":          "",
+	} {
+		got, _ := netnsFor(rules, netip.MustParseAddr(ip))
+		if got != want {
+			t.Errorf("netnsFor(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestDialTargetNetnsRule(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("network namespaces are Linux only")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	req := &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	// Entering the namespace the test already runs in is enough to exercise
+	// the switch there and back.
+	rule, _ := ParseNetnsRule("127.0.0.0/8 in /proc/self/ns/net")
+	s := NewSupervisor(Options{Mode: ModeSocks, NetnsRules: []NetnsRule{rule}})
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("entering a network namespace is not permitted here")
+	}
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Close()
+
+	rule, _ = ParseNetnsRule("127.0.0.0/8 in contun-missing")
+	s = NewSupervisor(Options{Mode: ModeSocks, NetnsRules: []NetnsRule{rule}})
+	if _, err := s.dialTarget(context.Background(), req, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dialTarget through a missing namespace: %v", err)
+	}
+	if missing := missingNetns([]NetnsRule{rule}); len(missing) != 1 || missing[0] != "/run/netns/contun-missing" {
+		t.Fatalf("missingNetns = %v", missing)
+	}
+}
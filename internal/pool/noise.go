@@ -0,0 +1,36 @@
+package pool
+
+import (
+	"fmt"
+
+	"contun/internal/secure"
+)
+
+// noisePrologue is mixed into every Noise handshake on the hub link.
+var noisePrologue = []byte(secure.Prologue)
+
+// noiseConfig builds the initiator configuration for --noise-hub-key. Without
+// --noise-key the worker uses a key generated for this run, which encrypts
+// the link but gives the hub nothing stable to pin.
+func (o *Options) noiseConfig() (*secure.Config, bool, error) {
+	hubKey, err := secure.ReadPublicKey(o.NoiseHubKeyFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("read --noise-hub-key: %w", err)
+	}
+	cfg := &secure.Config{PeerKey: hubKey, Prologue: noisePrologue}
+	if o.NoiseKeyFile == "" {
+		if cfg.StaticKey, err = secure.GenerateKey(); err != nil {
+			return nil, false, err
+		}
+		return cfg, true, nil
+	}
+	text, err := LoadSecret(o.NoiseKeyFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("read --noise-key: %w", err)
+	}
+	defer text.Wipe()
+	if cfg.StaticKey, err = secure.ParsePrivateKey(text.Bytes()); err != nil {
+		return nil, false, fmt.Errorf("--noise-key: %w", err)
+	}
+	return cfg, false, nil
+}
@@ -0,0 +1,66 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"contun/internal/secure"
+)
+
+func TestHubSessionNoise(t *testing.T) {
+	hubKey, _ := secure.GenerateKey()
+	workerKey, _ := secure.GenerateKey()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	s.link().noise = &secure.Config{StaticKey: workerKey, PeerKey: hubKey.PublicKey(), Prologue: noisePrologue}
+	worker, hub := net.Pipe()
+	defer hub.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	line, _ := bufio.NewReader(hub).ReadString('\n')
+	if !strings.Contains(line, "CAPS cancel,noise") {
+		t.Fatalf("HELLO did not advertise noise: %q", line)
+	}
+	hub.Write([]byte("OK CAPS noise\n"))
+	conn, err := secure.Server(hub, secure.Config{StaticKey: hubKey, Prologue: noisePrologue})
+	if err != nil {
+		t.Fatalf("hub handshake: %v", err)
+	}
+	if !conn.PeerKey().Equal(workerKey.PublicKey()) {
+		t.Fatalf("hub saw the wrong worker key")
+	}
+
+	port := target.Addr().(*net.TCPAddr).Port
+	conn.Write([]byte("REQUEST CONNECT ipv4 127.0.0.1 " + strconv.Itoa(port) + "\n"))
+	reader := bufio.NewReader(conn)
+	if reply, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q: %v", reply, err)
+	}
+	if data, err := io.ReadAll(reader); err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected stream %q: %v", data, err)
+	}
+	conn.Close()
+	<-done
+}
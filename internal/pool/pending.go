@@ -0,0 +1,130 @@
+package pool
+
+import (
+	"strings"
+	"sync"
+)
+
+// pendingQueue holds the REQUESTs a hub that accepted the "queue"
+// capability sent while the worker was still busy with an earlier one. It
+// replaces the implicit buffering of whatever happened to sit in the reader:
+// at most limit requests wait, in arrival order, and one more is answered
+// "RETRY <session>" at once so the hub can hand it to another worker.
+// A nil *pendingQueue queues nothing.
+type pendingQueue struct {
+	s     *Supervisor
+	limit int
+
+	mu        sync.Mutex
+	lines     []string
+	cancelled map[string]bool // queued sessions the hub has since cancelled
+}
+
+func (s *Supervisor) newPendingQueue(limit int) *pendingQueue {
+	return &pendingQueue{s: s, limit: limit, cancelled: make(map[string]bool)}
+}
+
+// offer handles a control message that arrived while the worker was busy.
+// It reports whether the message was a REQUEST or a CANCEL for one that is
+// queued, and so has been dealt with; a full queue answers the REQUEST with
+// RETRY on writer.
+func (q *pendingQueue) offer(line string, writer *controlWriter) bool {
+	if q == nil {
+		return false
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 2 && fields[0] == "CANCEL" {
+		return q.cancel(fields[1])
+	}
+	if len(fields) == 0 || fields[0] != "REQUEST" {
+		return false
+	}
+	q.mu.Lock()
+	full := len(q.lines) >= q.limit
+	if !full {
+		q.lines = append(q.lines, line)
+		q.s.pending.Add(1)
+	}
+	q.mu.Unlock()
+	if full {
+		q.s.pendingRejected.Add(1)
+		writer.sendNotice("RETRY " + requestSessionID(line))
+	}
+	return true
+}
+
+// take returns the oldest queued REQUEST and whether the hub cancelled it
+// while it waited.
+func (q *pendingQueue) take() (line string, cancelled bool, ok bool) {
+	if q == nil {
+		return "", false, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.lines) == 0 {
+		return "", false, false
+	}
+	line, q.lines = q.lines[0], q.lines[1:]
+	q.s.pending.Add(-1)
+	id := requestSessionID(line)
+	cancelled = q.cancelled[id]
+	delete(q.cancelled, id)
+	return line, cancelled, true
+}
+
+// cancel marks a queued session as cancelled. It reports whether the
+// session was queued.
+func (q *pendingQueue) cancel(id string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, line := range q.lines {
+		if requestSessionID(line) == id {
+			q.cancelled[id] = true
+			return true
+		}
+	}
+	return false
+}
+
+// release answers every request still queued with RETRY, for when the
+// worker stops serving the hub connection.
+func (q *pendingQueue) release(writer *controlWriter) {
+	for {
+		line, _, ok := q.take()
+		if !ok {
+			return
+		}
+		writer.sendNotice("RETRY " + requestSessionID(line))
+	}
+}
+
+// queueingSource passes the REQUESTs a busy worker reads, while watching
+// for CANCEL during a dial or scan, to the pending queue instead of
+// dropping them.
+type queueingSource struct {
+	controlSource
+	queue  *pendingQueue
+	writer *controlWriter
+}
+
+func (q queueingSource) takeControl() (string, bool) {
+	for {
+		line, ok := q.controlSource.takeControl()
+		if !ok || !q.queue.offer(line, q.writer) {
+			return line, ok
+		}
+	}
+}
+
+// requestSessionID returns the session ID of a REQUEST line, or "" for one
+// without an ID or that does not parse.
+func requestSessionID(line string) string {
+	req, err := ParseRequest(line)
+	if err != nil {
+		return ""
+	}
+	return req.SessionID
+}
@@ -0,0 +1,101 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingRequests(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			c, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Write([]byte("bye"))
+				c.Close()
+			}()
+		}
+	}()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 2, PendingRequests: 1})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, ",queue") {
+		t.Fatalf("HELLO %q does not offer queue", line)
+	}
+	hub.Write([]byte("OK CAPS cancel,queue\n"))
+	frames := NewFrameConn(hub, reader)
+	request := func(id string) string {
+		return "REQUEST CONNECT ipv4 127.0.0.1 " + strconv.Itoa(target.Addr().(*net.TCPAddr).Port) + " " + id
+	}
+	frames.WriteControl(request("1"))
+	if reply, err := frames.ReadControl(); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("reply to 1: %q, %v", reply, err)
+	}
+
+	// While 1 is bridging, 2 fills the queue, 3 is turned away and a
+	// CANCEL reaches 2 in the queue.
+	frames.WriteControl(request("2"))
+	frames.WriteControl(request("3"))
+	if line, err := frames.ReadControl(); err != nil || line != "RETRY 3" {
+		t.Fatalf("got %q, %v, want RETRY 3", line, err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); !strings.Contains(s.statsLine(), " pending=1 retried=1"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %q", s.statsLine())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	frames.WriteControl("CANCEL 2")
+	frames.CloseWrite()
+	if got, err := io.ReadAll(frames); err != nil || string(got) != "bye" {
+		t.Fatalf("stream 1 = %q, %v", got, err)
+	}
+	frames.EndStream()
+
+	// 2 is answered in order, without a dial, once 1 has ended.
+	if reply, err := frames.ReadControl(); err != nil || !strings.HasPrefix(reply, "REPLY 1 ") {
+		t.Fatalf("reply to cancelled 2: %q, %v", reply, err)
+	}
+	frames.WriteControl(request("4"))
+	if reply, err := frames.ReadControl(); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("reply to 4: %q, %v", reply, err)
+	}
+	hub.Close()
+	<-done
+	if n := s.pending.Load(); n != 0 {
+		t.Fatalf("%d requests still counted as pending", n)
+	}
+}
+
+func TestPendingRequestsNeedProtocol2(t *testing.T) {
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, PendingRequests: 4})
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, _ := bufio.NewReader(hub).ReadString('\n'); strings.Contains(line, "queue") {
+		t.Fatalf("protocol 1 HELLO %q offers queue", line)
+	}
+	hub.Close()
+}
@@ -0,0 +1,74 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// pingTimeout bounds one REQUEST PING, including name resolution.
+const pingTimeout = 3 * time.Second
+
+// pingFallbackPort is dialled when ICMP is unavailable and the hub named no
+// port.
+const pingFallbackPort = 80
+
+// errNoICMP reports that the worker may not send ICMP echo requests, so
+// PING falls back to timing a TCP connect.
+var errNoICMP = errors.New("icmp echo unavailable")
+
+// ping answers a REQUEST PING with the round trip time to the host, or a
+// failure REPLY when it does not answer. The hub session stays idle; only
+// a failure to write the reply is returned.
+func (s *Supervisor) ping(ctx context.Context, writer *controlWriter, req *Request, logger *log.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	ip, rtt, via, err := s.probe(ctx, req)
+	if err != nil {
+		status := mapErrorToStatus(err)
+		logger.Printf("ping %s failed: %v", req.Address, normalizeError(err))
+		s.audit.RecordSampled("ping", map[string]any{"dest": req.Address, "outcome": "unreachable", "status": status})
+		return writer.send(fmt.Sprintf("REPLY %d %s %s %d", status, AddrIPv4, "0.0.0.0", 0))
+	}
+	logger.Printf("ping %s (%s) via %s: %s", req.Address, ip, via, rtt)
+	s.audit.RecordSampled("ping", map[string]any{"dest": req.Address, "outcome": "reachable", "via": via, "rtt_us": rtt.Microseconds()})
+	// Milliseconds keep the line ASCII; Duration.String would use "µs".
+	return writer.send(fmt.Sprintf("REPLY 0 %s %s %d rtt=%.3fms via=%s", classifyAddr(ip.String()), ip, req.Port, float64(rtt)/float64(time.Millisecond), via))
+}
+
+// probe resolves the requested host and measures one round trip to it,
+// with an ICMP echo where the worker may send one and a TCP connect
+// otherwise. A refused connection still proves the host is up.
+func (s *Supervisor) probe(ctx context.Context, req *Request) (net.IP, time.Duration, string, error) {
+	ip := net.ParseIP(req.Address)
+	if ip == nil {
+		var err error
+		if ip, err = s.resolveProbe(ctx, req.Address); err != nil {
+			return nil, 0, "", err
+		}
+	}
+	flag, device := s.opts.targetDevice()
+	rtt, err := icmpEcho(ctx, ip, flag, device)
+	if !errors.Is(err, errNoICMP) {
+		return ip, rtt.Round(time.Microsecond), "icmp", err
+	}
+
+	port := req.Port
+	if port == 0 {
+		port = pingFallbackPort
+	}
+	started := time.Now()
+	dialer := s.targetDialer()
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	rtt = time.Since(started).Round(time.Microsecond)
+	if err == nil {
+		_ = conn.Close()
+	} else if !errors.Is(err, syscall.ECONNREFUSED) {
+		return ip, 0, "tcp", err
+	}
+	return ip, rtt, "tcp", nil
+}
@@ -0,0 +1,85 @@
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// icmpEcho sends one ICMP echo request to ip over an unprivileged ping
+// socket and returns the round trip time. It fails with errNoICMP when the
+// kernel refuses the socket, which it does unless the process group is
+// listed in net.ipv4.ping_group_range. A non-empty device is the --vrf or
+// --bind-interface device, named by flag, the socket is bound to.
+func icmpEcho(ctx context.Context, ip net.IP, flag, device string) (time.Duration, error) {
+	family, proto, request, reply := syscall.AF_INET, syscall.IPPROTO_ICMP, byte(8), byte(0)
+	if ip.To4() == nil {
+		family, proto, request, reply = syscall.AF_INET6, syscall.IPPROTO_ICMPV6, 128, 129
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errNoICMP, err)
+	}
+	if device != "" {
+		if err := syscall.BindToDevice(fd, device); err != nil {
+			_ = syscall.Close(fd)
+			return 0, fmt.Errorf("bind to %s %s: %w", flag, device, err)
+		}
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	conn, err := net.FilePacketConn(f)
+	_ = f.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errNoICMP, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	// The kernel fills in the identifier and, for IPv6, the checksum.
+	const seq = 1
+	msg := []byte{request, 0, 0, 0, 0, 0, 0, seq, 'c', 'o', 'n', 't', 'u', 'n'}
+	if request == 8 {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	started := time.Now()
+	if _, err := conn.WriteTo(msg, &net.UDPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, fmt.Errorf("no echo reply: timed out")
+			}
+			return 0, err
+		}
+		if n >= 8 && buf[0] == reply && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return time.Since(started), nil
+		}
+	}
+}
+
+// icmpChecksum is the Internet checksum of an ICMP message whose checksum
+// field is zero.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(msg[i])<<8 | uint32(msg[i+1])
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package pool
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// icmpEcho fails with errNoICMP: unprivileged ICMP is only used on Linux,
+// so PING times a TCP connect instead.
+func icmpEcho(ctx context.Context, ip net.IP, flag, device string) (time.Duration, error) {
+	return 0, errNoICMP
+}
@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHubSessionPing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, "ping") {
+		t.Fatalf("HELLO does not offer ping: %q", line)
+	}
+	fmt.Fprintf(hub, "OK CAPS ping\nREQUEST PING ipv4 127.0.0.1 %d 1\n", port)
+	line, _ := reader.ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) != 7 || strings.Join(fields[:5], " ") != fmt.Sprintf("REPLY 0 ipv4 127.0.0.1 %d", port) ||
+		!strings.HasPrefix(fields[5], "rtt=") || (fields[6] != "via=icmp" && fields[6] != "via=tcp") {
+		t.Fatalf("unexpected ping reply %q", line)
+	}
+	if _, err := time.ParseDuration(strings.TrimPrefix(fields[5], "rtt=")); err != nil {
+		t.Fatalf("rtt in %q: %v", line, err)
+	}
+
+	// The session stays idle and serves the next request.
+	hub.Write([]byte("REQUEST PING domain unresolvable.invalid 0 2\n"))
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 4 ") {
+		t.Fatalf("unresolvable host got %q, want REPLY 4", line)
+	}
+	hub.Close()
+	<-done
+}
@@ -0,0 +1,415 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PluginProtocol is the version of the plugin protocol poolgo speaks.
+//
+// A plugin is a program poolgo starts (--plugin) and talks to over its
+// standard input and output, one JSON object per line. poolgo sends
+// requests {"id":N,"method":M,"params":{...}} and the plugin answers each
+// with {"id":N,"result":{...}} or {"id":N,"error":"..."}, in any order.
+// Notifications have no id and get no answer. Anything the plugin writes
+// to standard error is logged. The methods are:
+//
+//   - hello: sent first, with the protocol version, poolgo version, mode and
+//     labels. The result names the plugin and what it provides:
+//     {"version":1,"name":"ldap-authz","provides":["authorize","audit"]}.
+//   - authorize: the request fields a --hook sees; the result is
+//     {"action":"allow"}, {"action":"deny","reason":"..."} or
+//     {"action":"rewrite","host":"...","port":N}.
+//   - audit (notification): every audit record, as in --audit-format json.
+//   - dial: {"address":"hub:port"}; the plugin carries the hub connection by
+//     its own means and answers with a local {"network":"unix"|"tcp",
+//     "address":"..."} for the worker to connect to instead.
+const PluginProtocol = 1
+
+// What a plugin may provide.
+const (
+	pluginAuthorize = "authorize"
+	pluginAudit     = "audit"
+	pluginTransport = "transport"
+)
+
+// pluginTimeout bounds the hello exchange and every call; pluginQueue is
+// how many messages may wait for a slow plugin before calls fail and audit
+// records are dropped.
+const (
+	pluginTimeout = 5 * time.Second
+	pluginQueue   = 256
+)
+
+// errPluginExited is returned for calls to a plugin that has stopped.
+var errPluginExited = errors.New("plugin exited")
+
+// plugin is a running --plugin process.
+type plugin struct {
+	name     string
+	provides map[string]bool
+	cmd      *exec.Cmd
+	logger   *log.Logger
+
+	queue  chan []byte   // lines for the plugin's standard input
+	stop   chan struct{} // closed by close
+	exited chan struct{}
+
+	mu      sync.Mutex
+	nextID  int64
+	pending map[int64]chan pluginMessage
+}
+
+// pluginMessage is one line of the plugin protocol in either direction.
+type pluginMessage struct {
+	ID     int64           `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params any             `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// pluginHello is the result of the hello call.
+type pluginHello struct {
+	Version  int      `json:"version"`
+	Name     string   `json:"name"`
+	Provides []string `json:"provides"`
+}
+
+// pluginVerdict is the result of the authorize call.
+type pluginVerdict struct {
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+}
+
+// startPlugin runs command, split on spaces without shell quoting, and
+// completes the hello exchange.
+func startPlugin(command string, opts *Options, logger *log.Logger) (*plugin, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := &plugin{
+		name:     filepath.Base(args[0]),
+		provides: make(map[string]bool),
+		cmd:      cmd,
+		logger:   logger,
+		queue:    make(chan []byte, pluginQueue),
+		stop:     make(chan struct{}),
+		exited:   make(chan struct{}),
+		pending:  make(map[int64]chan pluginMessage),
+	}
+	go p.write(stdin)
+	var output sync.WaitGroup
+	output.Add(2)
+	go func() {
+		defer output.Done()
+		p.read(stdout)
+	}()
+	go func() {
+		defer output.Done()
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			p.logger.Printf("plugin %s: %s", p.name, lines.Text())
+		}
+	}()
+	go func() {
+		// Wait closes the pipes, so it must follow the last read.
+		output.Wait()
+		err := cmd.Wait()
+		close(p.exited)
+		p.failPending()
+		p.logger.Printf("plugin %s exited: %v", p.name, err)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	var hello pluginHello
+	err = p.call(ctx, "hello", map[string]any{
+		"version": PluginProtocol, "poolgo": BuildVersion(), "mode": opts.Mode, "labels": opts.Labels,
+	}, &hello)
+	if err == nil && hello.Version != PluginProtocol {
+		err = fmt.Errorf("speaks plugin protocol %d, want %d", hello.Version, PluginProtocol)
+	}
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	if hello.Name != "" {
+		p.name = hello.Name
+	}
+	for _, what := range hello.Provides {
+		switch what {
+		case pluginAuthorize, pluginAudit, pluginTransport:
+			p.provides[what] = true
+		default:
+			p.logger.Printf("plugin %s: ignoring unknown service %q", p.name, what)
+		}
+	}
+	return p, nil
+}
+
+// write feeds queued lines to the plugin until it exits, or until close,
+// after which it flushes what is queued and closes the plugin's input.
+func (p *plugin) write(stdin io.WriteCloser) {
+	defer stdin.Close()
+	for {
+		select {
+		case line := <-p.queue:
+			if _, err := stdin.Write(line); err != nil {
+				return
+			}
+		case <-p.stop:
+			for {
+				select {
+				case line := <-p.queue:
+					if _, err := stdin.Write(line); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-p.exited:
+			return
+		}
+	}
+}
+
+// read hands each answer to the call waiting for it.
+func (p *plugin) read(stdout io.Reader) {
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(make([]byte, 0, 4096), 1<<20)
+	for lines.Scan() {
+		var msg pluginMessage
+		if err := json.Unmarshal(lines.Bytes(), &msg); err != nil || msg.ID == 0 {
+			p.logger.Printf("plugin %s: ignoring malformed line %q", p.name, lines.Text())
+			continue
+		}
+		p.mu.Lock()
+		wait := p.pending[msg.ID]
+		delete(p.pending, msg.ID)
+		p.mu.Unlock()
+		if wait != nil {
+			wait <- msg
+		}
+	}
+}
+
+// failPending ends the calls still waiting on a plugin that exited.
+func (p *plugin) failPending() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, wait := range p.pending {
+		close(wait)
+		delete(p.pending, id)
+	}
+}
+
+// send queues one message without blocking.
+func (p *plugin) send(msg pluginMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-p.exited:
+		return errPluginExited
+	case <-p.stop:
+		return errPluginExited
+	default:
+	}
+	select {
+	case p.queue <- append(line, '\n'):
+		return nil
+	default:
+		return fmt.Errorf("plugin %s is not keeping up", p.name)
+	}
+}
+
+// call sends a request and decodes its result into result.
+func (p *plugin) call(ctx context.Context, method string, params, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	wait := make(chan pluginMessage, 1)
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = wait
+	p.mu.Unlock()
+	forget := func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}
+
+	if err := p.send(pluginMessage{ID: id, Method: method, Params: params}); err != nil {
+		forget()
+		return err
+	}
+	select {
+	case msg, ok := <-wait:
+		if !ok {
+			return errPluginExited
+		}
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if err := json.Unmarshal(msg.Result, result); err != nil {
+			return fmt.Errorf("malformed %s result: %v", method, err)
+		}
+		return nil
+	case <-ctx.Done():
+		forget()
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// Decide asks the plugin to authorize req, like a --hook script.
+func (p *plugin) Decide(ctx context.Context, req *Request, mode Mode, labels map[string]string, _ *log.Logger) (Decision, error) {
+	ports := req.Ports
+	if ports == nil {
+		ports = []int{}
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	var v pluginVerdict
+	err := p.call(ctx, "authorize", map[string]any{
+		"command": req.Command, "atype": req.AddrType, "host": req.Address, "port": req.Port,
+		"ports": ports, "session": req.SessionID, "mode": mode, "labels": labels,
+	}, &v)
+	if err != nil {
+		return Decision{}, err
+	}
+	switch v.Action {
+	case "allow":
+		return Decision{}, nil
+	case "deny":
+		return Decision{Deny: true, Reason: v.Reason}, nil
+	case "rewrite":
+		if v.Port < 0 || v.Port > 65535 || strings.ContainsAny(v.Host, " \t\r\n") || v.Host == "" && v.Port == 0 {
+			return Decision{}, fmt.Errorf("invalid rewrite to %q port %d", v.Host, v.Port)
+		}
+		return Decision{Host: v.Host, Port: v.Port}, nil
+	}
+	return Decision{}, fmt.Errorf("unknown action %q", v.Action)
+}
+
+// audit forwards an audit record, dropping it if the plugin is behind.
+func (p *plugin) audit(record map[string]any) {
+	if err := p.send(pluginMessage{Method: "audit", Params: record}); err != nil {
+		p.logger.Printf("plugin %s: dropping %v audit record: %v", p.name, record["event"], err)
+	}
+}
+
+// dial asks the plugin for a local endpoint that carries a connection to
+// the hub at address, and connects to it.
+func (p *plugin) dial(ctx context.Context, dialer net.Dialer, address string) (net.Conn, error) {
+	var endpoint struct {
+		Network string `json:"network"`
+		Address string `json:"address"`
+	}
+	if err := p.call(ctx, "dial", map[string]any{"address": address}, &endpoint); err != nil {
+		return nil, fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	if endpoint.Network != "unix" && endpoint.Network != "tcp" {
+		return nil, fmt.Errorf("plugin %s: cannot dial network %q", p.name, endpoint.Network)
+	}
+	return dialer.DialContext(ctx, endpoint.Network, endpoint.Address)
+}
+
+// close ends the plugin's input and gives it pluginTimeout to exit before
+// killing it.
+func (p *plugin) close() {
+	close(p.stop)
+	select {
+	case <-p.exited:
+	case <-time.After(pluginTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+// startPlugins starts every --plugin. At most one may provide a transport,
+// and not together with --via-ssh, since both would carry the hub
+// connection.
+func (s *Supervisor) startPlugins() error {
+	var transport *plugin
+	for _, command := range s.opts.Plugins {
+		p, err := startPlugin(command, &s.opts, s.logger)
+		if err != nil {
+			s.closePlugins()
+			return err
+		}
+		s.plugins = append(s.plugins, p)
+		if p.provides[pluginTransport] {
+			switch {
+			case transport != nil:
+				err = fmt.Errorf("plugins %s and %s both provide a transport", transport.name, p.name)
+			case s.opts.ViaSSH != "":
+				err = fmt.Errorf("plugin %s provides a transport, which cannot be combined with --via-ssh", p.name)
+			}
+			if err != nil {
+				s.closePlugins()
+				return err
+			}
+			transport = p
+		}
+		var provides []string
+		for what := range p.provides {
+			provides = append(provides, what)
+		}
+		sort.Strings(provides)
+		s.logger.Printf("Started plugin %s providing %s", p.name, strings.Join(provides, ","))
+	}
+	return nil
+}
+
+// pluginsFor lists the plugins that provide what, in --plugin order.
+func (s *Supervisor) pluginsFor(what string) []*plugin {
+	var found []*plugin
+	for _, p := range s.plugins {
+		if p.provides[what] {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func (s *Supervisor) closePlugins() {
+	for _, p := range s.plugins {
+		p.close()
+	}
+	s.plugins = nil
+}
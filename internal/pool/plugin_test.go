@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPluginHelper is not a test: with POOLGO_PLUGIN_HELPER set, the test
+// binary re-executes itself as a plugin that provides what the variable
+// lists. It denies port 22, sends db.internal to the "db-port" label,
+// appends audit records to POOLGO_PLUGIN_AUDIT and dials the hub at
+// POOLGO_PLUGIN_HUB.
+func TestPluginHelper(t *testing.T) {
+	provides := os.Getenv("POOLGO_PLUGIN_HELPER")
+	if provides == "" {
+		return
+	}
+	var labels map[string]string
+	out := json.NewEncoder(os.Stdout)
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		var msg struct {
+			ID     int64           `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(lines.Bytes(), &msg); err != nil {
+			fmt.Fprintf(os.Stderr, "bad line: %v\n", err)
+			os.Exit(1)
+		}
+		var result any
+		switch msg.Method {
+		case "hello":
+			var hello struct{ Labels map[string]string }
+			json.Unmarshal(msg.Params, &hello)
+			labels = hello.Labels
+			result = map[string]any{"version": PluginProtocol, "name": "helper", "provides": strings.Split(provides, ",")}
+		case "authorize":
+			var req struct {
+				Host string
+				Port int
+			}
+			json.Unmarshal(msg.Params, &req)
+			switch {
+			case req.Port == 22:
+				result = map[string]any{"action": "deny", "reason": "no ssh"}
+			case req.Host == "db.internal":
+				var port int
+				fmt.Sscan(labels["db-port"], &port)
+				result = map[string]any{"action": "rewrite", "host": "127.0.0.1", "port": port}
+			default:
+				result = map[string]any{"action": "allow"}
+			}
+		case "audit":
+			f, err := os.OpenFile(os.Getenv("POOLGO_PLUGIN_AUDIT"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err == nil {
+				f.Write(append(msg.Params, '\n'))
+				f.Close()
+			}
+			continue
+		case "dial":
+			result = map[string]any{"network": "tcp", "address": os.Getenv("POOLGO_PLUGIN_HUB")}
+		}
+		out.Encode(map[string]any{"id": msg.ID, "result": result})
+	}
+	os.Exit(0)
+}
+
+// helperPlugin returns a --plugin command running TestPluginHelper.
+func helperPlugin(t *testing.T, provides string) string {
+	t.Helper()
+	t.Setenv("POOLGO_PLUGIN_HELPER", provides)
+	return os.Args[0] + " -test.run=^TestPluginHelper$"
+}
+
+func TestPluginAuthorizeAndAudit(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("POOLGO_PLUGIN_AUDIT", auditPath)
+	logger := log.New(io.Discard, "", 0)
+	p, err := startPlugin(helperPlugin(t, "authorize,audit,metrics"), &Options{
+		Mode: ModeSocks, Labels: map[string]string{"db-port": "5432"},
+	}, logger)
+	if err != nil {
+		t.Fatalf("startPlugin: %v", err)
+	}
+	if p.name != "helper" || !p.provides[pluginAuthorize] || !p.provides[pluginAudit] || len(p.provides) != 2 {
+		t.Fatalf("hello: name %q provides %v", p.name, p.provides)
+	}
+
+	decide := func(line string) Decision {
+		t.Helper()
+		req, err := ParseRequest(line)
+		if err != nil {
+			t.Fatalf("ParseRequest(%q): %v", line, err)
+		}
+		d, err := p.Decide(context.Background(), req, ModeSocks, nil, logger)
+		if err != nil {
+			t.Fatalf("Decide(%q): %v", line, err)
+		}
+		return d
+	}
+	if d := decide("REQUEST CONNECT ipv4 10.0.0.5 443 1"); d != (Decision{}) {
+		t.Fatalf("allow: %+v", d)
+	}
+	if d := decide("REQUEST CONNECT ipv4 10.0.0.5 22 2"); !d.Deny || d.Reason != "no ssh" {
+		t.Fatalf("deny: %+v", d)
+	}
+	if d := decide("REQUEST CONNECT domain db.internal 1 3"); d.Deny || d.Host != "127.0.0.1" || d.Port != 5432 {
+		t.Fatalf("rewrite: %+v", d)
+	}
+
+	audit, err := openAuditLog("", AuditJSON, 1, []*plugin{p})
+	if err != nil {
+		t.Fatalf("openAuditLog: %v", err)
+	}
+	audit.Record("request_denied", map[string]any{"dest": "10.0.0.5", "port": 22})
+	audit.Close()
+	p.close()
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("audit sink wrote nothing: %v", err)
+	}
+	var rec map[string]any
+	if err := json.Unmarshal(data, &rec); err != nil || rec["event"] != "request_denied" || rec["dest"] != "10.0.0.5" {
+		t.Fatalf("audit sink got %q (%v)", data, err)
+	}
+
+	if _, err := p.Decide(context.Background(), &Request{Command: "CONNECT"}, ModeSocks, nil, logger); err == nil {
+		t.Fatal("Decide on a closed plugin succeeded")
+	}
+}
+
+func TestPluginTransport(t *testing.T) {
+	hub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hub.Close()
+	t.Setenv("POOLGO_PLUGIN_HUB", hub.Addr().String())
+	command := helperPlugin(t, "transport")
+
+	s := NewSupervisor(Options{Mode: ModeSocks, HubHost: "hub.invalid", HubPort: 5555, Plugins: []string{command}})
+	s.logger = log.New(io.Discard, "", 0)
+	if err := s.startPlugins(); err != nil {
+		t.Fatalf("startPlugins: %v", err)
+	}
+	defer s.closePlugins()
+	if err := s.connectLink(s.link(), nil); err != nil {
+		t.Fatalf("connectLink: %v", err)
+	}
+	conn, err := s.dialHub(context.Background(), s.link())
+	if err != nil {
+		t.Fatalf("dialHub through the plugin: %v", err)
+	}
+	conn.Close()
+	if c, err := hub.Accept(); err != nil {
+		t.Fatalf("accept: %v", err)
+	} else {
+		c.Close()
+	}
+
+	s = NewSupervisor(Options{Mode: ModeSocks, Plugins: []string{command, command}})
+	s.logger = log.New(io.Discard, "", 0)
+	if err := s.startPlugins(); err == nil || len(s.plugins) != 0 {
+		t.Fatalf("two transport plugins: %v", err)
+	}
+}
+
+func TestParseArgsPlugin(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--plugin", os.Args[0] + " -x", "--plugin", os.Args[0]})
+	if err != nil || len(opts.Plugins) != 2 || !strings.Contains(opts.Features(), "plugin") {
+		t.Fatalf("ParseArgs: %+v, %v", opts, err)
+	}
+	for _, command := range []string{"", "/nonexistent/plugin"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--plugin", command}); err == nil {
+			t.Fatalf("accepted --plugin %q", command)
+		}
+	}
+}
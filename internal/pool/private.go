@@ -0,0 +1,60 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// errPrivateTarget refuses a domain that only resolved to addresses
+// --deny-private-resolved keeps out of reach. It is answered with status 2
+// (not allowed by ruleset).
+var errPrivateTarget = errors.New("resolves only to private addresses")
+
+// privateDenied reports whether --deny-private-resolved keeps the worker
+// from dialling ip, an address a domain resolved to: a loopback, private
+// (RFC 1918 or fc00::/7), link-local or unspecified one that no --allow
+// address rule covers.
+func (o *Options) privateDenied(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !o.DenyPrivate || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()) {
+		return false
+	}
+	for _, r := range o.Allow {
+		if r.Network.IsValid() && r.Network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicTargets drops the addresses of a resolved domain that
+// --deny-private-resolved refuses, and fails when none are left.
+func (o *Options) publicTargets(targets []netip.AddrPort) ([]netip.AddrPort, error) {
+	kept := slices.DeleteFunc(slices.Clone(targets), func(t netip.AddrPort) bool { return o.privateDenied(t.Addr()) })
+	if len(kept) == 0 && len(targets) > 0 {
+		return nil, fmt.Errorf("%w: %s", errPrivateTarget, targets[0].Addr())
+	}
+	return kept, nil
+}
+
+// resolveProbe resolves host for PING and SCAN, which use its first
+// address that --deny-private-resolved lets through.
+func (s *Supervisor) resolveProbe(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := s.resolver().LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.link().opts
+	targets := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		targets[i] = netip.AddrPortFrom(addr.Unmap(), 0)
+	}
+	if targets, err = opts.publicTargets(targets); err != nil {
+		return nil, err
+	}
+	return targets[0].Addr().AsSlice(), nil
+}
@@ -0,0 +1,71 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestPrivateDenied(t *testing.T) {
+	allow, _ := ParseACLRule("10.9.0.0/16:22")
+	opts := Options{DenyPrivate: true, Allow: []ACLRule{allow}}
+	for _, tc := range []struct {
+		ip     string
+		denied bool
+	}{
+		{"169.254.169.254", true},
+		{"127.0.0.1", true},
+		{"::ffff:192.168.1.1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"10.9.1.1", false},
+		{"8.8.8.8", false},
+		{"2001:db8::1", false},
+	} {
+		if got := opts.privateDenied(netip.MustParseAddr(tc.ip)); got != tc.denied {
+			t.Errorf("privateDenied(%s) = %v, want %v", tc.ip, got, tc.denied)
+		}
+	}
+	if (&Options{}).privateDenied(netip.MustParseAddr("127.0.0.1")) {
+		t.Fatal("privateDenied without --deny-private-resolved")
+	}
+}
+
+func TestDialTargetDenyPrivate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	req := &Request{AddrType: AddrDomain, Address: "localhost", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	s := NewSupervisor(Options{DenyPrivate: true})
+	_, err = s.dialTarget(context.Background(), req, nil)
+	if !errors.Is(err, errPrivateTarget) || mapErrorToStatus(err) != 2 {
+		t.Fatalf("dialTarget(localhost) = %v, want a status 2 refusal", err)
+	}
+	if _, err := s.dialTarget(context.Background(), &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: req.Port}, nil); err != nil {
+		t.Fatalf("dialTarget refused an address literal: %v", err)
+	}
+
+	v4, _ := ParseACLRule("127.0.0.0/8")
+	v6, _ := ParseACLRule("::1")
+	s = NewSupervisor(Options{DenyPrivate: true, Allow: []ACLRule{v4, v6}})
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("dialTarget(localhost) with an --allow rule: %v", err)
+	}
+	conn.Close()
+}
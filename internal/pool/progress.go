@@ -0,0 +1,79 @@
+package pool
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// progressDelay is how long a dial stage may run before the hub hears about
+// it; fast dials send no PROGRESS lines at all.
+const progressDelay = 500 * time.Millisecond
+
+// progressReporter sends "PROGRESS <stage> <detail>" lines for dial stages
+// that are still running after progressDelay, so the hub can tell a slow
+// target from a stuck worker.
+type progressReporter struct {
+	writer *controlWriter
+
+	mu    sync.Mutex
+	gen   int
+	timer *time.Timer
+	done  bool
+}
+
+func newProgressReporter(writer *controlWriter) *progressReporter {
+	return &progressReporter{writer: writer}
+}
+
+// stage marks the start of a dial stage. A nil reporter does nothing.
+func (p *progressReporter) stage(name, detail string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.gen++
+	gen := p.gen
+	line := strings.TrimSpace("PROGRESS " + name + " " + detail)
+	p.timer = time.AfterFunc(progressDelay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if !p.done && p.gen == gen {
+			p.writer.sendNotice(line)
+		}
+	})
+}
+
+// finish stops reporting; no PROGRESS line is written after it returns.
+func (p *progressReporter) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// control reports the connecting stage. It is installed as the dialer's
+// ControlContext, which runs once per address after name resolution.
+func (p *progressReporter) control(next func(context.Context, string, string, syscall.RawConn) error) func(context.Context, string, string, syscall.RawConn) error {
+	return func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		p.stage("connecting", address)
+		if next != nil {
+			return next(ctx, network, address, c)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package pool
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe for use from timer goroutines.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProgressReporter(t *testing.T) {
+	var out lockedBuffer
+	p := newProgressReporter(newControlWriter(&out))
+
+	p.stage("resolving", "example.com")
+	p.stage("connecting", "192.0.2.1:443")
+	time.Sleep(progressDelay + 200*time.Millisecond)
+	p.finish()
+	if got := out.String(); got != "PROGRESS connecting 192.0.2.1:443\n" {
+		t.Fatalf("unexpected progress lines %q", got)
+	}
+
+	var quiet lockedBuffer
+	p = newProgressReporter(newControlWriter(&quiet))
+	p.stage("resolving", "example.com")
+	p.finish()
+	time.Sleep(progressDelay + 200*time.Millisecond)
+	if got := quiet.String(); got != "" {
+		t.Fatalf("fast dial reported progress %q", got)
+	}
+}
@@ -0,0 +1,84 @@
+package pool
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// ProxyProtocol selects the PROXY protocol header --send-proxy-protocol
+// writes to targets.
+type ProxyProtocol string
+
+const (
+	ProxyProtocolV1 ProxyProtocol = "v1" // the text form
+	ProxyProtocolV2 ProxyProtocol = "v2" // the binary form
+)
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyHeader encodes a PROXY protocol header telling a target that src
+// connected to dst. When either address is unknown the header says so,
+// "PROXY UNKNOWN" or a version 2 LOCAL command, and the target uses the
+// connection's own addresses. An IPv4 address paired with an IPv6 one is
+// sent IPv4-mapped, since a header carries a single family.
+func proxyHeader(version ProxyProtocol, src, dst netip.AddrPort) []byte {
+	known := src.IsValid() && dst.IsValid()
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	if known && srcIP.Is4() != dstIP.Is4() {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if !srcIP.Is4() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, src.Port(), dst.Port()))
+	}
+
+	header := []byte(proxyV2Signature)
+	if !known {
+		// Version 2, LOCAL, unspecified family, no addresses.
+		return append(header, 0x20, 0x00, 0x00, 0x00)
+	}
+	var addrs []byte
+	family := byte(0x11) // TCP over IPv4
+	if srcIP.Is4() {
+		s, d := srcIP.As4(), dstIP.As4()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	} else {
+		family = 0x21 // TCP over IPv6
+		s, d := srcIP.As16(), dstIP.As16()
+		addrs = append(append(addrs, s[:]...), d[:]...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+	addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	header = append(header, 0x21, family) // version 2, PROXY
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// sendProxyHeader writes the --send-proxy-protocol header for req to a
+// freshly dialled target. The destination is the address conn reached,
+// or through an --upstream-proxy the requested one when it is an IP
+// address; the source is the client address the hub sent, if any.
+func (s *Supervisor) sendProxyHeader(conn net.Conn, req *Request) error {
+	l := s.link()
+	var dst netip.AddrPort
+	if l.upstream == nil {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			dst = addr.AddrPort()
+		}
+	} else if ip, err := netip.ParseAddr(req.Address); err == nil {
+		dst = netip.AddrPortFrom(ip, uint16(req.Port))
+	}
+	if _, err := conn.Write(proxyHeader(l.opts.SendProxyProtocol, req.Client, dst)); err != nil {
+		return fmt.Errorf("sending PROXY header to %s: %v", req.hostPort(), err)
+	}
+	return nil
+}
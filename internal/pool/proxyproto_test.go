@@ -0,0 +1,90 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src, v4dst := netip.MustParseAddrPort("192.0.2.7:51234"), netip.MustParseAddrPort("10.0.0.5:5432")
+	v6src := netip.MustParseAddrPort("[2001:db8::7]:51234")
+	for _, tc := range []struct {
+		version  ProxyProtocol
+		src, dst netip.AddrPort
+		want     string
+	}{
+		{ProxyProtocolV1, v4src, v4dst, "PROXY TCP4 192.0.2.7 10.0.0.5 51234 5432\r\n"},
+		{ProxyProtocolV1, v6src, v4dst, "PROXY TCP6 2001:db8::7 ::ffff:10.0.0.5 51234 5432\r\n"},
+		{ProxyProtocolV1, netip.AddrPort{}, v4dst, "PROXY UNKNOWN\r\n"},
+		{ProxyProtocolV2, netip.AddrPort{}, v4dst, proxyV2Signature + "\x20\x00\x00\x00"},
+		{ProxyProtocolV2, v4src, v4dst, proxyV2Signature + "\x21\x11\x00\x0c" +
+			"\xc0\x00\x02\x07" + "\x0a\x00\x00\x05" + "\xc8\x22" + "\x15\x38"},
+	} {
+		if got := string(proxyHeader(tc.version, tc.src, tc.dst)); got != tc.want {
+			t.Errorf("proxyHeader(%s, %s, %s) = %q, want %q", tc.version, tc.src, tc.dst, got, tc.want)
+		}
+	}
+	if h := proxyHeader(ProxyProtocolV2, v6src, v4dst); len(h) != 16+36 || h[13] != 0x21 || h[15] != 36 {
+		t.Errorf("IPv6 v2 header %x", h)
+	}
+}
+
+func TestParseArgsSendProxyProtocol(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--send-proxy-protocol", "V2"})
+	if err != nil || opts.SendProxyProtocol != ProxyProtocolV2 {
+		t.Fatalf("ParseArgs: %v, %q", err, opts.SendProxyProtocol)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--send-proxy-protocol", "v3"}); err == nil {
+		t.Error("--send-proxy-protocol v3 accepted")
+	}
+
+	req, err := ParseRequest("REQUEST CONNECT domain db.internal 5432 7 affinity=abc client=[2001:db8::7]:51234")
+	if err != nil || req.Client != netip.MustParseAddrPort("[2001:db8::7]:51234") || req.SessionID != "7" {
+		t.Fatalf("ParseRequest: %+v, %v", req, err)
+	}
+	for _, line := range []string{
+		"REQUEST CONNECT domain db.internal 5432 client=db.internal:1",
+		"REQUEST PING domain db.internal 0 client=192.0.2.7:51234",
+	} {
+		if _, err := ParseRequest(line); err == nil {
+			t.Errorf("ParseRequest(%q) accepted", line)
+		}
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		got <- b
+	}()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, SendProxyProtocol: ProxyProtocolV1})
+	target := ln.Addr().(*net.TCPAddr).AddrPort()
+	req := &Request{Command: CommandConnect, AddrType: AddrIPv4, Address: "127.0.0.1", Port: int(target.Port()), Client: netip.MustParseAddrPort("192.0.2.7:51234")}
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	conn.Close()
+	want := "PROXY TCP4 192.0.2.7 127.0.0.1 51234 " + strconv.Itoa(req.Port) + "\r\nhello"
+	if b := <-got; !bytes.Equal(b, []byte(want)) {
+		t.Fatalf("target read %q, want %q", b, want)
+	}
+}
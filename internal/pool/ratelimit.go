@@ -0,0 +1,153 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket limits the byte rate of one or more streams to what rate
+// holds, which may change while the bucket is in use. Bytes read before
+// they were paid for become a debt the next reader waits off, so a bucket
+// allows a burst of about one second's worth.
+type tokenBucket struct {
+	rate *atomic.Int64 // bytes per second; 0 is unlimited
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate *atomic.Int64) *tokenBucket {
+	return &tokenBucket{rate: rate, last: time.Now()}
+}
+
+// take pays for n bytes and waits until the bucket is out of debt, or ctx
+// is done.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	rate := float64(b.rate.Load())
+	if rate <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*rate, rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 || sleepWithContext(ctx, wait) {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// limitedReader holds reads from r to the rates of its buckets.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// Small reads keep a slow stream's waits short, so it notices a
+	// closed bridge or a raised limit soon.
+	if limit := l.chunk(); limit < len(p) {
+		p = p[:limit]
+	}
+	n, err := l.r.Read(p)
+	for _, b := range l.buckets {
+		if waitErr := b.take(l.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// chunk is a tenth of a second's worth of the slowest bucket.
+func (l *limitedReader) chunk() int {
+	limit := 32 * 1024
+	for _, b := range l.buckets {
+		if rate := b.rate.Load(); rate > 0 {
+			limit = min(limit, max(int(rate/10), 1))
+		}
+	}
+	return limit
+}
+
+// rateLimited wraps the reader of one bridge direction in --rate-limit and
+// --pool-rate-limit, if either is set. The session's own bucket follows the
+// current --rate-limit, and the pool's buckets are shared by every session,
+// one per direction. Like --stall-timeout, this rules out the kernel's
+// zero-copy path for the session.
+func (s *Supervisor) rateLimited(ctx context.Context, r io.Reader, fromHub bool) io.Reader {
+	if s.streamRate.Load() <= 0 && s.poolRate.Load() <= 0 {
+		return r
+	}
+	pool := s.poolToHub
+	if fromHub {
+		pool = s.poolToTarget
+	}
+	return &limitedReader{ctx: ctx, r: r, buckets: []*tokenBucket{newTokenBucket(&s.streamRate), pool}}
+}
+
+// RateLimiter is a byte rate limit that streams share, as hubgo's
+// --listener-rate-limit does across the clients of a listener.
+type RateLimiter struct {
+	rate   atomic.Int64
+	bucket *tokenBucket
+}
+
+// NewRateLimiter returns a limiter allowing rate bytes per second.
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.rate.Store(rate)
+	l.bucket = newTokenBucket(&l.rate)
+	return l
+}
+
+// Rate returns the limit in bytes per second.
+func (l *RateLimiter) Rate() int64 { return l.rate.Load() }
+
+// Reader holds reads from r to the limiter's rate, shared with every other
+// reader it returned, until ctx is done.
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &limitedReader{ctx: ctx, r: r, buckets: []*tokenBucket{l.bucket}}
+}
+
+// setRates applies --rate-limit and --pool-rate-limit to running and new
+// sessions.
+func (s *Supervisor) setRates(stream, pool int64) {
+	s.streamRate.Store(stream)
+	s.poolRate.Store(pool)
+}
+
+// ParseRate parses a --rate-limit value in bytes per second, such as "512K",
+// "10M/s" or "off" (0).
+func ParseRate(text string) (int64, error) {
+	if strings.EqualFold(text, "off") || text == "0" {
+		return 0, nil
+	}
+	return parseByteSize(strings.TrimSuffix(text, "/s"))
+}
+
+// FormatRate shows a rate as ParseRate accepts it.
+func FormatRate(rate int64) string {
+	if rate <= 0 {
+		return "off"
+	}
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if rate%u.size == 0 {
+			return fmt.Sprintf("%d%s/s", rate/u.size, u.suffix)
+		}
+	}
+	return strconv.FormatInt(rate, 10) + "/s"
+}
@@ -0,0 +1,74 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitedReader(t *testing.T) {
+	s := NewSupervisor(Options{RateLimit: 100 << 10})
+	r := s.rateLimited(context.Background(), bytes.NewReader(make([]byte, 50<<10)), true)
+	started := time.Now()
+	if n, err := io.Copy(io.Discard, r); err != nil || n != 50<<10 {
+		t.Fatalf("copy: %d, %v", n, err)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("50K at 100K/s took %s", elapsed)
+	}
+
+	s.setRates(0, 0)
+	if _, ok := s.rateLimited(context.Background(), strings.NewReader("x"), false).(*strings.Reader); !ok {
+		t.Fatal("wrapped a reader without limits")
+	}
+
+	// A cancelled bridge stops a reader that is paying off its debt.
+	s.setRates(0, 1<<10)
+	ctx, cancel := context.WithCancel(context.Background())
+	r = s.rateLimited(ctx, bytes.NewReader(make([]byte, 8<<10)), false)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := io.Copy(io.Discard, r); err != context.Canceled {
+		t.Fatalf("copy after cancel: %v", err)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for text, want := range map[string]int64{"off": 0, "0": 0, "512K": 512 << 10, "10M/s": 10 << 20, "1500": 1500} {
+		if rate, err := ParseRate(text); err != nil || rate != want {
+			t.Errorf("ParseRate(%q) = %d, %v; want %d", text, rate, err, want)
+		}
+	}
+	for _, text := range []string{"", "fast", "-1M", "10M/h"} {
+		if _, err := ParseRate(text); err == nil {
+			t.Errorf("ParseRate accepted %q", text)
+		}
+	}
+	for rate, want := range map[int64]string{0: "off", 512 << 10: "512K/s", 3 << 30: "3G/s", 1500: "1500/s"} {
+		if got := FormatRate(rate); got != want {
+			t.Errorf("FormatRate(%d) = %q, want %q", rate, got, want)
+		}
+	}
+}
+
+func TestAdminRateLimit(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--rate-limit", "1M", "--pool-rate-limit", "off"})
+	if err != nil || opts.RateLimit != 1<<20 || opts.PoolRateLimit != 0 {
+		t.Fatalf("ParseArgs: %+v, %v", opts, err)
+	}
+	s := NewSupervisor(*opts)
+	if got := s.adminCommand("rate-limit"); got != "rate-limit 1M/s\n" {
+		t.Fatalf("rate-limit: %q", got)
+	}
+	if got := s.adminCommand("pool-rate-limit 20M"); got != "pool-rate-limit 20M/s\n" || s.poolRate.Load() != 20<<20 {
+		t.Fatalf("pool-rate-limit 20M: %q", got)
+	}
+	if got := s.adminCommand("rate-limit off"); got != "rate-limit off\n" || s.streamRate.Load() != 0 {
+		t.Fatalf("rate-limit off: %q", got)
+	}
+	if got := s.adminCommand("rate-limit lots"); !strings.HasPrefix(got, "error: ") {
+		t.Fatalf("rate-limit lots: %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package pool
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// readAheadChunk caps a single read from the target, matching the bridge's
+// copy buffer.
+const readAheadChunk = 32 * 1024
+
+// readAhead reads the target in its own goroutine so the connection keeps
+// draining while a write to a slow hub is in progress, but never holds more
+// than limit unread bytes: once it does, it stops reading until the bridge
+// catches up. Memory per session is then limit, whatever the hub link or
+// its transport does with writes.
+type readAhead struct {
+	r     io.Reader
+	limit int
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int   // bytes in chunks
+	err    error // from r, returned once chunks are drained
+	closed bool
+}
+
+// newReadAhead starts reading r. Call close once the bridge has ended.
+func newReadAhead(r io.Reader, limit int) *readAhead {
+	ra := &readAhead{r: r, limit: limit}
+	ra.cond = sync.NewCond(&ra.mu)
+	go ra.fill()
+	return ra
+}
+
+func (ra *readAhead) fill() {
+	for {
+		ra.mu.Lock()
+		for ra.size >= ra.limit && !ra.closed {
+			ra.cond.Wait()
+		}
+		room := ra.limit - ra.size
+		closed := ra.closed
+		ra.mu.Unlock()
+		if closed {
+			return
+		}
+
+		chunk := make([]byte, min(room, readAheadChunk))
+		n, err := ra.r.Read(chunk)
+
+		ra.mu.Lock()
+		if n > 0 {
+			ra.chunks = append(ra.chunks, chunk[:n])
+			ra.size += n
+		}
+		if err != nil {
+			ra.err = err
+		}
+		ra.cond.Broadcast()
+		ra.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for len(ra.chunks) == 0 && ra.err == nil && !ra.closed {
+		ra.cond.Wait()
+	}
+	if len(ra.chunks) > 0 {
+		n := copy(p, ra.chunks[0])
+		if n == len(ra.chunks[0]) {
+			ra.chunks[0] = nil
+			ra.chunks = ra.chunks[1:]
+		} else {
+			ra.chunks[0] = ra.chunks[0][n:]
+		}
+		ra.size -= n
+		ra.cond.Broadcast()
+		return n, nil
+	}
+	if ra.closed {
+		return 0, net.ErrClosed
+	}
+	return 0, ra.err
+}
+
+// close stops reading ahead. A read already blocked on the target returns
+// when the target connection is closed.
+func (ra *readAhead) close() {
+	ra.mu.Lock()
+	ra.closed = true
+	ra.chunks = nil
+	ra.cond.Broadcast()
+	ra.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package pool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes taken from r.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestReadAheadBounded(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MiB
+	src := &countingReader{r: bytes.NewReader(data)}
+	ra := newReadAhead(src, 100*1024)
+	defer ra.close()
+
+	// Nothing consumes yet: reading stops at the limit.
+	time.Sleep(50 * time.Millisecond)
+	if n := src.n.Load(); n != 100*1024 {
+		t.Fatalf("read %d bytes ahead, want exactly the 100KiB limit", n)
+	}
+
+	var got bytes.Buffer
+	buf := make([]byte, 10000)
+	for {
+		n, err := ra.Read(buf)
+		got.Write(buf[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if ahead := src.n.Load() - int64(got.Len()); ahead > 100*1024 {
+			t.Fatalf("%d bytes read ahead, over the limit", ahead)
+		}
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("got %d bytes, want the %d written", got.Len(), len(data))
+	}
+}
+
+func TestReadAheadClose(t *testing.T) {
+	target, remote := net.Pipe()
+	defer remote.Close()
+	ra := newReadAhead(target, 1024)
+	done := make(chan error, 1)
+	go func() {
+		_, err := ra.Read(make([]byte, 10))
+		done <- err
+	}()
+	ra.close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Read after close: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("close did not wake a blocked Read")
+	}
+	target.Close()
+}
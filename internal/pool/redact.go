@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+
+	"contun/internal/logx"
+)
+
+// RedactMode selects how --redact hides a destination host in the log.
+type RedactMode string
+
+const (
+	// RedactHash shows a stable digest of the host, so records about the
+	// same host can still be matched up.
+	RedactHash RedactMode = "hash"
+	// RedactTruncate keeps the parent domain of a name, or the first half
+	// of an IPv4 address.
+	RedactTruncate RedactMode = "truncate"
+)
+
+// redactedHost returns how the log shows host, and whether a --redact
+// pattern covers it at all.
+func (o *Options) redactedHost(host string) (string, bool) {
+	name := strings.ToLower(host)
+	matched := false
+	for _, pattern := range o.Redact {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return host, false
+	}
+	if o.RedactMode == RedactTruncate {
+		if ip, err := netip.ParseAddr(name); err == nil {
+			if ip.Is4() {
+				b := ip.As4()
+				return fmt.Sprintf("%d.%d.*.*", b[0], b[1]), true
+			}
+			return "*", true
+		}
+		if labels := strings.Split(strings.TrimSuffix(name, "."), "."); len(labels) > 2 {
+			return "*." + strings.Join(labels[len(labels)-2:], "."), true
+		}
+		return "*", true
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "redacted-" + hex.EncodeToString(sum[:6]), true
+}
+
+// redactDest derives a logger that hides req's destination, when a
+// --redact pattern covers it. Audit records, the session log and the admin
+// socket, which stay local, keep it. The logger also shows the --alias
+// name of the destination, if it has one.
+func (s *Supervisor) redactDest(logger *log.Logger, req *Request) *log.Logger {
+	logger = s.aliasDest(logger, req)
+	if shown, ok := s.link().opts.redactedHost(req.Address); ok {
+		return logx.Redact(logger, req.Address, shown)
+	}
+	return logger
+}
+
+// redactLine hides the hosts --redact covers in a control line, on their
+// own or as host:port.
+func (o *Options) redactLine(line string) string {
+	if len(o.Redact) == 0 {
+		return line
+	}
+	fields := strings.Split(line, " ")
+	for i, field := range fields {
+		if shown, ok := o.redactedHost(field); ok {
+			fields[i] = shown
+		} else if host, port, err := net.SplitHostPort(field); err == nil {
+			if shown, ok := o.redactedHost(host); ok {
+				fields[i] = net.JoinHostPort(shown, port)
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// traceLine logs a control line at proto=trace, with "<" for lines from the
+// hub and ">" for lines to it.
+func (s *Supervisor) traceLine(logger *log.Logger, dir, line string) {
+	if logx.Enabled("proto", logx.Trace) {
+		logx.At(logger, "proto", logx.Trace).Printf("%s %s", dir, s.link().opts.redactLine(line))
+	}
+}
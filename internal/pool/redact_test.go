@@ -0,0 +1,62 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactedHost(t *testing.T) {
+	opts := Options{Redact: []string{"*.corp.example", "10.20.*"}, RedactMode: RedactHash}
+	hashed, ok := opts.redactedHost("DB.corp.example")
+	if !ok || !strings.HasPrefix(hashed, "redacted-") || len(hashed) != len("redacted-")+12 {
+		t.Fatalf("hash: %q, %v", hashed, ok)
+	}
+	if again, _ := opts.redactedHost("db.corp.example"); again != hashed {
+		t.Fatalf("hash is not stable: %q, %q", again, hashed)
+	}
+	if shown, ok := opts.redactedHost("example.org"); ok || shown != "example.org" {
+		t.Fatalf("unmatched host: %q, %v", shown, ok)
+	}
+
+	opts.RedactMode = RedactTruncate
+	for host, want := range map[string]string{"db.eu.corp.example": "*.corp.example", "10.20.3.4": "10.20.*.*"} {
+		if got, _ := opts.redactedHost(host); got != want {
+			t.Errorf("truncate %s = %q, want %q", host, got, want)
+		}
+	}
+	if got := opts.redactLine("NOTICE inbound-limit db.corp.example:22 100 alert"); got != "NOTICE inbound-limit *.corp.example:22 100 alert" {
+		t.Fatalf("redactLine: %q", got)
+	}
+	opts.Redact = []string{"2001:db8::*"}
+	if got := opts.redactLine("NOTICE inbound-limit [2001:db8::5]:22 100 alert"); got != "NOTICE inbound-limit *:22 100 alert" {
+		t.Fatalf("redactLine with IPv6: %q", got)
+	}
+}
+
+func TestHubSessionRedact(t *testing.T) {
+	deny, _ := ParseACLRule("db.corp.example")
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, Deny: []ACLRule{deny}, Redact: []string{"*.corp.example"}})
+	var logs bytes.Buffer
+	worker, hub := tcpPair(t)
+	go s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(&logs, "", 0))
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK\nREQUEST CONNECT domain db.corp.example 22 1\n")
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 2 ") {
+		t.Fatalf("denied request answered %q", line)
+	}
+	hub.Close()
+	time.Sleep(50 * time.Millisecond)
+	shown, _ := s.opts.redactedHost("db.corp.example")
+	if got := logs.String(); strings.Contains(got, "db.corp.example") || !strings.Contains(got, "denied by acl: "+shown+":22") {
+		t.Fatalf("log shows %q", got)
+	}
+}
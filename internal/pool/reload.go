@@ -0,0 +1,545 @@
+package pool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"contun/internal/logx"
+	"contun/internal/secure"
+	"contun/internal/transport"
+)
+
+// rollStep bounds how long a rolling replacement waits for a new worker to
+// reach the hub before retiring the worker it replaces anyway.
+const rollStep = 10 * time.Second
+
+// reloadKind says how Reload applies a change to an Options field.
+type reloadKind int
+
+const (
+	reloadRestart   reloadKind = iota // kept until poolgo restarts
+	reloadLive                        // takes effect at once
+	reloadReconnect                   // workers are replaced one at a time
+)
+
+// reloadKinds classifies the Options fields Reload can apply; every other
+// field needs a restart.
+var reloadKinds = map[string]reloadKind{
+	"Workers":           reloadLive,
+	"MinWorkers":        reloadLive,
+	"MaxWorkers":        reloadLive,
+	"ScaleDownAfter":    reloadLive,
+	"RetryDelay":        reloadLive,
+	"ScanConcurrency":   reloadLive,
+	"HookFile":          reloadLive,
+	"Hook":              reloadLive,
+	"Labels":            reloadLive,
+	"Aliases":           reloadLive,
+	"Allow":             reloadLive,
+	"Deny":              reloadLive,
+	"ACLFile":           reloadLive,
+	"DenyPrivate":       reloadLive,
+	"LogLevel":          reloadLive,
+	"Redact":            reloadLive,
+	"RedactMode":        reloadLive,
+	"StallTimeout":      reloadLive,
+	"IdleTimeout":       reloadLive,
+	"ReadAhead":         reloadLive,
+	"RateLimit":         reloadLive,
+	"PoolRateLimit":     reloadLive,
+	"MaxSessions":       reloadLive,
+	"QueueTimeout":      reloadLive,
+	"MaxLoad":           reloadLive,
+	"MaxCPU":            reloadLive,
+	"SimulateLatency":   reloadLive,
+	"DNSServer":         reloadLive,
+	"UpstreamProxy":     reloadLive,
+	"SourceRules":       reloadLive,
+	"NetnsRules":        reloadLive,
+	"HubDialTimeout":    reloadLive,
+	"TargetDialTimeout": reloadLive,
+	"TargetDNSTTL":      reloadLive,
+	"Sources":           reloadLive,
+
+	"HubHost":           reloadReconnect,
+	"HubPort":           reloadReconnect,
+	"Progress":          reloadReconnect,
+	"PendingRequests":   reloadReconnect,
+	"Protocol":          reloadReconnect,
+	"FlowControl":       reloadReconnect,
+	"FlowWindow":        reloadReconnect,
+	"MaxFrameSize":      reloadReconnect,
+	"Compress":          reloadReconnect,
+	"HeartbeatInterval": reloadReconnect,
+	"HeartbeatTimeout":  reloadReconnect,
+	"TLS":               reloadReconnect,
+	"TLSCAFile":         reloadReconnect,
+	"TLSServerName":     reloadReconnect,
+	"TLSInsecure":       reloadReconnect,
+	"TLSCertFile":       reloadReconnect,
+	"TLSKeyFile":        reloadReconnect,
+	"NoiseHubKeyFile":   reloadReconnect,
+	"NoiseKeyFile":      reloadReconnect,
+	"ViaSSH":            reloadReconnect,
+	"SSHKeyFile":        reloadReconnect,
+	"SSHKnownHosts":     reloadReconnect,
+	"HubProxy":          reloadReconnect,
+	"HubURL":            reloadReconnect,
+	"Transport":         reloadReconnect,
+	"AuthTokenFile":     reloadReconnect,
+	"AuthToken":         reloadReconnect,
+	"AuthMode":          reloadReconnect,
+	"Exposes":           reloadReconnect,
+	"TargetPatterns":    reloadReconnect,
+	"SendProxyProtocol": reloadReconnect,
+}
+
+// link is one generation of the configuration workers use to reach and talk
+// to the hub. A hub connection keeps the link it was dialled with until it
+// ends, so a reload never mixes settings within one connection.
+type link struct {
+	opts *Options
+	hash string // opts.ConfigHash()
+	gen  int    // bumped when reconnecting is needed to apply a change
+
+	transport *hubTransport // dials the hub as --transport, --tls and --hub-url say
+	noise     *secure.Config
+	ssh       *sshJump
+
+	resolver *net.Resolver  // --dns-server's; nil for the system's
+	upstream *upstreamProxy // --upstream-proxy's, or nil
+	hubProxy *upstreamProxy // --hub-proxy's, or nil
+	hubURL   *url.URL       // --hub-url's, or nil
+
+	// Digests of the key files behind the transport's TLS, noise and ssh,
+	// so a reload notices rotated keys at unchanged paths.
+	tlsSum, noiseSum, sshSum string
+}
+
+func newLink(opts *Options) *link {
+	// ParseArgs has checked --dns-server, --upstream-proxy, --hub-proxy and
+	// --hub-url.
+	l := &link{opts: opts, hash: opts.ConfigHash()}
+	l.resolver, _ = NewResolver(opts.DNSServer)
+	if opts.UpstreamProxy != "" {
+		l.upstream, _ = parseUpstreamProxy(opts.UpstreamProxy)
+	}
+	if opts.HubProxy != "" {
+		l.hubProxy, _ = parseUpstreamProxy(opts.HubProxy)
+	}
+	if opts.HubURL != "" {
+		l.hubURL, _, _, _ = parseHubURL(opts.HubURL)
+	}
+	return l
+}
+
+// link returns the current link.
+func (s *Supervisor) link() *link {
+	return s.current.Load()
+}
+
+// connectLink prepares the transport, Noise and SSH state of l. With prev
+// set it keeps prev's transport (and with it a QUIC connection), Noise key
+// and SSH connection when their settings and key files are unchanged.
+func (s *Supervisor) connectLink(l, prev *link) error {
+	o := l.opts
+	if o.NoiseHubKeyFile != "" {
+		l.noiseSum = keyDigest(o.NoiseHubKeyFile, o.NoiseKeyFile)
+		if prev != nil && prev.noise != nil && prev.noiseSum == l.noiseSum &&
+			prev.opts.NoiseHubKeyFile == o.NoiseHubKeyFile && prev.opts.NoiseKeyFile == o.NoiseKeyFile {
+			l.noise = prev.noise
+		} else {
+			cfg, ephemeral, err := o.noiseConfig()
+			if err != nil {
+				return err
+			}
+			if ephemeral {
+				s.logger.Printf("Noise: no --noise-key given, using a key generated for this run")
+			}
+			s.logger.Printf("Noise: worker public key %s", secure.EncodePublicKey(cfg.StaticKey.PublicKey()))
+			l.noise = cfg
+		}
+	}
+	if o.ViaSSH != "" {
+		l.sshSum = keyDigest(o.SSHKeyFile, o.SSHKnownHosts)
+		if prev != nil && prev.ssh != nil && prev.sshSum == l.sshSum && prev.opts.ViaSSH == o.ViaSSH &&
+			prev.opts.SSHKeyFile == o.SSHKeyFile && prev.opts.SSHKnownHosts == o.SSHKnownHosts {
+			l.ssh = prev.ssh
+		} else {
+			jump, err := o.sshJump()
+			if err != nil {
+				return err
+			}
+			jump.logger = s.logger
+			jump.control = s.bufferControl()
+			jump.keepAlive = o.setKeepAlive
+			l.ssh = jump
+		}
+	}
+	if o.TLS || o.Transport == transportQUIC {
+		l.tlsSum = keyDigest(o.TLSCAFile, o.TLSCertFile, o.TLSKeyFile)
+	}
+	if prev != nil && prev.transport != nil && prev.tlsSum == l.tlsSum && prev.ssh == l.ssh && sameTransport(prev.opts, o) {
+		// prev's transport dials through prev's SSH connection and hub
+		// proxy, which are l's as well.
+		l.transport = prev.transport
+		return nil
+	}
+	t, err := s.newTransport(l)
+	if err != nil {
+		return err
+	}
+	l.transport = &hubTransport{t}
+	return nil
+}
+
+// hubTransport is the transport of one or more links; they hold the same
+// pointer when they share it, so only the last of them closes it.
+type hubTransport struct {
+	transport.Transport
+}
+
+// newTransport builds the --transport transport for l. Transports over
+// TCP reach the hub with dialHubTCP on l.
+func (s *Supervisor) newTransport(l *link) (transport.Transport, error) {
+	o := l.opts
+	cfg := transport.Config{
+		Address: net.JoinHostPort(o.HubHost, strconv.Itoa(o.HubPort)),
+		URL:     l.hubURL,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return s.dialHubTCP(ctx, l)
+		},
+	}
+	if o.TLS || o.Transport == transportQUIC {
+		var err error
+		if cfg.TLS, err = o.hubTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	name := o.Transport
+	if name == "" {
+		name = transportTCP // Options built without ParseArgs
+	}
+	return transport.New(name, cfg)
+}
+
+// sameTransport reports whether a and b reach the hub the same way.
+func sameTransport(a, b *Options) bool {
+	return a.Transport == b.Transport && a.HubHost == b.HubHost && a.HubPort == b.HubPort && a.HubURL == b.HubURL &&
+		a.TLS == b.TLS && a.TLSCAFile == b.TLSCAFile && a.TLSServerName == b.TLSServerName && a.TLSInsecure == b.TLSInsecure &&
+		a.TLSCertFile == b.TLSCertFile && a.TLSKeyFile == b.TLSKeyFile && a.HubProxy == b.HubProxy
+}
+
+// release frees what l holds that cur no longer uses, once no worker is
+// left on l.
+func (l *link) release(cur *link) {
+	if l.ssh != nil && l.ssh != cur.ssh {
+		_ = l.ssh.Close()
+	}
+	if l.transport != nil && l.transport != cur.transport {
+		_ = l.transport.Close()
+	}
+	if l.opts.AuthToken != cur.opts.AuthToken {
+		l.opts.AuthToken.Wipe()
+	}
+}
+
+// close shuts down the SSH connection and transport of the final link.
+func (l *link) close() {
+	if l.ssh != nil {
+		_ = l.ssh.Close()
+	}
+	if l.transport != nil {
+		_ = l.transport.Close()
+	}
+}
+
+// fileDigest fingerprints the contents of the named files; unset and
+// unreadable ones count as empty.
+func keyDigest(paths ...string) string {
+	h := sha256.New()
+	for _, path := range paths {
+		if path != "" {
+			data, _ := os.ReadFile(path)
+			h.Write(data)
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// worker is a worker goroutine started by runWorkers.
+type worker struct {
+	id     int
+	link   *link
+	target *Destination // direct mode only
+	retire context.CancelFunc
+	done   chan struct{}
+
+	ready     chan struct{} // closed once the worker has reached the hub
+	readyOnce sync.Once
+
+	mu     sync.Mutex
+	status workerStatus       // reported on the admin socket
+	kill   context.CancelFunc // ends the current hub connection
+}
+
+// connected records that the worker reached the hub.
+func (w *worker) connected() {
+	if w != nil {
+		w.readyOnce.Do(func() { close(w.ready) })
+	}
+}
+
+// runWorkers keeps --workers workers connected until accept ends and
+// applies each reload: workers dialled with an older link generation are
+// replaced one at a time, then workers are started or retired to match the
+// new count. With --max-workers the count follows demand instead; see
+// scaleWorkers. A retired worker finishes the request it is serving.
+func (s *Supervisor) runWorkers(ctx, accept context.Context) {
+	var (
+		wg      sync.WaitGroup
+		workers []*worker
+		nextID  int
+		byGen   = make(map[int][]*worker) // every worker started per link generation
+		tick    <-chan time.Time          // paces autoscaling once --max-workers is set
+	)
+	// start runs a worker for the slot'th place in workers, which also
+	// picks its direct-mode target.
+	start := func(l *link, slot int) *worker {
+		nextID++
+		workerCtx, retire := context.WithCancel(accept)
+		w := &worker{id: nextID, link: l, retire: retire, done: make(chan struct{}), ready: make(chan struct{})}
+		if targets := l.opts.Targets; len(targets) > 0 {
+			w.target = targets[slot%len(targets)]
+		}
+		byGen[l.gen] = append(byGen[l.gen], w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(w.done)
+			defer retire()
+			s.runWorker(ctx, workerCtx, w)
+		}()
+		return w
+	}
+
+	for {
+		cur := s.link()
+		replaced := 0
+		for i, old := range workers {
+			if old.link.gen == cur.gen {
+				continue
+			}
+			w := start(cur, i)
+			select {
+			case <-w.ready:
+			case <-time.After(rollStep):
+				s.logger.Printf("Reload: worker %d has not reached the hub after %s; replacing worker %d anyway", w.id, rollStep, old.id)
+			case <-accept.Done():
+			}
+			old.retire()
+			workers[i] = w
+			replaced++
+		}
+		if replaced > 0 {
+			s.logger.Printf("Reload: replaced %d worker(s)", replaced)
+		}
+		for gen, started := range byGen {
+			if gen == cur.gen {
+				continue
+			}
+			// No new worker uses an older generation; free it once the
+			// last of its workers has finished.
+			delete(byGen, gen)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, w := range started {
+					<-w.done
+				}
+				started[0].link.release(s.link())
+			}()
+		}
+		if cur.opts.MaxWorkers > 0 {
+			add, idle := scaleWorkers(workers, cur.opts, time.Now())
+			for i := 0; i < add; i++ {
+				workers = append(workers, start(cur, len(workers)))
+			}
+			for _, w := range idle {
+				w.retire()
+				workers = slices.DeleteFunc(workers, func(x *worker) bool { return x == w })
+			}
+			if add > 0 || len(idle) > 0 {
+				s.logger.Printf("Autoscale: %d worker(s) (started %d, retired %d idle)", len(workers), add, len(idle))
+			}
+			if tick == nil {
+				ticker := time.NewTicker(scaleTick(cur.opts))
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+		} else {
+			for len(workers) < cur.opts.Workers {
+				workers = append(workers, start(cur, len(workers)))
+			}
+			for len(workers) > cur.opts.Workers {
+				workers[len(workers)-1].retire()
+				workers = workers[:len(workers)-1]
+			}
+		}
+		s.running.Store(int64(len(workers)))
+
+		select {
+		case <-tick:
+		case <-s.demand:
+		case <-s.reloaded:
+		case <-accept.Done():
+			wg.Wait()
+			return
+		}
+	}
+}
+
+// Reload applies options parsed again after a SIGHUP, typically from an
+// edited --config file, without restarting the pool. --workers,
+// --min-workers, --max-workers, --scale-down-after, --retry-delay,
+// --hub-dial-timeout, --target-dial-timeout, --target-dns-ttl,
+// --source-rule, --netns-rule, --scan-concurrency, --hook, --label,
+// --alias, --allow, --deny, --acl-file, --deny-private-resolved,
+// --log-level, --redact, --redact-mode, --rate-limit, --pool-rate-limit,
+// --max-sessions, --queue-timeout, --max-load, --max-cpu, --dns-server,
+// --upstream-proxy, --stall-timeout, --idle-timeout, --read-ahead and
+// --simulate-latency take effect at once (the last four for sessions
+// started afterwards).
+// Changes to how workers reach the hub (its address or URL, TLS, Noise,
+// SSH, the hub proxy, authentication, protocol, compression, progress,
+// pending requests and heartbeats) and to --expose, --target-pattern and
+// --send-proxy-protocol, including rotated key files, replace the workers
+// one at a time so the hub never loses all of them. Other
+// options need a restart; Reload logs them and keeps the running values. On error the running configuration is kept.
+func (s *Supervisor) Reload(next Options) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	cur := s.link()
+	parsed := []*Secret{next.ShutdownKey, next.AuthToken}
+
+	var live, reconnect, restart []string
+	curValue, nextValue := reflect.ValueOf(cur.opts).Elem(), reflect.ValueOf(&next).Elem()
+	for i := 0; i < curValue.NumField(); i++ {
+		name := curValue.Type().Field(i).Name
+		if optionEqual(curValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			// Keep the running value, which may hold state such as a
+			// locked secret.
+			nextValue.Field(i).Set(curValue.Field(i))
+			continue
+		}
+		switch reloadKinds[name] {
+		case reloadLive:
+			live = append(live, name)
+		case reloadReconnect:
+			reconnect = append(reconnect, name)
+		default:
+			restart = append(restart, name)
+			nextValue.Field(i).Set(curValue.Field(i))
+		}
+	}
+
+	// discard wipes the secrets parsed for this reload that are not kept.
+	discard := func(keep ...*Secret) {
+		keep = append(keep, cur.opts.ShutdownKey, cur.opts.AuthToken)
+		for _, secret := range parsed {
+			if !slices.Contains(keep, secret) {
+				secret.Wipe()
+			}
+		}
+	}
+
+	if next.Workers < len(next.Targets) {
+		discard()
+		return fmt.Errorf("--workers must be at least the number of --target destinations (%d)", len(next.Targets))
+	}
+	if next.MaxWorkers > 0 && len(next.Targets) > 1 {
+		discard()
+		return fmt.Errorf("--max-workers cannot share workers out between several --target destinations")
+	}
+
+	l := newLink(&next)
+	l.gen = cur.gen
+	l.transport, l.noise, l.ssh = cur.transport, cur.noise, cur.ssh
+	l.tlsSum, l.noiseSum, l.sshSum = cur.tlsSum, cur.noiseSum, cur.sshSum
+	if (next.TLS || next.Transport == transportQUIC) && keyDigest(next.TLSCAFile, next.TLSCertFile, next.TLSKeyFile) != cur.tlsSum ||
+		next.NoiseHubKeyFile != "" && keyDigest(next.NoiseHubKeyFile, next.NoiseKeyFile) != cur.noiseSum ||
+		next.ViaSSH != "" && keyDigest(next.SSHKeyFile, next.SSHKnownHosts) != cur.sshSum {
+		reconnect = append(reconnect, "key files")
+	}
+	if len(reconnect) > 0 {
+		l.transport, l.noise, l.ssh = nil, nil, nil
+		l.tlsSum, l.noiseSum, l.sshSum = "", "", ""
+		if err := s.connectLink(l, cur); err != nil {
+			discard()
+			return err
+		}
+		l.gen++
+	}
+	discard(next.ShutdownKey, next.AuthToken)
+
+	if len(restart) > 0 {
+		s.logger.Printf("Reload: %s changed but need a restart; keeping the running values", strings.Join(restart, ", "))
+	}
+	for _, warning := range next.UnusedFlags() {
+		logx.At(s.logger, "pool", logx.Warn).Printf("Reload: warning: %s", warning)
+	}
+	if len(live) == 0 && len(reconnect) == 0 {
+		s.logger.Printf("Reload: nothing to apply")
+		return nil
+	}
+	if len(reconnect) > 0 {
+		// The new workers may reach a hub that understands CAPS again.
+		s.bareHello.Store(false)
+	}
+	if next.Protocol != cur.opts.Protocol {
+		s.protocol.Store(ProtocolVersion)
+		if next.Protocol != 0 {
+			s.protocol.Store(int32(next.Protocol))
+		}
+	}
+	s.current.Store(l)
+	logx.SetLevels(next.LogLevel)
+	if slices.Contains(live, "RateLimit") || slices.Contains(live, "PoolRateLimit") {
+		s.setRates(next.RateLimit, next.PoolRateLimit)
+	}
+	if slices.Contains(live, "MaxSessions") {
+		s.wakeSessions()
+	}
+	s.logger.Printf("Reload: applied %s; configuration hash %s", strings.Join(append(live, reconnect...), ", "), l.hash)
+	s.audit.Record("reload", map[string]any{"live": live, "reconnect": reconnect, "restart": restart, "config": l.hash})
+	select {
+	case s.reloaded <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// optionEqual compares two values of the same Options field. Secrets
+// compare by content and hooks by script.
+func optionEqual(a, b any) bool {
+	switch a := a.(type) {
+	case *Secret:
+		return a.Equal(b.(*Secret))
+	case *Hook:
+		b := b.(*Hook)
+		return (a == nil) == (b == nil) && (a == nil || a.Sum == b.Sum)
+	}
+	return reflect.DeepEqual(a, b)
+}
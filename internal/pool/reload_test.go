@@ -0,0 +1,170 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReloadClassifies(t *testing.T) {
+	opts := Options{Mode: ModeSocks, Workers: 2, RetryDelay: time.Second, HubHost: "127.0.0.1", HubPort: 5555, StateFile: "/run/pool.json"}
+	s := NewSupervisor(opts)
+	s.logger = log.New(io.Discard, "", 0)
+	first := s.link()
+	if err := s.connectLink(first, nil); err != nil {
+		t.Fatalf("connectLink: %v", err)
+	}
+
+	if err := s.Reload(opts); err != nil || s.link() != first {
+		t.Fatalf("Reload without changes replaced the link (%v)", err)
+	}
+
+	next := opts
+	next.Workers, next.RetryDelay = 4, 3*time.Second
+	next.StateFile = "/tmp/pool.json"
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	l := s.link()
+	if l.opts.Workers != 4 || l.opts.RetryDelay != 3*time.Second || l.gen != first.gen {
+		t.Fatalf("live changes not applied in place: %+v gen %d", l.opts, l.gen)
+	}
+	if l.opts.StateFile != "/run/pool.json" {
+		t.Fatalf("restart-only option changed to %q", l.opts.StateFile)
+	}
+
+	next.Protocol = 1
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if l := s.link(); l.gen != first.gen+1 || l.transport != first.transport {
+		t.Fatalf("protocol change: gen %d, transport kept %v", l.gen, l.transport == first.transport)
+	}
+
+	next.HubPort = 6666
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if l := s.link(); l.opts.HubPort != 6666 || l.gen != first.gen+2 || l.transport == first.transport {
+		t.Fatalf("hub change not rolled: port %d gen %d", l.opts.HubPort, l.gen)
+	}
+
+	bad := next
+	bad.TLS, bad.TLSCAFile = true, "/nonexistent/ca.pem"
+	if err := s.Reload(bad); err == nil || s.link().opts.TLS {
+		t.Fatalf("Reload with unreadable TLS material: %v", err)
+	}
+}
+
+func TestReloadRollsWorkers(t *testing.T) {
+	listen := func() net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		return ln
+	}
+	// accept answers the next HELLO on ln.
+	accept := func(ln net.Listener) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(15 * time.Second))
+		r := bufio.NewReader(c)
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "HELLO ") {
+			t.Fatalf("expected HELLO, got %q", line)
+		}
+		c.Write([]byte("OK\n"))
+		return c, r
+	}
+	oldHub, newHub := listen(), listen()
+
+	opts := Options{
+		Mode: ModeSocks, Protocol: 1, Workers: 2, RetryDelay: time.Second, ScanConcurrency: 1,
+		HubHost: "127.0.0.1", HubPort: oldHub.Addr().(*net.TCPAddr).Port,
+	}
+	s := NewSupervisor(opts)
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := make(chan error, 1)
+	go func() { run <- s.Run(ctx) }()
+
+	var old [2]*bufio.Reader
+	for i := range old {
+		_, old[i] = accept(oldHub)
+	}
+
+	next := opts
+	next.HubPort, next.Workers = newHub.Addr().(*net.TCPAddr).Port, 3
+	if err := s.Reload(next); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		accept(newHub)
+	}
+	for i, r := range old {
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("worker on the old hub %d not retired: %v", i, err)
+		}
+	}
+
+	cancel()
+	select {
+	case <-run:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if got := fmt.Sprint(s.link().opts.HubPort); got != fmt.Sprint(next.HubPort) {
+		t.Fatalf("link points at port %s", got)
+	}
+}
+
+func TestRunWorkersSharesTargets(t *testing.T) {
+	hub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hub.Close()
+	opts, err := ParseArgs([]string{
+		"-p", fmt.Sprint(hub.Addr().(*net.TCPAddr).Port), "--protocol", "1", "-w", "3",
+		"--target", "10.0.0.1:22", "--target", "db.internal:5432",
+	})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	s := NewSupervisor(*opts)
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	got := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		c, err := hub.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		fields := strings.Fields(line)
+		if len(fields) < 7 || fields[0] != "HELLO" || fields[3] != "DEST" {
+			t.Fatalf("unexpected HELLO %q", line)
+		}
+		got[strings.Join(fields[4:7], " ")]++
+	}
+	if got["ipv4 10.0.0.1 22"] != 2 || got["domain db.internal 5432"] != 1 {
+		t.Fatalf("workers per target: %v", got)
+	}
+}
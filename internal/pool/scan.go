@@ -0,0 +1,245 @@
+package pool
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxScanPorts bounds the ports in one REQUEST SCAN, which keeps the reply
+// to a single control line well inside a protocol version 2 frame.
+const MaxScanPorts = 1024
+
+// MaxBanner bounds the banner=<n> bytes a SCAN may read from each open
+// port, and MaxBannerTotal the banner bytes across all its ports, so the
+// base64 banners still fit the reply line.
+const (
+	MaxBanner      = 1024
+	MaxBannerTotal = 16 * 1024
+)
+
+// bannerTimeout bounds the wait for a service to speak first after a
+// connect, and bannerGrace the wait for more once it has: most banners
+// arrive in one segment, well short of the bytes asked for.
+const (
+	bannerTimeout = 2 * time.Second
+	bannerGrace   = 200 * time.Millisecond
+)
+
+// scanDialTimeout bounds the connect attempt to each port of a scan. A port
+// that neither accepts nor refuses within it is reported with status 4.
+const scanDialTimeout = 2 * time.Second
+
+// ParsePorts parses a SCAN port list: comma-separated ports and inclusive
+// ranges such as "22,80,8000-8010". Ports keep the order given and appear
+// once.
+func ParsePorts(list string) ([]int, error) {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		lo, hi, isRange := strings.Cut(item, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 1 || last > 65535 || first > last {
+			return nil, fmt.Errorf("invalid port list entry %q", item)
+		}
+		for port := first; port <= last; port++ {
+			if seen[port] {
+				continue
+			}
+			if len(ports) == MaxScanPorts {
+				return nil, fmt.Errorf("port list names more than %d ports", MaxScanPorts)
+			}
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// FormatPorts renders ports as a SCAN port list, collapsing runs of
+// consecutive ports into ranges.
+func FormatPorts(ports []int) string {
+	var b strings.Builder
+	for i := 0; i < len(ports); {
+		j := i
+		for j+1 < len(ports) && ports[j+1] == ports[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.Itoa(ports[i]))
+		if j > i {
+			fmt.Fprintf(&b, "-%d", ports[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// portResult is the outcome of one connect probe in a scan.
+type portResult struct {
+	port   int
+	status int // REPLY status: 0 accepted, 5 refused, 4 no answer
+	rtt    time.Duration
+	banner []byte // first bytes the service sent, with banner=<n>
+}
+
+// String renders the result as one entry of a SCAN reply:
+// "<port>:<status>:<ms>ms", followed by ":<base64>" when there is a banner.
+func (r portResult) String() string {
+	entry := fmt.Sprintf("%d:%d:%.3fms", r.port, r.status, float64(r.rtt)/float64(time.Millisecond))
+	if len(r.banner) > 0 {
+		entry += ":" + base64.RawStdEncoding.EncodeToString(r.banner)
+	}
+	return entry
+}
+
+// scan answers a REQUEST SCAN by dialling every listed port of the host,
+// at most --scan-concurrency at a time, and closing each connection as
+// soon as it is established, or once it has read the requested banner.
+// Nothing is bridged; the hub session stays idle afterwards. With stream
+// set, each port's result is sent as a "RESULT <entry>" line as soon as it
+// is known and the reply only counts them; otherwise the reply lists them
+// all. A CANCEL for the session stops the scan early. Only a failure of the
+// hub connection is returned.
+func (s *Supervisor) scan(ctx context.Context, hub net.Conn, control controlSource, writer *controlWriter, req *Request, stream bool, logger *log.Logger) error {
+	scanCtx, cancelScan := context.WithCancel(ctx)
+	defer cancelScan()
+	watch := watchCancel(hub, control, req.SessionID, cancelScan)
+
+	ip := net.ParseIP(req.Address)
+	var lookupErr error
+	if ip == nil {
+		lookupCtx, cancel := context.WithTimeout(scanCtx, scanDialTimeout)
+		ip, lookupErr = s.resolveProbe(lookupCtx, req.Address)
+		cancel()
+	}
+
+	started := time.Now()
+	results := make([]portResult, 0, len(req.Ports))
+	var mu sync.Mutex
+	if lookupErr == nil {
+		slots := make(chan struct{}, max(s.link().opts.ScanConcurrency, 1))
+		var wg sync.WaitGroup
+	launch:
+		for _, port := range req.Ports {
+			select {
+			case slots <- struct{}{}:
+			case <-scanCtx.Done():
+				break launch
+			}
+			wg.Add(1)
+			go func(port int) {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				r := s.probePort(scanCtx, ip, port, req.Banner)
+				if scanCtx.Err() != nil {
+					// Aborted by CANCEL or a failed hub connection.
+					return
+				}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+				if stream {
+					// A failed write surfaces through the cancel watch.
+					_ = writer.send("RESULT " + r.String())
+				}
+			}(port)
+		}
+		wg.Wait()
+	}
+	hubErr := watch.stop()
+
+	switch {
+	case watch.cancelled.Load():
+		logger.Printf("hub cancelled scan %s of %s after %d of %d ports", req.SessionID, req.Address, len(results), len(req.Ports))
+		s.audit.RecordSampled("scan", map[string]any{"dest": req.Address, "outcome": "cancelled", "ports": len(results)})
+		return writer.send(fmt.Sprintf("REPLY 1 %s %s %d", AddrIPv4, "0.0.0.0", 0))
+	case hubErr != nil:
+		return hubErr
+	case lookupErr != nil:
+		status := mapErrorToStatus(lookupErr)
+		logger.Printf("scan of %s failed: %v", req.Address, normalizeError(lookupErr))
+		s.audit.RecordSampled("scan", map[string]any{"dest": req.Address, "outcome": "unresolved", "status": status})
+		return writer.send(fmt.Sprintf("REPLY %d %s %s %d", status, AddrIPv4, "0.0.0.0", 0))
+	}
+
+	open := 0
+	for _, r := range results {
+		if r.status == 0 {
+			open++
+		}
+	}
+	logger.Printf("scan of %s (%s): %d of %d ports open in %s", req.Address, ip, open, len(results), time.Since(started).Round(time.Millisecond))
+	s.audit.RecordSampled("scan", map[string]any{"dest": req.Address, "ports": len(results), "open": open})
+	reply := fmt.Sprintf("REPLY 0 %s %s 0", classifyAddr(ip.String()), ip)
+	if stream {
+		return writer.send(fmt.Sprintf("%s scanned=%d", reply, len(results)))
+	}
+	// Report ports in the order requested.
+	entries := make([]string, len(results))
+	order := make(map[int]int, len(req.Ports))
+	for i, port := range req.Ports {
+		order[port] = i
+	}
+	sort.Slice(results, func(i, j int) bool { return order[results[i].port] < order[results[j].port] })
+	for i, r := range results {
+		entries[i] = r.String()
+	}
+	return writer.send(fmt.Sprintf("%s scan=%s", reply, strings.Join(entries, ",")))
+}
+
+// probePort times one connect to ip:port and, when banner is positive,
+// reads up to that many bytes the service sends first.
+func (s *Supervisor) probePort(ctx context.Context, ip net.IP, port, banner int) portResult {
+	dialCtx, cancel := context.WithTimeout(ctx, scanDialTimeout)
+	defer cancel()
+	started := time.Now()
+	dialer := s.targetDialer()
+	conn, err := dialer.DialContext(dialCtx, "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	rtt := time.Since(started).Round(time.Microsecond)
+	if err != nil {
+		return portResult{port: port, status: mapErrorToStatus(err), rtt: rtt}
+	}
+	defer conn.Close()
+	result := portResult{port: port, status: 0, rtt: rtt}
+	if banner > 0 {
+		result.banner = readBanner(ctx, conn, banner)
+	}
+	return result
+}
+
+// readBanner reads up to n bytes from conn, giving the service
+// bannerTimeout to start talking and bannerGrace after each read to say
+// more. Services that wait for the client yield nothing. Cancelling ctx
+// ends the wait.
+func readBanner(ctx context.Context, conn net.Conn, n int) []byte {
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+	buf := make([]byte, n)
+	got := 0
+	_ = conn.SetReadDeadline(time.Now().Add(bannerTimeout))
+	for got < n && ctx.Err() == nil {
+		m, err := conn.Read(buf[got:])
+		got += m
+		if err != nil {
+			break
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(bannerGrace))
+	}
+	return buf[:got]
+}
@@ -0,0 +1,164 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePorts(t *testing.T) {
+	ports, err := ParsePorts("443,20-22,80,21")
+	if err != nil || fmt.Sprint(ports) != "[443 20 21 22 80]" {
+		t.Fatalf("ParsePorts = %v, %v", ports, err)
+	}
+	if got := FormatPorts([]int{20, 21, 22, 80, 443, 444}); got != "20-22,80,443-444" {
+		t.Fatalf("FormatPorts = %q", got)
+	}
+	for _, bad := range []string{"", "0", "22-20", "80,", "1-65536", "http"} {
+		if _, err := ParsePorts(bad); err == nil {
+			t.Fatalf("ParsePorts(%q) accepted", bad)
+		}
+	}
+	if _, err := ParsePorts(fmt.Sprintf("1-%d", MaxScanPorts+1)); err == nil {
+		t.Fatalf("accepted more than %d ports", MaxScanPorts)
+	}
+}
+
+func TestHubSessionScan(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	open := ln.Addr().(*net.TCPAddr).Port
+	// A port that was just closed refuses connections.
+	spare, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closed := spare.Addr().(*net.TCPAddr).Port
+	spare.Close()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1, ScanConcurrency: 2})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, "scan") {
+		t.Fatalf("HELLO does not offer scan: %q", line)
+	}
+	fmt.Fprintf(hub, "OK CAPS scan\nREQUEST SCAN ipv4 127.0.0.1 %d,%d 1\n", closed, open)
+	line, _ := reader.ReadString('\n')
+	fields := strings.Fields(line)
+	if len(fields) != 6 || strings.Join(fields[:5], " ") != "REPLY 0 ipv4 127.0.0.1 0" || !strings.HasPrefix(fields[5], "scan=") {
+		t.Fatalf("unexpected scan reply %q", line)
+	}
+	entries := strings.Split(strings.TrimPrefix(fields[5], "scan="), ",")
+	if len(entries) != 2 || !strings.HasPrefix(entries[0], fmt.Sprintf("%d:5:", closed)) || !strings.HasPrefix(entries[1], fmt.Sprintf("%d:0:", open)) {
+		t.Fatalf("unexpected scan results %q", fields[5])
+	}
+	if _, err := time.ParseDuration(entries[1][strings.LastIndex(entries[1], ":")+1:]); err != nil {
+		t.Fatalf("connect time in %q: %v", entries[1], err)
+	}
+
+	// With banner=<n> open ports report what the service sent first.
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("220 ready\r\n"))
+			conn.Close()
+		}
+	}()
+	fmt.Fprintf(hub, "REQUEST SCAN ipv4 127.0.0.1 %d,%d 2 banner=64\n", open, closed)
+	line, _ = reader.ReadString('\n')
+	entries = strings.Split(strings.TrimPrefix(strings.Fields(line)[5], "scan="), ",")
+	if !strings.HasSuffix(entries[0], ":"+base64.RawStdEncoding.EncodeToString([]byte("220 ready\r\n"))) || strings.Count(entries[1], ":") != 2 {
+		t.Fatalf("unexpected banner scan results %q", line)
+	}
+
+	// The session stays idle and serves the next request.
+	hub.Write([]byte("REQUEST SCAN domain unresolvable.invalid 80 3\n"))
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 4 ") {
+		t.Fatalf("unresolvable host got %q, want REPLY 4", line)
+	}
+	hub.Close()
+	<-done
+}
+
+func TestHubSessionScanStream(t *testing.T) {
+	// Services that accept but never speak keep a banner scan waiting.
+	var quiet []int
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer ln.Close()
+		quiet = append(quiet, ln.Addr().(*net.TCPAddr).Port)
+	}
+	spare, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	closed := spare.Addr().(*net.TCPAddr).Port
+	spare.Close()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+	hub.SetDeadline(time.Now().Add(10 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	fmt.Fprintf(hub, "OK CAPS cancel,results,scan\nREQUEST SCAN ipv4 127.0.0.1 %d,%d 1\n", closed, quiet[0])
+
+	// Results arrive one by one, and the reply only counts them.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		line, _ := reader.ReadString('\n')
+		entry, ok := strings.CutPrefix(strings.TrimSpace(line), "RESULT ")
+		if !ok {
+			t.Fatalf("want a RESULT line, got %q", line)
+		}
+		port, _, _ := strings.Cut(entry, ":")
+		got[port] = true
+	}
+	if !got[fmt.Sprint(closed)] || !got[fmt.Sprint(quiet[0])] {
+		t.Fatalf("results for ports %v", got)
+	}
+	if line, _ := reader.ReadString('\n'); strings.TrimSpace(line) != "REPLY 0 ipv4 127.0.0.1 0 scanned=2" {
+		t.Fatalf("unexpected reply %q", line)
+	}
+
+	// CANCEL stops a scan that is still waiting for banners.
+	fmt.Fprintf(hub, "REQUEST SCAN ipv4 127.0.0.1 %d,%d,%d 2 banner=16\n", closed, quiet[0], quiet[1])
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, fmt.Sprintf("RESULT %d:5:", closed)) {
+		t.Fatalf("want the refused port first, got %q", line)
+	}
+	started := time.Now()
+	hub.Write([]byte("CANCEL 2\n"))
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 1 ") {
+		t.Fatalf("cancelled scan got %q, want REPLY 1", line)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Fatalf("cancel took %s", waited)
+	}
+	hub.Close()
+	<-done
+}
@@ -0,0 +1,144 @@
+package pool
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"unsafe"
+)
+
+// Secret holds key material loaded from disk. Where the platform allows it
+// the backing memory is locked so it cannot be swapped out, and it always
+// prints as [redacted] so it never leaks into logs or state files. Each
+// Secret has pages of its own, so unlocking one never unlocks another.
+type Secret struct {
+	b      []byte
+	pages  []byte // the whole pages b lies in, used by nothing else
+	locked bool
+	mac    bool // b holds the HMAC-SHA256 pads derived from the key; see PrepareMAC
+}
+
+func newSecret(b []byte) *Secret {
+	s := &Secret{}
+	s.alloc(len(b))
+	copy(s.b, b)
+	return s
+}
+
+// alloc gives s n bytes of locked memory on pages of their own. Go does
+// not move heap objects, so the pages stay put once found inside a
+// buffer a page longer than they are.
+func (s *Secret) alloc(n int) {
+	size := os.Getpagesize()
+	length := max(1, (n+size-1)/size) * size
+	buf := make([]byte, length+size)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(size)); rem != 0 {
+		off = size - rem
+	}
+	s.pages = buf[off : off+length]
+	s.b = s.pages[:n]
+	s.locked = lockMemory(s.pages) == nil
+}
+
+// Bytes exposes the key material, or nil once PrepareMAC has replaced it.
+// Callers must not retain the slice beyond the Secret's lifetime.
+func (s *Secret) Bytes() []byte {
+	if s == nil || s.mac {
+		return nil
+	}
+	return s.b
+}
+
+// Locked reports whether the key material is locked into RAM.
+func (s *Secret) Locked() bool {
+	return s != nil && s.locked
+}
+
+// PrepareMAC is for secrets only ever used as HMAC-SHA256 keys. It
+// derives the inner and outer padded keys HMAC starts from and zeroes the
+// key itself, so that only MAC can use the Secret from then on.
+func (s *Secret) PrepareMAC() {
+	if s == nil || s.b == nil || s.mac {
+		return
+	}
+	key := s.b
+	if len(key) > sha256.BlockSize {
+		sum := sha256.Sum256(key)
+		defer clear(sum[:])
+		key = sum[:]
+	}
+	pads := &Secret{mac: true}
+	pads.alloc(2 * sha256.BlockSize)
+	for i := 0; i < sha256.BlockSize; i++ {
+		var k byte
+		if i < len(key) {
+			k = key[i]
+		}
+		pads.b[i], pads.b[sha256.BlockSize+i] = k^0x36, k^0x5c
+	}
+	s.Wipe()
+	*s = *pads
+}
+
+// MAC returns the HMAC-SHA256 of msg keyed with the secret.
+func (s *Secret) MAC(msg []byte) []byte {
+	if !s.mac {
+		mac := hmac.New(sha256.New, s.b)
+		mac.Write(msg)
+		return mac.Sum(nil)
+	}
+	inner := sha256.New()
+	inner.Write(s.b[:sha256.BlockSize])
+	inner.Write(msg)
+	outer := sha256.New()
+	outer.Write(s.b[sha256.BlockSize:])
+	outer.Write(inner.Sum(nil))
+	return outer.Sum(nil)
+}
+
+// Equal reports whether two secrets hold the same key, prepared the same
+// way.
+func (s *Secret) Equal(o *Secret) bool {
+	if s == nil || o == nil {
+		return s == o
+	}
+	return s.mac == o.mac && subtle.ConstantTimeCompare(s.b, o.b) == 1
+}
+
+// Wipe zeroes and unlocks the key material.
+func (s *Secret) Wipe() {
+	if s == nil || s.b == nil {
+		return
+	}
+	clear(s.b)
+	if s.locked {
+		_ = unlockMemory(s.pages)
+		s.locked = false
+	}
+	s.b, s.pages = nil, nil
+}
+
+func (s *Secret) String() string   { return "[redacted]" }
+func (s *Secret) GoString() string { return "[redacted]" }
+
+// MarshalJSON keeps key material out of any JSON rendering.
+func (s *Secret) MarshalJSON() ([]byte, error) { return []byte(`"[redacted]"`), nil }
+
+// LoadSecret reads a key file, trimming surrounding whitespace. The raw read
+// buffer is zeroed once the key has been copied into its own Secret.
+func LoadSecret(path string) (*Secret, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(data)
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return newSecret(key), nil
+}
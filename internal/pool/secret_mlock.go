@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package pool
+
+import "syscall"
+
+func lockMemory(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Mlock(b)
+}
+
+func unlockMemory(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	return syscall.Munlock(b)
+}
+
+// disableCoreDumps stops the kernel from writing key material to a core file
+// if the process crashes.
+func disableCoreDumps() error {
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{})
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package pool
+
+import "errors"
+
+var errNoMlock = errors.New("memory locking not supported on this platform")
+
+func lockMemory([]byte) error { return errNoMlock }
+
+func unlockMemory([]byte) error { return nil }
+
+func disableCoreDumps() error { return nil }
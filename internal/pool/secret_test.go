@@ -0,0 +1,87 @@
+package pool
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestSecretRedactedAndWiped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("  hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := LoadSecret(path)
+	if err != nil {
+		t.Fatalf("LoadSecret error: %v", err)
+	}
+	if string(secret.Bytes()) != "hunter2" {
+		t.Fatalf("unexpected key %q", secret.Bytes())
+	}
+	if out := fmt.Sprintf("%v %+v %#v", secret, Options{ShutdownKey: secret}, secret); strings.Contains(out, "hunter2") {
+		t.Fatalf("secret leaked into formatted output: %s", out)
+	}
+	backing := secret.Bytes()
+	secret.Wipe()
+	for _, b := range backing {
+		if b != 0 {
+			t.Fatalf("backing memory not zeroed: %q", backing)
+		}
+	}
+	if secret.Bytes() != nil {
+		t.Fatalf("wiped secret still exposes bytes")
+	}
+}
+
+func TestSecretPrepareMAC(t *testing.T) {
+	for _, key := range []string{"s3cret", strings.Repeat("k", 100)} {
+		secret := newSecret([]byte(key))
+		raw := secret.Bytes()
+		want := hmac.New(sha256.New, []byte(key))
+		want.Write([]byte("payload"))
+
+		secret.PrepareMAC()
+		for _, b := range raw {
+			if b != 0 {
+				t.Fatalf("raw key not zeroed once the MAC was prepared: %q", raw)
+			}
+		}
+		if secret.Bytes() != nil {
+			t.Fatalf("prepared secret still exposes its key")
+		}
+		if got := secret.MAC([]byte("payload")); !bytes.Equal(got, want.Sum(nil)) {
+			t.Fatalf("prepared MAC %x, want %x", got, want.Sum(nil))
+		}
+		other := newSecret([]byte(key))
+		if other.Equal(secret) {
+			t.Fatalf("raw and prepared copies of a key compare equal")
+		}
+		other.PrepareMAC()
+		if !other.Equal(secret) {
+			t.Fatalf("two prepared copies of a key differ")
+		}
+		other.Wipe()
+		secret.Wipe()
+	}
+}
+
+func TestSecretOwnPages(t *testing.T) {
+	a, b := newSecret([]byte("one")), newSecret([]byte("two"))
+	defer a.Wipe()
+	defer b.Wipe()
+	size := uintptr(os.Getpagesize())
+	for _, s := range []*Secret{a, b} {
+		if start := uintptr(unsafe.Pointer(&s.pages[0])); start%size != 0 || uintptr(len(s.pages))%size != 0 {
+			t.Fatalf("secret pages at %#x+%d are not whole pages", start, len(s.pages))
+		}
+	}
+	if &a.pages[0] == &b.pages[0] {
+		t.Fatalf("two secrets share a page")
+	}
+}
@@ -0,0 +1,100 @@
+package pool
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SessionLogFormat selects how --session-log records are written.
+type SessionLogFormat string
+
+const (
+	SessionLogJSONL SessionLogFormat = "jsonl"
+	SessionLogCSV   SessionLogFormat = "csv"
+)
+
+// sessionLogColumns is the CSV header, in record order.
+var sessionLogColumns = []string{
+	"time", "session", "host", "port", "bytes_out", "bytes_in", "duration_ms", "reason", "error", "alias", "client", "client_id",
+}
+
+// sessionRecord summarises one bridged stream. BytesOut went from the hub
+// to the target, BytesIn from the target back to the hub.
+type sessionRecord struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	Host     string    `json:"host"`
+	Port     int       `json:"port"`
+	BytesOut int64     `json:"bytes_out"`
+	BytesIn  int64     `json:"bytes_in"`
+	Duration int64     `json:"duration_ms"`
+	Reason   endReason `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+	Alias    string    `json:"alias,omitempty"`     // the --alias name of the destination
+	Client   string    `json:"client,omitempty"`    // the hub's client, ip:port
+	ClientID string    `json:"client_id,omitempty"` // the hub's name for it
+}
+
+// sessionLog appends one record per bridged stream to the --session-log
+// file. Unlike the audit log it is never sampled. A nil *sessionLog
+// discards records.
+type sessionLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	format SessionLogFormat
+	csv    *csv.Writer
+}
+
+// openSessionLog opens path for appending. A CSV file gets a header row
+// when it is new or empty.
+func openSessionLog(path string, format SessionLogFormat) (*sessionLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &sessionLog{f: f, format: format}
+	if format == SessionLogCSV {
+		l.csv = csv.NewWriter(f)
+		if info, err := f.Stat(); err == nil && info.Size() == 0 {
+			_ = l.csv.Write(sessionLogColumns)
+			l.csv.Flush()
+		}
+	}
+	return l, nil
+}
+
+// Record appends rec. Write failures are ignored, as for the audit log.
+func (l *sessionLog) Record(rec sessionRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.csv != nil {
+		_ = l.csv.Write([]string{
+			rec.Time.UTC().Format(time.RFC3339Nano), rec.Session, rec.Host, strconv.Itoa(rec.Port),
+			strconv.FormatInt(rec.BytesOut, 10), strconv.FormatInt(rec.BytesIn, 10),
+			strconv.FormatInt(rec.Duration, 10), string(rec.Reason), rec.Error, rec.Alias,
+			rec.Client, rec.ClientID,
+		})
+		l.csv.Flush()
+		return
+	}
+	rec.Time = rec.Time.UTC()
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	_, _ = l.f.Write(append(line, '\n'))
+}
+
+func (l *sessionLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLogJSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.jsonl")
+	l, err := openSessionLog(path, SessionLogJSONL)
+	if err != nil {
+		t.Fatalf("openSessionLog: %v", err)
+	}
+	s := NewSupervisor(Options{})
+	s.sessionLog = l
+	req := &Request{Command: "CONNECT", Address: "db.internal", Port: 5432, SessionID: "7"}
+	started := time.Now().Add(-1500 * time.Millisecond)
+	s.endSession(context.Background(), req, started, bridgeResult{reason: endTargetClosed, toTarget: 120, toHub: 4096}, nil, log.New(io.Discard, "", 0))
+	s.endSession(context.Background(), req, started, bridgeResult{reason: endError}, errors.New("connection reset"), log.New(io.Discard, "", 0))
+	l.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d records: %q", len(lines), data)
+	}
+	var rec sessionRecord
+	if err := json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatalf("decode %q: %v", lines[0], err)
+	}
+	if rec.Session != "7" || rec.Host != "db.internal" || rec.Port != 5432 || rec.BytesOut != 120 || rec.BytesIn != 4096 ||
+		rec.Reason != endTargetClosed || rec.Duration < 1500 || rec.Error != "" {
+		t.Fatalf("record %+v", rec)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil || rec.Error != "connection reset" {
+		t.Fatalf("error record %q: %v", lines[1], err)
+	}
+}
+
+func TestSessionLogCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.csv")
+	for i := 0; i < 2; i++ {
+		l, err := openSessionLog(path, SessionLogCSV)
+		if err != nil {
+			t.Fatalf("openSessionLog: %v", err)
+		}
+		l.Record(sessionRecord{Time: time.Now(), Session: "1", Host: "10.0.0.5", Port: 443, BytesOut: 1, BytesIn: 2, Reason: endClientClosed, Alias: "dc1-web", Client: "192.0.2.7:51234", ClientID: "42"})
+		l.Close()
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv: %v", err)
+	}
+	// One header, even though the file was opened twice.
+	if len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(sessionLogColumns, ",") {
+		t.Fatalf("rows %q", rows)
+	}
+	if got := strings.Join(rows[1][1:], ","); got != "1,10.0.0.5,443,1,2,0,client-closed,,dc1-web,192.0.2.7:51234,42" {
+		t.Fatalf("row %q", got)
+	}
+}
+
+func TestParseArgsSessionLog(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--session-log", "s.csv", "--session-log-format", "CSV"})
+	if err != nil || opts.SessionLog != "s.csv" || opts.SessionLogFormat != SessionLogCSV {
+		t.Fatalf("ParseArgs: %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--session-log-format", "xml"}); err == nil {
+		t.Fatal("accepted --session-log-format xml")
+	}
+}
@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownSkew bounds how far a SHUTDOWN timestamp may drift from the local
+// clock before the message is treated as stale. Replays within the window
+// are caught by shutdownNonces.
+const shutdownSkew = 5 * time.Minute
+
+// ErrRemoteShutdown is returned by Run when the hub decommissioned the pool
+// with a verified SHUTDOWN message.
+var ErrRemoteShutdown = errors.New("pool shut down by hub")
+
+// SignShutdown builds a SHUTDOWN control line authenticated with key. A
+// worker that announced an IDENTITY gets one naming it, which no other
+// connection accepts; id is "" for the others.
+func SignShutdown(key *Secret, id string, ts time.Time, nonce string) string {
+	payload := fmt.Sprintf("SHUTDOWN %d %s", ts.Unix(), nonce)
+	if id != "" {
+		payload += " " + id
+	}
+	return payload + " " + shutdownMAC(key, payload)
+}
+
+// verifyShutdown checks a SHUTDOWN line of the form
+// "SHUTDOWN <unix-ts> <nonce> [<id>] <hex-hmac-sha256>". The line must name
+// id when the worker announced one, and name nothing otherwise.
+func verifyShutdown(key *Secret, id, line string, now time.Time) error {
+	fields := strings.Fields(line)
+	want := 4
+	if id != "" {
+		want = 5
+	}
+	if len(fields) != want || fields[0] != "SHUTDOWN" {
+		return fmt.Errorf("malformed shutdown line")
+	}
+	ts, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", fields[1])
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > shutdownSkew || d < -shutdownSkew {
+		return fmt.Errorf("timestamp outside the accepted window")
+	}
+	if id != "" && fields[3] != id {
+		return fmt.Errorf("addressed to another worker")
+	}
+	payload := strings.Join(fields[:want-1], " ")
+	mac := shutdownMAC(key, payload)
+	if !hmac.Equal([]byte(mac), []byte(strings.ToLower(fields[want-1]))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// newShutdownIdentity picks the ID a worker announces in its IDENTITY
+// line. It is fresh for every hub connection, so a SHUTDOWN captured on one
+// is refused on any other, including those of a restarted pool.
+func newShutdownIdentity() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// shutdownNonces remembers the nonces of accepted SHUTDOWN messages for as
+// long as their timestamps are within the window, so a message captured on
+// its way to one worker cannot be replayed to another of the same pool.
+type shutdownNonces struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce -> when its message leaves the window
+}
+
+// accept verifies line as verifyShutdown does and refuses a nonce it has
+// already accepted.
+func (n *shutdownNonces) accept(key *Secret, id, line string, now time.Time) error {
+	if err := verifyShutdown(key, id, line, now); err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	ts, _ := strconv.ParseInt(fields[1], 10, 64)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for nonce, expires := range n.seen {
+		if now.After(expires) {
+			delete(n.seen, nonce)
+		}
+	}
+	if _, ok := n.seen[fields[2]]; ok {
+		return fmt.Errorf("nonce %s already used", fields[2])
+	}
+	if n.seen == nil {
+		n.seen = make(map[string]time.Time)
+	}
+	n.seen[fields[2]] = time.Unix(ts, 0).Add(shutdownSkew)
+	return nil
+}
+
+func shutdownMAC(key *Secret, payload string) string {
+	return hex.EncodeToString(key.MAC([]byte(payload)))
+}
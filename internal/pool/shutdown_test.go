@@ -0,0 +1,81 @@
+package pool
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyShutdown(t *testing.T) {
+	key := newSecret([]byte("s3cret"))
+	defer key.Wipe()
+	now := time.Unix(1700000000, 0)
+	line := SignShutdown(key, "", now, "abc123")
+
+	if err := verifyShutdown(key, "", line, now.Add(time.Minute)); err != nil {
+		t.Fatalf("expected valid shutdown, got %v", err)
+	}
+	if err := verifyShutdown(newSecret([]byte("other")), "", line, now); err == nil {
+		t.Fatalf("expected signature mismatch with wrong key")
+	}
+	if err := verifyShutdown(key, "", line, now.Add(time.Hour)); err == nil {
+		t.Fatalf("expected stale shutdown to be rejected")
+	}
+	if err := verifyShutdown(key, "", "SHUTDOWN 1700000000 abc123", now); err == nil {
+		t.Fatalf("expected unsigned shutdown to be rejected")
+	}
+}
+
+func TestVerifyShutdownIdentity(t *testing.T) {
+	key := newSecret([]byte("s3cret"))
+	defer key.Wipe()
+	now := time.Unix(1700000000, 0)
+	line := SignShutdown(key, "0a1b", now, "abc123")
+
+	if err := verifyShutdown(key, "0a1b", line, now); err != nil {
+		t.Fatalf("expected shutdown naming the worker to be accepted, got %v", err)
+	}
+	if err := verifyShutdown(key, "2c3d", line, now); err == nil {
+		t.Fatalf("expected shutdown naming another worker to be rejected")
+	}
+	if err := verifyShutdown(key, "", line, now); err == nil {
+		t.Fatalf("expected shutdown naming a worker to be rejected without an identity")
+	}
+	if err := verifyShutdown(key, "0a1b", SignShutdown(key, "", now, "abc123"), now); err == nil {
+		t.Fatalf("expected shutdown naming no worker to be rejected once an identity was announced")
+	}
+	forged := strings.Replace(line, " 0a1b ", " 2c3d ", 1)
+	if err := verifyShutdown(key, "2c3d", forged, now); err == nil {
+		t.Fatalf("expected the identity to be covered by the signature")
+	}
+}
+
+func TestShutdownNoncesReplay(t *testing.T) {
+	key := newSecret([]byte("s3cret"))
+	defer key.Wipe()
+	now := time.Unix(1700000000, 0)
+	line := SignShutdown(key, "", now, "abc123")
+	var seen shutdownNonces
+
+	if err := seen.accept(key, "", line, now); err != nil {
+		t.Fatalf("expected first shutdown to be accepted, got %v", err)
+	}
+	if err := seen.accept(key, "", line, now.Add(time.Minute)); err == nil {
+		t.Fatalf("expected replayed shutdown to be rejected")
+	}
+	if err := seen.accept(key, "", SignShutdown(key, "", now, "def456"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("expected shutdown with a fresh nonce to be accepted, got %v", err)
+	}
+	if err := seen.accept(key, "", "SHUTDOWN 1700000000 ghi789 00", now); err == nil {
+		t.Fatalf("expected unsigned shutdown to be rejected")
+	}
+	if _, ok := seen.seen["ghi789"]; ok {
+		t.Fatalf("unsigned shutdown must not be remembered")
+	}
+	if err := seen.accept(key, "", SignShutdown(key, "", now.Add(10*time.Minute), "jkl012"), now.Add(10*time.Minute)); err != nil {
+		t.Fatalf("expected later shutdown to be accepted, got %v", err)
+	}
+	if len(seen.seen) != 1 {
+		t.Fatalf("expected nonces outside the window to be forgotten, have %d", len(seen.seen))
+	}
+}
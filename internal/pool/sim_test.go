@@ -0,0 +1,386 @@
+package pool
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// simulation is a discrete-event model of a pool's workers and the hub's
+// queue of waiting clients, run on a virtual clock so that hours of traffic
+// take milliseconds. Workers follow runWorker: dial, serve requests one at
+// a time on the connection, and wait for the real Supervisor's retryDelay
+// after a failure. The worker count is read from the Supervisor too, so
+// Reload scales the model the way it scales runWorkers.
+type simulation struct {
+	s      *Supervisor
+	rng    *rand.Rand
+	now    time.Duration
+	events simEvents
+	seq    int
+	began  bool
+
+	arrival  func() time.Duration         // gap between client requests
+	service  func() time.Duration         // how long a request holds its worker
+	connect  func() time.Duration         // dial and handshake latency
+	hubFault func(at time.Duration) error // why the hub refuses workers at a time, if it does
+
+	workers []*simWorker
+	idle    []*simWorker
+	queue   []time.Duration // arrival times of clients waiting for a worker
+	epoch   int             // bumped when every hub connection is lost
+	stats   simStats
+}
+
+type simWorker struct {
+	id        int
+	failures  int // runWorker's certFailures
+	connected bool
+	busy      bool
+	retired   bool
+	epoch     int // of the current connection
+	dials     int
+}
+
+type simStats struct {
+	Arrived, Served, Lost int
+	Dials, FailedDials    int
+	MaxQueue              int
+	Waits                 []simWait
+}
+
+type simWait struct {
+	Arrived, Wait time.Duration
+}
+
+type simEvent struct {
+	at  time.Duration
+	seq int
+	fn  func()
+}
+
+type simEvents []*simEvent
+
+func (q simEvents) Len() int { return len(q) }
+func (q simEvents) Less(i, j int) bool {
+	return q[i].at < q[j].at || q[i].at == q[j].at && q[i].seq < q[j].seq
+}
+func (q simEvents) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simEvents) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simEvents) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// newSimulation models a pool started with opts. Unless a test changes
+// them, clients arrive every 500ms and hold a worker for 2s on average, and
+// dialling the hub takes 50-250ms.
+func newSimulation(opts Options, seed uint64) *simulation {
+	s := NewSupervisor(opts)
+	s.logger = log.New(io.Discard, "", 0)
+	sim := &simulation{s: s, rng: rand.New(rand.NewPCG(seed, seed))}
+	sim.arrival = sim.exponential(500 * time.Millisecond)
+	sim.service = sim.exponential(2 * time.Second)
+	sim.connect = sim.uniform(50*time.Millisecond, 250*time.Millisecond)
+	sim.hubFault = func(time.Duration) error { return nil }
+	return sim
+}
+
+func (sim *simulation) exponential(mean time.Duration) func() time.Duration {
+	return func() time.Duration { return time.Duration(sim.rng.ExpFloat64() * float64(mean)) }
+}
+
+func (sim *simulation) uniform(lo, hi time.Duration) func() time.Duration {
+	return func() time.Duration { return lo + time.Duration(sim.rng.Int64N(int64(hi-lo))) }
+}
+
+// at schedules fn at virtual time t.
+func (sim *simulation) at(t time.Duration, fn func()) {
+	sim.seq++
+	heap.Push(&sim.events, &simEvent{at: t, seq: sim.seq, fn: fn})
+}
+
+// run processes events up to virtual time until.
+func (sim *simulation) run(until time.Duration) {
+	if !sim.began {
+		sim.began = true
+		sim.scale()
+		sim.at(sim.arrival(), sim.arrive)
+	}
+	for len(sim.events) > 0 && sim.events[0].at <= until {
+		e := heap.Pop(&sim.events).(*simEvent)
+		sim.now = e.at
+		e.fn()
+	}
+	sim.now = until
+}
+
+// scale starts or retires workers to match the current --workers, as
+// runWorkers does after a reload.
+func (sim *simulation) scale() {
+	want := sim.s.link().opts.Workers
+	for len(sim.workers) < want {
+		w := &simWorker{id: len(sim.workers) + 1}
+		sim.workers = append(sim.workers, w)
+		sim.dial(w)
+	}
+	for len(sim.workers) > want {
+		w := sim.workers[len(sim.workers)-1]
+		sim.workers = sim.workers[:len(sim.workers)-1]
+		w.retired = true
+		if !w.busy {
+			sim.idle = slices.DeleteFunc(sim.idle, func(i *simWorker) bool { return i == w })
+			w.connected = false
+		}
+	}
+}
+
+// reload applies next with Supervisor.Reload and rescales.
+func (sim *simulation) reload(next Options) error {
+	err := sim.s.Reload(next)
+	sim.scale()
+	return err
+}
+
+func (sim *simulation) dial(w *simWorker) {
+	if w.retired {
+		return
+	}
+	sim.stats.Dials++
+	w.dials++
+	sim.at(sim.now+sim.connect(), func() {
+		if w.retired {
+			return
+		}
+		if err := sim.hubFault(sim.now); err != nil {
+			sim.stats.FailedDials++
+			sim.at(sim.now+sim.s.retryDelay(err, &w.failures), func() { sim.dial(w) })
+			return
+		}
+		w.connected, w.epoch = true, sim.epoch
+		sim.ready(w)
+	})
+}
+
+// ready returns a connected worker to the hub's idle list.
+func (sim *simulation) ready(w *simWorker) {
+	sim.idle = append(sim.idle, w)
+	sim.dispatch()
+}
+
+// dispatch pairs waiting clients with idle workers in arrival order.
+func (sim *simulation) dispatch() {
+	for len(sim.queue) > 0 && len(sim.idle) > 0 {
+		w := sim.idle[0]
+		sim.idle = sim.idle[1:]
+		arrived := sim.queue[0]
+		sim.queue = sim.queue[1:]
+		sim.stats.Waits = append(sim.stats.Waits, simWait{Arrived: arrived, Wait: sim.now - arrived})
+		w.busy = true
+		epoch := w.epoch
+		sim.at(sim.now+sim.service(), func() {
+			if w.epoch != epoch || !w.connected {
+				return // the connection was lost mid-request
+			}
+			w.busy = false
+			sim.stats.Served++
+			if w.retired {
+				w.connected = false
+				return
+			}
+			sim.ready(w)
+		})
+	}
+}
+
+func (sim *simulation) arrive() {
+	sim.stats.Arrived++
+	sim.queue = append(sim.queue, sim.now)
+	sim.stats.MaxQueue = max(sim.stats.MaxQueue, len(sim.queue))
+	sim.dispatch()
+	sim.at(sim.now+sim.arrival(), sim.arrive)
+}
+
+// dropAll cuts every hub connection, as a network outage between the
+// bastion and the hub would. Each worker sees its session end with EOF.
+func (sim *simulation) dropAll() {
+	sim.epoch++
+	sim.idle = nil
+	for _, w := range sim.workers {
+		if !w.connected {
+			continue
+		}
+		if w.busy {
+			sim.stats.Lost++
+		}
+		w.connected, w.busy = false, false
+		sim.at(sim.now+sim.s.retryDelay(io.EOF, &w.failures), func() { sim.dial(w) })
+	}
+}
+
+func (sim *simulation) connected() int {
+	n := 0
+	for _, w := range sim.workers {
+		if w.connected {
+			n++
+		}
+	}
+	return n
+}
+
+// waitQuantile returns the q-quantile of the waits of clients that arrived
+// in [from, to).
+func (sim *simulation) waitQuantile(q float64, from, to time.Duration) time.Duration {
+	var waits []time.Duration
+	for _, w := range sim.stats.Waits {
+		if w.Arrived >= from && w.Arrived < to {
+			waits = append(waits, w.Wait)
+		}
+	}
+	if len(waits) == 0 {
+		return 0
+	}
+	slices.Sort(waits)
+	return waits[int(q*float64(len(waits)-1))]
+}
+
+func TestSimulationSteadyLoad(t *testing.T) {
+	sim := newSimulation(Options{Workers: 8, RetryDelay: time.Second}, 1)
+	sim.run(6 * time.Hour)
+
+	if sim.stats.Arrived < 40000 || sim.stats.Arrived-sim.stats.Served-len(sim.queue) > 8 {
+		t.Fatalf("arrived %d, served %d, queued %d", sim.stats.Arrived, sim.stats.Served, len(sim.queue))
+	}
+	if p99 := sim.waitQuantile(0.99, 0, 6*time.Hour); p99 > 5*time.Second {
+		t.Fatalf("p99 wait %s at half capacity", p99)
+	}
+	if sim.stats.Dials != 8 {
+		t.Fatalf("%d dials without failures", sim.stats.Dials)
+	}
+}
+
+func TestSimulationLinkOutage(t *testing.T) {
+	const start, end = time.Hour, time.Hour + 10*time.Minute
+	sim := newSimulation(Options{Workers: 4, RetryDelay: time.Second}, 2)
+	sim.arrival = sim.exponential(2 * time.Second)
+	sim.service = sim.exponential(time.Second)
+	sim.hubFault = func(at time.Duration) error {
+		if at >= start && at < end {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	}
+	sim.at(start, sim.dropAll)
+	var during, after int
+	sim.at(start+time.Minute, func() { during = sim.connected() })
+	// A worker notices within one retry delay and one dial.
+	sim.at(end+time.Second+250*time.Millisecond, func() { after = sim.connected() })
+	sim.run(2 * time.Hour)
+
+	if during != 0 || after != 4 {
+		t.Fatalf("connected workers: %d during the outage, %d after", during, after)
+	}
+	for _, w := range sim.workers {
+		// A constant retry delay: one dial per second of outage, plus
+		// the dial that succeeds.
+		if w.dials > 10*60+2 {
+			t.Fatalf("worker %d dialled %d times", w.id, w.dials)
+		}
+	}
+	if max := sim.waitQuantile(1, start, end); max > end-start {
+		t.Fatalf("a client queued during the outage waited %s", max)
+	}
+	if p99 := sim.waitQuantile(0.99, end+time.Minute, 2*time.Hour); p99 > 5*time.Second {
+		t.Fatalf("p99 wait %s after the backlog cleared", p99)
+	}
+}
+
+func TestSimulationCertificateBackoff(t *testing.T) {
+	const fixed = 2 * time.Hour
+	sim := newSimulation(Options{Workers: 4, RetryDelay: time.Second}, 3)
+	sim.hubFault = func(at time.Duration) error {
+		if at < fixed {
+			return &certificateError{err: errors.New("x509: certificate has expired")}
+		}
+		return nil
+	}
+	var served int
+	sim.at(fixed, func() { served = sim.stats.Served })
+	sim.run(fixed + maxCertBackoff + time.Second)
+
+	if served != 0 || sim.connected() != 4 {
+		t.Fatalf("served %d before the fix, %d workers connected after", served, sim.connected())
+	}
+	for _, w := range sim.workers {
+		// 1s doubling to the 5m cap takes 9 tries and 511s; the rest of
+		// the two hours is spent 5m apart.
+		if w.dials < 25 || w.dials > 40 {
+			t.Fatalf("worker %d dialled %d times in %s of certificate errors", w.id, w.dials, fixed)
+		}
+	}
+}
+
+func TestSimulationReloadScales(t *testing.T) {
+	opts := Options{Workers: 4, RetryDelay: time.Second}
+	sim := newSimulation(opts, 4)
+	sim.arrival = sim.exponential(250 * time.Millisecond)
+	sim.service = sim.exponential(1500 * time.Millisecond)
+	sim.run(time.Hour)
+	if len(sim.queue) < 1000 {
+		t.Fatalf("only %d queued with too few workers", len(sim.queue))
+	}
+
+	opts.Workers = 12
+	if err := sim.reload(opts); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	sim.run(3 * time.Hour)
+	if len(sim.workers) != 12 || sim.connected() != 12 {
+		t.Fatalf("%d workers, %d connected after scaling up", len(sim.workers), sim.connected())
+	}
+	if p99 := sim.waitQuantile(0.99, 2*time.Hour, 3*time.Hour); p99 > 5*time.Second {
+		t.Fatalf("p99 wait %s after scaling up", p99)
+	}
+
+	opts.Workers = 2
+	if err := sim.reload(opts); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	sim.run(3*time.Hour + time.Minute)
+	if sim.connected() != 2 {
+		t.Fatalf("%d workers connected after scaling down", sim.connected())
+	}
+}
+
+func TestSimulationDeterministic(t *testing.T) {
+	stats := func(seed uint64) simStats {
+		sim := newSimulation(Options{Workers: 3, RetryDelay: time.Second}, seed)
+		sim.hubFault = func(at time.Duration) error {
+			if at%(20*time.Minute) < time.Minute {
+				return syscall.ECONNRESET
+			}
+			return nil
+		}
+		for at := 20 * time.Minute; at < 2*time.Hour; at += 20 * time.Minute {
+			sim.at(at, sim.dropAll)
+		}
+		sim.run(2 * time.Hour)
+		return sim.stats
+	}
+	if a, b := stats(7), stats(7); !reflect.DeepEqual(a, b) {
+		t.Fatalf("the same seed gave different runs: %d/%d/%d vs %d/%d/%d",
+			a.Arrived, a.Served, a.Dials, b.Arrived, b.Served, b.Dials)
+	}
+	if a, b := stats(7), stats(8); reflect.DeepEqual(a, b) {
+		t.Fatal("different seeds gave identical runs")
+	}
+}
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+)
+
+// maxSocketBuffer caps --so-rcvbuf and --so-sndbuf; setsockopt takes an int.
+const maxSocketBuffer = 1 << 30
+
+// bufferControl returns a dialer control function that applies
+// --so-rcvbuf and --so-sndbuf before the connection is made, so the
+// receive window scale offered in the SYN accounts for them. It returns
+// nil when neither is set.
+func (s *Supervisor) bufferControl() func(context.Context, string, string, syscall.RawConn) error {
+	rcv, snd := s.opts.SoRcvBuf, s.opts.SoSndBuf
+	if rcv == 0 && snd == 0 {
+		return nil
+	}
+	return func(_ context.Context, _, _ string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			if rcv > 0 {
+				if opErr = setSocketBuffer(fd, syscall.SO_RCVBUF, rcv); opErr != nil {
+					opErr = fmt.Errorf("set --so-rcvbuf: %w", opErr)
+					return
+				}
+			}
+			if snd > 0 {
+				if opErr = setSocketBuffer(fd, syscall.SO_SNDBUF, snd); opErr != nil {
+					opErr = fmt.Errorf("set --so-sndbuf: %w", opErr)
+					return
+				}
+			}
+			s.bufferCheck.Do(func() { s.reportBuffers(fd, rcv, snd) })
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// reportBuffers logs, once, the buffer sizes the kernel granted, since
+// Linux silently caps them at net.core.rmem_max and wmem_max.
+func (s *Supervisor) reportBuffers(fd uintptr, rcv, snd int) {
+	gotRcv, err1 := getSocketBuffer(fd, syscall.SO_RCVBUF)
+	gotSnd, err2 := getSocketBuffer(fd, syscall.SO_SNDBUF)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	s.logger.Printf("socket buffers: requested rcvbuf=%d sndbuf=%d, kernel granted rcvbuf=%d sndbuf=%d", rcv, snd, gotRcv, gotSnd)
+	if gotRcv < rcv || gotSnd < snd {
+		s.logger.Printf("warning: the kernel capped the socket buffers; raise net.core.rmem_max/wmem_max (Linux) or kern.ipc.maxsockbuf (macOS)")
+	}
+}
@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"io"
+	"log"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestBufferControl(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	s := NewSupervisor(Options{SoRcvBuf: 64 << 10, SoSndBuf: 96 << 10})
+	s.logger = log.New(io.Discard, "", 0)
+	conn, err := s.dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	raw, _ := conn.(*net.TCPConn).SyscallConn()
+	raw.Control(func(fd uintptr) {
+		// Linux reports double the requested size to account for overhead.
+		if got, err := getSocketBuffer(fd, syscall.SO_RCVBUF); err != nil || got < 64<<10 {
+			t.Errorf("SO_RCVBUF = %d (%v), want at least 64K", got, err)
+		}
+		if got, err := getSocketBuffer(fd, syscall.SO_SNDBUF); err != nil || got < 96<<10 {
+			t.Errorf("SO_SNDBUF = %d (%v), want at least 96K", got, err)
+		}
+	})
+
+	if NewSupervisor(Options{}).dialer.ControlContext != nil {
+		t.Fatal("dialer control installed without --so-rcvbuf/--so-sndbuf")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package pool
+
+import "syscall"
+
+func setSocketBuffer(fd uintptr, opt, size int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, size)
+}
+
+func getSocketBuffer(fd uintptr, opt int) (int, error) {
+	return syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+}
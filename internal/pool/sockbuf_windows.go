@@ -0,0 +1,19 @@
+//go:build windows
+
+package pool
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func setSocketBuffer(fd uintptr, opt, size int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, size)
+}
+
+func getSocketBuffer(fd uintptr, opt int) (int, error) {
+	var v int32
+	l := int32(unsafe.Sizeof(v))
+	err := syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, int32(opt), (*byte)(unsafe.Pointer(&v)), &l)
+	return int(v), err
+}
@@ -0,0 +1,145 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// SourceRule makes connections to targets in Network leave from Source, on
+// bastions with an address on each of several networks.
+type SourceRule struct {
+	Network netip.Prefix
+	Source  netip.Addr
+}
+
+func (r SourceRule) String() string {
+	return r.Network.String() + " via " + r.Source.String()
+}
+
+// ParseSourceRule parses a --source-rule value, "<cidr> via <ip>" or
+// "<cidr>=<ip>".
+func ParseSourceRule(text string) (SourceRule, error) {
+	network, source, ok := strings.Cut(text, "=")
+	if fields := strings.Fields(text); !ok && len(fields) == 3 && fields[1] == "via" {
+		network, source, ok = fields[0], fields[2], true
+	}
+	if !ok {
+		return SourceRule{}, fmt.Errorf("expected <cidr> via <ip>, got %q", text)
+	}
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(network))
+	if err != nil {
+		return SourceRule{}, fmt.Errorf("invalid network %q", network)
+	}
+	addr, err := netip.ParseAddr(strings.TrimSpace(source))
+	if err != nil || addr.Zone() != "" {
+		return SourceRule{}, fmt.Errorf("invalid source address %q", source)
+	}
+	if addr.Is4() != prefix.Addr().Is4() {
+		return SourceRule{}, fmt.Errorf("%s and %s are different address families", prefix, addr)
+	}
+	return SourceRule{Network: prefix.Masked(), Source: addr}, nil
+}
+
+// sourceFor returns the source address for connections to ip: that of the
+// most specific rule whose network contains it.
+func sourceFor(rules []SourceRule, ip netip.Addr) (netip.Addr, bool) {
+	ip = ip.Unmap()
+	best := -1
+	for i, r := range rules {
+		if r.Network.Contains(ip) && (best < 0 || r.Network.Bits() > rules[best].Network.Bits()) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return netip.Addr{}, false
+	}
+	return rules[best].Source, true
+}
+
+// namedTarget reports whether host names a container or Kubernetes
+// service that resolveTarget looks up rather than a host.
+func (s *Supervisor) namedTarget(host string) bool {
+	return s.containers != nil && containerTarget(host) || s.k8s != nil && k8sTarget(host)
+}
+
+// resolveTarget returns the addresses to connect to for req's target: the
+// address itself, those of the containers it names with --container-api or
+// of the pods behind the Kubernetes service it names with --kubeconfig, or
+// those DNS returns for a domain, asking --dns-server if set.
+func (s *Supervisor) resolveTarget(ctx context.Context, req *Request) ([]netip.AddrPort, error) {
+	withPort := func(ips []netip.Addr, err error) ([]netip.AddrPort, error) {
+		targets := make([]netip.AddrPort, len(ips))
+		for i, ip := range ips {
+			targets[i] = netip.AddrPortFrom(ip, uint16(req.Port))
+		}
+		return targets, err
+	}
+	if ip, err := netip.ParseAddr(req.Address); err == nil {
+		return withPort([]netip.Addr{ip}, nil)
+	}
+	switch {
+	case s.containers != nil && containerTarget(req.Address):
+		return withPort(s.containers.lookup(ctx, req.Address))
+	case s.k8s != nil && k8sTarget(req.Address):
+		return s.k8s.lookup(ctx, req.Address, req.Port)
+	}
+	return withPort(s.resolver().LookupNetIP(ctx, "ip", req.Address))
+}
+
+// dialSourced connects to each of targets in turn with dialer, binding
+// each attempt to the source address the rules pick for it and dialing
+// from the network namespace the netns rules pick.
+func dialSourced(ctx context.Context, dialer net.Dialer, targets []netip.AddrPort, rules []SourceRule, netns []NetnsRule) (net.Conn, error) {
+	var firstErr error
+	for _, target := range targets {
+		ip := target.Addr()
+		d := dialer
+		if source, ok := sourceFor(rules, ip); ok {
+			d.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+		}
+		address := net.JoinHostPort(ip.Unmap().String(), strconv.Itoa(int(target.Port())))
+		var conn net.Conn
+		var err error
+		if path, ok := netnsFor(netns, ip); ok {
+			conn, err = dialInNetns(ctx, d, path, address)
+		} else {
+			conn, err = d.DialContext(ctx, "tcp", address)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// unassignedSources returns the rule sources no local interface has, which
+// every dial through them would fail to bind.
+func unassignedSources(rules []SourceRule) []netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	local := make(map[netip.Addr]bool)
+	for _, a := range addrs {
+		if prefix, err := netip.ParsePrefix(a.String()); err == nil {
+			local[prefix.Addr()] = true
+		}
+	}
+	var missing []netip.Addr
+	for _, r := range rules {
+		if !local[r.Source] {
+			missing = append(missing, r.Source)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+)
+
+func TestParseSourceRule(t *testing.T) {
+	for text, want := range map[string]string{
+		"10.1.0.0/16 via 10.1.0.9": "10.1.0.0/16 via 10.1.0.9",
+		"10.2.3.4/16=10.2.0.9":     "10.2.0.0/16 via 10.2.0.9",
+		"fd00::/8 via fd00::9":     "fd00::/8 via fd00::9",
+	} {
+		rule, err := ParseSourceRule(text)
+		if err != nil || rule.String() != want {
+			t.Errorf("ParseSourceRule(%q) = %v, %v; want %s", text, rule, err, want)
+		}
+	}
+	for _, text := range []string{"10.1.0.0/16", "10.1.0.0/16 via", "10.1.0.0 via 10.1.0.9", "10.1.0.0/16 via fd00::9", "10.1.0.0/16 through 10.1.0.9"} {
+		if _, err := ParseSourceRule(text); err == nil {
+			t.Errorf("ParseSourceRule(%q) accepted an invalid rule", text)
+		}
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--source-rule", "10.1.0.0/16 via nowhere"}); err == nil {
+		t.Fatalf("ParseArgs accepted an invalid --source-rule")
+	}
+}
+
+func TestSourceFor(t *testing.T) {
+	var rules []SourceRule
+	for _, text := range []string{"10.0.0.0/8 via 10.0.0.9", "10.2.0.0/16 via 10.2.0.9"} {
+		rule, _ := ParseSourceRule(text)
+		rules = append(rules, rule)
+	}
+	for ip, want := range map[string]string{
+		"10.1.2.3":        "10.0.0.9",
+		"10.2.2.3":        "10.2.0.9",
+		"::ffff:10.2.2.3": "10.2.0.9",
+		"192.168.1.1":     "",
+		"fd00::1":         "",
+	} {
+		got := ""
+		if source, ok := sourceFor(rules, netip.MustParseAddr(ip)); ok {
+			got = source.String()
+		}
+		if got != want {
+			t.Errorf("sourceFor(%s) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestDialTargetSourceRule(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 needs Linux loopback")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c.RemoteAddr()
+			c.Close()
+		}
+	}()
+
+	rule, _ := ParseSourceRule("127.0.0.0/8 via 127.0.0.2")
+	s := NewSupervisor(Options{Mode: ModeSocks, SourceRules: []SourceRule{rule}})
+	conn, err := s.dialTarget(context.Background(), &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}, nil)
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	defer conn.Close()
+	if from := (<-accepted).(*net.TCPAddr); !from.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("target saw a connection from %s, want 127.0.0.2", from)
+	}
+}
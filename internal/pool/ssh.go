@@ -0,0 +1,299 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshHandshakeTimeout bounds the SSH key exchange and authentication with
+// the jump host.
+const sshHandshakeTimeout = 10 * time.Second
+
+// parseSSHTarget splits a --via-ssh value of the form user@host[:port].
+func parseSSHTarget(target string) (user, addr string, err error) {
+	user, host, ok := strings.Cut(target, "@")
+	if !ok || user == "" || host == "" {
+		return "", "", fmt.Errorf("--via-ssh must be user@host[:port]")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return user, host, nil
+}
+
+// sshJump owns the SSH connection to the --via-ssh jump host. All workers
+// share it and open one direct-tcpip channel each to reach the hub.
+type sshJump struct {
+	addr      string
+	config    *ssh.ClientConfig
+	logger    *log.Logger
+	control   func(context.Context, string, string, syscall.RawConn) error
+	keepAlive func(*net.Dialer) // applies --tcp-keepalive
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+// sshJump builds the jump host client from --via-ssh, --ssh-key and
+// --ssh-known-hosts. Host keys are always verified.
+func (o *Options) sshJump() (*sshJump, error) {
+	user, addr, err := parseSSHTarget(o.ViaSSH)
+	if err != nil {
+		return nil, err
+	}
+	knownHostsFile := o.SSHKnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("locate known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("--ssh-known-hosts: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if o.SSHKeyFile != "" {
+		key, err := LoadSecret(o.SSHKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read --ssh-key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key.Bytes())
+		key.Wipe()
+		if err != nil {
+			return nil, fmt.Errorf("--ssh-key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("--via-ssh needs --ssh-key or a running ssh-agent")
+	}
+
+	return &sshJump{
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         sshHandshakeTimeout,
+		},
+	}, nil
+}
+
+// dial opens a channel through the jump host to addr, connecting to the
+// jump host first if needed.
+func (j *sshJump) dial(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := j.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ssh forward to %s: %w", addr, err)
+	}
+	return newDeadlineConn(conn), nil
+}
+
+func (j *sshJump) connect(ctx context.Context) (*ssh.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.client != nil {
+		return j.client, nil
+	}
+
+	// ctx carries --hub-dial-timeout.
+	dialer := net.Dialer{ControlContext: j.control}
+	if j.keepAlive != nil {
+		j.keepAlive(&dialer)
+	}
+	raw, err := dialer.DialContext(ctx, "tcp", j.addr)
+	if err != nil {
+		return nil, fmt.Errorf("ssh jump host: %w", err)
+	}
+	_ = raw.SetDeadline(time.Now().Add(sshHandshakeTimeout))
+	conn, chans, reqs, err := ssh.NewClientConn(raw, j.addr, j.config)
+	if err != nil {
+		_ = raw.Close()
+		return nil, classifySSHError(err)
+	}
+	_ = raw.SetDeadline(time.Time{})
+	client := ssh.NewClient(conn, chans, reqs)
+	j.client = client
+	if j.logger != nil {
+		j.logger.Printf("Connected to SSH jump host %s as %s", j.addr, j.config.User)
+	}
+
+	go func() {
+		_ = client.Wait()
+		j.mu.Lock()
+		if j.client == client {
+			j.client = nil
+		}
+		j.mu.Unlock()
+	}()
+	return client, nil
+}
+
+func (j *sshJump) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.client == nil {
+		return nil
+	}
+	err := j.client.Close()
+	j.client = nil
+	return err
+}
+
+// classifySSHError maps host key and authentication failures onto the
+// credential errors that make workers back off.
+func classifySSHError(err error) error {
+	var keyErr *knownhosts.KeyError
+	switch {
+	case errors.As(err, &keyErr):
+		return &certificateError{err: fmt.Errorf("ssh host key: %w", err)}
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return &authError{reason: "ssh: " + err.Error()}
+	}
+	return fmt.Errorf("ssh jump host: %w", err)
+}
+
+// deadlineConn adds read deadlines to connections that lack them, such as
+// SSH channels, by reading in a background goroutine. watchCancel relies on
+// read deadlines to stop watching the hub.
+type deadlineConn struct {
+	net.Conn
+	reads     chan readResult
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	pending  []byte
+	err      error
+	deadline time.Time
+	changed  chan struct{}
+}
+
+type readResult struct {
+	b   []byte
+	err error
+}
+
+func newDeadlineConn(conn net.Conn) *deadlineConn {
+	c := &deadlineConn{
+		Conn:    conn,
+		reads:   make(chan readResult),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go c.pump()
+	return c
+}
+
+func (c *deadlineConn) pump() {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.Conn.Read(buf)
+		select {
+		case c.reads <- readResult{b: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case r := <-c.reads:
+			c.mu.Lock()
+			c.pending, c.err = r.b, r.err
+			c.mu.Unlock()
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	_ = c.Conn.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *deadlineConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+func (c *deadlineConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
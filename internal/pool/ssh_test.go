@@ -0,0 +1,186 @@
+package pool
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSSHJump runs a minimal SSH server that only forwards direct-tcpip
+// channels for clientKey, and returns its address and host key.
+func startSSHJump(t *testing.T, clientKey ssh.PublicKey) (string, ssh.PublicKey) {
+	t.Helper()
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			raw, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(raw, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for nc := range chans {
+					var dest struct {
+						Host     string
+						Port     uint32
+						OrigHost string
+						OrigPort uint32
+					}
+					if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &dest) != nil {
+						nc.Reject(ssh.UnknownChannelType, "unsupported")
+						continue
+					}
+					target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, strconv.Itoa(int(dest.Port))))
+					if err != nil {
+						nc.Reject(ssh.ConnectionFailed, err.Error())
+						continue
+					}
+					ch, creqs, _ := nc.Accept()
+					go ssh.DiscardRequests(creqs)
+					go func() { io.Copy(ch, target); ch.CloseWrite() }()
+					go func() { io.Copy(target, ch); target.Close() }()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), hostSigner.PublicKey()
+}
+
+func sshTestOptions(t *testing.T, jumpAddr string, hostKey ssh.PublicKey, clientPriv ed25519.PrivateKey) Options {
+	t.Helper()
+	t.Setenv("SSH_AUTH_SOCK", "")
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(jumpAddr)}, hostKey) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+	return Options{ViaSSH: "tester@" + jumpAddr, SSHKeyFile: keyFile, SSHKnownHosts: knownHosts}
+}
+
+func TestSSHJumpDial(t *testing.T) {
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(clientPub)
+	jumpAddr, hostKey := startSSHJump(t, sshPub)
+
+	hub, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer hub.Close()
+	go func() {
+		c, err := hub.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 4)
+		io.ReadFull(c, buf)
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+
+	opts := sshTestOptions(t, jumpAddr, hostKey, clientPriv)
+	jump, err := opts.sshJump()
+	if err != nil {
+		t.Fatalf("sshJump: %v", err)
+	}
+	defer jump.Close()
+
+	conn, err := jump.dial(context.Background(), hub.Addr().String())
+	if err != nil {
+		t.Fatalf("dial through jump host: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected read deadline on SSH channel, got %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.Write([]byte("ping"))
+	data, err := io.ReadAll(conn)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+}
+
+func TestSSHJumpRejectsUnknownHostKey(t *testing.T) {
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	sshPub, _ := ssh.NewPublicKey(clientPub)
+	jumpAddr, _ := startSSHJump(t, sshPub)
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewPublicKey(otherPub)
+	opts := sshTestOptions(t, jumpAddr, otherKey, clientPriv)
+	jump, err := opts.sshJump()
+	if err != nil {
+		t.Fatalf("sshJump: %v", err)
+	}
+	defer jump.Close()
+
+	_, err = jump.dial(context.Background(), "127.0.0.1:1")
+	var certErr *certificateError
+	if !errors.As(err, &certErr) {
+		t.Fatalf("expected host key error, got %v", err)
+	}
+}
+
+func TestParseSSHTarget(t *testing.T) {
+	for in, want := range map[string]string{
+		"ops@jump.example.net":      "jump.example.net:22",
+		"ops@jump.example.net:2222": "jump.example.net:2222",
+		"ops@[2001:db8::1]":         "[2001:db8::1]:22",
+		"ops@[2001:db8::1]:2222":    "[2001:db8::1]:2222",
+	} {
+		user, addr, err := parseSSHTarget(in)
+		if err != nil || user != "ops" || addr != want {
+			t.Fatalf("parseSSHTarget(%q) = %q, %q, %v", in, user, addr, err)
+		}
+	}
+	if _, _, err := parseSSHTarget("jump.example.net"); err == nil {
+		t.Fatalf("expected missing user to be rejected")
+	}
+}
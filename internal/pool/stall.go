@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"contun/internal/logx"
+)
+
+// flow tracks one direction of a bridge for --stall-timeout. A direction
+// waiting to read is idle, which is normal; one waiting to write is stalled,
+// because the far side is not taking the data it was sent.
+type flow struct {
+	name     string
+	writing  atomic.Bool
+	progress atomic.Int64 // UnixNano of the last completed read or write
+
+	stalledAt time.Time // when the stall was reported; owned by the monitor
+}
+
+func newFlow(name string, now time.Time) *flow {
+	f := &flow{name: name}
+	f.progress.Store(now.UnixNano())
+	return f
+}
+
+func (f *flow) touch() { f.progress.Store(time.Now().UnixNano()) }
+
+func (f *flow) since(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, f.progress.Load()))
+}
+
+// copyFlow is io.CopyBuffer with progress tracking. It gives up the
+// ReaderFrom and WriterTo shortcuts, such as splice, so it is only used
+// with --stall-timeout.
+func copyFlow(dst io.Writer, src io.Reader, buf []byte, f *flow) (written int64, err error) {
+	for {
+		var n int
+		n, err = src.Read(buf)
+		if n > 0 {
+			f.touch()
+			f.writing.Store(true)
+			w, werr := dst.Write(buf[:n])
+			f.writing.Store(false)
+			f.touch()
+			written += int64(w)
+			if werr == nil && w != n {
+				werr = io.ErrShortWrite
+			}
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// checkStall reports f when it has been stuck writing for timeout while
+// other moved data within that time, the signature of a path that fails in
+// one direction only, and reports when it recovers.
+func (s *Supervisor) checkStall(f, other *flow, timeout time.Duration, now time.Time, logger *log.Logger) {
+	idle := f.since(now)
+	switch {
+	case f.stalledAt.IsZero() && f.writing.Load() && idle >= timeout && other.since(now) < timeout:
+		f.stalledAt = now
+		s.stalls.Add(1)
+		logx.At(logger, "bridge", logx.Warn).Printf("bridge stalled: %s has been blocked writing for %s while %s is flowing",
+			f.name, idle.Round(time.Second), other.name)
+	case !f.stalledAt.IsZero() && idle < now.Sub(f.stalledAt):
+		logx.At(logger, "bridge", logx.Info).Printf("bridge resumed: %s is moving again after %s", f.name, now.Sub(f.stalledAt).Round(time.Second))
+		f.stalledAt = time.Time{}
+	}
+}
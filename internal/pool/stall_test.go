@@ -0,0 +1,75 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBridgeStall(t *testing.T) {
+	hub, client := tcpPair(t)
+	// A pipe write blocks until the other end reads, like a target whose
+	// receive window stays shut.
+	target, remote := net.Pipe()
+	defer remote.Close()
+	s := NewSupervisor(Options{StallTimeout: 100 * time.Millisecond})
+	var logs bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.bridge(ctx, hub, target, hub, target, log.New(&logs, "", 0))
+		close(done)
+	}()
+	go io.Copy(io.Discard, client)
+
+	client.Write([]byte("request"))
+	for deadline := time.Now().Add(5 * time.Second); s.stalls.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("stall not detected")
+		}
+		// Keep the target-to-hub direction flowing.
+		remote.Write([]byte("x"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	buf := make([]byte, 16)
+	remote.Read(buf)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	out := logs.String()
+	if !strings.Contains(out, "bridge stalled: hub->target") || !strings.Contains(out, "bridge resumed: hub->target") {
+		t.Fatalf("logs:\n%s", out)
+	}
+	if strings.Contains(out, "target->hub has been") || s.stalls.Load() != 1 {
+		t.Fatalf("%d stalls reported:\n%s", s.stalls.Load(), out)
+	}
+	if line := s.statsLine(); !strings.Contains(line, " stalls=1 ") {
+		t.Fatalf("stats line %q", line)
+	}
+}
+
+func TestBridgeIdleIsNotStall(t *testing.T) {
+	hub, client := tcpPair(t)
+	target, remote := tcpPair(t)
+	s := NewSupervisor(Options{StallTimeout: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	go io.Copy(io.Discard, client)
+	go func() {
+		// A download: only the target sends.
+		for ctx.Err() == nil {
+			remote.Write([]byte("data"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	s.bridge(ctx, hub, target, hub, target, log.New(io.Discard, "", 0))
+	if n := s.stalls.Load(); n != 0 {
+		t.Fatalf("%d stalls reported for a one-way transfer", n)
+	}
+}
@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// configFingerprint holds what ConfigHash covers: the settings that decide
+// how a pool treats the hub and its requests. Host-local paths and names
+// are left out because they legitimately differ between bastions, so
+// files only count by what was loaded from them and secrets, plugins and
+// local services by whether they are set. Labels name the bastion and are
+// left out too. Options added later stay out until they are listed here.
+type configFingerprint struct {
+	Hub               string
+	Mode              Mode
+	Targets           []*Destination
+	TargetPatterns    []ACLRule
+	Workers           [3]int // fixed, minimum and maximum
+	ScaleDownAfter    time.Duration
+	RetryDelay        time.Duration
+	Progress          bool
+	Protocol          int
+	Compress          string
+	FlowControl       bool
+	FlowWindow        int
+	MaxFrameSize      int
+	Buffers           [4]int // SO_RCVBUF, SO_SNDBUF, read-ahead and target MSS
+	RateLimit         int64
+	PoolRateLimit     int64
+	MaxSessions       int
+	QueueTimeout      time.Duration
+	MaxLoad           float64
+	MaxCPU            float64
+	SourceRules       []SourceRule
+	NetnsRules        []NetnsRule
+	Containers        bool
+	Kubernetes        bool
+	DNSServer         string
+	UpstreamProxy     string
+	SendProxyProtocol ProxyProtocol
+	ScanConcurrency   int
+	PendingRequests   int
+	Timeouts          []time.Duration
+	TLS               bool
+	TLSServerName     string
+	TLSInsecure       bool
+	ClientCertificate bool
+	Noise             bool
+	ViaSSH            string
+	HubProxy          string
+	HubURL            string
+	Transport         string
+	ExpireAt          time.Time
+	MaxRuntime        time.Duration
+	Shutdown          bool
+	ShutdownWipe      bool
+	Auth              bool
+	AuthMode          AuthMode
+	Redact            []string
+	RedactMode        RedactMode
+	Audit             bool
+	AuditSample       float64
+	TamperNotice      bool
+	InboundLimit      int64
+	InboundAction     InboundAction
+	AlertPatterns     []*AlertPattern
+	AlertWebhook      bool
+	Hook              string // the script's SHA-256
+	Plugins           int
+	Aliases           []DestAlias
+	Exposes           []Expose
+	Allow             []ACLRule // with the rules loaded from --acl-file
+	Deny              []ACLRule
+	DenyPrivate       bool
+	TraceSample       float64
+}
+
+// ConfigHash fingerprints the effective configuration so a hub can spot
+// bastions running stale or mismatched settings; see configFingerprint.
+func (o Options) ConfigHash() string {
+	c := configFingerprint{
+		Hub:               net.JoinHostPort(o.HubHost, strconv.Itoa(o.HubPort)),
+		Mode:              o.Mode,
+		Targets:           o.Targets,
+		TargetPatterns:    o.TargetPatterns,
+		Workers:           [3]int{o.Workers, o.MinWorkers, o.MaxWorkers},
+		ScaleDownAfter:    o.ScaleDownAfter,
+		RetryDelay:        o.RetryDelay,
+		Progress:          o.Progress,
+		Protocol:          o.Protocol,
+		Compress:          o.Compress,
+		FlowControl:       o.FlowControl,
+		FlowWindow:        o.FlowWindow,
+		MaxFrameSize:      o.MaxFrameSize,
+		Buffers:           [4]int{o.SoRcvBuf, o.SoSndBuf, o.ReadAhead, o.TargetMSS},
+		RateLimit:         o.RateLimit,
+		PoolRateLimit:     o.PoolRateLimit,
+		MaxSessions:       o.MaxSessions,
+		QueueTimeout:      o.QueueTimeout,
+		MaxLoad:           o.MaxLoad,
+		MaxCPU:            o.MaxCPU,
+		SourceRules:       o.SourceRules,
+		NetnsRules:        o.NetnsRules,
+		Containers:        o.ContainerAPI != "",
+		Kubernetes:        o.Kubeconfig != "",
+		DNSServer:         o.DNSServer,
+		UpstreamProxy:     redactedProxy(o.UpstreamProxy),
+		SendProxyProtocol: o.SendProxyProtocol,
+		ScanConcurrency:   o.ScanConcurrency,
+		PendingRequests:   o.PendingRequests,
+		Timeouts: []time.Duration{o.HubDialTimeout, o.TargetDialTimeout, o.TargetDNSTTL,
+			o.KeepAlive, o.KeepAliveInterval, o.HeartbeatInterval, o.HeartbeatTimeout,
+			o.DrainTimeout, o.StallTimeout, o.IdleTimeout, o.SimulateLatency},
+		TLS:               o.TLS,
+		TLSServerName:     o.TLSServerName,
+		TLSInsecure:       o.TLSInsecure,
+		ClientCertificate: o.TLSCertFile != "",
+		Noise:             o.NoiseHubKeyFile != "",
+		ViaSSH:            o.ViaSSH,
+		HubProxy:          redactedProxy(o.HubProxy),
+		HubURL:            o.HubURL,
+		Transport:         o.Transport,
+		ExpireAt:          o.ExpireAt,
+		MaxRuntime:        o.MaxRuntime,
+		Shutdown:          o.ShutdownKey != nil,
+		ShutdownWipe:      o.ShutdownWipe,
+		Auth:              o.AuthToken != nil,
+		AuthMode:          o.AuthMode,
+		Redact:            o.Redact,
+		RedactMode:        o.RedactMode,
+		Audit:             o.AuditLog != "",
+		AuditSample:       o.AuditSample,
+		TamperNotice:      o.TamperNotice,
+		InboundLimit:      o.InboundLimit,
+		InboundAction:     o.InboundAction,
+		AlertPatterns:     o.AlertPatterns,
+		AlertWebhook:      o.AlertWebhook != "",
+		Plugins:           len(o.Plugins),
+		Aliases:           o.Aliases,
+		Exposes:           o.Exposes,
+		Allow:             o.Allow,
+		Deny:              o.Deny,
+		DenyPrivate:       o.DenyPrivate,
+		TraceSample:       o.TraceSample,
+	}
+	if o.Hook != nil {
+		c.Hook = o.Hook.Sum
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// statsLine renders the periodic STATS control line.
+func (s *Supervisor) statsLine() string {
+	l := s.link()
+	workers := int64(l.opts.Workers)
+	if l.opts.MaxWorkers > 0 {
+		workers = s.running.Load()
+	}
+	return fmt.Sprintf("STATS config=%s workers=%d active=%d version=%s proto=%d features=%s stalls=%d pending=%d retried=%d",
+		l.hash, workers, s.active.Load(), BuildVersion(), s.protocol.Load(), l.opts.Features(), s.stalls.Load(),
+		s.pending.Load(), s.pendingRejected.Load())
+}
+
+// runStats sends a STATS line on every idle hub session each interval.
+func (s *Supervisor) runStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.broadcastNotice(s.statsLine())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package pool
+
+import "testing"
+
+func TestConfigHashIgnoresLocalPaths(t *testing.T) {
+	base, err := ParseArgs([]string{"--hub-port", "5555", "--mode", "socks", "--workers", "3"})
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	base.Kubeconfig, base.Plugins = "in-cluster", []string{"/opt/pool/authz"}
+	base.AuditLog = "/var/log/poolgo/audit.jsonl"
+	base.AlertWebhook = "https://alerts.example/dc1"
+	moved := *base
+	moved.StateFile = "/var/tmp/state.json"
+	moved.AuditLog = "/var/tmp/audit.jsonl"
+	moved.SessionLog = "/var/tmp/sessions.jsonl"
+	moved.AdminSocket = "/run/poolgo/admin.sock"
+	moved.ACLFile = "/etc/poolgo/acl"
+	moved.Kubeconfig = "/root/.kube/config"
+	moved.Plugins = []string{"/usr/local/bin/authz"}
+	moved.TUN = "tun7"
+	moved.VRF = "vrf-blue"
+	moved.BindInterface = "eth1"
+	moved.AlertWebhook = "https://alerts.example/dc2"
+	moved.Labels = map[string]string{"site": "dc2"}
+	if base.ConfigHash() != moved.ConfigHash() {
+		t.Fatalf("host-local paths changed the config hash")
+	}
+	resized := *base
+	resized.Workers = 4
+	if base.ConfigHash() == resized.ConfigHash() {
+		t.Fatalf("worker count change did not change the config hash")
+	}
+	denied := *base
+	denied.Deny = []ACLRule{{}}
+	if base.ConfigHash() == denied.ConfigHash() {
+		t.Fatalf("a loaded --deny rule did not change the config hash")
+	}
+}
@@ -8,255 +8,1367 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"contun/internal/logx"
+	"contun/internal/secure"
+	"contun/internal/transport"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrExpired is returned by Run when the pool stops because its --expire-at or
+// --max-runtime window has elapsed.
+var ErrExpired = errors.New("pool expired")
+
+// errLegacyHub is returned when the hub hung up on HELLO 2 under
+// --protocol auto; the worker reconnects at once with version 1.
+var errLegacyHub = errors.New("hub does not speak protocol 2")
+
+// errCapsRefused is returned when the hub hung up on a HELLO 1 that
+// carried CAPS, as hub.pl did before capabilities; the worker reconnects
+// at once with a bare HELLO.
+var errCapsRefused = errors.New("hub does not understand capabilities")
+
 // Supervisor manages pool workers.
 type Supervisor struct {
-	opts    Options
-	logger  *log.Logger
-	dialer  net.Dialer
-	retries time.Duration
+	opts       Options // as started; Reload never changes it
+	logger     *log.Logger
+	dialer     net.Dialer
+	containers *containerClient // set with --container-api
+	k8s        *k8sClient       // set by Run with --kubeconfig
+
+	// current is the configuration workers dial the hub with; see Reload.
+	current  atomic.Pointer[link]
+	reloadMu sync.Mutex
+	reloaded chan struct{} // signals Run that current changed
+
+	// stopAccepting ends the accept phase: idle workers disconnect and busy
+	// workers exit once their current bridge finishes.
+	stopAccepting  context.CancelFunc
+	remoteShutdown atomic.Bool
+	shutdownSeen   shutdownNonces
+	draining       chan struct{} // closed by Drain
+	drainOnce      sync.Once
+
+	audit       *auditLog
+	tracer      trace.Tracer
+	sessionLog  *sessionLog
+	plugins     []*plugin
+	webhook     *webhook
+	bufferCheck sync.Once
+	active      counter      // bridges open
+	stalls      atomic.Int64 // bridge directions reported by --stall-timeout
+
+	running atomic.Int64  // workers runWorkers keeps, which autoscaling varies
+	demand  chan struct{} // a worker took a request; see noteDemand
+
+	// streamRate and poolRate hold --rate-limit and --pool-rate-limit,
+	// which the admin socket may change; see rateLimited.
+	streamRate, poolRate    atomic.Int64
+	poolToTarget, poolToHub *tokenBucket
+
+	load loadMonitor // --max-load and --max-cpu
+
+	targetDNS targetDNS // --target-dns-ttl
+
+	slotsMu   sync.Mutex
+	slotsUsed int           // streams holding a --max-sessions slot
+	slotFreed chan struct{} // closed and replaced when a slot is released
+
+	pending         counter      // REQUESTs queued across workers; see pendingQueue
+	pendingRejected atomic.Int64 // REQUESTs answered RETRY because a queue was full
+
+	// protocol is the control protocol version offered in HELLO. With
+	// --protocol auto it drops to 1 when the hub turns out not to speak 2.
+	protocol atomic.Int32
+	// bareHello leaves CAPS out of HELLO 1 once a hub hung up on them,
+	// until a bare HELLO is refused as well.
+	bareHello atomic.Bool
+
+	tunBusy atomic.Bool // a hub session owns the --tun device
+
+	capsMu   sync.Mutex
+	declined string // capabilities last reported as declined by a hub
+
+	sessionsMu sync.Mutex
+	sessions   map[*controlWriter]struct{}
+
+	workersMu sync.Mutex
+	workers   map[int]*worker // running workers by ID, for the admin socket
+
+	interceptors []Interceptor // registered ones, then AddInterceptor's
 }
 
 // NewSupervisor constructs a Supervisor for the provided options.
 func NewSupervisor(opts Options) *Supervisor {
-	return &Supervisor{
-		opts:    opts,
-		logger:  log.Default(),
-		dialer:  net.Dialer{Timeout: 5 * time.Second},
-		retries: opts.RetryDelay,
+	s := &Supervisor{
+		opts:     opts,
+		logger:   log.Default(),
+		dialer:   net.Dialer{Timeout: defaultDialTimeout},
+		sessions: make(map[*controlWriter]struct{}),
+		workers:  make(map[int]*worker),
+		draining: make(chan struct{}),
+		reloaded: make(chan struct{}, 1),
+		demand:   make(chan struct{}, 1),
+		tracer:   noopTracer,
+	}
+	s.slotFreed = make(chan struct{})
+	s.load.read = readLoad
+	registeredMu.Lock()
+	s.interceptors = slices.Clone(registeredInterceptors)
+	registeredMu.Unlock()
+	s.current.Store(newLink(&opts))
+	s.setRates(opts.RateLimit, opts.PoolRateLimit)
+	s.poolToTarget, s.poolToHub = newTokenBucket(&s.poolRate), newTokenBucket(&s.poolRate)
+	s.dialer.ControlContext = s.bufferControl()
+	opts.setKeepAlive(&s.dialer)
+	if opts.ContainerAPI != "" {
+		s.containers = newContainerClient(opts.ContainerAPI)
+	}
+	s.protocol.Store(ProtocolVersion)
+	if opts.Protocol != 0 {
+		s.protocol.Store(int32(opts.Protocol))
 	}
+	return s
 }
 
 // Run launches workers and blocks until context cancellation.
 func (s *Supervisor) Run(ctx context.Context) error {
-	s.logger.Printf("Starting pool with %d worker(s) in %s mode targeting hub %s:%d",
-		s.opts.Workers, s.opts.Mode, s.opts.HubHost, s.opts.HubPort)
-	if s.opts.Mode == ModeDirect && s.opts.DirectDestination != nil {
-		s.logger.Printf("Direct mode destination %s:%d",
-			s.opts.DirectDestination.Host, s.opts.DirectDestination.Port)
+	if s.opts.MaxWorkers > 0 {
+		s.logger.Printf("Starting pool with %d to %d worker(s) in %s mode targeting hub %s",
+			s.opts.MinWorkers, s.opts.MaxWorkers, s.opts.Mode, net.JoinHostPort(s.opts.HubHost, strconv.Itoa(s.opts.HubPort)))
+	} else {
+		s.logger.Printf("Starting pool with %d worker(s) in %s mode targeting hub %s",
+			s.opts.Workers, s.opts.Mode, net.JoinHostPort(s.opts.HubHost, strconv.Itoa(s.opts.HubPort)))
+	}
+	for _, dest := range s.opts.Targets {
+		host, _ := s.opts.redactedHost(dest.Host)
+		s.logger.Printf("Direct mode destination %s", net.JoinHostPort(host, strconv.Itoa(dest.Port)))
+	}
+	for _, r := range s.opts.TargetPatterns {
+		s.logger.Printf("Direct mode destination pattern %s", r)
+	}
+	s.logger.Printf("poolgo %s, effective configuration hash %s, features %s",
+		BuildVersion(), s.link().hash, s.opts.Features())
+
+	for _, warning := range s.opts.UnusedFlags() {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: %s", warning)
+	}
+	for _, source := range unassignedSources(s.opts.SourceRules) {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: --source-rule address %s is not assigned to any interface; dials through it will fail", source)
+	}
+	for _, path := range missingNetns(s.opts.NetnsRules) {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: --netns-rule namespace %s does not exist; dials through it will fail", path)
+	}
+	if s.opts.Kubeconfig != "" {
+		client, err := newK8sClient(s.opts.Kubeconfig)
+		if err != nil {
+			return fmt.Errorf("--kubeconfig: %w", err)
+		}
+		s.k8s = client
+	}
+	if flag, device := s.opts.targetDevice(); device != "" {
+		if _, err := net.InterfaceByName(device); err != nil {
+			logx.At(s.logger, "pool", logx.Warn).Printf("warning: %s %s: %v; target connections will fail until it exists", flag, device, err)
+		}
+	}
+	if addr := s.opts.BindAddress; addr.IsValid() && len(unassignedSources([]SourceRule{{Source: addr}})) > 0 {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: --bind-address %s is not assigned to any interface; target connections will fail", addr)
+	}
+	if s.opts.SimulateLatency > 0 {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: --simulate-latency delays every target dial and read by %s; do not use it in production", s.opts.SimulateLatency)
+	}
+
+	defer s.wipeSecrets()
+	if err := s.protectSecrets(); err != nil {
+		logx.At(s.logger, "pool", logx.Warn).Printf("warning: %v", err)
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	if err := s.startPlugins(); err != nil {
+		return err
+	}
+	defer s.closePlugins()
+	if s.opts.OTLPEndpoint != "" {
+		stop, err := s.startTracing(ctx)
+		if err != nil {
+			return fmt.Errorf("start tracing: %w", err)
+		}
+		defer stop()
+	}
+
+	first := newLink(&s.opts)
+	if err := s.connectLink(first, nil); err != nil {
+		return err
+	}
+	s.current.Store(first)
+	defer func() { s.link().close() }()
+	s.logStartup(ctx)
+
+	if sinks := s.pluginsFor(pluginAudit); s.opts.AuditLog != "" || len(sinks) > 0 {
+		audit, err := openAuditLog(s.opts.AuditLog, s.opts.AuditFormat, s.opts.AuditSample, sinks)
+		if err != nil {
+			return fmt.Errorf("open audit log: %w", err)
+		}
+		audit.alias = func(host string, port int) string { return s.link().opts.aliasFor(host, port) }
+		s.audit = audit
+		defer audit.Close()
+	}
+	if s.opts.SessionLog != "" {
+		sessions, err := openSessionLog(s.opts.SessionLog, s.opts.SessionLogFormat)
+		if err != nil {
+			return fmt.Errorf("open session log: %w", err)
+		}
+		s.sessionLog = sessions
+		defer sessions.Close()
+	}
+
+	start := time.Now()
+	deadline, hasDeadline := s.opts.Deadline(start)
+	if hasDeadline && !deadline.After(start) {
+		s.logger.Printf("Engagement window ended at %s; refusing to start", deadline.Format(time.RFC3339))
+		s.audit.Record("expired", map[string]any{"deadline": deadline, "phase": "startup"})
+		s.wipeState()
+		return ErrExpired
+	}
+
+	if s.opts.StateFile != "" {
+		state := poolState{
+			PID:       os.Getpid(),
+			StartedAt: start,
+			Mode:      s.opts.Mode,
+			Hub:       net.JoinHostPort(s.opts.HubHost, fmt.Sprint(s.opts.HubPort)),
+			Workers:   s.opts.Workers,
+		}
+		if hasDeadline {
+			state.ExpiresAt = &deadline
+		}
+		if err := writeStateFile(s.opts.StateFile, state); err != nil {
+			return fmt.Errorf("write state file: %w", err)
+		}
+		defer s.wipeState()
+	}
+
+	var cancel context.CancelFunc
+	if hasDeadline {
+		s.logger.Printf("Pool will shut down at %s", deadline.Format(time.RFC3339))
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
 	defer cancel()
 
-	var wg sync.WaitGroup
-	for i := 0; i < s.opts.Workers; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			s.runWorker(ctx, id)
-		}(i + 1)
+	accept, stopAccepting := context.WithCancel(ctx)
+	defer stopAccepting()
+	s.stopAccepting = stopAccepting
+	go func() {
+		select {
+		case <-s.draining:
+			stopAccepting()
+		case <-ctx.Done():
+		}
+	}()
+
+	if s.opts.AdminSocket != "" {
+		ln, err := ListenAdmin(s.opts.AdminSocket)
+		if err != nil {
+			return fmt.Errorf("admin socket: %w", err)
+		}
+		s.logger.Printf("Admin socket listening on %s", s.opts.AdminSocket)
+		go s.serveAdmin(ctx, ln)
+	}
+	if s.opts.TamperNotice {
+		monitor, err := newTamperMonitor(s.opts.TamperInterval, s.reportTamper)
+		if err != nil {
+			return fmt.Errorf("tamper monitor: %w", err)
+		}
+		go monitor.run(ctx)
+	}
+	if s.opts.StatsInterval > 0 {
+		go s.runStats(ctx, s.opts.StatsInterval)
+	}
+	if loadSupported {
+		go s.runLoadMonitor(ctx)
+	}
+	if s.opts.AlertWebhook != "" {
+		s.webhook = newWebhook(s.opts.AlertWebhook, s.logger)
+		go s.webhook.run(ctx)
 	}
 
-	wg.Wait()
+	s.runWorkers(ctx, accept)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.logger.Printf("Engagement window ended at %s; shutting down", deadline.Format(time.RFC3339))
+		s.audit.Record("expired", map[string]any{"deadline": deadline, "phase": "running"})
+		return ErrExpired
+	}
+	if s.remoteShutdown.Load() {
+		s.logger.Printf("Workers drained after hub SHUTDOWN; exiting")
+		if s.opts.ShutdownWipe {
+			s.wipeCredentials()
+		}
+		return ErrRemoteShutdown
+	}
 	return ctx.Err()
 }
 
-func (s *Supervisor) runWorker(ctx context.Context, id int) {
-	logger := log.New(log.Writer(), fmt.Sprintf("[pool worker %d] ", id), log.Flags())
+// Drain stops the pool taking new requests. Every hub connection is sent
+// GOODBYE so the hub stops handing it work; idle workers then disconnect and
+// busy ones finish their current request first. Run returns once the last
+// one is done; callers bound the wait by cancelling Run's context.
+func (s *Supervisor) Drain() {
+	s.drainOnce.Do(func() {
+		told := s.broadcastNotice("GOODBYE")
+		active := s.active.Load()
+		s.logger.Printf("Draining: sent GOODBYE on %d hub connection(s), waiting for %d active session(s)", told, active)
+		s.audit.Record("drain", map[string]any{"active": active})
+		close(s.draining)
+	})
+}
+
+// reportTamper logs and audits a tamper notice and forwards it to the hub on
+// every idle control connection.
+func (s *Supervisor) reportTamper(n tamperNotice) {
+	s.logger.Printf("tamper notice (%s): %s", n.Kind, n.Detail)
+	sent := s.broadcastNotice(fmt.Sprintf("NOTICE tamper %s %s", n.Kind, n.Detail))
+	s.audit.Record("tamper", map[string]any{"kind": n.Kind, "detail": n.Detail, "hub_sessions_notified": sent})
+}
+
+// broadcastNotice sends an informational line on every idle hub session and
+// returns how many sessions received it.
+func (s *Supervisor) broadcastNotice(line string) int {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	sent := 0
+	for cw := range s.sessions {
+		if cw.sendNotice(line) {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (s *Supervisor) trackSession(cw *controlWriter) {
+	s.sessionsMu.Lock()
+	s.sessions[cw] = struct{}{}
+	s.sessionsMu.Unlock()
+}
 
+func (s *Supervisor) untrackSession(cw *controlWriter) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, cw)
+	s.sessionsMu.Unlock()
+}
+
+// secrets lists the key material held by the supervisor.
+func (s *Supervisor) secrets() []*Secret {
+	var out []*Secret
+	for _, secret := range []*Secret{s.opts.ShutdownKey, s.opts.AuthToken, s.link().opts.AuthToken} {
+		if secret != nil && !slices.Contains(out, secret) {
+			out = append(out, secret)
+		}
+	}
+	return out
+}
+
+// protectSecrets disables core dumps and reports key material that could not
+// be locked into RAM.
+func (s *Supervisor) protectSecrets() error {
+	held := s.secrets()
+	if len(held) == 0 {
+		return nil
+	}
+	if err := disableCoreDumps(); err != nil {
+		return fmt.Errorf("could not disable core dumps: %v", err)
+	}
+	for _, secret := range held {
+		if !secret.Locked() {
+			return fmt.Errorf("key material could not be locked in memory and may be swapped to disk")
+		}
+	}
+	return nil
+}
+
+func (s *Supervisor) wipeSecrets() {
+	for _, secret := range s.secrets() {
+		secret.Wipe()
+	}
+}
+
+// wipeCredentials removes credential files named on the command line.
+func (s *Supervisor) wipeCredentials() {
+	for _, path := range []string{s.opts.ShutdownKeyFile, s.opts.AuthTokenFile, s.opts.TLSKeyFile, s.opts.NoiseKeyFile, s.opts.SSHKeyFile} {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Printf("failed to remove %s: %v", path, err)
+			continue
+		}
+		s.logger.Printf("Removed credential file %s", path)
+	}
+}
+
+func (s *Supervisor) wipeState() {
+	if s.opts.StateFile == "" {
+		return
+	}
+	if err := removeStateFile(s.opts.StateFile); err != nil {
+		s.logger.Printf("failed to remove state file: %v", err)
+	}
+}
+
+// runWorker keeps one connection to the hub open with w's link until accept
+// ends.
+func (s *Supervisor) runWorker(ctx, accept context.Context, w *worker) {
+	logger := logx.New(s.logger, fmt.Sprintf("[pool worker %d] ", w.id), "worker", w.id)
+	s.registerWorker(w)
+	defer s.unregisterWorker(w)
+
+	// failures collapses the same connection error repeated retry after
+	// retry during a hub outage.
+	failures := &logx.Repeats{Every: s.opts.LogRepeats}
+	defer failures.Flush()
+	certFailures := 0
 	for {
-		if ctx.Err() != nil {
+		if accept.Err() != nil {
 			return
 		}
 
-		conn, err := s.dialHub(ctx)
+		w.setState(workerConnecting, nil)
+		conn, err := s.dialHub(accept, w.link)
 		if err != nil {
-			logger.Printf("failed to connect to hub: %v", err)
-			if !sleepWithContext(ctx, s.retries) {
+			err = normalizeError(err)
+			w.setState(workerBackoff, err)
+			delay := s.retryDelay(err, &certFailures)
+			failures.Log(logx.At(logger, "pool", logx.Warn), fmt.Sprintf("failed to connect to hub: %v (retrying in %s)", err, delay),
+				"error", err, "retry_ms", delay)
+			if !sleepWithContext(accept, delay) {
 				return
 			}
 			continue
 		}
 
+		failures.Flush()
 		logger.Printf("connected to hub")
+		w.connected()
 		sessionCtx, cancel := context.WithCancel(ctx)
-		err = s.handleHubSession(sessionCtx, conn, logger)
+		w.serving(cancel)
+		err = s.handleHubSession(sessionCtx, accept, w.link, w, conn, logger)
 		cancel()
-		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
-			logger.Printf("session error: %v", err)
+		delay := s.retryDelay(err, &certFailures)
+		if errors.Is(err, errLegacyHub) || errors.Is(err, errCapsRefused) {
+			delay = 0
+		}
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) && accept.Err() == nil {
+			err = normalizeError(err)
+			logx.Log(logx.At(logger, "pool", logx.Warn), fmt.Sprintf("session error: %v", err), "error", err)
+			w.setState(workerBackoff, err)
 		} else {
 			logger.Printf("session ended")
+			w.setState(workerBackoff, nil)
 		}
 		_ = conn.Close()
 
-		if !sleepWithContext(ctx, s.retries) {
+		if !sleepWithContext(accept, delay) {
 			return
 		}
 	}
 }
 
-func (s *Supervisor) dialHub(ctx context.Context) (net.Conn, error) {
-	address := net.JoinHostPort(s.opts.HubHost, fmt.Sprint(s.opts.HubPort))
-	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+// defaultDialTimeout bounds hub and target dials when
+// --hub-dial-timeout or --target-dial-timeout is unset.
+const defaultDialTimeout = 5 * time.Second
+
+// dialTimeout returns d, or defaultDialTimeout for Options built without
+// ParseArgs.
+func dialTimeout(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultDialTimeout
+	}
+	return d
+}
+
+// dialHub opens a worker's session with the hub over l's transport.
+func (s *Supervisor) dialHub(ctx context.Context, l *link) (transport.Session, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, dialTimeout(s.link().opts.HubDialTimeout))
 	defer cancel()
-	return s.dialer.DialContext(dialCtx, "tcp", address)
+	session, err := l.transport.Dial(dialCtx)
+	if err != nil {
+		return nil, classifyTLSError(err)
+	}
+	return session, nil
 }
 
-func (s *Supervisor) handleHubSession(ctx context.Context, hub net.Conn, logger *log.Logger) error {
-	abort := make(chan struct{})
-	defer close(abort)
-	go func() {
-		select {
-		case <-ctx.Done():
-			_ = hub.Close()
-		case <-abort:
+// dialHubTCP makes the TCP connection to the hub, through a transport
+// plugin, the SSH jump host or the hub proxy when one is configured.
+func (s *Supervisor) dialHubTCP(ctx context.Context, l *link) (net.Conn, error) {
+	address := net.JoinHostPort(l.opts.HubHost, fmt.Sprint(l.opts.HubPort))
+	dialer := s.dialer
+	dialer.Timeout = dialTimeout(s.link().opts.HubDialTimeout)
+	if plugins := s.pluginsFor(pluginTransport); len(plugins) > 0 {
+		return plugins[0].dial(ctx, dialer, address)
+	}
+	if l.ssh != nil {
+		return l.ssh.dial(ctx, address)
+	}
+	if l.hubProxy != nil {
+		return l.hubProxy.dialHost(ctx, &dialer, l.opts.HubHost, l.opts.HubPort)
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// handleHubSession serves one hub connection for w, which may be nil in
+// tests, and keeps its admin socket status current.
+func (s *Supervisor) handleHubSession(ctx, accept context.Context, l *link, w *worker, hub net.Conn, logger *log.Logger) error {
+	opts := l.opts
+	var target *Destination // the destination w declares in direct mode
+	if w != nil {
+		target = w.target
+	}
+	// busy is set while a request is handled, from its REQUEST line until
+	// the bridge (if any) ends.
+	var busy atomic.Bool
+	raw := hub
+	defer context.AfterFunc(ctx, func() { _ = raw.Close() })()
+	defer context.AfterFunc(accept, func() {
+		// Let a request in flight, including its bridge, run to
+		// completion while draining.
+		if !busy.Load() {
+			_ = raw.Close()
 		}
-	}()
+	})()
 
 	reader := bufio.NewReader(hub)
-	writer := bufio.NewWriter(hub)
+	writer := newControlWriter(hub)
 
-	if err := s.performHandshake(writer, reader); err != nil {
-		return fmt.Errorf("handshake failed: %w", err)
+	session := &hubSession{version: int(s.protocol.Load())}
+	_, handshake := s.tracer.Start(ctx, "hub.handshake", trace.WithAttributes(
+		attribute.String("contun.hub", net.JoinHostPort(opts.HubHost, strconv.Itoa(opts.HubPort))),
+		attribute.Int("contun.protocol", session.version),
+	))
+	caps, err := s.performHandshake(l, target, writer, reader, session.version)
+	if errors.Is(err, errLegacyHub) {
+		if s.protocol.CompareAndSwap(int32(session.version), 1) {
+			logx.At(logger, "proto", logx.Info).Printf("hub closed the connection after HELLO %d; falling back to protocol 1", session.version)
+		}
+		return endSpan(handshake, err)
+	}
+	if errors.Is(err, errCapsRefused) {
+		if s.bareHello.CompareAndSwap(false, true) {
+			logx.At(logger, "proto", logx.Info).Printf("hub closed the connection after HELLO with capabilities; retrying without them")
+		}
+		return endSpan(handshake, err)
+	}
+	if err != nil {
+		var authErr *authError
+		if errors.As(err, &authErr) {
+			s.audit.Record("auth_failed", map[string]any{"reason": authErr.reason})
+		}
+		// With TLS 1.3 the hub rejects a client certificate after the TLS
+		// handshake completes, so the alert surfaces on the first read.
+		return endSpan(handshake, fmt.Errorf("handshake failed: %w", classifyTLSError(err)))
+	}
+	session.caps = caps
+	if l.noise != nil {
+		// Encryption never degrades: a hub that cannot do Noise is refused.
+		if !caps[capNoise] {
+			return endSpan(handshake, fmt.Errorf("hub does not support Noise encryption"))
+		}
+		if reader.Buffered() > 0 {
+			return endSpan(handshake, fmt.Errorf("unexpected data before Noise handshake"))
+		}
+		conn, err := secure.Client(hub, *l.noise)
+		if err != nil {
+			return endSpan(handshake, fmt.Errorf("noise handshake failed: %w", err))
+		}
+		hub = conn
+		reader = bufio.NewReader(hub)
+		writer = newControlWriter(hub)
+	}
+	endSpan(handshake, nil)
+	var control controlSource = lineSource{reader}
+	readControl := func() (string, error) { return readLine(reader) }
+	s.noteDeclined(l, caps, logger)
+	// identity is what this connection's SHUTDOWN messages must name.
+	var identity string
+	if caps[capIdentity] {
+		identity = newShutdownIdentity()
+	}
+	var frames *FrameConn
+	var queue *pendingQueue
+	if session.version >= 2 {
+		frames = NewFrameConn(hub, reader)
+		frames.OnControl = func(line string) {
+			// Framing lets SHUTDOWN reach a worker that is bridging; it
+			// drains once the bridge ends.
+			if strings.HasPrefix(line, "SHUTDOWN") {
+				s.handleShutdown(line, identity, logger)
+				return
+			}
+			// hubgo explains streams it closes, such as for its
+			// --idle-timeout.
+			if text, ok := strings.CutPrefix(line, "NOTICE "); ok {
+				logx.At(logger, "proto", logx.Info).Printf("hub notice: %s", text)
+				return
+			}
+			queue.offer(line, writer)
+		}
+		if opts.MaxFrameSize > 0 {
+			frames.SetMaxFrameSize(opts.MaxFrameSize)
+		}
+		if caps[capWindow] {
+			window := FlowWindow
+			if opts.FlowWindow > 0 {
+				window = opts.FlowWindow
+			}
+			frames.SetWindow(window)
+		}
+		hub, control, readControl = frames, frames, frames.ReadControl
+		writer = newFrameWriter(frames)
+		if caps[capQueue] {
+			queue = s.newPendingQueue(opts.PendingRequests)
+			control = queueingSource{control, queue, writer}
+			defer queue.release(writer)
+		}
+	}
+	logx.At(logger, "proto", logx.Debug).Printf("hub session uses protocol %d with capabilities %s", session.version, caps)
+	if len(s.interceptors) > 0 {
+		info := HandshakeInfo{Hub: net.JoinHostPort(opts.HubHost, strconv.Itoa(opts.HubPort)), Version: session.version, Caps: caps.names()}
+		if w != nil {
+			info.Worker = w.id
+		}
+		if err := s.handshake(ctx, info); err != nil {
+			return fmt.Errorf("hub session refused by interceptor: %w", err)
+		}
+	}
+	writer.trace = func(line string) { s.traceLine(logger, ">", line) }
+	s.trackSession(writer)
+	defer s.untrackSession(writer)
+	if identity != "" {
+		if err := writer.send("IDENTITY " + identity); err != nil {
+			return err
+		}
+	}
+	if caps[capExpose] {
+		for _, e := range opts.Exposes {
+			writer.sendNotice(e.line())
+		}
+	}
+	if caps[capPattern] {
+		for _, r := range opts.TargetPatterns {
+			writer.sendNotice(targetPatternLine(r))
+		}
+	}
+	var hb *heartbeat
+	if caps[capHeartbeat] {
+		hb = startHeartbeat(raw, writer, opts.HeartbeatInterval, opts.HeartbeatTimeout)
+		defer hb.stop()
 	}
 
-	for ctx.Err() == nil {
-		line, err := readLine(reader)
+	// rt traces the request being handled; it ends when the next one is
+	// read or the session ends.
+	var rt *requestTrace
+	defer func() { rt.end() }()
+	for accept.Err() == nil {
+		rt.end()
+		rt = nil
+		busy.Store(false)
+		w.setState(workerIdle, nil)
+		line, cancelled, queued := queue.take()
+		var err error
+		if !queued {
+			hb.waiting(true)
+			line, err = readControl()
+			hb.waiting(false)
+		}
 		if err != nil {
+			if hb.timedOut() {
+				return fmt.Errorf("hub did not answer PING within %s", opts.HeartbeatTimeout)
+			}
 			return err
 		}
-		if line == "" {
+		s.traceLine(logger, "<", line)
+		if line == "" || strings.HasPrefix(line, "PONG") {
+			continue
+		}
+		if strings.HasPrefix(line, "SHUTDOWN") {
+			if s.handleShutdown(line, identity, logger) {
+				return nil
+			}
 			continue
 		}
+		busy.Store(true)
+		received := time.Now()
+		rt = s.traceRequest(ctx)
+		parse := rt.stage("request.parse")
 		req, err := ParseRequest(line)
 		if err != nil {
-			logger.Printf("invalid request %q: %v", line, err)
+			endSpan(parse, err)
+			logx.At(logger, "proto", logx.Warn).Printf("invalid request %q: %v", line, err)
+			continue
+		}
+		rt.describe(req, s.link().opts.aliasFor(req.Address, req.Port))
+		logger := s.redactDest(logger, req)
+		w.begin(req)
+		s.noteDemand()
+		if cancelled {
+			endSpan(parse, nil)
+			logx.At(logger, "bridge", logx.Info).Printf("hub cancelled queued session %s to %s", req.SessionID, req.hostPort())
+			if err := sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0); err != nil {
+				return err
+			}
 			continue
 		}
 		if err := validateRequestAddress(req); err != nil {
-			logger.Printf("invalid destination %q: %v", line, err)
+			endSpan(parse, err)
+			logx.At(logger, "proto", logx.Warn).Printf("invalid destination %q: %v", line, err)
+			s.audit.Record("request_denied", map[string]any{"dest": req.Address, "port": req.Port, "reason": err.Error()})
 			if err := sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0); err != nil {
 				return err
 			}
 			continue
 		}
+		requested := req.Address
+		allowed, err := s.authorize(ctx, writer, req, logger)
+		parse.SetAttributes(attribute.Bool("contun.allowed", allowed))
+		if endSpan(parse, err) != nil {
+			return err
+		} else if !allowed {
+			continue
+		}
+		if req.Address != requested {
+			logger = s.redactDest(logger, req)
+		}
+
+		if req.Command == CommandAssociate {
+			if opts.Mode != ModeSocks {
+				logger.Printf("rejecting UDP association in %s mode", opts.Mode)
+				if err := sendReply(writer, 7, AddrIPv4, "0.0.0.0", 0); err != nil {
+					return err
+				}
+				continue
+			}
+			if frames == nil && reader.Buffered() > 0 {
+				return fmt.Errorf("unexpected buffered data before UDP association")
+			}
+			if err := s.associate(ctx, hub, writer, req, logger); err != nil {
+				return err
+			}
+			if frames == nil {
+				reader.Reset(hub)
+			}
+			writer.reset(hub)
+			continue
+		}
 
-		if s.opts.Mode == ModeDirect && s.opts.DirectDestination != nil {
-			dest := s.opts.DirectDestination
-			if req.Address != dest.Host || req.Port != dest.Port || req.AddrType != dest.AddrType {
-				logger.Printf("rejecting mismatched request %s:%d", req.Address, req.Port)
+		if req.Command == CommandPing || req.Command == CommandScan {
+			if opts.Mode != ModeSocks {
+				logger.Printf("rejecting %s in %s mode", req.Command, opts.Mode)
+				if err := sendReply(writer, 7, AddrIPv4, "0.0.0.0", 0); err != nil {
+					return err
+				}
+				continue
+			}
+			if req.Command == CommandScan {
+				err = s.scan(ctx, hub, control, writer, req, session.caps[capResults], logger)
+			} else {
+				err = s.ping(ctx, writer, req, logger)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if req.Command == CommandTUN {
+			if opts.TUN == "" {
+				logger.Printf("rejecting TUN session: no --tun device configured")
+				if err := sendReply(writer, 7, AddrIPv4, "0.0.0.0", 0); err != nil {
+					return err
+				}
+				continue
+			}
+			if frames == nil && reader.Buffered() > 0 {
+				return fmt.Errorf("unexpected buffered data before TUN session")
+			}
+			if err := s.tunnel(ctx, hub, writer, req, logger); err != nil {
+				return err
+			}
+			if frames == nil {
+				reader.Reset(hub)
+			}
+			writer.reset(hub)
+			continue
+		}
+
+		if dest := target; opts.Mode == ModeDirect && dest != nil {
+			if (req.Address != dest.Host || req.Port != dest.Port || req.AddrType != dest.AddrType) && !opts.exposes(req) {
+				logger.Printf("rejecting mismatched request %s", req.hostPort())
+				s.audit.Record("request_denied", map[string]any{"dest": req.Address, "port": req.Port, "reason": "not the direct-mode target"})
 				if err := sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0); err != nil {
 					return err
 				}
 				continue
 			}
 		}
+		if opts.Mode == ModeDirect && len(opts.TargetPatterns) > 0 && !opts.matchesTargetPattern(req) && !opts.exposes(req) {
+			logger.Printf("rejecting request %s outside --target-pattern", req.hostPort())
+			s.audit.Record("request_denied", map[string]any{"dest": req.Address, "port": req.Port, "reason": "outside --target-pattern"})
+			if err := sendReply(writer, 2, AddrIPv4, "0.0.0.0", 0); err != nil {
+				return err
+			}
+			continue
+		}
 
-		targetConn, err := s.dialTarget(ctx, req)
+		started := time.Now()
+		dest := req.hostPort()
+		dialCtx, cancelDial := context.WithCancel(ctx)
+		if req.Deadline > 0 {
+			// The hub's client has given up by then; so does the dial.
+			dialCtx, cancelDial = context.WithDeadline(ctx, received.Add(req.Deadline))
+		}
+		watch := watchCancel(hub, control, req.SessionID, cancelDial)
+		var progress *progressReporter
+		if session.caps[capProgress] {
+			progress = newProgressReporter(writer)
+		}
+		dial := rt.stage("target.dial")
+		// release gives back the --max-sessions slot once the stream ends.
+		release := sync.OnceFunc(s.releaseSession)
+		var targetConn net.Conn
+		err = s.load.admit()
+		if err == nil {
+			err = s.acquireSession(dialCtx)
+		}
+		if err == nil {
+			if targetConn, err = s.dialTarget(dialCtx, req, progress); err != nil {
+				release()
+			}
+		}
+		hubErr := watch.stop()
+		expired := req.Deadline > 0 && errors.Is(dialCtx.Err(), context.DeadlineExceeded)
+		cancelDial()
+		dial.SetAttributes(attribute.Bool("contun.cancelled", watch.cancelled.Load()))
+		endSpan(dial, err)
+		closeTarget := func() {
+			_ = targetConn.Close()
+			release()
+		}
+		if watch.cancelled.Load() {
+			if targetConn != nil {
+				closeTarget()
+			}
+			logx.Log(logx.At(logger, "bridge", logx.Info), fmt.Sprintf("hub cancelled session %s to %s", req.SessionID, req.hostPort()),
+				"session", req.SessionID, "dest", dest)
+			s.audit.RecordSampled("session", map[string]any{
+				"dest": req.Address, "port": req.Port, "outcome": "cancelled",
+			})
+			if err := sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if hubErr != nil {
+			if targetConn != nil {
+				closeTarget()
+			}
+			return hubErr
+		}
+		if errors.Is(err, errTooManySessions) || errors.Is(err, errOverloaded) {
+			reason, outcome := "--max-sessions reached", "busy"
+			if errors.Is(err, errOverloaded) {
+				reason, outcome = err.Error(), "overloaded"
+			}
+			logx.Log(logx.At(logger, "bridge", logx.Warn), fmt.Sprintf("turning away session %s to %s: %s", req.SessionID, req.hostPort(), reason),
+				"session", req.SessionID, "dest", dest)
+			s.audit.RecordSampled("session", map[string]any{
+				"dest": req.Address, "port": req.Port, "outcome": outcome,
+			})
+			// A hub that pipelines can hand the request to another worker.
+			if session.caps[capQueue] && req.SessionID != "" {
+				s.pendingRejected.Add(1)
+				writer.sendNotice("RETRY " + req.SessionID)
+				continue
+			}
+			if err := sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil && expired {
+			err = errDeadlineExpired
+		}
 		if err != nil {
-			status := mapErrorToStatus(err)
-			logger.Printf("failed to reach %s:%d: %v", req.Address, req.Port, err)
+			status, err := mapErrorToStatus(err), normalizeError(err)
+			logx.Log(logx.At(logger, "bridge", logx.Warn), fmt.Sprintf("failed to reach %s: %v", req.hostPort(), err),
+				"session", req.SessionID, "dest", dest, "duration_ms", time.Since(started), "error", err)
+			if errors.Is(err, errPrivateTarget) {
+				s.audit.Record("request_denied", map[string]any{"dest": req.Address, "port": req.Port, "reason": err.Error()})
+			} else {
+				s.audit.RecordSampled("session", map[string]any{
+					"dest": req.Address, "port": req.Port, "outcome": "dial_failed", "status": status,
+				})
+			}
+			info := s.sessionInfo(req, started)
+			info.Duration, info.Status, info.Err = time.Since(started), status, err
+			s.dialResult(ctx, req, info)
 			if sendErr := sendReply(writer, status, AddrIPv4, "0.0.0.0", 0); sendErr != nil {
 				return sendErr
 			}
 			continue
 		}
-		logger.Printf("bridging %s:%d", req.Address, req.Port)
+		logx.Log(logx.At(logger, "bridge", logx.Info), fmt.Sprintf("bridging %s%s", req.hostPort(), req.clientDesc()),
+			append([]any{"session", req.SessionID, "dest", dest}, req.clientFields()...)...)
+		s.dialResult(ctx, req, s.sessionInfo(req, started))
 		if err := sendReply(writer, 0, AddrIPv4, "0.0.0.0", 0); err != nil {
-			_ = targetConn.Close()
+			closeTarget()
 			return err
 		}
-		if reader.Buffered() > 0 {
-			_ = targetConn.Close()
+		if frames == nil && reader.Buffered() > 0 {
+			closeTarget()
 			return fmt.Errorf("unexpected buffered data before streaming")
 		}
-		if err := writer.Flush(); err != nil {
-			_ = targetConn.Close()
-			return err
+
+		toHub, fromHub := hub, io.Reader(hub)
+		if caps[opts.Compress] {
+			if toHub, err = NewCompressConn(hub, opts.Compress); err == nil {
+				fromHub, err = NewDecompressReader(hub, opts.Compress)
+			}
+			if err != nil {
+				closeTarget()
+				return err
+			}
 		}
 
-		if err := s.bridge(ctx, hub, targetConn); err != nil && !errors.Is(err, context.Canceled) {
-			logger.Printf("bridge ended: %v", err)
+		s.active.Add(1)
+		if idle := s.link().opts.IdleTimeout; idle > 0 {
+			targetConn = newIdleConn(targetConn, idle)
+		}
+		var fromTarget io.Reader = targetConn
+		var delayed *delayedReader
+		if latency := s.link().opts.SimulateLatency; latency > 0 {
+			delayed = newDelayedReader(targetConn, latency)
+			fromTarget = delayed
+		}
+		if opts.InboundLimit > 0 {
+			fromTarget = &inboundMeter{
+				r:      fromTarget,
+				limit:  opts.InboundLimit,
+				action: opts.InboundAction,
+				alert:  func(total int64) { s.reportInbound(req, total) },
+			}
+		}
+		fromHub = s.scanStream(fromHub, req, "outbound")
+		fromTarget = s.scanStream(fromTarget, req, "inbound")
+		var ahead *readAhead
+		if limit := s.link().opts.ReadAhead; limit > 0 {
+			ahead = newReadAhead(fromTarget, limit)
+			fromTarget = ahead
+		}
+		bridging := rt.stage("bridge")
+		res, err := s.bridge(ctx, toHub, targetConn, fromHub, fromTarget, logger)
+		bridging.SetAttributes(
+			attribute.Int64("contun.bytes_out", res.toTarget),
+			attribute.Int64("contun.bytes_in", res.toHub),
+			attribute.String("contun.reason", string(res.reason)),
+		)
+		endSpan(bridging, err)
+		if ahead != nil {
+			ahead.close()
+		}
+		if delayed != nil {
+			delayed.close()
+		}
+		s.active.Add(-1)
+		s.endSession(ctx, req, started, res, err, logger)
+		closeTarget()
+		if res.closed {
+			// The bridge had to close the hub connection to stop a copy.
+			return ctx.Err()
 		}
-		_ = targetConn.Close()
-		reader.Reset(hub)
-		writer.Reset(hub)
+		if frames == nil {
+			reader.Reset(hub)
+		}
+		writer.reset(hub)
 	}
-	return ctx.Err()
+	return accept.Err()
+}
+
+// endSession emits the one summary of a bridged stream: a log record, the
+// sampled session audit record, a --session-log entry and the
+// interceptors' OnBridgeClose.
+func (s *Supervisor) endSession(ctx context.Context, req *Request, started time.Time, res bridgeResult, err error, logger *log.Logger) {
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	} else if err != nil {
+		err = normalizeError(err)
+	}
+	duration := time.Since(started)
+	rec := sessionRecord{
+		Time: time.Now(), Session: req.SessionID, Host: req.Address, Port: req.Port,
+		BytesOut: res.toTarget, BytesIn: res.toHub, Duration: duration.Milliseconds(), Reason: res.reason,
+		Alias: s.link().opts.aliasFor(req.Address, req.Port), ClientID: req.ClientID,
+	}
+	if req.Client.IsValid() {
+		rec.Client = req.Client.String()
+	}
+	msg := fmt.Sprintf("bridge to %s%s ended: %s (%d bytes out, %d bytes in, %s)",
+		req.hostPort(), req.clientDesc(), res.reason, res.toTarget, res.toHub, duration.Round(time.Millisecond))
+	fields := append([]any{
+		"session", req.SessionID, "dest", req.hostPort(),
+		"bytes_out", res.toTarget, "bytes_in", res.toHub, "duration_ms", duration, "reason", string(res.reason),
+	}, req.clientFields()...)
+	if err != nil {
+		rec.Error = err.Error()
+		msg += ": " + rec.Error
+		fields = append(fields, "error", err)
+	}
+	logx.Log(logx.At(logger, "bridge", logx.Info), msg, fields...)
+	record := map[string]any{
+		"dest": req.Address, "port": req.Port, "outcome": "bridged", "reason": string(res.reason),
+		"duration_ms": rec.Duration, "bytes_out": rec.BytesOut, "bytes_in": rec.BytesIn,
+	}
+	if rec.Client != "" {
+		record["client"] = rec.Client
+	}
+	if rec.ClientID != "" {
+		record["client_id"] = rec.ClientID
+	}
+	s.audit.RecordSampled("session", record)
+	s.sessionLog.Record(rec)
+	info := s.sessionInfo(req, started)
+	info.Duration, info.BytesOut, info.BytesIn, info.Reason, info.Err = duration, res.toTarget, res.toHub, string(res.reason), err
+	s.bridgeClosed(ctx, req, info)
 }
 
-func (s *Supervisor) performHandshake(writer *bufio.Writer, reader *bufio.Reader) error {
+// handleShutdown verifies a hub SHUTDOWN line, which must name identity
+// when the session announced one, and, when it is authentic, starts
+// draining the whole pool. It reports whether the session should end.
+func (s *Supervisor) handleShutdown(line, identity string, logger *log.Logger) bool {
+	if s.opts.ShutdownKey == nil {
+		logger.Printf("ignoring SHUTDOWN from hub: no --shutdown-key configured")
+		return false
+	}
+	if err := s.shutdownSeen.accept(s.opts.ShutdownKey, identity, line, time.Now()); err != nil {
+		logger.Printf("rejecting SHUTDOWN from hub: %v", err)
+		s.audit.Record("shutdown_rejected", map[string]any{"reason": err.Error()})
+		return false
+	}
+	logger.Printf("verified SHUTDOWN from hub; draining pool")
+	s.audit.Record("shutdown", map[string]any{"wipe": s.opts.ShutdownWipe})
+	s.remoteShutdown.Store(true)
+	s.stopAccepting()
+	return true
+}
+
+// performHandshake registers the worker with the hub using the given
+// protocol version, declaring target in direct mode, and returns the
+// capabilities the hub accepted in its OK line. A constrained direct-mode
+// worker registers in socks mode, so that the hub passes on the
+// destination each client asks for.
+func (s *Supervisor) performHandshake(l *link, target *Destination, writer *controlWriter, reader *bufio.Reader, version int) (capSet, error) {
 	var b strings.Builder
-	b.WriteString("HELLO 1 ")
-	b.WriteString(string(s.opts.Mode))
-	if s.opts.Mode == ModeDirect && s.opts.DirectDestination != nil {
+	fmt.Fprintf(&b, "HELLO %d ", version)
+	if l.opts.Mode == ModeDirect && len(l.opts.TargetPatterns) > 0 {
+		b.WriteString(string(ModeSocks))
+	} else {
+		b.WriteString(string(l.opts.Mode))
+	}
+	if l.opts.Mode == ModeDirect && target != nil {
 		b.WriteByte(' ')
-		b.WriteString(FormatDestination(s.opts.DirectDestination))
+		b.WriteString(FormatDestination(target))
 	}
-	b.WriteByte('\n')
-	if _, err := writer.WriteString(b.String()); err != nil {
-		return err
+	bare := version == 1 && s.bareHello.Load()
+	if !bare {
+		b.WriteString(" CAPS ")
+		caps := l.capabilities()
+		if version >= 2 && l.opts.PendingRequests > 0 {
+			// Pipelined REQUESTs need framing to stay apart from stream data.
+			caps = append(caps, capQueue)
+		}
+		b.WriteString(strings.Join(caps, ","))
 	}
-	if err := writer.Flush(); err != nil {
-		return err
+	if err := writer.send(b.String()); err != nil {
+		return nil, err
 	}
 	resp, err := readLine(reader)
 	if err != nil {
-		return err
+		// Hubs that only speak version 1 hang up on a newer HELLO without
+		// an answer, and those that predate capabilities on CAPS.
+		hungUp := errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+		switch {
+		case hungUp && version > 1 && l.opts.Protocol == 0:
+			return nil, errLegacyHub
+		case hungUp && version == 1 && !bare:
+			return nil, errCapsRefused
+		case hungUp && bare:
+			// Refused without CAPS too, so they were not the reason.
+			s.bareHello.Store(false)
+		}
+		return nil, err
+	}
+	if strings.HasPrefix(resp, "CHALLENGE ") {
+		if l.opts.AuthTokenFile == "" {
+			return nil, &authError{reason: "hub requires authentication; set --auth-token-file"}
+		}
+		line, err := authResponse(l.opts.AuthMode, l.opts.AuthToken, resp)
+		if err != nil {
+			return nil, err
+		}
+		if err := writer.send(line); err != nil {
+			return nil, err
+		}
+		if resp, err = readLine(reader); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(resp, "ERR") {
+			return nil, &authError{reason: resp}
+		}
+	}
+	if caps, ok := strings.CutPrefix(resp, "OK CAPS "); ok {
+		return parseCaps(caps), nil
 	}
 	if resp != "OK" {
-		return fmt.Errorf("hub rejected handshake: %s", resp)
+		return nil, fmt.Errorf("hub rejected handshake: %s", resp)
 	}
-	return nil
+	return capSet{}, nil
 }
 
-func sendReply(writer *bufio.Writer, status int, addrType AddrType, addr string, port int) error {
-	if _, err := writer.WriteString(fmt.Sprintf("REPLY %d %s %s %d\n", status, addrType, addr, port)); err != nil {
-		return err
+// sendReply answers a REQUEST. A successful reply switches the session to
+// streaming so no further control lines are written until the bridge ends.
+func sendReply(writer *controlWriter, status int, addrType AddrType, addr string, port int) error {
+	line := fmt.Sprintf("REPLY %d %s %s %d", status, addrType, addr, port)
+	if status == 0 {
+		return writer.startStream(line)
 	}
-	return writer.Flush()
+	return writer.send(line)
 }
 
-func (s *Supervisor) dialTarget(ctx context.Context, req *Request) (net.Conn, error) {
-	address := net.JoinHostPort(req.Address, fmt.Sprint(req.Port))
-	dialCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+func (s *Supervisor) dialTarget(ctx context.Context, req *Request, progress *progressReporter) (net.Conn, error) {
+	address := req.hostPort()
+	timeout := dialTimeout(s.link().opts.TargetDialTimeout)
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	return s.dialer.DialContext(dialCtx, "tcp", address)
+	if latency := s.link().opts.SimulateLatency; latency > 0 && !sleepWithContext(dialCtx, latency) {
+		return nil, dialCtx.Err()
+	}
+	dialer := s.targetDialer()
+	dialer.Timeout = timeout
+	if s.opts.TargetMSS > 0 {
+		dialer.ControlContext = s.mssControl(dialer.ControlContext)
+	}
+	dial := func() (net.Conn, error) {
+		l := s.link()
+		opts := l.opts
+		screen := opts.DenyPrivate && req.AddrType == AddrDomain && !s.namedTarget(req.Address)
+		if l.upstream != nil {
+			return s.dialUpstream(dialCtx, l.upstream, &dialer, req, screen)
+		}
+		cached := opts.TargetDNSTTL > 0 && opts.Mode == ModeDirect && req.AddrType == AddrDomain && !s.namedTarget(req.Address)
+		if len(opts.SourceRules) == 0 && len(opts.NetnsRules) == 0 && !s.namedTarget(req.Address) && !screen && !cached {
+			return dialer.DialContext(dialCtx, "tcp", address)
+		}
+		var targets []netip.AddrPort
+		var err error
+		if cached {
+			targets, err = s.cachedTarget(dialCtx, req, opts.TargetDNSTTL)
+		} else {
+			targets, err = s.resolveTarget(dialCtx, req)
+		}
+		if err == nil && screen {
+			targets, err = opts.publicTargets(targets)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialSourced(dialCtx, dialer, targets, opts.SourceRules, opts.NetnsRules)
+		if err != nil && cached {
+			s.targetDNS.expire(req.Address)
+		}
+		return conn, err
+	}
+	if progress != nil {
+		defer progress.finish()
+		dialer.ControlContext = progress.control(dialer.ControlContext)
+		if req.AddrType == AddrDomain {
+			progress.stage("resolving", req.Address)
+		}
+	}
+	conn, err := dial()
+	if err != nil || s.link().opts.SendProxyProtocol == "" {
+		return conn, err
+	}
+	if err := s.sendProxyHeader(conn, req); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
-func (s *Supervisor) bridge(ctx context.Context, hub net.Conn, target net.Conn) error {
-	// Ensure cancellation tears down both sockets.
-	done := make(chan struct{})
-	go func() {
-		select {
-		case <-ctx.Done():
+// bridgeResult describes a finished bridge.
+type bridgeResult struct {
+	reason   endReason
+	closed   bool  // the owner closed the connections
+	toTarget int64 // bytes copied from the hub to the target
+	toHub    int64 // bytes copied from the target to the hub
+}
+
+// errNoHalfClose ends a copy whose destination cannot be half-closed.
+var errNoHalfClose = errors.New("connection cannot be half-closed")
+
+// copyBuffers holds the buffers bridges copy through, so that sessions
+// opening and closing at a high rate reuse them rather than allocate 64
+// KiB each.
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 32*1024)
+	return &buf
+}}
+
+// copyPooled is io.Copy with a buffer from copyBuffers when it needs one.
+// Between TCP connections the kernel moves the bytes and no buffer is
+// taken, so an idle session holds none.
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := src.(io.WriterTo); ok {
+		return io.Copy(dst, src)
+	}
+	if _, ok := dst.(io.ReaderFrom); ok {
+		return io.Copy(dst, src)
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// bridge copies bytes both ways until both directions finish and reports
+// why the session ended, judged by the first direction to stop. fromHub and
+// fromTarget are the readers for each direction: the connections
+// themselves, or wrappers that meter or scan the traffic.
+//
+// The hub-to-target copy runs on its own goroutine and the other on the
+// caller's. Only the owner closes the connections, and only while a copy is
+// still running: when ctx is cancelled or a copy fails. The owner is a
+// context.AfterFunc rather than a goroutine, so an idle bridge costs one
+// goroutine besides its worker's. res.closed reports that it did, in which
+// case the hub connection is unusable and the caller must end the session.
+// A copy that finishes cleanly just half-closes its destination. With
+// --stall-timeout a monitor goroutine also watches both directions for
+// stalls, and --rate-limit and --pool-rate-limit pace the copies.
+func (s *Supervisor) bridge(ctx context.Context, hub, target net.Conn, fromHub, fromTarget io.Reader, logger *log.Logger) (res bridgeResult, err error) {
+	type copyResult struct {
+		fromHub bool
+		n       int64
+		err     error
+	}
+	results := make(chan copyResult, 2)
+	bctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// finished is set under mu once both copies are done, after which the
+	// owner must leave the connections alone.
+	var mu sync.Mutex
+	finished := false
+	stopOwner := context.AfterFunc(bctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !finished {
+			res.closed = true
 			_ = hub.Close()
 			_ = target.Close()
-		case <-done:
 		}
-	}()
+	})
+	defer stopOwner()
 
-	errCh := make(chan error, 2)
-	copyStream := func(dst, src net.Conn) {
-		buf := make([]byte, 32*1024)
-		_, err := io.CopyBuffer(dst, src, buf)
-		if tcp, ok := dst.(*net.TCPConn); ok {
-			_ = tcp.CloseWrite()
+	stallTimeout := s.link().opts.StallTimeout
+	start := time.Now()
+	toTarget, toHub := newFlow("hub->target", start), newFlow("target->hub", start)
+
+	copyStream := func(dst net.Conn, src io.Reader, fromHub bool, f *flow) {
+		var n int64
+		var err error
+		if stallTimeout > 0 {
+			buf := copyBuffers.Get().(*[]byte)
+			n, err = copyFlow(dst, src, *buf, f)
+			copyBuffers.Put(buf)
 		} else {
-			_ = dst.Close()
+			n, err = copyPooled(dst, src)
+		}
+		if err == nil {
+			if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = hc.CloseWrite()
+			} else {
+				// Without a half-close the owner has to close both.
+				err = errNoHalfClose
+			}
+		}
+		// Report before cancelling, so the other direction's read error
+		// cannot decide the reason.
+		results <- copyResult{fromHub: fromHub, n: n, err: err}
+		if err != nil {
+			cancel()
 		}
-		errCh <- err
 	}
+	copiesDone := make(chan struct{})
+	var monitor sync.WaitGroup
+	if stallTimeout > 0 {
+		monitor.Add(1)
+		go func() {
+			defer monitor.Done()
+			ticker := time.NewTicker(max(stallTimeout/4, 10*time.Millisecond))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-bctx.Done():
+					return
+				case <-copiesDone:
+					return
+				case now := <-ticker.C:
+					s.checkStall(toTarget, toHub, stallTimeout, now, logger)
+					s.checkStall(toHub, toTarget, stallTimeout, now, logger)
+				}
+			}
+		}()
+	}
+	var copies sync.WaitGroup
+	copies.Add(1)
+	go func() {
+		defer copies.Done()
+		copyStream(target, s.rateLimited(bctx, fromHub, true), true, toTarget)
+	}()
+	copyStream(hub, s.rateLimited(bctx, fromTarget, false), false, toHub)
+	copies.Wait()
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+	close(copiesDone)
+	monitor.Wait()
 
-	go copyStream(target, hub)
-	go copyStream(hub, target)
-
-	var firstErr error
 	for i := 0; i < 2; i++ {
-		if err := <-errCh; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
-			if firstErr == nil {
-				firstErr = err
-			}
+		c := <-results
+		if c.fromHub {
+			res.toTarget = c.n
+		} else {
+			res.toHub = c.n
+		}
+		if errors.Is(c.err, errNoHalfClose) {
+			c.err = nil
+		}
+		if i == 0 {
+			res.reason = bridgeEnd(ctx, c.fromHub, c.err)
+		}
+		if err == nil && c.err != nil && !errors.Is(c.err, io.EOF) && !errors.Is(c.err, net.ErrClosed) {
+			err = c.err
 		}
 	}
-
-	close(done)
-	return firstErr
+	return res, err
 }
 
 func readLine(r *bufio.Reader) (string, error) {
@@ -287,29 +1399,6 @@ func sleepWithContext(ctx context.Context, d time.Duration) bool {
 	}
 }
 
-func mapErrorToStatus(err error) int {
-	if err == nil {
-		return 0
-	}
-	msg := strings.ToLower(err.Error())
-	switch {
-	case strings.Contains(msg, "refused"):
-		return 5
-	case strings.Contains(msg, "network is unreachable"):
-		return 3
-	case strings.Contains(msg, "host is unreachable"):
-		return 4
-	case strings.Contains(msg, "no route"):
-		return 4
-	case strings.Contains(msg, "timeout"), strings.Contains(msg, "timed out"):
-		return 4
-	case strings.Contains(msg, "no such host"), strings.Contains(msg, "lookup"):
-		return 4
-	default:
-		return 1
-	}
-}
-
 func validateRequestAddress(req *Request) error {
 	switch req.AddrType {
 	case AddrIPv4:
@@ -0,0 +1,94 @@
+package pool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// errTracerUnsupported is returned by tracerPID on platforms where debugger
+// attachment cannot be detected.
+var errTracerUnsupported = errors.New("tracer detection not supported on this platform")
+
+// tamperNotice describes a detected tamper condition.
+type tamperNotice struct {
+	Kind   string // "ptrace" or "binary"
+	Detail string
+}
+
+// tamperMonitor periodically checks for debugger attachment and changes to
+// the running executable. It only reports; it never stops the pool.
+type tamperMonitor struct {
+	interval time.Duration
+	exe      string
+	digest   string
+	notify   func(tamperNotice)
+
+	tracer   int
+	modified bool
+}
+
+func newTamperMonitor(interval time.Duration, notify func(tamperNotice)) (*tamperMonitor, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locate executable: %w", err)
+	}
+	digest, err := fileDigest(exe)
+	if err != nil {
+		return nil, fmt.Errorf("hash executable: %w", err)
+	}
+	return &tamperMonitor{interval: interval, exe: exe, digest: digest, notify: notify}, nil
+}
+
+func (m *tamperMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check reports each condition once when it first appears.
+func (m *tamperMonitor) check() {
+	if pid, err := tracerPID(); err == nil && pid != m.tracer {
+		m.tracer = pid
+		if pid != 0 {
+			m.notify(tamperNotice{Kind: "ptrace", Detail: fmt.Sprintf("tracer pid %d attached", pid)})
+		}
+	}
+	if m.modified {
+		return
+	}
+	digest, err := fileDigest(m.exe)
+	switch {
+	case err != nil:
+		m.modified = true
+		m.notify(tamperNotice{Kind: "binary", Detail: fmt.Sprintf("executable unreadable: %v", err)})
+	case digest != m.digest:
+		m.modified = true
+		m.notify(tamperNotice{Kind: "binary", Detail: "executable sha256 changed to " + digest})
+	}
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,27 @@
+package pool
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tracerPID returns the pid of the process ptrace-attached to us, or 0.
+func tracerPID() (int, error) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "TracerPid:"); ok {
+			return strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errTracerUnsupported
+}
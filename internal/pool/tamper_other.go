@@ -0,0 +1,7 @@
+//go:build !linux
+
+package pool
+
+func tracerPID() (int, error) {
+	return 0, errTracerUnsupported
+}
@@ -0,0 +1,33 @@
+package pool
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTamperMonitorReportsBinaryChangeOnce(t *testing.T) {
+	exe := filepath.Join(t.TempDir(), "poolgo")
+	if err := os.WriteFile(exe, []byte("original"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileDigest(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notices []tamperNotice
+	m := &tamperMonitor{exe: exe, digest: digest, notify: func(n tamperNotice) { notices = append(notices, n) }}
+
+	m.check()
+	if len(notices) != 0 {
+		t.Fatalf("unexpected notices for untouched binary: %+v", notices)
+	}
+	if err := os.WriteFile(exe, []byte("patched"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	m.check()
+	m.check()
+	if len(notices) != 1 || notices[0].Kind != "binary" {
+		t.Fatalf("expected a single binary notice, got %+v", notices)
+	}
+}
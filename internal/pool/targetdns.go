@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"contun/internal/logx"
+)
+
+// targetDNS remembers what direct-mode domain targets resolved to for
+// --target-dns-ttl. Without it every session resolves its target afresh,
+// so a backend that fails over by changing its DNS records is followed at
+// the next session; with it a worker resolves at most once per TTL, and
+// again at once after a dial to the remembered addresses fails.
+type targetDNS struct {
+	mu      sync.Mutex
+	entries map[string]*targetDNSEntry
+}
+
+type targetDNSEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// lookup returns the addresses host resolves to, from the cache while they
+// are younger than ttl, or by calling resolve. It logs when a fresh answer
+// differs from the one it replaces, which is how failover shows up.
+func (c *targetDNS) lookup(ctx context.Context, host string, ttl time.Duration, resolve func(context.Context, string) ([]netip.Addr, error), logger *log.Logger) ([]netip.Addr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	e := c.entries[host]
+	if e != nil && now.Before(e.expires) {
+		addrs := e.addrs
+		c.mu.Unlock()
+		return addrs, nil
+	}
+	c.mu.Unlock()
+
+	addrs, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev := c.entries[host]; prev != nil && !slices.Equal(prev.addrs, addrs) {
+		logx.At(logger, "bridge", logx.Info).Printf("target %s now resolves to %s (was %s)", host, addrList(addrs), addrList(prev.addrs))
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*targetDNSEntry)
+	}
+	c.entries[host] = &targetDNSEntry{addrs: addrs, expires: now.Add(ttl)}
+	return addrs, nil
+}
+
+// expire makes the next lookup of host resolve it again, after a dial to
+// the addresses it returned failed. What they were is kept to compare the
+// next answer with.
+func (c *targetDNS) expire(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e := c.entries[host]; e != nil {
+		e.expires = time.Time{}
+	}
+}
+
+// addrList renders addrs for a log line.
+func addrList(addrs []netip.Addr) string {
+	var b []byte
+	for i, addr := range addrs {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = addr.AppendTo(b)
+	}
+	return string(b)
+}
+
+// cachedTarget is resolveTarget for a domain target under --target-dns-ttl.
+func (s *Supervisor) cachedTarget(ctx context.Context, req *Request, ttl time.Duration) ([]netip.AddrPort, error) {
+	ips, err := s.targetDNS.lookup(ctx, req.Address, ttl, func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return s.resolver().LookupNetIP(ctx, "ip", host)
+	}, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]netip.AddrPort, len(ips))
+	for i, ip := range ips {
+		targets[i] = netip.AddrPortFrom(ip, uint16(req.Port))
+	}
+	return targets, nil
+}
@@ -0,0 +1,73 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTargetDNS(t *testing.T) {
+	answer := []netip.Addr{netip.MustParseAddr("10.0.0.1")}
+	lookups := 0
+	resolve := func(context.Context, string) ([]netip.Addr, error) {
+		lookups++
+		return answer, nil
+	}
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	var c targetDNS
+	ctx := context.Background()
+
+	for range 3 {
+		addrs, err := c.lookup(ctx, "db.internal", time.Hour, resolve, logger)
+		if err != nil || len(addrs) != 1 || addrs[0] != answer[0] {
+			t.Fatalf("lookup = %v, %v", addrs, err)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("resolved %d times within the TTL, want 1", lookups)
+	}
+
+	// A failed dial makes the next session resolve again, and a changed
+	// answer is logged.
+	answer = []netip.Addr{netip.MustParseAddr("10.0.0.2")}
+	c.expire("db.internal")
+	addrs, _ := c.lookup(ctx, "db.internal", time.Hour, resolve, logger)
+	if lookups != 2 || addrs[0] != answer[0] {
+		t.Fatalf("after expire: %d lookups, addrs %v", lookups, addrs)
+	}
+	if !strings.Contains(buf.String(), "target db.internal now resolves to 10.0.0.2 (was 10.0.0.1)") {
+		t.Fatalf("log = %q", buf.String())
+	}
+
+	// An entry older than the TTL is resolved again.
+	c.expire("db.internal")
+	c.lookup(ctx, "db.internal", time.Nanosecond, resolve, logger)
+	time.Sleep(time.Millisecond)
+	c.lookup(ctx, "db.internal", time.Nanosecond, resolve, logger)
+	if lookups != 4 {
+		t.Fatalf("resolved %d times past the TTL, want 4", lookups)
+	}
+}
+
+func TestParseArgsTargetDNSTTL(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-t", "db.internal", "-T", "5432"})
+	if err != nil || opts.TargetDNSTTL != 0 {
+		t.Fatalf("default: %v, %v", opts, err)
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-t", "db.internal", "-T", "5432", "--target-dns-ttl", "30s"})
+	if err != nil || opts.TargetDNSTTL != 30*time.Second {
+		t.Fatalf("30s: %v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-t", "db.internal", "-T", "5432", "--target-dns-ttl", "-1s"}); err == nil {
+		t.Fatal("negative TTL accepted")
+	}
+	opts, err = ParseArgs([]string{"-p", "5555", "-m", "socks", "--target-dns-ttl", "30s"})
+	if err != nil || len(opts.UnusedFlags()) != 1 {
+		t.Fatalf("socks mode: %v, %v", opts.UnusedFlags(), err)
+	}
+}
@@ -0,0 +1,22 @@
+package pool
+
+// targetPatternLine is the control line announcing a --target-pattern
+// rule to a hub that accepted the pattern capability.
+func targetPatternLine(r ACLRule) string {
+	return "PATTERN " + r.String()
+}
+
+// matchesTargetPattern reports whether a constrained direct-mode worker,
+// one given --target-pattern instead of a target, serves req: a CONNECT
+// to a destination one of the patterns covers as the hub named it.
+func (o *Options) matchesTargetPattern(req *Request) bool {
+	if req.Command != CommandConnect {
+		return false
+	}
+	for _, r := range o.TargetPatterns {
+		if r.Matches(req.Address, req.Port) {
+			return true
+		}
+	}
+	return false
+}
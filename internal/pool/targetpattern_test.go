@@ -0,0 +1,72 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArgsTargetPattern(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "--target-pattern", "*.lab.corp:22", "--target-pattern", "10.9.0.0/16:22,80"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	if len(opts.TargetPatterns) != 2 || len(opts.Targets) != 0 || opts.TargetPatterns[1].String() != "10.9.0.0/16:22,80" {
+		t.Fatalf("patterns %v, targets %v", opts.TargetPatterns, opts.Targets)
+	}
+	for _, args := range [][]string{
+		{"-p", "5555", "--target-pattern", "*.lab.corp:0"},
+		{"-p", "5555", "--target-pattern", "*.lab.corp:22", "-t", "db.internal", "-T", "5432"},
+		{"-p", "5555", "--target-pattern", "*.lab.corp:22", "--target", "db.internal:5432"},
+		{"-p", "5555", "-m", "socks", "--target-pattern", "*.lab.corp:22"},
+	} {
+		if _, err := ParseArgs(args); err == nil {
+			t.Errorf("ParseArgs(%q) accepted invalid arguments", args)
+		}
+	}
+
+	for _, tc := range []struct {
+		req  Request
+		want bool
+	}{
+		{Request{Command: CommandConnect, AddrType: AddrDomain, Address: "git.lab.corp", Port: 22}, true},
+		{Request{Command: CommandConnect, AddrType: AddrDomain, Address: "git.lab.corp", Port: 443}, false},
+		{Request{Command: CommandConnect, AddrType: AddrIPv4, Address: "10.9.3.4", Port: 80}, true},
+		{Request{Command: CommandConnect, AddrType: AddrIPv4, Address: "10.8.3.4", Port: 80}, false},
+		{Request{Command: CommandPing, AddrType: AddrIPv4, Address: "10.9.3.4", Port: 80}, false},
+	} {
+		if got := opts.matchesTargetPattern(&tc.req); got != tc.want {
+			t.Errorf("matchesTargetPattern(%s %s) = %v", tc.req.Command, tc.req.hostPort(), got)
+		}
+	}
+}
+
+func TestTargetPatternSession(t *testing.T) {
+	rule, _ := ParseACLRule("*.lab.corp:22")
+	s := NewSupervisor(Options{Mode: ModeDirect, Protocol: 1, TargetPatterns: []ACLRule{rule}})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "HELLO 1 socks CAPS ") || !strings.Contains(line, "pattern") {
+		t.Fatalf("HELLO %q, want socks mode offering pattern", line)
+	}
+	hub.Write([]byte("OK CAPS pattern\n"))
+	if line, _ := reader.ReadString('\n'); line != "PATTERN *.lab.corp:22\n" {
+		t.Fatalf("announcement %q", line)
+	}
+	hub.Write([]byte("REQUEST CONNECT domain db.other.corp 22\n"))
+	if line, _ := reader.ReadString('\n'); !strings.HasPrefix(line, "REPLY 2 ") {
+		t.Fatalf("reply %q, want not allowed", line)
+	}
+	hub.Close()
+	<-done
+}
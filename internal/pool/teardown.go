@@ -0,0 +1,41 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// endReason says why a bridged session ended. The values are recorded in
+// session audit records and logs so normal completions can be told apart
+// from failures afterwards.
+type endReason string
+
+const (
+	endClientClosed endReason = "client-closed" // the hub side finished first
+	endTargetClosed endReason = "target-closed" // the target finished first
+	endIdleTimeout  endReason = "idle-timeout"  // no traffic for too long
+	endQuota        endReason = "quota"         // a byte or time budget ran out
+	endAdminKill    endReason = "admin-kill"    // the pool was shut down or expired
+	endError        endReason = "error"         // a read or write failed
+)
+
+// bridgeEnd classifies the first copy direction to finish. fromHub is true
+// when the hub-to-target copy ended first.
+func bridgeEnd(ctx context.Context, fromHub bool, err error) endReason {
+	switch {
+	case ctx.Err() != nil:
+		return endAdminKill
+	case errors.Is(err, errInboundQuota):
+		return endQuota
+	case errors.Is(err, errIdleTimeout):
+		return endIdleTimeout
+	case err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed):
+		return endError
+	case fromHub:
+		return endClientClosed
+	default:
+		return endTargetClosed
+	}
+}
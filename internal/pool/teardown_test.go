@@ -0,0 +1,142 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection, so bridge can
+// half-close them like real hub and target sockets.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	peer := <-accepted
+	t.Cleanup(func() {
+		dialed.Close()
+		peer.Close()
+	})
+	return dialed, peer
+}
+
+func TestBridgeEndReason(t *testing.T) {
+	cases := []struct {
+		name string
+		end  func(client, target net.Conn, cancel context.CancelFunc)
+		want endReason
+	}{
+		{
+			name: "client closed",
+			end: func(client, target net.Conn, _ context.CancelFunc) {
+				client.Close()
+				time.Sleep(50 * time.Millisecond)
+				target.Close()
+			},
+			want: endClientClosed,
+		},
+		{
+			name: "target closed",
+			end: func(client, target net.Conn, _ context.CancelFunc) {
+				target.Close()
+				time.Sleep(50 * time.Millisecond)
+				client.Close()
+			},
+			want: endTargetClosed,
+		},
+		{
+			name: "shutdown",
+			end:  func(_, _ net.Conn, cancel context.CancelFunc) { cancel() },
+			want: endAdminKill,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hub, client := tcpPair(t)
+			target, remote := tcpPair(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			s := NewSupervisor(Options{})
+			done := make(chan endReason, 1)
+			go func() {
+				res, _ := s.bridge(ctx, hub, target, hub, target, log.New(io.Discard, "", 0))
+				done <- res.reason
+			}()
+			tc.end(client, remote, cancel)
+			select {
+			case got := <-done:
+				if got != tc.want {
+					t.Fatalf("got reason %q, want %q", got, tc.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("bridge did not finish")
+			}
+		})
+	}
+}
+
+// TestBridgeLeavesHubOpen checks that only a bridge still copying closes
+// the connections: cancelling right after a clean end must not close the
+// hub connection under the session loop.
+func TestBridgeLeavesHubOpen(t *testing.T) {
+	s := NewSupervisor(Options{})
+	for i := 0; i < 50; i++ {
+		hub, client := tcpPair(t)
+		target, remote := tcpPair(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		client.(*net.TCPConn).CloseWrite()
+		remote.(*net.TCPConn).CloseWrite()
+		res, err := s.bridge(ctx, hub, target, hub, target, log.New(io.Discard, "", 0))
+		cancel()
+		if res.closed || err != nil {
+			t.Fatalf("clean end: closed %v, err %v", res.closed, err)
+		}
+		if err := hub.SetDeadline(time.Time{}); err != nil {
+			t.Fatalf("hub connection closed after a clean end: %v", err)
+		}
+	}
+
+	hub, _ := tcpPair(t)
+	target, _ := tcpPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if res, _ := s.bridge(ctx, hub, target, hub, target, log.New(io.Discard, "", 0)); !res.closed || res.reason != endAdminKill {
+		t.Fatalf("cancelled bridge: reason %q, closed %v", res.reason, res.closed)
+	}
+}
+
+// TestBridgeCountsBytes checks the per-direction totals with and without
+// the instrumented --stall-timeout copy.
+func TestBridgeCountsBytes(t *testing.T) {
+	for _, stall := range []time.Duration{0, time.Minute} {
+		s := NewSupervisor(Options{StallTimeout: stall})
+		hub, client := tcpPair(t)
+		target, remote := tcpPair(t)
+		go io.Copy(io.Discard, client)
+		go io.Copy(io.Discard, remote)
+		client.Write([]byte("hello"))
+		client.(*net.TCPConn).CloseWrite()
+		remote.Write([]byte("welcome"))
+		remote.(*net.TCPConn).CloseWrite()
+		res, err := s.bridge(context.Background(), hub, target, hub, target, log.New(io.Discard, "", 0))
+		if err != nil || res.toTarget != 5 || res.toHub != 7 {
+			t.Fatalf("stall-timeout %s: %+v, %v", stall, res, err)
+		}
+	}
+}
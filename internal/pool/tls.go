@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxCertBackoff caps the retry delay after repeated certificate failures.
+const maxCertBackoff = 5 * time.Minute
+
+// certificateError marks TLS failures caused by certificate validation on
+// either side of the hub link. Retrying at the normal cadence cannot fix
+// them, so workers back off instead of hammering the hub.
+type certificateError struct {
+	err error
+}
+
+func (e *certificateError) Error() string { return "certificate error: " + e.err.Error() }
+func (e *certificateError) Unwrap() error { return e.err }
+
+// classifyTLSError wraps certificate-related failures in certificateError
+// and returns other errors unchanged.
+func classifyTLSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+	)
+	switch {
+	case errors.As(err, &verifyErr), errors.As(err, &invalidErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr):
+		return &certificateError{err: err}
+	case isCertificateAlert(err):
+		return &certificateError{err: err}
+	}
+	return err
+}
+
+// certificateAlerts are the TLS alerts a peer sends when it rejects our
+// certificate (RFC 8446 section 6.2).
+var certificateAlerts = map[tls.AlertError]bool{
+	42:  true, // bad_certificate
+	43:  true, // unsupported_certificate
+	44:  true, // certificate_revoked
+	45:  true, // certificate_expired
+	46:  true, // certificate_unknown
+	48:  true, // unknown_ca
+	49:  true, // access_denied
+	116: true, // certificate_required
+}
+
+// isCertificateAlert reports whether err carries one of certificateAlerts.
+// Over TCP crypto/tls surfaces received alerts as an unexported type, so the
+// alert is recognised by its "remote error: tls: <description>" text.
+func isCertificateAlert(err error) bool {
+	var alert tls.AlertError
+	if errors.As(err, &alert) {
+		return certificateAlerts[alert]
+	}
+	msg := err.Error()
+	for a := range certificateAlerts {
+		if strings.Contains(msg, "remote error: "+a.Error()) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns how long a worker waits after err. Certificate and
+// authentication errors back off exponentially up to maxCertBackoff; any
+// other outcome resets the failure count and uses the configured retry delay.
+func (s *Supervisor) retryDelay(err error, certFailures *int) time.Duration {
+	var (
+		certErr *certificateError
+		authErr *authError
+	)
+	if !errors.As(err, &certErr) && !errors.As(err, &authErr) {
+		*certFailures = 0
+		return s.link().opts.RetryDelay
+	}
+	*certFailures++
+	delay := s.link().opts.RetryDelay
+	for i := 1; i < *certFailures && delay < maxCertBackoff; i++ {
+		delay *= 2
+	}
+	return min(max(delay, time.Second), maxCertBackoff)
+}
+
+// hubTLSConfig builds the client TLS configuration used when dialling the
+// hub with --tls.
+func (o *Options) hubTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         o.TLSServerName,
+		InsecureSkipVerify: o.TLSInsecure,
+	}
+	if cfg.ServerName == "" {
+		// crypto/tls checks an IP address against the certificate's IP
+		// SANs, and sends no SNI for it.
+		cfg.ServerName = o.HubHost
+	}
+	if o.TLSCertFile != "" {
+		cert, err := loadClientCertificate(o.TLSCertFile, o.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if o.TLSCAFile != "" {
+		pem, err := os.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read --tls-ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("--tls-ca %s contains no PEM certificates", o.TLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// loadClientCertificate parses the worker's client certificate. The private
+// key PEM is held in a Secret and zeroed as soon as the key pair is built.
+func loadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read --tls-cert: %w", err)
+	}
+	key, err := LoadSecret(keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read --tls-key: %w", err)
+	}
+	defer key.Wipe()
+	cert, err := tls.X509KeyPair(certPEM, key.Bytes())
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load client certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,351 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"contun/internal/transport"
+	"contun/pkg/pooltest"
+)
+
+// testCertificate issues a self-signed certificate for dnsName, or an IP
+// address, and writes its PEM encoding to dir, returning the TLS
+// certificate and the PEM path.
+func testCertificate(t *testing.T, dir, dnsName string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: dnsName},
+		DNSNames:              []string{dnsName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(dnsName); ip != nil {
+		tmpl.DNSNames, tmpl.IPAddresses = nil, []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, dnsName+".pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certPath, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, dnsName+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPath
+}
+
+func TestDialHubTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert, caPath := testCertificate(t, dir, "hub.test")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	dial := func(serverName string) error {
+		opts, err := ParseArgs([]string{
+			"--hub-port", port, "--mode", "socks",
+			"--tls", "--tls-ca", caPath, "--tls-server-name", serverName,
+		})
+		if err != nil {
+			t.Fatalf("ParseArgs error: %v", err)
+		}
+		s := NewSupervisor(*opts)
+		if err := s.connectLink(s.link(), nil); err != nil {
+			t.Fatalf("connectLink error: %v", err)
+		}
+		conn, err := s.dialHub(context.Background(), s.link())
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	if err := dial("hub.test"); err != nil {
+		t.Fatalf("expected verified TLS dial, got %v", err)
+	}
+	if err := dial("other.test"); err == nil {
+		t.Fatalf("expected verification failure for mismatched server name")
+	}
+}
+
+func TestDialHubTLSByIP(t *testing.T) {
+	dir := t.TempDir()
+	cert, caPath := testCertificate(t, dir, "127.0.0.1")
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	opts, err := ParseArgs([]string{
+		"--hub-host", "127.0.0.1", "--hub-port", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port),
+		"--mode", "socks", "--tls", "--tls-ca", caPath,
+	})
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+	s := NewSupervisor(*opts)
+	if err := s.connectLink(s.link(), nil); err != nil {
+		t.Fatalf("connectLink error: %v", err)
+	}
+	conn, err := s.dialHub(context.Background(), s.link())
+	if err != nil {
+		t.Fatalf("expected TLS dial verified against the IP SAN, got %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestDialHubMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	hubCert, caPath := testCertificate(t, dir, "hub.test")
+	_, clientCertPath := testCertificate(t, dir, "worker.test")
+	clientPEM, err := os.ReadFile(clientCertPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{hubCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if conn.(*tls.Conn).Handshake() == nil {
+				_, _ = conn.Write([]byte("OK\n"))
+			}
+			_ = conn.Close()
+		}
+	}()
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	exchange := func(extra ...string) error {
+		args := append([]string{"--hub-port", port, "--mode", "socks",
+			"--tls", "--tls-ca", caPath, "--tls-server-name", "hub.test"}, extra...)
+		opts, err := ParseArgs(args)
+		if err != nil {
+			t.Fatalf("ParseArgs error: %v", err)
+		}
+		s := NewSupervisor(*opts)
+		if err := s.connectLink(s.link(), nil); err != nil {
+			t.Fatalf("connectLink error: %v", err)
+		}
+		conn, err := s.dialHub(context.Background(), s.link())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 3))
+		return classifyTLSError(err)
+	}
+
+	if err := exchange("--tls-cert", clientCertPath, "--tls-key", filepath.Join(dir, "worker.test.key")); err != nil {
+		t.Fatalf("expected mutual TLS exchange to succeed, got %v", err)
+	}
+	err = exchange()
+	var certErr *certificateError
+	if !errors.As(err, &certErr) {
+		t.Fatalf("expected certificate error without client cert, got %v", err)
+	}
+
+	s := NewSupervisor(Options{RetryDelay: time.Second})
+	failures := 0
+	if d := s.retryDelay(err, &failures); d != time.Second {
+		t.Fatalf("first certificate retry delay %v", d)
+	}
+	if d := s.retryDelay(err, &failures); d != 2*time.Second {
+		t.Fatalf("second certificate retry delay %v", d)
+	}
+	if d := s.retryDelay(io.EOF, &failures); d != time.Second || failures != 0 {
+		t.Fatalf("non-certificate error should reset backoff, got %v after %d failures", d, failures)
+	}
+}
+
+func TestParseArgsTLSFlagsRequireTLS(t *testing.T) {
+	if _, err := ParseArgs([]string{"--hub-port", "5555", "--mode", "socks", "--tls-insecure"}); err == nil {
+		t.Fatalf("expected --tls-insecure without --tls to be rejected")
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	dir := t.TempDir()
+	cert, caPath := testCertificate(t, dir, "hub.test")
+	ln, err := transport.ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	target := pooltest.NewTarget(t)
+	result := make(chan error, 1)
+	go func() {
+		// A fake hub: register the worker and bridge one CONNECT.
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if hello, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(hello, "HELLO 2 socks") {
+			result <- fmt.Errorf("HELLO %q, %v", hello, err)
+			return
+		}
+		fmt.Fprintf(conn, "OK\n")
+		frames := NewFrameConn(conn, r)
+		frames.WriteControl(fmt.Sprintf("REQUEST CONNECT ipv4 %s %d 1", target.Host(), target.Port()))
+		if reply, err := frames.ReadControl(); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+			result <- fmt.Errorf("REPLY %q, %v", reply, err)
+			return
+		}
+		io.WriteString(frames, "over quic")
+		frames.CloseWrite()
+		got, err := io.ReadAll(frames)
+		if err == nil && string(got) != "over quic" {
+			err = fmt.Errorf("stream returned %q", got)
+		}
+		result <- err
+	}()
+
+	opts, err := ParseArgs([]string{"-p", strconv.Itoa(ln.Addr().(*net.UDPAddr).Port), "-m", "socks", "-w", "1",
+		"--transport", "quic", "--tls-ca", caPath, "--tls-server-name", "hub.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSupervisor(*opts)
+	s.logger = log.New(io.Discard, "", 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go s.Run(ctx)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-ctx.Done():
+		t.Fatal("no bridged stream over QUIC")
+	}
+
+	for _, args := range [][]string{
+		{"--transport", "quic", "--tls"},
+		{"--transport", "quic", "--via-ssh", "ops@jump"},
+		{"--transport", "sctp"},
+	} {
+		if _, err := ParseArgs(append([]string{"-p", "5555", "-m", "socks"}, args...)); err == nil {
+			t.Errorf("accepted %q", args)
+		}
+	}
+}
+
+// countingDials counts the sessions the "counting" test transport dials.
+var countingDials atomic.Int32
+
+func init() {
+	transport.Register("counting", func(cfg transport.Config) (transport.Transport, error) {
+		return transport.Func(func(ctx context.Context) (net.Conn, error) {
+			countingDials.Add(1)
+			return cfg.Dial(ctx)
+		}), nil
+	})
+}
+
+func TestRegisteredTransport(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	opts, err := ParseArgs([]string{"-p", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port), "-m", "socks", "--transport", "counting"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSupervisor(*opts)
+	if err := s.connectLink(s.link(), nil); err != nil {
+		t.Fatalf("connectLink: %v", err)
+	}
+	before := countingDials.Load()
+	conn, err := s.dialHub(context.Background(), s.link())
+	if err != nil {
+		t.Fatalf("dialHub: %v", err)
+	}
+	conn.Close()
+	if countingDials.Load() != before+1 {
+		t.Fatalf("the registered transport did not dial")
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--transport", "pigeon"}); err == nil || !strings.Contains(err.Error(), "counting, quic, tcp") {
+		t.Fatalf("unknown transport: %v", err)
+	}
+}
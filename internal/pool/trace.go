@@ -0,0 +1,107 @@
+package pool
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName identifies poolgo's spans in exported traces.
+const tracerName = "contun/internal/pool"
+
+// noopTracer is used until --otlp-endpoint installs an exporter.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// startTracing exports spans to --otlp-endpoint over OTLP/HTTP. The
+// returned function flushes spans still queued and stops the exporter.
+func (s *Supervisor) startTracing(ctx context.Context) (func(), error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(s.opts.OTLPEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("service.name", "poolgo"),
+		attribute.String("service.version", BuildVersion()),
+	}
+	keys := make([]string, 0, len(s.opts.Labels))
+	for k := range s.opts.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		attrs = append(attrs, attribute.String("contun.label."+k, s.opts.Labels[k]))
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attrs...)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(s.opts.TraceSample))),
+	)
+	s.tracer = provider.Tracer(tracerName)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			s.logger.Printf("failed to flush traces: %v", err)
+		}
+	}, nil
+}
+
+// endSpan records err, if any, on span, ends it and returns err.
+func endSpan(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// requestTrace follows one request from the hub: a "request" span covering
+// it from the REQUEST line until it is answered or its bridge ends, with
+// children for the stages where time goes. A nil *requestTrace does
+// nothing.
+type requestTrace struct {
+	tracer trace.Tracer
+	ctx    context.Context
+	span   trace.Span
+}
+
+func (s *Supervisor) traceRequest(ctx context.Context) *requestTrace {
+	ctx, span := s.tracer.Start(ctx, "request")
+	return &requestTrace{tracer: s.tracer, ctx: ctx, span: span}
+}
+
+// describe attaches the parsed request, and its --alias name if it has
+// one, to the root span.
+func (t *requestTrace) describe(req *Request, alias string) {
+	t.span.SetAttributes(
+		attribute.String("contun.session", req.SessionID),
+		attribute.String("contun.affinity", req.Affinity),
+		attribute.String("contun.command", req.Command),
+		attribute.String("contun.target.host", req.Address),
+		attribute.Int("contun.target.port", req.Port),
+	)
+	if alias != "" {
+		t.span.SetAttributes(attribute.String("contun.target.alias", alias))
+	}
+}
+
+// stage starts a child span.
+func (t *requestTrace) stage(name string) trace.Span {
+	_, span := t.tracer.Start(t.ctx, name)
+	return span
+}
+
+func (t *requestTrace) end() {
+	if t != nil {
+		t.span.End()
+	}
+}
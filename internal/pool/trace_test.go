@@ -0,0 +1,118 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceBridgedRequest(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		if c, err := target.Accept(); err == nil {
+			c.Write([]byte("hello"))
+			c.Close()
+		}
+	}()
+
+	recorder := tracetest.NewSpanRecorder()
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	s.tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracerName)
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	reader.ReadString('\n')
+	port := target.Addr().(*net.TCPAddr).Port
+	hub.Write([]byte("OK\nREQUEST CONNECT ipv4 127.0.0.1 " + strconv.Itoa(port) + " 9\n"))
+	if reply, _ := reader.ReadString('\n'); !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	hub.(*net.TCPConn).CloseWrite()
+	if got, _ := io.ReadAll(reader); string(got) != "hello" {
+		t.Fatalf("stream = %q", got)
+	}
+	hub.Close()
+	<-done
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"hub.handshake", "request", "request.parse", "target.dial", "bridge"} {
+		if spans[name] == nil {
+			t.Fatalf("no %s span among %v", name, recorder.Ended())
+		}
+	}
+	root := spans["request"].SpanContext().SpanID()
+	for _, name := range []string{"request.parse", "target.dial", "bridge"} {
+		if spans[name].Parent().SpanID() != root {
+			t.Fatalf("%s is not a child of the request span", name)
+		}
+	}
+	attrs := map[string]string{}
+	for _, kv := range append(spans["request"].Attributes(), spans["bridge"].Attributes()...) {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["contun.session"] != "9" || attrs["contun.target.port"] != strconv.Itoa(port) ||
+		attrs["contun.bytes_in"] != "5" || attrs["contun.reason"] != string(endTargetClosed) {
+		t.Fatalf("attributes %v", attrs)
+	}
+}
+
+func TestTraceExport(t *testing.T) {
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			exports.Add(1)
+		}
+	}))
+	defer collector.Close()
+
+	s := NewSupervisor(Options{OTLPEndpoint: collector.URL + "/v1/traces", TraceSample: 1})
+	s.logger = log.New(io.Discard, "", 0)
+	stop, err := s.startTracing(context.Background())
+	if err != nil {
+		t.Fatalf("startTracing: %v", err)
+	}
+	s.traceRequest(context.Background()).end()
+	stop()
+	if exports.Load() == 0 {
+		t.Fatal("no spans reached the collector")
+	}
+}
+
+func TestParseArgsTracing(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--otlp-endpoint", "http://collector:4318", "--trace-sample", "0.1"})
+	if err != nil || opts.TraceSample != 0.1 || !strings.Contains(opts.Features(), "otlp") {
+		t.Fatalf("ParseArgs: %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{
+		{"--otlp-endpoint", "collector:4318"},
+		{"--trace-sample", "2"},
+	} {
+		if _, err := ParseArgs(append([]string{"-p", "5555", "-m", "socks"}, args...)); err == nil {
+			t.Fatalf("accepted %q", args)
+		}
+	}
+}
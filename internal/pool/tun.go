@@ -0,0 +1,128 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// maxPacket bounds the IP packets read from the TUN device. It matches the
+// largest datagram frame so every packet fits in one frame.
+const maxPacket = MaxDatagram
+
+// After REPLY 0 to REQUEST TUN the hub connection carries raw IP packets,
+// one per datagram frame (a 2-byte big-endian length and the packet), in
+// both directions. The worker writes packets from the hub to the --tun
+// device and frames everything the kernel routes into the device back.
+
+// relayPackets copies packets between the hub and dev until the hub
+// finishes sending, the context is cancelled or either side fails. dev is
+// closed on return.
+func relayPackets(ctx context.Context, hub net.Conn, dev io.ReadWriteCloser, counts *udpCounts) (endReason, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = hub.Close()
+			_ = dev.Close()
+		case <-done:
+		}
+	}()
+
+	fromDevice := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxPacket)
+		for {
+			n, err := dev.Read(buf)
+			if err != nil {
+				fromDevice <- err
+				return
+			}
+			if err := WriteDatagram(hub, buf[:n]); err != nil {
+				fromDevice <- err
+				return
+			}
+			counts.in.Add(1)
+		}
+	}()
+
+	buf := make([]byte, MaxDatagram)
+	var relayErr error
+	for {
+		packet, err := ReadDatagram(hub, buf)
+		if err != nil {
+			relayErr = err
+			break
+		}
+		if len(packet) == 0 || (packet[0]>>4 != 4 && packet[0]>>4 != 6) {
+			continue
+		}
+		// The kernel rejects packets it cannot route; that only loses the
+		// packet, as it would on a real link.
+		if _, err := dev.Write(packet); err == nil {
+			counts.out.Add(1)
+		}
+	}
+
+	_ = dev.Close()
+	devErr := <-fromDevice
+	if hc, ok := hub.(interface{ CloseWrite() error }); ok {
+		_ = hc.CloseWrite()
+	}
+	reason := bridgeEnd(ctx, true, relayErr)
+	if errors.Is(devErr, io.EOF) || errors.Is(devErr, net.ErrClosed) || errors.Is(devErr, os.ErrClosed) {
+		devErr = nil
+	}
+	if err := relayErr; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return reason, err
+	}
+	return reason, devErr
+}
+
+// tunnel answers a REQUEST TUN by attaching to the --tun device and
+// relaying packets until the hub ends the session. Only one hub session
+// can own the device at a time. It returns an error only when the hub
+// session is unusable.
+func (s *Supervisor) tunnel(ctx context.Context, hub net.Conn, writer *controlWriter, req *Request, logger *log.Logger) error {
+	if !s.tunBusy.CompareAndSwap(false, true) {
+		logger.Printf("refusing TUN session: %s is in use by another worker", s.opts.TUN)
+		return sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0)
+	}
+	defer s.tunBusy.Store(false)
+
+	started := time.Now()
+	dev, err := OpenTUN(s.opts.TUN)
+	if err != nil {
+		logger.Printf("cannot open TUN device %s: %v", s.opts.TUN, err)
+		s.audit.RecordSampled("session", map[string]any{
+			"dest": req.Address, "outcome": "tun_failed", "status": 1,
+		})
+		return sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0)
+	}
+	if err := sendReply(writer, 0, AddrIPv4, "0.0.0.0", 0); err != nil {
+		_ = dev.Close()
+		return err
+	}
+	logger.Printf("relaying IP packets through %s (hub peer %s)", s.opts.TUN, req.Address)
+
+	s.active.Add(1)
+	var counts udpCounts
+	reason, err := relayPackets(ctx, hub, dev, &counts)
+	s.active.Add(-1)
+	if err != nil {
+		logger.Printf("TUN session ended (%s): %v", reason, err)
+	} else {
+		logger.Printf("TUN session ended: %s", reason)
+	}
+	s.audit.RecordSampled("session", map[string]any{
+		"dest": req.Address, "outcome": "tunnelled", "reason": string(reason),
+		"packets_out": counts.out.Load(), "packets_in": counts.in.Load(),
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
+	return nil
+}
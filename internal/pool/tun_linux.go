@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// TUNSupported reports whether --tun is available on this platform.
+const TUNSupported = true
+
+// OpenTUN attaches to the TUN interface name, creating it if it does not
+// exist yet. Creating an interface needs CAP_NET_ADMIN; attaching to one
+// made with "ip tuntap add ... user <user>" does not.
+func OpenTUN(name string) (io.ReadWriteCloser, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %q too long", name)
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], name)
+	ifr.flags = syscall.IFF_TUN | syscall.IFF_NO_PI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("attach to %s: %w", name, errno)
+	}
+	// A non-blocking descriptor lets the runtime poller wake a blocked Read
+	// when the device is closed.
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
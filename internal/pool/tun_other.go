@@ -0,0 +1,16 @@
+//go:build !linux
+
+package pool
+
+import (
+	"errors"
+	"io"
+)
+
+// TUNSupported reports whether --tun is available on this platform.
+const TUNSupported = false
+
+// OpenTUN fails: TUN devices are only available on Linux.
+func OpenTUN(name string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN devices are only supported on Linux")
+}
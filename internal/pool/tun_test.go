@@ -0,0 +1,124 @@
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeTUN stands in for a TUN device: packets written by the relay arrive
+// on written, and packets sent on routed are read back as kernel output.
+type fakeTUN struct {
+	written chan []byte
+	routed  chan []byte
+	closed  chan struct{}
+}
+
+func newFakeTUN() *fakeTUN {
+	return &fakeTUN{written: make(chan []byte, 4), routed: make(chan []byte, 4), closed: make(chan struct{})}
+}
+
+func (d *fakeTUN) Read(p []byte) (int, error) {
+	select {
+	case packet := <-d.routed:
+		return copy(p, packet), nil
+	case <-d.closed:
+		return 0, os.ErrClosed
+	}
+}
+
+func (d *fakeTUN) Write(p []byte) (int, error) {
+	d.written <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (d *fakeTUN) Close() error {
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+	return nil
+}
+
+func TestRelayPackets(t *testing.T) {
+	worker, hub := tcpPair(t)
+	dev := newFakeTUN()
+	var counts udpCounts
+	done := make(chan error, 1)
+	go func() {
+		_, err := relayPackets(context.Background(), worker, dev, &counts)
+		done <- err
+	}()
+
+	ipv4 := append([]byte{0x45}, bytes.Repeat([]byte{0}, 19)...)
+	WriteDatagram(hub, []byte{0x00, 1, 2})
+	WriteDatagram(hub, ipv4)
+	select {
+	case got := <-dev.written:
+		if !bytes.Equal(got, ipv4) {
+			t.Fatalf("device got %x, want the IPv4 packet", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("packet did not reach the device")
+	}
+
+	ipv6 := append([]byte{0x60}, bytes.Repeat([]byte{0}, 39)...)
+	dev.routed <- ipv6
+	hub.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(hub)
+	if got, err := ReadDatagram(reader, make([]byte, MaxDatagram)); err != nil || !bytes.Equal(got, ipv6) {
+		t.Fatalf("hub got %x (%v), want the IPv6 packet", got, err)
+	}
+
+	hub.(*net.TCPConn).CloseWrite()
+	if err := <-done; err != nil {
+		t.Fatalf("relayPackets: %v", err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("relay did not end the hub stream: %v", err)
+	}
+	if counts.out.Load() != 1 || counts.in.Load() != 1 {
+		t.Fatalf("counted %d out, %d in; want 1 each", counts.out.Load(), counts.in.Load())
+	}
+}
+
+func TestParseArgsTUN(t *testing.T) {
+	if !TUNSupported {
+		t.Skip("TUN devices are not supported on this platform")
+	}
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--tun", "contun0"})
+	if err != nil || opts.TUN != "contun0" {
+		t.Fatalf("ParseArgs = %+v, %v", opts, err)
+	}
+	if _, err := ParseArgs([]string{"-p", "5555", "-t", "10.0.0.1", "-T", "22", "--tun", "contun0"}); err == nil {
+		t.Fatal("expected --tun to require socks mode")
+	}
+}
+
+func TestOpenTUNCloseUnblocksRead(t *testing.T) {
+	dev, err := OpenTUN("contuntest0")
+	if err != nil {
+		t.Skipf("cannot create a TUN device here: %v", err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := dev.Read(make([]byte, maxPacket))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dev.Close()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Fatalf("Read returned no error after Close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close did not unblock Read")
+	}
+}
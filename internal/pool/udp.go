@@ -0,0 +1,283 @@
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request commands. CONNECT opens a TCP stream; ASSOCIATE relays UDP
+// datagrams for a SOCKS5 UDP ASSOCIATE client; TUN relays raw IP packets
+// through the worker's --tun device; PING only measures the round trip to
+// a host and SCAN tries to connect to a batch of its ports, both leaving
+// the worker idle.
+const (
+	CommandConnect   = "CONNECT"
+	CommandAssociate = "ASSOCIATE"
+	CommandTUN       = "TUN"
+	CommandPing      = "PING"
+	CommandScan      = "SCAN"
+)
+
+// MaxDatagram is the largest datagram frame body.
+const MaxDatagram = 0xFFFF
+
+// maxUDPPeers bounds the remote addresses one association remembers, and
+// so accepts replies from.
+const maxUDPPeers = 1024
+
+// After REPLY 0 to REQUEST ASSOCIATE the hub connection carries datagram
+// frames instead of a byte stream. Each frame is a 2-byte big-endian length
+// followed by a SOCKS5 UDP request header without RSV and FRAG (ATYP,
+// DST.ADDR, DST.PORT) and the payload. Frames from the hub name the
+// destination; frames from the worker name the source of a reply.
+
+// ReadDatagram reads one frame body into buf, which must hold MaxDatagram
+// bytes, and returns it.
+func ReadDatagram(r io.Reader, buf []byte) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(head[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// WriteDatagram writes body as one frame with a single Write call.
+func WriteDatagram(w io.Writer, body []byte) error {
+	if len(body) > MaxDatagram {
+		return fmt.Errorf("datagram of %d bytes too large", len(body))
+	}
+	frame := make([]byte, 2, 2+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+// ParseDatagram splits a frame body into its address and payload.
+func ParseDatagram(body []byte) (AddrType, string, int, []byte, error) {
+	if len(body) < 1 {
+		return "", "", 0, nil, errors.New("empty datagram")
+	}
+	var atype AddrType
+	var host string
+	rest := body[1:]
+	switch body[0] {
+	case 1:
+		if len(rest) < 4 {
+			return "", "", 0, nil, errors.New("short ipv4 datagram header")
+		}
+		atype, host, rest = AddrIPv4, net.IP(rest[:4]).String(), rest[4:]
+	case 3:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) || rest[0] == 0 {
+			return "", "", 0, nil, errors.New("short domain datagram header")
+		}
+		atype, host, rest = AddrDomain, string(rest[1:1+rest[0]]), rest[1+rest[0]:]
+	case 4:
+		if len(rest) < 16 {
+			return "", "", 0, nil, errors.New("short ipv6 datagram header")
+		}
+		atype, host, rest = AddrIPv6, net.IP(rest[:16]).String(), rest[16:]
+	default:
+		return "", "", 0, nil, fmt.Errorf("unknown datagram address type %d", body[0])
+	}
+	if len(rest) < 2 {
+		return "", "", 0, nil, errors.New("short datagram header")
+	}
+	return atype, host, int(binary.BigEndian.Uint16(rest)), rest[2:], nil
+}
+
+// AppendDatagram appends a frame body naming addr to dst.
+func AppendDatagram(dst []byte, addr netip.AddrPort, payload []byte) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		dst = append(dst, 1)
+	} else {
+		dst = append(dst, 4)
+	}
+	dst = append(dst, ip.AsSlice()...)
+	dst = binary.BigEndian.AppendUint16(dst, addr.Port())
+	return append(dst, payload...)
+}
+
+// udpCounts tallies datagrams relayed for one association.
+type udpCounts struct {
+	out, in atomic.Int64
+}
+
+// relayUDP serves a UDP association: frames from the hub are sent from a
+// fresh UDP socket, and replies from addresses the client has sent to are
+// framed back to the hub. It ends when the hub finishes sending, when the
+// context is cancelled or on error.
+func (s *Supervisor) relayUDP(ctx context.Context, hub net.Conn, pc net.PacketConn, counts *udpCounts) (endReason, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = hub.Close()
+			_ = pc.Close()
+		case <-done:
+		}
+	}()
+
+	var mu sync.Mutex
+	peers := make(map[netip.AddrPort]bool)
+	resolved := make(map[string]netip.AddrPort)
+
+	replies := make(chan error, 1)
+	go func() {
+		buf := make([]byte, MaxDatagram)
+		var frame []byte
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				replies <- err
+				return
+			}
+			addr := from.(*net.UDPAddr).AddrPort()
+			addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+			mu.Lock()
+			known := peers[addr]
+			mu.Unlock()
+			if !known {
+				continue
+			}
+			frame = AppendDatagram(frame[:0], addr, buf[:n])
+			if len(frame) > MaxDatagram {
+				continue
+			}
+			if err := WriteDatagram(hub, frame); err != nil {
+				replies <- err
+				return
+			}
+			counts.in.Add(1)
+		}
+	}()
+
+	buf := make([]byte, MaxDatagram)
+	var relayErr error
+	for {
+		body, err := ReadDatagram(hub, buf)
+		if err != nil {
+			relayErr = err
+			break
+		}
+		atype, host, port, payload, err := ParseDatagram(body)
+		if err != nil || port == 0 {
+			continue
+		}
+		key := net.JoinHostPort(host, strconv.Itoa(port))
+		addr, ok := resolved[key]
+		if !ok {
+			if err := validateRequestAddress(&Request{AddrType: atype, Address: host, Port: port}); err != nil {
+				continue
+			}
+			udpAddr, err := resolveUDP(ctx, s.resolver(), key)
+			if err != nil {
+				s.logger.Printf("udp: cannot resolve %s: %v", key, err)
+				continue
+			}
+			addr = udpAddr.AddrPort()
+			if len(resolved) < maxUDPPeers {
+				resolved[key] = addr
+			}
+		}
+		mu.Lock()
+		if len(peers) < maxUDPPeers {
+			peers[addr] = true
+		}
+		mu.Unlock()
+		if _, err := pc.WriteTo(payload, net.UDPAddrFromAddrPort(addr)); err == nil {
+			counts.out.Add(1)
+		}
+	}
+
+	_ = pc.Close()
+	replyErr := <-replies
+	if hc, ok := hub.(interface{ CloseWrite() error }); ok {
+		_ = hc.CloseWrite()
+	}
+	reason := bridgeEnd(ctx, true, relayErr)
+	if errors.Is(replyErr, net.ErrClosed) {
+		replyErr = nil
+	}
+	if err := relayErr; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		return reason, err
+	}
+	return reason, replyErr
+}
+
+func resolveUDP(ctx context.Context, resolver *net.Resolver, address string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	ip := ips[0].Unmap()
+	for _, candidate := range ips {
+		if candidate.Unmap().Is4() {
+			ip = candidate.Unmap()
+			break
+		}
+	}
+	p, _ := strconv.Atoi(port)
+	return net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(p))), nil
+}
+
+// associate answers a REQUEST ASSOCIATE and relays datagrams until the
+// association ends. It returns an error only when the hub session is
+// unusable.
+func (s *Supervisor) associate(ctx context.Context, hub net.Conn, writer *controlWriter, req *Request, logger *log.Logger) error {
+	started := time.Now()
+	pc, err := s.listenTargetPacket(ctx)
+	if err != nil {
+		logger.Printf("udp association failed: %v", err)
+		s.audit.RecordSampled("session", map[string]any{
+			"dest": req.Address, "port": req.Port, "outcome": "associate_failed", "status": 1,
+		})
+		return sendReply(writer, 1, AddrIPv4, "0.0.0.0", 0)
+	}
+	local := pc.LocalAddr().(*net.UDPAddr)
+	if err := sendReply(writer, 0, AddrIPv4, "0.0.0.0", local.Port); err != nil {
+		_ = pc.Close()
+		return err
+	}
+	logger.Printf("relaying UDP on port %d", local.Port)
+
+	s.active.Add(1)
+	var counts udpCounts
+	reason, err := s.relayUDP(ctx, hub, pc, &counts)
+	s.active.Add(-1)
+	if err != nil {
+		logger.Printf("udp association ended (%s): %v", reason, err)
+	} else {
+		logger.Printf("udp association ended: %s", reason)
+	}
+	s.audit.RecordSampled("session", map[string]any{
+		"dest": req.Address, "port": req.Port, "outcome": "associated", "reason": string(reason),
+		"datagrams_out": counts.out.Load(), "datagrams_in": counts.in.Load(),
+		"duration_ms": time.Since(started).Milliseconds(),
+	})
+	return nil
+}
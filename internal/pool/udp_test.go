@@ -0,0 +1,83 @@
+package pool
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHubSessionUDPAssociate(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen udp: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+
+	s := NewSupervisor(Options{Mode: ModeSocks, Protocol: 1})
+	worker, hub := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.handleHubSession(context.Background(), context.Background(), s.link(), nil, worker, log.New(io.Discard, "", 0))
+	}()
+
+	hub.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(hub)
+	if line, _ := reader.ReadString('\n'); !strings.Contains(line, "udp") {
+		t.Fatalf("socks HELLO did not advertise udp: %q", line)
+	}
+	hub.Write([]byte("OK CAPS cancel,udp\nREQUEST ASSOCIATE ipv4 0.0.0.0 0 7\n"))
+	if reply, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "REPLY 0 ") {
+		t.Fatalf("unexpected reply %q: %v", reply, err)
+	}
+
+	target := echo.LocalAddr().(*net.UDPAddr).AddrPort()
+	if err := WriteDatagram(hub, AppendDatagram(nil, target, []byte("ping"))); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+	body, err := ReadDatagram(reader, make([]byte, MaxDatagram))
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	atype, host, port, payload, err := ParseDatagram(body)
+	if err != nil || atype != AddrIPv4 || netip.MustParseAddr(host) != target.Addr() || port != int(target.Port()) || string(payload) != "echo ping" {
+		t.Fatalf("unexpected reply datagram %s %s:%d %q (%v)", atype, host, port, payload, err)
+	}
+
+	hub.(*net.TCPConn).CloseWrite()
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("worker did not end the association: %v", err)
+	}
+	hub.Close()
+	<-done
+}
+
+func TestParseDatagram(t *testing.T) {
+	body := []byte{3, 11}
+	body = append(body, "example.com"...)
+	body = append(body, 0, 53, 'q')
+	atype, host, port, payload, err := ParseDatagram(body)
+	if err != nil || atype != AddrDomain || host != "example.com" || port != 53 || string(payload) != "q" {
+		t.Fatalf("ParseDatagram = %s %s %d %q %v", atype, host, port, payload, err)
+	}
+	for _, bad := range [][]byte{nil, {1, 127, 0}, {3, 0, 0, 53}, {9, 0, 0}} {
+		if _, _, _, _, err := ParseDatagram(bad); err == nil {
+			t.Fatalf("ParseDatagram(%v) accepted", bad)
+		}
+	}
+}
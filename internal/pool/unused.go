@@ -0,0 +1,56 @@
+package pool
+
+import (
+	"fmt"
+	"slices"
+)
+
+// unusedFlags lists flags that only qualify another option or one mode:
+// set on their own they parse fine and do nothing, which is how a typo or
+// a leftover in a shared config file usually goes unnoticed. unused says
+// whether o ignores the flag and why.
+var unusedFlags = []struct {
+	flag   string
+	unused func(o *Options) (string, bool)
+}{
+	{"allow", socksOnly},
+	{"deny", socksOnly},
+	{"acl-file", socksOnly},
+	{"deny-private-resolved", socksOnly},
+	{"scan-concurrency", socksOnly},
+	{"target-dns-ttl", func(o *Options) (string, bool) { return "in socks mode", o.Mode != ModeDirect }},
+	{"min-workers", func(o *Options) (string, bool) { return "without --max-workers", o.MaxWorkers == 0 }},
+	{"scale-down-after", func(o *Options) (string, bool) { return "without --max-workers", o.MaxWorkers == 0 }},
+	{"queue-timeout", func(o *Options) (string, bool) { return "without --max-sessions", o.MaxSessions == 0 }},
+	{"auth-mode", func(o *Options) (string, bool) { return "without --auth-token-file", o.AuthTokenFile == "" }},
+	{"redact-mode", func(o *Options) (string, bool) { return "without --redact", len(o.Redact) == 0 }},
+	{"audit-format", func(o *Options) (string, bool) { return "without --audit-log", o.AuditLog == "" }},
+	{"audit-sample", func(o *Options) (string, bool) { return "without --audit-log", o.AuditLog == "" }},
+	{"session-log-format", func(o *Options) (string, bool) { return "without --session-log", o.SessionLog == "" }},
+	{"tamper-interval", func(o *Options) (string, bool) { return "without --tamper-notice", !o.TamperNotice }},
+	{"inbound-limit-action", func(o *Options) (string, bool) { return "without --inbound-limit", o.InboundLimit == 0 }},
+	{"trace-sample", func(o *Options) (string, bool) { return "without --otlp-endpoint", o.OTLPEndpoint == "" }},
+	{"heartbeat-timeout", func(o *Options) (string, bool) { return "with --heartbeat 0", o.HeartbeatInterval == 0 }},
+	{"tcp-keepalive-interval", func(o *Options) (string, bool) { return "with --tcp-keepalive 0", o.KeepAlive < 0 }},
+}
+
+// socksOnly also lets constrained direct-mode pools, those given
+// --target-pattern, use the flag: they serve many destinations too.
+func socksOnly(o *Options) (string, bool) {
+	return "in direct mode", o.Mode == ModeDirect && len(o.TargetPatterns) == 0
+}
+
+// UnusedFlags returns a warning for each flag the command line or the
+// --config file set that the rest of the options leave without effect.
+func (o *Options) UnusedFlags() []string {
+	var warnings []string
+	for _, u := range unusedFlags {
+		if !slices.Contains(o.Sources.Args, u.flag) && !slices.Contains(o.Sources.File, u.flag) {
+			continue
+		}
+		if why, unused := u.unused(o); unused {
+			warnings = append(warnings, fmt.Sprintf("--%s has no effect %s", u.flag, why))
+		}
+	}
+	return warnings
+}
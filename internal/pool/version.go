@@ -0,0 +1,96 @@
+package pool
+
+import (
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Version is the poolgo build version. Release builds set it with
+// -ldflags "-X contun/internal/pool.Version=<version>".
+var Version = ""
+
+// ProtocolVersion is the highest hub control protocol version spoken.
+const ProtocolVersion = 2
+
+// BuildVersion returns Version, falling back to the VCS revision embedded by
+// the Go toolchain and finally to "dev".
+func BuildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v := info.Main.Version; v != "" && v != "(devel)" {
+			return v
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				return "dev-" + setting.Value[:12]
+			}
+		}
+	}
+	return "dev"
+}
+
+// Features lists the optional behaviours enabled by the options, sorted and
+// comma-separated, or "none".
+func (o Options) Features() string {
+	var features []string
+	add := func(enabled bool, name string) {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	add(o.TLS, "tls")
+	add(o.TLSCertFile != "", "mtls")
+	add(o.NoiseHubKeyFile != "", "noise")
+	add(o.ViaSSH != "", "ssh")
+	add(!o.ExpireAt.IsZero() || o.MaxRuntime > 0, "expiry")
+	add(o.ShutdownKey != nil, "shutdown")
+	add(o.AuditLog != "", "audit")
+	add(o.SessionLog != "", "session-log")
+	add(o.AdminSocket != "", "admin")
+	add(o.AuthToken != nil, "auth")
+	add(o.TamperNotice, "tamper")
+	add(o.StatsInterval > 0, "stats")
+	add(o.FlowControl, "flow-control")
+	add(o.SoRcvBuf > 0 || o.SoSndBuf > 0, "sockbuf")
+	add(o.TargetMSS > 0, "mss")
+	add(o.VRF != "", "vrf")
+	add(o.BindAddress.IsValid() || o.BindInterface != "", "bind")
+	add(o.DNSServer != "", "dns-server")
+	add(o.TargetDNSTTL > 0, "target-dns-ttl")
+	add(len(o.Exposes) > 0, "expose")
+	add(len(o.TargetPatterns) > 0, "target-pattern")
+	add(o.UpstreamProxy != "", "upstream-proxy")
+	add(o.SendProxyProtocol != "", "proxy-protocol")
+	add(o.HubProxy != "", "hub-proxy")
+	add(o.HubURL != "", "websocket")
+	add(o.Transport == transportQUIC, "quic")
+	add(o.ContainerAPI != "", "container-api")
+	add(o.Kubeconfig != "", "k8s")
+	add(len(o.SourceRules) > 0, "source-rule")
+	add(len(o.NetnsRules) > 0, "netns-rule")
+	add(o.TUN != "", "tun")
+	add(o.Compress != "", "compress")
+	add(o.InboundLimit > 0, "inbound-limit")
+	add(len(o.AlertPatterns) > 0, "alert-pattern")
+	add(o.Hook != nil, "hook")
+	add(len(o.Allow) > 0 || len(o.Deny) > 0, "acl")
+	add(o.DenyPrivate, "deny-private-resolved")
+	add(len(o.Plugins) > 0, "plugin")
+	add(o.MaxWorkers > 0, "autoscale")
+	add(len(o.Redact) > 0, "redact")
+	add(o.RateLimit > 0 || o.PoolRateLimit > 0, "rate-limit")
+	add(o.MaxSessions > 0, "max-sessions")
+	add(o.MaxLoad > 0 || o.MaxCPU > 0, "load-admission")
+	add(o.StallTimeout > 0, "stall-timeout")
+	add(o.IdleTimeout > 0, "idle-timeout")
+	add(o.SimulateLatency > 0, "simulate-latency")
+	add(o.OTLPEndpoint != "", "otlp")
+	if len(features) == 0 {
+		return "none"
+	}
+	sort.Strings(features)
+	return strings.Join(features, ",")
+}
@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// maxVRFName is the longest interface name Linux accepts (IFNAMSIZ less
+// the terminating NUL).
+const maxVRFName = 15
+
+// targetDevice returns the device target sockets are bound to, the --vrf
+// or --bind-interface one, and the flag that named it.
+func (o *Options) targetDevice() (flag, name string) {
+	if o.VRF != "" {
+		return "--vrf", o.VRF
+	}
+	if o.BindInterface != "" {
+		return "--bind-interface", o.BindInterface
+	}
+	return "", ""
+}
+
+// bindDevice binds the socket behind c to the target device. For a --vrf
+// device its route lookups then use that VRF's table instead of the main
+// one; for a --bind-interface device it only leaves through that NIC.
+func (s *Supervisor) bindDevice(c syscall.RawConn) error {
+	flag, device := s.opts.targetDevice()
+	var opErr error
+	if err := c.Control(func(fd uintptr) { opErr = bindToDevice(fd, device) }); err != nil {
+		return err
+	}
+	if opErr != nil {
+		return fmt.Errorf("bind to %s %s: %w", flag, device, opErr)
+	}
+	return nil
+}
+
+// targetDialer returns the dialer for connections to targets: s.dialer,
+// resolving names with --dns-server, leaving from --bind-address and bound
+// to the --vrf or --bind-interface device when they are set. The hub
+// connection keeps using s.dialer, which stays in the management plane.
+func (s *Supervisor) targetDialer() net.Dialer {
+	dialer := s.dialer
+	dialer.Resolver = s.link().resolver
+	if s.opts.BindAddress.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: s.opts.BindAddress.AsSlice()}
+	}
+	if _, device := s.opts.targetDevice(); device == "" {
+		return dialer
+	}
+	next := dialer.ControlContext
+	dialer.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		if err := s.bindDevice(c); err != nil {
+			return err
+		}
+		if next != nil {
+			return next(ctx, network, address, c)
+		}
+		return nil
+	}
+	return dialer
+}
+
+// listenTargetPacket opens the UDP socket an association relays through,
+// on --bind-address and bound to the target device like target
+// connections.
+func (s *Supervisor) listenTargetPacket(ctx context.Context) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	if _, device := s.opts.targetDevice(); device != "" {
+		lc.Control = func(_, _ string, c syscall.RawConn) error { return s.bindDevice(c) }
+	}
+	address := ":0"
+	if s.opts.BindAddress.IsValid() {
+		address = net.JoinHostPort(s.opts.BindAddress.String(), "0")
+	}
+	return lc.ListenPacket(ctx, "udp", address)
+}
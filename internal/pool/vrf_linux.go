@@ -0,0 +1,9 @@
+package pool
+
+import "syscall"
+
+const vrfSupported = true
+
+func bindToDevice(fd uintptr, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pool
+
+import "errors"
+
+const vrfSupported = false
+
+func bindToDevice(uintptr, string) error {
+	return errors.New("VRFs are only supported on Linux")
+}
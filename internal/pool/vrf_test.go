@@ -0,0 +1,100 @@
+//go:build linux
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestTargetVRF(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	req := &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}
+
+	s := NewSupervisor(Options{VRF: "lo"})
+	conn, err := s.dialTarget(context.Background(), req, nil)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device is not permitted here")
+	}
+	if err != nil {
+		t.Fatalf("dialTarget bound to lo: %v", err)
+	}
+	conn.Close()
+
+	s = NewSupervisor(Options{VRF: "contun-none0"})
+	if _, err := s.dialTarget(context.Background(), req, nil); !errors.Is(err, syscall.ENODEV) {
+		t.Fatalf("dialTarget bound to a missing device: %v, want ENODEV", err)
+	}
+}
+
+func TestParseArgsVRF(t *testing.T) {
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--vrf", "vrf-data"})
+	if err != nil || opts.VRF != "vrf-data" {
+		t.Fatalf("--vrf vrf-data: %+v, %v", opts, err)
+	}
+	for _, name := range []string{"a-very-long-vrf-name", "vrf/data"} {
+		if _, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--vrf", name}); err == nil {
+			t.Errorf("ParseArgs accepted --vrf %q", name)
+		}
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	peers := make(chan net.Addr, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		peers <- c.RemoteAddr()
+		c.Close()
+	}()
+
+	opts, err := ParseArgs([]string{"-p", "5555", "-m", "socks", "--bind-address", "127.0.0.2", "--bind-interface", "lo"})
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	s := NewSupervisor(*opts)
+	conn, err := s.dialTarget(context.Background(), &Request{AddrType: AddrIPv4, Address: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port}, nil)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device is not permitted here")
+	}
+	if err != nil {
+		t.Fatalf("dialTarget: %v", err)
+	}
+	conn.Close()
+	if peer := (<-peers).(*net.TCPAddr); !peer.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("target saw the pool at %s, want 127.0.0.2", peer)
+	}
+
+	for _, args := range [][]string{
+		{"--bind-address", "lo"},
+		{"--bind-interface", "eth0", "--vrf", "vrf-data"},
+		{"--bind-interface", "a-very-long-interface-name"},
+	} {
+		if _, err := ParseArgs(append([]string{"-p", "5555", "-m", "socks"}, args...)); err == nil {
+			t.Errorf("ParseArgs accepted %q", args)
+		}
+	}
+}
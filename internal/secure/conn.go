@@ -0,0 +1,215 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// maxFrame is the largest Noise message (specification section 3).
+	maxFrame = 65535
+	// maxPayload is the plaintext carried by one full frame.
+	maxPayload = maxFrame - tagLen
+)
+
+// Prologue is the prologue poolgo and hubgo bind into every hub link
+// handshake.
+const Prologue = "contun noise 1"
+
+// Config describes one end of a secure channel.
+type Config struct {
+	// StaticKey is this end's long-term key.
+	StaticKey *ecdh.PrivateKey
+	// PeerKey is the responder's static public key. Initiators must set it;
+	// responders learn the initiator's key from the handshake.
+	PeerKey *ecdh.PublicKey
+	// Prologue binds out-of-band context into the handshake hash. Both ends
+	// must use the same value.
+	Prologue []byte
+}
+
+// Conn is a net.Conn whose payload travels in length-prefixed, AES-GCM
+// sealed frames. An empty frame marks the end of the peer's stream, which
+// lets CloseWrite half-close the channel like a TCP or TLS connection.
+type Conn struct {
+	net.Conn
+	peer *ecdh.PublicKey
+
+	readMu  sync.Mutex
+	recv    *cipherState
+	raw     []byte // bytes read from the wire but not yet a full frame
+	rbuf    []byte
+	plain   []byte // decrypted bytes not yet returned by Read
+	readEOF bool
+
+	writeMu sync.Mutex
+	send    *cipherState
+	wbuf    []byte
+}
+
+// Client runs the initiator side of the IK handshake over conn.
+func Client(conn net.Conn, cfg Config) (*Conn, error) {
+	if cfg.StaticKey == nil || cfg.PeerKey == nil {
+		return nil, fmt.Errorf("secure: client needs a static key and the peer key")
+	}
+	ss, e, msg, err := initiatorHello(cfg.StaticKey, cfg.PeerKey, cfg.Prologue, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{Conn: conn, peer: cfg.PeerKey}
+	if err := c.writeFrame(msg); err != nil {
+		return nil, err
+	}
+	reply, err := c.readFrame()
+	if err != nil {
+		return nil, handshakeError(err)
+	}
+	if c.send, c.recv, _, err = initiatorFinish(ss, cfg.StaticKey, e, reply); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Server runs the responder side of the IK handshake over conn. The
+// initiator's static key is available from PeerKey afterwards.
+func Server(conn net.Conn, cfg Config) (*Conn, error) {
+	if cfg.StaticKey == nil {
+		return nil, fmt.Errorf("secure: server needs a static key")
+	}
+	c := &Conn{Conn: conn}
+	msg, err := c.readFrame()
+	if err != nil {
+		return nil, handshakeError(err)
+	}
+	reply, send, recv, peer, _, err := responderHandshake(cfg.StaticKey, cfg.Prologue, msg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeFrame(reply); err != nil {
+		return nil, err
+	}
+	c.send, c.recv, c.peer = send, recv, peer
+	return c, nil
+}
+
+func handshakeError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("secure: peer closed during handshake: %w", io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// PeerKey returns the remote static public key.
+func (c *Conn) PeerKey() *ecdh.PublicKey { return c.peer }
+
+// Read decrypts the next frames into p. A read deadline that expires
+// part-way through a frame leaves the partial frame buffered, so reads can
+// be interrupted and resumed safely.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.plain) == 0 {
+		if c.readEOF {
+			return 0, io.EOF
+		}
+		frame, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		plain, err := c.recv.decrypt(frame[:0], nil, frame)
+		if err != nil {
+			return 0, err
+		}
+		if len(plain) == 0 {
+			c.readEOF = true
+			continue
+		}
+		c.plain = plain
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// Write seals p into one or more frames.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxPayload)]
+		if err := c.sealFrame(chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data follows and half-closes the
+// underlying connection when it supports that.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.sealFrame(nil); err != nil {
+		return err
+	}
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) sealFrame(plaintext []byte) error {
+	buf, err := c.send.encrypt(append(c.wbuf[:0], 0, 0), nil, plaintext)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+	c.wbuf = buf
+	_, err = c.Conn.Write(buf)
+	return err
+}
+
+// writeFrame sends a handshake message.
+func (c *Conn) writeFrame(frame []byte) error {
+	if len(frame) > maxFrame {
+		return fmt.Errorf("secure: frame of %d bytes exceeds %d", len(frame), maxFrame)
+	}
+	buf := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(buf, uint16(len(frame)))
+	copy(buf[2:], frame)
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// readFrame returns a copy of the next complete frame.
+func (c *Conn) readFrame() ([]byte, error) {
+	for {
+		if len(c.raw) >= 2 {
+			n := int(binary.BigEndian.Uint16(c.raw))
+			if len(c.raw) >= 2+n {
+				frame := append([]byte(nil), c.raw[2:2+n]...)
+				c.raw = c.raw[2+n:]
+				return frame, nil
+			}
+		}
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, 32*1024)
+		}
+		n, err := c.Conn.Read(c.rbuf)
+		c.raw = append(c.raw, c.rbuf[:n]...)
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(c.raw) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
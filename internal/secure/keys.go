@@ -0,0 +1,70 @@
+// Package secure implements an opt-in Noise_IK_25519_AESGCM_SHA256 channel
+// for the hub link, for deployments where TLS cannot be terminated on the
+// hub. After the line-protocol handshake both ends run a Noise IK handshake
+// and every further byte, control lines included, travels in authenticated
+// frames.
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// GenerateKey returns a new X25519 static key pair.
+func GenerateKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// EncodePublicKey renders a public key as lower-case hex.
+func EncodePublicKey(pub *ecdh.PublicKey) string {
+	return hex.EncodeToString(pub.Bytes())
+}
+
+// EncodePrivateKey renders a private key as lower-case hex.
+func EncodePrivateKey(priv *ecdh.PrivateKey) string {
+	return hex.EncodeToString(priv.Bytes())
+}
+
+// ParsePublicKey decodes a hex X25519 public key.
+func ParsePublicKey(text string) (*ecdh.PublicKey, error) {
+	raw, err := decodeKey(text)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+}
+
+// ParsePrivateKey decodes a hex X25519 private key. The decoded buffer is
+// zeroed once the key has been built.
+func ParsePrivateKey(text []byte) (*ecdh.PrivateKey, error) {
+	raw, err := decodeKey(string(bytes.TrimSpace(text)))
+	if err != nil {
+		return nil, err
+	}
+	defer clear(raw)
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// ReadPublicKey loads a hex public key from path.
+func ReadPublicKey(path string) (*ecdh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(string(bytes.TrimSpace(data)))
+}
+
+func decodeKey(text string) ([]byte, error) {
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded")
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(raw))
+	}
+	return raw, nil
+}
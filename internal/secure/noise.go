@@ -0,0 +1,271 @@
+package secure
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// protocolName identifies the handshake pattern and primitives (Noise
+// specification revision 34, section 8).
+const protocolName = "Noise_IK_25519_AESGCM_SHA256"
+
+const (
+	keyLen  = 32
+	tagLen  = 16
+	hashLen = sha256.Size
+)
+
+var errNonceExhausted = errors.New("secure: nonce space exhausted")
+
+// cipherState is the Noise CipherState: an AES-256-GCM key and a counter
+// nonce.
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // key is always 32 bytes
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) nonce() []byte {
+	var nonce [12]byte
+	binary.BigEndian.PutUint64(nonce[4:], c.n)
+	return nonce[:]
+}
+
+func (c *cipherState) encrypt(dst, ad, plaintext []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, errNonceExhausted
+	}
+	out := c.aead.Seal(dst, c.nonce(), plaintext, ad)
+	c.n++
+	return out, nil
+}
+
+func (c *cipherState) decrypt(dst, ad, ciphertext []byte) ([]byte, error) {
+	if c.n == math.MaxUint64 {
+		return nil, errNonceExhausted
+	}
+	out, err := c.aead.Open(dst, c.nonce(), ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("secure: message authentication failed")
+	}
+	c.n++
+	return out, nil
+}
+
+// symmetricState is the Noise SymmetricState.
+type symmetricState struct {
+	cs *cipherState
+	ck [hashLen]byte
+	h  [hashLen]byte
+}
+
+func newSymmetricState() *symmetricState {
+	s := &symmetricState{}
+	copy(s.h[:], protocolName) // the name is shorter than HASHLEN
+	s.ck = s.h
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	ck, k := hkdf(s.ck[:], ikm)
+	s.ck = ck
+	s.cs = newCipherState(k[:keyLen])
+}
+
+func (s *symmetricState) encryptAndHash(dst, plaintext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(plaintext)
+		return append(dst, plaintext...), nil
+	}
+	out, err := s.cs.encrypt(dst, s.h[:], plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(out[len(dst):])
+	return out, nil
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	out, err := s.cs.decrypt(nil, s.h[:], ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return out, nil
+}
+
+// split derives the initiator-to-responder and responder-to-initiator
+// transport ciphers.
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(s.ck[:], nil)
+	return newCipherState(k1[:keyLen]), newCipherState(k2[:keyLen])
+}
+
+// hkdf is the two-output HKDF defined by the Noise specification.
+func hkdf(ck, ikm []byte) (out1, out2 [hashLen]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	mac.Sum(out1[:0])
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{0x02})
+	mac.Sum(out2[:0])
+	return out1, out2
+}
+
+func dh(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) ([]byte, error) {
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("secure: %w", err)
+	}
+	return secret, nil
+}
+
+// initiatorHello builds IK message 1 (-> e, es, s, ss) and returns the
+// state needed to read the responder's answer.
+func initiatorHello(static *ecdh.PrivateKey, remote *ecdh.PublicKey, prologue, payload []byte) (*symmetricState, *ecdh.PrivateKey, []byte, error) {
+	ss := newSymmetricState()
+	ss.mixHash(prologue)
+	ss.mixHash(remote.Bytes())
+
+	e, err := GenerateKey()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	msg := append([]byte(nil), e.PublicKey().Bytes()...)
+	ss.mixHash(e.PublicKey().Bytes())
+
+	secret, err := dh(e, remote)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if msg, err = ss.encryptAndHash(msg, static.PublicKey().Bytes()); err != nil {
+		return nil, nil, nil, err
+	}
+	if secret, err = dh(static, remote); err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if msg, err = ss.encryptAndHash(msg, payload); err != nil {
+		return nil, nil, nil, err
+	}
+	return ss, e, msg, nil
+}
+
+// initiatorFinish consumes IK message 2 (<- e, ee, se) and returns the
+// send and receive ciphers plus the responder's payload.
+func initiatorFinish(ss *symmetricState, static, e *ecdh.PrivateKey, msg []byte) (send, recv *cipherState, payload []byte, err error) {
+	if len(msg) < keyLen+tagLen {
+		return nil, nil, nil, fmt.Errorf("secure: short handshake response")
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:keyLen])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("secure: %w", err)
+	}
+	ss.mixHash(re.Bytes())
+	secret, err := dh(e, re)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if secret, err = dh(static, re); err != nil {
+		return nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if payload, err = ss.decryptAndHash(msg[keyLen:]); err != nil {
+		return nil, nil, nil, err
+	}
+	send, recv = ss.split()
+	return send, recv, payload, nil
+}
+
+// responderHandshake consumes IK message 1, builds message 2 and returns the
+// transport ciphers, the initiator's static key and its payload.
+func responderHandshake(static *ecdh.PrivateKey, prologue, msg, payload []byte) (reply []byte, send, recv *cipherState, peer *ecdh.PublicKey, peerPayload []byte, err error) {
+	ss := newSymmetricState()
+	ss.mixHash(prologue)
+	ss.mixHash(static.PublicKey().Bytes())
+
+	if len(msg) < keyLen+keyLen+tagLen+tagLen {
+		return nil, nil, nil, nil, nil, fmt.Errorf("secure: short handshake message")
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:keyLen])
+	if err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("secure: %w", err)
+	}
+	ss.mixHash(re.Bytes())
+	secret, err := dh(static, re)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	rsRaw, err := ss.decryptAndHash(msg[keyLen : 2*keyLen+tagLen])
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	if peer, err = ecdh.X25519().NewPublicKey(rsRaw); err != nil {
+		return nil, nil, nil, nil, nil, fmt.Errorf("secure: %w", err)
+	}
+	if secret, err = dh(static, peer); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if peerPayload, err = ss.decryptAndHash(msg[2*keyLen+tagLen:]); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+
+	e, err := GenerateKey()
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	reply = append(reply, e.PublicKey().Bytes()...)
+	ss.mixHash(e.PublicKey().Bytes())
+	if secret, err = dh(e, re); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if secret, err = dh(e, peer); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	ss.mixKey(secret)
+	if reply, err = ss.encryptAndHash(reply, payload); err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	recv, send = ss.split()
+	return reply, send, recv, peer, peerPayload, nil
+}
@@ -0,0 +1,127 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// pair completes a handshake over an in-memory pipe and returns the
+// worker (initiator) and hub (responder) ends.
+func pair(t *testing.T, workerKey, hubKey *ecdh.PrivateKey) (*Conn, *Conn, net.Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	t.Cleanup(func() { a.Close(); b.Close() })
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	server := make(chan result, 1)
+	go func() {
+		c, err := Server(b, Config{StaticKey: hubKey, Prologue: []byte("test")})
+		server <- result{c, err}
+	}()
+	client, err := Client(a, Config{StaticKey: workerKey, PeerKey: hubKey.PublicKey(), Prologue: []byte("test")})
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	res := <-server
+	if res.err != nil {
+		t.Fatalf("server handshake: %v", res.err)
+	}
+	return client, res.conn, b
+}
+
+func TestHandshakeAndStream(t *testing.T) {
+	hubKey, _ := GenerateKey()
+	workerKey, _ := GenerateKey()
+	client, server, _ := pair(t, workerKey, hubKey)
+	if !server.PeerKey().Equal(workerKey.PublicKey()) {
+		t.Fatalf("hub learned the wrong worker key")
+	}
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 10000) // spans several frames
+	go func() {
+		client.Write(payload)
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("stream mismatch: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestHandshakeRejectsWrongHubKey(t *testing.T) {
+	hubKey, _ := GenerateKey()
+	otherKey, _ := GenerateKey()
+	workerKey, _ := GenerateKey()
+	a, b := net.Pipe()
+	defer a.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Server(b, Config{StaticKey: hubKey})
+		b.Close()
+		errs <- err
+	}()
+	if _, err := Client(a, Config{StaticKey: workerKey, PeerKey: otherKey.PublicKey()}); err == nil {
+		t.Fatalf("worker accepted a hub with an unexpected key")
+	}
+	if err := <-errs; err == nil {
+		t.Fatalf("hub accepted a handshake addressed to another key")
+	}
+}
+
+// recorder captures frames written by a Conn.
+type recorder struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (r *recorder) Write(p []byte) (int, error) { return r.buf.Write(p) }
+
+func TestReadDeadlineKeepsPartialFrame(t *testing.T) {
+	hubKey, _ := GenerateKey()
+	workerKey, _ := GenerateKey()
+	client, server, wire := pair(t, workerKey, hubKey)
+
+	rec := &recorder{}
+	sealer := &Conn{Conn: rec, send: server.send}
+	sealer.Write([]byte("REQUEST CONNECT ipv4 192.0.2.1 80\n"))
+	frame := rec.buf.Bytes()
+
+	go wire.Write(frame[:5])
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64)
+	if _, err := client.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	client.SetReadDeadline(time.Time{})
+
+	go wire.Write(frame[5:])
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "REQUEST CONNECT ipv4 192.0.2.1 80\n" {
+		t.Fatalf("got %q, %v after resuming", buf[:n], err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key, _ := GenerateKey()
+	priv, err := ParsePrivateKey([]byte(EncodePrivateKey(key) + "\n"))
+	if err != nil || !priv.Equal(key) {
+		t.Fatalf("private key round trip failed: %v", err)
+	}
+	pub, err := ParsePublicKey(EncodePublicKey(key.PublicKey()))
+	if err != nil || !pub.Equal(key.PublicKey()) {
+		t.Fatalf("public key round trip failed: %v", err)
+	}
+	if _, err := ParsePublicKey("abcd"); err == nil {
+		t.Fatalf("expected short key to be rejected")
+	}
+}
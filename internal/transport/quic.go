@@ -0,0 +1,332 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/quic"
+)
+
+// ALPN is the application protocol both ends of a QUIC hub link announce.
+const ALPN = "contun"
+
+// quicKeepAlive keeps a QUIC connection through NAT bindings and within
+// the idle timeout while no worker is busy.
+const quicKeepAlive = 10 * time.Second
+
+// quicMaxStreams bounds the workers one QUIC connection carries at once.
+const quicMaxStreams = 4096
+
+// QUIC is the experimental QUIC transport: workers share one QUIC
+// connection to the hub, over a single UDP socket, and each gets its own
+// stream on it. The connection is dialled with the first worker and again
+// after it fails.
+type QUIC struct {
+	address string
+	config  *quic.Config
+
+	mu   sync.Mutex
+	ep   *quic.Endpoint
+	conn *quic.Conn // nil until dialled, and once it ended
+}
+
+// NewQUIC returns a QUIC transport to address, a UDP host:port, verifying
+// the hub with cfg.
+func NewQUIC(address string, cfg *tls.Config) *QUIC {
+	cfg = cfg.Clone()
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{ALPN}
+	return &QUIC{address: address, config: &quic.Config{
+		TLSConfig:       cfg,
+		KeepAlivePeriod: quicKeepAlive,
+	}}
+}
+
+func (q *QUIC) Dial(ctx context.Context) (Session, error) {
+	conn, err := q.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		q.forget(conn)
+		return nil, err
+	}
+	return newStreamConn(stream, nil, nil), nil
+}
+
+// connection returns the shared QUIC connection, dialling it if needed.
+func (q *QUIC) connection(ctx context.Context) (*quic.Conn, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn != nil {
+		return q.conn, nil
+	}
+	if q.ep == nil {
+		ep, err := quic.Listen("udp", ":0", nil)
+		if err != nil {
+			return nil, err
+		}
+		q.ep = ep
+	}
+	conn, err := q.ep.Dial(ctx, "udp", q.address, q.config)
+	if err != nil {
+		return nil, err
+	}
+	q.conn = conn
+	go func() {
+		_ = conn.Wait(context.Background())
+		q.forget(conn)
+	}()
+	return conn, nil
+}
+
+// forget drops conn so the next Dial makes a new connection.
+func (q *QUIC) forget(conn *quic.Conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn == conn {
+		q.conn = nil
+		conn.Abort(nil)
+	}
+}
+
+// Close ends the shared connection, and with it every stream on it.
+func (q *QUIC) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.conn != nil {
+		q.conn.Abort(nil)
+		q.conn = nil
+	}
+	if q.ep == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := q.ep.Close(ctx)
+	q.ep = nil
+	return err
+}
+
+// ListenQUIC accepts QUIC connections on address, a UDP host:port, with
+// cfg, which must hold the hub's certificate. Each stream a peer opens is
+// returned by Accept as one connection.
+func ListenQUIC(address string, cfg *tls.Config) (net.Listener, error) {
+	cfg = cfg.Clone()
+	cfg.MinVersion = tls.VersionTLS13
+	cfg.NextProtos = []string{ALPN}
+	ep, err := quic.Listen("udp", address, &quic.Config{
+		TLSConfig:            cfg,
+		KeepAlivePeriod:      quicKeepAlive,
+		MaxBidiRemoteStreams: quicMaxStreams,
+		MaxUniRemoteStreams:  -1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ln := &quicListener{ep: ep, ctx: ctx, cancel: cancel, streams: make(chan net.Conn)}
+	go ln.acceptConns()
+	return ln, nil
+}
+
+type quicListener struct {
+	ep      *quic.Endpoint
+	ctx     context.Context
+	cancel  context.CancelFunc
+	streams chan net.Conn
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		conn, err := l.ep.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *quicListener) acceptStreams(conn *quic.Conn) {
+	local := l.Addr()
+	remote := peerAddr(conn)
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			conn.Abort(nil)
+			return
+		}
+		select {
+		case l.streams <- newStreamConn(stream, local, remote):
+		case <-l.ctx.Done():
+			stream.Reset(0)
+			conn.Abort(nil)
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.cancel()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return l.ep.Close(ctx)
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return net.UDPAddrFromAddrPort(l.ep.LocalAddr())
+}
+
+// peerAddr returns the address conn's peer sends from. The quic package
+// only shows it in the connection's String, as "quic.Conn(side,->addr)".
+func peerAddr(conn *quic.Conn) net.Addr {
+	_, addr, _ := strings.Cut(conn.String(), "->")
+	ap, err := netip.ParseAddrPort(strings.TrimSuffix(addr, ")"))
+	if err != nil {
+		return &net.UDPAddr{}
+	}
+	return net.UDPAddrFromAddrPort(ap)
+}
+
+// streamConn presents a QUIC stream as a net.Conn. Writes are flushed at
+// once, as the hub protocol expects of a socket, and deadlines become the
+// contexts the stream waits with.
+type streamConn struct {
+	stream        *quic.Stream
+	local, remote net.Addr
+
+	readDeadline, writeDeadline deadline
+}
+
+func newStreamConn(stream *quic.Stream, local, remote net.Addr) *streamConn {
+	if local == nil {
+		local = &net.UDPAddr{}
+	}
+	if remote == nil {
+		remote = &net.UDPAddr{}
+	}
+	c := &streamConn{stream: stream, local: local, remote: remote}
+	c.readDeadline.set(time.Time{})
+	c.writeDeadline.set(time.Time{})
+	return c
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	ctx := c.readDeadline.context()
+	c.stream.SetReadContext(ctx)
+	n, err := c.stream.Read(p)
+	return n, deadlineError(ctx, err)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	ctx := c.writeDeadline.context()
+	c.stream.SetWriteContext(ctx)
+	n, err := c.stream.Write(p)
+	if err == nil {
+		c.stream.Flush()
+	}
+	return n, deadlineError(ctx, err)
+}
+
+// CloseWrite sends the end of the stream; the peer reads io.EOF.
+func (c *streamConn) CloseWrite() error {
+	c.stream.CloseWrite()
+	return nil
+}
+
+// Close ends both directions without waiting for the peer to acknowledge
+// what was sent.
+func (c *streamConn) Close() error {
+	c.stream.CloseWrite()
+	c.stream.CloseRead()
+	c.readDeadline.stop()
+	c.writeDeadline.stop()
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadlineError reports a wait cut short by a deadline as
+// os.ErrDeadlineExceeded, as a socket would.
+func deadlineError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// deadline is a context that expires at a time which can be moved, also
+// while an operation waits on it.
+type deadline struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.ctx == nil || d.ctx.Err() != nil {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+	}
+	switch {
+	case t.IsZero():
+	case time.Until(t) <= 0:
+		d.cancel()
+	default:
+		d.timer = time.AfterFunc(time.Until(t), d.cancel)
+	}
+}
+
+func (d *deadline) context() context.Context {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ctx
+}
+
+func (d *deadline) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+)
+
+// Config is what a transport is built from: where the hub is and how the
+// worker was told to reach it.
+type Config struct {
+	// Address is the hub's host:port.
+	Address string
+
+	// TLS verifies the hub, and presents a client certificate when it has
+	// one. It is nil when the link is not to use TLS; QUIC requires it.
+	TLS *tls.Config
+
+	// URL is set when the link is to travel inside WebSocket.
+	URL *url.URL
+
+	// Dial makes a TCP connection to Address, through an SSH jump host, a
+	// proxy or a transport plugin when the worker has one. Transports that
+	// run over TCP should dial with it; it is never nil.
+	Dial Func
+}
+
+// Factory builds a transport from cfg. It is called again whenever the
+// hub link's settings change, and the transport it replaced is closed
+// once no worker uses it.
+type Factory func(cfg Config) (Transport, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+func init() {
+	Register("tcp", newTCP)
+	Register("quic", newQUICFactory)
+}
+
+// Register makes a transport available under name, for --transport. It
+// is meant to be called from init functions and panics if name is empty
+// or already taken.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if name == "" || factory == nil {
+		panic("transport: Register needs a name and a factory")
+	}
+	if _, taken := registry[name]; taken {
+		panic("transport: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// Registered reports whether a transport named name exists.
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[name]
+	return ok
+}
+
+// Names returns the registered transport names, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// New builds the transport registered as name.
+func New(name string, cfg Config) (Transport, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", name)
+	}
+	if cfg.Dial == nil {
+		var dialer net.Dialer
+		cfg.Dial = func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", cfg.Address)
+		}
+	}
+	return factory(cfg)
+}
+
+// newTCP gives each worker a TCP connection, in TLS and then WebSocket as
+// cfg asks.
+func newTCP(cfg Config) (Transport, error) {
+	var t Transport = cfg.Dial
+	if cfg.TLS != nil {
+		t = TLS(t, cfg.TLS)
+	}
+	if cfg.URL != nil {
+		t = WebSocket(t, cfg.URL)
+	}
+	return t, nil
+}
+
+func newQUICFactory(cfg Config) (Transport, error) {
+	if cfg.TLS == nil {
+		return nil, errors.New("quic transport needs a TLS configuration")
+	}
+	if cfg.URL != nil {
+		return nil, errors.New("quic transport cannot carry WebSocket")
+	}
+	return NewQUIC(cfg.Address, cfg.TLS), nil
+}
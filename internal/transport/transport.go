@@ -0,0 +1,87 @@
+// Package transport carries the hub link. A Transport gives each worker its
+// own session with the hub: a TCP connection, optionally wrapped in TLS
+// and then WebSocket, or a stream of a QUIC connection all workers share.
+// The hub protocol runs unchanged on whichever session it gets.
+//
+// Transports are chosen by name from a registry (see Register), which
+// holds "tcp" and "quic" and any transport a program embedding the pool
+// adds.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+
+	"contun/internal/websocket"
+)
+
+// Session is one worker's connection to the hub. The hub protocol runs on
+// it as on a socket. Sessions that can end their sending side alone, as
+// TCP, TLS, WebSocket and QUIC streams can, also have a CloseWrite() error
+// method.
+type Session interface {
+	net.Conn
+}
+
+// Transport dials sessions with the hub, one per worker.
+type Transport interface {
+	// Dial returns a new session with the hub; ctx bounds the dial and
+	// any handshake.
+	Dial(ctx context.Context) (Session, error)
+
+	// Close releases what the transport holds across dials, such as a
+	// shared QUIC connection. Connections already dialled may end with it.
+	Close() error
+}
+
+// Func turns a dial function into a Transport that holds nothing between
+// dials.
+type Func func(ctx context.Context) (net.Conn, error)
+
+func (f Func) Dial(ctx context.Context) (Session, error) { return f(ctx) }
+func (f Func) Close() error                              { return nil }
+
+// TLS wraps the connections next dials in TLS with cfg. A failed
+// handshake is reported as "tls handshake: ..." and wraps the TLS error.
+func TLS(next Transport, cfg *tls.Config) Transport {
+	return &layer{next: next, wrap: func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		return tlsConn, nil
+	}}
+}
+
+// WebSocket carries the connections next dials inside WebSocket, with the
+// opening handshake for u. next must reach u's host, through TLS for
+// wss:// URLs.
+func WebSocket(next Transport, u *url.URL) Transport {
+	return &layer{next: next, wrap: func(ctx context.Context, conn net.Conn) (net.Conn, error) {
+		return websocket.Client(ctx, conn, u)
+	}}
+}
+
+// layer runs a handshake over each connection another transport dials.
+type layer struct {
+	next Transport
+	wrap func(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+func (l *layer) Dial(ctx context.Context) (Session, error) {
+	conn, err := l.next.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := l.wrap(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+func (l *layer) Close() error { return l.next.Close() }
@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// certificate makes a self-signed certificate for 127.0.0.1 and a pool
+// of roots that trusts it.
+func certificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+func TestQUIC(t *testing.T) {
+	cert, roots := certificate(t)
+	ln, err := ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(interface{ CloseWrite() error }).CloseWrite()
+			}()
+		}
+	}()
+
+	q := NewQUIC(ln.Addr().String(), &tls.Config{RootCAs: roots})
+	defer q.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var conns []net.Conn
+	for _, msg := range []string{"first", "second"} {
+		conn, err := q.Dial(ctx)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		io.WriteString(conn, msg)
+		conn.(interface{ CloseWrite() error }).CloseWrite()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if got, err := io.ReadAll(conn); err != nil || string(got) != msg {
+			t.Fatalf("stream echoed %q (%v), want %q", got, err, msg)
+		}
+	}
+	if q.conn == nil {
+		t.Fatal("no shared connection")
+	}
+
+	// A deadline that passes while Read waits ends the wait.
+	conn, err := q.Dial(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "x")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.Read(make([]byte, 1))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		conn.SetReadDeadline(time.Now())
+	}()
+	conn.SetReadDeadline(time.Time{})
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read after the deadline = %v", err)
+	}
+}
+
+func TestQUICUntrusted(t *testing.T) {
+	cert, _ := certificate(t)
+	ln, err := ListenQUIC("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	q := NewQUIC(ln.Addr().String(), &tls.Config{})
+	defer q.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := q.Dial(ctx); err == nil {
+		t.Fatal("dialled a hub with an untrusted certificate")
+	}
+}
+
+func TestLayers(t *testing.T) {
+	cert, roots := certificate(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.WriteString(conn, "hello")
+			}()
+		}
+	}()
+	raw := Func(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", ln.Addr().String())
+	})
+	conn, err := TLS(raw, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}).Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q (%v)", got, err)
+	}
+	if _, err := TLS(raw, &tls.Config{ServerName: "127.0.0.1"}).Dial(context.Background()); err == nil {
+		t.Fatal("TLS accepted an untrusted certificate")
+	}
+
+	// The registered tcp transport layers the same way, dialling the
+	// address itself when given no Dial.
+	tcp, err := New("tcp", Config{Address: ln.Addr().String(), TLS: &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := tcp.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if got, err := io.ReadAll(session); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q (%v)", got, err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	if names := Names(); !slices.Contains(names, "tcp") || !slices.Contains(names, "quic") || !slices.IsSorted(names) {
+		t.Fatalf("Names() = %q", names)
+	}
+	if !Registered("quic") || Registered("pigeon") {
+		t.Fatal("Registered is wrong")
+	}
+	if _, err := New("pigeon", Config{}); err == nil {
+		t.Fatal("New built an unknown transport")
+	}
+	if _, err := New("quic", Config{Address: "127.0.0.1:1"}); err == nil {
+		t.Fatal("quic built without TLS")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering tcp twice did not panic")
+		}
+	}()
+	Register("tcp", newTCP)
+}
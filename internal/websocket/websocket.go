@@ -0,0 +1,363 @@
+// Package websocket carries the hub link inside a WebSocket connection
+// (RFC 6455), so it can pass TLS-intercepting middleboxes and reverse
+// proxies such as nginx or a cloud load balancer that only forward HTTP.
+// The stream travels in binary messages; message boundaries mean nothing.
+// A Close frame ends one direction only, which lets CloseWrite half-close
+// the stream like TCP.
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol is the subprotocol poolgo asks for and hubgo accepts.
+const Protocol = "contun"
+
+// acceptGUID is appended to the client's key to derive the server's
+// answer (RFC 6455 section 1.3).
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// closeTimeout bounds how long Close spends sending its Close frame.
+const closeTimeout = time.Second
+
+// maxFrame bounds the payload of the frames Write sends.
+const maxFrame = 32 * 1024
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Conn is a net.Conn whose bytes travel as WebSocket messages over the
+// embedded connection.
+type Conn struct {
+	net.Conn
+	client bool // mask what it sends, as clients must
+
+	readMu    sync.Mutex
+	reader    *bufio.Reader // may hold bytes read past the handshake
+	remaining int64         // payload left in the current data frame
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	readEOF   bool
+
+	writeMu   sync.Mutex
+	closeSent bool
+	wbuf      []byte
+}
+
+// Client runs the opening handshake for u, a ws:// or wss:// URL, over
+// conn, which already reaches the server (through TLS for wss://). ctx
+// bounds the handshake.
+func Client(ctx context.Context, conn net.Conn, u *url.URL) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	path := u.RequestURI()
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: " + Protocol + "\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("websocket handshake: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, fmt.Errorf("websocket handshake: server answered %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("websocket handshake: bad Sec-WebSocket-Accept")
+	}
+	return &Conn{Conn: conn, client: true, reader: reader}, nil
+}
+
+// IsUpgrade reports whether the connection reader reads from starts with
+// an HTTP GET, rather than the hub protocol's HELLO.
+func IsUpgrade(reader *bufio.Reader) bool {
+	start, err := reader.Peek(4)
+	return err == nil && string(start) == "GET "
+}
+
+// Upgrade reads the client's opening handshake from reader, which reads
+// conn, and accepts it. A request that is not a WebSocket upgrade is
+// answered 400 and reported as an error. The request is returned so the
+// caller can look at its headers.
+func Upgrade(conn net.Conn, reader *bufio.Reader) (*Conn, *http.Request, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("websocket handshake: %w", err)
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case req.Method != http.MethodGet,
+		!headerHas(req.Header, "Upgrade", "websocket"),
+		!headerHas(req.Header, "Connection", "upgrade"),
+		req.Header.Get("Sec-WebSocket-Version") != "13",
+		key == "":
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, req, errors.New("websocket handshake: not a WebSocket upgrade request")
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if headerHas(req.Header, "Sec-WebSocket-Protocol", Protocol) {
+		resp += "Sec-WebSocket-Protocol: " + Protocol + "\r\n"
+	}
+	if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+		return nil, req, err
+	}
+	return &Conn{Conn: conn, reader: reader}, req, nil
+}
+
+// headerHas reports whether a comma-separated header lists token, in any
+// case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Read returns payload bytes of data messages. It answers pings, skips
+// pongs, and returns io.EOF once the peer sent a Close frame.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.remaining == 0 {
+		if c.readEOF {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.reader.Read(p)
+	if c.masked {
+		c.maskPos = maskBytes(c.mask, c.maskPos, p[:n])
+	}
+	c.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextFrame reads frame headers until a data frame with a payload starts,
+// handling control frames on the way.
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := int64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return unexpected(err)
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return unexpected(err)
+		}
+		if length = int64(binary.BigEndian.Uint64(ext[:])); length < 0 {
+			return errors.New("websocket: frame too long")
+		}
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return unexpected(err)
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining, c.mask, c.masked, c.maskPos = length, mask, masked, 0
+		return nil
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return unexpected(err)
+		}
+		if masked {
+			maskBytes(mask, 0, payload)
+		}
+		switch opcode {
+		case opClose:
+			c.readEOF = true
+		case opPing:
+			c.writeMu.Lock()
+			defer c.writeMu.Unlock()
+			if !c.closeSent {
+				return c.writeFrame(opPong, payload)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("websocket: unexpected opcode %d", opcode)
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Write sends p in binary messages.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxFrame)]
+		if err := c.writeFrame(opBinary, chunk); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// CloseWrite sends a Close frame, after which the peer reads io.EOF. The
+// peer may keep sending until it closes its side in turn.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	return c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000, normal closure
+}
+
+// Close sends a Close frame unless CloseWrite already did, and closes the
+// connection. It skips the frame rather than wait for a Write blocked on a
+// stalled peer.
+func (c *Conn) Close() error {
+	if c.writeMu.TryLock() {
+		if !c.closeSent {
+			c.closeSent = true
+			_ = c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+			_ = c.writeFrame(opClose, []byte{0x03, 0xE8})
+		}
+		c.writeMu.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// writeFrame sends one final frame. The caller holds writeMu.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	b := append(c.wbuf[:0], 0x80|opcode)
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	case n <= 0xFFFF:
+		b = binary.BigEndian.AppendUint16(append(b, maskBit|126), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint64(append(b, maskBit|127), uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		b = append(b, mask[:]...)
+		start := len(b)
+		b = append(b, payload...)
+		maskBytes(mask, 0, b[start:])
+	} else {
+		b = append(b, payload...)
+	}
+	c.wbuf = b
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// maskBytes applies mask to b, whose first byte is at offset pos of the
+// payload, and returns the offset following b. It works a word at a time,
+// as masking dominates the cost of a frame.
+func maskBytes(mask [4]byte, pos int, b []byte) int {
+	for len(b) > 0 && pos%4 != 0 {
+		b[0] ^= mask[pos%4]
+		b, pos = b[1:], pos+1
+	}
+	word := uint64(binary.LittleEndian.Uint32(mask[:]))
+	word |= word << 32
+	for len(b) >= 8 {
+		binary.LittleEndian.PutUint64(b, binary.LittleEndian.Uint64(b)^word)
+		b = b[8:]
+	}
+	for i := range b {
+		b[i] ^= mask[i%4]
+	}
+	return (pos + len(b)) % 4
+}
@@ -0,0 +1,128 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pair runs the handshake over a loopback TCP connection and returns the
+// client and server ends.
+func pair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan *Conn, 1)
+	go func() {
+		raw, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		reader := bufio.NewReader(raw)
+		if !IsUpgrade(reader) {
+			raw.Close()
+			accepted <- nil
+			return
+		}
+		conn, req, err := Upgrade(raw, reader)
+		if err != nil || req.URL.Path != "/tunnel" {
+			raw.Close()
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := Client(ctx, raw, &url.URL{Scheme: "ws", Host: ln.Addr().String(), Path: "/tunnel"})
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("server handshake failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, server
+}
+
+func TestStream(t *testing.T) {
+	client, server := pair(t)
+	big := bytes.Repeat([]byte("0123456789"), 10000) // several frames
+	go func() {
+		client.Write(big)
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil || !bytes.Equal(got, big) {
+		t.Fatalf("server read %d bytes (%v), want %d", len(got), err, len(big))
+	}
+
+	// The server can still answer after the client half-closed.
+	if _, err := io.WriteString(server, "reply"); err != nil {
+		t.Fatal(err)
+	}
+	server.CloseWrite()
+	if got, err := io.ReadAll(client); err != nil || string(got) != "reply" {
+		t.Fatalf("client read %q (%v)", got, err)
+	}
+	if _, err := client.Write([]byte("late")); err == nil {
+		t.Fatal("Write after CloseWrite succeeded")
+	}
+}
+
+func TestPing(t *testing.T) {
+	client, server := pair(t)
+	server.writeMu.Lock()
+	server.writeFrame(opPing, []byte("are you there"))
+	server.writeFrame(opBinary, []byte("data"))
+	server.writeMu.Unlock()
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "data" {
+		t.Fatalf("client read %q (%v)", buf, err)
+	}
+	client.CloseWrite()
+	// The pong comes before the Close frame, and Read skips it.
+	if got, err := io.ReadAll(server); err != nil || len(got) != 0 {
+		t.Fatalf("server read %q (%v)", got, err)
+	}
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "GET / HTTP/1.1\r\nHost: hub\r\n\r\n")
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := Upgrade(server, bufio.NewReader(server))
+		server.Close()
+		errc <- err
+	}()
+	answer, _ := io.ReadAll(client)
+	if err := <-errc; err == nil {
+		t.Fatal("upgraded a plain GET")
+	}
+	if !strings.HasPrefix(string(answer), "HTTP/1.1 400 ") {
+		t.Fatalf("answered %q", answer)
+	}
+}
@@ -0,0 +1,179 @@
+// Package pool runs a contun pool inside another Go program, for agents
+// that want to carry the bastion side of the tunnel themselves rather
+// than ship poolgo next to them. poolgo is itself a thin wrapper around
+// it.
+//
+// A pool is configured with the command-line arguments poolgo takes, so
+// every flag, --config file and reload rule documented for poolgo applies
+// unchanged:
+//
+//	p, err := pool.New(pool.Config{
+//		Args: []string{"--hub-host", "hub.example", "--hub-port", "7000", "--mode", "socks"},
+//		OnSessionEnd: func(s pool.SessionInfo) {
+//			metrics.Observe(s.Host, s.BytesIn, s.BytesOut)
+//		},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return p.Run(ctx)
+package pool
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"contun/internal/logx"
+	"contun/internal/pool"
+	"contun/internal/transport"
+)
+
+// Config is what New builds a pool from.
+type Config struct {
+	// Args are poolgo's arguments without the program name, such as
+	// {"--hub-host", "hub.example", "--workers", "8"}.
+	Args []string
+
+	// Logger receives the pool's log in text form. When it is nil the
+	// pool logs through the standard logger, which New points at standard
+	// error in the --log-format given, as poolgo does. --log-level applies
+	// process-wide either way.
+	Logger *log.Logger
+
+	// OnSessionStart, OnSessionEnd and OnSessionFailed, when set, are
+	// called as bridged sessions start and end and when a target cannot
+	// be reached. They run on the worker serving the session and hold it
+	// up, so they should return quickly.
+	OnSessionStart  func(SessionInfo)
+	OnSessionEnd    func(SessionInfo)
+	OnSessionFailed func(SessionInfo)
+
+	// Interceptors see every hub session and request, and can deny or
+	// rewrite requests; see Interceptor. They run after the callbacks
+	// above and after those added with RegisterInterceptor.
+	Interceptors []Interceptor
+}
+
+// SessionInfo describes a session to the Config callbacks: its
+// destination and, as they become known, its duration, byte counts and
+// teardown reason, or the REPLY status of a target that failed.
+type SessionInfo = pool.SessionInfo
+
+// An Interceptor sees what a worker does on each hub session: the
+// handshake, every REQUEST, which it may deny or rewrite as a --hook
+// script can, the dial and the end of the bridge. Embed NopInterceptor to
+// implement only some of the methods. The methods run on the worker
+// serving the session and hold it up, so they should return quickly.
+type (
+	Interceptor    = pool.Interceptor
+	NopInterceptor = pool.NopInterceptor
+	HandshakeInfo  = pool.HandshakeInfo
+	// Request is a REQUEST from the hub as OnRequest sees it.
+	Request = pool.Request
+	// Decision is OnRequest's answer: Deny, with a Reason, or a Host or
+	// Port to dial instead; the zero Decision allows the request as is.
+	Decision = pool.Decision
+)
+
+// RegisterInterceptor adds i to every pool the program runs, ahead of
+// each Config's own, for extensions compiled into a build. Call it from
+// an init function.
+func RegisterInterceptor(i Interceptor) {
+	pool.RegisterInterceptor(i)
+}
+
+// Errors Run returns when the pool stopped by itself.
+var (
+	// ErrExpired means --expire-at or --max-runtime ran out.
+	ErrExpired = pool.ErrExpired
+	// ErrRemoteShutdown means the hub decommissioned the pool with a
+	// verified SHUTDOWN.
+	ErrRemoteShutdown = pool.ErrRemoteShutdown
+)
+
+// Pool is a pool of workers built by New.
+type Pool struct {
+	supervisor *pool.Supervisor
+	opts       *pool.Options
+}
+
+// New checks cfg and builds a pool from it. It does not connect to the
+// hub; Run does. Args that are invalid, or that ask for --help or
+// --version, are reported as errors.
+func New(cfg Config) (*Pool, error) {
+	opts, err := pool.ParseArgs(cfg.Args)
+	if err != nil {
+		return nil, err
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logx.Setup(opts.LogFormat, os.Stderr, "pool")
+		logger = log.Default()
+	}
+	logx.SetLevels(opts.LogLevel)
+
+	s := pool.NewSupervisor(*opts)
+	s.SetLogger(logger)
+	s.SetEvents(pool.Events{
+		SessionStart:  cfg.OnSessionStart,
+		SessionEnd:    cfg.OnSessionEnd,
+		SessionFailed: cfg.OnSessionFailed,
+	})
+	for _, i := range cfg.Interceptors {
+		s.AddInterceptor(i)
+	}
+	return &Pool{supervisor: s, opts: opts}, nil
+}
+
+// Run connects the workers and serves the hub until ctx is cancelled, the
+// pool expires or the hub shuts it down. It returns ctx's error in the
+// first case, and ErrExpired or ErrRemoteShutdown in the others.
+func (p *Pool) Run(ctx context.Context) error {
+	return p.supervisor.Run(ctx)
+}
+
+// Drain stops taking new sessions: idle workers disconnect and busy ones
+// finish their session first. Cancel Run's context to close what is left,
+// after DrainTimeout as poolgo does or whenever suits.
+func (p *Pool) Drain() {
+	p.supervisor.Drain()
+}
+
+// DrainTimeout returns --drain-timeout, how long poolgo lets sessions
+// finish after Drain before it closes them; 0 closes them at once.
+func (p *Pool) DrainTimeout() time.Duration {
+	return p.opts.DrainTimeout
+}
+
+// Reload parses args as New does and applies what it can to the running
+// pool, as poolgo does on SIGHUP. Settings that need a restart keep their
+// running values and are logged. On error the running configuration is
+// kept.
+func (p *Pool) Reload(args []string) error {
+	opts, err := pool.ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	return p.supervisor.Reload(*opts)
+}
+
+// A Transport carries workers' connections to the hub; see
+// RegisterTransport.
+type (
+	Transport       = transport.Transport
+	TransportConfig = transport.Config
+	TransportConn   = transport.Session
+	// TransportFactory builds a transport for the hub link. It is called
+	// again whenever the link's settings change, and the transport it
+	// replaced is closed once no worker uses it.
+	TransportFactory = transport.Factory
+)
+
+// RegisterTransport makes a transport available as --transport name, next
+// to the built-in tcp and quic. Register before New parses Args naming it,
+// typically from an init function. It panics if name is empty or taken.
+func RegisterTransport(name string, factory TransportFactory) {
+	transport.Register(name, factory)
+}
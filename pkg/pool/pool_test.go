@@ -0,0 +1,79 @@
+package pool_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"contun/pkg/pool"
+	"contun/pkg/pooltest"
+)
+
+// denyDB is an interceptor that keeps the pool off port 5432.
+type denyDB struct{ pool.NopInterceptor }
+
+func (denyDB) OnRequest(_ context.Context, req pool.Request) (pool.Decision, error) {
+	return pool.Decision{Deny: req.Port == 5432, Reason: "no databases"}, nil
+}
+
+func TestPool(t *testing.T) {
+	hub, target := pooltest.NewHub(t), pooltest.NewTarget(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	started, ended, failed := make(chan pool.SessionInfo, 1), make(chan pool.SessionInfo, 1), make(chan pool.SessionInfo, 1)
+	p, err := pool.New(pool.Config{
+		Args: []string{"--mode", "socks", "--workers", "1", "--retry-delay", "0.01",
+			"--hub-host", hub.Host(), "--hub-port", strconv.Itoa(hub.Port())},
+		Logger:          log.New(io.Discard, "", 0),
+		OnSessionStart:  func(s pool.SessionInfo) { started <- s },
+		OnSessionEnd:    func(s pool.SessionInfo) { ended <- s },
+		OnSessionFailed: func(s pool.SessionInfo) { failed <- s },
+		Interceptors:    []pool.Interceptor{denyDB{}},
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+
+	err = hub.Play(ctx,
+		pooltest.Request{Host: target.Host(), Port: refused, Status: 5},
+		pooltest.Request{Host: target.Host(), Port: 5432, Status: 2},
+		pooltest.Request{Host: target.Host(), Port: target.Port(), Send: "hello", Expect: "hello"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := <-failed; s.Port != refused || s.Status != 5 || s.Err == nil {
+		t.Errorf("OnSessionFailed got %+v", s)
+	}
+	if s := <-started; s.Host != target.Host() || s.Port != target.Port() || s.Started.IsZero() {
+		t.Errorf("OnSessionStart got %+v", s)
+	}
+	if s := <-ended; s.BytesOut != 5 || s.BytesIn != 5 || s.Reason == "" {
+		t.Errorf("OnSessionEnd got %+v", s)
+	}
+
+	if err := p.Reload([]string{"--workers", "0"}); err == nil {
+		t.Error("Reload accepted invalid arguments")
+	}
+	cancel()
+	if err := <-ran; err != context.Canceled && err != context.DeadlineExceeded {
+		t.Fatalf("Run = %v", err)
+	}
+
+	if _, err := pool.New(pool.Config{Args: []string{"--no-such-flag"}}); err == nil {
+		t.Fatal("New accepted an unknown flag")
+	}
+}
@@ -0,0 +1,366 @@
+// Package pooltest provides test doubles for code that embeds or drives a
+// contun pool: a fake hub that accepts workers and sends them requests, a
+// fake target that echoes and records what reaches it, and Play, which
+// runs a scripted sequence of requests and checks each outcome.
+//
+// The fake hub speaks control protocol version 1. It hangs up on a worker
+// that offers a newer version, as a version 1 hub does, and a pool left to
+// pick its protocol falls back to 1 and dials again.
+//
+//	hub, target := pooltest.NewHub(t), pooltest.NewTarget(t)
+//	// start the pool against hub.Port() in socks mode
+//	err := hub.Play(ctx,
+//		pooltest.Request{Host: "127.0.0.1", Port: target.Port(), Send: "ping", Expect: "ping"},
+//		pooltest.Request{Host: "db.invalid", Port: 5432, Status: 4},
+//	)
+package pooltest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hub is a fake hub listening on the loopback interface.
+type Hub struct {
+	// Caps lists the capabilities the hub accepts when a worker offers
+	// them; it accepts none when empty. Set it before workers connect.
+	Caps []string
+
+	ln net.Listener
+
+	// idle is the worker Play keeps between requests that did not start
+	// a bridge.
+	idle *Worker
+}
+
+// NewHub starts a fake hub that tb's cleanup stops.
+func NewHub(tb testing.TB) *Hub {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("pooltest: listen: %v", err)
+	}
+	h := &Hub{ln: ln}
+	tb.Cleanup(func() { h.Close() })
+	return h
+}
+
+// Host returns the address workers dial, for --hub-host.
+func (h *Hub) Host() string { return "127.0.0.1" }
+
+// Port returns the port workers dial, for --hub-port.
+func (h *Hub) Port() int { return h.ln.Addr().(*net.TCPAddr).Port }
+
+// Close stops accepting workers and hangs up on the idle one Play kept.
+func (h *Hub) Close() error {
+	if h.idle != nil {
+		h.idle.Close()
+		h.idle = nil
+	}
+	return h.ln.Close()
+}
+
+// Accept waits for the next worker and completes its handshake.
+func (h *Hub) Accept(ctx context.Context) (*Worker, error) {
+	ln := h.ln.(*net.TCPListener)
+	stop := context.AfterFunc(ctx, func() { ln.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		if !stop() {
+			ln.SetDeadline(time.Time{})
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		w, err := h.handshake(ctx, conn)
+		if err != nil {
+			conn.Close()
+			if errors.Is(err, errNewerProtocol) {
+				continue
+			}
+			return nil, err
+		}
+		return w, nil
+	}
+}
+
+// errNewerProtocol is a HELLO for a protocol version the fake hub does not
+// speak.
+var errNewerProtocol = errors.New("pooltest: worker offered a newer protocol")
+
+func (h *Hub) handshake(ctx context.Context, conn net.Conn) (*Worker, error) {
+	w := &Worker{conn: conn, reader: bufio.NewReader(conn)}
+	line, err := w.ReadLine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "HELLO" {
+		return nil, fmt.Errorf("pooltest: unexpected handshake %q", line)
+	}
+	if fields[1] != "1" {
+		return nil, errNewerProtocol
+	}
+	w.Hello, w.Mode = line, fields[2]
+	rest := fields[3:]
+	if len(rest) >= 4 && rest[0] == "DEST" {
+		w.Dest, rest = strings.Join(rest[1:4], " "), rest[4:]
+	}
+	if len(rest) == 2 && rest[0] == "CAPS" {
+		for _, c := range strings.Split(rest[1], ",") {
+			if c == "" {
+				continue
+			}
+			w.Offered = append(w.Offered, c)
+			if slices.Contains(h.Caps, c) {
+				w.Accepted = append(w.Accepted, c)
+			}
+		}
+	}
+	answer := "OK"
+	if len(w.Accepted) > 0 {
+		answer += " CAPS " + strings.Join(w.Accepted, ",")
+	}
+	if err := w.Send(answer); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Worker is one worker connection the fake hub accepted. Once Connect
+// returns status 0 the connection carries the bridged stream: Read, Write
+// and CloseWrite reach the target through the worker.
+type Worker struct {
+	Hello    string   // the HELLO line as sent
+	Mode     string   // direct or socks
+	Dest     string   // "<atype> <addr> <port>" declared in direct mode
+	Offered  []string // capabilities the worker offered
+	Accepted []string // those the hub accepted
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Send writes one control line.
+func (w *Worker) Send(line string) error {
+	_, err := io.WriteString(w.conn, line+"\n")
+	return err
+}
+
+// ReadLine reads one control line, without its line ending.
+func (w *Worker) ReadLine(ctx context.Context) (string, error) {
+	stop := context.AfterFunc(ctx, func() { w.conn.SetReadDeadline(time.Unix(1, 0)) })
+	line, err := w.reader.ReadString('\n')
+	if !stop() {
+		w.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Reply is a worker's answer to a REQUEST.
+type Reply struct {
+	Status int
+	Addr   string
+	Port   int
+}
+
+// Connect sends REQUEST CONNECT for host:port and waits for the REPLY.
+func (w *Worker) Connect(ctx context.Context, host string, port int) (Reply, error) {
+	atype := "domain"
+	if ip, err := netip.ParseAddr(host); err == nil {
+		atype = "ipv4"
+		if ip.Is6() {
+			atype = "ipv6"
+		}
+	}
+	if err := w.Send(fmt.Sprintf("REQUEST CONNECT %s %s %d", atype, host, port)); err != nil {
+		return Reply{}, err
+	}
+	line, err := w.ReadLine(ctx)
+	if err != nil {
+		return Reply{}, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "REPLY" {
+		return Reply{}, fmt.Errorf("pooltest: unexpected reply %q", line)
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Reply{}, fmt.Errorf("pooltest: unexpected reply %q", line)
+	}
+	bound, _ := strconv.Atoi(fields[4])
+	return Reply{Status: status, Addr: fields[3], Port: bound}, nil
+}
+
+func (w *Worker) Read(p []byte) (int, error)  { return w.reader.Read(p) }
+func (w *Worker) Write(p []byte) (int, error) { return w.conn.Write(p) }
+
+// CloseWrite ends the stream towards the target.
+func (w *Worker) CloseWrite() error { return w.conn.(*net.TCPConn).CloseWrite() }
+
+// Close hangs up on the worker.
+func (w *Worker) Close() error { return w.conn.Close() }
+
+// Request is one step of a script for Play: a CONNECT and what should come
+// of it.
+type Request struct {
+	Host string
+	Port int
+
+	// Status is the REPLY status expected; 0 for a bridged stream.
+	Status int
+
+	// Send is written to a bridged stream, which is then half-closed, and
+	// Expect is what must come back before the target closes its side.
+	Send   string
+	Expect string
+}
+
+// Play runs requests in order, each on an idle worker, and returns the
+// first that did not turn out as scripted. A worker refused a request can
+// take the next one; a bridged stream uses its connection up, so the next
+// request waits for a new worker.
+func (h *Hub) Play(ctx context.Context, requests ...Request) error {
+	for i, req := range requests {
+		if err := h.play(ctx, req); err != nil {
+			return fmt.Errorf("pooltest: request %d (%s): %w", i+1, net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), err)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) play(ctx context.Context, req Request) error {
+	w := h.idle
+	h.idle = nil
+	if w == nil {
+		var err error
+		if w, err = h.Accept(ctx); err != nil {
+			return err
+		}
+	}
+	reply, err := w.Connect(ctx, req.Host, req.Port)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if reply.Status != req.Status {
+		w.Close()
+		return fmt.Errorf("REPLY status %d, want %d", reply.Status, req.Status)
+	}
+	if reply.Status != 0 {
+		h.idle = w
+		return nil
+	}
+	defer w.Close()
+	stop := context.AfterFunc(ctx, func() { w.conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	if _, err := io.WriteString(w, req.Send); err != nil {
+		return err
+	}
+	if err := w.CloseWrite(); err != nil {
+		return err
+	}
+	got, err := io.ReadAll(w)
+	if err != nil {
+		return err
+	}
+	if string(got) != req.Expect {
+		return fmt.Errorf("stream returned %q, want %q", got, req.Expect)
+	}
+	return nil
+}
+
+// Target is a fake target on the loopback interface. It echoes what each
+// connection sends until that side closes, and records it.
+type Target struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	accepted int
+	received []byte
+}
+
+// NewTarget starts a fake target that tb's cleanup stops.
+func NewTarget(tb testing.TB) *Target {
+	tb.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("pooltest: listen: %v", err)
+	}
+	t := &Target{ln: ln}
+	tb.Cleanup(func() { ln.Close() })
+	go t.serve()
+	return t
+}
+
+func (t *Target) serve() {
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		t.accepted++
+		t.mu.Unlock()
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 32*1024)
+			for {
+				n, err := conn.Read(buf)
+				if n > 0 {
+					t.mu.Lock()
+					t.received = append(t.received, buf[:n]...)
+					t.mu.Unlock()
+					if _, err := conn.Write(buf[:n]); err != nil {
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Host returns the target's address.
+func (t *Target) Host() string { return "127.0.0.1" }
+
+// Port returns the target's port.
+func (t *Target) Port() int { return t.ln.Addr().(*net.TCPAddr).Port }
+
+// Accepted returns how many connections reached the target.
+func (t *Target) Accepted() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.accepted
+}
+
+// Received returns everything the target has read, across connections.
+func (t *Target) Received() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.received)
+}
@@ -0,0 +1,79 @@
+package pooltest
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"contun/internal/pool"
+)
+
+func TestPlay(t *testing.T) {
+	hub, target := NewHub(t), NewTarget(t)
+	hub.Caps = []string{"cancel"}
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	deny, _ := pool.ParseACLRule("10.9.9.9")
+
+	s := pool.NewSupervisor(pool.Options{
+		Mode: pool.ModeSocks, Workers: 1, RetryDelay: 10 * time.Millisecond,
+		HubHost: hub.Host(), HubPort: hub.Port(), Deny: []pool.ACLRule{deny},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go s.Run(ctx)
+
+	err = hub.Play(ctx,
+		Request{Host: target.Host(), Port: refused, Status: 5},
+		Request{Host: "10.9.9.9", Port: 22, Status: 2},
+		Request{Host: target.Host(), Port: target.Port(), Send: "hello", Expect: "hello"},
+		Request{Host: "localhost", Port: target.Port(), Send: "again", Expect: "again"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target.Accepted() != 2 || string(target.Received()) != "helloagain" {
+		t.Fatalf("target saw %d connections and %q", target.Accepted(), target.Received())
+	}
+
+	err = hub.Play(ctx, Request{Host: target.Host(), Port: refused})
+	if err == nil {
+		t.Fatal("Play accepted a refused CONNECT scripted to succeed")
+	}
+}
+
+func TestAcceptHandshake(t *testing.T) {
+	hub := NewHub(t)
+	hub.Caps = []string{"cancel", "progress"}
+	for _, hello := range []string{"HELLO 2 socks CAPS cancel", "HELLO 1 direct DEST ipv4 10.0.0.5 22 CAPS cancel,udp"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(hub.Host(), strconv.Itoa(hub.Port())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, hello+"\n")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w, err := hub.Accept(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.Mode != "direct" || w.Dest != "ipv4 10.0.0.5 22" || len(w.Offered) != 2 || len(w.Accepted) != 1 || w.Accepted[0] != "cancel" {
+		t.Fatalf("worker %+v", w)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	if _, err := hub.Accept(short); err != context.DeadlineExceeded {
+		t.Fatalf("Accept without workers = %v", err)
+	}
+}
@@ -78,7 +78,14 @@ with socketserver.ThreadingTCPServer(("127.0.0.1", PORT), Handler) as httpd:
 PY
 SERVER_PID=$!
 
-perl "${REPO_ROOT}/hub.pl" \
+# shellcheck disable=SC2206
+if [[ -n "${HUB_BIN:-}" ]]; then
+  read -r -a HUB_CMD <<<"${HUB_BIN}"
+else
+  HUB_CMD=(perl "${REPO_ROOT}/hub.pl")
+fi
+
+"${HUB_CMD[@]}" \
   --client-bind 127.0.0.1 \
   --client-port "${CLIENT_PORT}" \
   --pool-bind 127.0.0.1 \